@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Services with acme-domains terminate their clients' TLS (like with
+// tls-cert) with certs obtained and renewed from an ACME CA (Let's Encrypt
+// unless acme-directory says otherwise) by autocert. The CA validates each
+// domain with a TLS-ALPN-01 challenge answered on the service's addr (which it
+// must reach on port 443) or, with acme-http-addr, an HTTP-01 challenge
+// answered there (which it must reach on port 80). The certs and the ACME
+// account key are cached in acme-cache so they survive restarts.
+
+var (
+	// acmeCacheDir is the dir the certs and account key are cached in (blank
+	// means tunnelit/acme in the user's cache dir).
+	acmeCacheDir string
+	// acmeEmail is the contact email of the ACME account (blank means none).
+	acmeEmail string
+	// acmeDirectory is the ACME CA's directory URL (blank means Let's
+	// Encrypt's).
+	acmeDirectory string
+	// acmeHTTPAddr is the address HTTP-01 challenges are answered on (blank
+	// means they aren't).
+	acmeHTTPAddr string
+	// clientACMEDomains are the domains the default service's certs are
+	// obtained for (see ServiceConfig.ACMEDomains).
+	clientACMEDomains []string
+
+	// acmeManager obtains and renews the certs of all the services.
+	acmeManager *autocert.Manager
+)
+
+var errACMEChallenge = errors.New("answered ACME challenge")
+
+// setupACME sets up obtaining certs with ACME, which must succeed if any of
+// the config's services use it.
+func setupACME(cfg *Config) error {
+	usesACME := false
+	for _, sc := range cfg.Services {
+		usesACME = usesACME || len(sc.ACMEDomains) != 0
+	}
+	dir := acmeCacheDir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil && usesACME {
+			return fmt.Errorf(`error finding ACME cache (pass "acme-cache"): %w`, err)
+		} else if err == nil {
+			dir = filepath.Join(cacheDir, "tunnelit", "acme")
+		}
+	}
+	acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: acmeHostPolicy,
+		Email:      acmeEmail,
+	}
+	if dir != "" {
+		acmeManager.Cache = autocert.DirCache(dir)
+	}
+	if acmeDirectory != "" {
+		acmeManager.Client = &acme.Client{DirectoryURL: acmeDirectory}
+	}
+	if acmeHTTPAddr == "" {
+		return nil
+	}
+	ln, err := listen(acmeHTTPAddr)
+	if err != nil {
+		return fmt.Errorf("error starting ACME HTTP listener: %w", err)
+	}
+	log.Print("Answering ACME HTTP challenges on ", ln.Addr())
+	go func() {
+		// Requests other than challenges are redirected to HTTPS
+		log.Fatal("Error serving ACME HTTP challenges: ", http.Serve(
+			ln, acmeManager.HTTPHandler(nil),
+		))
+	}()
+	return nil
+}
+
+// acmeHostPolicy only allows certs for the services' ACME domains.
+func acmeHostPolicy(_ context.Context, host string) error {
+	for _, svc := range allServices() {
+		if slices.ContainsFunc(svc.config().ACMEDomains, func(d string) bool {
+			return strings.EqualFold(d, host)
+		}) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q isn't any service's ACME domain", host)
+}
+
+// acmeChallengeConfig returns the config answering the client hello if it's
+// the CA's TLS-ALPN-01 challenge (nil if it isn't).
+func acmeChallengeConfig(hello *tls.ClientHelloInfo) *tls.Config {
+	if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return nil
+	}
+	return &tls.Config{
+		NextProtos:     []string{acme.ALPNProto},
+		GetCertificate: acmeManager.GetCertificate,
+	}
+}
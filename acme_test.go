@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeACMECache writes a cert for the domain to the dir as autocert caches
+// them. It's valid long enough not to be renewed.
+func writeACMECache(t *testing.T, dir, domain string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := os.WriteFile(filepath.Join(dir, domain), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTerminateClientTLSWithACME(t *testing.T) {
+	dir := t.TempDir()
+	writeACMECache(t, dir, "app.example.com")
+	oldCache, oldDirectory, oldManager := acmeCacheDir, acmeDirectory, acmeManager
+	oldServices := services
+	t.Cleanup(func() {
+		acmeCacheDir, acmeDirectory, acmeManager = oldCache, oldDirectory, oldManager
+		services = oldServices
+	})
+	// Never reached, since the cert is cached and other domains are refused
+	acmeCacheDir, acmeDirectory = dir, "http://127.0.0.1:1/directory"
+
+	sc := &ServiceConfig{ACMEDomains: []string{"app.example.com"}}
+	cfg := &Config{Services: map[string]*ServiceConfig{"app": sc}}
+	if err := setupACME(cfg); err != nil {
+		t.Fatal("error setting up ACME: ", err)
+	}
+	svc := &service{name: "app"}
+	svc.cfg.Store(sc)
+	services = map[string]*service{"app": svc}
+
+	tests := []struct {
+		serverName string
+		// ok is whether the handshake succeeds.
+		ok bool
+	}{
+		{serverName: "app.example.com", ok: true},
+		{serverName: "APP.example.com", ok: true},
+		{serverName: "other.example.com"},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		clientErr := make(chan error, 1)
+		var peer *x509.Certificate
+		go func() {
+			tc := tls.Client(c1, &tls.Config{
+				ServerName: tt.serverName, InsecureSkipVerify: true,
+			})
+			err := tc.Handshake()
+			if err == nil {
+				peer = tc.ConnectionState().PeerCertificates[0]
+			}
+			c1.Close()
+			clientErr <- err
+		}()
+		conn, err := svc.terminateClientTLS(c2)
+		cerr := <-clientErr
+		c2.Close()
+		if !tt.ok {
+			if err == nil || cerr == nil {
+				t.Errorf("%s: expected handshake to fail", tt.serverName)
+			}
+			continue
+		} else if err != nil || cerr != nil {
+			t.Errorf("%s: handshake failed: %v (client: %v)", tt.serverName, err, cerr)
+			continue
+		}
+		if _, ok := conn.(*terminatedConn); !ok {
+			t.Errorf("%s: expected terminated conn, got %T", tt.serverName, conn)
+		} else if peer.Subject.CommonName != "app.example.com" {
+			t.Errorf("%s: expected cached cert, got %s", tt.serverName, peer.Subject)
+		}
+	}
+}
+
+func TestACMEConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		sc   ServiceConfig
+		// wantErr is whether the config is invalid.
+		wantErr bool
+	}{
+		{name: "acme domains", sc: ServiceConfig{ACMEDomains: []string{"a.example.com"}}},
+		{
+			name: "acme with alpn",
+			sc: ServiceConfig{
+				ACMEDomains: []string{"a.example.com"}, ALPN: []string{"http/1.1"},
+			},
+		},
+		{
+			name: "acme with tls-cert",
+			sc: ServiceConfig{
+				ACMEDomains: []string{"a.example.com"}, TLSCert: "c.pem", TLSKey: "k.pem",
+			},
+			wantErr: true,
+		},
+		{name: "alpn without tls", sc: ServiceConfig{ALPN: []string{"h2"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		sc := tt.sc
+		sc.Addr = "127.0.0.1:0"
+		cfg := &Config{Services: map[string]*ServiceConfig{"svc": &sc}}
+		if err := cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	adminAddr string
+	// draining is whether new tunnel conns are refused (set through the admin
+	// API), letting the pool drain as clients use it.
+	draining atomic.Bool
+)
+
+func runAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tokens", handleTokens)
+	mux.HandleFunc("/tokens/", handleToken)
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/tags", handleTags)
+	mux.HandleFunc("/rates", handleRates)
+	mux.HandleFunc("/talkers", handleTalkers)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/dump", handleDump)
+	mux.HandleFunc("/drain", handleDrain)
+	mux.HandleFunc("/pipes", handlePipes)
+	mux.HandleFunc("/pipes/", handlePipeCapture)
+	mux.HandleFunc("/requests", handleRequests)
+	mux.HandleFunc("/requests/", handleRequest)
+	// The inspector's page holds no data, so it's served to anyone (and the
+	// API it uses is authenticated)
+	root := http.NewServeMux()
+	root.Handle("/", authAdmin(mux))
+	root.HandleFunc("/inspector", handleInspectorUI)
+
+	ln, err := net.Listen(tcpNetwork, addr)
+	if err != nil {
+		log.Fatal("Error starting admin listener: ", err)
+	}
+	if err := checkAdminListener(ln.Addr()); err != nil {
+		log.Fatal(err)
+	}
+	log.Print("Listening for admin requests on ", addr)
+	srvr := &http.Server{
+		Handler:           root,
+		ReadHeaderTimeout: idleTimeout,
+		ReadTimeout:       adminReadTimeout,
+		WriteTimeout:      adminWriteTimeout,
+		IdleTimeout:       adminIdleTimeout,
+	}
+	if err := srvr.Serve(ln); err != nil {
+		log.Fatal("Error running admin server: ", err)
+	}
+}
+
+const (
+	// adminReadTimeout is how long an admin request (with its body) may take
+	// to read.
+	adminReadTimeout = 30 * time.Second
+	// adminWriteTimeout is how long an admin request may take to answer
+	// (e.g., replaying a request through a tunnel).
+	adminWriteTimeout = time.Minute
+	// adminIdleTimeout is how long an admin client's idle conn is kept.
+	adminIdleTimeout = 2 * time.Minute
+)
+
+// checkAdminListener returns an error if the admin API would be
+// unauthenticated on a non-loopback address (with no admin tokens).
+func checkAdminListener(addr net.Addr) error {
+	if len(adminTokens.Load()) != 0 {
+		return nil
+	} else if ip := addrIP(addr); ip == nil || !ip.IsLoopback() {
+		return errors.New(
+			`"admin-addr" must be a loopback address unless admin tokens are configured`,
+		)
+	}
+	log.Print("WARNING: admin API has no tokens configured and only accepts local requests")
+	return nil
+}
+
+// handleTokens handles listing (GET) and creating (POST) tokens.
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Don't expose the hashes
+		type tokenInfo struct {
+			Name    string      `json:"name"`
+			Created time.Time   `json:"created"`
+			Rotated time.Time   `json:"rotated"`
+			Limits  TokenLimits `json:"limits"`
+		}
+		toks := state.ListTokens()
+		infos := make([]tokenInfo, len(toks))
+		for i, tok := range toks {
+			infos[i] = tokenInfo{
+				Name: tok.Name, Created: tok.Created, Rotated: tok.Rotated,
+				Limits: tok.Limits,
+			}
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+			TokenLimits
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "Missing token name", http.StatusBadRequest)
+			return
+		}
+		if req.MaxConns < 0 || req.MaxBandwidth < 0 || req.MaxServices < 0 {
+			http.Error(w, "Limits must not be negative", http.StatusBadRequest)
+			return
+		}
+		secret, err := state.CreateToken(req.Name, req.TokenLimits)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Created token %q", req.Name)
+		go warmVerifierKeys()
+		writeJSON(w, http.StatusCreated, map[string]string{
+			"name":  req.Name,
+			"token": secret,
+		})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleToken handles revoking (DELETE) a token by name, or rotating its
+// secret (POST to /tokens/{name}/rotate).
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/tokens/")
+	if strings.HasSuffix(name, "/rotate") {
+		handleRotateToken(w, r, strings.TrimSuffix(name, "/rotate"))
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ok, err := state.RevokeToken(name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	log.Printf(
+		"Revoked token %q, closing %d idle conns (established pipes are kept)",
+		name, closeTokenIdle(name),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRotateToken handles replacing a token's secret. The grace query
+// parameter is how long the old secret is still accepted (default 0), giving
+// time to move tunnels to the new one. Established pipes are unaffected.
+func handleRotateToken(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var grace time.Duration
+	if s := r.URL.Query().Get("grace"); s != "" {
+		var err error
+		if grace, err = time.ParseDuration(s); err != nil || grace < 0 {
+			http.Error(
+				w, "grace must be a non-negative duration", http.StatusBadRequest,
+			)
+			return
+		}
+	}
+	secret, ok, err := state.RotateToken(name, grace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Rotated token %q (old secret accepted for %s)", name, grace)
+	go warmVerifierKeys()
+	writeJSON(w, http.StatusOK, map[string]string{
+		"name":  name,
+		"token": secret,
+	})
+}
+
+// handleStats handles getting the live stats for each service.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, serviceStats())
+}
+
+// handleDrain handles getting (GET), starting (POST), and stopping (DELETE)
+// draining.
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !draining.Swap(true) {
+			log.Print("Draining, refusing new tunnel conns")
+		}
+	case http.MethodDelete:
+		if draining.Swap(false) {
+			log.Print("Stopped draining, accepting tunnel conns")
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": draining.Load()})
+}
+
+// handleTags handles getting the stats for each tag.
+func handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, allTagStats())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
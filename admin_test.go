@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setAdminTokens sets the admin tokens for the test.
+func setAdminTokens(t *testing.T, tokens map[string]string) {
+	t.Helper()
+	var ats []*AdminToken
+	for token, role := range tokens {
+		hash := sha256.Sum256([]byte(token))
+		at := &AdminToken{Name: role, Hash: hex.EncodeToString(hash[:]), Role: role}
+		if err := at.parse(); err != nil {
+			t.Fatal(err)
+		}
+		ats = append(ats, at)
+	}
+	old, _ := adminTokens.LoadSafe()
+	adminTokens.Store(ats)
+	t.Cleanup(func() { adminTokens.Store(old) })
+}
+
+func TestAuthAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     map[string]string
+		method     string
+		remoteAddr string
+		token      string
+		want       int
+	}{
+		{
+			name: "no tokens, loopback", method: http.MethodPost,
+			remoteAddr: "127.0.0.1:1234", want: http.StatusOK,
+		},
+		{
+			name: "no tokens, IPv6 loopback", method: http.MethodGet,
+			remoteAddr: "[::1]:1234", want: http.StatusOK,
+		},
+		{
+			name: "no tokens, remote", method: http.MethodGet,
+			remoteAddr: "192.0.2.1:1234", want: http.StatusForbidden,
+		},
+		{
+			name: "missing token", tokens: map[string]string{"op": roleOperator},
+			method: http.MethodGet, remoteAddr: "127.0.0.1:1234",
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong token", tokens: map[string]string{"op": roleOperator},
+			method: http.MethodGet, remoteAddr: "192.0.2.1:1234", token: "other",
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "operator", tokens: map[string]string{"op": roleOperator},
+			method: http.MethodPost, remoteAddr: "192.0.2.1:1234", token: "op",
+			want: http.StatusOK,
+		},
+		{
+			name: "read-only GET", tokens: map[string]string{"ro": roleReadOnly},
+			method: http.MethodGet, remoteAddr: "192.0.2.1:1234", token: "ro",
+			want: http.StatusOK,
+		},
+		{
+			name: "read-only POST", tokens: map[string]string{"ro": roleReadOnly},
+			method: http.MethodPost, remoteAddr: "192.0.2.1:1234", token: "ro",
+			want: http.StatusForbidden,
+		},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAdminTokens(t, tt.tokens)
+			r := httptest.NewRequest(tt.method, "/stats", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			authAdmin(ok).ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestCheckAdminListener(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens map[string]string
+		addr   string
+		ok     bool
+	}{
+		{name: "loopback", addr: "127.0.0.1:8000", ok: true},
+		{name: "IPv6 loopback", addr: "[::1]:8000", ok: true},
+		{name: "all interfaces", addr: "0.0.0.0:8000"},
+		{name: "public", addr: "192.0.2.1:8000"},
+		{
+			name: "public with tokens", tokens: map[string]string{"op": roleOperator},
+			addr: "0.0.0.0:8000", ok: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAdminTokens(t, tt.tokens)
+			addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkAdminListener(addr); (err == nil) != tt.ok {
+				t.Fatalf("expected ok %v, got error %v", tt.ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/johnietre/utils/go"
+)
+
+// Admin API roles.
+const (
+	// roleReadOnly may only make GET (and HEAD) requests.
+	roleReadOnly = "read-only"
+	// roleOperator may make any request.
+	roleOperator = "operator"
+)
+
+const adminTokenEnvName = "TUNNELIT_ADMIN_TOKEN"
+
+// AdminToken is a bearer token that grants access to the admin API.
+type AdminToken struct {
+	Name string `json:"name"`
+	// Hash is the hex-encoded SHA-256 hash of the token.
+	Hash string `json:"hash"`
+	// Role is either "read-only" or "operator".
+	Role string `json:"role"`
+
+	hash []byte
+}
+
+// adminTokens are the tokens accepted by the admin API. If there are none,
+// the admin API only accepts requests from loopback addresses.
+var adminTokens utils.AValue[[]*AdminToken]
+
+func (at *AdminToken) parse() error {
+	if at.Role != roleReadOnly && at.Role != roleOperator {
+		return fmt.Errorf(
+			"invalid role %q (must be %q or %q)", at.Role, roleReadOnly, roleOperator,
+		)
+	}
+	hash, err := hex.DecodeString(at.Hash)
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("invalid hash (must be a hex-encoded SHA-256 hash)")
+	}
+	at.hash = hash
+	return nil
+}
+
+// tokenRole returns the role granted by the given token, if any.
+func tokenRole(token string) (string, bool) {
+	hash := sha256.Sum256([]byte(token))
+	for _, at := range adminTokens.Load() {
+		if subtle.ConstantTimeCompare(hash[:], at.hash) == 1 {
+			return at.Role, true
+		}
+	}
+	return "", false
+}
+
+// authAdmin requires requests to have a bearer token with a role permitting
+// the request. Without tokens, only requests from loopback addresses are let
+// through (e.g., if the tokens were removed from the config since starting).
+func authAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(adminTokens.Load()) == 0 {
+			ip := addrIP(addrFromString(r.RemoteAddr))
+			if ip == nil || !ip.IsLoopback() {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		role, ok := tokenRole(strings.TrimPrefix(auth, "Bearer "))
+		if !ok || !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if role != roleOperator &&
+			r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/argon2"
+)
+
+var (
+	// requireChallenge is whether the proxy rejects tunnels that send their
+	// password hash rather than answering a challenge.
+	requireChallenge bool
+	// legacyAuth is whether the tunnel sends its password hash rather than
+	// answering the proxy's challenge (for proxies that don't support them).
+	legacyAuth bool
+	// passwordVerifierStr is the verifier the proxy checks the password
+	// against rather than its hash (blank means the hash).
+	passwordVerifierStr string
+	// passwordVerifier is the parsed passwordVerifierStr (nil if none).
+	passwordVerifier *pwdVerifier
+)
+
+// verifierScheme prefixes password verifiers.
+const verifierScheme = "argon2id"
+
+// pwdVerifier is a salted password verifier (see tunnelit.VerifierKeys),
+// which, unlike the password hash, is slow to brute-force and can't be used to
+// authenticate if leaked. It's formatted like a PHC string:
+// "argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<base64 salt>$<base64 stored key>".
+type pwdVerifier struct {
+	params    tunnelit.VerifierParams
+	storedKey [sha256.Size]byte
+}
+
+// newPasswordVerifier creates a verifier for the password hash with the
+// params.
+func newPasswordVerifier(
+	pwdHash [sha256.Size]byte, params tunnelit.VerifierParams,
+) *pwdVerifier {
+	_, storedKey := tunnelit.VerifierKeys(pwdHash, params)
+	return &pwdVerifier{params: params, storedKey: storedKey}
+}
+
+// parsePasswordVerifier parses a verifier formatted by pwdVerifier.String.
+func parsePasswordVerifier(s string) (*pwdVerifier, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 5 || parts[0] != verifierScheme {
+		return nil, fmt.Errorf(
+			"expected %s$v=%d$m=<memory>,t=<time>,p=<threads>$<salt>$<stored key>",
+			verifierScheme, argon2.Version,
+		)
+	} else if parts[1] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, fmt.Errorf("unsupported argon2 version: %s", parts[1])
+	}
+	v := &pwdVerifier{}
+	var threads uint8
+	_, err := fmt.Sscanf(
+		parts[2], "m=%d,t=%d,p=%d", &v.params.Memory, &v.params.Time, &threads,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid params: %s", parts[2])
+	}
+	v.params.Threads = threads
+	if err := v.params.Validate(); err != nil {
+		return nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(salt) != tunnelit.SaltSize {
+		return nil, fmt.Errorf("salt must be %d bytes of base64", tunnelit.SaltSize)
+	}
+	copy(v.params.Salt[:], salt)
+	key, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) != sha256.Size {
+		return nil, fmt.Errorf("stored key must be %d bytes of base64", sha256.Size)
+	}
+	copy(v.storedKey[:], key)
+	return v, nil
+}
+
+func (v *pwdVerifier) String() string {
+	return fmt.Sprintf(
+		"%s$v=%d$m=%d,t=%d,p=%d$%s$%s", verifierScheme, argon2.Version,
+		v.params.Memory, v.params.Time, v.params.Threads,
+		base64.RawStdEncoding.EncodeToString(v.params.Salt[:]),
+		base64.RawStdEncoding.EncodeToString(v.storedKey[:]),
+	)
+}
+
+// challengeParams returns the params sent with challenges, which are zeros
+// without a verifier.
+func (v *pwdVerifier) challengeParams() []byte {
+	if v == nil {
+		return make([]byte, tunnelit.VerifierParamsSize)
+	}
+	return v.params.Append(nil)
+}
+
+// passwordMatches returns whether the credential is for the proxy password,
+// checking the verifier's proof if the proxy has one and the password hash
+// otherwise (see authMatches).
+func passwordMatches(cred, nonce, proof []byte) bool {
+	if v := passwordVerifier; v != nil {
+		return proof != nil && tunnelit.ProofVerifies(v.storedKey, nonce, proof)
+	}
+	return authMatches(cred, nonce, nil, passwordHash.Load())
+}
+
+// readCredential reads the tunnel's credential, challenging the tunnel if it
+// asks to be. The nonce is nil if the tunnel sent its password hash instead,
+// which is followed by its registration (returned encoded) if the tunnel sent
+// tunnelit.HashRequest first, or by nothing if the tunnel predates
+// registrations.
+// If the proxy has a password verifier and the tunnel asked for a version 2
+// challenge, the tunnel sends only the proof (see tunnelit.VerifierProof)
+// and the credential is left zero. If the tunnel asked the proxy to prove its
+// identity first (see tunnelit.IdentityRequest), the registration it sent
+// with the request is returned (encoded) after sending the proof; otherwise,
+// it's nil and is read after.
+func readCredential(conn net.Conn) (
+	cred [sha256.Size]byte, nonce, proof, regMsg []byte, err error,
+) {
+	if _, err := io.ReadFull(conn, cred[:]); err != nil {
+		return cred, nil, nil, nil, err
+	}
+	req := string(cred[:])
+	if req == tunnelit.HashRequest {
+		if _, err := io.ReadFull(conn, cred[:]); err != nil {
+			return cred, nil, nil, nil, err
+		}
+		regMsg, err = tunnelit.ReadMsgBytes(conn)
+		return cred, nil, nil, regMsg, err
+	} else if req != tunnelit.ChallengeRequest &&
+		req != tunnelit.ChallengeRequestV2 && req != tunnelit.IdentityRequest {
+		return cred, nil, nil, nil, nil
+	}
+	var reg Registration
+	if req == tunnelit.IdentityRequest {
+		if regMsg, err = tunnelit.ReadMsgBytes(conn); err != nil {
+			return cred, nil, nil, nil, err
+		} else if err := json.Unmarshal(regMsg, &reg); err != nil {
+			return cred, nil, nil, nil, err
+		} else if len(reg.Nonce) != tunnelit.IdentityNonceSize {
+			return cred, nil, nil, nil, fmt.Errorf(
+				"invalid identity nonce length %d", len(reg.Nonce),
+			)
+		}
+	}
+	cred = [sha256.Size]byte{}
+	nonce = make([]byte, tunnelit.ChallengeSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return cred, nil, nil, nil, err
+	}
+	challenge := nonce
+	if req != tunnelit.ChallengeRequest {
+		challenge = append(challenge, passwordVerifier.challengeParams()...)
+	}
+	if _, err := utils.WriteAll(conn, challenge); err != nil {
+		return cred, nil, nil, nil, err
+	}
+	if regMsg != nil {
+		err := writeMsg(conn, proveIdentity(reg.Nonce, challenge, regMsg))
+		if err != nil {
+			return cred, nil, nil, nil, err
+		}
+	}
+	if req != tunnelit.ChallengeRequest && passwordVerifier != nil {
+		proof = make([]byte, sha256.Size)
+		_, err = io.ReadFull(conn, proof)
+		return cred, nonce, proof, regMsg, err
+	}
+	_, err = io.ReadFull(conn, cred[:])
+	return cred, nonce, nil, regMsg, err
+}
+
+// authMatches returns whether the credential (or proof) is for the hash: the
+// proof of the verifier derived from the hash with the proxy's verifier
+// params if there's a proof, the response to the challenge nonce if there's a
+// nonce, and the hash itself otherwise.
+func authMatches(cred, nonce, proof []byte, hash [sha256.Size]byte) bool {
+	if proof != nil {
+		if passwordVerifier == nil {
+			return false
+		}
+		_, storedKey := tunnelit.CachedVerifierKeys(hash, passwordVerifier.params)
+		return tunnelit.ProofVerifies(storedKey, nonce, proof)
+	} else if nonce == nil {
+		return subtle.ConstantTimeCompare(cred, hash[:]) == 1
+	}
+	return hmac.Equal(cred, tunnelit.ChallengeResponse(hash, nonce))
+}
+
+// warmVerifierKeys derives the verifiers of the tokens and credentials ahead
+// of time (if the proxy has a password verifier) so that tunnels using them
+// don't wait for it, since deriving them is slow by design.
+func warmVerifierKeys() {
+	if passwordVerifier == nil {
+		return
+	}
+	var hashes [][sha256.Size]byte
+	for _, tok := range state.ListTokens() {
+		for _, h := range []string{tok.Hash, tok.PrevHash} {
+			if b, err := hex.DecodeString(h); err == nil && len(b) == sha256.Size {
+				hashes = append(hashes, [sha256.Size]byte(b))
+			}
+		}
+	}
+	creds, _ := credentials.LoadSafe()
+	for _, c := range creds {
+		hashes = append(hashes, c.hash)
+	}
+	for _, hash := range hashes {
+		tunnelit.CachedVerifierKeys(hash, passwordVerifier.params)
+	}
+}
+
+// TokenForAuth returns a copy of the token the credential (or proof) is for
+// (see authMatches), if any. The token's previous secret is accepted until it
+// expires.
+func (s *State) TokenForAuth(cred, nonce, proof []byte) (Token, bool) {
+	now := time.Now()
+	// Not checked under the lock since deriving verifiers is slow
+	for _, tok := range s.ListTokens() {
+		if hashAuthMatches(cred, nonce, proof, tok.Hash) ||
+			(now.Before(tok.PrevExpires) &&
+				hashAuthMatches(cred, nonce, proof, tok.PrevHash)) {
+			return tok, true
+		}
+	}
+	return Token{}, false
+}
+
+// hashAuthMatches is authMatches for a hex-encoded hash.
+func hashAuthMatches(cred, nonce, proof []byte, hexHash string) bool {
+	b, err := hex.DecodeString(hexHash)
+	if err != nil || len(b) != sha256.Size {
+		return false
+	}
+	return authMatches(cred, nonce, proof, [sha256.Size]byte(b))
+}
+
+// RunHashPassword prints a verifier of the password for the proxy's
+// password-verifier flag.
+func RunHashPassword(cmd *cobra.Command, args []string) {
+	params, err := tunnelit.DefaultVerifierParams()
+	if err != nil {
+		log.Fatal("Error generating salt: ", err)
+	}
+	params.Time = must(cmd.Flags().GetUint32("time"))
+	params.Memory = must(cmd.Flags().GetUint32("memory"))
+	params.Threads = must(cmd.Flags().GetUint8("threads"))
+	if err := params.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(newPasswordVerifier(passwordHash.Load(), params))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+	"github.com/johnietre/utils/go"
+)
+
+// testVerifierParams are cheap verifier params for tests.
+var testVerifierParams = tunnelit.VerifierParams{
+	Salt: [tunnelit.SaltSize]byte{1, 2, 3}, Time: 1, Memory: 64, Threads: 1,
+}
+
+func TestPasswordVerifierRoundTrip(t *testing.T) {
+	v := newPasswordVerifier(sha256.Sum256([]byte("password")), testVerifierParams)
+	parsed, err := parsePasswordVerifier(v.String())
+	if err != nil {
+		t.Fatal("error parsing verifier: ", err)
+	} else if *parsed != *v {
+		t.Fatalf("expected %+v, got %+v", *v, *parsed)
+	}
+}
+
+func TestParsePasswordVerifier(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{name: "empty", s: ""},
+		{name: "wrong scheme", s: "pbkdf2-sha256$600000$AAAA$AAAA"},
+		{name: "wrong version", s: "argon2id$v=16$m=64,t=1,p=1$AQIDAAAAAAAAAAAAAAAAAA$" + zeroKey},
+		{name: "bad params", s: "argon2id$v=19$m=x,t=1,p=1$AQIDAAAAAAAAAAAAAAAAAA$" + zeroKey},
+		{name: "too costly", s: "argon2id$v=19$m=64,t=99,p=1$AQIDAAAAAAAAAAAAAAAAAA$" + zeroKey},
+		{name: "short salt", s: "argon2id$v=19$m=64,t=1,p=1$AQID$" + zeroKey},
+		{name: "short key", s: "argon2id$v=19$m=64,t=1,p=1$AQIDAAAAAAAAAAAAAAAAAA$AAAA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePasswordVerifier(tt.s); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+// zeroKey is a base64-encoded zero stored key.
+const zeroKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+func TestAuthMatchesWithVerifier(t *testing.T) {
+	pwdHash := sha256.Sum256([]byte("password"))
+	tokHash := sha256.Sum256([]byte("token"))
+	old := passwordVerifier
+	passwordVerifier = newPasswordVerifier(pwdHash, testVerifierParams)
+	defer func() { passwordVerifier = old }()
+
+	nonce := bytes.Repeat([]byte{7}, tunnelit.ChallengeSize)
+	challenge := testVerifierParams.Append(append([]byte(nil), nonce...))
+	tests := []struct {
+		name string
+		// secret is the tunnel's hash.
+		secret [sha256.Size]byte
+		// password and token are whether the proof is expected to match the
+		// password and the token.
+		password, token bool
+	}{
+		{name: "password", secret: pwdHash, password: true},
+		{name: "token", secret: tokHash, token: true},
+		{name: "neither", secret: sha256.Sum256([]byte("wrong"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof, err := tunnelit.ChallengeAnswer(tt.secret, challenge)
+			if err != nil {
+				t.Fatal("error answering challenge: ", err)
+			}
+			if got := passwordMatches(nil, nonce, proof); got != tt.password {
+				t.Fatalf("expected password match %v, got %v", tt.password, got)
+			}
+			if got := authMatches(nil, nonce, proof, tokHash); got != tt.token {
+				t.Fatalf("expected token match %v, got %v", tt.token, got)
+			}
+		})
+	}
+}
+
+func TestReadCredential(t *testing.T) {
+	old := passwordVerifier
+	passwordVerifier = nil
+	defer func() { passwordVerifier = old }()
+
+	hash := sha256.Sum256([]byte("password"))
+	identityReq := func(nonceSize int) []byte {
+		var buf bytes.Buffer
+		buf.WriteString(tunnelit.IdentityRequest)
+		tunnelit.WriteMsg(&buf, Registration{Nonce: make([]byte, nonceSize)})
+		return buf.Bytes()
+	}
+	// What a tunnel using legacy auth sends (with no status read back)
+	var legacyReg bytes.Buffer
+	tunnelit.Register(
+		struct {
+			io.Reader
+			io.Writer
+		}{&bytes.Buffer{}, &legacyReg},
+		hash, true, tunnelit.Registration{Service: "web"}, nil,
+	)
+	tests := []struct {
+		name  string
+		input []byte
+		ok    bool
+		// challenged is whether the tunnel is sent a challenge nonce.
+		challenged bool
+		// service is the service of the registration expected along with
+		// the credential (blank means none).
+		service string
+	}{
+		{name: "hash", input: hash[:], ok: true},
+		{
+			name: "hash with registration", input: legacyReg.Bytes(), ok: true,
+			service: "web",
+		},
+		{
+			name:  "hash request without registration",
+			input: append([]byte(tunnelit.HashRequest), hash[:]...),
+		},
+		{name: "hash request without hash", input: []byte(tunnelit.HashRequest)},
+		{
+			name:       "challenge response",
+			input:      append([]byte(tunnelit.ChallengeRequest), hash[:]...),
+			ok:         true,
+			challenged: true,
+		},
+		{name: "empty"},
+		{name: "truncated hash", input: hash[:10]},
+		{
+			name:       "truncated challenge response",
+			input:      append([]byte(tunnelit.ChallengeRequest), hash[:10]...),
+			challenged: true,
+		},
+		{name: "identity request without registration", input: []byte(tunnelit.IdentityRequest)},
+		{name: "identity request with short nonce", input: identityReq(tunnelit.IdentityNonceSize - 1)},
+		{
+			name:  "identity request with invalid registration",
+			input: append([]byte(tunnelit.IdentityRequest), 0, 2, '{', ']'),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, written := scriptedConn(t, tt.input)
+			cred, nonce, _, regMsg, err := readCredential(conn)
+			conn.Close()
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok=%v, got error %v", tt.ok, err)
+			}
+			w := <-written
+			if tt.challenged != (len(w) == tunnelit.ChallengeSize) {
+				t.Fatalf("expected challenged=%v, got %x written", tt.challenged, w)
+			} else if !tt.ok {
+				return
+			} else if tt.challenged && !bytes.Equal(nonce, w) {
+				t.Fatalf("expected nonce %x, got %x", w, nonce)
+			} else if cred != hash {
+				t.Fatalf("expected credential %x, got %x", hash, cred)
+			}
+			var reg Registration
+			if tt.service == "" && regMsg != nil {
+				t.Fatalf("expected no registration, got %s", regMsg)
+			} else if tt.service == "" {
+				return
+			} else if err := json.Unmarshal(regMsg, &reg); err != nil {
+				t.Fatal("error decoding registration: ", err)
+			} else if reg.Service != tt.service {
+				t.Fatalf("expected service %q, got %q", tt.service, reg.Service)
+			}
+		})
+	}
+}
+
+func TestAuthMatches(t *testing.T) {
+	old := passwordVerifier
+	passwordVerifier = nil
+	defer func() { passwordVerifier = old }()
+
+	hash := sha256.Sum256([]byte("password"))
+	wrong := sha256.Sum256([]byte("wrong"))
+	nonce := bytes.Repeat([]byte{7}, tunnelit.ChallengeSize)
+	tests := []struct {
+		name        string
+		cred, nonce []byte
+		want        bool
+	}{
+		{name: "hash", cred: hash[:], want: true},
+		{name: "wrong hash", cred: wrong[:]},
+		{
+			name: "challenge response", nonce: nonce,
+			cred: tunnelit.ChallengeResponse(hash, nonce), want: true,
+		},
+		{
+			name: "wrong challenge response", nonce: nonce,
+			cred: tunnelit.ChallengeResponse(wrong, nonce),
+		},
+		// The hash itself doesn't answer a challenge
+		{name: "hash for a challenge", cred: hash[:], nonce: nonce},
+	}
+	for _, tt := range tests {
+		if got := authMatches(tt.cred, tt.nonce, nil, hash); got != tt.want {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestStateTokenForAuth(t *testing.T) {
+	s := newState("")
+	secret, err := s.CreateToken("laptop", TokenLimits{})
+	if err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+	hash := sha256.Sum256([]byte(secret))
+	nonce := bytes.Repeat([]byte{7}, tunnelit.ChallengeSize)
+	if tok, ok := s.TokenForAuth(hash[:], nil, nil); !ok || tok.Name != "laptop" {
+		t.Fatalf("expected the token for its hash, got %+v", tok)
+	}
+	resp := tunnelit.ChallengeResponse(hash, nonce)
+	if tok, ok := s.TokenForAuth(resp, nonce, nil); !ok || tok.Name != "laptop" {
+		t.Fatalf("expected the token for its challenge response, got %+v", tok)
+	}
+	other := sha256.Sum256([]byte("other"))
+	resp = tunnelit.ChallengeResponse(other, nonce)
+	if tok, ok := s.TokenForAuth(resp, nonce, nil); ok {
+		t.Fatalf("expected no token for another secret, got %+v", tok)
+	}
+}
+
+func TestRequireChallenge(t *testing.T) {
+	setTestPassword(t)
+	setState(t, newState(""))
+	svc := newService("web", &ServiceConfig{})
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"web": svc}
+	oldRequire, oldVerifier := requireChallenge, passwordVerifier
+	requireChallenge, passwordVerifier = true, nil
+	t.Cleanup(func() {
+		readyCh, services = oldReadyCh, oldServices
+		requireChallenge, passwordVerifier = oldRequire, oldVerifier
+	})
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+
+	pwdHash := sha256.Sum256([]byte(tunnelittest.DefaultPassword))
+	for _, legacy := range []bool{false, true} {
+		conn, proxySide := pipeConn(t)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		go handleProxyConn(proxySide, false)
+		status, err := tunnelit.Register(
+			conn, pwdHash, legacy, Registration{Service: "web"}, nil,
+		)
+		want := passwordOk
+		if legacy {
+			want = passwordInvalid
+		}
+		if err != nil {
+			t.Fatal("error registering: ", err)
+		} else if status != want {
+			t.Fatalf(
+				"legacy %v: expected %s, got %s", legacy,
+				tunnelit.StatusText(want), tunnelit.StatusText(status),
+			)
+		}
+	}
+}
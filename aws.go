@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// imdsAddr is the address of the EC2 instance metadata service.
+var imdsAddr = "http://169.254.169.254"
+
+// awsCredsRefreshWindow is how long before the instance role's credentials
+// expire that they're refreshed.
+const awsCredsRefreshWindow = 5 * time.Minute
+
+var passwordFrom string
+
+// awsCreds are the credentials used to sign AWS requests.
+type awsCreds struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	// Expiration is when the instance role's credentials expire (zero for
+	// the environment's).
+	Expiration time.Time `json:"Expiration"`
+}
+
+// awsClient makes requests to AWS JSON APIs using the credentials from the
+// environment or, if not set, the EC2 instance role (refreshed as they
+// expire).
+type awsClient struct {
+	region string
+	creds  awsCreds
+	// fromIMDS is whether the credentials are the instance role's.
+	fromIMDS bool
+	client   *http.Client
+	signer   *v4.Signer
+}
+
+func newAWSClient() (*awsClient, error) {
+	ac := &awsClient{
+		region: os.Getenv("AWS_REGION"),
+		creds: awsCreds{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		client: &http.Client{Timeout: 10 * time.Second},
+		signer: v4.NewSigner(),
+	}
+	if ac.region == "" {
+		ac.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if ac.region != "" && ac.creds.AccessKeyID != "" {
+		return ac, nil
+	}
+
+	// Fall back to the instance metadata service (IMDSv2)
+	imdsToken, err := ac.imdsToken()
+	if err != nil {
+		return nil, err
+	}
+	if ac.region == "" {
+		region, err := ac.imds(http.MethodGet, "/latest/meta-data/placement/region", imdsToken)
+		if err != nil {
+			return nil, fmt.Errorf("error getting region: %w", err)
+		}
+		ac.region = region
+	}
+	if ac.creds.AccessKeyID == "" {
+		ac.fromIMDS = true
+		if err := ac.refreshCreds(imdsToken); err != nil {
+			return nil, err
+		}
+	}
+	return ac, nil
+}
+
+// imdsToken returns a new IMDSv2 session token.
+func (ac *awsClient) imdsToken() (string, error) {
+	req, err := http.NewRequest(http.MethodPut, imdsAddr+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := ac.do(req)
+	if err != nil {
+		return "", fmt.Errorf("error getting IMDS token: %w", err)
+	}
+	return token, nil
+}
+
+// imds makes a request to the instance metadata service with the token.
+func (ac *awsClient) imds(method, path, token string) (string, error) {
+	req, err := http.NewRequest(method, imdsAddr+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return ac.do(req)
+}
+
+// do makes the request, returning the (trimmed) body of an OK response.
+func (ac *awsClient) do(req *http.Request) (string, error) {
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("received status %s", resp.Status)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// refreshCreds gets the instance role's credentials with the IMDS token (a
+// new one if blank).
+func (ac *awsClient) refreshCreds(imdsToken string) error {
+	if imdsToken == "" {
+		var err error
+		if imdsToken, err = ac.imdsToken(); err != nil {
+			return err
+		}
+	}
+	const credsPath = "/latest/meta-data/iam/security-credentials/"
+	role, err := ac.imds(http.MethodGet, credsPath, imdsToken)
+	if err != nil {
+		return fmt.Errorf("error getting instance role: %w", err)
+	}
+	role, _, _ = strings.Cut(role, "\n")
+	b, err := ac.imds(http.MethodGet, credsPath+role, imdsToken)
+	if err != nil {
+		return fmt.Errorf("error getting instance role credentials: %w", err)
+	}
+	var creds awsCreds
+	if err := json.Unmarshal([]byte(b), &creds); err != nil {
+		return fmt.Errorf("error parsing instance role credentials: %w", err)
+	}
+	ac.creds = creds
+	return nil
+}
+
+// Call calls the target action of the given service's JSON API, decoding the
+// response into out.
+func (ac *awsClient) Call(service, target string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	if ac.fromIMDS &&
+		time.Until(ac.creds.Expiration) < awsCredsRefreshWindow {
+		if err := ac.refreshCreds(""); err != nil {
+			return err
+		}
+	}
+	host := service + "." + ac.region + ".amazonaws.com"
+	req, err := http.NewRequest(
+		http.MethodPost, "https://"+host+"/", bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	if err := ac.sign(req, service, body, time.Now()); err != nil {
+		return fmt.Errorf("error signing request: %w", err)
+	}
+
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("received status %s: %s %s", resp.Status, e.Type, e.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// sign signs the request using AWS Signature Version 4.
+func (ac *awsClient) sign(
+	req *http.Request, service string, body []byte, now time.Time,
+) error {
+	bodyHash := sha256.Sum256(body)
+	creds := aws.Credentials{
+		AccessKeyID:     ac.creds.AccessKeyID,
+		SecretAccessKey: ac.creds.SecretAccessKey,
+		SessionToken:    ac.creds.Token,
+	}
+	return ac.signer.SignHTTP(
+		context.Background(), creds, req, hex.EncodeToString(bodyHash[:]),
+		service, ac.region, now,
+	)
+}
+
+// loadPasswordFrom fetches the password from the given source, which is one
+// of "aws-sm://<secret-id>" (Secrets Manager) or "aws-ssm://<parameter-name>"
+// (SSM Parameter Store).
+func loadPasswordFrom(src string) (string, error) {
+	scheme, name, ok := strings.Cut(src, "://")
+	if !ok || name == "" {
+		return "", fmt.Errorf("invalid password source %q", src)
+	}
+	if scheme != "aws-sm" && scheme != "aws-ssm" {
+		return "", fmt.Errorf("unknown password source scheme %q", scheme)
+	}
+	ac, err := newAWSClient()
+	if err != nil {
+		return "", err
+	}
+	if scheme == "aws-sm" {
+		var out struct {
+			SecretString string `json:"SecretString"`
+		}
+		err := ac.Call(
+			"secretsmanager", "secretsmanager.GetSecretValue",
+			map[string]string{"SecretId": name}, &out,
+		)
+		if err != nil {
+			return "", fmt.Errorf("error getting secret %q: %w", name, err)
+		}
+		return out.SecretString, nil
+	}
+	var out struct {
+		Parameter struct {
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	err = ac.Call(
+		"ssm", "AmazonSSM.GetParameter",
+		map[string]any{"Name": name, "WithDecryption": true}, &out,
+	)
+	if err != nil {
+		return "", fmt.Errorf("error getting parameter %q: %w", name, err)
+	}
+	return out.Parameter.Value, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+func TestAWSSign(t *testing.T) {
+	// Vectors from the AWS Signature Version 4 test suite
+	ac := &awsClient{
+		region: "us-east-1",
+		creds: awsCreds{
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		},
+		signer: v4.NewSigner(),
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	const credential = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature="
+	tests := []struct {
+		name, method, sig string
+	}{
+		{
+			name: "get-vanilla", method: http.MethodGet,
+			sig: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "post-vanilla", method: http.MethodPost,
+			sig: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "https://example.amazonaws.com/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ac.sign(req, "service", nil, now); err != nil {
+				t.Fatal("error signing: ", err)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("expected date 20150830T123600Z, got %q", got)
+			}
+			if got := req.Header.Get("Authorization"); got != credential+tt.sig {
+				t.Fatalf("expected authorization %q, got %q", credential+tt.sig, got)
+			}
+		})
+	}
+}
+
+// fakeIMDS is an IMDSv2 server for an instance in us-west-2 with the role
+// "role", whose credentials are the next of creds each time they're fetched.
+type fakeIMDS struct {
+	creds []awsCreds
+	// fetches is how many times the credentials were fetched.
+	fetches atomic.Int64
+}
+
+const fakeIMDSToken = "imds-token"
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/latest/api/token" {
+		if r.Method != http.MethodPut ||
+			r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, fakeIMDSToken)
+		return
+	}
+	// Only IMDSv2 requests (with the session token) are answered
+	if r.Header.Get("X-aws-ec2-metadata-token") != fakeIMDSToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/latest/meta-data/placement/region":
+		io.WriteString(w, "us-west-2")
+	case "/latest/meta-data/iam/security-credentials/":
+		io.WriteString(w, "role\n")
+	case "/latest/meta-data/iam/security-credentials/role":
+		i := int(f.fetches.Add(1)) - 1
+		json.NewEncoder(w).Encode(f.creds[min(i, len(f.creds)-1)])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling the function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// startFakeIMDS starts the IMDS server, pointing imdsAddr to it, and clears
+// the AWS environment variables.
+func startFakeIMDS(t *testing.T, imds *fakeIMDS) {
+	t.Helper()
+	srv := httptest.NewServer(imds)
+	t.Cleanup(srv.Close)
+	oldAddr := imdsAddr
+	imdsAddr = srv.URL
+	t.Cleanup(func() { imdsAddr = oldAddr })
+	for _, name := range []string{
+		"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID",
+		"AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestAWSClientIMDS(t *testing.T) {
+	imds := &fakeIMDS{creds: []awsCreds{
+		{
+			// Expiring within the refresh window
+			AccessKeyID: "first", SecretAccessKey: "s1", Token: "t1",
+			Expiration: time.Now().Add(time.Minute),
+		},
+		{
+			AccessKeyID: "second", SecretAccessKey: "s2", Token: "t2",
+			Expiration: time.Now().Add(time.Hour),
+		},
+	}}
+	startFakeIMDS(t, imds)
+
+	ac, err := newAWSClient()
+	if err != nil {
+		t.Fatal("error creating client: ", err)
+	} else if ac.region != "us-west-2" {
+		t.Fatalf("expected region us-west-2, got %q", ac.region)
+	} else if ac.creds.AccessKeyID != "first" || ac.creds.Token != "t1" {
+		t.Fatalf("expected the role's first credentials, got %+v", ac.creds)
+	}
+
+	// AWS's API is faked by the transport (passing IMDS requests through),
+	// which records the credentials each call is signed with
+	var signedBy []string
+	ac.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if strings.HasPrefix(imdsAddr, "http://"+r.URL.Host) {
+			return http.DefaultTransport.RoundTrip(r)
+		}
+		signedBy = append(signedBy, r.Header.Get("X-Amz-Security-Token"))
+		if r.URL.Host != "ssm.us-west-2.amazonaws.com" ||
+			!strings.Contains(r.Header.Get("Authorization"), "Credential=second/") {
+			return &http.Response{
+				StatusCode: http.StatusForbidden, Status: "403 Forbidden",
+				Body: io.NopCloser(strings.NewReader("{}")),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK, Status: "200 OK",
+			Body: io.NopCloser(strings.NewReader(`{"Parameter":{"Value":"pwd"}}`)),
+		}, nil
+	})
+	for i := 0; i < 2; i++ {
+		var out struct{ Parameter struct{ Value string } }
+		err := ac.Call("ssm", "AmazonSSM.GetParameter", map[string]string{}, &out)
+		if err != nil {
+			t.Fatalf("call %d: error calling: %v", i, err)
+		} else if out.Parameter.Value != "pwd" {
+			t.Fatalf("call %d: expected value pwd, got %q", i, out.Parameter.Value)
+		}
+	}
+	// The expiring credentials are refreshed once, before the first call
+	if n := imds.fetches.Load(); n != 2 {
+		t.Fatalf("expected credentials fetched twice, got %d", n)
+	} else if strings.Join(signedBy, ",") != "t2,t2" {
+		t.Fatalf("expected calls signed with the refreshed token, got %v", signedBy)
+	}
+}
+
+func TestAWSClientEnv(t *testing.T) {
+	imds := &fakeIMDS{creds: []awsCreds{{AccessKeyID: "role"}}}
+	startFakeIMDS(t, imds)
+	t.Setenv("AWS_DEFAULT_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "env")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	ac, err := newAWSClient()
+	if err != nil {
+		t.Fatal("error creating client: ", err)
+	} else if ac.region != "eu-west-1" || ac.creds.AccessKeyID != "env" {
+		t.Fatalf("expected the environment's region and credentials, got %q %+v", ac.region, ac.creds)
+	} else if ac.fromIMDS || imds.fetches.Load() != 0 {
+		t.Fatal("expected the instance role's credentials unused")
+	}
+}
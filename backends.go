@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+// deadBackendCooldown is how long a backend that failed to be dialed is
+// skipped for.
+const deadBackendCooldown = 10 * time.Second
+
+// backendPool rotates through the backend server addresses per connection,
+// skipping those that recently failed to be dialed. Addresses can be
+// discovered (see k8sBackend), so the set of addresses changes over time.
+type backendPool struct {
+	// specs are the addresses as configured.
+	specs []string
+	// static are the addresses that aren't discovered.
+	static []string
+	k8s    []*k8sBackend
+	// network is the network the backends are dialed on (blank means
+	// tcpNetwork).
+	network string
+	next    atomic.Uint32
+	set     atomic.Pointer[backendSet]
+
+	// mtx guards the discovered addresses of each k8s backend.
+	mtx        sync.Mutex
+	discovered [][]string
+}
+
+// backendSet is a set of backend addresses.
+type backendSet struct {
+	addrs []string
+	// deadUntil holds, for each addr, the unix nano time until which it's
+	// considered dead.
+	deadUntil []atomic.Int64
+}
+
+func newBackendPool(specs []string, k8s []*k8sBackend) *backendPool {
+	bp := &backendPool{
+		specs: specs, k8s: k8s, discovered: make([][]string, len(k8s)),
+	}
+	for _, spec := range specs {
+		if !strings.HasPrefix(spec, k8sScheme) {
+			bp.static = append(bp.static, spec)
+		}
+	}
+	bp.set.Store(&backendSet{
+		addrs: bp.static, deadUntil: make([]atomic.Int64, len(bp.static)),
+	})
+	return bp
+}
+
+// watch keeps the discovered addresses up to date until the stop chan is
+// closed.
+func (bp *backendPool) watch(stop <-chan utils.Unit) {
+	for i, kb := range bp.k8s {
+		i := i
+		go kb.watch(stop, func(addrs []string) { bp.update(i, addrs) })
+	}
+}
+
+// update sets the addresses discovered by the k8s backend at index i.
+func (bp *backendPool) update(i int, addrs []string) {
+	bp.mtx.Lock()
+	defer bp.mtx.Unlock()
+	bp.discovered[i] = addrs
+	seen := make(map[string]bool)
+	var all []string
+	for _, addr := range bp.static {
+		if !seen[addr] {
+			seen[addr] = true
+			all = append(all, addr)
+		}
+	}
+	for _, discovered := range bp.discovered {
+		for _, addr := range discovered {
+			if !seen[addr] {
+				seen[addr] = true
+				all = append(all, addr)
+			}
+		}
+	}
+	// Keep which addrs are dead
+	old := bp.set.Load()
+	deadUntil := make(map[string]int64, len(old.addrs))
+	for j, addr := range old.addrs {
+		deadUntil[addr] = old.deadUntil[j].Load()
+	}
+	set := &backendSet{addrs: all, deadUntil: make([]atomic.Int64, len(all))}
+	for j, addr := range all {
+		set.deadUntil[j].Store(deadUntil[addr])
+	}
+	bp.set.Store(set)
+	sorted := append([]string(nil), addrs...)
+	sort.Strings(sorted)
+	if len(sorted) == 0 {
+		log.Printf("No servers found for %s", bp.k8s[i])
+	} else {
+		log.Printf("Servers for %s: %s", bp.k8s[i], strings.Join(sorted, ", "))
+	}
+}
+
+// Dial dials the next live backend, trying each backend at most once. If all
+// backends are considered dead, they are all tried anyway.
+func (bp *backendPool) Dial() (net.Conn, string, error) {
+	set := bp.set.Load()
+	if len(set.addrs) == 0 {
+		return nil, "", errors.New("no servers available: none discovered")
+	}
+	start := int(bp.next.Add(1)-1) % len(set.addrs)
+	now := time.Now().UnixNano()
+	var lastErr error
+	for _, skipDead := range []bool{true, false} {
+		tried := false
+		for i := 0; i < len(set.addrs); i++ {
+			idx := (start + i) % len(set.addrs)
+			if skipDead && set.deadUntil[idx].Load() > now {
+				continue
+			}
+			tried = true
+			addr := set.addrs[idx]
+			network := bp.network
+			if network == "" {
+				network = tcpNetwork
+			}
+			conn, err := dialer.Dial(network, addr)
+			if err == nil {
+				set.deadUntil[idx].Store(0)
+				return conn, addr, nil
+			}
+			if set.deadUntil[idx].Swap(
+				time.Now().Add(deadBackendCooldown).UnixNano(),
+			) == 0 {
+				log.Printf("Marking server %s as dead: %v", addr, err)
+			}
+			lastErr = err
+		}
+		if tried {
+			break
+		}
+	}
+	return nil, "", fmt.Errorf("no servers available: %w", lastErr)
+}
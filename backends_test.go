@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+)
+
+// deadAddr returns the address of a listener that has been closed.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// dialBackend dials the next backend from the pool, returning its address.
+func dialBackend(t *testing.T, bp *backendPool) string {
+	t.Helper()
+	conn, addr, err := bp.Dial()
+	if err != nil {
+		t.Fatal("error dialing backend: ", err)
+	}
+	conn.Close()
+	return addr
+}
+
+func TestBackendPoolRotates(t *testing.T) {
+	addr1 := tunnelittest.StartEchoBackend(t)
+	addr2 := tunnelittest.StartEchoBackend(t)
+	bp := newBackendPool([]string{addr1, addr2}, nil)
+	want := []string{addr1, addr2, addr1, addr2}
+	for i, w := range want {
+		if got := dialBackend(t, bp); got != w {
+			t.Fatalf("dial %d: expected %s, got %s", i, w, got)
+		}
+	}
+}
+
+func TestBackendPoolSkipsDead(t *testing.T) {
+	live := tunnelittest.StartEchoBackend(t)
+	dead := deadAddr(t)
+	bp := newBackendPool([]string{dead, live}, nil)
+	for i := 0; i < 4; i++ {
+		if got := dialBackend(t, bp); got != live {
+			t.Fatalf("dial %d: expected %s, got %s", i, live, got)
+		}
+	}
+	if until := bp.set.Load().deadUntil[0].Load(); until == 0 {
+		t.Fatal("expected the dead backend to be marked dead")
+	}
+
+	// Dead backends are still tried when they're all dead
+	bp = newBackendPool([]string{deadAddr(t)}, nil)
+	for i := 0; i < 2; i++ {
+		if _, _, err := bp.Dial(); err == nil {
+			t.Fatal("expected an error with no live backends")
+		}
+	}
+}
+
+func TestBackendPoolNone(t *testing.T) {
+	bp := newBackendPool(nil, nil)
+	if _, _, err := bp.Dial(); err == nil {
+		t.Fatal("expected an error with no backends")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+var (
+	// authFailLimit is the number of failed auths from an IP within
+	// authFailWindow that gets it banned (0 means never).
+	authFailLimit uint
+	// authFailWindow is the window failed auths are counted in.
+	authFailWindow time.Duration
+	// authBanDuration is how long IPs are banned for.
+	authBanDuration time.Duration
+	// authFailLogFile is the file auth failures are logged to (blank means the
+	// main log).
+	authFailLogFile string
+	authFailLogger  *log.Logger
+
+	authFailures = struct {
+		sync.Mutex
+		ips map[string]*authFailure
+	}{ips: make(map[string]*authFailure)}
+)
+
+// authFailure tracks the failed auths from an IP.
+type authFailure struct {
+	// count is the number of failures since windowStart.
+	count       uint
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// openAuthFailLog opens the auth failure log, if any.
+func openAuthFailLog() error {
+	if authFailLogFile == "" {
+		return nil
+	}
+	f, err := utils.OpenAppend(authFailLogFile)
+	if err != nil {
+		return err
+	}
+	authFailLogger = log.New(f, "", 0)
+	return nil
+}
+
+// logAuthFailure logs a failed auth or rejected IP on a single line of a
+// stable format for tools like fail2ban and CrowdSec:
+//
+//	2006-01-02T15:04:05Z tunnelit auth-failure ip=192.0.2.1 reason=invalid-password
+//
+// The reason is one of invalid-password, challenge-required, banned,
+// tunnel-cidr, client-cidr, and client-cidr-denied. The IP is only anonymized
+// (see anonymize-ips) in the main log.
+func logAuthFailure(addr net.Addr, reason string) {
+	ip := ""
+	if a := addrIP(addr); a != nil {
+		ip = a.String()
+	}
+	format := "%s tunnelit auth-failure ip=%s reason=%s"
+	now := time.Now().UTC().Format(time.RFC3339)
+	if authFailLogger != nil {
+		authFailLogger.Printf(format, now, ip, reason)
+		return
+	}
+	if anonymizeIPs != "" {
+		ip = logAddr(addr)
+	}
+	log.Printf(format, now, ip, reason)
+}
+
+// recordAuthFailure records a failed auth from the address, banning its IP if
+// it has failed too often.
+func recordAuthFailure(addr net.Addr) {
+	ip := addrIP(addr)
+	if authFailLimit == 0 || ip == nil {
+		return
+	}
+	now := time.Now()
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	f := authFailures.ips[ip.String()]
+	if f == nil || now.Sub(f.windowStart) > authFailWindow {
+		if f == nil && len(authFailures.ips) >= 10_000 {
+			pruneAuthFailures(now)
+		}
+		f = &authFailure{windowStart: now}
+		authFailures.ips[ip.String()] = f
+	}
+	f.count++
+	if f.count >= authFailLimit && now.After(f.bannedUntil) {
+		f.bannedUntil = now.Add(authBanDuration)
+		log.Printf(
+			"Banning %s for %s after %d failed auths",
+			logAddr(addr), authBanDuration, f.count,
+		)
+		audit(
+			"Banned %s for %s after %d failed auths", ip, authBanDuration, f.count,
+		)
+	}
+}
+
+// authBanned returns whether the address's IP is banned, logging it if so.
+// It's checked as tunnels are accepted so banned IPs don't take up handshake
+// slots.
+func authBanned(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if authFailLimit == 0 || ip == nil {
+		return false
+	}
+	authFailures.Lock()
+	f := authFailures.ips[ip.String()]
+	banned := f != nil && time.Now().Before(f.bannedUntil)
+	authFailures.Unlock()
+	if banned {
+		logAuthFailure(addr, "banned")
+	}
+	return banned
+}
+
+// pruneAuthFailures removes the IPs that are neither banned nor in their
+// window. The lock must be held.
+func pruneAuthFailures(now time.Time) {
+	for ip, f := range authFailures.ips {
+		if now.Sub(f.windowStart) > authFailWindow && now.After(f.bannedUntil) {
+			delete(authFailures.ips, ip)
+		}
+	}
+}
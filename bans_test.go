@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setAuthBans sets the ban limits for the test, clearing any failures.
+func setAuthBans(t *testing.T, limit uint, window, ban time.Duration) {
+	t.Helper()
+	oldLimit, oldWindow, oldBan := authFailLimit, authFailWindow, authBanDuration
+	authFailures.Lock()
+	oldIPs := authFailures.ips
+	authFailures.ips = make(map[string]*authFailure)
+	authFailures.Unlock()
+	t.Cleanup(func() {
+		authFailLimit, authFailWindow, authBanDuration = oldLimit, oldWindow, oldBan
+		authFailures.Lock()
+		authFailures.ips = oldIPs
+		authFailures.Unlock()
+	})
+	authFailLimit, authFailWindow, authBanDuration = limit, window, ban
+}
+
+func TestAuthBans(t *testing.T) {
+	setAuthBans(t, 3, time.Minute, time.Hour)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+	for i := 0; i < 2; i++ {
+		recordAuthFailure(addr)
+	}
+	recordAuthFailure(other)
+	if authBanned(addr) {
+		t.Fatal("expected no ban under the limit")
+	}
+	// The port doesn't matter, only the IP
+	recordAuthFailure(&net.TCPAddr{IP: addr.IP, Port: 4321})
+	if !authBanned(addr) {
+		t.Fatal("expected a ban at the limit")
+	} else if authBanned(other) {
+		t.Fatal("expected only the failing IP banned")
+	}
+
+	// Bans are lifted once they're over
+	authFailures.Lock()
+	authFailures.ips["192.0.2.1"].bannedUntil = time.Now().Add(-time.Second)
+	authFailures.Unlock()
+	if authBanned(addr) {
+		t.Fatal("expected the ban to be lifted")
+	}
+
+	// Failures outside the window aren't counted
+	authFailures.Lock()
+	authFailures.ips["192.0.2.2"].windowStart = time.Now().Add(-time.Hour)
+	authFailures.Unlock()
+	recordAuthFailure(other)
+	recordAuthFailure(other)
+	if authBanned(other) {
+		t.Fatal("expected the failures outside the window not counted")
+	}
+
+	// Without a limit, no one is banned
+	setAuthBans(t, 0, time.Minute, time.Hour)
+	for i := 0; i < 5; i++ {
+		recordAuthFailure(addr)
+	}
+	if authBanned(addr) || len(authFailures.ips) != 0 {
+		t.Fatal("expected no failures recorded without a limit")
+	}
+}
+
+func TestPruneAuthFailures(t *testing.T) {
+	setAuthBans(t, 3, time.Minute, time.Hour)
+	now := time.Now()
+	authFailures.ips = map[string]*authFailure{
+		"expired":  {count: 2, windowStart: now.Add(-time.Hour)},
+		"counting": {count: 2, windowStart: now},
+		"banned": {
+			count: 3, windowStart: now.Add(-time.Hour),
+			bannedUntil: now.Add(time.Hour),
+		},
+	}
+	pruneAuthFailures(now)
+	if _, ok := authFailures.ips["expired"]; ok {
+		t.Fatal("expected the expired failures pruned")
+	} else if len(authFailures.ips) != 2 {
+		t.Fatalf("expected 2 IPs left, got %d", len(authFailures.ips))
+	}
+}
+
+func TestLogAuthFailure(t *testing.T) {
+	oldFile, oldLogger := authFailLogFile, authFailLogger
+	t.Cleanup(func() { authFailLogFile, authFailLogger = oldFile, oldLogger })
+	authFailLogFile, authFailLogger = "", nil
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.123"), Port: 1234}
+	line := regexp.MustCompile(
+		`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ tunnelit auth-failure ` +
+			`ip=(\S*) reason=(\S+)$`,
+	)
+
+	// The IP is anonymized in the main log
+	setPrivacy(t, "truncate", "")
+	logs := captureLog(t)
+	logAuthFailure(addr, "banned")
+	_, msg, _ := strings.Cut(strings.TrimSpace(logs.String()), " ")
+	_, msg, _ = strings.Cut(msg, " ")
+	if m := line.FindStringSubmatch(msg); m == nil {
+		t.Fatalf("expected the stable format, got %q", msg)
+	} else if m[1] != "192.0.2.0/24" || m[2] != "banned" {
+		t.Fatalf("expected the anonymized IP and reason, got %q", msg)
+	}
+
+	// But not in its own file, which only has the failures
+	authFailLogFile = filepath.Join(t.TempDir(), "auth.log")
+	if err := openAuthFailLog(); err != nil {
+		t.Fatal("error opening auth failure log: ", err)
+	}
+	logAuthFailure(addr, "invalid-password")
+	logAuthFailure(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, "tunnel-cidr")
+	b, err := os.ReadFile(authFailLogFile)
+	if err != nil {
+		t.Fatal("error reading auth failure log: ", err)
+	}
+	want := [][2]string{
+		{"192.0.2.123", "invalid-password"},
+		{"", "tunnel-cidr"},
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got %q", len(want), b)
+	}
+	for i, l := range lines {
+		m := line.FindStringSubmatch(l)
+		if m == nil || m[1] != want[i][0] || m[2] != want[i][1] {
+			t.Fatalf("expected ip=%s reason=%s, got %q", want[i][0], want[i][1], l)
+		}
+	}
+
+	// Tunnels with invalid passwords are logged
+	if err := os.Truncate(authFailLogFile, 0); err != nil {
+		t.Fatal(err)
+	}
+	setTestPassword(t)
+	setState(t, newState(""))
+	reg := Registration{Service: "web"}
+	status, _ := registerTunnel(t, sha256.Sum256([]byte("wrong")), reg)
+	if status != passwordInvalid {
+		t.Fatalf("expected the password rejected, got %d", status)
+	}
+	waitFor(t, "the invalid password logged", func() bool {
+		b, _ := os.ReadFile(authFailLogFile)
+		return strings.Contains(string(b), "reason=invalid-password\n")
+	})
+}
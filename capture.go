@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// captureMagic starts each capture file.
+	captureMagic = "TUNNELIT-CAPTURE\x01"
+	// defaultCaptureMaxBytes is the default limit on the payload bytes
+	// recorded by a capture.
+	defaultCaptureMaxBytes = 16 << 20
+)
+
+// captureDir is the directory captures are written to.
+var captureDir string
+
+// CaptureHeader follows the magic in a capture file (as a message written by
+// writeMsg). It's followed by the records, each being a direction byte (0 for
+// bytes from the client, 1 for bytes to it), the 8-byte big-endian
+// nanoseconds since the capture started, the 4-byte big-endian length, and
+// the bytes.
+type CaptureHeader struct {
+	PipeID     uint64    `json:"pipe_id"`
+	Service    string    `json:"service"`
+	Tunnel     string    `json:"tunnel,omitempty"`
+	ClientAddr string    `json:"client_addr"`
+	PeerAddr   string    `json:"peer_addr"`
+	Started    time.Time `json:"started"`
+}
+
+// pipeCapture records the bytes piped in both directions of a pipe to a file,
+// stopping once the limit is reached.
+type pipeCapture struct {
+	path  string
+	start time.Time
+	// done is called (with the mutex held) once the capture stops, with the
+	// error writing it (if any).
+	done func(pc *pipeCapture, reason string, err error)
+
+	mtx      sync.Mutex
+	f        io.WriteCloser
+	w        *bufio.Writer
+	left     int64
+	recorded int64
+	closed   bool
+}
+
+// startCapture starts capturing the pipe's traffic to a new file in the
+// capture directory, recording up to maxBytes of payload.
+func startCapture(ap *activePipe, maxBytes int64) (*pipeCapture, error) {
+	if err := os.MkdirAll(captureDir, 0700); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	f, err := os.CreateTemp(captureDir, fmt.Sprintf(
+		"tunnelit-pipe-%d-%s-*.tcap", ap.id, now.UTC().Format("20060102T150405Z"),
+	))
+	if err != nil {
+		return nil, err
+	}
+	pc, err := newPipeCapture(f.Name(), f, CaptureHeader{
+		PipeID: ap.id, Service: ap.service, Tunnel: ap.tunnel,
+		ClientAddr: ap.clientAddr, PeerAddr: ap.peerAddr, Started: now,
+	}, maxBytes)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	pc.done = func(pc *pipeCapture, reason string, err error) {
+		if err != nil {
+			log.Printf("Error writing capture %s: %v", pc.path, err)
+		}
+		log.Printf(
+			"Stopped capture %s (%s, %d bytes recorded)",
+			pc.path, reason, pc.recorded,
+		)
+	}
+	// Replace the previous capture if it's done (e.g., hit its limit)
+	old := ap.capture.Load()
+	if (old != nil && !old.info().Done) || !ap.capture.CompareAndSwap(old, pc) {
+		f.Close()
+		os.Remove(pc.path)
+		return nil, errCaptureRunning
+	}
+	log.Printf("Capturing pipe #%d to %s", ap.id, pc.path)
+	return pc, nil
+}
+
+var errCaptureRunning = errors.New("pipe is already being captured")
+
+// newPipeCapture writes the magic and header to the file (closing it on
+// error) and returns a capture recording to it.
+func newPipeCapture(
+	path string, f io.WriteCloser, hdr CaptureHeader, maxBytes int64,
+) (*pipeCapture, error) {
+	pc := &pipeCapture{
+		path: path, start: hdr.Started, f: f, w: bufio.NewWriter(f),
+		left: maxBytes,
+	}
+	if _, err := pc.w.WriteString(captureMagic); err != nil {
+		f.Close()
+		return nil, err
+	} else if err := writeMsg(pc.w, hdr); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// record records the bytes sent in the given direction.
+func (pc *pipeCapture) record(up bool, p []byte) {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	if pc.closed {
+		return
+	}
+	if int64(len(p)) > pc.left {
+		p = p[:pc.left]
+	}
+	var hdr [13]byte
+	if !up {
+		hdr[0] = 1
+	}
+	binary.BigEndian.PutUint64(hdr[1:], uint64(time.Since(pc.start)))
+	binary.BigEndian.PutUint32(hdr[9:], uint32(len(p)))
+	pc.w.Write(hdr[:])
+	if _, err := pc.w.Write(p); err != nil {
+		pc.closeLocked("error writing: " + err.Error())
+		return
+	}
+	pc.left -= int64(len(p))
+	pc.recorded += int64(len(p))
+	if pc.left <= 0 {
+		pc.closeLocked("size limit reached")
+	}
+}
+
+// close stops the capture, logging the reason.
+func (pc *pipeCapture) close(reason string) {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	pc.closeLocked(reason)
+}
+
+func (pc *pipeCapture) closeLocked(reason string) {
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	err := pc.w.Flush()
+	if cerr := pc.f.Close(); err == nil {
+		err = cerr
+	}
+	if pc.done != nil {
+		pc.done(pc, reason, err)
+	}
+}
+
+// CaptureInfo describes a capture, as reported by the admin API.
+type CaptureInfo struct {
+	File     string `json:"file"`
+	Recorded int64  `json:"recorded"`
+	Done     bool   `json:"done"`
+}
+
+func (pc *pipeCapture) info() CaptureInfo {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	return CaptureInfo{File: pc.path, Recorded: pc.recorded, Done: pc.closed}
+}
+
+// PipeInfo is an active pipe, as reported by the admin API.
+type PipeInfo struct {
+	ID         uint64       `json:"id"`
+	Service    string       `json:"service"`
+	Tunnel     string       `json:"tunnel,omitempty"`
+	ClientAddr string       `json:"client_addr"`
+	PeerAddr   string       `json:"peer_addr"`
+	Started    time.Time    `json:"started"`
+	Sent       uint64       `json:"sent"`
+	Received   uint64       `json:"received"`
+	Capture    *CaptureInfo `json:"capture,omitempty"`
+}
+
+// handlePipes handles listing (GET) the active pipes.
+func handlePipes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pipes := allActivePipes()
+	infos := make([]PipeInfo, len(pipes))
+	for i, ap := range pipes {
+		infos[i] = PipeInfo{
+			ID: ap.id, Service: ap.service, Tunnel: ap.tunnel,
+			ClientAddr: ap.clientAddr, PeerAddr: ap.peerAddr, Started: ap.start,
+			Sent: ap.sent.Load(), Received: ap.received.Load(),
+		}
+		if pc := ap.capture.Load(); pc != nil {
+			ci := pc.info()
+			infos[i].Capture = &ci
+		}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handlePipeCapture handles starting (POST) and stopping (DELETE) the capture
+// of an active pipe at /pipes/{id}/capture. Starting takes an optional
+// max_bytes limit.
+func handlePipeCapture(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/pipes/")
+	id, err := strconv.ParseUint(strings.TrimSuffix(path, "/capture"), 10, 64)
+	if !strings.HasSuffix(path, "/capture") || err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	ap, ok := getActivePipe(id)
+	if !ok {
+		http.Error(w, "Pipe not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			MaxBytes int64 `json:"max_bytes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Bad request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MaxBytes < 0 {
+			http.Error(w, "max_bytes must not be negative", http.StatusBadRequest)
+			return
+		} else if req.MaxBytes == 0 {
+			req.MaxBytes = defaultCaptureMaxBytes
+		}
+		pc, err := startCapture(ap, req.MaxBytes)
+		if errors.Is(err, errCaptureRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, pc.info())
+	case http.MethodDelete:
+		pc := ap.capture.Swap(nil)
+		if pc == nil {
+			http.Error(w, "Pipe isn't being captured", http.StatusNotFound)
+			return
+		}
+		pc.close("stopped through the admin API")
+		writeJSON(w, http.StatusOK, pc.info())
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bufferCloser is a buffer that records whether it was closed.
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestPipeCaptureRecord(t *testing.T) {
+	var buf bufferCloser
+	hdr := CaptureHeader{PipeID: 7, Service: "web", Started: time.Now()}
+	pc, err := newPipeCapture("test.tcap", &buf, hdr, 8)
+	if err != nil {
+		t.Fatal("error creating capture: ", err)
+	}
+	var reason string
+	pc.done = func(pc *pipeCapture, r string, err error) { reason = r }
+	pc.record(true, []byte("hello"))
+	pc.record(false, []byte("world"))
+	// Past the limit, nothing more is recorded
+	pc.record(true, []byte("ignored"))
+	if !buf.closed || reason != "size limit reached" {
+		t.Fatalf("expected the capture to stop at its limit, got %q", reason)
+	} else if info := pc.info(); !info.Done || info.Recorded != 8 {
+		t.Fatalf("expected 8 bytes recorded, got %+v", info)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil ||
+		string(magic) != captureMagic {
+		t.Fatalf("expected the magic, got %q (error: %v)", magic, err)
+	}
+	var got CaptureHeader
+	if err := readMsg(r, &got); err != nil {
+		t.Fatal("error reading header: ", err)
+	} else if got.PipeID != 7 || got.Service != "web" {
+		t.Fatalf("expected the header, got %+v", got)
+	}
+	want := []struct {
+		up   bool
+		data string
+	}{{true, "hello"}, {false, "wor"}}
+	for _, w := range want {
+		rec, err := readCaptureRecord(r)
+		if err != nil {
+			t.Fatal("error reading record: ", err)
+		} else if rec.up != w.up || string(rec.data) != w.data {
+			t.Fatalf(
+				"expected %q (up %v), got %q (up %v)", w.data, w.up, rec.data, rec.up,
+			)
+		}
+	}
+	if _, err := readCaptureRecord(r); err != io.EOF {
+		t.Fatal("expected no more records, got ", err)
+	}
+}
+
+// waitFor waits for the condition to hold, failing the test if it doesn't
+// within 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for ", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// capturePipe sends a request to the pipe's capture endpoint, returning the
+// response.
+func capturePipe(
+	t *testing.T, method, id, body string,
+) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handlePipeCapture(w, httptest.NewRequest(
+		method, "/pipes/"+id+"/capture", strings.NewReader(body),
+	))
+	return w
+}
+
+func TestHandlePipeCapture(t *testing.T) {
+	oldDir := captureDir
+	captureDir = t.TempDir()
+	t.Cleanup(func() { captureDir = oldDir })
+
+	client, backend, done := startPipe(t, connInfo{service: "web"})
+	// Once data flows, the pipe is tracked
+	go client.Write([]byte("hi"))
+	if _, err := io.ReadFull(backend, make([]byte, 2)); err != nil {
+		t.Fatal("error reading: ", err)
+	}
+	pipes := allActivePipes()
+	if len(pipes) != 1 {
+		t.Fatalf("expected 1 active pipe, got %d", len(pipes))
+	}
+	ap := pipes[0]
+	id := fmt.Sprint(ap.id)
+	// The bytes are counted once the write returns
+	waitFor(t, "the bytes to be counted", func() bool {
+		return ap.sent.Load()+ap.received.Load() == 2
+	})
+
+	w := httptest.NewRecorder()
+	handlePipes(w, httptest.NewRequest(http.MethodGet, "/pipes", nil))
+	var infos []PipeInfo
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatal("error decoding pipes: ", err)
+	} else if len(infos) != 1 || infos[0].Service != "web" ||
+		infos[0].Sent+infos[0].Received != 2 || infos[0].Capture != nil {
+		t.Fatalf("expected the uncaptured pipe, got %+v", infos)
+	}
+
+	if w := capturePipe(t, http.MethodDelete, id, ""); w.Code != 404 {
+		t.Fatalf("expected 404 stopping no capture, got %d", w.Code)
+	} else if w := capturePipe(t, http.MethodPost, "9999", ""); w.Code != 404 {
+		t.Fatalf("expected 404 for an unknown pipe, got %d", w.Code)
+	}
+	w = capturePipe(t, http.MethodPost, id, `{"max_bytes":-1}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative limit, got %d", w.Code)
+	}
+	w = capturePipe(t, http.MethodPost, id, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the capture started, got %d: %s", w.Code, w.Body)
+	}
+	w = capturePipe(t, http.MethodPost, id, "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected a running capture to conflict, got %d", w.Code)
+	}
+	go client.Write([]byte("captured"))
+	if _, err := io.ReadFull(backend, make([]byte, 8)); err != nil {
+		t.Fatal("error reading: ", err)
+	}
+	waitFor(t, "the bytes to be captured", func() bool {
+		return ap.capture.Load().info().Recorded == 8
+	})
+	w = capturePipe(t, http.MethodDelete, id, "")
+	var info CaptureInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal("error decoding capture: ", err)
+	} else if !info.Done || info.Recorded != 8 {
+		t.Fatalf("expected 8 bytes captured, got %+v", info)
+	}
+
+	r, hdr, err := openCapture(info.File, "")
+	if err != nil {
+		t.Fatal("error opening capture: ", err)
+	} else if hdr.Service != "web" || fmt.Sprint(hdr.PipeID) != id {
+		t.Fatalf("expected the pipe's header, got %+v", hdr)
+	}
+	if rec, err := readCaptureRecord(r); err != nil {
+		t.Fatal("error reading record: ", err)
+	} else if !rec.up || string(rec.data) != "captured" {
+		t.Fatalf("expected the client's bytes, got %q", rec.data)
+	}
+	client.Close()
+	backend.Close()
+	waitPipe(t, done)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chaos holds the faults injected into the pipe path when running in chaos
+// mode. It is only meant for testing.
+type Chaos struct {
+	// Latency is added before each chunk is written.
+	Latency time.Duration
+	// Jitter is the maximum random amount added to the latency.
+	Jitter time.Duration
+	// Reset is the probability (0 to 1) that a chunk causes the connections to
+	// be reset.
+	Reset float64
+	// Rate is the maximum bytes per second written (0 means unlimited).
+	Rate int64
+}
+
+var (
+	chaosSpec string
+	chaos     *Chaos
+)
+
+// ParseChaos parses a chaos spec of the form
+// "latency=50ms,jitter=20ms,reset=0.01,rate=65536".
+func ParseChaos(spec string) (*Chaos, error) {
+	c := &Chaos{}
+	for _, part := range strings.Split(spec, ",") {
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid chaos option %q", part)
+		}
+		var err error
+		switch k {
+		case "latency":
+			c.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			c.Jitter, err = time.ParseDuration(v)
+		case "reset":
+			c.Reset, err = strconv.ParseFloat(v, 64)
+			if err == nil && (c.Reset < 0 || c.Reset > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "rate":
+			c.Rate, err = strconv.ParseInt(v, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown chaos option %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos option %q: %w", k, err)
+		}
+	}
+	return c, nil
+}
+
+// Copy copies from rconn to wconn like io.Copy, injecting the configured
+// faults along the way.
+func (c *Chaos) Copy(wconn, rconn net.Conn) (int64, error) {
+	var total int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := rconn.Read(buf)
+		if n > 0 {
+			if delay := c.delay(); delay > 0 {
+				time.Sleep(delay)
+			}
+			if c.Reset > 0 && rand.Float64() < c.Reset {
+				resetConn(rconn)
+				resetConn(wconn)
+				return total, fmt.Errorf("chaos reset")
+			}
+			if c.Rate > 0 {
+				time.Sleep(time.Duration(n) * time.Second / time.Duration(c.Rate))
+			}
+			wn, werr := wconn.Write(buf[:n])
+			total += int64(wn)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return total, nil
+			}
+			return total, rerr
+		}
+	}
+}
+
+func (c *Chaos) delay() time.Duration {
+	d := c.Latency
+	if c.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(c.Jitter)))
+	}
+	return d
+}
+
+// resetConn closes the conn, sending a TCP RST rather than a FIN if possible.
+func resetConn(conn net.Conn) {
+	if tc, ok := unwrapConn(conn).(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseChaos(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Chaos
+		ok   bool
+	}{
+		{spec: "", ok: true},
+		{
+			spec: "latency=50ms,jitter=20ms,reset=0.01,rate=65536",
+			want: Chaos{
+				Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond,
+				Reset: 0.01, Rate: 65536,
+			},
+			ok: true,
+		},
+		{
+			spec: "latency=5ms,", want: Chaos{Latency: 5 * time.Millisecond},
+			ok: true,
+		},
+		{spec: "latency"},
+		{spec: "latency=fast"},
+		{spec: "reset=1.5"},
+		{spec: "reset=-0.1"},
+		{spec: "rate=lots"},
+		{spec: "drop=0.5"},
+	}
+	for _, tt := range tests {
+		c, err := ParseChaos(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%q: expected ok %v, got error %v", tt.spec, tt.ok, err)
+		} else if err == nil && *c != tt.want {
+			t.Fatalf("%q: expected %+v, got %+v", tt.spec, tt.want, *c)
+		}
+	}
+}
+
+// chaosCopy copies the data through the chaos, returning what was received,
+// the number of bytes copied, and the copy's error.
+func chaosCopy(
+	t *testing.T, c *Chaos, data []byte,
+) ([]byte, int64, error) {
+	t.Helper()
+	src, srcPeer := net.Pipe()
+	dst, dstPeer := net.Pipe()
+	defer src.Close()
+	defer dstPeer.Close()
+	go func() {
+		srcPeer.Write(data)
+		srcPeer.Close()
+	}()
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(dstPeer)
+		got <- b
+	}()
+	n, err := c.Copy(dst, src)
+	dst.Close()
+	return <-got, n, err
+}
+
+func TestChaosCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("chaos"), 100)
+
+	start := time.Now()
+	got, n, err := chaosCopy(t, &Chaos{Latency: 20 * time.Millisecond}, data)
+	if err != nil {
+		t.Fatal("error copying: ", err)
+	} else if !bytes.Equal(got, data) || n != int64(len(data)) {
+		t.Fatalf(
+			"expected %d bytes copied intact, got %d (%d)", len(data), len(got), n,
+		)
+	} else if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected the latency to be added, took %s", elapsed)
+	}
+
+	start = time.Now()
+	if _, _, err := chaosCopy(t, &Chaos{Rate: 5000}, data); err != nil {
+		t.Fatal("error copying: ", err)
+	} else if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected 500 bytes at 5000 B/s to take 100ms, took %s", elapsed)
+	}
+
+	got, n, err = chaosCopy(t, &Chaos{Reset: 1}, data)
+	if err == nil {
+		t.Fatal("expected the copy to be reset")
+	} else if len(got) != 0 || n != 0 {
+		t.Fatalf("expected nothing copied before the reset, got %d", len(got))
+	}
+}
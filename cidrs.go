@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+var (
+	// allowCIDRs are the networks clients must be in to connect (empty means
+	// any network).
+	allowCIDRs []string
+	// denyCIDRs are the networks clients are rejected from, even if they're
+	// in an allowed network.
+	denyCIDRs []string
+	// tunnelAllowCIDRs are the networks tunnels must be in to connect (empty
+	// means any network).
+	tunnelAllowCIDRs []string
+
+	allowNets, denyNets, tunnelAllowNets []*net.IPNet
+)
+
+// parseAllowedCIDRs parses the allowed and denied client and tunnel networks.
+func parseAllowedCIDRs() error {
+	var err error
+	if allowNets, err = parseCIDRs(allowCIDRs); err != nil {
+		return fmt.Errorf("allow-cidr: %w", err)
+	} else if denyNets, err = parseCIDRs(denyCIDRs); err != nil {
+		return fmt.Errorf("deny-cidr: %w", err)
+	} else if tunnelAllowNets, err = parseCIDRs(tunnelAllowCIDRs); err != nil {
+		return fmt.Errorf("tunnel-allow-cidr: %w", err)
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// clientAllowed returns whether a client with the given address may connect,
+// logging why if it may not (see logAuthFailure). It's checked as clients are
+// accepted so rejected clients never wait for a tunnel conn.
+func clientAllowed(addr net.Addr) bool {
+	if len(allowNets) == 0 && len(denyNets) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		log.Printf("Rejecting client %s: address has no IP", logAddr(addr))
+		return false
+	}
+	if len(allowNets) != 0 && !netsContain(allowNets, ip) {
+		logAuthFailure(addr, "client-cidr")
+		return false
+	} else if netsContain(denyNets, ip) {
+		logAuthFailure(addr, "client-cidr-denied")
+		return false
+	}
+	return true
+}
+
+// tunnelAllowed returns whether a tunnel with the given address may connect,
+// logging why if it may not (see logAuthFailure). It's checked as tunnels are
+// accepted, before anything is read from them.
+func tunnelAllowed(addr net.Addr) bool {
+	if len(tunnelAllowNets) == 0 {
+		return true
+	}
+	if ip := addrIP(addr); ip == nil || !netsContain(tunnelAllowNets, ip) {
+		logAuthFailure(addr, "tunnel-cidr")
+		return false
+	}
+	return true
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// setCIDRs sets the allowed and denied CIDRs for the test, parsing them.
+func setCIDRs(t *testing.T, allow, deny, tunnelAllow []string) {
+	t.Helper()
+	oldAllow, oldDeny, oldTunnelAllow := allowCIDRs, denyCIDRs, tunnelAllowCIDRs
+	oldNets := [][]*net.IPNet{allowNets, denyNets, tunnelAllowNets}
+	t.Cleanup(func() {
+		allowCIDRs, denyCIDRs, tunnelAllowCIDRs = oldAllow, oldDeny, oldTunnelAllow
+		allowNets, denyNets, tunnelAllowNets = oldNets[0], oldNets[1], oldNets[2]
+	})
+	allowCIDRs, denyCIDRs, tunnelAllowCIDRs = allow, deny, tunnelAllow
+	if err := parseAllowedCIDRs(); err != nil {
+		t.Fatal("error parsing CIDRs: ", err)
+	}
+}
+
+func TestParseAllowedCIDRs(t *testing.T) {
+	setCIDRs(t, nil, nil, nil)
+	for _, cidrs := range [][]string{
+		{"192.0.2.0/24", "2001:db8::/32"},
+		{"192.0.2.1"},
+		{"192.0.2.0/33"},
+	} {
+		allowCIDRs = cidrs
+		err := parseAllowedCIDRs()
+		if want := len(cidrs) == 2; (err == nil) != want {
+			t.Fatalf("%v: expected valid to be %v, got %v", cidrs, want, err)
+		}
+	}
+	if len(allowNets) != 0 {
+		t.Fatalf("expected no networks after an error, got %v", allowNets)
+	}
+	allowCIDRs, tunnelAllowCIDRs = nil, []string{"10.0.0.0/8", "bad"}
+	if err := parseAllowedCIDRs(); err == nil {
+		t.Fatal("expected an error for an invalid tunnel CIDR")
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	setCIDRs(t, nil, nil, nil)
+	if !clientAllowed(addr("198.51.100.1")) {
+		t.Fatal("expected any client allowed without CIDRs")
+	}
+
+	setCIDRs(
+		t, []string{"192.0.2.0/24", "2001:db8::/32"},
+		[]string{"192.0.2.128/25"}, nil,
+	)
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{addr: addr("192.0.2.1"), want: true},
+		{addr: addr("2001:db8::1"), want: true},
+		{addr: addr("198.51.100.1"), want: false},
+		{addr: addr("192.0.2.200"), want: false},
+		{addr: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := clientAllowed(tt.addr); got != tt.want {
+			t.Fatalf("%s: expected allowed to be %v", tt.addr, tt.want)
+		}
+	}
+
+	// Only a deny list allows everything outside of it
+	setCIDRs(t, nil, []string{"192.0.2.0/24"}, nil)
+	if clientAllowed(addr("192.0.2.1")) || !clientAllowed(addr("198.51.100.1")) {
+		t.Fatal("expected only the denied network rejected")
+	}
+}
+
+func TestTunnelAllowed(t *testing.T) {
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	setCIDRs(t, nil, nil, nil)
+	if !tunnelAllowed(addr("198.51.100.1")) {
+		t.Fatal("expected any tunnel allowed without CIDRs")
+	}
+
+	// The client lists don't apply to tunnels
+	setCIDRs(
+		t, []string{"198.51.100.0/24"}, []string{"10.1.0.0/16"},
+		[]string{"10.0.0.0/8"},
+	)
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{addr: addr("10.1.2.3"), want: true},
+		{addr: addr("198.51.100.1"), want: false},
+		{addr: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := tunnelAllowed(tt.addr); got != tt.want {
+			t.Fatalf("%s: expected allowed to be %v", tt.addr, tt.want)
+		}
+	}
+}
+
+func TestListenClientsDenied(t *testing.T) {
+	setCIDRs(t, nil, []string{"127.0.0.0/8"}, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	go listenClients(newService("web", &ServiceConfig{}), ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("error dialing: ", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); err == nil || (ok && nerr.Timeout()) {
+		t.Fatal("expected the denied client to be closed, got ", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Certs from files are kept up to date by reloading them when an external
+// client (e.g., certbot or lego) renews them. Services can instead have the
+// proxy obtain and renew their certs itself (see acme.go).
+
+var (
+	// clientTLSCertFile and clientTLSKeyFile are the cert and key to terminate
+	// TLS for the default service's clients with (see ServiceConfig.TLSCert).
+	clientTLSCertFile string
+	clientTLSKeyFile  string
+	// clientTLSALPN are the ALPN protocols offered to the default service's
+	// clients (see ServiceConfig.ALPN).
+	clientTLSALPN []string
+
+	// loadedCerts are the certs loaded by loadCert, keyed by their files.
+	loadedCerts = struct {
+		sync.Mutex
+		certs map[string]*loadedCert
+	}{certs: make(map[string]*loadedCert)}
+)
+
+// loadedCert is a cert loaded from files, along with when they were modified.
+type loadedCert struct {
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+	// stapled is the cert with its latest OCSP response stapled (nil if it
+	// has none yet; see stapleOCSP).
+	stapled atomic.Pointer[tls.Certificate]
+}
+
+// current returns the cert to use, with its OCSP response if it has one.
+func (lc *loadedCert) current() *tls.Certificate {
+	if cert := lc.stapled.Load(); cert != nil {
+		return cert
+	}
+	return lc.cert
+}
+
+// loadCert returns the cert from the files, reloading it if either file was
+// modified since it was loaded.
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	id := certFile + "\x00" + keyFile
+	loadedCerts.Lock()
+	defer loadedCerts.Unlock()
+	lc := loadedCerts.certs[id]
+	if lc != nil && lc.certMod.Equal(certInfo.ModTime()) &&
+		lc.keyMod.Equal(keyInfo.ModTime()) {
+		return lc.current(), nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		if lc != nil {
+			// Keep using the old cert in case the files are mid-renewal
+			log.Printf("Error reloading TLS cert %s: %v", certFile, err)
+			return lc.current(), nil
+		}
+		return nil, err
+	}
+	if lc != nil {
+		log.Print("Reloaded TLS cert ", certFile)
+	}
+	lc = &loadedCert{
+		cert: &cert, certMod: certInfo.ModTime(), keyMod: keyInfo.ModTime(),
+	}
+	loadedCerts.certs[id] = lc
+	if ocspStapling {
+		go lc.stapleOCSP(id)
+	}
+	return &cert, nil
+}
+
+// terminatedConn is a client conn whose TLS the proxy terminated.
+type terminatedConn struct {
+	*tls.Conn
+	// ja3 is the JA3 fingerprint of the client's hello (blank if unknown).
+	ja3 string
+}
+
+// terminateClientTLS handshakes with the service's client if the service
+// terminates TLS, returning the conn to pipe. If the client was the ACME CA,
+// whose challenge was answered, errACMEChallenge is returned (and the conn
+// closed).
+func (svc *service) terminateClientTLS(conn net.Conn) (net.Conn, error) {
+	sc := svc.config()
+	if !sc.terminatesTLS() {
+		return conn, nil
+	}
+	getCert := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return loadCert(sc.TLSCert, sc.TLSKey)
+	}
+	acmeCerts := len(sc.ACMEDomains) != 0
+	if acmeCerts {
+		getCert = acmeManager.GetCertificate
+	}
+	// Records the client hello for its fingerprint
+	hc := &helloRecorder{Conn: conn}
+	var ja3 string
+	tc := tls.Server(hc, tlsSettings.apply(&tls.Config{
+		NextProtos: sc.ALPN,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			ja3 = helloJA3(hc.stop())
+			if acmeCerts {
+				return acmeChallengeConfig(hello), nil
+			}
+			return nil, nil
+		},
+		GetCertificate: getCert,
+	}))
+	tc.SetDeadline(time.Now().Add(idleTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	if acmeCerts && tc.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		tc.Close()
+		return nil, errACMEChallenge
+	}
+	tc.SetDeadline(time.Time{})
+	return &terminatedConn{Conn: tc, ja3: ja3}, nil
+}
+
+// helloRecorder records what's read from the conn until stopped.
+type helloRecorder struct {
+	net.Conn
+	buf     bytes.Buffer
+	stopped bool
+}
+
+func (c *helloRecorder) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.stopped {
+		c.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// stop stops recording, returning what was recorded.
+func (c *helloRecorder) stop() []byte {
+	c.stopped = true
+	return c.buf.Bytes()
+}
+
+// NetConn returns the underlying conn.
+func (c *helloRecorder) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed cert for the name and its key to files in
+// the dir, returning the files.
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("error generating key: ", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("error creating cert: ", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal("error marshaling key: ", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadCertReloads(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "old.example.com")
+	old, err := loadCert(certFile, keyFile)
+	if err != nil {
+		t.Fatal("error loading cert: ", err)
+	}
+	if again, _ := loadCert(certFile, keyFile); again != old {
+		t.Fatal("expected the unchanged cert to be reused")
+	}
+
+	writeTestCert(t, dir, "new.example.com")
+	// Make sure the modification times differ on coarse filesystems
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	renewed, err := loadCert(certFile, keyFile)
+	if err != nil {
+		t.Fatal("error reloading cert: ", err)
+	} else if bytes.Equal(renewed.Certificate[0], old.Certificate[0]) {
+		t.Fatal("expected the renewed cert")
+	}
+
+	// A bad renewal keeps the last good cert
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	later = later.Add(time.Second)
+	os.Chtimes(keyFile, later, later)
+	if kept, err := loadCert(certFile, keyFile); err != nil || kept != renewed {
+		t.Fatalf("expected the last good cert to be kept (err: %v)", err)
+	}
+}
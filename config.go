@@ -0,0 +1,484 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+)
+
+// Config is the proxy config file.
+type Config struct {
+	// Services are the services tunnels can register for, keyed by name.
+	Services map[string]*ServiceConfig `json:"services"`
+	// Tags are the rules used to tag client connections.
+	Tags []*TagRule `json:"tags,omitempty"`
+	// AdminTokens are the bearer tokens accepted by the admin API. No tokens
+	// means the admin API only accepts requests from loopback addresses.
+	AdminTokens []*AdminToken `json:"admin-tokens,omitempty"`
+}
+
+// ServiceConfig is the config for a single service.
+type ServiceConfig struct {
+	// Addr is the address to listen for clients of the service on. A service
+	// without one (or a WSAddr) is only reachable through other services'
+	// routes. With port 0 (e.g., ":0"), the proxy picks a free port, which is
+	// reported to the tunnels and through the admin API.
+	Addr string `json:"addr,omitempty"`
+	// WSAddr is the address to listen for WebSocket clients (e.g., browsers)
+	// of the service on. The messages of each WebSocket conn are piped as a
+	// byte stream.
+	WSAddr string `json:"ws-addr,omitempty"`
+	// UDPAddr is the address to listen for UDP clients of the service on. Each
+	// client's datagrams are relayed through its own tunnel conn, so the
+	// service's tunnels must relay them to UDP servers (see the tunnel's udp).
+	UDPAddr string `json:"udp-addr,omitempty"`
+	// WSOrigins are the Origin headers accepted from WebSocket clients (empty
+	// means any are).
+	WSOrigins []string `json:"ws-origins,omitempty"`
+	// Routes are checked in order against each client's address. The client
+	// is paired with a tunnel conn from the first matching route's service,
+	// or from this service if none match.
+	Routes []*RouteConfig `json:"routes,omitempty"`
+	// Schedule holds the windows during which clients are accepted. Outside
+	// of them, clients are sent the maintenance response (if any) and closed.
+	// No windows means clients are always accepted.
+	Schedule []*ScheduleWindow `json:"schedule,omitempty"`
+	// Timezone is the IANA timezone the schedule is in (blank means local).
+	Timezone string `json:"timezone,omitempty"`
+	// MaintenanceResponse is written to clients rejected by the schedule.
+	MaintenanceResponse string `json:"maintenance-response,omitempty"`
+	// Policy is the name of the load-balancing policy used to pick which
+	// tunnel each client is paired with (blank means lowest-latency).
+	Policy string `json:"policy,omitempty"`
+	// Reject is an expression (see Expr) that rejects the clients it matches.
+	Reject string `json:"reject,omitempty"`
+	// Tokens reserves the service for the tunnels using the named tokens so
+	// that no other tunnel can register for it (e.g., while the reserving
+	// tunnel is briefly disconnected). Tunnels using the password can always
+	// register. Empty means any token can.
+	Tokens []string `json:"tokens,omitempty"`
+	// TunnelSelector restricts the service's clients to the tunnels
+	// registered with all of its tags (e.g., {"region": "eu"}). Empty means
+	// any tunnel.
+	TunnelSelector tunnelSelector `json:"tunnel-selector,omitempty"`
+	// Record records complete sessions of the clients piped through the
+	// service's tunnels (see the proxy's record-dir). Clients whose sessions
+	// can't be recorded are disconnected.
+	Record bool `json:"record,omitempty"`
+	// Fallback is the address (e.g., of a "service offline" page server or
+	// another datacenter) that clients are piped to when the service has no
+	// tunnels for them or none becomes available in time. Blank means such
+	// clients are closed.
+	Fallback string `json:"fallback,omitempty"`
+	// TLSCert and TLSKey are the PEM-encoded cert and key files to terminate
+	// TLS for the service's clients (on addr) with, so tunnels get plaintext.
+	// They're reloaded when they change (e.g., when renewed by certbot).
+	TLSCert string `json:"tls-cert,omitempty"`
+	TLSKey  string `json:"tls-key,omitempty"`
+	// ACMEDomains are the domains to terminate TLS for the service's clients
+	// with certs for, obtained and renewed with ACME (see acme.go), in place
+	// of tls-cert.
+	ACMEDomains []string `json:"acme-domains,omitempty"`
+	// ALPN are the protocols (e.g., "h2" and "http/1.1") offered to clients
+	// when terminating their TLS (empty means none, which HTTP clients take
+	// as HTTP/1.1). Offering "h2" requires the servers to speak HTTP/2 without
+	// TLS (h2c) since the negotiated protocol is piped to them as is.
+	ALPN []string `json:"alpn,omitempty"`
+	// Mode is how the service's clients are handled: blank pipes them to the
+	// tunnels' servers, and "connect" or "socks" make the service an HTTP
+	// CONNECT proxy or SOCKS5 server whose clients' destinations are dialed by
+	// the tunnels (which must have egress). "http" routes clients by the Host
+	// of their first request to tunnels serving it (see the tunnel's
+	// http-hosts), responding 502 if there are none. Routes must be to
+	// services of the same mode.
+	Mode string `json:"mode,omitempty"`
+	// StreamIdleTimeout is how long the service's piped connections may go
+	// without bytes in either direction before they're closed (e.g., "5m";
+	// "0" means never; blank means the stream-idle-timeout flag's). gRPC
+	// streams detected in http mode are always exempt.
+	StreamIdleTimeout string `json:"stream-idle-timeout,omitempty"`
+	// HTTPDomain is the domain (e.g., "tunnel.example.com", whose wildcard
+	// DNS points at the proxy) whose subdomains are assigned to named tunnels
+	// without hosts in http mode, e.g., "web.tunnel.example.com" to the
+	// tunnel named "web". Requires mode "http".
+	HTTPDomain string `json:"http-domain,omitempty"`
+	// Inspect is the number of the service's recent HTTP/1.x requests (and
+	// their responses) kept for the admin API's inspector, which can replay
+	// them (0 means none). Requires mode "http", and only requests the proxy
+	// can read (in plaintext or with their TLS terminated) are kept.
+	Inspect int `json:"inspect,omitempty"`
+	// AcceptProxyProtocol is whether the clients on addr are preceded by a
+	// PROXY protocol header (v1 or v2; e.g., from an AWS NLB), whose client
+	// address is used in place of the conn's for the ACLs and logs and is
+	// forwarded to the tunnels (see the tunnel's proxy-protocol). Clients
+	// without a header are rejected.
+	AcceptProxyProtocol bool `json:"accept-proxy-protocol,omitempty"`
+	// JA3 is whether the JA3 fingerprints of clients' TLS client hellos are
+	// included in the logs and metrics. Unless the proxy terminates their TLS,
+	// the client hellos are peeked at, so clients must speak first (as TLS
+	// clients do).
+	JA3 bool `json:"ja3,omitempty"`
+	// JA3Blocklist are the JA3 fingerprints (MD5 hex) whose clients are
+	// rejected (e.g., those of abusive bots). Implies ja3.
+	JA3Blocklist []string `json:"ja3-blocklist,omitempty"`
+
+	loc    *time.Location
+	policy tunnelit.Policy
+	reject *Expr
+	// peekHello is whether clients' TLS client hellos are needed (for their
+	// SNI or fingerprint).
+	peekHello bool
+	// ja3Blocked is the set of JA3Blocklist.
+	ja3Blocked map[string]bool
+	// streamIdle is the parsed StreamIdleTimeout.
+	streamIdle time.Duration
+}
+
+// TunnelConfig is the tunnel config file.
+type TunnelConfig struct {
+	// Services are the services the tunnel serves, keyed by name.
+	Services map[string]*TunnelServiceConfig `json:"services"`
+}
+
+// TunnelServiceConfig is the tunnel's config for a single service.
+type TunnelServiceConfig struct {
+	// Saddrs are the addresses of the servers to pipe to, rotated through per
+	// connection. Those of the form k8s://namespace/service:port are the
+	// ready endpoints of the Kubernetes service, watched for changes.
+	Saddrs []string `json:"saddrs"`
+	// MinIdle is the number of idle conns kept for the service in addition to
+	// (and independent of) the shared idle conns.
+	MinIdle uint `json:"min-idle,omitempty"`
+	// Weight is the tunnel's weight for the service's weighted policy (0
+	// means 1).
+	Weight uint `json:"weight,omitempty"`
+	// WakeMAC is the MAC address to send a Wake-on-LAN magic packet to when
+	// the servers can't be dialed (blank means don't).
+	WakeMAC string `json:"wake-mac,omitempty"`
+	// WakeAddr is the (broadcast) address to send magic packets to (blank
+	// means 255.255.255.255:9).
+	WakeAddr string `json:"wake-addr,omitempty"`
+	// WakeWait is how long to wait for the woken server (e.g., "30s"; blank
+	// means 30s).
+	WakeWait string `json:"wake-wait,omitempty"`
+	// UDP is whether the servers are UDP servers, relaying the datagrams of
+	// the service's UDP clients (see the proxy's udp-addr).
+	UDP bool `json:"udp,omitempty"`
+	// Egress is whether the tunnel dials the destinations clients of the
+	// service ask for (see the proxy's connect and socks modes). Saddrs are
+	// optional with it.
+	Egress bool `json:"egress,omitempty"`
+	// EgressCIDRs are the networks the destinations must be in (empty means
+	// any).
+	EgressCIDRs []string `json:"egress-cidrs,omitempty"`
+	// ProxyProtocol is the version of the PROXY protocol header ("v1" or
+	// "v2") sent to the servers with the clients' addresses (blank means
+	// none). Not supported with UDP.
+	ProxyProtocol string `json:"proxy-protocol,omitempty"`
+	// HTTPHosts are the HTTP hosts the tunnel serves for the service (see
+	// the proxy's http mode), which are matched like SNI patterns (e.g.,
+	// "*.example.com").
+	HTTPHosts []string `json:"http-hosts,omitempty"`
+	// Mux is whether the service's clients are multiplexed over a single
+	// conn (a session) to the proxy rather than each taking an idle conn
+	// (min-idle is then ignored).
+	Mux bool `json:"mux,omitempty"`
+	// Link is whether the tunnel keeps a link to the proxy for the service,
+	// so that losing the connection to the proxy is noticed within seconds.
+	Link bool `json:"link,omitempty"`
+
+	waker      *waker
+	k8s        []*k8sBackend
+	egressNets []*net.IPNet
+}
+
+// parse parses the service's server addresses, wake settings, egress
+// networks, and PROXY protocol version.
+func (sc *TunnelServiceConfig) parse() error {
+	if err := sc.parseBackends(); err != nil {
+		return err
+	} else if err := sc.parseWake(); err != nil {
+		return err
+	} else if len(sc.EgressCIDRs) != 0 && !sc.Egress {
+		return errors.New("egress-cidrs requires egress")
+	} else if err := validProxyProtocol(sc.ProxyProtocol); err != nil {
+		return err
+	} else if sc.ProxyProtocol != "" && sc.UDP {
+		return errors.New("proxy-protocol isn't supported with udp")
+	}
+	var err error
+	if sc.egressNets, err = parseCIDRs(sc.EgressCIDRs); err != nil {
+		return fmt.Errorf("egress-cidrs: %w", err)
+	}
+	return nil
+}
+
+// LoadTunnelConfig loads and validates the tunnel config at the given path.
+func LoadTunnelConfig(path string) (*TunnelConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &TunnelConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
+	}
+	if cfg.Services == nil {
+		cfg.Services = make(map[string]*TunnelServiceConfig)
+	}
+	for name, sc := range cfg.Services {
+		if sc == nil || (len(sc.Saddrs) == 0 && !sc.Egress) {
+			return nil, fmt.Errorf("service %q: missing saddrs", name)
+		}
+		if err := sc.parse(); err != nil {
+			return nil, fmt.Errorf("service %q: %w", name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// RouteConfig routes clients from certain networks to another service.
+type RouteConfig struct {
+	// CIDRs are the networks the client's address must be in (any of).
+	CIDRs []string `json:"cidrs,omitempty"`
+	// When is an expression (see Expr) the client must match.
+	When string `json:"when,omitempty"`
+	// SNI are the server names (e.g., "db.example.com" or "*.example.com")
+	// the SNI of the client's TLS client hello must match (any of). The hello
+	// is peeked at without terminating TLS, so routes can pass TLS services
+	// through to different tunnels.
+	SNI     []string `json:"sni,omitempty"`
+	Service string   `json:"service"`
+	// TunnelSelector, if set, overrides the routed service's tunnel selector
+	// for the matching clients, partitioning the service's tunnels (e.g.,
+	// routing a region's clients to the tunnels in it).
+	TunnelSelector tunnelSelector `json:"tunnel-selector,omitempty"`
+
+	nets []*net.IPNet
+	when *Expr
+}
+
+// LoadConfig loads and validates the config at the given path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
+	}
+	if cfg.Services == nil {
+		cfg.Services = make(map[string]*ServiceConfig)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	for i, at := range cfg.AdminTokens {
+		if err := at.parse(); err != nil {
+			return fmt.Errorf("admin token %d: %w", i, err)
+		}
+	}
+	for i, tr := range cfg.Tags {
+		if err := tr.parse(); err != nil {
+			return fmt.Errorf("tag rule %d: %w", i, err)
+		}
+	}
+	for name, sc := range cfg.Services {
+		if sc == nil {
+			sc = &ServiceConfig{}
+			cfg.Services[name] = sc
+		}
+		if err := sc.parseSchedule(); err != nil {
+			return fmt.Errorf("service %q: %w", name, err)
+		}
+		var err error
+		if sc.policy, err = tunnelit.NewPolicy(sc.Policy); err != nil {
+			return fmt.Errorf("service %q: %w", name, err)
+		}
+		if sc.Fallback != "" {
+			if sc.Mode != "" {
+				return fmt.Errorf(
+					"service %q: fallback isn't supported with mode %q", name, sc.Mode,
+				)
+			}
+			if _, _, err := net.SplitHostPort(sc.Fallback); err != nil {
+				return fmt.Errorf("service %q fallback: %w", name, err)
+			}
+		}
+		if (sc.TLSCert == "") != (sc.TLSKey == "") {
+			return fmt.Errorf(
+				"service %q: must provide both tls-cert and tls-key or neither", name,
+			)
+		} else if sc.TLSCert != "" && len(sc.ACMEDomains) != 0 {
+			return fmt.Errorf(
+				"service %q: tls-cert and acme-domains are mutually exclusive", name,
+			)
+		} else if len(sc.ALPN) != 0 && !sc.terminatesTLS() {
+			return fmt.Errorf("service %q: alpn requires tls-cert or acme-domains", name)
+		}
+		switch sc.Mode {
+		case "", modeConnect, modeSocks, modeHTTP:
+		default:
+			return fmt.Errorf("service %q: unknown mode %q", name, sc.Mode)
+		}
+		if sc.StreamIdleTimeout != "" {
+			sc.streamIdle, err = time.ParseDuration(sc.StreamIdleTimeout)
+			if err != nil {
+				return fmt.Errorf("service %q stream-idle-timeout: %w", name, err)
+			} else if sc.streamIdle < 0 {
+				return fmt.Errorf(
+					"service %q: stream-idle-timeout must not be negative", name,
+				)
+			}
+		}
+		if sc.HTTPDomain != "" && sc.Mode != modeHTTP {
+			return fmt.Errorf("service %q: http-domain requires mode %q", name, modeHTTP)
+		}
+		if sc.Inspect < 0 {
+			return fmt.Errorf("service %q: inspect must not be negative", name)
+		} else if sc.Inspect != 0 && sc.Mode != modeHTTP {
+			return fmt.Errorf("service %q: inspect requires mode %q", name, modeHTTP)
+		}
+		if sc.JA3 || len(sc.JA3Blocklist) != 0 {
+			if sc.dialsDestinations() {
+				return fmt.Errorf("service %q: ja3 isn't supported with mode %q", name, sc.Mode)
+			}
+			sc.peekHello = true
+		}
+		sc.ja3Blocked = make(map[string]bool, len(sc.JA3Blocklist))
+		for _, fp := range sc.JA3Blocklist {
+			if b, err := hex.DecodeString(fp); err != nil || len(b) != md5.Size {
+				return fmt.Errorf("service %q: invalid JA3 fingerprint %q", name, fp)
+			}
+			sc.ja3Blocked[strings.ToLower(fp)] = true
+		}
+		if sc.Reject != "" {
+			if sc.reject, err = CompileExpr(sc.Reject); err != nil {
+				return fmt.Errorf("service %q reject: %w", name, err)
+			}
+		}
+		for i, rc := range sc.Routes {
+			if rsc, ok := cfg.Services[rc.Service]; !ok {
+				return fmt.Errorf(
+					"service %q route %d: unknown service %q", name, i, rc.Service,
+				)
+			} else if rsc == nil && sc.Mode != "" ||
+				rsc != nil && rsc.Mode != sc.Mode {
+				return fmt.Errorf(
+					"service %q route %d: service %q has a different mode",
+					name, i, rc.Service,
+				)
+			}
+			if len(rc.CIDRs) == 0 && rc.When == "" && len(rc.SNI) == 0 {
+				return fmt.Errorf(
+					"service %q route %d: missing cidrs, when, or sni", name, i,
+				)
+			}
+			if len(rc.SNI) != 0 {
+				sc.peekHello = true
+			}
+			if rc.When != "" {
+				if rc.when, err = CompileExpr(rc.When); err != nil {
+					return fmt.Errorf("service %q route %d: %w", name, i, err)
+				}
+			}
+			rc.nets = rc.nets[:0]
+			for _, cidr := range rc.CIDRs {
+				_, ipNet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return fmt.Errorf("service %q route %d: %w", name, i, err)
+				}
+				rc.nets = append(rc.nets, ipNet)
+			}
+		}
+	}
+	return nil
+}
+
+// dialsDestinations returns whether the service's clients ask for
+// destinations dialed by the tunnels (connect and socks modes).
+func (sc *ServiceConfig) dialsDestinations() bool {
+	return sc.Mode == modeConnect || sc.Mode == modeSocks
+}
+
+// terminatesTLS returns whether the proxy terminates the TLS of the service's
+// clients (with tls-cert or acme-domains).
+func (sc *ServiceConfig) terminatesTLS() bool {
+	return sc.TLSCert != "" || len(sc.ACMEDomains) != 0
+}
+
+// streamIdleTimeout returns how long the service's piped connections may be
+// idle (0 means forever).
+func (sc *ServiceConfig) streamIdleTimeout() time.Duration {
+	if sc.StreamIdleTimeout == "" {
+		return streamIdleTimeout
+	}
+	return sc.streamIdle
+}
+
+// Matches returns whether the IP is in any of the route's networks (if any)
+// and the env matches the route's expression (if any).
+func (rc *RouteConfig) Matches(ip net.IP, env *exprEnv) bool {
+	if len(rc.nets) != 0 {
+		matched := false
+		for _, ipNet := range rc.nets {
+			if ipNet.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rc.SNI) != 0 && !sniMatches(rc.SNI, env.sni) {
+		return false
+	}
+	return rc.when == nil || evalRule(rc.when, env)
+}
+
+// sniMatches returns whether the SNI matches any of the server names, which
+// may be wildcards of a single label (e.g., "*.example.com").
+func sniMatches(names []string, sni string) bool {
+	if sni == "" {
+		return false
+	}
+	sni = strings.ToLower(sni)
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == sni {
+			return true
+		}
+		if strings.HasPrefix(name, "*.") {
+			if _, rest, ok := strings.Cut(sni, "."); ok && rest == name[2:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evalRule evaluates the rule's expression, logging any error and treating it
+// as not matching.
+func evalRule(e *Expr, env *exprEnv) bool {
+	matched, err := e.Eval(env)
+	if err != nil {
+		log.Printf("Error evaluating %q: %v", e, err)
+		return false
+	}
+	return matched
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the config to a temp file, returning its path.
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTunnelConfig(t *testing.T) {
+	path := writeConfig(t, `{"services": {
+		"web": {"saddrs": ["127.0.0.1:8080", "127.0.0.1:8081"], "min-idle": 2},
+		"": {"saddrs": ["127.0.0.1:9000"]}
+	}}`)
+	cfg, err := LoadTunnelConfig(path)
+	if err != nil {
+		t.Fatal("error loading config: ", err)
+	}
+	if len(cfg.Services) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(cfg.Services))
+	}
+	web := cfg.Services["web"]
+	if web == nil || len(web.Saddrs) != 2 || web.MinIdle != 2 {
+		t.Fatalf("expected web with 2 saddrs and 2 min idle, got %+v", web)
+	}
+
+	cfg, err = LoadTunnelConfig(writeConfig(t, `{}`))
+	if err != nil {
+		t.Fatal("error loading empty config: ", err)
+	} else if cfg.Services == nil {
+		t.Fatal("expected an empty services map")
+	}
+
+	for _, config := range []string{
+		`{"services": {"web": {"min-idle": 1}}}`,
+		`{"services": {"web": null}}`,
+		`{"services": `,
+	} {
+		if _, err := LoadTunnelConfig(writeConfig(t, config)); err == nil {
+			t.Fatalf("expected an error loading %s", config)
+		}
+	}
+	if _, err := LoadTunnelConfig(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Fatal("expected an error loading a nonexistent config")
+	}
+}
+
+func TestSNIMatches(t *testing.T) {
+	names := []string{"db.example.com", "*.apps.example.com"}
+	tests := []struct {
+		sni  string
+		want bool
+	}{
+		{sni: "db.example.com", want: true},
+		{sni: "DB.Example.com", want: true},
+		{sni: "web.apps.example.com", want: true},
+		{sni: "apps.example.com"},
+		{sni: "a.web.apps.example.com"},
+		{sni: "web.example.com"},
+		{sni: ""},
+	}
+	for _, tt := range tests {
+		if got := sniMatches(names, tt.sni); got != tt.want {
+			t.Fatalf("%q: expected matches to be %v", tt.sni, tt.want)
+		}
+	}
+}
+
+func TestSNIRoutes(t *testing.T) {
+	cfg := &Config{Services: map[string]*ServiceConfig{
+		"tls": {
+			Addr: "127.0.0.1:0",
+			Routes: []*RouteConfig{
+				{SNI: []string{"db.example.com"}, Service: "db"},
+			},
+		},
+		"db": {Addr: "127.0.0.1:0"},
+	}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal("error validating config: ", err)
+	} else if !cfg.Services["tls"].peekHello || cfg.Services["db"].peekHello {
+		t.Fatal("expected only the service with SNI routes to peek at hellos")
+	}
+
+	rc := cfg.Services["tls"].Routes[0]
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	for sni, want := range map[string]bool{
+		"db.example.com": true, "web.example.com": false, "": false,
+	} {
+		env := newClientEnv(addr, sni, "tls", nil, time.Now())
+		if got := rc.Matches(addr.IP, env); got != want {
+			t.Fatalf("%q: expected the route to match to be %v", sni, want)
+		}
+	}
+
+	cfg.Services["tls"].Routes[0].SNI = nil
+	if err := cfg.validate(); err == nil {
+		t.Fatal("expected an error for a route without a condition")
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	oldTimeout := streamIdleTimeout
+	streamIdleTimeout = time.Hour
+	t.Cleanup(func() { streamIdleTimeout = oldTimeout })
+	tests := []struct {
+		timeout string
+		want    time.Duration
+		ok      bool
+	}{
+		{timeout: "", want: time.Hour, ok: true},
+		{timeout: "5m", want: 5 * time.Minute, ok: true},
+		{timeout: "0", want: 0, ok: true},
+		{timeout: "-1m"},
+		{timeout: "soon"},
+	}
+	for _, tt := range tests {
+		sc := &ServiceConfig{Addr: "127.0.0.1:0", StreamIdleTimeout: tt.timeout}
+		cfg := &Config{Services: map[string]*ServiceConfig{"svc": sc}}
+		if err := cfg.validate(); (err == nil) != tt.ok {
+			t.Fatalf("%q: expected valid to be %v, got %v", tt.timeout, tt.ok, err)
+		} else if tt.ok && sc.streamIdleTimeout() != tt.want {
+			t.Fatalf(
+				"%q: expected %s, got %s",
+				tt.timeout, tt.want, sc.streamIdleTimeout(),
+			)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Services in connect mode (see ServiceConfig.Mode) are HTTP CONNECT proxies:
+// each client asks for a destination, which the service's tunnels dial in
+// place of their servers (see the tunnel's egress), so clients can reach any
+// host reachable from the tunnels' machines.
+
+// modeConnect is the mode of services whose clients speak HTTP CONNECT.
+const modeConnect = "connect"
+
+var (
+	// flagHTTPConnect is whether the default service is in connect mode
+	// (overriding the config).
+	flagHTTPConnect bool
+	// tunnelEgress is whether the default service's tunnel dials the
+	// destinations clients ask for.
+	tunnelEgress bool
+	// tunnelEgressCIDRs are the networks the default service's destinations
+	// must be in (empty means any).
+	tunnelEgressCIDRs []string
+)
+
+// errDialFailed is returned when the tunnel couldn't dial a destination.
+var errDialFailed = errors.New("tunnel couldn't dial destination")
+
+// clientDial is a destination a client asked for, which the tunnel dials in
+// place of its servers.
+type clientDial struct {
+	req DialRequest
+	// reply tells the client whether the destination was dialed.
+	reply func(ok bool) error
+}
+
+// fail tells the client (if it asked for a destination) that the destination
+// couldn't be dialed.
+func (d *clientDial) fail() {
+	if d != nil {
+		d.reply(false)
+	}
+}
+
+// readClientDial reads the destination the client of a service in the given
+// mode asked for, returning the conn to pipe.
+func readClientDial(conn net.Conn, mode string) (*clientDial, net.Conn, error) {
+	if mode == modeSocks {
+		dial, err := readSocksRequest(conn)
+		return dial, conn, err
+	}
+	return readConnectRequest(conn)
+}
+
+// readConnectRequest reads the client's CONNECT request, returning the
+// destination and the conn to pipe, which replays anything the client sent
+// after the request.
+func readConnectRequest(conn net.Conn) (*clientDial, net.Conn, error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, conn, err
+	}
+	if req.Method != http.MethodConnect {
+		rejectClient(
+			conn,
+			"HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n",
+		)
+		return nil, conn, fmt.Errorf("method %s isn't CONNECT", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		rejectClient(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+		return nil, conn, fmt.Errorf("invalid destination: %w", err)
+	}
+	dial := &clientDial{
+		req: DialRequest{Addr: req.Host},
+		reply: func(ok bool) error {
+			resp := "HTTP/1.1 200 Connection established\r\n\r\n"
+			if !ok {
+				resp = "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"
+			}
+			conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+			defer conn.SetWriteDeadline(time.Time{})
+			_, err := conn.Write([]byte(resp))
+			return err
+		},
+	}
+	if n := br.Buffered(); n != 0 {
+		b, _ := br.Peek(n)
+		conn = &replayConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(append([]byte(nil), b...)), conn),
+		}
+	}
+	return dial, conn, nil
+}
+
+// dialEgress dials the destination a client asked for, which must be in the
+// service's egress networks (if any).
+func (ts *tunnelService) dialEgress(addr string) (net.Conn, error) {
+	if len(ts.egressNets) == 0 {
+		return dialer.Dial(tcpNetwork, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), idleTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// Dial the checked IP rather than the host so the check can't be raced by
+	// another lookup
+	for _, ip := range ips {
+		if netsContain(ts.egressNets, ip.IP) {
+			return dialer.Dial(tcpNetwork, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	return nil, fmt.Errorf("%s isn't in the egress CIDRs", host)
+}
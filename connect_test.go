@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+	"github.com/johnietre/utils/go"
+)
+
+func TestReadConnectRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// addr is the destination read (blank means an error is expected).
+		addr string
+		// rest is what the client sent after the request.
+		rest string
+		// written is the start of the response to the client.
+		written string
+	}{
+		{
+			name:    "CONNECT",
+			input:   "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			addr:    "example.com:443",
+			written: "HTTP/1.1 200 ",
+		},
+		{
+			name:    "data after request",
+			input:   "CONNECT [::1]:22 HTTP/1.1\r\nHost: [::1]:22\r\n\r\nSSH-2.0-test\r\n",
+			addr:    "[::1]:22",
+			rest:    "SSH-2.0-test\r\n",
+			written: "HTTP/1.1 200 ",
+		},
+		{name: "empty"},
+		{name: "not HTTP", input: "\x16\x03\x01\x00\x05hello\r\n\r\n"},
+		{name: "truncated", input: "CONNECT example.com:443 HTTP/1.1\r\n"},
+		{
+			name:    "GET",
+			input:   "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			written: "HTTP/1.1 405 ",
+		},
+		{
+			name:    "missing port",
+			input:   "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			written: "HTTP/1.1 400 ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, written := scriptedConn(t, []byte(tt.input))
+			dial, piped, err := readConnectRequest(conn)
+			if tt.addr == "" {
+				if err == nil {
+					t.Fatalf("expected error, got destination %s", dial.req.Addr)
+				}
+			} else if err != nil {
+				t.Fatal("error reading request: ", err)
+			} else if dial.req.Addr != tt.addr {
+				t.Fatalf("expected destination %s, got %s", tt.addr, dial.req.Addr)
+			} else if rest, err := io.ReadAll(piped); err != nil || string(rest) != tt.rest {
+				t.Fatalf("expected %q after request, got %q (err: %v)", tt.rest, rest, err)
+			} else if err := dial.reply(true); err != nil {
+				t.Fatal("error replying: ", err)
+			}
+			conn.Close()
+			if got := string(<-written); !strings.HasPrefix(got, tt.written) ||
+				(tt.written == "" && got != "") {
+				t.Fatalf("expected response starting %q, got %q", tt.written, got)
+			}
+		})
+	}
+}
+
+func TestDialEgress(t *testing.T) {
+	addr := tunnelittest.StartEchoBackend(t)
+	_, port, _ := net.SplitHostPort(addr)
+	tests := []struct {
+		name  string
+		cidrs []string
+		addr  string
+		ok    bool
+	}{
+		{name: "any", addr: addr, ok: true},
+		{name: "in CIDRs", cidrs: []string{"127.0.0.0/8"}, addr: addr, ok: true},
+		{
+			name:  "name resolving into CIDRs",
+			cidrs: []string{"127.0.0.0/8"},
+			addr:  net.JoinHostPort("localhost", port),
+			ok:    true,
+		},
+		{name: "outside CIDRs", cidrs: []string{"10.0.0.0/8"}, addr: addr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &TunnelServiceConfig{
+				Saddrs: []string{addr}, Egress: true, EgressCIDRs: tt.cidrs,
+			}
+			if err := sc.parse(); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := newTunnelService("egress", sc).dialEgress(tt.addr)
+			if !tt.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error dialing: ", err)
+			}
+			defer conn.Close()
+			b := []byte("ping")
+			if _, err := conn.Write(b); err != nil {
+				t.Fatal("error writing: ", err)
+			} else if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+				t.Fatalf("expected echo, got %q (err: %v)", b, err)
+			}
+		})
+	}
+}
+
+func TestServeReadyDial(t *testing.T) {
+	addr := tunnelittest.StartEchoBackend(t)
+	sc := &TunnelServiceConfig{
+		Saddrs: []string{addr}, Egress: true, EgressCIDRs: []string{"127.0.0.0/8"},
+	}
+	if err := sc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTunnelService("egress", sc)
+	tests := []struct {
+		addr string
+		want byte
+	}{
+		{addr: addr, want: connReady},
+		{addr: "192.0.2.1:443", want: dialFailed},
+	}
+	for _, tt := range tests {
+		tunnelSide, proxySide := net.Pipe()
+		defer proxySide.Close()
+		proxySide.SetDeadline(time.Now().Add(5 * time.Second))
+		released := make(chan utils.Unit, 1)
+		go ts.serveReady(tunnelSide, connDial, func() {
+			released <- utils.Unit{}
+		})
+		if err := writeMsg(proxySide, DialRequest{Addr: tt.addr}); err != nil {
+			t.Fatal("error writing dial request: ", err)
+		}
+		b := []byte{0}
+		if _, err := io.ReadFull(proxySide, b); err != nil || b[0] != tt.want {
+			t.Fatalf(
+				"%s: expected %d, got %d (err: %v)", tt.addr, tt.want, b[0], err,
+			)
+		}
+		<-released
+		if tt.want != connReady {
+			continue
+		}
+		// The client is piped to the destination
+		go proxySide.Write([]byte("ping"))
+		got := make([]byte, 4)
+		_, err := io.ReadFull(proxySide, got)
+		if err != nil || string(got) != "ping" {
+			t.Fatalf("expected the destination's echo, got %q (err: %v)", got, err)
+		}
+	}
+}
+
+// putFakeEgressConn puts a conn of a fake egress tunnel in the service's pool,
+// sending the dial requests it receives on reqs and responding with resp.
+func putFakeEgressConn(
+	t *testing.T, svc *service, resp byte, reqs chan<- DialRequest,
+) {
+	t.Helper()
+	tunnelSide, proxySide := net.Pipe()
+	t.Cleanup(func() { tunnelSide.Close() })
+	go func() {
+		b := []byte{0}
+		if _, err := io.ReadFull(tunnelSide, b); err != nil || b[0] != connDial {
+			return
+		}
+		var req DialRequest
+		if err := readMsg(tunnelSide, &req); err != nil {
+			return
+		}
+		reqs <- req
+		tunnelSide.Write([]byte{resp})
+		io.Copy(tunnelSide, tunnelSide)
+	}()
+	svc.idle.Put(proxySide, "egress", tunnelInfo{weight: 1})
+}
+
+func TestHandleClientConnDial(t *testing.T) {
+	oldReadyCh := readyCh
+	readyCh = make(chan utils.Unit, 10)
+	t.Cleanup(func() { readyCh = oldReadyCh })
+
+	for _, resp := range []byte{connReady, dialFailed} {
+		svc := newService("proxy", &ServiceConfig{Mode: modeConnect})
+		reqs := make(chan DialRequest, 1)
+		putFakeEgressConn(t, svc, resp, reqs)
+		replies := make(chan bool, 1)
+		dial := &clientDial{
+			req: DialRequest{Addr: "example.com:443"},
+			reply: func(ok bool) error {
+				replies <- ok
+				return nil
+			},
+		}
+		clientConn, proxySide := net.Pipe()
+		defer clientConn.Close()
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		go handleClientConn(
+			proxySide, svc, tunnelFilter{}, nil, "", dial, httpHead{},
+		)
+		if req := <-reqs; req.Addr != "example.com:443" {
+			t.Fatalf("expected the client's destination sent, got %s", req.Addr)
+		} else if ok := <-replies; ok != (resp == connReady) {
+			t.Fatalf("%d: expected the client replied %v", resp, !ok)
+		}
+		if resp != connReady {
+			if _, err := clientConn.Read(make([]byte, 1)); err == nil {
+				t.Fatal("expected the client closed after a failed dial")
+			}
+			continue
+		}
+		go clientConn.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(clientConn, b); err != nil || string(b) != "ping" {
+			t.Fatalf("expected the client piped, got %q (err: %v)", b, err)
+		}
+	}
+}
+
+func TestEgressRequired(t *testing.T) {
+	setTestPassword(t)
+	setState(t, newState(""))
+	svc := newService("proxy", &ServiceConfig{Mode: modeConnect})
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"proxy": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+
+	pwdHash := sha256.Sum256([]byte(tunnelittest.DefaultPassword))
+	tests := []struct {
+		egress bool
+		want   byte
+	}{
+		{egress: false, want: egressRequired},
+		{egress: true, want: passwordOk},
+	}
+	for _, tt := range tests {
+		reg := Registration{Service: "proxy", Egress: tt.egress}
+		if status, _ := registerTunnel(t, pwdHash, reg); status != tt.want {
+			t.Fatalf(
+				"egress %v: expected %s, got %s", tt.egress,
+				tunnelit.StatusText(tt.want), tunnelit.StatusText(status),
+			)
+		}
+	}
+}
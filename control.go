@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// controlSocket, if set, is the path of the unix socket the tunnel serves its
+// control API on.
+var controlSocket string
+
+// runControl serves the control API on the unix socket at the path, letting
+// local processes add and remove the services being tunneled.
+func runControl(path string, sel *proxySelector) {
+	// Remove the socket left by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Fatal("Error removing old control socket: ", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatal("Error listening on control socket: ", err)
+	}
+	// Only let the tunnel's user control it
+	if err := os.Chmod(path, 0600); err != nil {
+		log.Fatal("Error setting control socket permissions: ", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		handleControlServices(w, r, sel)
+	})
+	mux.HandleFunc("/services/", handleControlService)
+	log.Print("Listening for control requests on ", path)
+	if err := http.Serve(ln, mux); err != nil {
+		log.Fatal("Error serving control API: ", err)
+	}
+}
+
+// ControlService is a service being tunneled, as reported by the control API.
+type ControlService struct {
+	Service string   `json:"service"`
+	Saddrs  []string `json:"saddrs"`
+	// Endpoints are the addresses the proxies reported clients can reach the
+	// service on.
+	Endpoints []string   `json:"endpoints"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	// Link is the proxy's last status over the service's link (nil if there
+	// is none).
+	Link *LinkStatus `json:"link,omitempty"`
+}
+
+func (ts *tunnelService) controlInfo() ControlService {
+	info := ControlService{
+		Service:   ts.reg.Service,
+		Saddrs:    ts.backends.specs,
+		Endpoints: ts.endpointAddrs(),
+	}
+	if !ts.expires.IsZero() {
+		info.Expires = &ts.expires
+	}
+	ts.linkMtx.Lock()
+	info.Link = ts.linkStatus
+	ts.linkMtx.Unlock()
+	return info
+}
+
+// handleControlServices handles listing (GET) and adding (POST) services.
+// Adding a service waits for the proxy to register it, responding with its
+// endpoints.
+func handleControlServices(
+	w http.ResponseWriter, r *http.Request, sel *proxySelector,
+) {
+	switch r.Method {
+	case http.MethodGet:
+		tss := allTunnelServices()
+		sort.Slice(tss, func(i, j int) bool {
+			return tss[i].reg.Service < tss[j].reg.Service
+		})
+		infos := make([]ControlService, len(tss))
+		for i, ts := range tss {
+			infos[i] = ts.controlInfo()
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case http.MethodPost:
+		var req struct {
+			Service string `json:"service"`
+			// TTL is how long until the service is removed (blank means never).
+			TTL string `json:"ttl"`
+			TunnelServiceConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sc := &req.TunnelServiceConfig
+		if len(sc.Saddrs) == 0 {
+			http.Error(w, "Missing saddrs", http.StatusBadRequest)
+			return
+		}
+		if err := sc.parse(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+		}
+		// The service only uses its reserved conns so that it doesn't take the
+		// shared ones (which the proxy may not have room for)
+		if sc.MinIdle == 0 {
+			sc.MinIdle = 1
+		}
+		ts := newTunnelService(req.Service, sc)
+		ts.reservedOnly = true
+		ts.failed = make(chan error, 1)
+		if ttl > 0 {
+			ts.expires = time.Now().Add(ttl)
+		}
+		if !addTunnelService(ts) {
+			http.Error(w, "Service already tunneled", http.StatusConflict)
+			return
+		}
+		go ts.run(sel)
+
+		timer := time.NewTimer(idleTimeout)
+		defer timer.Stop()
+		select {
+		case <-ts.ready:
+		case err := <-ts.failed:
+			removeTunnelService(ts)
+			http.Error(w, "Proxy rejected the service: "+err.Error(), http.StatusBadGateway)
+			return
+		case <-timer.C:
+			removeTunnelService(ts)
+			http.Error(w, "Timed out waiting for the proxy", http.StatusGatewayTimeout)
+			return
+		}
+		if ttl > 0 {
+			time.AfterFunc(ttl, func() {
+				if removeTunnelService(ts) {
+					log.Printf("Removed %s since its TTL passed", ts.displayName())
+				}
+			})
+		}
+		log.Printf("Added %s through the control API", ts.displayName())
+		writeJSON(w, http.StatusCreated, ts.controlInfo())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleControlService handles removing (DELETE) a service by name.
+func handleControlService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/services/")
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts, ok := getTunnelService(name)
+	if !ok || !removeTunnelService(ts) {
+		http.Error(w, "Service not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Removed %s through the control API", ts.displayName())
+	w.WriteHeader(http.StatusNoContent)
+}
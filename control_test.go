@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+)
+
+// startControl serves the control API using the proxies, returning a client
+// of it.
+func startControl(t *testing.T, proxyAddrs ...string) *http.Client {
+	t.Helper()
+	oldServices := tunnelServices
+	tunnelServices = make(map[string]*tunnelService)
+	t.Cleanup(func() {
+		for _, ts := range allTunnelServices() {
+			removeTunnelService(ts)
+		}
+		tunnelServices = oldServices
+	})
+	path := filepath.Join(t.TempDir(), "control.sock")
+	go runControl(path, newProxySelector(proxyAddrs, ""))
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+	t.Cleanup(client.CloseIdleConnections)
+	// Wait for the socket
+	for i := 0; ; i++ {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			break
+		} else if i == 100 {
+			t.Fatal("control socket never listened: ", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client
+}
+
+func TestControlServices(t *testing.T) {
+	setTestPassword(t)
+	proxy := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{
+		Services: []string{"web"},
+	})
+	client := startControl(t, proxy.TunnelAddr)
+	do := func(method, path, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(
+			method, "http://tunnelit"+path, strings.NewReader(body),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal("error making request: ", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	backend := tunnelittest.StartEchoBackend(t)
+	resp, body := do(
+		http.MethodPost, "/services",
+		`{"service": "web", "saddrs": ["`+backend+`"], "ttl": "1h"}`,
+	)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf(
+			"expected the service to be added, got %s: %s", resp.Status, body,
+		)
+	}
+	var info ControlService
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatal("error decoding service: ", err)
+	} else if info.Service != "web" || info.Expires == nil ||
+		len(info.Endpoints) != 1 {
+		t.Fatalf("expected web with its expiry and endpoint, got %s", body)
+	}
+	// Clients of the proxy reach the backend
+	conn, err := net.Dial("tcp", proxy.ClientAddr(t, "web"))
+	if err != nil {
+		t.Fatal("error dialing proxy: ", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("expected the backend's echo, got %q, %v", got, err)
+	}
+
+	resp, body = do(
+		http.MethodPost, "/services", `{"service": "web", "saddrs": ["x:1"]}`,
+	)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a conflict adding web again, got %s", resp.Status)
+	}
+	var infos []ControlService
+	_, body = do(http.MethodGet, "/services", "")
+	if err := json.Unmarshal([]byte(body), &infos); err != nil ||
+		len(infos) != 1 || infos[0].Service != "web" {
+		t.Fatalf("expected web to be listed, got %s", body)
+	}
+
+	resp, _ = do(http.MethodDelete, "/services/web", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected web to be removed, got %s", resp.Status)
+	}
+	resp, _ = do(http.MethodDelete, "/services/web", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected removing web again to fail, got %s", resp.Status)
+	}
+}
+
+func TestControlServicesInvalid(t *testing.T) {
+	setTestPassword(t)
+	proxy := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{})
+	client := startControl(t, proxy.TunnelAddr)
+	tests := []struct {
+		body string
+		want int
+	}{
+		{body: `{`, want: http.StatusBadRequest},
+		{body: `{"service": "web"}`, want: http.StatusBadRequest},
+		{
+			body: `{"service": "web", "saddrs": ["x:1"], "ttl": "-1s"}`,
+			want: http.StatusBadRequest,
+		},
+		// The proxy doesn't have the service
+		{
+			body: `{"service": "unknown", "saddrs": ["x:1"]}`,
+			want: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		resp, err := client.Post(
+			"http://tunnelit/services", "application/json",
+			strings.NewReader(tt.body),
+		)
+		if err != nil {
+			t.Fatal("error making request: ", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Fatalf("%s: expected %d, got %s", tt.body, tt.want, resp.Status)
+		}
+	}
+}
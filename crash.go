@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// crashDir is the directory crash reports are written to (blank means they
+// aren't written).
+var crashDir string
+
+// recoverConn recovers a panic in the goroutine handling the conn, logging it
+// and writing a crash report so that the rest of the process keeps serving.
+// The conn is closed. It must be deferred directly.
+func recoverConn(what string, conn net.Conn) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	metrics.Panics.Inc()
+	conn.Close()
+	log.Printf(
+		"PANIC handling %s (local %s, remote %s): %v\n%s",
+		what, conn.LocalAddr(), logAddr(conn.RemoteAddr()), v, stack,
+	)
+	if crashDir == "" {
+		return
+	}
+	path, err := writeCrashReport(what, conn, v, stack)
+	if err != nil {
+		log.Print("Error writing crash report: ", err)
+		return
+	}
+	log.Print("Wrote crash report to ", path)
+}
+
+// writeCrashReport writes a report of the panic to a new file in the crash
+// directory, returning the file's path.
+func writeCrashReport(
+	what string, conn net.Conn, v any, stack []byte,
+) (string, error) {
+	if err := os.MkdirAll(crashDir, 0700); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	f, err := os.CreateTemp(
+		crashDir,
+		fmt.Sprintf("tunnelit-crash-%s-*.txt", now.Format("20060102T150405Z")),
+	)
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(
+		f,
+		"Time: %s\nPID: %d\nHandling: %s\nLocal address: %s\nRemote address: %s\nPanic: %v\n\n%s",
+		now.Format(time.RFC3339Nano), os.Getpid(), what,
+		conn.LocalAddr(), logAddr(conn.RemoteAddr()), v, stack,
+	)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return f.Name(), err
+}
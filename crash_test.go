@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverConn(t *testing.T) {
+	oldDir := crashDir
+	crashDir = filepath.Join(t.TempDir(), "crashes")
+	t.Cleanup(func() { crashDir = oldDir })
+	buf := captureLog(t)
+	conn, peer := pipeConn(t)
+	panics := metrics.Panics.Total()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverConn("test conn", conn)
+		panic("boom")
+	}()
+	<-done
+
+	if got := metrics.Panics.Total() - panics; got != 1 {
+		t.Fatalf("expected 1 panic counted, got %d", got)
+	} else if !strings.Contains(buf.String(), "PANIC handling test conn") {
+		t.Fatalf("expected the panic logged, got %q", buf)
+	}
+	// The conn is closed
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the conn to be closed")
+	}
+	paths, _ := filepath.Glob(filepath.Join(crashDir, "tunnelit-crash-*.txt"))
+	if len(paths) != 1 {
+		t.Fatalf("expected 1 crash report, got %v", paths)
+	}
+	b, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal("error reading crash report: ", err)
+	}
+	for _, want := range []string{
+		"Handling: test conn\n", "Panic: boom\n", "TestRecoverConn",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Fatalf("expected %q in the crash report, got:\n%s", want, b)
+		}
+	}
+
+	// Without a panic, the conn is left open
+	conn, peer = pipeConn(t)
+	func() {
+		defer recoverConn("test conn", conn)
+	}()
+	go peer.Write([]byte("x"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal("expected the conn to be left open, got ", err)
+	}
+}
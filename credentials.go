@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/johnietre/utils/go"
+)
+
+// credentialsFile is the file holding the named credentials tunnels can
+// authenticate with (blank means none).
+var credentialsFile string
+
+// Credential is a named secret that tunnels can authenticate with (as their
+// password), optionally limited to some services.
+type Credential struct {
+	// Secret is the credential's secret.
+	Secret string `json:"secret,omitempty"`
+	// Hash is the hex-encoded SHA-256 hash of the secret, which can be given
+	// instead of the secret so that the file doesn't hold it.
+	Hash string `json:"hash,omitempty"`
+	// Services are the services the credential can be used for (empty means
+	// any).
+	Services []string `json:"services,omitempty"`
+
+	name string
+	hash [sha256.Size]byte
+}
+
+// credentials are the named credentials, keyed by name.
+var credentials utils.AValue[map[string]*Credential]
+
+// loadCredentials loads the credentials file, which is a JSON object mapping
+// names to credentials.
+func loadCredentials(path string) (map[string]*Credential, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds map[string]*Credential
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, err
+	}
+	for name, c := range creds {
+		if err := c.parse(name); err != nil {
+			return nil, fmt.Errorf("credential %q: %w", name, err)
+		}
+	}
+	return creds, nil
+}
+
+func (c *Credential) parse(name string) error {
+	if c == nil {
+		return errors.New("missing secret or hash")
+	}
+	c.name = name
+	if (c.Secret == "") == (c.Hash == "") {
+		return errors.New("must have exactly one of secret or hash")
+	} else if c.Secret != "" {
+		c.hash = sha256.Sum256([]byte(c.Secret))
+		return nil
+	}
+	hash, err := hex.DecodeString(c.Hash)
+	if err != nil || len(hash) != sha256.Size {
+		return errors.New("invalid hash (must be a hex-encoded SHA-256 hash)")
+	}
+	copy(c.hash[:], hash)
+	return nil
+}
+
+// allows returns whether the credential can be used for the service.
+func (c *Credential) allows(service string) bool {
+	return len(c.Services) == 0 || containsStr(c.Services, service)
+}
+
+// credentialFor returns the credential the tunnel's credential (or proof) is
+// for (see authMatches), if any.
+func credentialFor(cred, nonce, proof []byte) (*Credential, bool) {
+	// There are none unless a credentials file was given
+	creds, _ := credentials.LoadSafe()
+	for _, c := range creds {
+		if authMatches(cred, nonce, proof, c.hash) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// reloadCredentialsOnHUP reloads the credentials file whenever the proxy gets
+// a SIGHUP, so that credentials can be added, rotated, or revoked without a
+// restart. Tunnels keep the conns they already have.
+func reloadCredentialsOnHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		creds, err := loadCredentials(credentialsFile)
+		if err != nil {
+			log.Print("Error reloading credentials: ", err)
+			continue
+		}
+		credentials.Store(creds)
+		log.Printf("Reloaded %d credentials", len(creds))
+		go warmVerifierKeys()
+	}
+}
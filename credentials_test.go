@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+)
+
+// setCredentials sets the credentials for the test.
+func setCredentials(t *testing.T, creds map[string]*Credential) {
+	t.Helper()
+	old, _ := credentials.LoadSafe()
+	credentials.Store(creds)
+	t.Cleanup(func() { credentials.Store(old) })
+}
+
+func TestLoadCredentials(t *testing.T) {
+	ciHash := sha256.Sum256([]byte("ci secret"))
+	path := writeConfig(t, `{
+		"laptop": {"secret": "laptop secret"},
+		"ci": {"hash": "`+hex.EncodeToString(ciHash[:])+`", "services": ["web"]}
+	}`)
+	creds, err := loadCredentials(path)
+	if err != nil {
+		t.Fatal("error loading credentials: ", err)
+	}
+	if c := creds["laptop"]; c == nil || c.name != "laptop" ||
+		c.hash != sha256.Sum256([]byte("laptop secret")) {
+		t.Fatalf("expected the laptop credential, got %+v", c)
+	} else if c := creds["ci"]; c == nil || c.hash != ciHash {
+		t.Fatalf("expected the ci credential, got %+v", c)
+	}
+	if !creds["laptop"].allows("db") {
+		t.Fatal("expected a credential without services to allow any")
+	} else if !creds["ci"].allows("web") || creds["ci"].allows("db") {
+		t.Fatal("expected a credential to allow only its services")
+	}
+
+	for _, config := range []string{
+		`{"both": {"secret": "s", "hash": "` + hex.EncodeToString(ciHash[:]) + `"}}`,
+		`{"neither": {"services": ["web"]}}`,
+		`{"short": {"hash": "abcd"}}`,
+		`{"null": null}`,
+		`[]`,
+	} {
+		if _, err := loadCredentials(writeConfig(t, config)); err == nil {
+			t.Fatalf("expected an error for %s", config)
+		}
+	}
+}
+
+func TestCredentialRegistration(t *testing.T) {
+	setTestPassword(t)
+	setState(t, newState(""))
+	creds := make(map[string]*Credential)
+	for name, c := range map[string]*Credential{
+		"laptop": {Secret: "laptop secret"},
+		"ci":     {Secret: "ci secret", Services: []string{"web"}},
+	} {
+		if err := c.parse(name); err != nil {
+			t.Fatal("error parsing credential: ", err)
+		}
+		creds[name] = c
+	}
+	setCredentials(t, creds)
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{
+		"web": newService("web", &ServiceConfig{}),
+		"db":  newService("db", &ServiceConfig{}),
+	}
+	t.Cleanup(func() {
+		for _, svc := range services {
+			closeIdle(svc.idle.drain())
+		}
+		readyCh, services = oldReadyCh, oldServices
+	})
+
+	tests := []struct {
+		secret, service string
+		want            byte
+	}{
+		{secret: "laptop secret", service: "db", want: passwordOk},
+		{secret: "ci secret", service: "web", want: passwordOk},
+		{secret: "ci secret", service: "db", want: serviceReserved},
+		{secret: "unknown secret", service: "web", want: passwordInvalid},
+	}
+	for _, tt := range tests {
+		reg := Registration{Service: tt.service, Tunnel: tt.secret}
+		status, _ := registerTunnel(t, sha256.Sum256([]byte(tt.secret)), reg)
+		if status != tt.want {
+			t.Fatalf(
+				"%s for %s: expected %s, got %s", tt.secret, tt.service,
+				tunnelit.StatusText(tt.want), tunnelit.StatusText(status),
+			)
+		}
+	}
+	// The credential's name is kept with the tunnel once its conn is pooled
+	waitFor(t, "the tunnel's credential", func() bool {
+		return services["web"].idle.tunnelStats()["ci secret"].Credential == "ci"
+	})
+}
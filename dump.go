@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// dumpOnSignal writes a state dump to the log's output each time the process
+// gets SIGQUIT (instead of exiting, as Go does by default).
+func dumpOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGQUIT)
+	for range ch {
+		writeStateDump(log.Writer())
+	}
+}
+
+// handleDump handles getting a state dump.
+func handleDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeStateDump(w)
+}
+
+// writeStateDump writes a human-readable snapshot of the process's state: each
+// service's pool and waiting clients, the active pipes, and the goroutines.
+func writeStateDump(w io.Writer) {
+	now := time.Now()
+	fmt.Fprintf(
+		w, "=== tunnelit state dump at %s (%d goroutines) ===\n",
+		now.Format(time.RFC3339), runtime.NumGoroutine(),
+	)
+
+	svcs := allServices()
+	names := make([]string, 0, len(svcs))
+	for name := range svcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		svc := svcs[name]
+		fmt.Fprintf(
+			w, "\n%s: %d idle, %d active, %d waiting\n", svc.displayName(),
+			svc.idle.Len(), svc.stats.ActiveConns.Load(),
+			svc.stats.WaitingClients.Load(),
+		)
+		svc.idle.writeDump(w, now)
+	}
+
+	tss := allTunnelServices()
+	sort.Slice(tss, func(i, j int) bool {
+		return tss[i].reg.Service < tss[j].reg.Service
+	})
+	for _, ts := range tss {
+		ts.idleMtx.Lock()
+		idle, byProxy := len(ts.idle), make(map[string]int)
+		for _, proxyAddr := range ts.idle {
+			byProxy[proxyAddr]++
+		}
+		ts.idleMtx.Unlock()
+		fmt.Fprintf(
+			w, "\n%s: %d idle conns to proxies, %d reserved tokens free\n",
+			ts.displayName(), idle, len(ts.reserved),
+		)
+		proxyAddrs := make([]string, 0, len(byProxy))
+		for proxyAddr := range byProxy {
+			proxyAddrs = append(proxyAddrs, proxyAddr)
+		}
+		sort.Strings(proxyAddrs)
+		for _, proxyAddr := range proxyAddrs {
+			fmt.Fprintf(w, "  proxy %s: %d idle\n", proxyAddr, byProxy[proxyAddr])
+		}
+	}
+
+	pipes := allActivePipes()
+	fmt.Fprintf(w, "\nActive pipes (%d, oldest first):\n", len(pipes))
+	for _, ap := range pipes {
+		svcName := ap.service
+		if svcName == "" {
+			svcName = "default"
+		}
+		fmt.Fprintf(
+			w, "  #%d %s <-> %s [%s] age %s, %d bytes sent, %d bytes received\n",
+			ap.id, ap.clientAddr, ap.peerAddr, svcName,
+			now.Sub(ap.start).Round(time.Millisecond),
+			ap.sent.Load(), ap.received.Load(),
+		)
+	}
+
+	fmt.Fprint(w, "\nGoroutines:\n")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+	fmt.Fprint(w, "=== end of state dump ===\n")
+}
+
+// writeDump writes the pool's tunnels and waiting clients.
+func (p *idlePool) writeDump(w io.Writer, now time.Time) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	ids := make([]string, 0, len(p.tunnels))
+	for id := range p.tunnels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		pt := p.tunnels[id]
+		fmt.Fprintf(
+			w, "  tunnel %s: %d idle, %d active, weight %d, rtt %s, last conn %s ago\n",
+			pt.label(), len(pt.conns), pt.active, pt.weight,
+			pt.rtt.Round(time.Microsecond),
+			now.Sub(pt.lastPut).Round(time.Millisecond),
+		)
+	}
+	for i, wt := range p.waiters {
+		selStr := ""
+		if len(wt.filter.sel) != 0 {
+			selStr = fmt.Sprintf(
+				" (for tunnels matching %v)", map[string]string(wt.filter.sel),
+			)
+		}
+		if wt.filter.host != "" {
+			selStr += fmt.Sprintf(" (for host %s)", wt.filter.host)
+		}
+		fmt.Fprintf(
+			w, "  waiting client %d: waiting for %s%s\n",
+			i+1, now.Sub(wt.since).Round(time.Millisecond), selStr,
+		)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteStateDump(t *testing.T) {
+	svc := newService("web", &ServiceConfig{})
+	oldServices := services
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { services = oldServices })
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	svc.idle.Put(c1, "laptop", tunnelInfo{weight: 2})
+	client, backend, done := startPipe(t, connInfo{service: "web"})
+	// Once data flows, the pipe is tracked
+	go client.Write([]byte("hi"))
+	if _, err := io.ReadFull(backend, make([]byte, 2)); err != nil {
+		t.Fatal("error reading: ", err)
+	}
+
+	var buf bytes.Buffer
+	writeStateDump(&buf)
+	dump := buf.String()
+	for _, want := range []string{
+		"=== tunnelit state dump at ",
+		"\nweb: 1 idle, 0 active, 0 waiting\n",
+		"  tunnel laptop: 1 idle, 0 active, weight 2,",
+		"\nActive pipes (1, oldest first):\n",
+		"[web] age ",
+		"\nGoroutines:\n",
+		"=== end of state dump ===\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Fatalf("expected %q in the dump, got:\n%s", want, dump)
+		}
+	}
+	client.Close()
+	backend.Close()
+	waitPipe(t, done)
+}
+
+func TestHandleDump(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleDump(w, httptest.NewRequest(http.MethodGet, "/dump", nil))
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "=== end of state dump ===") {
+		t.Fatalf("expected the dump, got %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	handleDump(w, httptest.NewRequest(http.MethodPost, "/dump", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST to be disallowed, got %d", w.Code)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnietre/utils/go"
+	"github.com/spf13/cobra"
+)
+
+// End-to-end encryption is negotiated between the tunnel and the e2e-client
+// wrapper on the client's machine through the proxy, which only pipes the
+// ciphertext. The handshake is:
+//
+//  1. The client sends its ephemeral X25519 public key.
+//  2. The tunnel sends its ephemeral public key and its Ed25519 signature of
+//     e2eLabel followed by both ephemeral keys, which the client checks
+//     against the tunnel's pinned public key.
+//
+// Both then derive a key for each direction from the X25519 shared secret
+// with HKDF-SHA256 (salted with the signed transcript), and send records of a
+// 2-byte (big endian) length followed by the AES-256-GCM sealed record, each
+// with the next nonce of a counter (so records dropped, replayed or reordered
+// by the proxy fail to authenticate). A record's plaintext is its type
+// (e2eData or e2eClose) followed by its data. Each side sends a close record
+// before closing, so a stream cut short by the proxy is an error rather than
+// a clean EOF.
+
+// e2eLabel is the label of the protocol mixed into the signature and keys.
+const e2eLabel = "tunnelit-e2e-v2"
+
+// e2eMaxRecord is the most data sealed in a record.
+const e2eMaxRecord = 16 << 10
+
+// The types of records.
+const (
+	// e2eData records carry the stream's data.
+	e2eData byte = 0
+	// e2eClose records end the stream (in the sender's direction).
+	e2eClose byte = 1
+)
+
+// e2eCloseTimeout is how long closing waits to send the close record.
+const e2eCloseTimeout = time.Second
+
+var (
+	// e2eKeyFile is the tunnel's key file for end-to-end encryption (blank
+	// means disabled).
+	e2eKeyFile string
+	e2eKey     ed25519.PrivateKey
+)
+
+// errE2ETruncated is returned reading an e2e stream that ends without a close
+// record.
+var errE2ETruncated = errors.New("e2e stream truncated")
+
+// e2eServer does the tunnel's side of the handshake on the client conn.
+func e2eServer(conn net.Conn, key ed25519.PrivateKey) (net.Conn, error) {
+	curve := ecdh.X25519()
+	clientPub := make([]byte, 32)
+	if _, err := io.ReadFull(conn, clientPub); err != nil {
+		return nil, fmt.Errorf("error reading client key: %w", err)
+	}
+	priv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+	transcript := append(append([]byte(e2eLabel), clientPub...), pub...)
+	msg := append(pub, ed25519.Sign(key, transcript)...)
+	if _, err := utils.WriteAll(conn, msg); err != nil {
+		return nil, fmt.Errorf("error writing key: %w", err)
+	}
+	return newE2EConn(conn, priv, clientPub, transcript, false)
+}
+
+// e2eClient does the client's side of the handshake on the conn to the
+// tunnel, verifying the tunnel with its public key.
+func e2eClient(conn net.Conn, tunnelKey ed25519.PublicKey) (net.Conn, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+	if _, err := utils.WriteAll(conn, pub); err != nil {
+		return nil, fmt.Errorf("error writing key: %w", err)
+	}
+	msg := make([]byte, len(pub)+ed25519.SignatureSize)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, fmt.Errorf("error reading tunnel key: %w", err)
+	}
+	tunnelPub, sig := msg[:len(pub)], msg[len(pub):]
+	transcript := append(append([]byte(e2eLabel), pub...), tunnelPub...)
+	if !ed25519.Verify(tunnelKey, transcript, sig) {
+		return nil, errors.New("tunnel's signature doesn't match its public key")
+	}
+	return newE2EConn(conn, priv, tunnelPub, transcript, true)
+}
+
+// newE2EConn derives the keys from the X25519 exchange of the private key and
+// peer's public key and wraps the conn with them.
+func newE2EConn(
+	conn net.Conn, priv *ecdh.PrivateKey, peerPub, transcript []byte,
+	isClient bool,
+) (*e2eConn, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, errors.New("invalid peer key")
+	}
+	// Fails for low-order points, giving an all-zero secret
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, errors.New("invalid peer key")
+	}
+	c2s, err := e2eAEAD(secret, transcript, "client to tunnel")
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := e2eAEAD(secret, transcript, "tunnel to client")
+	if err != nil {
+		return nil, err
+	}
+	ec := &e2eConn{Conn: conn, seal: s2c, open: c2s}
+	if isClient {
+		ec.seal, ec.open = c2s, s2c
+	}
+	return ec, nil
+}
+
+// e2eAEAD derives the key for a direction from the shared secret.
+func e2eAEAD(secret, transcript []byte, dir string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, transcript, e2eLabel+" "+dir, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// e2eConn is a conn encrypted end to end.
+type e2eConn struct {
+	net.Conn
+	seal, open cipher.AEAD
+
+	writeMtx   sync.Mutex
+	writeCount uint64
+	// closed is whether the close record was sent.
+	closed bool
+
+	readCount uint64
+	// plain is the rest of the last record opened.
+	plain []byte
+	// eof is whether the peer's close record was read.
+	eof bool
+}
+
+func (c *e2eConn) Write(p []byte) (int, error) {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n := 0
+	for len(p) != 0 {
+		chunk := p
+		if len(chunk) > e2eMaxRecord {
+			chunk = chunk[:e2eMaxRecord]
+		}
+		if err := c.writeRecord(e2eData, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// writeRecord seals and writes a record of the type. The write mutex must be
+// held.
+func (c *e2eConn) writeRecord(typ byte, data []byte) error {
+	plain := append([]byte{typ}, data...)
+	rec := make([]byte, 2, 2+len(plain)+c.seal.Overhead())
+	rec = c.seal.Seal(rec, e2eNonce(c.seal, c.writeCount), plain, nil)
+	binary.BigEndian.PutUint16(rec, uint16(len(rec)-2))
+	c.writeCount++
+	_, err := utils.WriteAll(c.Conn, rec)
+	return err
+}
+
+func (c *e2eConn) Read(p []byte) (int, error) {
+	for len(c.plain) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(c.Conn, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return 0, errE2ETruncated
+			}
+			return 0, err
+		}
+		rec := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(c.Conn, rec); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, errE2ETruncated
+			}
+			return 0, err
+		}
+		plain, err := c.open.Open(rec[:0], e2eNonce(c.open, c.readCount), rec, nil)
+		if err != nil || len(plain) == 0 {
+			return 0, errors.New("e2e record failed to authenticate")
+		}
+		c.readCount++
+		switch plain[0] {
+		case e2eData:
+			c.plain = plain[1:]
+		case e2eClose:
+			c.eof = true
+		default:
+			return 0, fmt.Errorf("unknown e2e record type %d", plain[0])
+		}
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// CloseWrite sends the close record, ending the stream in this direction.
+func (c *e2eConn) CloseWrite() error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.writeRecord(e2eClose, nil)
+}
+
+// Close sends the close record (if not yet sent) before closing the conn.
+func (c *e2eConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(e2eCloseTimeout))
+	c.CloseWrite()
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying conn.
+func (c *e2eConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// e2eNonce returns the nonce for the record with the given count.
+func e2eNonce(aead cipher.AEAD, count uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], count)
+	return nonce
+}
+
+// RunE2EClient listens for local clients, encrypting each end to end with a
+// tunnel through the proxy.
+func RunE2EClient(cmd *cobra.Command, args []string) {
+	listenAddr := must(cmd.Flags().GetString("listen"))
+	proxyAddr := must(cmd.Flags().GetString("addr"))
+	tunnelKey, err := parsePubKey(must(cmd.Flags().GetString("tunnel-pubkey")))
+	if err != nil {
+		log.Fatal("Error parsing tunnel public key: ", err)
+	}
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal("Error listening: ", err)
+	}
+	log.Printf(
+		"Listening on %s for clients to encrypt to the tunnel through %s",
+		ln.Addr(), proxyAddr,
+	)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal("Error accepting: ", err)
+		}
+		go func() {
+			proxyConn, err := net.DialTimeout("tcp", proxyAddr, idleTimeout)
+			if err != nil {
+				log.Print("Error connecting to proxy: ", err)
+				conn.Close()
+				return
+			}
+			proxyConn.SetDeadline(time.Now().Add(idleTimeout))
+			ec, err := e2eClient(proxyConn, tunnelKey)
+			if err != nil {
+				log.Print("Error handshaking with tunnel: ", err)
+				proxyConn.Close()
+				conn.Close()
+				return
+			}
+			proxyConn.SetDeadline(time.Time{})
+			pipeConns(conn, ec, connInfo{
+				stats: &stats, idleTimeout: streamIdleTimeout,
+			})
+		}()
+	}
+}
+
+// e2ePubKey returns the base64 public key of the tunnel's e2e key.
+func e2ePubKey() string {
+	return base64.StdEncoding.EncodeToString(e2eKey.Public().(ed25519.PublicKey))
+}
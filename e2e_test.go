@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+)
+
+// startUDPEcho starts a UDP server echoing each datagram, returning its
+// address.
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error starting UDP server: ", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestServeReadyE2E(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := e2eKey
+	e2eKey = key
+	t.Cleanup(func() { e2eKey = oldKey })
+
+	tests := []struct {
+		name string
+		udp  bool
+	}{
+		{name: "tcp service is encrypted"},
+		{name: "udp service is piped as is", udp: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &TunnelServiceConfig{UDP: tt.udp}
+			if tt.udp {
+				sc.Saddrs = []string{startUDPEcho(t)}
+			} else {
+				sc.Saddrs = []string{tunnelittest.StartEchoBackend(t)}
+			}
+			if err := sc.parse(); err != nil {
+				t.Fatal(err)
+			}
+			ts := newTunnelService("svc", sc)
+			tunnelSide, proxySide := net.Pipe()
+			defer proxySide.Close()
+			go ts.serveReady(tunnelSide, connReady, func() {})
+
+			proxySide.SetDeadline(time.Now().Add(5 * time.Second))
+			b := []byte{0}
+			if _, err := io.ReadFull(proxySide, b); err != nil || b[0] != connReady {
+				t.Fatalf("expected ready byte, got %d (err: %v)", b[0], err)
+			}
+			var conn net.Conn = proxySide
+			msg := []byte("ping")
+			if tt.udp {
+				// A framed datagram
+				msg = append([]byte{0, byte(len(msg))}, msg...)
+			} else if conn, err = e2eClient(proxySide, pub); err != nil {
+				t.Fatal("error handshaking end to end: ", err)
+			}
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatal("error writing: ", err)
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal("error reading echo: ", err)
+			} else if string(got) != string(msg) {
+				t.Fatalf("expected echo %q, got %q", msg, got)
+			}
+		})
+	}
+}
+
+// tamperConn flips the last bit of each write once tampering is set.
+type tamperConn struct {
+	net.Conn
+	tamper bool
+}
+
+func (c *tamperConn) Write(p []byte) (int, error) {
+	if c.tamper {
+		p = append([]byte(nil), p...)
+		p[len(p)-1] ^= 1
+	}
+	return c.Conn.Write(p)
+}
+
+func TestE2EConn(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// pinned is the tunnel key the client pins.
+		pinned ed25519.PublicKey
+		// tamper is whether the client's records are tampered with.
+		tamper bool
+		// handshakeOK and readOK are whether the handshake and reading the
+		// client's record by the tunnel are expected to succeed.
+		handshakeOK, readOK bool
+	}{
+		{name: "pinned key", pinned: pub, handshakeOK: true, readOK: true},
+		{name: "other key", pinned: otherPub},
+		{name: "tampered record", pinned: pub, tamper: true, handshakeOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientSide, tunnelSide := net.Pipe()
+			defer clientSide.Close()
+			defer tunnelSide.Close()
+			clientSide.SetDeadline(time.Now().Add(5 * time.Second))
+			tunnelSide.SetDeadline(time.Now().Add(5 * time.Second))
+			served := make(chan net.Conn, 1)
+			go func() {
+				conn, err := e2eServer(tunnelSide, key)
+				if err != nil {
+					tunnelSide.Close()
+				}
+				served <- conn
+			}()
+
+			tc := &tamperConn{Conn: clientSide}
+			client, err := e2eClient(tc, tt.pinned)
+			if !tt.handshakeOK {
+				if err == nil {
+					t.Fatal("expected handshake error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error handshaking: ", err)
+			}
+			tunnel := <-served
+			if tunnel == nil {
+				t.Fatal("tunnel's handshake failed")
+			}
+
+			// Records larger than the max are split
+			msg := bytes.Repeat([]byte("ping"), e2eMaxRecord/2)
+			tc.tamper = tt.tamper
+			go client.Write(msg)
+			got := make([]byte, len(msg))
+			_, err = io.ReadFull(tunnel, got)
+			if !tt.readOK {
+				if err == nil {
+					t.Fatal("expected tampered record rejected")
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error reading: ", err)
+			} else if !bytes.Equal(got, msg) {
+				t.Fatal("expected message decrypted intact")
+			}
+		})
+	}
+}
+
+// bufConn is a conn whose reads are from r and writes are to w.
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *bufConn) Close() error                { return nil }
+
+func (c *bufConn) SetWriteDeadline(time.Time) error { return nil }
+
+// newE2EPair returns the client and tunnel sides of a handshake, both with
+// bufConns as their conns.
+func newE2EPair(t *testing.T) (client, tunnel *e2eConn) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSide, tunnelSide := net.Pipe()
+	defer clientSide.Close()
+	defer tunnelSide.Close()
+	served := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := e2eServer(tunnelSide, key)
+		served <- conn
+	}()
+	conn, err := e2eClient(clientSide, pub)
+	if err != nil {
+		t.Fatal("error handshaking: ", err)
+	}
+	client = conn.(*e2eConn)
+	tunnel, _ = (<-served).(*e2eConn)
+	if tunnel == nil {
+		t.Fatal("tunnel's handshake failed")
+	}
+	client.Conn, tunnel.Conn = &bufConn{}, &bufConn{}
+	return client, tunnel
+}
+
+// splitRecords splits the stream into its records (with their lengths).
+func splitRecords(stream []byte) [][]byte {
+	var recs [][]byte
+	for len(stream) >= 2 {
+		n := 2 + int(binary.BigEndian.Uint16(stream))
+		recs = append(recs, stream[:n])
+		stream = stream[n:]
+	}
+	return recs
+}
+
+func TestE2EStream(t *testing.T) {
+	tests := []struct {
+		name string
+		// modify modifies the records written by the client (two data records
+		// followed by the close record) before the tunnel reads them.
+		modify func(recs [][]byte) [][]byte
+		// ok is whether the stream is expected to be read through to EOF.
+		ok bool
+	}{
+		{
+			name:   "intact",
+			modify: func(recs [][]byte) [][]byte { return recs },
+			ok:     true,
+		},
+		{
+			name: "tampered",
+			modify: func(recs [][]byte) [][]byte {
+				recs[1][len(recs[1])-1] ^= 1
+				return recs
+			},
+		},
+		{
+			name: "reordered",
+			modify: func(recs [][]byte) [][]byte {
+				recs[0], recs[1] = recs[1], recs[0]
+				return recs
+			},
+		},
+		{
+			name: "replayed",
+			modify: func(recs [][]byte) [][]byte {
+				return [][]byte{recs[0], recs[0], recs[1], recs[2]}
+			},
+		},
+		{
+			name:   "dropped",
+			modify: func(recs [][]byte) [][]byte { return append(recs[:1], recs[2:]...) },
+		},
+		{
+			name:   "truncated at a record",
+			modify: func(recs [][]byte) [][]byte { return recs[:2] },
+		},
+		{
+			name: "truncated in a record",
+			modify: func(recs [][]byte) [][]byte {
+				recs[2] = recs[2][:len(recs[2])-1]
+				return recs
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, tunnel := newE2EPair(t)
+			for _, msg := range []string{"first", "second"} {
+				if _, err := client.Write([]byte(msg)); err != nil {
+					t.Fatal("error writing: ", err)
+				}
+			}
+			if err := client.Close(); err != nil {
+				t.Fatal("error closing: ", err)
+			} else if _, err := client.Write([]byte("x")); err == nil {
+				t.Fatal("expected error writing after close")
+			}
+
+			recs := splitRecords(client.Conn.(*bufConn).w.Bytes())
+			if len(recs) != 3 {
+				t.Fatalf("expected 3 records, got %d", len(recs))
+			}
+			tunnel.Conn.(*bufConn).r = bytes.NewReader(bytes.Join(tt.modify(recs), nil))
+			got, err := io.ReadAll(tunnel)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected error reading, got %q", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error reading: ", err)
+			} else if string(got) != "firstsecond" {
+				t.Fatalf("expected %q, got %q", "firstsecond", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// expiredForgetAfter is how long an expired tunnel is remembered so that its
+// conns keep being rejected.
+const expiredForgetAfter = time.Hour
+
+// ephemeralTunnel is a tunnel that registered with a TTL.
+type ephemeralTunnel struct {
+	expires time.Time
+	// token is the name of the token the tunnel used (blank for the password).
+	token string
+	// services are the names of the services the tunnel registered for.
+	services map[string]bool
+	expired  bool
+}
+
+var (
+	ephemeralsMtx sync.Mutex
+	// ephemerals are the tunnels with TTLs, keyed by tunnel ID.
+	ephemerals = make(map[string]*ephemeralTunnel)
+)
+
+// registerEphemeral records a tunnel conn's registration for the service,
+// starting the tunnel's TTL if it's the tunnel's first registration with one.
+// False is returned if the tunnel has already expired.
+func registerEphemeral(
+	tunnelID, token, service string, ttl time.Duration,
+) bool {
+	ephemeralsMtx.Lock()
+	defer ephemeralsMtx.Unlock()
+	et := ephemerals[tunnelID]
+	if et == nil {
+		if ttl <= 0 {
+			return true
+		}
+		et = &ephemeralTunnel{
+			expires: time.Now().Add(ttl), token: token, services: make(map[string]bool),
+		}
+		ephemerals[tunnelID] = et
+		log.Printf("Tunnel %s expires in %s", tunnelID, ttl)
+		time.AfterFunc(ttl, func() { expireTunnel(tunnelID) })
+	}
+	if et.expired {
+		return false
+	}
+	et.services[service] = true
+	return true
+}
+
+// tunnelHasExpired returns whether the tunnel has expired.
+func tunnelHasExpired(tunnelID string) bool {
+	ephemeralsMtx.Lock()
+	defer ephemeralsMtx.Unlock()
+	et := ephemerals[tunnelID]
+	return et != nil && et.expired
+}
+
+// unlessExpired calls f unless the tunnel has expired, returning whether it
+// was called. The tunnel can't expire while f runs, so conns pooled by f are
+// closed once it does.
+func unlessExpired(tunnelID string, f func()) bool {
+	ephemeralsMtx.Lock()
+	defer ephemeralsMtx.Unlock()
+	if et := ephemerals[tunnelID]; et != nil && et.expired {
+		return false
+	}
+	f()
+	return true
+}
+
+// expireTunnel deregisters the tunnel, closing its idle conns, closing the
+// listeners of services no other tunnels serve, and revoking its token (if
+// any). Conns already in use are left to finish.
+func expireTunnel(tunnelID string) {
+	ephemeralsMtx.Lock()
+	et := ephemerals[tunnelID]
+	et.expired = true
+	ephemeralsMtx.Unlock()
+	time.AfterFunc(expiredForgetAfter, func() {
+		ephemeralsMtx.Lock()
+		defer ephemeralsMtx.Unlock()
+		delete(ephemerals, tunnelID)
+	})
+	log.Printf("Tunnel %s expired", tunnelID)
+
+	// The services can't change since the tunnel is marked expired
+	for name := range et.services {
+		svc, ok := getService(name)
+		if !ok {
+			continue
+		}
+		closeIdle(svc.idle.removeTunnel(tunnelID))
+		if !svc.idle.hasTunnels(tunnelFilter{}) {
+			svc.pauseListeners()
+		}
+	}
+	if et.token == "" {
+		return
+	}
+	if _, err := state.RevokeToken(et.token); err != nil {
+		log.Printf("Error revoking token %q: %v", et.token, err)
+		return
+	}
+	log.Printf("Revoked token %q of expired tunnel %s", et.token, tunnelID)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+func TestExpireTunnel(t *testing.T) {
+	s := newState("")
+	setState(t, s)
+	if _, err := s.CreateToken("laptop", TokenLimits{}); err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+	sc := &ServiceConfig{Addr: "127.0.0.1:0"}
+	if err := sc.parseSchedule(); err != nil {
+		t.Fatal("error parsing schedule: ", err)
+	}
+	svc := newService("web", sc)
+	if err := svc.updateListeners(); err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer svc.remove()
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+
+	const tunnelID, shortID = "ephemeral-test", "ephemeral-short"
+	t.Cleanup(func() {
+		ephemeralsMtx.Lock()
+		delete(ephemerals, tunnelID)
+		delete(ephemerals, shortID)
+		ephemeralsMtx.Unlock()
+	})
+	if !registerEphemeral("permanent", "", "web", 0) {
+		t.Fatal("expected a tunnel without a TTL to register")
+	} else if _, ok := ephemerals["permanent"]; ok {
+		t.Fatal("expected a tunnel without a TTL not to be tracked")
+	}
+	if !registerEphemeral(tunnelID, "laptop", "web", time.Hour) {
+		t.Fatal("expected the tunnel to register")
+	}
+	tunnelSide, proxySide := net.Pipe()
+	defer tunnelSide.Close()
+	if !unlessExpired(tunnelID, func() {
+		svc.idle.Put(proxySide, tunnelID, tunnelInfo{weight: 1})
+	}) {
+		t.Fatal("expected the conn to be pooled before expiring")
+	}
+	addr := svc.endpoints(nil).Addr
+
+	expireTunnel(tunnelID)
+	if !tunnelHasExpired(tunnelID) {
+		t.Fatal("expected the tunnel to have expired")
+	} else if registerEphemeral(tunnelID, "laptop", "web", time.Hour) {
+		t.Fatal("expected an expired tunnel not to register")
+	} else if unlessExpired(tunnelID, func() {}) {
+		t.Fatal("expected nothing to be pooled for an expired tunnel")
+	}
+	tunnelSide.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := tunnelSide.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the idle conn to be closed")
+	}
+	// The service has no other tunnels, so its listener is closed
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("expected the listener to be closed")
+	}
+	if _, ok := s.Tokens["laptop"]; ok {
+		t.Fatal("expected the tunnel's token to be revoked")
+	}
+
+	// Tunnels expire once their TTL is up
+	registerEphemeral(shortID, "", "other", 50*time.Millisecond)
+	if tunnelHasExpired(shortID) {
+		t.Fatal("expected the tunnel not to have expired yet")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !tunnelHasExpired(shortID) {
+		t.Fatal("expected the tunnel to have expired after its TTL")
+	}
+}
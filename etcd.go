@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	etcdUsernameEnvName = "ETCD_USERNAME"
+	etcdPasswordEnvName = "ETCD_PASSWORD"
+	// etcdReloadDelay is how long to wait after a change before reloading so
+	// that several changes made together are applied together.
+	etcdReloadDelay = 500 * time.Millisecond
+	// etcdRetryDelay is how long to wait before rewatching after an error.
+	etcdRetryDelay = time.Second
+)
+
+var (
+	etcdEndpoints []string
+	// etcdPrefix is the prefix of the config's keys:
+	//   - <prefix>services/<name>: a service's config (JSON), with an empty name
+	//     being the default service.
+	//   - <prefix>admin-tokens: the admin tokens (JSON list).
+	//   - <prefix>password: the tunnel password.
+	etcdPrefix string
+)
+
+// etcdClient talks to etcd through its v3 JSON gateway, trying each endpoint
+// in turn.
+type etcdClient struct {
+	endpoints []string
+	client    *http.Client
+	// watchClient has no timeout since watches are long-lived.
+	watchClient *http.Client
+	token       string
+}
+
+func newEtcdClient(endpoints []string) (*etcdClient, error) {
+	ec := &etcdClient{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		watchClient: &http.Client{},
+	}
+	for _, ep := range endpoints {
+		if !strings.Contains(ep, "://") {
+			ep = "http://" + ep
+		}
+		ec.endpoints = append(ec.endpoints, strings.TrimSuffix(ep, "/"))
+	}
+	if user := os.Getenv(etcdUsernameEnvName); user != "" {
+		var resp struct {
+			Token string `json:"token"`
+		}
+		err := ec.call("/v3/auth/authenticate", map[string]string{
+			"name": user, "password": os.Getenv(etcdPasswordEnvName),
+		}, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("error authenticating: %w", err)
+		}
+		ec.token = resp.Token
+	}
+	return ec, nil
+}
+
+// post POSTs the body to the path on the first endpoint that responds.
+func (ec *etcdClient) post(
+	ctx context.Context, client *http.Client, path string, body any,
+) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ep := range ec.endpoints {
+		req, err := http.NewRequestWithContext(
+			ctx, http.MethodPost, ep+path, bytes.NewReader(b),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if ec.token != "" {
+			req.Header.Set("Authorization", ec.token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			var e struct {
+				Message string `json:"message"`
+			}
+			json.NewDecoder(resp.Body).Decode(&e)
+			resp.Body.Close()
+			return nil, fmt.Errorf("received status %s: %s", resp.Status, e.Message)
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func (ec *etcdClient) call(path string, body, out any) error {
+	resp, err := ec.post(context.Background(), ec.client, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// etcdKV is a key-value pair from etcd (the JSON gateway base64-encodes keys
+// and values).
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// prefixEnd returns the end of the range of keys with the prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All keys
+	return []byte{0}
+}
+
+// Range returns the keys with the prefix and the revision they were read at.
+func (ec *etcdClient) Range(prefix string) ([]etcdKV, int64, error) {
+	var resp struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		KVs []etcdKV `json:"kvs"`
+	}
+	err := ec.call("/v3/kv/range", map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd(prefix)),
+	}, &resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	rev, _ := strconv.ParseInt(resp.Header.Revision, 10, 64)
+	return resp.KVs, rev, nil
+}
+
+// Watch watches the keys with the prefix starting at the revision (0 means
+// the current one), sending on the chan whenever they change. It returns once
+// the watch fails.
+func (ec *etcdClient) Watch(prefix string, rev int64, changed chan<- int64) error {
+	req := map[string]any{
+		"key":       base64.StdEncoding.EncodeToString([]byte(prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd(prefix)),
+	}
+	if rev != 0 {
+		req["start_revision"] = strconv.FormatInt(rev, 10)
+	}
+	resp, err := ec.post(
+		context.Background(), ec.watchClient, "/v3/watch",
+		map[string]any{"create_request": req},
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Header struct {
+					Revision string `json:"revision"`
+				} `json:"header"`
+				Events       []json.RawMessage `json:"events"`
+				Canceled     bool              `json:"canceled"`
+				CancelReason string            `json:"cancel_reason"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		} else if msg.Error != nil {
+			return fmt.Errorf("watch error: %s", msg.Error.Message)
+		} else if msg.Result.Canceled {
+			return fmt.Errorf("watch canceled: %s", msg.Result.CancelReason)
+		}
+		if len(msg.Result.Events) != 0 {
+			rev, _ := strconv.ParseInt(msg.Result.Header.Revision, 10, 64)
+			changed <- rev
+		}
+	}
+}
+
+// etcdConfig builds the config from the keys under the prefix, returning the
+// password as well (blank if not set).
+func etcdConfig(kvs []etcdKV, prefix string) (*Config, string, error) {
+	cfg := &Config{Services: make(map[string]*ServiceConfig)}
+	pwd := ""
+	for _, kv := range kvs {
+		key := strings.TrimPrefix(string(kv.Key), prefix)
+		switch {
+		case strings.HasPrefix(key, "services/"):
+			name := strings.TrimPrefix(key, "services/")
+			sc := &ServiceConfig{}
+			if err := json.Unmarshal(kv.Value, sc); err != nil {
+				return nil, "", fmt.Errorf("error parsing %s: %w", kv.Key, err)
+			}
+			cfg.Services[name] = sc
+		case key == "admin-tokens":
+			if err := json.Unmarshal(kv.Value, &cfg.AdminTokens); err != nil {
+				return nil, "", fmt.Errorf("error parsing %s: %w", kv.Key, err)
+			}
+		case key == "password":
+			pwd = string(kv.Value)
+		}
+	}
+	addFlagService(cfg)
+	if err := cfg.validate(); err != nil {
+		return nil, "", err
+	}
+	return cfg, pwd, nil
+}
+
+// loadEtcdConfig loads the config from etcd, returning the client and the
+// revision the config was read at so the config can be watched.
+func loadEtcdConfig() (*etcdClient, *Config, int64, error) {
+	ec, err := newEtcdClient(etcdEndpoints)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	kvs, rev, err := ec.Range(etcdPrefix)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("error reading config from etcd: %w", err)
+	}
+	cfg, pwd, err := etcdConfig(kvs, etcdPrefix)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if pwd != "" {
+		passwordHash.Store(sha256.Sum256([]byte(pwd)))
+	}
+	log.Printf("Loaded config from etcd (revision %d)", rev)
+	return ec, cfg, rev, nil
+}
+
+// watchConfig watches the config's keys (starting after the revision they
+// were loaded at), applying the config when they change. Invalid configs are
+// logged and not applied.
+func (ec *etcdClient) watchConfig(rev int64) {
+	changed := make(chan int64, 1)
+	go func() {
+		start := rev + 1
+		for {
+			if err := ec.Watch(etcdPrefix, start, changed); err != nil {
+				log.Print("Error watching etcd, retrying: ", err)
+			}
+			time.Sleep(etcdRetryDelay)
+			// Rewatch from the current revision, reloading to pick up any
+			// changes missed in the meantime
+			start = 0
+			changed <- 0
+		}
+	}()
+	for range changed {
+		// Wait for related changes to come in
+		time.Sleep(etcdReloadDelay)
+		for len(changed) != 0 {
+			<-changed
+		}
+		kvs, rev, err := ec.Range(etcdPrefix)
+		if err != nil {
+			log.Print("Error reading config from etcd: ", err)
+			continue
+		}
+		cfg, pwd, err := etcdConfig(kvs, etcdPrefix)
+		if err != nil {
+			log.Printf("Error applying config from etcd (revision %d): %v", rev, err)
+			continue
+		}
+		if pwd != "" {
+			hash := sha256.Sum256([]byte(pwd))
+			if old, _ := passwordHash.Swap(hash); old != hash {
+				log.Print("Password changed in etcd")
+			}
+		}
+		adminTokens.Store(cfg.AdminTokens)
+		updateServices(cfg)
+		log.Printf("Applied config from etcd (revision %d)", rev)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []byte
+	}{
+		{"tunnelit/", []byte("tunnelit0")},
+		{"a\xFF", []byte("b")},
+		{"\xFF\xFF", []byte{0}},
+	}
+	for _, tt := range tests {
+		if got := prefixEnd(tt.prefix); !bytes.Equal(got, tt.want) {
+			t.Fatalf("%q: expected %q, got %q", tt.prefix, tt.want, got)
+		}
+	}
+}
+
+// fakeEtcd starts a fake etcd JSON gateway serving the keys, requiring the
+// token if auth is done, and returning its URL.
+func fakeEtcd(t *testing.T, kvs map[string]string) string {
+	t.Helper()
+	const token = "tok123"
+	srvr := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]any
+			json.NewDecoder(r.Body).Decode(&req)
+			if r.URL.Path == "/v3/auth/authenticate" {
+				if req["name"] != "user" || req["password"] != "pass" {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"message": "authentication failed"}`))
+					return
+				}
+				fmt.Fprintf(w, `{"token": %q}`, token)
+				return
+			} else if r.Header.Get("Authorization") != token {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"message": "invalid auth token"}`))
+				return
+			}
+			switch r.URL.Path {
+			case "/v3/kv/range":
+				var resp struct {
+					Header map[string]string `json:"header"`
+					KVs    []etcdKV          `json:"kvs"`
+				}
+				resp.Header = map[string]string{"revision": "7"}
+				for k, v := range kvs {
+					resp.KVs = append(resp.KVs, etcdKV{[]byte(k), []byte(v)})
+				}
+				json.NewEncoder(w).Encode(resp)
+			case "/v3/watch":
+				// The created response, a change, and then a cancelation
+				w.Write([]byte(`{"result": {"header": {"revision": "7"}}}` + "\n"))
+				w.Write([]byte(
+					`{"result": {"header": {"revision": "8"}, "events": [{}]}}` + "\n",
+				))
+				w.Write([]byte(
+					`{"result": {"canceled": true, "cancel_reason": "compacted"}}`,
+				))
+			default:
+				http.NotFound(w, r)
+			}
+		},
+	))
+	t.Cleanup(srvr.Close)
+	return srvr.URL
+}
+
+func TestEtcdClient(t *testing.T) {
+	url := fakeEtcd(t, map[string]string{"tunnelit/password": "secret"})
+	t.Setenv(etcdUsernameEnvName, "user")
+	t.Setenv(etcdPasswordEnvName, "wrong")
+	if _, err := newEtcdClient([]string{url}); err == nil ||
+		!strings.Contains(err.Error(), "authentication failed") {
+		t.Fatal("expected an authentication error, got ", err)
+	}
+
+	t.Setenv(etcdPasswordEnvName, "pass")
+	// The first endpoint is down, so the second is used
+	ec, err := newEtcdClient([]string{deadAddr(t), url + "/"})
+	if err != nil {
+		t.Fatal("error creating client: ", err)
+	}
+	kvs, rev, err := ec.Range("tunnelit/")
+	if err != nil {
+		t.Fatal("error reading range: ", err)
+	} else if rev != 7 || len(kvs) != 1 || string(kvs[0].Value) != "secret" {
+		t.Fatalf("expected the password at revision 7, got %d, %+v", rev, kvs)
+	}
+
+	changed := make(chan int64, 2)
+	if err := ec.Watch("tunnelit/", 8, changed); err == nil ||
+		!strings.Contains(err.Error(), "compacted") {
+		t.Fatal("expected the watch to end with the cancelation, got ", err)
+	}
+	if len(changed) != 1 || <-changed != 8 {
+		t.Fatal("expected one change at revision 8")
+	}
+}
+
+func TestEtcdConfig(t *testing.T) {
+	kv := func(key, value string) etcdKV {
+		return etcdKV{Key: []byte(key), Value: []byte(value)}
+	}
+	cfg, pwd, err := etcdConfig([]etcdKV{
+		kv("tunnelit/services/web", `{"addr": "127.0.0.1:8080"}`),
+		kv("tunnelit/services/", `{"addr": "127.0.0.1:8081"}`),
+		kv("tunnelit/password", "secret"),
+		kv("tunnelit/unknown", "ignored"),
+	}, "tunnelit/")
+	if err != nil {
+		t.Fatal("error building config: ", err)
+	} else if pwd != "secret" {
+		t.Fatalf("expected the password, got %q", pwd)
+	} else if len(cfg.Services) != 2 ||
+		cfg.Services["web"].Addr != "127.0.0.1:8080" ||
+		cfg.Services[""].Addr != "127.0.0.1:8081" {
+		t.Fatalf("expected web and the default service, got %+v", cfg.Services)
+	}
+
+	for _, bad := range []etcdKV{
+		kv("tunnelit/services/web", `{"addr": `),
+		kv("tunnelit/admin-tokens", `{}`),
+		kv("tunnelit/services/web", `{"policy": "no-such-policy"}`),
+	} {
+		if _, _, err := etcdConfig([]etcdKV{bad}, "tunnelit/"); err == nil {
+			t.Fatalf("expected an error for %s", bad.Value)
+		}
+	}
+}
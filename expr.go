@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// Expr is a compiled rule expression, written in CEL
+// (https://github.com/google/cel-spec) and evaluating to a bool. Besides CEL's
+// standard operators and functions, expressions can use:
+//   - Variables: client.ip (string), client.port (int), client.sni (string,
+//     only set for services with SNI routes), service (string), tags (list of
+//     strings), now (timestamp), and tz (string, the service's timezone as a
+//     UTC offset, e.g., "-05:00", for now's getters).
+//   - Functions: cidr("10.0.0.0/8") (for use with in), hour() (0-23), and
+//     weekday() (0-6, Sunday is 0), the latter two being short for
+//     now.getHours(tz) and now.getDayOfWeek(tz).
+//
+// For example: client.ip in cidr("10.0.0.0/8") && hour() < 20
+type Expr struct {
+	src string
+	prg cel.Program
+}
+
+// exprEnv is what an expression is evaluated against.
+type exprEnv struct {
+	// vars are the values of the expression variables.
+	vars map[string]any
+	// sni is the SNI of the client's TLS client hello (if any).
+	sni string
+}
+
+// newClientEnv returns the env for a client with the given address (and SNI)
+// connecting to the given service.
+func newClientEnv(
+	clientAddr net.Addr, sni, svcName string, tags []string, now time.Time,
+) *exprEnv {
+	ip, port := "", int64(0)
+	if tcpAddr, ok := clientAddr.(*net.TCPAddr); ok {
+		ip, port = tcpAddr.IP.String(), int64(tcpAddr.Port)
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	return &exprEnv{
+		vars: map[string]any{
+			"client.ip":   ip,
+			"client.port": port,
+			"client.sni":  sni,
+			"service":     svcName,
+			"tags":        tags,
+			"now":         now,
+			"tz":          now.Format("-07:00"),
+		},
+		sni: sni,
+	}
+}
+
+// celEnv returns the CEL environment expressions are compiled in.
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("client.ip", cel.StringType),
+		cel.Variable("client.port", cel.IntType),
+		cel.Variable("client.sni", cel.StringType),
+		cel.Variable("service", cel.StringType),
+		cel.Variable("tags", cel.ListType(cel.StringType)),
+		cel.Variable("now", cel.TimestampType),
+		cel.Variable("tz", cel.StringType),
+		cel.Function("cidr",
+			cel.Overload(
+				"cidr_string", []*cel.Type{cel.StringType}, cidrType,
+				cel.UnaryBinding(func(s ref.Val) ref.Val {
+					_, ipNet, err := net.ParseCIDR(string(s.(types.String)))
+					if err != nil {
+						return types.WrapErr(err)
+					}
+					return cidrVal{ipNet}
+				}),
+			),
+		),
+		// The standard in calls the container's Contains (see cidrVal)
+		cel.Function(operators.In,
+			cel.Overload(
+				"in_string_cidr", []*cel.Type{cel.StringType, cidrType},
+				cel.BoolType,
+			),
+		),
+		cel.Macros(
+			cel.GlobalMacro("hour", 0, nowMacro("getHours")),
+			cel.GlobalMacro("weekday", 0, nowMacro("getDayOfWeek")),
+		),
+	)
+})
+
+// nowMacro returns a macro expanding to a call of the getter on now in tz.
+func nowMacro(getter string) cel.MacroFactory {
+	return func(
+		eh cel.MacroExprFactory, _ ast.Expr, _ []ast.Expr,
+	) (ast.Expr, *cel.Error) {
+		now, tz := eh.NewIdent("now"), eh.NewIdent("tz")
+		return eh.NewMemberCall(getter, now, tz), nil
+	}
+}
+
+// CompileExpr compiles the expression.
+func CompileExpr(src string) (*Expr, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	checked, iss := env.Compile(src)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	} else if !checked.OutputType().IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf(
+			"expression evaluates to %s, not bool", checked.OutputType(),
+		)
+	} else if err := checkCIDRs(checked); err != nil {
+		return nil, err
+	}
+	prg, err := env.Program(checked)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src: src, prg: prg}, nil
+}
+
+// checkCIDRs returns an error if a cidr call's literal network is invalid, so
+// that it's caught up front rather than when evaluated.
+func checkCIDRs(checked *cel.Ast) error {
+	calls := ast.MatchDescendants(
+		ast.NavigateAST(checked.NativeRep()), ast.FunctionMatcher("cidr"),
+	)
+	for _, call := range calls {
+		arg := call.AsCall().Args()[0]
+		if arg.Kind() != ast.LiteralKind {
+			continue
+		}
+		s, ok := arg.AsLiteral().(types.String)
+		if !ok {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(string(s)); err != nil {
+			return fmt.Errorf("cidr: %w", err)
+		}
+	}
+	return nil
+}
+
+// Eval evaluates the expression.
+func (e *Expr) Eval(env *exprEnv) (bool, error) {
+	v, _, err := e.prg.Eval(env.vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(types.Bool)
+	if !ok {
+		return false, fmt.Errorf("expression evaluated to %s, not bool", v.Type())
+	}
+	return bool(b), nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// cidrType is the type of the networks returned by cidr.
+var cidrType = types.NewOpaqueType("cidr")
+
+// cidrRuntimeType is cidrType when evaluating, where it's a container so that
+// in calls Contains.
+type cidrRuntimeType struct{}
+
+func (cidrRuntimeType) HasTrait(trait int) bool {
+	return trait == traits.ContainerType
+}
+
+func (cidrRuntimeType) TypeName() string {
+	return cidrType.TypeName()
+}
+
+// cidrVal is a network returned by cidr.
+type cidrVal struct {
+	*net.IPNet
+}
+
+// Contains returns whether the value is an IP (string) in the network.
+func (v cidrVal) Contains(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	ip := net.ParseIP(string(s))
+	return types.Bool(ip != nil && v.IPNet.Contains(ip))
+}
+
+func (v cidrVal) ConvertToNative(typeDesc reflect.Type) (any, error) {
+	if reflect.TypeOf(v.IPNet).AssignableTo(typeDesc) {
+		return v.IPNet, nil
+	}
+	return nil, errors.New("cidr can't be converted")
+}
+
+func (v cidrVal) ConvertToType(typeVal ref.Type) ref.Val {
+	if typeVal == types.TypeType {
+		return cidrType
+	}
+	return types.NewErr("can't convert cidr to %s", typeVal.TypeName())
+}
+
+func (v cidrVal) Equal(other ref.Val) ref.Val {
+	o, ok := other.(cidrVal)
+	return types.Bool(ok && v.String() == o.String())
+}
+
+func (v cidrVal) Type() ref.Type {
+	return cidrRuntimeType{}
+}
+
+func (v cidrVal) Value() any {
+	return v.IPNet
+}
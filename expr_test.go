@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCompileExprInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{name: "empty", src: ""},
+		{name: "syntax error", src: "client.ip =="},
+		{name: "unbalanced parentheses", src: "(hour() < 20"},
+		{name: "unknown variable", src: "client.mac == \"00:00:00:00:00:00\""},
+		{name: "unknown function", src: "minute() < 30"},
+		{name: "type mismatch", src: "client.port == \"80\""},
+		{name: "not bool", src: "client.port + 1"},
+		{name: "invalid cidr", src: "client.ip in cidr(\"10.0.0.0/33\")"},
+		{name: "cidr of int", src: "client.ip in cidr(10)"},
+		{name: "hour with args", src: "hour(1) < 20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileExpr(tt.src); err == nil {
+				t.Fatalf("expected error compiling %q", tt.src)
+			}
+		})
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	// A Sunday at 21:30 in loc (02:30 Monday in UTC)
+	now := time.Date(2026, 10, 18, 21, 30, 0, 0, loc)
+	env := newClientEnv(
+		&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5432},
+		"db.example.com", "db", []string{"office"}, now,
+	)
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: `client.ip in cidr("10.0.0.0/8")`, want: true},
+		{src: `client.ip in cidr("192.168.0.0/16")`},
+		{src: `!(client.ip in cidr("192.168.0.0/16"))`, want: true},
+		{src: `client.port == 5432 && client.sni == "db.example.com"`, want: true},
+		{src: `client.port in [80, 443]`},
+		{src: `service == "db" || service == "web"`, want: true},
+		{src: `"office" in tags`, want: true},
+		{src: `tags.exists(t, t.startsWith("off"))`, want: true},
+		{src: `size(tags) == 0`},
+		{src: `hour() == 21`, want: true},
+		{src: `weekday() == 0`, want: true},
+		{src: `hour() >= 9 && hour() < 17`},
+		{src: `now.getHours("UTC") == 2`, want: true},
+		{src: `client.sni.endsWith(".example.com")`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := CompileExpr(tt.src)
+			if err != nil {
+				t.Fatal("error compiling: ", err)
+			}
+			if got, err := e.Eval(env); err != nil {
+				t.Fatal("error evaluating: ", err)
+			} else if got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	// Networks only known when evaluated are checked then
+	e, err := CompileExpr(`client.ip in cidr(service)`)
+	if err != nil {
+		t.Fatal("error compiling: ", err)
+	}
+	env := newClientEnv(
+		&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5432},
+		"", "db", nil, time.Now(),
+	)
+	if _, err := e.Eval(env); err == nil {
+		t.Fatal("expected error evaluating invalid cidr")
+	} else if evalRule(e, env) {
+		t.Fatal("expected failed rule not to match")
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// With forward error correction (fec-data-shards and fec-parity-shards), the
+// QUIC transport's datagrams are sent in groups of data shards followed by
+// parity shards (Reed-Solomon), so the peer rebuilds up to parity-shards lost
+// datagrams of each group rather than QUIC waiting to notice the loss and
+// retransmit (e.g., over an LTE link with ~2% loss). Both sides must use the
+// same shard counts; datagrams from peers using others are dropped.
+//
+// Each datagram starts with a header of the data and parity shard counts (less
+// one each), the group's sequence number (4 bytes, big endian), the shard's
+// index, and, for parity shards, how many data shards the group has (less
+// one). Data shards carry the QUIC packet as is. The parity shards are
+// computed over the data shards' packets, each prefixed with its 2-byte length
+// and padded to the longest. A group's parity is sent once all its data shards
+// were, or once no more were sent for fecFlushDelay, in which case the group
+// is cut short and its missing data shards count as empty. That way, the last
+// packets of a burst (often ACKs or handshake packets) are protected too.
+// QUIC's path-MTU discovery is disabled with FEC so that its packets stay
+// small enough to leave room for the header.
+
+// fecHeaderSize is the size of the header of each datagram.
+const fecHeaderSize = 8
+
+const (
+	// fecMaxShards is the most shards a group can have in total.
+	fecMaxShards = 256
+	// fecWindow is how many of the latest groups of each peer are kept to
+	// rebuild their lost datagrams.
+	fecWindow = 16
+	// fecPeerIdle is how long a peer's groups are kept after its last
+	// datagram to or from it.
+	fecPeerIdle = time.Minute
+	// fecFlushDelay is how long a group may go without a new data shard
+	// before its parity is sent without the rest.
+	fecFlushDelay = 10 * time.Millisecond
+)
+
+var (
+	// fecDataShards and fecParityShards are the number of data and parity
+	// shards of each group of QUIC datagrams (0 means no FEC).
+	fecDataShards, fecParityShards int
+)
+
+// fecEnabled returns whether FEC was configured.
+func fecEnabled() bool {
+	return fecDataShards != 0 || fecParityShards != 0
+}
+
+// validFEC returns an error if the FEC shard counts are invalid.
+func validFEC() error {
+	if !fecEnabled() {
+		return nil
+	} else if fecDataShards <= 0 || fecParityShards <= 0 {
+		return errors.New(
+			"fec-data-shards and fec-parity-shards must both be positive",
+		)
+	} else if fecDataShards+fecParityShards > fecMaxShards {
+		return fmt.Errorf(
+			"fec-data-shards and fec-parity-shards must total at most %d",
+			fecMaxShards,
+		)
+	}
+	return nil
+}
+
+// fecConn is a packet conn adding FEC to the datagrams sent and received.
+type fecConn struct {
+	net.PacketConn
+	enc          reedsolomon.Encoder
+	data, parity int
+
+	sendMtx sync.Mutex
+	senders map[string]*fecSender
+
+	recvMtx   sync.Mutex
+	receivers map[string]*fecReceiver
+	// recovered are the rebuilt datagrams not yet returned by ReadFrom.
+	recovered []fecDatagram
+	// mismatched are the peers whose datagrams were dropped for using other
+	// shard counts (so it's only logged once).
+	mismatched map[string]bool
+	buf        []byte
+}
+
+// fecSender is the group being sent to a peer.
+type fecSender struct {
+	seq uint32
+	// shards are the data shards sent so far, with their lengths.
+	shards   [][]byte
+	lastSent time.Time
+	// flush sends the group's parity once it's been idle for fecFlushDelay.
+	flush *time.Timer
+}
+
+// fecReceiver is the groups being received from a peer.
+type fecReceiver struct {
+	groups   map[uint32]*fecGroup
+	latest   uint32
+	lastSeen time.Time
+}
+
+// fecGroup is the shards received of a group.
+type fecGroup struct {
+	shards [][]byte
+	count  int
+	// done is whether the group needs no more shards (all its data shards
+	// were received or rebuilt).
+	done bool
+}
+
+// fecDatagram is a datagram rebuilt from a peer.
+type fecDatagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// newFECConn returns the conn with FEC using the configured shard counts.
+func newFECConn(conn net.PacketConn) (*fecConn, error) {
+	enc, err := reedsolomon.New(fecDataShards, fecParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &fecConn{
+		PacketConn: conn,
+		enc:        enc,
+		data:       fecDataShards,
+		parity:     fecParityShards,
+		senders:    make(map[string]*fecSender),
+		receivers:  make(map[string]*fecReceiver),
+		mismatched: make(map[string]bool),
+		buf:        make([]byte, 1<<16),
+	}, nil
+}
+
+// header returns the header of the shard with the given index of the group,
+// which has the given number of data shards (only known for parity shards).
+func (c *fecConn) header(seq uint32, index, data int) []byte {
+	hdr := []byte{
+		byte(c.data - 1), byte(c.parity - 1), 0, 0, 0, 0, byte(index), 0,
+	}
+	binary.BigEndian.PutUint32(hdr[2:], seq)
+	if data != 0 {
+		hdr[7] = byte(data - 1)
+	}
+	return hdr
+}
+
+func (c *fecConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > 1<<16-1-fecHeaderSize-2 {
+		return 0, errors.New("datagram too large for FEC")
+	}
+	c.sendMtx.Lock()
+	defer c.sendMtx.Unlock()
+	now := time.Now()
+	s := c.senders[addr.String()]
+	if s == nil {
+		for key, s := range c.senders {
+			if now.Sub(s.lastSent) > fecPeerIdle {
+				delete(c.senders, key)
+			}
+		}
+		s = &fecSender{}
+		c.senders[addr.String()] = s
+	}
+	s.lastSent = now
+	hdr := c.header(s.seq, len(s.shards), 0)
+	if _, err := c.PacketConn.WriteTo(append(hdr, p...), addr); err != nil {
+		return 0, err
+	}
+	shard := make([]byte, 2, 2+len(p))
+	binary.BigEndian.PutUint16(shard, uint16(len(p)))
+	s.shards = append(s.shards, append(shard, p...))
+	if len(s.shards) < c.data {
+		if s.flush == nil {
+			s.flush = time.AfterFunc(fecFlushDelay, func() { c.flush(s, addr) })
+		} else {
+			s.flush.Reset(fecFlushDelay)
+		}
+		return len(p), nil
+	}
+	if s.flush != nil {
+		s.flush.Stop()
+	}
+	if err := c.sendParity(s, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush sends the parity of the peer's group if it's still partial.
+func (c *fecConn) flush(s *fecSender, addr net.Addr) {
+	c.sendMtx.Lock()
+	defer c.sendMtx.Unlock()
+	if len(s.shards) != 0 {
+		// QUIC retransmits the group's packets if they're lost
+		c.sendParity(s, addr)
+	}
+}
+
+// sendParity sends the parity shards of the peer's group (full or not) and
+// starts its next group.
+func (c *fecConn) sendParity(s *fecSender, addr net.Addr) error {
+	data := len(s.shards)
+	shards := padShards(s.shards, c.data+c.parity)
+	seq := s.seq
+	s.seq++
+	s.shards = s.shards[:0]
+	if err := c.enc.Encode(shards); err != nil {
+		return err
+	}
+	for i, shard := range shards[c.data:] {
+		hdr := c.header(seq, c.data+i, data)
+		_, err := c.PacketConn.WriteTo(append(hdr, shard...), addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// padShards returns the shards padded to the longest, with room for the rest
+// of the total shards (which are empty).
+func padShards(shards [][]byte, total int) [][]byte {
+	size := 0
+	for _, shard := range shards {
+		size = max(size, len(shard))
+	}
+	padded := make([][]byte, total)
+	for i := range padded {
+		padded[i] = make([]byte, size)
+		if i < len(shards) {
+			copy(padded[i], shards[i])
+		}
+	}
+	return padded
+}
+
+func (c *fecConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.recvMtx.Lock()
+	defer c.recvMtx.Unlock()
+	for {
+		if len(c.recovered) != 0 {
+			d := c.recovered[0]
+			c.recovered = c.recovered[1:]
+			return copy(p, d.b), d.addr, nil
+		}
+		n, addr, err := c.PacketConn.ReadFrom(c.buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		b := c.buf[:n]
+		if n < fecHeaderSize {
+			continue
+		} else if int(b[0])+1 != c.data || int(b[1])+1 != c.parity {
+			if !c.mismatched[addr.String()] {
+				c.mismatched[addr.String()] = true
+				log.Printf(
+					"Dropping datagrams from %s with FEC shards %d+%d (expected %d+%d)",
+					addr, int(b[0])+1, int(b[1])+1, c.data, c.parity,
+				)
+			}
+			continue
+		}
+		seq, index := binary.BigEndian.Uint32(b[2:]), int(b[6])
+		if index >= c.data+c.parity {
+			continue
+		}
+		data := int(b[7]) + 1
+		if index >= c.data && data > c.data {
+			continue
+		}
+		payload := b[fecHeaderSize:]
+		c.receive(addr, seq, index, data, payload)
+		if index < c.data {
+			return copy(p, payload), addr, nil
+		}
+	}
+}
+
+// receive stores the shard of the peer's group, rebuilding the group's lost
+// data shards (queued to be returned) once there are enough shards. For parity
+// shards, data is how many data shards the group has.
+func (c *fecConn) receive(
+	addr net.Addr, seq uint32, index, data int, payload []byte,
+) {
+	now := time.Now()
+	r := c.receivers[addr.String()]
+	if r == nil {
+		for key, r := range c.receivers {
+			if now.Sub(r.lastSeen) > fecPeerIdle {
+				delete(c.receivers, key)
+			}
+		}
+		r = &fecReceiver{groups: make(map[uint32]*fecGroup), latest: seq}
+		c.receivers[addr.String()] = r
+	}
+	r.lastSeen = now
+	if int32(seq-r.latest) > 0 {
+		r.latest = seq
+		for s := range r.groups {
+			if int32(r.latest-s) >= fecWindow {
+				delete(r.groups, s)
+			}
+		}
+	} else if int32(r.latest-seq) >= fecWindow {
+		return
+	}
+	g := r.groups[seq]
+	if g == nil {
+		g = &fecGroup{shards: make([][]byte, c.data+c.parity)}
+		r.groups[seq] = g
+	}
+	if g.done || g.shards[index] != nil {
+		return
+	}
+	if index < c.data {
+		shard := make([]byte, 2, 2+len(payload))
+		binary.BigEndian.PutUint16(shard, uint16(len(payload)))
+		g.shards[index] = append(shard, payload...)
+	} else {
+		g.shards[index] = append([]byte(nil), payload...)
+		// The data shards of a group cut short are empty
+		for i := data; i < c.data; i++ {
+			if g.shards[i] == nil {
+				g.shards[i] = []byte{0, 0}
+				g.count++
+			}
+		}
+	}
+	g.count++
+	if g.count < c.data {
+		return
+	}
+	g.done = true
+	var lost []int
+	for i, shard := range g.shards[:c.data] {
+		if shard == nil {
+			lost = append(lost, i)
+		}
+	}
+	if len(lost) == 0 {
+		return
+	}
+	padReceived(g.shards)
+	if err := c.enc.ReconstructData(g.shards); err != nil {
+		return
+	}
+	for _, i := range lost {
+		shard := g.shards[i]
+		n := int(binary.BigEndian.Uint16(shard))
+		if n > len(shard)-2 {
+			continue
+		}
+		c.recovered = append(c.recovered, fecDatagram{b: shard[2 : 2+n], addr: addr})
+	}
+}
+
+// bufferSetter is a conn whose socket buffer sizes can be set (e.g., a UDP
+// conn), which QUIC uses to enlarge them.
+type bufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+func (c *fecConn) SetReadBuffer(bytes int) error {
+	bs, ok := c.PacketConn.(bufferSetter)
+	if !ok {
+		return errors.New("conn doesn't allow setting buffer sizes")
+	}
+	return bs.SetReadBuffer(bytes)
+}
+
+func (c *fecConn) SetWriteBuffer(bytes int) error {
+	bs, ok := c.PacketConn.(bufferSetter)
+	if !ok {
+		return errors.New("conn doesn't allow setting buffer sizes")
+	}
+	return bs.SetWriteBuffer(bytes)
+}
+
+// padReceived pads the received data shards to the size of the parity shards
+// (which have the padded size).
+func padReceived(shards [][]byte) {
+	size := 0
+	for _, shard := range shards {
+		size = max(size, len(shard))
+	}
+	for i, shard := range shards {
+		if shard != nil && len(shard) < size {
+			shards[i] = append(shard, make([]byte, size-len(shard))...)
+		}
+	}
+}
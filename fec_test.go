@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// setFEC sets the FEC shard counts for the test.
+func setFEC(t *testing.T, data, parity int) {
+	t.Helper()
+	oldData, oldParity := fecDataShards, fecParityShards
+	fecDataShards, fecParityShards = data, parity
+	t.Cleanup(func() { fecDataShards, fecParityShards = oldData, oldParity })
+}
+
+// droppingConn is a packet conn dropping the datagrams written whose indexes
+// (counting from 0) are in drop.
+type droppingConn struct {
+	net.PacketConn
+	drop    map[int]bool
+	written int
+}
+
+func (c *droppingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	i := c.written
+	c.written++
+	if c.drop[i] {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// newFECPair returns a conn with FEC sending through a dropping conn to a conn
+// with FEC receiving, both over local UDP sockets.
+func newFECPair(t *testing.T, drop map[int]bool) (*fecConn, *fecConn) {
+	t.Helper()
+	var conns [2]net.PacketConn
+	for i := range conns {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns[i] = conn
+	}
+	sender, err := newFECConn(&droppingConn{PacketConn: conns[0], drop: drop})
+	if err != nil {
+		t.Fatal("error creating sender: ", err)
+	}
+	receiver, err := newFECConn(conns[1])
+	if err != nil {
+		t.Fatal("error creating receiver: ", err)
+	}
+	return sender, receiver
+}
+
+// readAll returns the datagrams read until none are received for a while.
+func readAll(t *testing.T, conn net.PacketConn) [][]byte {
+	t.Helper()
+	var got [][]byte
+	buf := make([]byte, 1<<16)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Fatal("error reading: ", err)
+			}
+			return got
+		}
+		got = append(got, append([]byte(nil), buf[:n]...))
+	}
+}
+
+func TestFECRecovery(t *testing.T) {
+	// With 4+2 shards, each group is written as datagrams 0-3 (data) and 4-5
+	// (parity), the next group starting at 6. A partial group's parity follows
+	// its last data shard (e.g., 7-8 after packet 4 at 6).
+	tests := []struct {
+		name string
+		// packets is how many packets are written (8 if 0).
+		packets int
+		drop    []int
+		// lost are the indexes of the packets expected to be lost.
+		lost []int
+	}{
+		{name: "no loss"},
+		{name: "one data shard", drop: []int{1}},
+		{name: "two data shards", drop: []int{0, 3}},
+		{name: "data and parity shards", drop: []int{2, 5}},
+		{name: "shards of each group", drop: []int{0, 1, 8, 10}},
+		{name: "more than the parity", drop: []int{0, 1, 2}, lost: []int{0, 1, 2}},
+		{name: "all parity shards", drop: []int{4, 5}},
+		{name: "partial group", packets: 5, drop: []int{6}},
+		{name: "partial group's shards", packets: 6, drop: []int{6, 7}},
+		{name: "partial group's data and parity", packets: 7, drop: []int{7, 9}},
+		{
+			name: "more than the partial group's parity", packets: 6,
+			drop: []int{6, 8, 9}, lost: []int{4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFEC(t, 4, 2)
+			drop := make(map[int]bool)
+			for _, i := range tt.drop {
+				drop[i] = true
+			}
+			sender, receiver := newFECPair(t, drop)
+
+			// Packets of varying sizes
+			numPackets := tt.packets
+			if numPackets == 0 {
+				numPackets = 8
+			}
+			var packets [][]byte
+			for i := 0; i < numPackets; i++ {
+				packets = append(packets, bytes.Repeat([]byte{byte(i + 1)}, 1+i*150))
+			}
+			for _, p := range packets {
+				n, err := sender.WriteTo(p, receiver.LocalAddr())
+				if err != nil {
+					t.Fatal("error writing: ", err)
+				} else if n != len(p) {
+					t.Fatalf("expected %d bytes written, got %d", len(p), n)
+				}
+			}
+
+			lost := make(map[int]bool)
+			for _, i := range tt.lost {
+				lost[i] = true
+			}
+			got := make(map[int]bool)
+			for _, p := range readAll(t, receiver) {
+				i := int(p[0]) - 1
+				if i < 0 || i >= len(packets) || !bytes.Equal(p, packets[i]) {
+					t.Fatalf("got corrupt packet of %d bytes", len(p))
+				} else if got[i] {
+					t.Fatalf("got packet %d twice", i)
+				}
+				got[i] = true
+			}
+			for i := range packets {
+				if got[i] == lost[i] {
+					t.Errorf("packet %d: expected received %v", i, !lost[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFECMismatchedShards(t *testing.T) {
+	setFEC(t, 4, 2)
+	sender, receiver := newFECPair(t, nil)
+	setFEC(t, 3, 2)
+	other, err := newFECConn(sender.PacketConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := other.WriteTo([]byte{byte(i)}, receiver.LocalAddr()); err != nil {
+			t.Fatal("error writing: ", err)
+		}
+	}
+	if got := readAll(t, receiver); len(got) != 0 {
+		t.Fatalf("expected datagrams with other shard counts dropped, got %d", len(got))
+	}
+}
+
+func TestValidFEC(t *testing.T) {
+	tests := []struct {
+		data, parity int
+		ok           bool
+	}{
+		{0, 0, true},
+		{10, 3, true},
+		{255, 1, true},
+		{10, 0, false},
+		{0, 3, false},
+		{-1, 3, false},
+		{200, 57, false},
+	}
+	for _, tt := range tests {
+		setFEC(t, tt.data, tt.parity)
+		if err := validFEC(); (err == nil) != tt.ok {
+			t.Errorf("%d+%d: expected valid %v, got error %v", tt.data, tt.parity, tt.ok, err)
+		}
+	}
+}
+
+func TestQUICTransportFEC(t *testing.T) {
+	setFEC(t, 4, 2)
+	ln, addr := setupTestQUIC(t)
+
+	conn, err := dialQUIC(addr)
+	if err != nil {
+		t.Fatal("error dialing: ", err)
+	}
+	defer conn.Close()
+	msg := bytes.Repeat([]byte("fec"), 10000)
+	go conn.Write(msg)
+	accepted := acceptTimeout(t, ln)
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(accepted, got); err != nil {
+		t.Fatal("error reading: ", err)
+	} else if !bytes.Equal(got, msg) {
+		t.Fatal("got corrupt data")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP/2 clients with prior knowledge (h2c, e.g., gRPC without TLS, or h2
+// negotiated with ALPN on TLS the proxy terminated) start with the connection
+// preface rather than an HTTP/1.1 request, so http mode reads the host from
+// the :authority (or host) of the first request's headers instead (along with
+// its content-type, to tell gRPC streams apart). The frames and HPACK are
+// decoded with golang.org/x/net/http2, so the header block may use the
+// dynamic table (within the limits of the default table size).
+
+// h2Preface is the connection preface HTTP/2 clients start with.
+const h2Preface = http2.ClientPreface
+
+const (
+	// h2MaxHeaderList is the most (decoded, by HPACK's size) of the first
+	// request's headers read.
+	h2MaxHeaderList = 64 << 10
+	// h2MaxFrames is the most frames read before the first request's headers.
+	h2MaxFrames = 16
+	// h2HeaderTableSize is HTTP/2's initial SETTINGS_HEADER_TABLE_SIZE, which
+	// the proxy never changes since it doesn't speak to the client.
+	h2HeaderTableSize = 4096
+)
+
+// readH2Head reads the connection preface and the frames up to the end of the
+// first request's headers, returning what's known of the request.
+func readH2Head(r *bufio.Reader) (httpHead, error) {
+	if _, err := r.Discard(len(h2Preface)); err != nil {
+		return httpHead{}, err
+	}
+	fr := http2.NewFramer(nil, r)
+	fr.ReadMetaHeaders = hpack.NewDecoder(h2HeaderTableSize, nil)
+	fr.MaxHeaderListSize = h2MaxHeaderList
+	for i := 0; i < h2MaxFrames; i++ {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return httpHead{}, fmt.Errorf("error reading HTTP/2 frame: %w", err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame, *http2.WindowUpdateFrame, *http2.PriorityFrame:
+			continue
+		case *http2.MetaHeadersFrame:
+			if f.Truncated {
+				return httpHead{}, errors.New("HTTP/2 headers too long")
+			}
+			return h2Head(f)
+		default:
+			return httpHead{}, fmt.Errorf(
+				"unexpected HTTP/2 frame type %s", f.Header().Type,
+			)
+		}
+	}
+	return httpHead{}, errors.New("too many HTTP/2 frames before headers")
+}
+
+// h2Head returns the :authority (or host, if there's no :authority) and
+// whether the content-type is gRPC's from the decoded headers.
+func h2Head(f *http2.MetaHeadersFrame) (httpHead, error) {
+	var head httpHead
+	host := ""
+	for _, hf := range f.RegularFields() {
+		switch hf.Name {
+		case "host":
+			host = hf.Value
+		case "content-type":
+			head.grpc = isGRPC(hf.Value)
+		}
+	}
+	if head.host = f.PseudoValue("authority"); head.host == "" {
+		head.host = host
+	}
+	if head.host == "" {
+		return head, errors.New("HTTP/2 request has no authority")
+	}
+	return head, nil
+}
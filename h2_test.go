@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// hpackBlock returns the header block encoding the fields, with the dynamic
+// table's size first set to tableSize (if not 0).
+func hpackBlock(tableSize uint32, fields ...hpack.HeaderField) []byte {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	if tableSize != 0 {
+		enc.SetMaxDynamicTableSize(tableSize)
+	}
+	for _, hf := range fields {
+		enc.WriteField(hf)
+	}
+	return buf.Bytes()
+}
+
+// h2Conn returns a reader of the preface followed by the frames written by
+// write.
+func h2Conn(t *testing.T, write func(fr *http2.Framer) error) *bufio.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString(h2Preface)
+	if err := write(http2.NewFramer(&buf, nil)); err != nil {
+		t.Fatal("error writing frames: ", err)
+	}
+	return bufio.NewReader(&buf)
+}
+
+// h2Headers writes the header block in a HEADERS frame preceded by a SETTINGS
+// frame, with the rest of it in CONTINUATION frames if longer than split (if
+// not 0).
+func h2Headers(block []byte, split int) func(fr *http2.Framer) error {
+	return func(fr *http2.Framer) error {
+		if err := fr.WriteSettings(); err != nil {
+			return err
+		}
+		first := block
+		if split != 0 && len(block) > split {
+			first = block[:split]
+		}
+		err := fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID: 1, BlockFragment: first,
+			EndHeaders: len(first) == len(block), EndStream: true,
+		})
+		for rest := block[len(first):]; err == nil && len(rest) != 0; {
+			chunk := rest
+			if len(chunk) > split {
+				chunk = chunk[:split]
+			}
+			rest = rest[len(chunk):]
+			err = fr.WriteContinuation(1, len(rest) == 0, chunk)
+		}
+		return err
+	}
+}
+
+func TestReadH2Head(t *testing.T) {
+	method := hpack.HeaderField{Name: ":method", Value: "POST"}
+	authority := hpack.HeaderField{Name: ":authority", Value: "example.com"}
+	grpc := hpack.HeaderField{Name: "content-type", Value: "application/grpc"}
+	path := hpack.HeaderField{Name: ":path", Value: "/" + strings.Repeat("p", 24)}
+	tests := []struct {
+		name  string
+		block []byte
+		// split is the most of the block in each frame (all if 0).
+		split   int
+		want    httpHead
+		wantErr bool
+	}{
+		{
+			name:  "authority",
+			block: hpackBlock(0, method, authority),
+			want:  httpHead{host: "example.com"},
+		},
+		{
+			name:  "host",
+			block: hpackBlock(0, method, hpack.HeaderField{Name: "host", Value: "h.example"}),
+			want:  httpHead{host: "h.example"},
+		},
+		{
+			name:  "gRPC across continuations",
+			block: hpackBlock(0, method, authority, path, grpc),
+			split: 10,
+			want:  httpHead{host: "example.com", grpc: true},
+		},
+		{
+			// Adding the content-type (60 bytes) evicts the path (62 bytes)
+			// from the 128-byte table holding it and the authority (53 bytes),
+			// the content-type then being referred to by its dynamic index
+			name:  "dynamic table eviction",
+			block: hpackBlock(128, path, authority, grpc, grpc),
+			want:  httpHead{host: "example.com", grpc: true},
+		},
+		{
+			// The path (index 64 once the content-type is added) was evicted
+			name: "evicted entry referred to",
+			block: append(
+				hpackBlock(128, path, authority, grpc), 0x80|64,
+			),
+			wantErr: true,
+		},
+		{
+			name:    "no authority",
+			block:   hpackBlock(0, method, grpc),
+			wantErr: true,
+		},
+		{
+			name: "oversized header list",
+			block: hpackBlock(0, authority, hpack.HeaderField{
+				Name: "x-big", Value: strings.Repeat("b", h2MaxHeaderList),
+			}),
+			split:   16 << 10,
+			wantErr: true,
+		},
+		{
+			// :authority (static index 1) without indexing, then the Huffman
+			// code of "a" (00011) padded with zeros rather than the EOS code's
+			// ones
+			name:    "invalid Huffman padding",
+			block:   []byte{0x01, 0x81, 0x18},
+			wantErr: true,
+		},
+		{
+			name:    "Huffman padding longer than 7 bits",
+			block:   []byte{0x01, 0x82, 0x1F, 0xFF},
+			wantErr: true,
+		},
+		{
+			name:  "valid Huffman padding",
+			block: []byte{0x01, 0x81, 0x1F},
+			want:  httpHead{host: "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := h2Conn(t, h2Headers(tt.block, tt.split))
+			got, err := readH2Head(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error reading head: ", err)
+			} else if got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReadH2HeadFrames(t *testing.T) {
+	block := hpackBlock(0, hpack.HeaderField{Name: ":authority", Value: "example.com"})
+	tests := []struct {
+		name    string
+		write   func(fr *http2.Framer) error
+		wantErr bool
+	}{
+		{
+			name: "window update and priority first",
+			write: func(fr *http2.Framer) error {
+				fr.WriteWindowUpdate(0, 1<<20)
+				fr.WritePriority(3, http2.PriorityParam{Weight: 1})
+				return h2Headers(block, 0)(fr)
+			},
+		},
+		{
+			name: "data first",
+			write: func(fr *http2.Framer) error {
+				return fr.WriteData(1, false, []byte("data"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "headers interrupted",
+			write: func(fr *http2.Framer) error {
+				fr.WriteHeaders(http2.HeadersFrameParam{
+					StreamID: 1, BlockFragment: block[:1],
+				})
+				return fr.WriteSettings()
+			},
+			wantErr: true,
+		},
+		{
+			name: "too many frames",
+			write: func(fr *http2.Framer) error {
+				for i := 0; i < h2MaxFrames; i++ {
+					fr.WriteWindowUpdate(0, 1)
+				}
+				return h2Headers(block, 0)(fr)
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readH2Head(h2Conn(t, tt.write))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// hookTimeout is how long a hook command or webhook may take.
+const hookTimeout = 10 * time.Second
+
+var (
+	// onConnect and onDisconnect are the hooks run when a pipe is established
+	// or torn down. Each is either a shell command (given the event through
+	// TUNNELIT_* env vars) or an http(s) URL (POSTed the event as JSON).
+	onConnect    string
+	onDisconnect string
+	hookClient   = &http.Client{Timeout: hookTimeout}
+)
+
+// hookEvent holds the metadata passed to a hook.
+type hookEvent struct {
+	Event      string `json:"event"`
+	Service    string `json:"service"`
+	ClientAddr string `json:"client_addr"`
+	PeerAddr   string `json:"peer_addr"`
+	Tags       string `json:"tags,omitempty"`
+	// The following are only set for disconnects.
+	BytesSent  int64 `json:"bytes_sent,omitempty"`
+	BytesRecvd int64 `json:"bytes_received,omitempty"`
+	DurationMS int64 `json:"duration_ms,omitempty"`
+}
+
+// env returns the event as env vars.
+func (ev hookEvent) env() []string {
+	return []string{
+		"TUNNELIT_EVENT=" + ev.Event,
+		"TUNNELIT_SERVICE=" + ev.Service,
+		"TUNNELIT_CLIENT_ADDR=" + ev.ClientAddr,
+		"TUNNELIT_PEER_ADDR=" + ev.PeerAddr,
+		"TUNNELIT_TAGS=" + ev.Tags,
+		fmt.Sprint("TUNNELIT_BYTES_SENT=", ev.BytesSent),
+		fmt.Sprint("TUNNELIT_BYTES_RECEIVED=", ev.BytesRecvd),
+		fmt.Sprint("TUNNELIT_DURATION_MS=", ev.DurationMS),
+	}
+}
+
+// hooksSet returns whether any hooks are set.
+func hooksSet() bool {
+	return onConnect != "" || onDisconnect != ""
+}
+
+// runHook runs the hook (if any) for the event, logging any error.
+func runHook(hook string, ev hookEvent) {
+	if hook == "" {
+		return
+	}
+	var err error
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		err = postHook(hook, ev)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", hook)
+		cmd.Env = append(os.Environ(), ev.env()...)
+		var out []byte
+		if out, err = cmd.CombinedOutput(); err != nil && len(out) != 0 {
+			err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+		}
+	}
+	if err != nil {
+		log.Printf("Error running %s hook: %v", ev.Event, err)
+	}
+}
+
+func postHook(url string, ev hookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := hookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("received status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setHooks sets the connect and disconnect hooks for the test.
+func setHooks(t *testing.T, connect, disconnect string) {
+	t.Helper()
+	oldConnect, oldDisconnect := onConnect, onDisconnect
+	onConnect, onDisconnect = connect, disconnect
+	t.Cleanup(func() { onConnect, onDisconnect = oldConnect, oldDisconnect })
+}
+
+func TestRunHookCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.out")
+	runHook(
+		`echo "$TUNNELIT_EVENT $TUNNELIT_SERVICE $TUNNELIT_BYTES_SENT" > `+path,
+		hookEvent{Event: "disconnect", Service: "web", BytesSent: 42},
+	)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("error reading hook output: ", err)
+	} else if got := strings.TrimSpace(string(b)); got != "disconnect web 42" {
+		t.Fatalf("expected the event in the env, got %q", got)
+	}
+
+	buf := captureLog(t)
+	runHook("echo oops; exit 3", hookEvent{Event: "connect"})
+	if !strings.Contains(buf.String(), "Error running connect hook") ||
+		!strings.Contains(buf.String(), "oops") {
+		t.Fatalf("expected the failure and its output logged, got %q", buf)
+	}
+}
+
+func TestPipeHooks(t *testing.T) {
+	events := make(chan hookEvent, 2)
+	srvr := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var ev hookEvent
+			if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			events <- ev
+		},
+	))
+	defer srvr.Close()
+	setHooks(t, srvr.URL, srvr.URL)
+
+	client, backend, done := startPipe(t, connInfo{service: "web"})
+	go client.Write([]byte("hello"))
+	if _, err := io.ReadFull(backend, make([]byte, 5)); err != nil {
+		t.Fatal("error reading: ", err)
+	}
+	client.Close()
+	backend.Close()
+	waitPipe(t, done)
+
+	for _, want := range []string{"connect", "disconnect"} {
+		select {
+		case ev := <-events:
+			if ev.Event != want || ev.Service != "web" {
+				t.Fatalf("expected a %s event for web, got %+v", want, ev)
+			} else if want == "disconnect" && ev.BytesSent != 5 {
+				t.Fatalf("expected 5 bytes sent, got %+v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %s hook", want)
+		}
+	}
+}
+
+func TestPostHookStatus(t *testing.T) {
+	srvr := httptest.NewServer(http.NotFoundHandler())
+	defer srvr.Close()
+	if err := postHook(srvr.URL, hookEvent{Event: "connect"}); err == nil {
+		t.Fatal("expected an error for a non-2xx status")
+	}
+}
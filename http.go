@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The HTTP inspector records the recent requests (and their responses) of
+// the clients of services in http mode with inspect set, exposing them
+// through the admin API (and its inspector UI) along with a way to replay a
+// recorded request through the service's tunnels (e.g., for debugging
+// webhooks). Only HTTP/1.x requests the proxy can read (in plaintext or with
+// their TLS terminated) are recorded, and they're parsed from copies of what's
+// piped, so the pipes are never slowed down: pipes whose parsing falls behind
+// stop being inspected.
+
+const (
+	// inspectBodyLimit caps the bytes kept of each recorded body.
+	inspectBodyLimit = 64 << 10
+	// inspectQueueLimit caps the bytes queued for parsing in each direction
+	// of an inspected pipe.
+	inspectQueueLimit = 1 << 20
+	// inspectQueueChunks caps the number of chunks queued for parsing in each
+	// direction of an inspected pipe.
+	inspectQueueChunks = 1024
+	// inspectPending caps the number of requests awaiting their responses in
+	// an inspected pipe.
+	inspectPending = 64
+)
+
+// lastExchangeID is the ID of the last recorded exchange.
+var lastExchangeID atomic.Uint64
+
+// HTTPExchange is a request (and its response, once it's read) recorded by
+// the inspector.
+type HTTPExchange struct {
+	ID         uint64    `json:"id"`
+	Service    string    `json:"service"`
+	Tunnel     string    `json:"tunnel,omitempty"`
+	ClientAddr string    `json:"client_addr"`
+	Time       time.Time `json:"time"`
+	// Replay is the ID of the exchange this is a replay of (0 if it isn't).
+	Replay   uint64            `json:"replay,omitempty"`
+	Request  RecordedRequest   `json:"request"`
+	Response *RecordedResponse `json:"response,omitempty"`
+	// DurationMS is how long the response took (once it's read).
+	DurationMS int64 `json:"duration_ms,omitempty"`
+}
+
+// RecordedRequest is a request recorded by the inspector.
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URI    string      `json:"uri"`
+	Proto  string      `json:"proto"`
+	Host   string      `json:"host"`
+	Header http.Header `json:"header"`
+	RecordedBody
+}
+
+// RecordedResponse is a response recorded by the inspector.
+type RecordedResponse struct {
+	Status int         `json:"status"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+	RecordedBody
+}
+
+// RecordedBody is the body of a recorded request or response.
+type RecordedBody struct {
+	// Body is the first inspectBodyLimit bytes of the body.
+	Body []byte `json:"body,omitempty"`
+	// BodySize is the size of the whole body.
+	BodySize int64 `json:"body_size"`
+	// Truncated is whether only part of the body was kept.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// readRecordedBody reads the body (until it ends or fails), keeping the first
+// inspectBodyLimit bytes.
+func readRecordedBody(body io.Reader) RecordedBody {
+	var buf bytes.Buffer
+	n, _ := io.Copy(&buf, io.LimitReader(body, inspectBodyLimit))
+	rest, _ := io.Copy(io.Discard, body)
+	return RecordedBody{Body: buf.Bytes(), BodySize: n + rest, Truncated: rest != 0}
+}
+
+// exchangeRing holds a service's most recent exchanges.
+type exchangeRing struct {
+	mtx sync.Mutex
+	// exchanges are the exchanges, oldest first.
+	exchanges []*HTTPExchange
+}
+
+// add adds the exchange, dropping the oldest ones past max.
+func (r *exchangeRing) add(ex *HTTPExchange, max int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.exchanges = append(r.exchanges, ex)
+	if n := len(r.exchanges) - max; n > 0 {
+		clear(r.exchanges[:n])
+		r.exchanges = append(r.exchanges[:0], r.exchanges[n:]...)
+	}
+}
+
+// respond records the exchange's response.
+func (r *exchangeRing) respond(ex *HTTPExchange, resp *RecordedResponse) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	ex.Response = resp
+	ex.DurationMS = time.Since(ex.Time).Milliseconds()
+}
+
+// list returns copies of the exchanges, newest first.
+func (r *exchangeRing) list() []HTTPExchange {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	exs := make([]HTTPExchange, len(r.exchanges))
+	for i, ex := range r.exchanges {
+		exs[len(exs)-1-i] = *ex
+	}
+	return exs
+}
+
+// get returns a copy of the exchange with the ID.
+func (r *exchangeRing) get(id uint64) (HTTPExchange, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, ex := range r.exchanges {
+		if ex.ID == id {
+			return *ex, true
+		}
+	}
+	return HTTPExchange{}, false
+}
+
+// pipeInspector parses the requests and responses piped in either direction
+// of a pipe, recording them in the service's ring.
+type pipeInspector struct {
+	ring *exchangeRing
+	max  int
+	// template holds what's recorded with each of the pipe's exchanges.
+	template HTTPExchange
+	up, down *chunkReader
+}
+
+// inspectPipe starts inspecting the pipe's exchanges, recording them in the
+// ring (which keeps up to max exchanges). The inspector must be closed once
+// the pipe is done.
+func inspectPipe(ring *exchangeRing, max int, template HTTPExchange) *pipeInspector {
+	pi := &pipeInspector{
+		ring: ring, max: max, template: template,
+		up: newChunkReader(), down: newChunkReader(),
+	}
+	pending := make(chan *HTTPExchange, inspectPending)
+	go pi.readRequests(pending)
+	go pi.readResponses(pending)
+	return pi
+}
+
+// feed queues the bytes piped in the direction (up is from the client) for
+// parsing.
+func (pi *pipeInspector) feed(up bool, p []byte) {
+	if up {
+		pi.up.feed(p)
+	} else {
+		pi.down.feed(p)
+	}
+}
+
+// close stops the inspection once what's queued is parsed.
+func (pi *pipeInspector) close() {
+	pi.up.close()
+	pi.down.close()
+}
+
+// readRequests parses the client's requests, recording each and sending it to
+// be paired with its response. Upgraded conns (e.g., WebSockets) stop being
+// parsed once their requests' bytes no longer parse.
+func (pi *pipeInspector) readRequests(pending chan<- *HTTPExchange) {
+	defer close(pending)
+	br := bufio.NewReader(pi.up)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			pi.up.close()
+			return
+		}
+		ex := pi.template
+		ex.ID, ex.Time = lastExchangeID.Add(1), time.Now()
+		ex.Request = RecordedRequest{
+			Method: req.Method, URI: req.RequestURI, Proto: req.Proto,
+			Host: req.Host, Header: req.Header,
+			RecordedBody: readRecordedBody(req.Body),
+		}
+		pi.ring.add(&ex, pi.max)
+		select {
+		case pending <- &ex:
+		default:
+			// The responses are too far behind to be paired
+			pi.close()
+			return
+		}
+	}
+}
+
+// readResponses parses the responses, pairing each with the pending request
+// it's for.
+func (pi *pipeInspector) readResponses(pending <-chan *HTTPExchange) {
+	defer func() {
+		// Let the requests be read until the pipe is done
+		for range pending {
+		}
+	}()
+	br := bufio.NewReader(pi.down)
+	for ex := range pending {
+		var resp *http.Response
+		var err error
+		for {
+			resp, err = http.ReadResponse(br, &http.Request{Method: ex.Request.Method})
+			// Informational responses precede the final response
+			if err != nil || resp.StatusCode >= 200 ||
+				resp.StatusCode == http.StatusSwitchingProtocols {
+				break
+			}
+		}
+		if err != nil {
+			pi.down.close()
+			return
+		}
+		pi.ring.respond(ex, &RecordedResponse{
+			Status: resp.StatusCode, Proto: resp.Proto, Header: resp.Header,
+			RecordedBody: readRecordedBody(resp.Body),
+		})
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// No longer HTTP/1.x
+			pi.close()
+			return
+		}
+	}
+}
+
+// chunkReader reads chunks fed to it without blocking the feeder. Once more
+// than inspectQueueLimit bytes (or inspectQueueChunks chunks) are queued, the
+// reader is closed, and it returns EOF once what's queued is read.
+type chunkReader struct {
+	ch        chan []byte
+	queued    atomic.Int64
+	cur       []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChunkReader() *chunkReader {
+	return &chunkReader{
+		ch: make(chan []byte, inspectQueueChunks), done: make(chan struct{}),
+	}
+}
+
+// feed queues a copy of the bytes, closing the reader if the queue is full.
+func (c *chunkReader) feed(p []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if c.queued.Add(int64(len(p))) > inspectQueueLimit {
+		c.close()
+		return
+	}
+	select {
+	case c.ch <- bytes.Clone(p):
+	default:
+		c.close()
+	}
+}
+
+// close stops the reader from taking more chunks.
+func (c *chunkReader) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.cur) == 0 {
+		select {
+		case c.cur = <-c.ch:
+		case <-c.done:
+			select {
+			case c.cur = <-c.ch:
+			default:
+				return 0, io.EOF
+			}
+		}
+		c.queued.Add(-int64(len(c.cur)))
+	}
+	n := copy(p, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+// inspectedExchanges returns the recorded exchanges of the service (or all
+// services if blank), newest first.
+func inspectedExchanges(name string) []HTTPExchange {
+	var exs []HTTPExchange
+	for svcName, svc := range allServices() {
+		if name == "" || svcName == name {
+			exs = append(exs, svc.exchanges.list()...)
+		}
+	}
+	// The IDs increase with time
+	sort.Slice(exs, func(i, j int) bool { return exs[i].ID > exs[j].ID })
+	return exs
+}
+
+// findExchange returns the recorded exchange with the ID and its service.
+func findExchange(id uint64) (HTTPExchange, *service, bool) {
+	for _, svc := range allServices() {
+		if ex, ok := svc.exchanges.get(id); ok {
+			return ex, svc, true
+		}
+	}
+	return HTTPExchange{}, nil, false
+}
+
+// replayExchange sends the exchange's request through a tunnel of the service
+// (as a client of it would), returning the response, which is recorded as a
+// new exchange.
+func (svc *service) replayExchange(ex HTTPExchange) (*RecordedResponse, error) {
+	if ex.Request.Truncated {
+		return nil, errors.New("request body was too large to be recorded whole")
+	}
+	uri := ex.Request.URI
+	if uri == "" || uri == "*" && ex.Request.Method != http.MethodOptions {
+		uri = "/"
+	}
+	var raw bytes.Buffer
+	raw.WriteString(ex.Request.Method + " " + uri + " HTTP/1.1\r\n")
+	header := ex.Request.Header.Clone()
+	// Each replay gets its own conn
+	header.Set("Connection", "close")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(ex.Request.Body)))
+	if header.Get("Host") == "" {
+		header.Set("Host", ex.Request.Host)
+	}
+	header.Write(&raw)
+	raw.WriteString("\r\n")
+	raw.Write(ex.Request.Body)
+
+	host := ex.Request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	head := httpHead{
+		host: strings.ToLower(strings.Trim(host, "[]")), http1: true,
+		replay: ex.ID,
+	}
+	filter := tunnelFilter{host: head.host}
+	if !svc.idle.knowsTunnels(filter) {
+		return nil, fmt.Errorf("no tunnel serves host %s", head.host)
+	}
+	clientConn, proxySide := net.Pipe()
+	defer clientConn.Close()
+	go handleClientConn(proxySide, svc, filter, nil, "", nil, head)
+	clientConn.SetDeadline(time.Now().Add(idleTimeout))
+	go func() {
+		// Written concurrently so large requests don't deadlock with early
+		// responses
+		clientConn.Write(raw.Bytes())
+	}()
+	resp, err := http.ReadResponse(
+		bufio.NewReader(clientConn), &http.Request{Method: ex.Request.Method},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return &RecordedResponse{
+		Status: resp.StatusCode, Proto: resp.Proto, Header: resp.Header,
+		RecordedBody: readRecordedBody(resp.Body),
+	}, nil
+}
+
+// inspectRing returns the ring the client's exchanges are recorded in (nil if
+// they aren't inspected).
+func inspectRing(svc *service, sc *ServiceConfig, head httpHead) *exchangeRing {
+	if sc.Inspect == 0 || !head.http1 {
+		return nil
+	}
+	return &svc.exchanges
+}
+
+// handleRequests handles listing (GET) the recorded exchanges, newest first,
+// optionally only those of the service query parameter's service.
+func handleRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	exs := inspectedExchanges(r.URL.Query().Get("service"))
+	if exs == nil {
+		exs = []HTTPExchange{}
+	}
+	writeJSON(w, http.StatusOK, exs)
+}
+
+// handleRequest handles getting (GET) a recorded exchange at /requests/{id},
+// or replaying (POST) its request at /requests/{id}/replay, responding with
+// the replay's response.
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/requests/")
+	replay := strings.HasSuffix(path, "/replay")
+	id, err := strconv.ParseUint(strings.TrimSuffix(path, "/replay"), 10, 64)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	ex, svc, ok := findExchange(id)
+	if !ok {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return
+	}
+	if !replay {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, ex)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ex.Request.Truncated {
+		http.Error(
+			w, "Request body was too large to be recorded whole",
+			http.StatusConflict,
+		)
+		return
+	}
+	log.Printf("Replaying request %d to %s", id, svc.displayName())
+	resp, err := svc.replayExchange(ex)
+	if err != nil {
+		http.Error(w, "Error replaying request: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectorUI serves the inspector's page, which lists the recorded
+// exchanges (through the admin API, with the token entered in the page) and
+// replays them. It's served without authentication since it holds no data.
+func handleInspectorUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	io.WriteString(w, inspectorPage)
+}
+
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tunnelit inspector</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border-bottom: 1px solid #ddd; padding: 4px; text-align: left; vertical-align: top; }
+pre { white-space: pre-wrap; word-break: break-all; max-height: 20em; overflow: auto; background: #f6f6f6; margin: 0; }
+</style>
+</head>
+<body>
+<h1>HTTP inspector</h1>
+<p>
+<label>Admin token <input id="token" type="password"></label>
+<label>Service <input id="service"></label>
+<button id="refresh">Refresh</button>
+<span id="status"></span>
+</p>
+<table>
+<thead><tr><th>ID</th><th>Time</th><th>Service</th><th>Client</th><th>Request</th><th>Response</th><th></th></tr></thead>
+<tbody id="exchanges"></tbody>
+</table>
+<script>
+const $ = (id) => document.getElementById(id);
+$("token").value = sessionStorage.getItem("token") || "";
+
+async function api(method, path) {
+  const token = $("token").value;
+  sessionStorage.setItem("token", token);
+  const headers = token ? {Authorization: "Bearer " + token} : {};
+  const resp = await fetch(path, {method, headers});
+  if (!resp.ok) throw new Error(resp.status + ": " + (await resp.text()).trim());
+  return resp.json();
+}
+
+function message(m) {
+  const text = m.proto + " " + Object.entries(m.header || {})
+    .map(([k, vs]) => vs.map((v) => k + ": " + v).join("\n")).join("\n");
+  const body = m.body ? atob(m.body) : "";
+  const pre = document.createElement("pre");
+  pre.textContent = text + "\n\n" + body + (m.truncated ? "\n[truncated]" : "");
+  return pre;
+}
+
+function cell(row, content) {
+  const td = row.insertCell();
+  if (typeof content === "string") td.textContent = content;
+  else if (content) td.append(content);
+  return td;
+}
+
+async function refresh() {
+  const svc = $("service").value;
+  try {
+    const exs = await api("GET", "requests" + (svc ? "?service=" + encodeURIComponent(svc) : ""));
+    const tbody = $("exchanges");
+    tbody.replaceChildren();
+    for (const ex of exs) {
+      const row = tbody.insertRow();
+      cell(row, ex.id + (ex.replay ? " (replay of " + ex.replay + ")" : ""));
+      cell(row, new Date(ex.time).toLocaleString());
+      cell(row, ex.service + (ex.tunnel ? " via " + ex.tunnel : ""));
+      cell(row, ex.client_addr);
+      const req = cell(row, ex.request.method + " " + ex.request.host + ex.request.uri);
+      req.append(message(ex.request));
+      const resp = ex.response;
+      const respCell = cell(row, resp ? resp.status + " (" + ex.duration_ms + " ms)" : "pending");
+      if (resp) respCell.append(message(resp));
+      const button = document.createElement("button");
+      button.textContent = "Replay";
+      button.disabled = ex.request.truncated;
+      button.onclick = async () => {
+        try {
+          const r = await api("POST", "requests/" + ex.id + "/replay");
+          $("status").textContent = "Replayed " + ex.id + ": " + r.status;
+          refresh();
+        } catch (e) {
+          $("status").textContent = "Error replaying " + ex.id + ": " + e.message;
+        }
+      };
+      cell(row, button);
+    }
+    $("status").textContent = exs.length + " requests";
+  } catch (e) {
+    $("status").textContent = "Error: " + e.message;
+  }
+}
+
+$("refresh").onclick = refresh;
+refresh();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+func TestExchangeRing(t *testing.T) {
+	var r exchangeRing
+	for i := uint64(1); i <= 5; i++ {
+		r.add(&HTTPExchange{ID: i}, 3)
+	}
+	exs := r.list()
+	if len(exs) != 3 || exs[0].ID != 5 || exs[2].ID != 3 {
+		t.Fatalf("expected exchanges 5 to 3, got %+v", exs)
+	}
+	if _, ok := r.get(2); ok {
+		t.Fatal("expected dropped exchange to be gone")
+	} else if ex, ok := r.get(4); !ok || ex.ID != 4 {
+		t.Fatalf("expected exchange 4, got %+v (found: %v)", ex, ok)
+	}
+}
+
+// waitExchanges waits for the ring to hold n exchanges with responses,
+// returning them newest first.
+func waitExchanges(t *testing.T, r *exchangeRing, n int) []HTTPExchange {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		exs := r.list()
+		done := len(exs) == n
+		for _, ex := range exs {
+			done = done && ex.Response != nil
+		}
+		if done {
+			return exs
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expected %d answered exchanges, got %+v", n, exs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPipeInspector(t *testing.T) {
+	bigBody := strings.Repeat("a", inspectBodyLimit+10)
+	tests := []struct {
+		name     string
+		up, down []string
+		// want are the expected requests and their statuses, oldest first.
+		want []string
+		// truncated is whether the first request's body is truncated.
+		truncated bool
+	}{
+		{
+			name: "keep-alive requests",
+			up: []string{
+				"GET /a HTTP/1.1\r\nHost: web\r\n\r\n",
+				"POST /b HTTP/1.1\r\nHost: web\r\nContent-Length: 5\r\n\r\nhel", "lo",
+			},
+			down: []string{
+				"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+				"HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n",
+			},
+			want: []string{"GET /a 200", "POST /b 201"},
+		},
+		{
+			name: "informational response",
+			up: []string{
+				"PUT /c HTTP/1.1\r\nHost: web\r\nExpect: 100-continue\r\nContent-Length: 1\r\n\r\nx",
+			},
+			down: []string{
+				"HTTP/1.1 100 Continue\r\n\r\n",
+				"HTTP/1.1 204 No Content\r\n\r\n",
+			},
+			want: []string{"PUT /c 204"},
+		},
+		{
+			name: "HEAD response has no body",
+			up: []string{
+				"HEAD /d HTTP/1.1\r\nHost: web\r\n\r\n",
+				"GET /e HTTP/1.1\r\nHost: web\r\n\r\n",
+			},
+			down: []string{
+				"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n",
+				"HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+			},
+			want: []string{"HEAD /d 200", "GET /e 404"},
+		},
+		{
+			name: "upgrade stops parsing",
+			up: []string{
+				"GET /ws HTTP/1.1\r\nHost: web\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+				"\x81\x05hello",
+			},
+			down: []string{
+				"HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+				"\x81\x05world",
+			},
+			want: []string{"GET /ws 101"},
+		},
+		{
+			name: "large body",
+			up: []string{
+				"POST /f HTTP/1.1\r\nHost: web\r\nContent-Length: " +
+					strconv.Itoa(len(bigBody)) + "\r\n\r\n" + bigBody,
+			},
+			down:      []string{"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+			want:      []string{"POST /f 200"},
+			truncated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r exchangeRing
+			pi := inspectPipe(&r, 10, HTTPExchange{Service: "web", Tunnel: "t"})
+			for _, p := range tt.up {
+				pi.feed(true, []byte(p))
+			}
+			for _, p := range tt.down {
+				pi.feed(false, []byte(p))
+			}
+			exs := waitExchanges(t, &r, len(tt.want))
+			pi.close()
+			for i, want := range tt.want {
+				ex := exs[len(exs)-1-i]
+				got := ex.Request.Method + " " + ex.Request.URI + " " +
+					strconv.Itoa(ex.Response.Status)
+				if got != want {
+					t.Errorf("exchange %d: expected %q, got %q", i, want, got)
+				}
+				if ex.Service != "web" || ex.Tunnel != "t" || ex.Request.Host != "web" {
+					t.Errorf("exchange %d: template not applied: %+v", i, ex)
+				}
+			}
+			first := exs[len(exs)-1]
+			if first.Request.Truncated != tt.truncated {
+				t.Errorf("expected truncated %v, got %v", tt.truncated, first.Request.Truncated)
+			} else if tt.truncated && (len(first.Request.Body) != inspectBodyLimit ||
+				first.Request.BodySize != int64(len(bigBody))) {
+				t.Errorf(
+					"expected %d of %d bytes kept, got %d of %d", inspectBodyLimit,
+					len(bigBody), len(first.Request.Body), first.Request.BodySize,
+				)
+			}
+		})
+	}
+}
+
+func TestChunkReaderOverflowCloses(t *testing.T) {
+	c := newChunkReader()
+	c.feed([]byte("head"))
+	c.feed(make([]byte, inspectQueueLimit))
+	c.feed([]byte("ignored"))
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "head" {
+		t.Fatalf("expected only the queued bytes, got %q (err: %v)", b, err)
+	}
+}
+
+// serveTunnelConn acts as a tunnel's conn: it answers the ready exchange,
+// then responds to each request with its method and path.
+func serveTunnelConn(conn net.Conn) {
+	defer conn.Close()
+	b := []byte{0}
+	if _, err := io.ReadFull(conn, b); err != nil || b[0] != connReady {
+		return
+	} else if _, err := conn.Write(b); err != nil {
+		return
+	}
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		text := req.Method + " " + req.URL.Path + " " + string(body)
+		resp := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(text)) +
+			"\r\n\r\n" + text
+		if _, err := io.WriteString(conn, resp); err != nil || req.Close {
+			return
+		}
+	}
+}
+
+func TestReplayExchange(t *testing.T) {
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	svc := newService("web", &ServiceConfig{Mode: modeHTTP, Inspect: 10})
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	for i := 0; i < 2; i++ {
+		tunnelSide, proxySide := net.Pipe()
+		go serveTunnelConn(tunnelSide)
+		svc.idle.Put(proxySide, "t", tunnelInfo{hosts: []string{"web.example.com"}})
+	}
+
+	// A client's request through the service
+	clientConn, proxySide := net.Pipe()
+	defer clientConn.Close()
+	head := httpHead{host: "web.example.com", http1: true}
+	go handleClientConn(
+		proxySide, svc, tunnelFilter{host: head.host}, nil, "", nil, head,
+	)
+	go io.WriteString(
+		clientConn,
+		"POST /hook HTTP/1.1\r\nHost: web.example.com\r\nContent-Length: 4\r\n\r\nping",
+	)
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+	if err != nil {
+		t.Fatal("error reading response: ", err)
+	}
+	resp.Body.Close()
+	orig := waitExchanges(t, &svc.exchanges, 1)[0]
+
+	// Replaying it through the admin API
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(
+		http.MethodPost, "/requests/"+strconv.FormatUint(orig.ID, 10)+"/replay", nil,
+	))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 replaying, got %d: %s", rec.Code, rec.Body)
+	} else if !strings.Contains(rec.Body.String(), `"status":200`) {
+		t.Fatalf("expected replay's response, got %s", rec.Body)
+	}
+	exs := waitExchanges(t, &svc.exchanges, 2)
+	replayed := exs[0]
+	if replayed.Replay != orig.ID {
+		t.Fatalf("expected replay of %d, got %+v", orig.ID, replayed)
+	} else if got := string(replayed.Response.Body); got != "POST /hook ping" {
+		t.Fatalf("expected replayed request to reach the tunnel, got %q", got)
+	}
+
+	// Truncated requests can't be replayed
+	svc.exchanges.add(&HTTPExchange{
+		ID: lastExchangeID.Add(1), Service: "web",
+		Request: RecordedRequest{RecordedBody: RecordedBody{Truncated: true}},
+	}, 10)
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(
+		http.MethodPost,
+		"/requests/"+strconv.FormatUint(lastExchangeID.Load(), 10)+"/replay", nil,
+	))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 replaying truncated request, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest(http.MethodGet, "/requests/0", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown request, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Services in http mode (see ServiceConfig.Mode) route each client by the
+// Host of its first HTTP request to a tunnel serving that host (see the
+// tunnel's http-host), so tunnels for different sites can share a listener.
+// The conn is piped as is once routed, so its later requests go to the same
+// tunnel (browsers only reuse conns for the same host anyway), which also
+// lets HTTP/2 (and its trailers, e.g., gRPC's statuses) through end to end:
+// h2c upgrades happen on the routed conn,
+// HTTP/2 with prior knowledge is routed by the :authority of its first
+// request (see h2.go), and TLS the proxy doesn't terminate is routed by its SNI
+// (with ALPN left to the servers). With an HTTP
+// domain, named tunnels without hosts are assigned the subdomain of their name,
+// whose URL is reported to them along with the service's endpoints.
+
+// modeHTTP is the mode of services routing clients by HTTP host.
+const modeHTTP = "http"
+
+var (
+	// flagHTTPMode is whether the default service is in http mode (overriding
+	// the config).
+	flagHTTPMode bool
+	// flagHTTPDomain is the domain whose subdomains are assigned to the
+	// default service's named tunnels (overriding the config).
+	flagHTTPDomain string
+	// tunnelHTTPHosts are the HTTP hosts the default service's tunnel serves.
+	tunnelHTTPHosts []string
+)
+
+// assignedHost returns the subdomain of the service's HTTP domain assigned to
+// the tunnel with the name (blank if there's no domain or the name isn't a
+// valid DNS label).
+func (sc *ServiceConfig) assignedHost(name string) string {
+	if sc.HTTPDomain == "" || !isDNSLabel(name) {
+		return ""
+	}
+	return strings.ToLower(name + "." + strings.TrimSuffix(sc.HTTPDomain, "."))
+}
+
+// isDNSLabel returns whether s is a valid DNS label (letters, digits, and
+// inner hyphens).
+func isDNSLabel(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// hostURL returns the URL of the host on the service's listener (at addr),
+// including the port unless it's the scheme's default.
+func (sc *ServiceConfig) hostURL(host, addr string) string {
+	scheme, defPort := "http", "80"
+	if sc.terminatesTLS() {
+		scheme, defPort = "https", "443"
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil && port != defPort {
+		host = net.JoinHostPort(host, port)
+	}
+	return scheme + "://" + host
+}
+
+// httpHead is what's known of a client's first request.
+type httpHead struct {
+	// host is the request's host, lowercased and without the port.
+	host string
+	// grpc is whether the request is gRPC (including gRPC-Web), whose
+	// streams may be idle for long stretches.
+	grpc bool
+	// http1 is whether the request is HTTP/1.x (which the inspector can
+	// parse).
+	http1 bool
+	// replay is the ID of the recorded exchange whose request is being
+	// replayed (0 if it isn't a replay).
+	replay uint64
+}
+
+// isGRPC returns whether the content type is gRPC's (or gRPC-Web's).
+func isGRPC(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(contentType), "application/grpc")
+}
+
+// readHTTPHead reads the head of the client's first request (or its TLS
+// client hello, if the proxy doesn't terminate its TLS), returning what's
+// known of it and the conn to pipe, which replays what was read.
+func readHTTPHead(conn net.Conn) (httpHead, net.Conn, error) {
+	if _, ok := conn.(*terminatedConn); !ok {
+		hello, c, err := peekClientHello(conn)
+		if err != nil {
+			return httpHead{}, c, err
+		} else if hello.sni != "" {
+			return httpHead{host: strings.ToLower(hello.sni)}, c, nil
+		}
+		conn = c
+	}
+	var raw bytes.Buffer
+	br := bufio.NewReader(io.TeeReader(conn, &raw))
+	var head httpHead
+	if b, err := br.Peek(4); err != nil {
+		return head, conn, err
+	} else if string(b) == h2Preface[:4] {
+		if head, err = readH2Head(br); err != nil {
+			return head, conn, err
+		}
+	} else {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return head, conn, err
+		}
+		head = httpHead{
+			host: req.Host, grpc: isGRPC(req.Header.Get("Content-Type")),
+			http1: true,
+		}
+	}
+	if h, _, err := net.SplitHostPort(head.host); err == nil {
+		head.host = h
+	}
+	head.host = strings.ToLower(strings.Trim(head.host, "[]"))
+	if head.host == "" {
+		return head, conn, errors.New("request has no host")
+	}
+	return head, &replayConn{Conn: conn, r: io.MultiReader(&raw, conn)}, nil
+}
+
+// rejectHTTPClient responds to the client with the status and closes it.
+func rejectHTTPClient(conn net.Conn, status int) {
+	text := http.StatusText(status)
+	rejectClient(conn, fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n",
+		status, text, len(text)+1, text,
+	))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+	"github.com/johnietre/utils/go"
+)
+
+func TestReadHTTPHead(t *testing.T) {
+	tests := []struct {
+		name, input string
+		// want is the head read (a blank host means an error is expected).
+		want httpHead
+	}{
+		{
+			name:  "host with port",
+			input: "GET / HTTP/1.1\r\nHost: App.Example.com:8080\r\n\r\n",
+			want:  httpHead{host: "app.example.com", http1: true},
+		},
+		{
+			name:  "IPv6 host",
+			input: "GET / HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n",
+			want:  httpHead{host: "::1", http1: true},
+		},
+		{
+			name: "gRPC",
+			input: "POST /svc/Method HTTP/1.1\r\nHost: api.example.com\r\n" +
+				"Content-Type: application/grpc-web+proto\r\n\r\n",
+			want: httpHead{host: "api.example.com", grpc: true, http1: true},
+		},
+		{name: "no host", input: "GET / HTTP/1.0\r\n\r\n"},
+		{name: "not HTTP", input: "hello there\r\n\r\n"},
+		{name: "truncated", input: "GET / HTTP/1.1\r\nHost: app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _ := scriptedConn(t, []byte(tt.input))
+			head, conn, err := readHTTPHead(conn)
+			if tt.want.host == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", head)
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error reading head: ", err)
+			} else if head != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, head)
+			}
+			// The request is replayed to the tunnel
+			if b, err := io.ReadAll(conn); err != nil || string(b) != tt.input {
+				t.Fatalf("expected the request replayed, got %q (err: %v)", b, err)
+			}
+		})
+	}
+
+	// TLS clients are routed by their SNI
+	conn, peer := pipeConn(t)
+	go tls.Client(peer, &tls.Config{
+		ServerName: "App.Example.com", InsecureSkipVerify: true,
+	}).Handshake()
+	head, _, err := readHTTPHead(conn)
+	if err != nil {
+		t.Fatal("error reading head: ", err)
+	} else if head.host != "app.example.com" {
+		t.Fatalf("expected the SNI as the host, got %+v", head)
+	}
+}
+
+func TestPoolFiltersHosts(t *testing.T) {
+	pool := newIdlePool(&tunnelit.RoundRobin{})
+	conn, _ := pipeConn(t)
+	pool.Put(conn, "app", tunnelInfo{
+		weight: 1, hosts: []string{"app.example.com"},
+	})
+	conn, _ = pipeConn(t)
+	pool.Put(conn, "wild", tunnelInfo{
+		weight: 1, hosts: []string{"*.apps.example.com"},
+	})
+	tests := []struct {
+		host, want string
+	}{
+		{host: "app.example.com", want: "app"},
+		{host: "web.apps.example.com", want: "wild"},
+		{host: "db.example.com"},
+	}
+	for _, tt := range tests {
+		filter := tunnelFilter{host: tt.host}
+		if known := pool.knowsTunnels(filter); known != (tt.want != "") {
+			t.Fatalf("%s: expected known to be %v", tt.host, !known)
+		}
+		pc, ok := pool.TryGet(filter)
+		if tt.want == "" {
+			if ok {
+				t.Fatalf("%s: expected no conn, got %s's", tt.host, pc.tunnel.id)
+			}
+		} else if !ok || pc.tunnel.id != tt.want {
+			t.Fatalf("%s: expected %s's conn, got %v", tt.host, tt.want, pc.tunnel)
+		}
+	}
+	// Tunnels whose conns are all in use are still known
+	if !pool.knowsTunnels(tunnelFilter{host: "app.example.com"}) {
+		t.Fatal("expected the busy tunnel to be known")
+	}
+}
+
+func TestAcceptClientHTTP(t *testing.T) {
+	oldReadyCh := readyCh
+	readyCh = make(chan utils.Unit, 10)
+	t.Cleanup(func() { readyCh = oldReadyCh })
+	sc := &ServiceConfig{Mode: modeHTTP}
+	if err := sc.parseSchedule(); err != nil {
+		t.Fatal("error parsing schedule: ", err)
+	}
+	svc := newService("web", sc)
+	tunnelSide, proxySide := net.Pipe()
+	t.Cleanup(func() { tunnelSide.Close() })
+	go func() {
+		b := []byte{0}
+		if _, err := io.ReadFull(tunnelSide, b); err != nil {
+			return
+		}
+		tunnelSide.Write([]byte{connReady})
+		io.Copy(tunnelSide, tunnelSide)
+	}()
+	svc.idle.Put(proxySide, "app", tunnelInfo{
+		weight: 1, hosts: []string{"app.example.com"},
+	})
+
+	tests := []struct {
+		name, req string
+		// status is the status the client is rejected with (0 means it's
+		// piped).
+		status int
+	}{
+		{
+			name:   "unknown host",
+			req:    "GET / HTTP/1.1\r\nHost: db.example.com\r\n\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			name:   "bad request",
+			req:    "GET / HTTP/1.0\r\n\r\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "known host",
+			req:  "GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		clientConn, proxySide := net.Pipe()
+		defer clientConn.Close()
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		go svc.acceptClient(proxySide)
+		go clientConn.Write([]byte(tt.req))
+		if tt.status != 0 {
+			resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+			if err != nil {
+				t.Fatalf("%s: error reading response: %v", tt.name, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("%s: expected %d, got %s", tt.name, tt.status, resp.Status)
+			}
+			continue
+		}
+		// The tunnel echoes the request it's sent
+		b := make([]byte, len(tt.req))
+		if _, err := io.ReadFull(clientConn, b); err != nil || string(b) != tt.req {
+			t.Fatalf(
+				"%s: expected the request piped, got %q (err: %v)", tt.name, b, err,
+			)
+		}
+	}
+}
+
+func TestHostsRequired(t *testing.T) {
+	setTestPassword(t)
+	setState(t, newState(""))
+	svc := newService("web", &ServiceConfig{Mode: modeHTTP})
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+
+	pwdHash := sha256.Sum256([]byte(tunnelittest.DefaultPassword))
+	tests := []struct {
+		hosts []string
+		want  byte
+	}{
+		{want: hostsRequired},
+		{hosts: []string{"app.example.com"}, want: passwordOk},
+	}
+	for _, tt := range tests {
+		reg := Registration{Service: "web", Hosts: tt.hosts}
+		if status, _ := registerTunnel(t, pwdHash, reg); status != tt.want {
+			t.Fatalf(
+				"%v: expected %s, got %s", tt.hosts,
+				tunnelit.StatusText(tt.want), tunnelit.StatusText(status),
+			)
+		}
+	}
+}
+
+func TestAssignedHost(t *testing.T) {
+	sc := &ServiceConfig{Mode: modeHTTP, HTTPDomain: "Tunnel.Example.com."}
+	tests := []struct {
+		name, want string
+	}{
+		{name: "web", want: "web.tunnel.example.com"},
+		{name: "My-App2", want: "my-app2.tunnel.example.com"},
+		{name: ""},
+		{name: "-web"},
+		{name: "web-"},
+		{name: "web.app"},
+		{name: "web_app"},
+		{name: strings.Repeat("a", 64)},
+	}
+	for _, tt := range tests {
+		if got := sc.assignedHost(tt.name); got != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+	if got := (&ServiceConfig{Mode: modeHTTP}).assignedHost("web"); got != "" {
+		t.Fatalf("expected no host without a domain, got %q", got)
+	}
+}
+
+func TestHostURL(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{addr: "192.0.2.1:80", want: "http://web.example.com"},
+		{addr: "192.0.2.1:8080", want: "http://web.example.com:8080"},
+		{addr: "", want: "http://web.example.com"},
+	}
+	sc := &ServiceConfig{}
+	for _, tt := range tests {
+		if got := sc.hostURL("web.example.com", tt.addr); got != tt.want {
+			t.Fatalf("%q: expected %s, got %s", tt.addr, tt.want, got)
+		}
+	}
+	sc.TLSCert = "cert.pem"
+	if got := sc.hostURL("web.example.com", "192.0.2.1:443"); got !=
+		"https://web.example.com" {
+		t.Fatalf("expected an https URL without the port, got %s", got)
+	}
+}
+
+func TestHTTPDomainRequiresHTTPMode(t *testing.T) {
+	for mode, ok := range map[string]bool{modeHTTP: true, "": false} {
+		cfg := &Config{Services: map[string]*ServiceConfig{
+			"web": {
+				Addr: "127.0.0.1:0", Mode: mode, HTTPDomain: "tunnel.example.com",
+			},
+		}}
+		if err := cfg.validate(); (err == nil) != ok {
+			t.Fatalf("%q: expected valid to be %v, got %v", mode, ok, err)
+		}
+	}
+}
+
+func TestAssignedHostRegistration(t *testing.T) {
+	setTestPassword(t)
+	setState(t, newState(""))
+	svc := newService("web", &ServiceConfig{
+		Mode: modeHTTP, HTTPDomain: "tunnel.example.com",
+	})
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+	pwdHash := sha256.Sum256([]byte(tunnelittest.DefaultPassword))
+
+	// Tunnels whose names aren't DNS labels still need hosts
+	reg := Registration{Service: "web", Name: "my app"}
+	if status, _ := registerTunnel(t, pwdHash, reg); status != hostsRequired {
+		t.Fatalf("expected hosts required, got %s", tunnelit.StatusText(status))
+	}
+
+	reg = Registration{Service: "web", Name: "blog", Endpoints: true}
+	status, conn := registerTunnel(t, pwdHash, reg)
+	if status != passwordOk {
+		t.Fatalf(
+			"expected the tunnel accepted, got %s", tunnelit.StatusText(status),
+		)
+	}
+	var eps ServiceEndpoints
+	if err := readMsg(conn, &eps); err != nil {
+		t.Fatal("error reading endpoints: ", err)
+	} else if eps.URL != "http://blog.tunnel.example.com" {
+		t.Fatalf("expected the assigned subdomain's URL, got %q", eps.URL)
+	}
+	waitFor(t, "the tunnel to serve its subdomain", func() bool {
+		return svc.idle.knowsTunnels(
+			tunnelFilter{host: "blog.tunnel.example.com"},
+		)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+)
+
+var (
+	// identityKeyFile is the proxy's identity key file (blank means the proxy
+	// has no identity).
+	identityKeyFile string
+	identityKey     ed25519.PrivateKey
+	// proxyPubKey is the pinned public key (base64) the tunnel verifies the
+	// proxy's identity against (blank means unverified).
+	proxyPubKey string
+	pinnedKey   ed25519.PublicKey
+)
+
+// loadIdentityKey loads the proxy's identity key, generating and saving one if
+// the file doesn't exist.
+func loadIdentityKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			return nil, err
+		}
+		log.Print("Generated identity key at ", path)
+		return priv, nil
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity key must be an Ed25519 key")
+	}
+	return priv, nil
+}
+
+// parsePubKey parses a base64-encoded Ed25519 public key.
+func parsePubKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	} else if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: wrong length")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// proveIdentity signs the tunnel's nonce, the proxy's challenge, and the
+// encoded registration with the identity key (if any) (see
+// tunnelit.IdentityRequest).
+func proveIdentity(nonce, challenge, regMsg []byte) IdentityProof {
+	if identityKey == nil {
+		return IdentityProof{}
+	}
+	signed := tunnelit.IdentitySigned(nonce, challenge, regMsg)
+	return IdentityProof{Signature: ed25519.Sign(identityKey, signed)}
+}
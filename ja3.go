@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// maxJA3Fingerprints caps the number of distinct fingerprints counted for the
+// metrics. Clients with others are counted as "other".
+const maxJA3Fingerprints = 1000
+
+// TLS extensions whose contents are part of JA3 fingerprints.
+const (
+	extSupportedGroups = 10
+	extPointFormats    = 11
+)
+
+// ja3Counts counts the clients with each JA3 fingerprint.
+var ja3Counts = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+// clientHello is what's known of a client's TLS client hello.
+type clientHello struct {
+	sni string
+	// ja3 is the JA3 fingerprint of the client hello (blank if unknown).
+	ja3 string
+}
+
+// helloJA3 returns the JA3 fingerprint of the client hello in the TLS records,
+// logging if it can't be computed (e.g., if the records were cut short).
+func helloJA3(records []byte) string {
+	ja3, err := ja3Fingerprint(records)
+	if err != nil {
+		log.Print("Error computing JA3 fingerprint: ", err)
+		return ""
+	}
+	return ja3
+}
+
+// ja3Fingerprint returns the JA3 fingerprint (the MD5 hex of ja3String) of the
+// client hello in the TLS records.
+func ja3Fingerprint(records []byte) (string, error) {
+	s, err := ja3String(records)
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ja3String returns the JA3 string of the client hello in the TLS records:
+// its version, cipher suites, extensions, supported groups, and point formats
+// (leaving out GREASE values).
+func ja3String(records []byte) (string, error) {
+	msg, err := handshakeMessage(records)
+	if err != nil {
+		return "", err
+	}
+	var (
+		hello                  = cryptobyte.String(msg)
+		msgType                uint8
+		body, sessionID, comps cryptobyte.String
+		suites, exts           cryptobyte.String
+		version                uint16
+	)
+	if !hello.ReadUint8(&msgType) || msgType != 1 {
+		return "", errors.New("not a client hello")
+	} else if !hello.ReadUint24LengthPrefixed(&body) ||
+		!body.ReadUint16(&version) || !body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&suites) ||
+		!body.ReadUint8LengthPrefixed(&comps) {
+		return "", errors.New("malformed client hello")
+	}
+	var cipherIDs, extIDs, groups, formats []string
+	for !suites.Empty() {
+		var id uint16
+		if !suites.ReadUint16(&id) {
+			return "", errors.New("malformed cipher suites")
+		} else if !isGREASE(id) {
+			cipherIDs = append(cipherIDs, strconv.Itoa(int(id)))
+		}
+	}
+	if !body.Empty() && !body.ReadUint16LengthPrefixed(&exts) {
+		return "", errors.New("malformed extensions")
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return "", errors.New("malformed extensions")
+		} else if isGREASE(typ) {
+			continue
+		}
+		extIDs = append(extIDs, strconv.Itoa(int(typ)))
+		switch typ {
+		case extSupportedGroups:
+			var list cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return "", errors.New("malformed supported groups")
+			}
+			for !list.Empty() {
+				var g uint16
+				if !list.ReadUint16(&g) {
+					return "", errors.New("malformed supported groups")
+				} else if !isGREASE(g) {
+					groups = append(groups, strconv.Itoa(int(g)))
+				}
+			}
+		case extPointFormats:
+			var list cryptobyte.String
+			if !data.ReadUint8LengthPrefixed(&list) {
+				return "", errors.New("malformed point formats")
+			}
+			for _, f := range list {
+				formats = append(formats, strconv.Itoa(int(f)))
+			}
+		}
+	}
+	return fmt.Sprintf(
+		"%d,%s,%s,%s,%s", version, strings.Join(cipherIDs, "-"),
+		strings.Join(extIDs, "-"), strings.Join(groups, "-"),
+		strings.Join(formats, "-"),
+	), nil
+}
+
+// handshakeMessage returns the first handshake message in the TLS records,
+// which may span several records.
+func handshakeMessage(records []byte) ([]byte, error) {
+	var msg []byte
+	s := cryptobyte.String(records)
+	for {
+		if len(msg) >= 4 {
+			n := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if len(msg) >= n {
+				return msg[:n], nil
+			}
+		}
+		var typ uint8
+		var payload cryptobyte.String
+		if !s.ReadUint8(&typ) || !s.Skip(2) || !s.ReadUint16LengthPrefixed(&payload) {
+			return nil, io.ErrUnexpectedEOF
+		} else if typ != tlsRecordHandshake {
+			return nil, fmt.Errorf("unexpected TLS record type %d", typ)
+		}
+		msg = append(msg, payload...)
+	}
+}
+
+// isGREASE returns whether the value is a GREASE value (RFC 8701), which
+// clients add at random and so are left out of fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// countJA3 counts a client with the fingerprint for the metrics.
+func countJA3(ja3 string) {
+	ja3Counts.Lock()
+	defer ja3Counts.Unlock()
+	if _, ok := ja3Counts.counts[ja3]; !ok && len(ja3Counts.counts) >= maxJA3Fingerprints {
+		ja3 = "other"
+	}
+	ja3Counts.counts[ja3]++
+}
+
+// writeJA3Prometheus writes the client counts of each fingerprint in the
+// Prometheus text exposition format.
+func writeJA3Prometheus(w io.Writer) {
+	ja3Counts.Lock()
+	defer ja3Counts.Unlock()
+	fps := make([]string, 0, len(ja3Counts.counts))
+	for ja3 := range ja3Counts.counts {
+		fps = append(fps, ja3)
+	}
+	sort.Strings(fps)
+	fmt.Fprint(w, "# HELP tunnelit_ja3_clients_total Clients with each TLS fingerprint (JA3).\n")
+	fmt.Fprint(w, "# TYPE tunnelit_ja3_clients_total counter\n")
+	for _, ja3 := range fps {
+		fmt.Fprintf(
+			w, "tunnelit_ja3_clients_total{ja3=%q} %d\n", ja3, ja3Counts.counts[ja3],
+		)
+	}
+}
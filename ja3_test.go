@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// captureClientHello returns the TLS records of a client hello made with the
+// config and what the TLS server parsed of it.
+func captureClientHello(t *testing.T, cfg *tls.Config) ([]byte, *tls.ClientHelloInfo) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Client(c1, cfg).Handshake()
+	hc := &helloConn{Conn: c2}
+	hc.r = io.TeeReader(c2, &hc.buf)
+	var info *tls.ClientHelloInfo
+	err := tls.Server(hc, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			info = hello
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		t.Fatal("error reading client hello: ", err)
+	}
+	return hc.buf.Bytes(), info
+}
+
+// joinIDs joins the non-GREASE IDs with dashes.
+func joinIDs[T ~uint8 | ~uint16](ids []T) string {
+	var strs []string
+	for _, id := range ids {
+		if !isGREASE(uint16(id)) {
+			strs = append(strs, strconv.Itoa(int(id)))
+		}
+	}
+	return strings.Join(strs, "-")
+}
+
+func TestJA3String(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *tls.Config
+	}{
+		{name: "default", cfg: &tls.Config{ServerName: "example.com"}},
+		{
+			name: "TLS 1.2 only",
+			cfg: &tls.Config{
+				ServerName: "example.com",
+				MaxVersion: tls.VersionTLS12,
+				CipherSuites: []uint16{
+					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+				},
+				CurvePreferences: []tls.CurveID{tls.CurveP256},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, info := captureClientHello(t, tt.cfg)
+			got, err := ja3String(records)
+			if err != nil {
+				t.Fatal("error computing JA3 string: ", err)
+			}
+			// The legacy version is always TLS 1.2's for these clients
+			want := fmt.Sprintf(
+				"%d,%s,%s,%s,%s", tls.VersionTLS12, joinIDs(info.CipherSuites),
+				joinIDs(info.Extensions), joinIDs(info.SupportedCurves),
+				joinIDs(info.SupportedPoints),
+			)
+			if got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestJA3FingerprintSplitRecords(t *testing.T) {
+	records, _ := captureClientHello(t, &tls.Config{ServerName: "example.com"})
+	want, err := ja3Fingerprint(records)
+	if err != nil {
+		t.Fatal("error computing fingerprint: ", err)
+	}
+	// Split the handshake message across two records
+	payload := records[5:]
+	half := len(payload) / 2
+	var split bytes.Buffer
+	for _, part := range [][]byte{payload[:half], payload[half:]} {
+		split.Write([]byte{tlsRecordHandshake, 3, 1, byte(len(part) >> 8), byte(len(part))})
+		split.Write(part)
+	}
+	if got, err := ja3Fingerprint(split.Bytes()); err != nil {
+		t.Fatal("error computing fingerprint of split records: ", err)
+	} else if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if _, err := ja3Fingerprint(records[:len(records)-1]); err == nil {
+		t.Fatal("expected error computing fingerprint of truncated records")
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	tests := []struct {
+		v    uint16
+		want bool
+	}{
+		{0x0a0a, true},
+		{0x1a1a, true},
+		{0xfafa, true},
+		{0x0a1a, false},
+		{0x1301, false},
+		{0x000a, false},
+	}
+	for _, tt := range tests {
+		if got := isGREASE(tt.v); got != tt.want {
+			t.Errorf("isGREASE(%#04x): expected %v, got %v", tt.v, tt.want, got)
+		}
+	}
+}
+
+func TestTerminatedAndPeekedJA3Match(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "example.com")
+	clientCfg := &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}
+	records, _ := captureClientHello(t, clientCfg)
+	want, err := ja3Fingerprint(records)
+	if err != nil {
+		t.Fatal("error computing fingerprint: ", err)
+	}
+
+	svc := &service{name: "test"}
+	svc.cfg.Store(&ServiceConfig{TLSCert: certFile, TLSKey: keyFile})
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Client(c1, clientCfg).Handshake()
+	conn, err := svc.terminateClientTLS(c2)
+	if err != nil {
+		t.Fatal("error terminating TLS: ", err)
+	}
+	hello, _, err := peekClientHello(conn)
+	if err != nil {
+		t.Fatal("error peeking client hello: ", err)
+	} else if hello.ja3 != want || hello.sni != "example.com" {
+		t.Fatalf("expected JA3 %s and SNI example.com, got %+v", want, hello)
+	}
+}
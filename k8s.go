@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnietre/utils/go"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Servers of the form k8s://namespace/service:port are the ready endpoints of
+// the Kubernetes service, found from its EndpointSlices (discovery.k8s.io/v1)
+// with an informer, which relists them if the watch fails and resyncs them
+// periodically.
+
+const (
+	// k8sScheme prefixes server addresses discovered from a Kubernetes
+	// service's endpoints (k8s://namespace/service:port).
+	k8sScheme = "k8s://"
+	// k8sRetryDelay is how long to wait before retrying to load the config
+	// after an error.
+	k8sRetryDelay = 5 * time.Second
+)
+
+var (
+	// kubeconfigPath is the kubeconfig used to reach the Kubernetes API
+	// (blank means $KUBECONFIG, the in-cluster config, or ~/.kube/config, in
+	// that order).
+	kubeconfigPath string
+	// k8sResyncPeriod is how often the watched EndpointSlices are resynced.
+	k8sResyncPeriod = 5 * time.Minute
+)
+
+// k8sBackend is a Kubernetes service whose ready endpoints are piped to.
+type k8sBackend struct {
+	namespace, service string
+	// port is the name or number of the endpoints' port.
+	port string
+}
+
+// parseK8sBackend parses a k8s://namespace/service:port address.
+func parseK8sBackend(spec string) (*k8sBackend, error) {
+	rest := strings.TrimPrefix(spec, k8sScheme)
+	slash, colon := strings.Index(rest, "/"), strings.LastIndex(rest, ":")
+	if slash <= 0 || colon <= slash+1 || colon == len(rest)-1 {
+		return nil, fmt.Errorf(
+			"invalid server address %q (expected %snamespace/service:port)",
+			spec, k8sScheme,
+		)
+	}
+	return &k8sBackend{
+		namespace: rest[:slash], service: rest[slash+1 : colon],
+		port: rest[colon+1:],
+	}, nil
+}
+
+func (kb *k8sBackend) String() string {
+	return fmt.Sprintf("%s%s/%s:%s", k8sScheme, kb.namespace, kb.service, kb.port)
+}
+
+// parseBackends parses the service's discovered server addresses.
+func (sc *TunnelServiceConfig) parseBackends() error {
+	sc.k8s = nil
+	for _, spec := range sc.Saddrs {
+		if !strings.HasPrefix(spec, k8sScheme) {
+			continue
+		}
+		kb, err := parseK8sBackend(spec)
+		if err != nil {
+			return err
+		}
+		sc.k8s = append(sc.k8s, kb)
+	}
+	return nil
+}
+
+// watch calls update with the service's ready endpoints each time they change
+// until the stop chan is closed.
+func (kb *k8sBackend) watch(stop <-chan utils.Unit, update func([]string)) {
+	for {
+		client, err := getK8sClient()
+		if err == nil {
+			kb.watchWith(client, stop, update)
+			return
+		}
+		log.Printf("Error watching endpoints of %s: %v", kb, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(k8sRetryDelay):
+		}
+	}
+}
+
+// watchWith watches the service's EndpointSlices with the client, calling
+// update with the ready endpoints each time they change until the stop chan
+// is closed.
+func (kb *k8sBackend) watchWith(
+	client kubernetes.Interface, stop <-chan utils.Unit, update func([]string),
+) {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		client, k8sResyncPeriod,
+		informers.WithNamespace(kb.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = discoveryv1.LabelServiceName + "=" + kb.service
+		}),
+	)
+	informer := factory.Discovery().V1().EndpointSlices().Informer()
+
+	// Each change (and resync) reports the addresses of all the service's
+	// slices, those unchanged since the last report being skipped
+	var mtx sync.Mutex
+	var last []string
+	first := true
+	report := func() {
+		var slices []*discoveryv1.EndpointSlice
+		for _, obj := range informer.GetStore().List() {
+			if slice, ok := obj.(*discoveryv1.EndpointSlice); ok {
+				slices = append(slices, slice)
+			}
+		}
+		addrs := kb.addrs(slices)
+		mtx.Lock()
+		defer mtx.Unlock()
+		if first || strings.Join(addrs, ",") != strings.Join(last, ",") {
+			first, last = false, addrs
+			update(addrs)
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { report() },
+		UpdateFunc: func(any, any) { report() },
+		DeleteFunc: func(any) { report() },
+	})
+	informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		log.Printf("Error watching endpoints of %s: %v", kb, err)
+	})
+
+	stopCh := make(chan struct{})
+	go func() {
+		<-stop
+		close(stopCh)
+	}()
+	factory.Start(stopCh)
+	// Report that there are none if the service has no slices
+	if cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		report()
+	}
+	<-stopCh
+	factory.Shutdown()
+}
+
+// addrs returns the addresses of the slices' ready endpoints on the port.
+func (kb *k8sBackend) addrs(slices []*discoveryv1.EndpointSlice) []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, slice := range slices {
+		port := int32(0)
+		for _, p := range slice.Ports {
+			if p.Port == nil {
+				continue
+			}
+			if (p.Name != nil && *p.Name == kb.port) ||
+				strconv.Itoa(int(*p.Port)) == kb.port {
+				port = *p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			// Unknown readiness is to be taken as ready
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, ip := range ep.Addresses {
+				addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+				if !seen[addr] {
+					seen[addr] = true
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+var (
+	k8sClientMtx sync.Mutex
+	k8sClientVal kubernetes.Interface
+)
+
+// getK8sClient returns the client for the Kubernetes API, loading its config
+// the first time it's used successfully.
+func getK8sClient() (kubernetes.Interface, error) {
+	k8sClientMtx.Lock()
+	defer k8sClientMtx.Unlock()
+	if k8sClientVal != nil {
+		return k8sClientVal, nil
+	}
+	cfg, err := loadK8sConfig(kubeconfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading Kubernetes config: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	k8sClientVal = client
+	return client, nil
+}
+
+// loadK8sConfig loads the config from the kubeconfig's current context (path,
+// or if blank, $KUBECONFIG), the in-cluster config, or ~/.kube/config, in that
+// order. Kubeconfigs skipping TLS verification are refused.
+func loadK8sConfig(path string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if path != "" {
+		rules.ExplicitPath = path
+	} else if os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" &&
+		os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return rest.InClusterConfig()
+	}
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		rules, &clientcmd.ConfigOverrides{},
+	).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Insecure {
+		return nil, errors.New(
+			"insecure-skip-tls-verify isn't supported (set the cluster's certificate-authority instead)",
+		)
+	}
+	return cfg, nil
+}
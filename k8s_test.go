@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestParseK8sBackend(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *k8sBackend
+	}{
+		{"k8s://ns/svc:http", &k8sBackend{namespace: "ns", service: "svc", port: "http"}},
+		{"k8s://ns/svc:8080", &k8sBackend{namespace: "ns", service: "svc", port: "8080"}},
+		{"k8s://ns/svc", nil},
+		{"k8s://svc:80", nil},
+		{"k8s:///svc:80", nil},
+		{"k8s://ns/:80", nil},
+		{"k8s://ns/svc:", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseK8sBackend(tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.spec)
+			}
+		} else if err != nil {
+			t.Errorf("%s: error parsing: %v", tt.spec, err)
+		} else if *got != *tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.spec, tt.want, got)
+		} else if got.String() != tt.spec {
+			t.Errorf("%s: expected String() the same, got %s", tt.spec, got)
+		}
+	}
+}
+
+// endpointSlice returns a slice of the service's endpoints with the port (and
+// its name), each endpoint being ready unless its address ends with "!" (or
+// of unknown readiness if it ends with "?").
+func endpointSlice(name, service, portName string, port int32, addrs ...string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name, Namespace: "ns",
+			Labels: map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+	for _, addr := range addrs {
+		ep := discoveryv1.Endpoint{}
+		if ip, ok := strings.CutSuffix(addr, "!"); ok {
+			ep.Addresses, ep.Conditions.Ready = []string{ip}, new(bool)
+		} else if ip, ok := strings.CutSuffix(addr, "?"); ok {
+			ep.Addresses = []string{ip}
+		} else {
+			ready := true
+			ep.Addresses, ep.Conditions.Ready = []string{addr}, &ready
+		}
+		slice.Endpoints = append(slice.Endpoints, ep)
+	}
+	return slice
+}
+
+func TestK8sAddrs(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   string
+		slices []*discoveryv1.EndpointSlice
+		want   []string
+	}{
+		{
+			name: "named port",
+			port: "http",
+			slices: []*discoveryv1.EndpointSlice{
+				endpointSlice("a", "svc", "http", 8080, "10.0.0.2", "10.0.0.1"),
+			},
+			want: []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+		},
+		{
+			name: "port number",
+			port: "8080",
+			slices: []*discoveryv1.EndpointSlice{
+				endpointSlice("a", "svc", "http", 8080, "10.0.0.1"),
+			},
+			want: []string{"10.0.0.1:8080"},
+		},
+		{
+			name: "readiness",
+			port: "http",
+			slices: []*discoveryv1.EndpointSlice{
+				endpointSlice("a", "svc", "http", 80, "10.0.0.1!", "10.0.0.2?", "10.0.0.3"),
+			},
+			want: []string{"10.0.0.2:80", "10.0.0.3:80"},
+		},
+		{
+			name: "slices with duplicates and other ports",
+			port: "http",
+			slices: []*discoveryv1.EndpointSlice{
+				endpointSlice("a", "svc", "http", 80, "10.0.0.1", "10.0.0.2"),
+				endpointSlice("b", "svc", "http", 80, "10.0.0.2", "10.0.0.3"),
+				endpointSlice("c", "svc", "grpc", 90, "10.0.0.4"),
+			},
+			want: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
+		},
+		{
+			name: "no matching port",
+			port: "https",
+			slices: []*discoveryv1.EndpointSlice{
+				endpointSlice("a", "svc", "http", 80, "10.0.0.1"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kb := &k8sBackend{namespace: "ns", service: "svc", port: tt.port}
+			if got := kb.addrs(tt.slices); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestK8sWatch(t *testing.T) {
+	oldResync := k8sResyncPeriod
+	k8sResyncPeriod = 50 * time.Millisecond
+	t.Cleanup(func() { k8sResyncPeriod = oldResync })
+
+	client := fake.NewClientset(endpointSlice("a", "svc", "http", 80, "10.0.0.1"))
+	// Each watch is sent so that the test can end it as the API server would
+	watches := make(chan watch.Interface, 10)
+	client.PrependWatchReactor("endpointslices", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := client.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		if err == nil {
+			watches <- w
+		}
+		return true, w, err
+	})
+	kb := &k8sBackend{namespace: "ns", service: "svc", port: "http"}
+	stop := make(chan utils.Unit)
+	updates := make(chan []string, 10)
+	done := make(chan utils.Unit)
+	go func() {
+		kb.watchWith(client, stop, func(addrs []string) { updates <- addrs })
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	expect := func(want ...string) {
+		t.Helper()
+		select {
+		case got := <-updates:
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expected update to %v", want)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case got := <-updates:
+			t.Fatalf("expected no update, got %v", got)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+
+	ctx := context.Background()
+	slices := client.DiscoveryV1().EndpointSlices("ns")
+	expect("10.0.0.1:80")
+	// Resyncs (every 50ms) don't report the unchanged addresses again
+	expectNone()
+
+	_, err := slices.Create(ctx, endpointSlice("b", "svc", "http", 80, "10.0.0.2"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("10.0.0.1:80", "10.0.0.2:80")
+	_, err = slices.Update(ctx, endpointSlice("a", "svc", "http", 80, "10.0.0.1!"), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("10.0.0.2:80")
+
+	// The watch ending relists without reporting the unchanged addresses,
+	// changes after it being watched
+	(<-watches).Stop()
+	expectNone()
+	var w watch.Interface
+	select {
+	case w = <-watches:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the watch restarted")
+	}
+	defer w.Stop()
+	if err := slices.Delete(ctx, "b", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect()
+}
+
+// writeKubeconfig writes the kubeconfig to a temporary file, returning its
+// path.
+func writeKubeconfig(t *testing.T, cfg string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadK8sConfig(t *testing.T) {
+	const kubeconfig = `
+apiVersion: v1
+kind: Config
+current-context: %s
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example:6443
+    certificate-authority-data: %s
+- name: dev
+  cluster:
+    server: https://dev.example:6443
+    insecure-skip-tls-verify: true
+contexts:
+- name: prod
+  context: {cluster: prod, user: admin}
+- name: dev
+  context: {cluster: dev, user: admin}
+users:
+- name: admin
+  user:
+    token: secret-token
+`
+	// Any base64 is accepted as the certificate authority until it's used
+	const caData = "Y2EtZGF0YQ=="
+	tests := []struct {
+		name    string
+		context string
+		// env is whether the kubeconfig is given through $KUBECONFIG rather
+		// than the path.
+		env      bool
+		wantHost string
+	}{
+		{name: "current context", context: "prod", wantHost: "https://prod.example:6443"},
+		{name: "from $KUBECONFIG", context: "prod", env: true, wantHost: "https://prod.example:6443"},
+		{name: "insecure cluster", context: "dev"},
+		{name: "missing context", context: "staging"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeKubeconfig(t, fmt.Sprintf(kubeconfig, tt.context, caData))
+			t.Setenv("KUBERNETES_SERVICE_HOST", "")
+			t.Setenv("KUBECONFIG", "")
+			if tt.env {
+				t.Setenv("KUBECONFIG", path)
+				path = ""
+			}
+			cfg, err := loadK8sConfig(path)
+			if tt.wantHost == "" {
+				if err == nil {
+					t.Fatalf("expected error, got host %s", cfg.Host)
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error loading: ", err)
+			}
+			if cfg.Host != tt.wantHost {
+				t.Errorf("expected host %s, got %s", tt.wantHost, cfg.Host)
+			}
+			if cfg.BearerToken != "secret-token" {
+				t.Errorf("expected token secret-token, got %q", cfg.BearerToken)
+			}
+			if string(cfg.CAData) != "ca-data" {
+				t.Errorf("expected CA data decoded, got %q", cfg.CAData)
+			}
+		})
+	}
+}
+
+func TestLoadK8sConfigInCluster(t *testing.T) {
+	t.Setenv("KUBECONFIG", "")
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+	// Without the service account's token (as outside a pod), the in-cluster
+	// config fails to load rather than falling back to ~/.kube/config
+	if _, err := os.Stat("/var/run/secrets/kubernetes.io/serviceaccount/token"); err == nil {
+		t.Skip("running in a pod")
+	}
+	if _, err := loadK8sConfig(""); err == nil {
+		t.Fatal("expected error loading in-cluster config without a token")
+	}
+}
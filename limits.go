@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+// TokenLimits are the limits on what tunnels using a token may do. Zero values
+// mean unlimited.
+type TokenLimits struct {
+	// MaxConns is the maximum number of tunnel conns (idle or in use).
+	MaxConns int `json:"max_conns,omitempty"`
+	// MaxBandwidth is the maximum bytes per second across all the token's
+	// conns (in both directions).
+	MaxBandwidth int64 `json:"max_bandwidth,omitempty"`
+	// MaxServices is the maximum number of distinct services registered for
+	// at once.
+	MaxServices int `json:"max_services,omitempty"`
+}
+
+// tokenAllowed returns whether tunnels using the named token can register for
+// the service.
+func (sc *ServiceConfig) tokenAllowed(name string) bool {
+	return len(sc.Tokens) == 0 || containsStr(sc.Tokens, name)
+}
+
+// tokenUsage is the live usage of a token.
+type tokenUsage struct {
+	conns    int
+	services map[string]int
+	limiter  *rateLimiter
+}
+
+var (
+	tokenUsagesMtx sync.Mutex
+	tokenUsages    = make(map[string]*tokenUsage)
+)
+
+// acquireToken records a new tunnel conn using the token for the service,
+// returning the conn to use in its place (which releases the usage once
+// closed). An error is returned if the token's limits would be exceeded.
+func acquireToken(
+	conn net.Conn, name, service string, limits TokenLimits,
+) (net.Conn, error) {
+	tokenUsagesMtx.Lock()
+	defer tokenUsagesMtx.Unlock()
+	tu := tokenUsages[name]
+	if tu == nil {
+		tu = &tokenUsage{services: make(map[string]int)}
+		tokenUsages[name] = tu
+	}
+	if limits.MaxConns > 0 && tu.conns >= limits.MaxConns {
+		return nil, fmt.Errorf("max conns (%d) reached", limits.MaxConns)
+	}
+	if _, ok := tu.services[service]; !ok &&
+		limits.MaxServices > 0 && len(tu.services) >= limits.MaxServices {
+		return nil, fmt.Errorf("max services (%d) reached", limits.MaxServices)
+	}
+	if limits.MaxBandwidth > 0 {
+		if tu.limiter == nil {
+			tu.limiter = newRateLimiter(limits.MaxBandwidth)
+		}
+		tu.limiter.setRate(limits.MaxBandwidth)
+	} else {
+		tu.limiter = nil
+	}
+	tu.conns++
+	tu.services[service]++
+	return &tokenConn{Conn: conn, name: name, limiter: tu.limiter, release: func() {
+		tokenUsagesMtx.Lock()
+		defer tokenUsagesMtx.Unlock()
+		tu.conns--
+		if tu.services[service]--; tu.services[service] == 0 {
+			delete(tu.services, service)
+		}
+		if tu.conns == 0 {
+			delete(tokenUsages, name)
+		}
+	}}, nil
+}
+
+// tokenConn is a tunnel conn authenticated with a token. Its bandwidth is
+// limited by the token's limiter (if any) and it releases its usage of the
+// token once closed.
+type tokenConn struct {
+	net.Conn
+	// name is the name of the token.
+	name    string
+	limiter *rateLimiter
+	once    sync.Once
+	release func()
+}
+
+func (tc *tokenConn) Read(p []byte) (int, error) {
+	n, err := tc.Conn.Read(p)
+	if tc.limiter != nil && n > 0 {
+		tc.limiter.wait(n)
+	}
+	return n, err
+}
+
+func (tc *tokenConn) Write(p []byte) (int, error) {
+	if tc.limiter != nil {
+		tc.limiter.wait(len(p))
+	}
+	return tc.Conn.Write(p)
+}
+
+func (tc *tokenConn) Close() error {
+	tc.once.Do(tc.release)
+	return tc.Conn.Close()
+}
+
+// NetConn returns the underlying conn.
+func (tc *tokenConn) NetConn() net.Conn {
+	return tc.Conn
+}
+
+// closeTokenIdle closes the idle conns (and sessions) authenticated with the
+// named token (e.g., once it's revoked) so that no more clients are piped
+// through them, returning how many were closed. Conns in use are unaffected,
+// other than the streams of the sessions closed.
+func closeTokenIdle(name string) int {
+	usesToken := func(conn net.Conn) bool {
+		tc, ok := conn.(*tokenConn)
+		return ok && tc.name == name
+	}
+	closed := 0
+	for _, svc := range allServices() {
+		conns := svc.idle.removeIdle(usesToken)
+		for _, conn := range conns {
+			conn.Close()
+			// Signal that another idle conn can be accepted
+			readyCh <- utils.Unit{}
+		}
+		sessions := svc.idle.removeSessions(usesToken)
+		for _, sess := range sessions {
+			sess.Close()
+		}
+		closed += len(conns) + len(sessions)
+	}
+	return closed
+}
+
+// rateLimiter limits the rate of bytes, shared by any number of conns.
+type rateLimiter struct {
+	mtx  sync.Mutex
+	rate int64
+	// next is when the bytes sent so far are paid for.
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+func (rl *rateLimiter) setRate(rate int64) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	rl.rate = rate
+}
+
+// wait waits until n more bytes are allowed.
+func (rl *rateLimiter) wait(n int) {
+	rl.mtx.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	rl.next = rl.next.Add(time.Duration(n) * time.Second / time.Duration(rl.rate))
+	delay := rl.next.Sub(now)
+	rl.mtx.Unlock()
+	time.Sleep(delay)
+}
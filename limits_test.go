@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+	"github.com/johnietre/utils/go"
+)
+
+// pipeConn returns one end of an in-memory conn pair, closing both at the end
+// of the test.
+func pipeConn(t *testing.T) (conn, peer net.Conn) {
+	t.Helper()
+	conn, peer = net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+func TestAcquireTokenLimits(t *testing.T) {
+	limits := TokenLimits{MaxConns: 2, MaxServices: 1}
+	conn, _ := pipeConn(t)
+	tc1, err := acquireToken(conn, "tok", "a", limits)
+	if err != nil {
+		t.Fatal("error acquiring token: ", err)
+	}
+	defer tc1.Close()
+	if _, err := acquireToken(conn, "tok", "b", limits); err == nil {
+		t.Fatal("expected max services to be enforced")
+	}
+	tc2, err := acquireToken(conn, "tok", "a", limits)
+	if err != nil {
+		t.Fatal("error acquiring token: ", err)
+	}
+	if _, err := acquireToken(conn, "tok", "a", limits); err == nil {
+		t.Fatal("expected max conns to be enforced")
+	}
+	// Other tokens are counted separately
+	other, err := acquireToken(conn, "other", "b", limits)
+	if err != nil {
+		t.Fatal("error acquiring other token: ", err)
+	}
+	other.Close()
+
+	// Closing (even twice) releases the conn's usage once
+	tc2.Close()
+	tc2.Close()
+	tc3, err := acquireToken(conn, "tok", "a", limits)
+	if err != nil {
+		t.Fatal("expected a conn to be released, got ", err)
+	}
+	if _, err := acquireToken(conn, "tok", "a", limits); err == nil {
+		t.Fatal("expected a closed conn to be released only once")
+	}
+	tc3.Close()
+	tc1.Close()
+	tokenUsagesMtx.Lock()
+	_, ok := tokenUsages["tok"]
+	tokenUsagesMtx.Unlock()
+	if ok {
+		t.Fatal("expected the token's usage to be forgotten once unused")
+	}
+	// With no conns, another service can be used
+	tc4, err := acquireToken(conn, "tok", "b", limits)
+	if err != nil {
+		t.Fatal("error acquiring token for another service: ", err)
+	}
+	tc4.Close()
+}
+
+func TestTokenConnBandwidth(t *testing.T) {
+	conn, peer := pipeConn(t)
+	tc, err := acquireToken(conn, "slow", "a", TokenLimits{MaxBandwidth: 10000})
+	if err != nil {
+		t.Fatal("error acquiring token: ", err)
+	}
+	defer tc.Close()
+	go io.Copy(io.Discard, peer)
+	start := time.Now()
+	// 1000 bytes at 10000 B/s takes 100ms
+	for i := 0; i < 4; i++ {
+		if _, err := tc.Write(make([]byte, 250)); err != nil {
+			t.Fatal("error writing: ", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected writes to be limited to 100ms, took %s", elapsed)
+	}
+}
+
+func TestServiceConfigTokenAllowed(t *testing.T) {
+	sc := &ServiceConfig{}
+	if !sc.tokenAllowed("any") {
+		t.Fatal("expected any token allowed without a list")
+	}
+	sc.Tokens = []string{"a", "b"}
+	if !sc.tokenAllowed("b") || sc.tokenAllowed("c") {
+		t.Fatal("expected only listed tokens allowed")
+	}
+}
+
+func TestReservedServiceTokens(t *testing.T) {
+	setTestPassword(t)
+	s := newState("")
+	setState(t, s)
+	laptop, err := s.CreateToken("laptop", TokenLimits{})
+	if err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+	other, err := s.CreateToken("other", TokenLimits{})
+	if err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+	svc := newService("prod", &ServiceConfig{Tokens: []string{"laptop"}})
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"prod": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+
+	tests := []struct {
+		name   string
+		secret string
+		ping   bool
+		want   byte
+	}{
+		{name: "reserving token", secret: laptop, want: passwordOk},
+		{name: "password", secret: tunnelittest.DefaultPassword, want: passwordOk},
+		{name: "other token", secret: other, want: serviceReserved},
+		{name: "other token pinging", secret: other, ping: true, want: passwordOk},
+	}
+	for _, tt := range tests {
+		reg := Registration{Service: "prod", Tunnel: tt.name, Ping: tt.ping}
+		status, _ := registerTunnel(t, sha256.Sum256([]byte(tt.secret)), reg)
+		if status != tt.want {
+			t.Fatalf(
+				"%s: expected %s, got %s", tt.name,
+				tunnelit.StatusText(tt.want), tunnelit.StatusText(status),
+			)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+)
+
+// Without a link, a tunnel only learns that its idle conns are dead once the
+// proxy heartbeats them or pairs them with a client, and the proxy only once
+// its heartbeats fail. Tunnels with links (--link) keep one more conn per
+// service to the proxy, over which they exchange pool statuses every
+// heartbeat interval, so that both sides notice within a few intervals when
+// the connection between them is lost and close their idle conns right away,
+// replacing them (once the proxy is reachable again) rather than waiting for
+// clients to fail on them.
+
+// tunnelLink is whether the default service's tunnel keeps a link to the
+// proxy.
+var tunnelLink bool
+
+// linkTimeout is how long either side of a link waits for a status before
+// considering the link lost.
+const linkTimeout = 3 * heartbeatInterval
+
+var (
+	// errLinkUnsupported is returned when the proxy doesn't support links.
+	errLinkUnsupported = errors.New("proxy doesn't support links")
+	// errLinkSwitched is returned when the link is closed since the tunnel
+	// switched proxies.
+	errLinkSwitched = errors.New("switched proxies")
+)
+
+// answerLink answers the statuses sent over the tunnel's link until it's
+// lost, then closes the tunnel's idle conns and sessions for the service
+// (which are likely dead too) unless the tunnel has another link.
+func answerLink(conn net.Conn, svc *service, tunnelID string, info tunnelInfo) {
+	defer conn.Close()
+	lost := svc.idle.addLink(tunnelID, info)
+	var err error
+	for {
+		conn.SetReadDeadline(time.Now().Add(linkTimeout))
+		var status LinkStatus
+		if err = readMsg(conn, &status); err != nil {
+			break
+		}
+		reply := svc.idle.linkStatus(tunnelID, status.IdleConns)
+		conn.SetWriteDeadline(time.Now().Add(heartbeatTimeout))
+		if err = writeMsg(conn, reply); err != nil {
+			break
+		}
+	}
+	label := svc.idle.tunnelLabel(tunnelID)
+	if lost() != 0 {
+		log.Printf(
+			"Link from tunnel %s of %s replaced: %v", label, svc.displayName(), err,
+		)
+		return
+	}
+	log.Printf(
+		"Lost link to tunnel %s of %s, closing its idle conns: %v",
+		label, svc.displayName(), err,
+	)
+	closeIdle(svc.idle.takeTunnelIdle(tunnelID))
+}
+
+// runLink keeps a link to the current proxy for the service until it's
+// removed (or the proxy turns out not to support links).
+func (ts *tunnelService) runLink(sel *proxySelector) {
+	for {
+		proxyAddr := sel.Current()
+		up, err := ts.serveLink(proxyAddr, sel)
+		delay := dialRetryDelay
+		select {
+		case <-ts.stop:
+			return
+		default:
+		}
+		switch {
+		case errors.Is(err, errLinkUnsupported):
+			log.Printf(
+				"Proxy %s doesn't support links, so %s won't keep one (upgrade the proxy)",
+				proxyAddr, ts.displayName(),
+			)
+			return
+		case errors.Is(err, errLinkSwitched):
+			continue
+		case up:
+			log.Printf(
+				"Lost link to proxy %s for %s, closing its idle conns: %v",
+				proxyAddr, ts.displayName(), err,
+			)
+			ts.closeIdleTo(proxyAddr)
+		default:
+			log.Printf(
+				"Error establishing link to proxy %s for %s: %v",
+				proxyAddr, ts.displayName(), err,
+			)
+			delay = limitRetryDelay
+		}
+		select {
+		case <-ts.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// serveLink establishes a link to the proxy and sends statuses over it until
+// it's lost, the tunnel switches proxies, or the service is removed,
+// returning whether it was established.
+func (ts *tunnelService) serveLink(
+	proxyAddr string, sel *proxySelector,
+) (bool, error) {
+	conn, err := dialProxy(proxyAddr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	reg := ts.reg
+	reg.Link, reg.Mux, reg.Endpoints = true, false, false
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+	status, err := proxyHandshake(conn, reg)
+	if err != nil {
+		return false, err
+	} else if status != passwordOk {
+		return false, errors.New(tunnelit.StatusText(status))
+	}
+	b := []byte{0}
+	if _, err := conn.Read(b); err != nil {
+		return false, err
+	} else if b[0] != linkReady {
+		// Older proxies pool the conn like an idle conn, heartbeating it (or
+		// using it for a client)
+		return false, errLinkUnsupported
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("Established link to proxy %s for %s", proxyAddr, ts.displayName())
+	defer ts.setLinkStatus(nil)
+
+	// Statuses are read in the background so that losing the link is noticed
+	// while waiting to send the next
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(linkTimeout))
+			var status LinkStatus
+			if err := readMsg(conn, &status); err != nil {
+				errCh <- err
+				return
+			}
+			ts.setLinkStatus(&status)
+		}
+	}()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		status := LinkStatus{IdleConns: ts.idleCount(proxyAddr)}
+		conn.SetWriteDeadline(time.Now().Add(heartbeatTimeout))
+		if err := writeMsg(conn, status); err != nil {
+			return true, err
+		}
+		select {
+		case <-ts.stop:
+			return true, nil
+		case err := <-errCh:
+			return true, err
+		case <-ticker.C:
+		}
+		if sel.Current() != proxyAddr {
+			return true, errLinkSwitched
+		}
+	}
+}
+
+// setLinkStatus sets the status last received over the link (nil once it's
+// lost).
+func (ts *tunnelService) setLinkStatus(status *LinkStatus) {
+	ts.linkMtx.Lock()
+	defer ts.linkMtx.Unlock()
+	ts.linkStatus = status
+}
+
+// idleCount returns the number of the service's idle conns (or sessions) to
+// the proxy.
+func (ts *tunnelService) idleCount(proxyAddr string) int {
+	ts.idleMtx.Lock()
+	defer ts.idleMtx.Unlock()
+	n := 0
+	for _, addr := range ts.idle {
+		if addr == proxyAddr {
+			n++
+		}
+	}
+	return n
+}
+
+// closeIdleTo closes the service's idle conns (and sessions) to the proxy so
+// that they're replaced.
+func (ts *tunnelService) closeIdleTo(proxyAddr string) {
+	ts.idleMtx.Lock()
+	defer ts.idleMtx.Unlock()
+	for conn, addr := range ts.idle {
+		if addr == proxyAddr {
+			conn.Close()
+		}
+	}
+}
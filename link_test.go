@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+	"github.com/johnietre/utils/go"
+)
+
+// setLinkProxy sets up the proxy's state with the service for the test.
+func setLinkProxy(t *testing.T, svc *service) {
+	t.Helper()
+	setTestPassword(t)
+	setState(t, newState(""))
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{svc.name: svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+}
+
+func TestAnswerLink(t *testing.T) {
+	svc := newService("web", &ServiceConfig{})
+	setLinkProxy(t, svc)
+	putFakeTunnelConn(t, svc, "laptop", connReady)
+
+	pwdHash := sha256.Sum256([]byte(tunnelittest.DefaultPassword))
+	reg := Registration{Service: "web", Tunnel: "laptop", Link: true}
+	status, link := registerTunnel(t, pwdHash, reg)
+	if status != passwordOk {
+		t.Fatalf("expected the link accepted, got %s", tunnelit.StatusText(status))
+	}
+	b := []byte{0}
+	if _, err := io.ReadFull(link, b); err != nil || b[0] != linkReady {
+		t.Fatalf("expected the link ready, got %d (err: %v)", b[0], err)
+	}
+
+	// Each status is answered with the proxy's own
+	if err := writeMsg(link, LinkStatus{IdleConns: 3}); err != nil {
+		t.Fatal("error writing status: ", err)
+	}
+	var reply LinkStatus
+	if err := readMsg(link, &reply); err != nil {
+		t.Fatal("error reading status: ", err)
+	} else if reply.IdleConns != 1 {
+		t.Fatalf("expected the proxy's 1 idle conn, got %+v", reply)
+	}
+	stats := svc.idle.tunnelStats()["laptop"]
+	if !stats.Link || stats.LinkIdleConns != 3 {
+		t.Fatalf("expected the link's reported conns in the stats, got %+v", stats)
+	}
+
+	// Losing the link closes the tunnel's idle conns
+	link.Close()
+	waitFor(t, "the idle conns to be closed", func() bool {
+		stats := svc.idle.tunnelStats()["laptop"]
+		return !stats.Link && stats.IdleConns == 0
+	})
+}
+
+func TestServeLink(t *testing.T) {
+	svc := newService("web", &ServiceConfig{})
+	setLinkProxy(t, svc)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleProxyConn(conn, false)
+		}
+	}()
+	proxyAddr := ln.Addr().String()
+
+	sc := &TunnelServiceConfig{Saddrs: []string{"127.0.0.1:1"}, Link: true}
+	if err := sc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTunnelService("web", sc)
+	idle, _ := pipeConn(t)
+	ts.idle[idle] = proxyAddr
+	type result struct {
+		up  bool
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		up, err := ts.serveLink(proxyAddr, newProxySelector(
+			[]string{proxyAddr}, "web",
+		))
+		done <- result{up, err}
+	}()
+
+	// The tunnel's idle conns are reported to the proxy, and its answer kept
+	waitFor(t, "the link's statuses", func() bool {
+		for _, stats := range svc.idle.tunnelStats() {
+			if stats.Link && stats.LinkIdleConns == 1 {
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, "the proxy's status", func() bool {
+		ts.linkMtx.Lock()
+		defer ts.linkMtx.Unlock()
+		return ts.linkStatus != nil
+	})
+
+	close(ts.stop)
+	select {
+	case res := <-done:
+		if !res.up || res.err != nil {
+			t.Fatalf(
+				"expected the link up until stopped, got %v, %v", res.up, res.err,
+			)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the link to stop")
+	}
+	ts.linkMtx.Lock()
+	defer ts.linkMtx.Unlock()
+	if ts.linkStatus != nil {
+		t.Fatal("expected the status cleared once the link is gone")
+	}
+}
+
+func TestCloseIdleTo(t *testing.T) {
+	sc := &TunnelServiceConfig{Saddrs: []string{"127.0.0.1:1"}}
+	if err := sc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTunnelService("web", sc)
+	conns := make(map[string]net.Conn)
+	for _, addr := range []string{"proxy1", "proxy1", "proxy2"} {
+		conn, peer := pipeConn(t)
+		ts.idle[conn] = addr
+		conns[addr] = peer
+	}
+	if n := ts.idleCount("proxy1"); n != 2 {
+		t.Fatalf("expected 2 idle conns to proxy1, got %d", n)
+	}
+	ts.closeIdleTo("proxy1")
+	// Writing to an open pipe times out since nothing reads it
+	for addr, peer := range conns {
+		peer.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err := peer.Write([]byte{0})
+		if closed := err == io.ErrClosedPipe; closed != (addr == "proxy1") {
+			t.Fatalf("%s: expected closed to be %v", addr, !closed)
+		}
+	}
+}
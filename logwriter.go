@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// logQueueLen is the number of log writes queued before more are dropped.
+	logQueueLen = 4096
+	// logSlowWrite is how long a write can take before the output is
+	// considered slow.
+	logSlowWrite = 10 * time.Millisecond
+)
+
+// asyncWriter writes to the underlying writer without stalling callers when
+// it's slow (e.g., a log file on a busy disk or NFS). Writes go straight
+// through while the writer keeps up (so lines logged right before exiting,
+// e.g., by log.Fatal, usually aren't lost); once a write is in progress or
+// one was slow, others are queued and written in the background, and dropped
+// (and counted) once the queue is full.
+type asyncWriter struct {
+	w     io.Writer
+	mtx   sync.Mutex
+	queue chan []byte
+	// pending is the number of queued writes not yet written. Writes only go
+	// straight through when none are pending so they stay in order.
+	pending atomic.Int64
+	// slow is whether the last write took longer than logSlowWrite.
+	slow    atomic.Bool
+	dropped atomic.Uint64
+}
+
+func newAsyncWriter(w io.Writer) *asyncWriter {
+	aw := &asyncWriter{w: w, queue: make(chan []byte, logQueueLen)}
+	go aw.run()
+	return aw
+}
+
+func (aw *asyncWriter) Write(p []byte) (int, error) {
+	if aw.pending.Load() == 0 && !aw.slow.Load() && aw.mtx.TryLock() {
+		defer aw.mtx.Unlock()
+		aw.writeDropped()
+		return aw.write(p)
+	}
+	// The log package reuses its buffer
+	b := append([]byte(nil), p...)
+	aw.pending.Add(1)
+	select {
+	case aw.queue <- b:
+	default:
+		aw.pending.Add(-1)
+		aw.dropped.Add(1)
+		metrics.LogDrops.Inc()
+	}
+	return len(p), nil
+}
+
+// run writes the queued writes, noting any dropped ones periodically.
+func (aw *asyncWriter) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case b := <-aw.queue:
+			aw.mtx.Lock()
+			aw.writeDropped()
+			aw.write(b)
+			aw.pending.Add(-1)
+			aw.mtx.Unlock()
+		case <-ticker.C:
+			if aw.dropped.Load() != 0 && aw.mtx.TryLock() {
+				aw.writeDropped()
+				aw.mtx.Unlock()
+			}
+		}
+	}
+}
+
+// write writes to the underlying writer, recording whether it was slow. The
+// mutex must be held.
+func (aw *asyncWriter) write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := aw.w.Write(p)
+	aw.slow.Store(time.Since(start) > logSlowWrite)
+	return n, err
+}
+
+// writeDropped writes how many writes were dropped since it was last called,
+// if any. The mutex must be held.
+func (aw *asyncWriter) writeDropped() {
+	if n := aw.dropped.Swap(0); n != 0 {
+		fmt.Fprintf(aw.w, "Dropped %d log lines (log output too slow)\n", n)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gateWriter writes to the buffer once the gate is closed.
+type gateWriter struct {
+	buf  *syncBuffer
+	gate chan struct{}
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriterInOrder(t *testing.T) {
+	buf := &syncBuffer{}
+	aw := newAsyncWriter(buf)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(aw, "line %d\n", i)
+	}
+	// A fast writer is written to directly
+	if !strings.HasPrefix(buf.String(), "line 0\nline 1\n") {
+		t.Fatalf("expected lines written directly, got %q", buf)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for i, line := range lines {
+		if line != fmt.Sprintf("line %d", i) {
+			t.Fatalf("expected lines in order, got %q at %d", line, i)
+		}
+	}
+}
+
+func TestAsyncWriterDrops(t *testing.T) {
+	buf := &syncBuffer{}
+	w := &gateWriter{buf: buf, gate: make(chan struct{})}
+	aw := newAsyncWriter(w)
+	drops := metrics.LogDrops.Total()
+
+	// The first write blocks on the slow output
+	go fmt.Fprint(aw, "first\n")
+	for aw.mtx.TryLock() {
+		aw.mtx.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	const n = logQueueLen + 100
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(aw, "line %d\n", i)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected writes not to stall, took %s", elapsed)
+	}
+	dropped := metrics.LogDrops.Total() - drops
+	if dropped < 99 {
+		t.Fatalf("expected writes past the queue dropped, got %d", dropped)
+	}
+
+	close(w.gate)
+	for i := 0; aw.pending.Load() != 0; i++ {
+		if i == 500 {
+			t.Fatal("timed out waiting for queued writes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := fmt.Sprintf("Dropped %d log lines (log output too slow)\n", dropped)
+	if out := buf.String(); !strings.HasPrefix(out, "first\n") {
+		t.Fatalf("expected the first line first, got %q", out[:20])
+	} else if !strings.Contains(out, want) {
+		t.Fatalf("expected %q to be written", want)
+	} else if !strings.Contains(out, "\nline 0\n") {
+		t.Fatal("expected queued lines to be written")
+	}
+}
@@ -1,31 +1,51 @@
 package main
 
 import (
-	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"time"
 
+	"github.com/johnietre/tunnel-proxy/tunnelit"
 	"github.com/johnietre/utils/go"
 	"github.com/spf13/cobra"
 )
 
 var (
 	maxIdleConns uint = 10
-	passwordHash [sha256.Size]byte
+	passwordHash utils.AValue[[sha256.Size]byte]
 	logFile      string
 )
 
 const passwordEnvName = "TUNNELIT_PASSWORD"
 
 const (
-	connReady       byte = 1
-	passwordInvalid byte = 10
-	passwordOk      byte = 11
+	connReady       = tunnelit.ConnReady
+	heartbeatByte   = tunnelit.Heartbeat
+	connDial        = tunnelit.ConnDial
+	dialFailed      = tunnelit.DialFailed
+	muxReady        = tunnelit.MuxReady
+	linkReady       = tunnelit.LinkReady
+	pingTunnel      = tunnelit.PingTunnel
+	passwordInvalid = tunnelit.StatusPasswordInvalid
+	passwordOk      = tunnelit.StatusOK
+	serviceUnknown  = tunnelit.StatusServiceUnknown
+	limitExceeded   = tunnelit.StatusLimitExceeded
+	tunnelExpired   = tunnelit.StatusTunnelExpired
+	serviceReserved = tunnelit.StatusServiceReserved
+	badVersion      = tunnelit.StatusBadVersion
+	proxyDraining   = tunnelit.StatusDraining
+	egressRequired  = tunnelit.StatusEgressRequired
+	hostsRequired   = tunnelit.StatusHostsRequired
 )
 
 func main() {
@@ -37,7 +57,8 @@ func main() {
 		Long: `A tunnel/proxy program. This is most useful for when it is desired to proxy from a static IP to a non-static IP.
 This acts as the intermediary between some machine with a static IP and a server running on a machine without a static IP.
 When starting either the tunnel or proxy, a password is sent/checked for each new tunnel connection.
-The password can be set using the ` + passwordEnvName + ` environment variable.`,
+The password can be set using the ` + passwordEnvName + ` environment variable, read from a file or stdin, or fetched from Vault, AWS Secrets Manager, or SSM Parameter Store.
+Tunnels may also use a token created through the proxy's admin API in place of the password.`,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			if maxIdleConns == 0 {
 				return fmt.Errorf("iddle-conns must be greater than 0")
@@ -46,15 +67,70 @@ The password can be set using the ` + passwordEnvName + ` environment variable.`
 			for i := 0; i < int(maxIdleConns); i++ {
 				readyCh <- utils.Unit{}
 			}
+			go dumpOnSignal()
+			var logOut io.Writer = os.Stderr
 			if logFile != "" {
 				f, err := utils.OpenAppend(logFile)
 				if err != nil {
 					return err
 				}
-				log.SetOutput(f)
+				logOut = f
+			}
+			// Keep slow log output from stalling accepts and pipes
+			log.SetOutput(newAsyncWriter(logOut))
+			if maxConnBytes < 0 {
+				return fmt.Errorf("max-conn-bytes must not be negative")
+			}
+			ipv4 := must(cmd.Flags().GetBool("ipv4"))
+			ipv6 := must(cmd.Flags().GetBool("ipv6"))
+			if err := setAddressFamily(ipv4, ipv6); err != nil {
+				return err
+			}
+			if err := setupPrivacy(); err != nil {
+				return err
+			}
+			if err := setupSocketOpts(); err != nil {
+				return err
+			}
+			if chaosSpec != "" {
+				var err error
+				if chaos, err = ParseChaos(chaosSpec); err != nil {
+					return err
+				}
+				log.Printf("Running in chaos mode: %+v", *chaos)
+			}
+			sources := 0
+			for _, set := range []bool{
+				vaultPath != "", passwordFrom != "", passwordFile != "", passwordStdin,
+			} {
+				if set {
+					sources++
+				}
+			}
+			if sources > 1 {
+				return fmt.Errorf(
+					"vault-path, password-from, password-file, and password-stdin are mutually exclusive",
+				)
+			}
+			if vaultPath != "" {
+				if vaultRefresh <= 0 {
+					return fmt.Errorf("vault-refresh must be positive")
+				}
+				return loadVaultPassword()
 			}
 			pwd := os.Getenv(passwordEnvName)
-			passwordHash = sha256.Sum256([]byte(pwd))
+			var err error
+			if passwordFrom != "" {
+				pwd, err = loadPasswordFrom(passwordFrom)
+			} else if passwordFile != "" {
+				pwd, err = loadPasswordFile(passwordFile)
+			} else if passwordStdin {
+				pwd, err = readPasswordStdin()
+			}
+			if err != nil {
+				return err
+			}
+			passwordHash.Store(sha256.Sum256([]byte(pwd)))
 			return nil
 		},
 	}
@@ -65,6 +141,130 @@ The password can be set using the ` + passwordEnvName + ` environment variable.`
 	rootCmd.PersistentFlags().StringVar(
 		&logFile, "log", "", "File to log to (blank means stderr)",
 	)
+	rootCmd.PersistentFlags().Uint64Var(
+		&logSampleRate, "log-sample", 1,
+		"Only log 1 in N closed connections (errors are always logged)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&anonymizeIPs, "anonymize-ips", "",
+		"Anonymize addresses in the access logs by truncating (truncate) or hashing (hash) them (blank means off)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&auditLogFile, "audit-log", "",
+		"File to write the security audit log (with full addresses) to (blank means disabled)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&onConnect, "on-connect", "",
+		"Shell command (given TUNNELIT_* env vars) or http(s) URL (POSTed JSON) to run when a connection is established",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&onDisconnect, "on-disconnect", "",
+		"Shell command (given TUNNELIT_* env vars) or http(s) URL (POSTed JSON) to run when a connection is torn down",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&maxLifetime, "max-lifetime", 0,
+		"Maximum duration a piped connection may live (0 means unlimited)",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&lifetimeGrace, "lifetime-grace", 0,
+		"How long before the max lifetime is reached to log a warning",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&stallTimeout, "stall-timeout", 0,
+		"Close a piped connection if a write stalls for this long (0 means never)",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&streamIdleTimeout, "stream-idle-timeout", 0,
+		"Close a piped connection once neither side has sent anything for this long (0 means never; services may override it, and gRPC streams detected in http mode are exempt)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&tlsMinVersion, "tls-min-version", "",
+		"Minimum TLS version (1.0, 1.1, 1.2, or 1.3) for the link and the clients whose TLS is terminated (blank means 1.2)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&tlsMaxVersion, "tls-max-version", "",
+		"Maximum TLS version (1.0, 1.1, 1.2, or 1.3) for the link and the clients whose TLS is terminated (blank means the latest)",
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&tlsCiphers, "tls-ciphers", nil,
+		"Cipher suites (e.g., TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384) allowed for TLS 1.2 and below (empty means Go's defaults; TLS 1.3's aren't configurable)",
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&tlsCurves, "tls-curves", nil,
+		"Key exchanges (X25519MLKEM768, X25519, P256, P384, or P521) allowed for TLS, in order of preference (empty means Go's defaults)",
+	)
+	rootCmd.PersistentFlags().Int64Var(
+		&maxConnBytes, "max-conn-bytes", 0,
+		"Maximum bytes transferred in each direction of a piped connection (0 means unlimited)",
+	)
+	rootCmd.PersistentFlags().Bool(
+		"ipv4", false, "Only use IPv4 for listening and dialing",
+	)
+	rootCmd.PersistentFlags().Bool(
+		"ipv6", false, "Only use IPv6 for listening and dialing",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&dialer.FallbackDelay, "fallback-delay", 250*time.Millisecond,
+		"Head start given to the preferred address family (usually IPv6) before racing the other when an address resolves to both (negative disables racing)",
+	)
+	rootCmd.PersistentFlags().UintVar(
+		&fwmark, "fwmark", 0,
+		"SO_MARK to set on tunnel and backend sockets for policy routing (0 means unset; Linux only)",
+	)
+	rootCmd.PersistentFlags().IntVar(
+		&dscp, "dscp", -1,
+		"DSCP value (0-63) to set on tunnel and backend sockets (-1 means unset; Linux only)",
+	)
+	rootCmd.PersistentFlags().IntVar(
+		&rcvBuf, "rcvbuf", 0,
+		"SO_RCVBUF (in bytes) for piped sockets (0 means the kernel default; Linux only)",
+	)
+	rootCmd.PersistentFlags().IntVar(
+		&sndBuf, "sndbuf", 0,
+		"SO_SNDBUF (in bytes) for piped sockets (0 means the kernel default; Linux only)",
+	)
+	rootCmd.PersistentFlags().IntVar(
+		&linkMSS, "link-mss", 0,
+		"TCP MSS to clamp the tunnel-proxy link's sockets to so they don't blackhole behind smaller-MTU hops that drop oversized packets (e.g., 1452 behind PPPoE; 0 means the kernel's; Linux only)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&chaosSpec, "chaos", "",
+		"Inject faults into pipes for testing (e.g., latency=50ms,jitter=20ms,reset=0.001,rate=65536)",
+	)
+	rootCmd.PersistentFlags().MarkHidden("chaos")
+	rootCmd.PersistentFlags().StringVar(
+		&crashDir, "crash-dir", os.TempDir(),
+		"Directory to write a report to when handling a connection panics (blank means only log it)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&vaultAddr, "vault-addr", os.Getenv(vaultAddrEnvName),
+		"Address of the Vault server (defaults to "+vaultAddrEnvName+")",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&vaultPath, "vault-path", "",
+		"Vault secret path to read the password from, e.g., secret/data/tunnelit (authenticates with "+
+			vaultTokenEnvName+" or "+vaultRoleIDEnvName+" and "+vaultSecretIDEnvName+")",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&vaultField, "vault-field", "password",
+		"Field of the Vault secret holding the password",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&passwordFrom, "password-from", "",
+		"Fetch the password from aws-sm://<secret-id> or aws-ssm://<parameter-name> (using the environment's or instance role's credentials)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&passwordFile, "password-file", "",
+		"File to read the password from (should be mode 0600; a trailing newline is ignored)",
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&passwordStdin, "password-stdin", false,
+		"Read the password from the first line of stdin",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&vaultRefresh, "vault-refresh", 5*time.Minute,
+		"How often to refresh the password and renew the token from Vault",
+	)
 
 	proxyCmd := &cobra.Command{
 		Use:   "proxy",
@@ -73,9 +273,240 @@ The password can be set using the ` + passwordEnvName + ` environment variable.`
 This is usually be run on the machine with the static IP. The addresses passed to the "addr" and "paddr" flags are usually bound to static addresses.`,
 		Run: RunProxy,
 	}
-	proxyCmd.Flags().String("addr", "", "Address to listen for clients on")
+	proxyCmd.Flags().String(
+		"addr", "",
+		"Address to listen for clients of the default service on (port 0 picks a free port)",
+	)
+	proxyCmd.Flags().String(
+		"ws-addr", "",
+		"Address to listen for WebSocket clients (e.g., browsers) of the default service on",
+	)
+	proxyCmd.Flags().StringVar(
+		&flagUDPAddr, "udp-addr", "",
+		"Address to listen for UDP clients of the default service on (its tunnels must relay to UDP servers)",
+	)
+	proxyCmd.Flags().BoolVar(
+		&flagAcceptProxyProtocol, "accept-proxy-protocol", false,
+		"Read a PROXY protocol header (v1 or v2, e.g., from an AWS NLB) from each client on addr and use its client address for the ACLs and logs and forward it to the tunnels",
+	)
+	proxyCmd.Flags().BoolVar(
+		&flagHTTPConnect, "http-connect", false,
+		"Make addr an HTTP CONNECT proxy whose clients' destinations are dialed by the tunnels (which must have egress)",
+	)
+	proxyCmd.Flags().BoolVar(
+		&flagSocks, "socks", false,
+		"Make addr a SOCKS5 server whose clients' destinations are dialed by the tunnels (which must have egress)",
+	)
+	proxyCmd.Flags().BoolVar(
+		&flagHTTPMode, "http", false,
+		"Route addr's clients by the Host of their first HTTP request to tunnels serving it (see the tunnel's http-host), responding 502 if there are none",
+	)
+	proxyCmd.Flags().StringVar(
+		&flagHTTPDomain, "http-domain", "",
+		"Domain (e.g., tunnel.example.com, with wildcard DNS to the proxy) whose subdomains are assigned to named tunnels without http-hosts (e.g., web.tunnel.example.com to the tunnel named web); requires http",
+	)
+	proxyCmd.Flags().DurationVar(
+		&udpTimeout, "udp-timeout", udpTimeout,
+		"How long a UDP client's session (and tunnel conn) lasts without datagrams",
+	)
 	proxyCmd.Flags().String("paddr", "", "Address to listen for tunnels on")
-	proxyCmd.MarkFlagRequired("addr")
+	proxyCmd.Flags().StringVar(
+		&tunnelWSAddr, "tunnel-ws-addr", "",
+		"Address to serve the WebSocket endpoint for tunnels on, for tunnels that can only reach the proxy over HTTP(S) (over TLS with tls; blank means none)",
+	)
+	proxyCmd.Flags().StringVar(
+		&tunnelQUICAddr, "tunnel-quic-addr", "",
+		"UDP address to accept QUIC tunnels (those with transport quic) on (requires tls; blank means none)",
+	)
+	proxyCmd.Flags().IntVar(
+		&fecDataShards, "fec-data-shards", 0,
+		"Number of data shards in each group of QUIC datagrams with FEC (requires fec-parity-shards; tunnels must use the same counts; 0 means no FEC)",
+	)
+	proxyCmd.Flags().IntVar(
+		&fecParityShards, "fec-parity-shards", 0,
+		"Number of parity shards added to each group of QUIC datagrams, and so the most lost datagrams of a group that can be rebuilt (e.g., 10 and 3 for ~2% loss)",
+	)
+	proxyCmd.Flags().StringVar(
+		&tunnelWSPath, "tunnel-ws-path", tunnelWSPath,
+		"Path of the WebSocket endpoint for tunnels",
+	)
+	proxyCmd.Flags().StringVar(
+		&clientTLSCertFile, "client-tls-cert", "",
+		"PEM-encoded cert file to terminate TLS for clients on addr with, so tunnels get plaintext (reloaded when it changes, e.g., when renewed by certbot; requires client-tls-key)",
+	)
+	proxyCmd.Flags().StringVar(
+		&clientTLSKeyFile, "client-tls-key", "",
+		"PEM-encoded key file for client-tls-cert",
+	)
+	proxyCmd.Flags().StringSliceVar(
+		&clientACMEDomains, "client-acme-domain", nil,
+		"Domains to terminate TLS for clients on addr with certs for, obtained and renewed from an ACME CA (e.g., Let's Encrypt) in place of client-tls-cert (the CA must reach addr on port 443, or acme-http-addr on port 80)",
+	)
+	proxyCmd.Flags().StringVar(
+		&acmeCacheDir, "acme-cache", "",
+		"Dir to cache the certs obtained with ACME (and the account key) in (blank means tunnelit/acme in the user's cache dir)",
+	)
+	proxyCmd.Flags().StringVar(
+		&acmeEmail, "acme-email", "",
+		"Contact email for the ACME account (e.g., for expiry notices)",
+	)
+	proxyCmd.Flags().StringVar(
+		&acmeDirectory, "acme-directory", "",
+		"Directory URL of the ACME CA (blank means Let's Encrypt's production one)",
+	)
+	proxyCmd.Flags().StringVar(
+		&acmeHTTPAddr, "acme-http-addr", "",
+		"Address to answer ACME HTTP-01 challenges on, redirecting other requests to HTTPS (blank means only TLS-ALPN-01 challenges are answered, on the services' addrs)",
+	)
+	proxyCmd.Flags().StringSliceVar(
+		&clientTLSALPN, "client-tls-alpn", nil,
+		"ALPN protocols (e.g., h2,http/1.1) offered to clients when terminating their TLS; offering h2 requires the servers to speak h2c",
+	)
+	proxyCmd.Flags().BoolVar(
+		&ocspStapling, "ocsp-stapling", true,
+		"Staple OCSP responses (fetched from the OCSP servers in the certs and refreshed in the background) to the TLS certs of the tunnel listener and clients",
+	)
+	proxyCmd.Flags().StringVar(
+		&adminAddr, "admin-addr", "",
+		"Address to listen for admin API requests on (blank means disabled; must be a loopback address unless admin tokens are configured)",
+	)
+	proxyCmd.Flags().StringSliceVar(
+		&etcdEndpoints, "etcd-endpoints", nil,
+		"etcd endpoints to load the config from and watch for changes (instead of a config file; authenticates with "+etcdUsernameEnvName+" and "+etcdPasswordEnvName+" if set)",
+	)
+	proxyCmd.Flags().StringVar(
+		&etcdPrefix, "etcd-prefix", "/tunnelit/",
+		"Prefix of the config's etcd keys (services/<name>, admin-tokens, and password)",
+	)
+	proxyCmd.Flags().StringVar(
+		&captureDir, "capture-dir", os.TempDir(),
+		"Directory to write pipe captures started through the admin API to",
+	)
+	proxyCmd.Flags().StringVar(
+		&recordDir, "record-dir", "",
+		"Directory to write the (encrypted) recordings of the services with recording enabled to, along with an index of them (blank means disabled)",
+	)
+	proxyCmd.Flags().StringVar(
+		&recordKeyFile, "record-key-file", "",
+		"File holding the hex-encoded AES-256 key recordings are encrypted with",
+	)
+	proxyCmd.Flags().StringVar(
+		&recordRetention, "record-retention", "",
+		"How long recordings are kept (e.g., 90d or 12h; blank means forever)",
+	)
+	proxyCmd.Flags().BoolVar(
+		&useTLS, "tls", false,
+		"Encrypt the conns from tunnels with TLS (requires tls-cert and tls-key)",
+	)
+	proxyCmd.Flags().StringVar(
+		&tlsCertFile, "tls-cert", "", "PEM-encoded TLS cert file for the tunnel listener (reloaded when it changes)",
+	)
+	proxyCmd.Flags().StringVar(
+		&tlsKeyFile, "tls-key", "", "PEM-encoded TLS key file for the tunnel listener",
+	)
+	proxyCmd.Flags().StringVar(
+		&vaultTLSPath, "vault-tls-path", "",
+		"Vault KV secret path to read the tunnel listener's TLS cert and key from in place of tls-cert and tls-key (refreshed every vault-refresh; see vault-path for authenticating)",
+	)
+	proxyCmd.Flags().StringVar(
+		&vaultTLSCertField, "vault-tls-cert-field", "certificate",
+		"Field of the Vault TLS secret holding the PEM-encoded cert (chain)",
+	)
+	proxyCmd.Flags().StringVar(
+		&vaultTLSKeyField, "vault-tls-key-field", "private_key",
+		"Field of the Vault TLS secret holding the PEM-encoded key",
+	)
+	proxyCmd.Flags().StringVar(
+		&tlsClientCAFile, "tls-client-ca", "",
+		"File of PEM-encoded CA certs that tunnels' TLS client certs must be signed by (blank means client certs aren't required)",
+	)
+	proxyCmd.Flags().BoolVar(
+		&tlsCertOnly, "tls-client-cert-only", false,
+		"Accept tunnels with a verified client cert without checking their password or token",
+	)
+	proxyCmd.Flags().StringVar(
+		&credentialsFile, "credentials-file", "",
+		"JSON file mapping credential names to the secrets (or hashes) tunnels can authenticate with and the services each can be used for (reloaded on SIGHUP)",
+	)
+	proxyCmd.Flags().BoolVar(
+		&requireChallenge, "require-challenge", false,
+		"Reject tunnels that send their password hash rather than answering a challenge (i.e., those using legacy-auth or predating challenges)",
+	)
+	proxyCmd.Flags().StringVar(
+		&passwordVerifierStr, "password-verifier", "",
+		"Salted verifier of the password (from hash-password) to check tunnels against rather than the password hash, so the password can't be recovered quickly or used if the verifier leaks (tunnels predating verifiers can then only use tokens and credentials)",
+	)
+	proxyCmd.Flags().StringVar(
+		&identityKeyFile, "identity-key", "",
+		"Ed25519 key file used to prove the proxy's identity to tunnels (generated if it doesn't exist; its public key is logged)",
+	)
+	proxyCmd.Flags().StringVar(
+		&stateFile, "state-file", "",
+		"File to persist proxy state (e.g., tokens) to (blank means in-memory only)",
+	)
+	proxyCmd.Flags().UintVar(
+		&readyRetries, "ready-retries", 2,
+		"Number of other idle conns to try for a client when a conn fails to become ready",
+	)
+	proxyCmd.Flags().Int64Var(
+		&maxMemory, "max-memory", 0,
+		"Estimated memory budget (in bytes) for client conns, after which new clients are left in the TCP backlog (0 means unlimited)",
+	)
+	proxyCmd.Flags().StringVar(
+		&reportInterval, "report-interval", "",
+		"Emit a usage report each period (daily or weekly, ending at midnight UTC; blank means never)",
+	)
+	proxyCmd.Flags().StringVar(
+		&reportWebhook, "report-webhook", "",
+		"URL to POST usage reports (as JSON) to",
+	)
+	proxyCmd.Flags().StringVar(
+		&reportFile, "report-file", "",
+		"File to append usage reports (as JSON lines) to",
+	)
+	proxyCmd.Flags().StringVar(
+		&probeAddr, "probe-addr", "",
+		"Address to listen for availability probes on (blank means disabled)",
+	)
+	proxyCmd.Flags().StringVar(
+		&muxAddr, "mux-addr", "",
+		"Address to listen for clients of any service on, each selecting its service with a preamble or its TLS SNI (blank means disabled)",
+	)
+	proxyCmd.Flags().String(
+		"config", "", "Config file defining services and their routes",
+	)
+	proxyCmd.Flags().StringSliceVar(
+		&allowCIDRs, "allow-cidr", nil,
+		"CIDRs clients must be in to connect (empty means any; applies to all client listeners)",
+	)
+	proxyCmd.Flags().StringSliceVar(
+		&denyCIDRs, "deny-cidr", nil,
+		"CIDRs clients are rejected from, even if in an allowed CIDR",
+	)
+	proxyCmd.Flags().StringSliceVar(
+		&tunnelAllowCIDRs, "tunnel-allow-cidr", nil,
+		"CIDRs tunnels must be in to connect (empty means any)",
+	)
+	proxyCmd.Flags().StringVar(
+		&authFailLogFile, "auth-fail-log", "",
+		"File to log auth failures and rejected IPs to, one line each in a stable format for fail2ban or CrowdSec (blank means the main log)",
+	)
+	proxyCmd.Flags().UintVar(
+		&authFailLimit, "auth-fail-limit", 10,
+		"Number of invalid passwords from an IP within auth-fail-window that bans it for auth-ban (0 means never ban)",
+	)
+	proxyCmd.Flags().DurationVar(
+		&authFailWindow, "auth-fail-window", time.Minute,
+		"Window invalid passwords are counted in",
+	)
+	proxyCmd.Flags().DurationVar(
+		&authBanDuration, "auth-ban", 15*time.Minute,
+		"How long IPs are banned from connecting as tunnels after too many invalid passwords",
+	)
+	proxyCmd.Flags().StringSliceVar(
+		&logSkipTags, "log-skip-tags", nil,
+		"Tags of connections to leave out of the log",
+	)
 	proxyCmd.MarkFlagRequired("paddr")
 
 	tunnelCmd := &cobra.Command{
@@ -85,204 +516,1629 @@ This is usually be run on the machine with the static IP. The addresses passed t
 This is usually run on the machine without a static IP. The address passed to the "saddr" is usually a local IP.`,
 		Run: RunTunnel,
 	}
+	tunnelCmd.Flags().StringSlice(
+		"paddr", nil,
+		"Address(es) of tunnelit proxies, or URLs (ws://host/path or wss://host/path) of their WebSocket endpoints, reached through HTTPS_PROXY or HTTP_PROXY if set; with several, the one with the lowest RTT is used",
+	)
+	tunnelCmd.Flags().StringVar(
+		&tunnelTransport, "transport", transportTCP,
+		"Transport to reach the proxies over: tcp, or quic for streams of a single QUIC connection to each proxy (paddr then being its tunnel-quic-addr; requires tls)",
+	)
+	tunnelCmd.Flags().IntVar(
+		&fecDataShards, "fec-data-shards", 0,
+		"Number of data shards in each group of QUIC datagrams with FEC, for lossy links (requires transport quic and fec-parity-shards; must match the proxy's; 0 means no FEC)",
+	)
+	tunnelCmd.Flags().IntVar(
+		&fecParityShards, "fec-parity-shards", 0,
+		"Number of parity shards added to each group of QUIC datagrams, and so the most lost datagrams of a group that can be rebuilt (e.g., 10 and 3 for ~2% loss)",
+	)
+	tunnelCmd.Flags().StringVar(
+		&tunnelSSH, "ssh", "",
+		"SSH destination (user@bastion, or ssh://user@bastion:port) to reach the proxies through, for when SSH is the only egress (paddr is then as reachable from the bastion)",
+	)
+	tunnelCmd.Flags().StringVar(
+		&sshKeyFile, "ssh-key", "",
+		"Unencrypted private key file to authenticate to the ssh destination with, in addition to the SSH agent's keys (blank means ~/.ssh/id_ed25519, id_ecdsa, and id_rsa)",
+	)
+	tunnelCmd.Flags().StringVar(
+		&sshKnownHosts, "ssh-known-hosts", "",
+		"known_hosts file with the ssh destination's host key (blank means ~/.ssh/known_hosts)",
+	)
+	tunnelCmd.Flags().DurationVar(
+		&selectInterval, "select-interval", 30*time.Second,
+		"How often to measure the RTTs of the proxies (with several)",
+	)
+	tunnelCmd.Flags().DurationVar(
+		&netWatchInterval, "net-watch-interval", 2*time.Second,
+		"How often to check for network changes (e.g., switching from WiFi to LTE), reconnecting to the proxy on one (0 means never)",
+	)
+	tunnelCmd.Flags().StringSlice(
+		"saddr", nil,
+		"Address(es) of server(s) to pipe to, rotated through per connection (k8s://namespace/service:port pipes to the service's ready endpoints)",
+	)
+	tunnelCmd.Flags().BoolVar(
+		&tunnelUDP, "udp", false,
+		"Relay the datagrams of the service's UDP clients (see the proxy's udp-addr) to the servers as UDP, with a socket per client",
+	)
+	tunnelCmd.Flags().StringVar(
+		&tunnelProxyProtocol, "proxy-protocol", "",
+		"PROXY protocol version (v1 or v2) of the header with the client's address sent to the server before piping (blank means none)",
+	)
+	tunnelCmd.Flags().BoolVar(
+		&tunnelEgress, "egress", false,
+		"Dial the destinations the service's clients ask for (see the proxy's http-connect and socks), making any host reachable from this machine reachable through the proxy (saddr is then optional)",
+	)
+	tunnelCmd.Flags().StringSliceVar(
+		&tunnelEgressCIDRs, "egress-cidr", nil,
+		"CIDRs the destinations clients ask for must resolve into (empty means any; requires egress)",
+	)
+	tunnelCmd.Flags().StringSliceVar(
+		&tunnelHTTPHosts, "http-host", nil,
+		"HTTP host(s) (e.g., app.example.com or *.example.com) the tunnel serves for the service (see the proxy's http)",
+	)
+	tunnelCmd.Flags().BoolVar(
+		&tunnelMux, "mux", false,
+		"Multiplex the service's clients as streams over a single conn to the proxy rather than pre-dialing an idle conn per client (min-idle is then ignored; the session is replaced, closing its streams, when switching proxies)",
+	)
+	tunnelCmd.Flags().BoolVar(
+		&tunnelLink, "link", false,
+		"Keep a link (an extra conn exchanging pool statuses every few seconds) to the proxy for the service so that both sides notice within seconds when the connection is lost and replace the idle conns right away",
+	)
+	tunnelCmd.Flags().StringVar(
+		&kubeconfigPath, "kubeconfig", "",
+		"Kubeconfig used to watch k8s:// servers (blank means $KUBECONFIG, the in-cluster config, or ~/.kube/config)",
+	)
+	tunnelCmd.Flags().String(
+		"service", "", "Name of the service to register for (blank means default)",
+	)
+	tunnelCmd.Flags().Uint(
+		"min-idle", 0,
+		"Idle conns to keep for the service in addition to the shared idle conns (the proxy's idle-conns must leave room for these)",
+	)
+	tunnelCmd.Flags().Uint(
+		"weight", 0,
+		"Weight of the tunnel for the service's weighted policy (0 means 1)",
+	)
+	tunnelCmd.Flags().String(
+		"wake-mac", "",
+		"MAC address to send a Wake-on-LAN packet to when the server can't be dialed (blank means don't)",
+	)
+	tunnelCmd.Flags().String(
+		"wake-addr", defaultWakeAddr, "Address to send Wake-on-LAN packets to",
+	)
+	tunnelCmd.Flags().Duration(
+		"wake-wait", defaultWakeWait,
+		"How long to wait for a woken server before giving up on the conn",
+	)
+	tunnelCmd.Flags().String(
+		"config", "", "Config file defining the services to serve",
+	)
+	tunnelCmd.Flags().StringVar(
+		&proxyPubKey, "proxy-pubkey", "",
+		"Pinned public key (base64) to verify the proxy's identity with (blank means unverified)",
+	)
+	tunnelCmd.Flags().StringVar(
+		&e2eKeyFile, "e2e-key", "",
+		"Ed25519 key file to encrypt clients end to end with, so the proxy only sees ciphertext (clients must connect through e2e-client; udp services aren't encrypted; generated if it doesn't exist; blank means disabled)",
+	)
+	tunnelCmd.Flags().BoolVar(
+		&legacyAuth, "legacy-auth", false,
+		"Send the password hash rather than answering the proxy's challenge (for proxies that don't support challenges; the hash can be replayed by anyone sniffing the link)",
+	)
+	tunnelCmd.Flags().BoolVar(
+		&useTLS, "tls", false,
+		"Encrypt the conns to the proxy with TLS (the proxy must have TLS enabled)",
+	)
+	tunnelCmd.Flags().StringVar(
+		&tlsCAFile, "tls-ca", "",
+		"File of PEM-encoded CA certs to verify the proxy's TLS cert with (blank means the system's)",
+	)
+	tunnelCmd.Flags().StringVar(
+		&tlsCertFile, "tls-cert", "",
+		"PEM-encoded TLS client cert file to authenticate to the proxy with (requires tls-key; reloaded when it changes)",
+	)
+	tunnelCmd.Flags().StringVar(
+		&tlsKeyFile, "tls-key", "", "PEM-encoded TLS client key file",
+	)
 	tunnelCmd.Flags().String(
-		"paddr", "",
-		"Address of tunnelit server to tunnel to",
+		"bind-addr", "",
+		"Local IP address or interface name to dial the proxy and server from",
+	)
+	tunnelCmd.Flags().StringVar(
+		&controlSocket, "control-socket", "",
+		"Path of a unix socket to serve the control API (for adding and removing services) on",
+	)
+	tunnelCmd.Flags().StringVar(
+		&tunnelName, "name", "",
+		"Friendly name for the tunnel, shown in the proxy's logs, metrics, and admin API",
+	)
+	tunnelCmd.Flags().StringToStringVar(
+		&tunnelTags, "tag", nil,
+		"Tag (key=value) for the proxy's tunnel selectors to match (may be repeated)",
+	)
+	tunnelCmd.Flags().DurationVar(
+		&tunnelTTL, "ttl", 0,
+		"How long after registering the proxy deregisters the tunnel and revokes its token (0 means never)",
+	)
+	tunnelCmd.Flags().StringVar(
+		&endpointFile, "endpoint-file", "",
+		"File to write the services' endpoints assigned by the proxy to (one per line)",
+	)
+	tunnelCmd.Flags().BoolVar(
+		&showQR, "qr", false,
+		"Print the services' endpoints assigned by the proxy as QR codes",
 	)
-	tunnelCmd.Flags().String("saddr", "", "Address of server to pipe to")
 	tunnelCmd.MarkFlagRequired("paddr")
-	tunnelCmd.MarkFlagRequired("saddr")
 
-	rootCmd.AddCommand(proxyCmd, tunnelCmd)
+	topCmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show live proxy stats from the admin API",
+		Long:  `Show live per-service connection counts, throughput, and pool health, along with the client IPs transferring the most, from a proxy's admin API, updating in place.`,
+		Run:   RunTop,
+	}
+	topCmd.Flags().String(
+		"admin-addr", "127.0.0.1:8000", "Address of the proxy's admin API",
+	)
+	topCmd.Flags().String(
+		"admin-token", os.Getenv(adminTokenEnvName),
+		"Bearer token for the proxy's admin API (defaults to "+adminTokenEnvName+")",
+	)
+	topCmd.Flags().Duration("interval", time.Second, "How often to refresh")
+	topCmd.Flags().Int(
+		"talkers", 5,
+		"Number of top client IPs (by recent bytes transferred) to show (0 means none)",
+	)
+
+	usageCmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Work with the usage recorded by a proxy",
+	}
+	usageExportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export per-service, per-day usage from a proxy's state file",
+		Long:  `Export the connection counts and bytes transferred for each service and day (UTC), as recorded in a proxy's state file.`,
+		Run:   RunUsageExport,
+	}
+	usageExportCmd.Flags().String(
+		"state-file", "", "State file of the proxy to export the usage of",
+	)
+	usageExportCmd.Flags().String("format", "csv", "Output format (csv or json)")
+	usageExportCmd.Flags().String(
+		"since", "", "Only export usage from this long ago on (e.g., 30d or 12h; blank means all)",
+	)
+	usageCmd.AddCommand(usageExportCmd)
+
+	pingCmd := &cobra.Command{
+		Use:   "ping",
+		Short: "Measure the latency to a proxy",
+		Long:  `Handshake with a proxy and measure the round-trip latency of small control frames sent to it, optionally along with the end-to-end latency through a tunnel of the service to its server.`,
+		Run:   RunPing,
+	}
+	pingCmd.Flags().String("paddr", "", "Address of tunnelit server to ping")
+	pingCmd.Flags().Bool(
+		"e2e", false,
+		"Also measure the round trip through a tunnel of the service to its server (the tunnel connects to the server for each ping, as for a client)",
+	)
+	pingCmd.Flags().String(
+		"service", "", "Name of the service to register for (blank means default)",
+	)
+	pingCmd.Flags().Uint("count", 10, "Number of pings to send")
+	pingCmd.Flags().Duration("interval", time.Second, "Time between pings")
+	pingCmd.Flags().StringVar(
+		&proxyPubKey, "proxy-pubkey", "",
+		"Pinned public key (base64) to verify the proxy's identity with (blank means unverified)",
+	)
+	pingCmd.Flags().BoolVar(
+		&legacyAuth, "legacy-auth", false,
+		"Send the password hash rather than answering the proxy's challenge (for proxies that don't support challenges; the hash can be replayed by anyone sniffing the link)",
+	)
+	pingCmd.Flags().BoolVar(
+		&useTLS, "tls", false,
+		"Encrypt the conns to the proxy with TLS (the proxy must have TLS enabled)",
+	)
+	pingCmd.Flags().StringVar(
+		&tlsCAFile, "tls-ca", "",
+		"File of PEM-encoded CA certs to verify the proxy's TLS cert with (blank means the system's)",
+	)
+	pingCmd.Flags().StringVar(
+		&tlsCertFile, "tls-cert", "",
+		"PEM-encoded TLS client cert file to authenticate to the proxy with (requires tls-key; reloaded when it changes)",
+	)
+	pingCmd.Flags().StringVar(
+		&tlsKeyFile, "tls-key", "", "PEM-encoded TLS client key file",
+	)
+	pingCmd.Flags().StringVar(
+		&tunnelTransport, "transport", transportTCP,
+		"Transport to reach the proxy over (tcp or quic; see the tunnel's transport)",
+	)
+	pingCmd.Flags().IntVar(
+		&fecDataShards, "fec-data-shards", 0,
+		"Number of data shards with FEC (see the tunnel's fec-data-shards)",
+	)
+	pingCmd.Flags().IntVar(
+		&fecParityShards, "fec-parity-shards", 0,
+		"Number of parity shards with FEC (see the tunnel's fec-parity-shards)",
+	)
+	pingCmd.MarkFlagRequired("paddr")
+
+	recordingCmd := &cobra.Command{
+		Use:   "recording",
+		Short: "Work with the session recordings written by a proxy",
+	}
+	recordingDecryptCmd := &cobra.Command{
+		Use:   "decrypt <file>",
+		Short: "Decrypt a session recording to a capture",
+		Long:  `Decrypt a session recording, writing it in the same format as the captures started through the admin API.`,
+		Args:  cobra.ExactArgs(1),
+		Run:   RunRecordingDecrypt,
+	}
+	recordingDecryptCmd.Flags().String(
+		"key-file", "", "File holding the key the recording was encrypted with",
+	)
+	recordingDecryptCmd.Flags().String(
+		"out", "", "File to write the capture to (blank means stdout)",
+	)
+	recordingDecryptCmd.MarkFlagRequired("key-file")
+	recordingCmd.AddCommand(recordingDecryptCmd)
+
+	replayCmd := &cobra.Command{
+		Use:   "replay <capture-file>",
+		Short: "Replay a captured client byte stream against a server",
+		Long:  `Replay the bytes a client sent in a capture (or decrypted recording) against a server, e.g., to re-trigger a bug against a test instance. The server's responses are discarded unless written to a file.`,
+		Args:  cobra.ExactArgs(1),
+		Run:   RunReplay,
+	}
+	replayCmd.Flags().String("to", "", "Address of the server to replay to")
+	replayCmd.Flags().Bool(
+		"pace", false,
+		"Replay with the captured timing (instead of as fast as possible)",
+	)
+	replayCmd.Flags().Float64(
+		"speed", 1, "Speed multiplier of the captured timing when pacing",
+	)
+	replayCmd.Flags().String(
+		"responses", "",
+		"File to write the server's responses to (blank means discarded)",
+	)
+	replayCmd.Flags().Duration(
+		"wait", time.Second,
+		"How long to wait for the server's responses once replayed",
+	)
+	replayCmd.Flags().String(
+		"key-file", "",
+		"File holding the key to decrypt the capture with if it's a recording",
+	)
+	replayCmd.MarkFlagRequired("to")
+
+	hashPasswordCmd := &cobra.Command{
+		Use:   "hash-password",
+		Short: "Print a salted verifier of the password for a proxy",
+		Long:  `Print a salted verifier of the password (set the same way as for the other commands) to pass to a proxy's password-verifier flag. Deriving the verifier is deliberately slow so that the password is slow to brute-force if the verifier leaks.`,
+		Run:   RunHashPassword,
+	}
+	hashPasswordCmd.Flags().Uint32(
+		"time", 3,
+		"Number of Argon2id passes (tunnels derive the key once per proxy they connect to)",
+	)
+	hashPasswordCmd.Flags().Uint32(
+		"memory", 64<<10, "Memory (in KiB) used by Argon2id",
+	)
+	hashPasswordCmd.Flags().Uint8("threads", 4, "Argon2id parallelism")
+
+	e2eClientCmd := &cobra.Command{
+		Use:   "e2e-client",
+		Short: "Encrypt local clients end to end with a tunnel",
+		Long:  `Listen for local clients, connecting each through the proxy to a tunnel with an e2e-key and encrypting what's piped so the proxy only sees ciphertext.`,
+		Run:   RunE2EClient,
+	}
+	e2eClientCmd.Flags().String(
+		"listen", "127.0.0.1:0", "Address to listen for local clients on",
+	)
+	e2eClientCmd.Flags().String(
+		"addr", "", "Address of the proxy's client listener for the service",
+	)
+	e2eClientCmd.Flags().String(
+		"tunnel-pubkey", "", "Public key (base64) of the tunnel's e2e key",
+	)
+	e2eClientCmd.MarkFlagRequired("addr")
+	e2eClientCmd.MarkFlagRequired("tunnel-pubkey")
+
+	rootCmd.AddCommand(
+		proxyCmd, tunnelCmd, topCmd, usageCmd, pingCmd, recordingCmd, replayCmd,
+		hashPasswordCmd, e2eClientCmd,
+	)
 
 	cobra.CheckErr(rootCmd.Execute())
 }
 
+func RunProxy(cmd *cobra.Command, args []string) {
+	flagAddr = must(cmd.Flags().GetString("addr"))
+	flagWSAddr = must(cmd.Flags().GetString("ws-addr"))
+	proxyAddr := must(cmd.Flags().GetString("paddr"))
+	configFile := must(cmd.Flags().GetString("config"))
+
+	if (flagAddr == "" && flagWSAddr == "" && flagUDPAddr == "" &&
+		configFile == "" && len(etcdEndpoints) == 0) || proxyAddr == "" {
+		log.Fatal(
+			`Must provide "paddr" and one of "addr", "ws-addr", "udp-addr", "config", or "etcd-endpoints"`,
+		)
+	} else if configFile != "" && len(etcdEndpoints) != 0 {
+		log.Fatal(`"config" and "etcd-endpoints" are mutually exclusive`)
+	} else if flagHTTPConnect && flagSocks || flagHTTPMode &&
+		(flagHTTPConnect || flagSocks) {
+		log.Fatal(`"http-connect", "socks", and "http" are mutually exclusive`)
+	}
+	if maxMemory < 0 {
+		log.Fatal("max-memory must not be negative")
+	}
+	if err := parseAllowedCIDRs(); err != nil {
+		log.Fatal(err)
+	}
+	if err := openAuthFailLog(); err != nil {
+		log.Fatal("Error opening auth failure log: ", err)
+	}
+
+	cfg := &Config{Services: make(map[string]*ServiceConfig)}
+	var ec *etcdClient
+	var etcdRev int64
+	var err error
+	if configFile != "" {
+		cfg, err = LoadConfig(configFile)
+	} else if len(etcdEndpoints) != 0 {
+		ec, cfg, etcdRev, err = loadEtcdConfig()
+	}
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	if addFlagService(cfg) {
+		// Fill in the defaults
+		if err := cfg.validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	services = newServices(cfg)
+	if ec != nil {
+		go ec.watchConfig(etcdRev)
+	}
+	tagRules, tagStats = cfg.Tags, newTagStats(cfg.Tags)
+	adminTokens.Store(cfg.AdminTokens)
+
+	if err := setupRecording(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupProxyTLS(); err != nil {
+		log.Fatal(err)
+	} else if err := setupACME(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if passwordVerifierStr != "" {
+		if passwordVerifier, err = parsePasswordVerifier(passwordVerifierStr); err != nil {
+			log.Fatal("Error parsing password verifier: ", err)
+		}
+	}
+	if credentialsFile != "" {
+		creds, err := loadCredentials(credentialsFile)
+		if err != nil {
+			log.Fatal("Error loading credentials: ", err)
+		}
+		credentials.Store(creds)
+		go reloadCredentialsOnHUP()
+	}
+	for name, sc := range cfg.Services {
+		if sc.Record && recordDir == "" {
+			log.Fatalf(
+				`Service %q has recording enabled but no "record-dir" was provided`,
+				name,
+			)
+		}
+	}
+	if identityKeyFile != "" {
+		var err error
+		if identityKey, err = loadIdentityKey(identityKeyFile); err != nil {
+			log.Fatal("Error loading identity key: ", err)
+		}
+		log.Print(
+			"Identity public key: ",
+			base64.StdEncoding.EncodeToString(identityKey.Public().(ed25519.PublicKey)),
+		)
+	}
+	if stateFile != "" {
+		var err error
+		if state, err = LoadState(stateFile); err != nil {
+			log.Fatal("Error loading state: ", err)
+		}
+		go state.saveUsageLoop()
+	}
+	go warmVerifierKeys()
+	if reportInterval != "" {
+		if reportInterval != "daily" && reportInterval != "weekly" {
+			log.Fatal(`report-interval must be "daily" or "weekly"`)
+		} else if reportWebhook == "" && reportFile == "" {
+			log.Fatal(`Must provide "report-webhook" or "report-file" with "report-interval"`)
+		}
+		go reportLoop()
+	}
+	go sweepTalkersLoop()
+	if adminAddr != "" {
+		go runAdmin(adminAddr)
+	}
+	if probeAddr != "" {
+		go runProbe(probeAddr)
+	}
+
+	for _, svc := range services {
+		if err := svc.start(); err != nil {
+			log.Fatalf("Error listening for %s: %v", svc.displayName(), err)
+		}
+	}
+	if muxAddr != "" {
+		ln, err := listen(muxAddr)
+		if err != nil {
+			log.Fatal("Error starting shared client listener: ", err)
+		}
+		log.Print("Listening for clients of any service on ", ln.Addr())
+		go listenMux(ln)
+	}
+	log.Print("Listening for tunnels on ", proxyAddr)
+	listenProxy(proxyAddr)
+}
+
 var (
-	idleConns chan net.Conn
+	// flagAddr and flagWSAddr are the addresses the default service's clients
+	// are listened for on (overriding the config). See also flagUDPAddr.
+	flagAddr, flagWSAddr string
 )
 
-func RunProxy(cmd *cobra.Command, args []string) {
-	addr := must(cmd.Flags().GetString("addr"))
-	proxyAddr := must(cmd.Flags().GetString("paddr"))
+// addFlagService adds the addresses from the flags to the default service,
+// adding it if needed. Returns whether it was added.
+func addFlagService(cfg *Config) bool {
+	if flagAddr == "" && flagWSAddr == "" && flagUDPAddr == "" {
+		return false
+	}
+	sc, ok := cfg.Services[""]
+	if !ok {
+		sc = &ServiceConfig{}
+		cfg.Services[""] = sc
+	}
+	if flagAddr != "" {
+		sc.Addr = flagAddr
+	}
+	if flagWSAddr != "" {
+		sc.WSAddr = flagWSAddr
+	}
+	if flagUDPAddr != "" {
+		sc.UDPAddr = flagUDPAddr
+	}
+	if clientTLSCertFile != "" || clientTLSKeyFile != "" {
+		sc.TLSCert, sc.TLSKey = clientTLSCertFile, clientTLSKeyFile
+	}
+	if len(clientACMEDomains) != 0 {
+		sc.ACMEDomains = clientACMEDomains
+	}
+	if len(clientTLSALPN) != 0 {
+		sc.ALPN = clientTLSALPN
+	}
+	if flagAcceptProxyProtocol {
+		sc.AcceptProxyProtocol = true
+	}
+	if flagHTTPConnect {
+		sc.Mode = modeConnect
+	} else if flagSocks {
+		sc.Mode = modeSocks
+	} else if flagHTTPMode {
+		sc.Mode = modeHTTP
+	}
+	if flagHTTPDomain != "" {
+		sc.HTTPDomain = flagHTTPDomain
+	}
+	return !ok
+}
 
-	if addr == "" || proxyAddr == "" {
-		log.Fatal(`Must provide "addr" and "paddr"`)
+// listenClients accepts clients of the service from the listener until it's
+// closed.
+func listenClients(svc *service, ln net.Listener) {
+	for {
+		waitForMemory()
+		conn, err := ln.Accept()
+		if isClosedErr(err) {
+			return
+		} else if err != nil {
+			log.Fatal("Error accepting: ", err)
+		}
+		// With the PROXY protocol, the client's address is only known once the
+		// header is read
+		acceptPP := svc.config().AcceptProxyProtocol
+		if !acceptPP && !clientAllowed(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			if acceptPP {
+				var err error
+				conn.SetReadDeadline(time.Now().Add(idleTimeout))
+				if conn, err = readProxyProtoHeader(conn); err != nil {
+					log.Printf(
+						"Rejecting client %s of %s: error reading PROXY protocol header: %v",
+						logAddr(conn.RemoteAddr()), svc.displayName(), err,
+					)
+					conn.Close()
+					return
+				}
+				conn.SetReadDeadline(time.Time{})
+				if !clientAllowed(conn.RemoteAddr()) {
+					conn.Close()
+					return
+				}
+			}
+			clientConn, err := svc.terminateClientTLS(conn)
+			if errors.Is(err, errACMEChallenge) {
+				return
+			} else if err != nil {
+				log.Printf(
+					"Rejecting client %s of %s: %v",
+					logAddr(conn.RemoteAddr()), svc.displayName(), err,
+				)
+				conn.Close()
+				return
+			}
+			svc.acceptClient(clientConn)
+		}()
+	}
+}
+
+// acceptClient checks whether the client may connect to the service and, if
+// so, handles it.
+func (svc *service) acceptClient(conn net.Conn) {
+	defer recoverConn("client of "+svc.displayName(), conn)
+	metrics.ClientAccepts.Inc()
+	audit("Accepted client %s of %s", conn.RemoteAddr(), svc.displayName())
+	sc := svc.config()
+	if !sc.IsOpen(time.Now()) {
+		log.Printf(
+			"Rejecting client %s of %s: outside of schedule",
+			logAddr(conn.RemoteAddr()), svc.displayName(),
+		)
+		rejectClient(conn, sc.MaintenanceResponse)
+		return
+	}
+	var hello clientHello
+	if tc, ok := conn.(*terminatedConn); ok {
+		hello = clientHello{sni: tc.ConnectionState().ServerName, ja3: tc.ja3}
 	}
-
-	idleConns = make(chan net.Conn, maxIdleConns)
-
-	log.Printf("Listening for clients on %s and tunnels on %s", addr, proxyAddr)
-	go listenProxy(proxyAddr)
-
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatal("Error listening: ", err)
+	// UDP clients are framed datagrams, not TLS, and the TLS (if any) of
+	// clients asking for destinations is to their destinations
+	_, isUDP := conn.(*framedConn)
+	if (sc.peekHello || tagsNeedSNI(svc.name)) &&
+		!isUDP && !sc.dialsDestinations() {
+		var err error
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if hello, conn, err = peekClientHello(conn); err != nil {
+			log.Printf(
+				"Rejecting client %s of %s: error reading TLS client hello: %v",
+				logAddr(conn.RemoteAddr()), svc.displayName(), err,
+			)
+			conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
 	}
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Fatal("Error accepting: ", err)
+	if hello.ja3 != "" {
+		countJA3(hello.ja3)
+		if sc.ja3Blocked[hello.ja3] {
+			log.Printf(
+				"Rejecting client %s of %s: blocked TLS fingerprint %s",
+				logAddr(conn.RemoteAddr()), svc.displayName(), hello.ja3,
+			)
+			metrics.JA3Blocks.Inc()
+			rejectClient(conn, "")
+			return
+		}
+	}
+	var dial *clientDial
+	var head httpHead
+	if sc.dialsDestinations() {
+		var err error
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if dial, conn, err = readClientDial(conn, sc.Mode); err != nil {
+			log.Printf(
+				"Rejecting client %s of %s: error reading destination: %v",
+				logAddr(conn.RemoteAddr()), svc.displayName(), err,
+			)
+			conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		audit(
+			"Client %s of %s asked for %s",
+			conn.RemoteAddr(), svc.displayName(), dial.req.Addr,
+		)
+	} else if sc.Mode == modeHTTP && !isUDP {
+		var err error
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if head, conn, err = readHTTPHead(conn); err != nil {
+			log.Printf(
+				"Rejecting client %s of %s: error reading HTTP request: %v",
+				logAddr(conn.RemoteAddr()), svc.displayName(), err,
+			)
+			rejectHTTPClient(conn, http.StatusBadRequest)
+			return
 		}
-		go handleClientConn(conn)
+		conn.SetReadDeadline(time.Time{})
+	}
+	tags := tagsFor(conn.RemoteAddr(), svc.name, hello.sni)
+	env := newClientEnv(
+		conn.RemoteAddr(), hello.sni, svc.name, tags, time.Now().In(sc.loc),
+	)
+	if sc.reject != nil && evalRule(sc.reject, env) {
+		log.Printf(
+			"Rejecting client %s of %s: matched reject rule",
+			logAddr(conn.RemoteAddr()), svc.displayName(),
+		)
+		rejectClient(conn, "")
+		return
+	}
+	routed, sel := svc.route(conn.RemoteAddr(), env)
+	filter := tunnelFilter{sel: sel, host: head.host}
+	if head.host != "" && !routed.idle.knowsTunnels(filter) {
+		log.Printf(
+			"Rejecting client %s of %s: no tunnel serves host %s",
+			logAddr(conn.RemoteAddr()), svc.displayName(), head.host,
+		)
+		rejectHTTPClient(conn, http.StatusBadGateway)
+		return
 	}
+	handleClientConn(conn, routed, filter, tags, hello.ja3, dial, head)
 }
 
 func listenProxy(proxyAddr string) {
-	ln, err := net.Listen("tcp", proxyAddr)
+	tcpLn, err := listenLink(proxyAddr)
 	if err != nil {
 		log.Fatal("Error starting proxy listener: ", err)
 	}
-	for range readyCh {
+	ln := newTunnelListener(tcpLn)
+	if tunnelWSAddr != "" {
+		if err := ln.serveWS(tunnelWSAddr); err != nil {
+			log.Fatal("Error starting WebSocket tunnel listener: ", err)
+		}
+	}
+	if tunnelQUICAddr != "" {
+		if err := ln.serveQUIC(tunnelQUICAddr); err != nil {
+			log.Fatal("Error starting QUIC tunnel listener: ", err)
+		}
+	} else if fecEnabled() {
+		log.Fatal(`FEC requires "tunnel-quic-addr"`)
+	}
+	spareCh <- utils.Unit{}
+	for {
+		// Use the spare slot if all the others are taken so pings still get
+		// through
+		spare := false
+		select {
+		case <-readyCh:
+		case <-spareCh:
+			spare = true
+		}
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Fatal("Error accepting proxy conn: ", err)
 		}
-		go handleProxyConn(conn)
+		if !tunnelAllowed(conn.RemoteAddr()) || authBanned(conn.RemoteAddr()) {
+			conn.Close()
+			// Give back the slot since the conn never handshook
+			if spare {
+				spareCh <- utils.Unit{}
+			} else {
+				readyCh <- utils.Unit{}
+			}
+			continue
+		}
+		metrics.TunnelAccepts.Inc()
+		if err := markConn(conn); err != nil {
+			log.Print("Error marking tunnel conn: ", err)
+		}
+		_, isWS := conn.(*wsConn)
+		_, isQUIC := conn.(*quicConn)
+		if tlsConfig != nil && !isWS && !isQUIC {
+			// The handshake happens on the first read, under the handshake's
+			// deadline (WebSocket conns were already upgraded over TLS, and
+			// QUIC is encrypted by its own TLS)
+			conn = tls.Server(conn, tlsConfig)
+		}
+		go handleProxyConn(conn, spare)
 	}
 }
 
 var (
-	idleTimeout = time.Second * 10
+	idleTimeout  = time.Second * 10
+	readyRetries uint
 )
 
-func handleClientConn(clientConn net.Conn) {
+// rejectClient writes the response (if any) to the client and closes it.
+func rejectClient(conn net.Conn, resp string) {
+	if resp != "" {
+		conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+		conn.Write([]byte(resp))
+	}
+	conn.Close()
+}
+
+// handleClientConn pipes the client to a tunnel conn of the service. If dial
+// isn't nil, the tunnel dials the destination the client asked for rather
+// than its servers. The head is what's known of the client's first request in
+// http mode: streaming clients (e.g., gRPC) are exempt from the stream idle
+// timeout, and HTTP/1.x clients are inspected if the service inspects. The
+// client's TLS fingerprint (if known) is logged.
+func handleClientConn(
+	clientConn net.Conn, svc *service, filter tunnelFilter, tags []string,
+	ja3 string, dial *clientDial, head httpHead,
+) {
+	memInUse.Add(clientMemEstimate)
+	defer memInUse.Add(-clientMemEstimate)
 	closeClientConn := utils.NewT(true)
 	defer deferredClose(clientConn, closeClientConn)
 
-	// Wait for idle conn
-	var proxyConn net.Conn
-	timer := time.NewTimer(idleTimeout)
-	select {
-	case <-timer.C:
+	if svc.config().Fallback != "" && !svc.idle.hasTunnels(filter) {
+		*closeClientConn = !svc.fallback(clientConn, tags, ja3, "no tunnels")
 		return
-	case proxyConn = <-idleConns:
 	}
-	if !timer.Stop() {
-		<-timer.C
+	var proxyConn pooledConn
+	for attempt := uint(0); ; attempt++ {
+		var ok bool
+		if proxyConn, ok = svc.waitIdle(attempt == 0, filter); !ok {
+			*closeClientConn = !svc.fallback(clientConn, tags, ja3, "no idle conns")
+			dial.fail()
+			return
+		}
+		if proxyConn.sess == nil {
+			// Signal that another idle conn can be accepted
+			readyCh <- utils.Unit{}
+		}
+
+		err := readyExchange(proxyConn, clientConn, dial)
+		if err == nil {
+			break
+		}
+		proxyConn.Close()
+		svc.idle.done(proxyConn)
+		if errors.Is(err, errDialFailed) {
+			log.Printf(
+				"Tunnel couldn't dial %s for client %s of %s",
+				dial.req.Addr, logAddr(clientConn.RemoteAddr()), svc.displayName(),
+			)
+			dial.fail()
+			return
+		} else if attempt >= readyRetries {
+			log.Printf(
+				"Dropping client %s of %s after %d failed ready exchanges: %v",
+				logAddr(clientConn.RemoteAddr()), svc.displayName(), attempt+1, err,
+			)
+			*closeClientConn = !svc.fallback(
+				clientConn, tags, ja3, "failed ready exchanges",
+			)
+			dial.fail()
+			return
+		}
+		metrics.ReadyRetries.Inc()
+	}
+	defer svc.idle.done(proxyConn)
+	if dial != nil {
+		if err := dial.reply(true); err != nil {
+			proxyConn.Close()
+			return
+		}
+	}
+	*closeClientConn = false
+
+	sc := svc.config()
+	streamIdle := sc.streamIdleTimeout()
+	if head.grpc {
+		streamIdle = 0
 	}
-	closeProxyConn := utils.NewT(true)
-	defer deferredClose(clientConn, closeProxyConn)
+	sent, received := pipeConns(clientConn, proxyConn.Conn, connInfo{
+		service: svc.name,
+		tunnel:  proxyConn.tunnel.label(),
+		stats:   &svc.stats,
+		tags:    tags,
+		ja3:     ja3,
+		onActive: func(active int64) {
+			state.RecordActive(svc.name, active)
+		},
+		record:      sc.Record,
+		idleTimeout: streamIdle,
+		inspect:     inspectRing(svc, sc, head),
+		inspectMax:  sc.Inspect,
+		replay:      head.replay,
+	})
+	state.RecordUsage(svc.name, sent, received)
+}
+
+// fallback pipes the client to the service's fallback (if any) since no tunnel
+// could take it, returning whether it was piped (and closed).
+func (svc *service) fallback(
+	clientConn net.Conn, tags []string, ja3, reason string,
+) bool {
+	addr := svc.config().Fallback
+	if addr == "" {
+		return false
+	}
+	conn, err := dialer.Dial(tcpNetwork, addr)
+	if err != nil {
+		log.Printf(
+			"Error dialing fallback %s for client %s of %s: %v",
+			addr, logAddr(clientConn.RemoteAddr()), svc.displayName(), err,
+		)
+		return false
+	}
+	metrics.Fallbacks.Inc()
+	log.Printf(
+		"Piping client %s of %s to fallback %s: %s",
+		logAddr(clientConn.RemoteAddr()), svc.displayName(), addr, reason,
+	)
+	sent, received := pipeConns(clientConn, conn, connInfo{
+		service: svc.name,
+		tunnel:  "(fallback)",
+		stats:   &svc.stats,
+		tags:    tags,
+		ja3:     ja3,
+		onActive: func(active int64) {
+			state.RecordActive(svc.name, active)
+		},
+		record:      svc.config().Record,
+		idleTimeout: svc.config().streamIdleTimeout(),
+	})
+	state.RecordUsage(svc.name, sent, received)
+	return true
+}
 
-	// Signal that another idle conn can be accepted
-	readyCh <- utils.Unit{}
+// waitIdle waits for an idle conn of the service from a tunnel matching the
+// filter. The pool hit/miss metrics are only recorded if count is true.
+func (svc *service) waitIdle(
+	count bool, filter tunnelFilter,
+) (pooledConn, bool) {
+	proxyConn, ok := svc.idle.TryGet(filter)
+	if ok {
+		if count {
+			metrics.PoolHits.Inc()
+		}
+		return proxyConn, true
+	}
+	if count {
+		metrics.PoolMisses.Inc()
+	}
+	svc.stats.WaitingClients.Add(1)
+	defer svc.stats.WaitingClients.Add(-1)
+	return svc.idle.Get(idleTimeout, filter)
+}
 
-	// Notify the proxy conn that it's ready and wait for ready status
-	if _, err := proxyConn.Write([]byte{connReady}); err != nil {
-		return
+// readyExchange notifies the tunnel conn that it's being used for the client
+// and waits for the tunnel to respond that it's ready, having dialed the
+// client's destination if dial isn't nil.
+func readyExchange(
+	proxyConn pooledConn, clientConn net.Conn, dial *clientDial,
+) error {
+	proxyConn.SetDeadline(time.Now().Add(idleTimeout))
+	defer proxyConn.SetDeadline(time.Time{})
+	if dial == nil {
+		if _, err := proxyConn.Write([]byte{connReady}); err != nil {
+			return err
+		}
+	} else {
+		if _, err := proxyConn.Write([]byte{connDial}); err != nil {
+			return err
+		} else if err := writeMsg(proxyConn, dial.req); err != nil {
+			return err
+		}
+	}
+	if proxyConn.clientInfo {
+		info := ClientInfo{
+			Addr:      clientConn.RemoteAddr().String(),
+			LocalAddr: clientConn.LocalAddr().String(),
+		}
+		if err := writeMsg(proxyConn, info); err != nil {
+			return err
+		}
 	}
-	// TODO: Timeout?
 	b := []byte{0}
 	if _, err := proxyConn.Read(b); err != nil {
-		return
+		return err
+	} else if dial != nil && b[0] == dialFailed {
+		return errDialFailed
 	} else if b[0] != connReady {
-		log.Printf(
-			"Received unexpected response from tunnel, expected %d, got %d",
+		return fmt.Errorf(
+			"unexpected response from tunnel, expected %d, got %d",
 			connReady, b[0],
 		)
-		return
 	}
-	*closeClientConn, *closeProxyConn = false, false
+	return nil
+}
+
+// noStatus is passed to rejectTunnelConn to close the conn without a status
+// (e.g., when the handshake itself failed).
+const noStatus byte = 0
 
-	go pipe(clientConn, proxyConn)
-	pipe(proxyConn, clientConn)
+// rejectTunnelConn counts the failed handshake, writes the status (unless it's
+// noStatus), and closes the tunnel conn, giving back its accept slot unless it
+// was the spare one (which handleProxyConn gives back).
+func rejectTunnelConn(conn net.Conn, spare bool, status byte) {
+	metrics.HandshakeFailures.Inc()
+	if status != noStatus {
+		conn.Write([]byte{status})
+	}
+	conn.Close()
+	if !spare {
+		readyCh <- utils.Unit{}
+	}
 }
 
-func handleProxyConn(conn net.Conn) {
+// handleProxyConn handles a tunnel conn, which was accepted using the spare
+// slot if spare is true (instead of one from readyCh).
+func handleProxyConn(conn net.Conn, spare bool) {
+	defer recoverConn("tunnel conn", conn)
+	defer func() {
+		if spare {
+			spareCh <- utils.Unit{}
+		}
+	}()
 	conn.SetDeadline(time.Now().Add(idleTimeout))
-	var b [sha256.Size]byte
-	if _, err := io.ReadFull(conn, b[:]); err != nil {
-		conn.Close()
+	var reg Registration
+	b, nonce, proof, regMsg, err := readCredential(conn)
+	if err != nil {
+		rejectTunnelConn(conn, spare, noStatus)
 		return
-	} else if !bytes.Equal(b[:], passwordHash[:]) {
-		conn.Write([]byte{passwordInvalid})
-		conn.Close()
+	} else if regMsg == nil && nonce != nil {
+		if regMsg, err = tunnelit.ReadMsgBytes(conn); err != nil {
+			rejectTunnelConn(conn, spare, noStatus)
+			return
+		}
+	}
+	// baseline is whether the tunnel predates registrations (having sent its
+	// password hash alone), in which case it's registered for the default
+	// service
+	baseline := regMsg == nil
+	if baseline {
+		log.Printf(
+			"Tunnel conn from %s sent no registration, so using the default service",
+			conn.RemoteAddr(),
+		)
+	} else if err := json.Unmarshal(regMsg, &reg); err != nil {
+		rejectTunnelConn(conn, spare, noStatus)
+		return
+	}
+	if reg.Version > tunnelit.ProtocolVersion {
+		log.Printf(
+			"Rejecting tunnel conn from %s: unsupported protocol version %d",
+			conn.RemoteAddr(), reg.Version,
+		)
+		rejectTunnelConn(conn, spare, badVersion)
+		return
+	}
+	tunnelID := reg.Tunnel
+	if tunnelID == "" {
+		tunnelID = conn.RemoteAddr().String()
+	}
+	// isTunnel is whether the conn is to be pooled (rather than being a ping
+	// conn or a client from a dialer)
+	isTunnel := !reg.Ping && !reg.Dial
+	// Checked before the password since expiring may revoke the tunnel's token
+	if isTunnel && tunnelHasExpired(tunnelID) {
+		rejectTunnelConn(conn, spare, tunnelExpired)
+		return
+	}
+	// certName is the name of the tunnel's verified client cert (if any)
+	certName := clientCertName(conn)
+	// certOnly is whether the tunnel is authenticated by its client cert alone
+	certOnly := false
+	var tok *Token
+	var credential *Credential
+	if nonce == nil && requireChallenge {
+		audit(
+			"Tunnel conn from %s sent its password hash rather than answering a challenge",
+			conn.RemoteAddr(),
+		)
+		logAuthFailure(conn.RemoteAddr(), "challenge-required")
+		rejectTunnelConn(conn, spare, passwordInvalid)
+		return
+	}
+	if !passwordMatches(b[:], nonce, proof) {
+		t, ok := state.TokenForAuth(b[:], nonce, proof)
+		if ok {
+			tok = &t
+		} else if credential, ok = credentialFor(b[:], nonce, proof); ok {
+			// Checked against the service below
+		} else if tlsCertOnly && certName != "" {
+			certOnly = true
+		} else {
+			audit("Tunnel conn from %s used an invalid password", conn.RemoteAddr())
+			logAuthFailure(conn.RemoteAddr(), "invalid-password")
+			recordAuthFailure(conn.RemoteAddr())
+			rejectTunnelConn(conn, spare, passwordInvalid)
+			return
+		}
+	}
+	svc, ok := getService(reg.Service)
+	if !ok {
+		rejectTunnelConn(conn, spare, serviceUnknown)
+		return
+	}
+	// Dialers are still served since they use the conns already pooled
+	if !reg.Dial && draining.Load() {
+		rejectTunnelConn(conn, spare, proxyDraining)
+		return
+	}
+	if isTunnel && svc.config().dialsDestinations() && !reg.Egress {
+		rejectTunnelConn(conn, spare, egressRequired)
+		return
+	}
+	// assigned is the subdomain assigned to the tunnel (if any)
+	assigned := ""
+	if isTunnel && svc.config().Mode == modeHTTP && len(reg.Hosts) == 0 {
+		if assigned = svc.config().assignedHost(reg.Name); assigned != "" {
+			reg.Hosts = []string{assigned}
+		}
+	}
+	if isTunnel && svc.config().Mode == modeHTTP && len(reg.Hosts) == 0 {
+		rejectTunnelConn(conn, spare, hostsRequired)
+		return
+	}
+	if !reg.Ping && credential != nil && !credential.allows(reg.Service) {
+		audit(
+			"Tunnel conn from %s using credential %q rejected from service %s",
+			conn.RemoteAddr(), credential.name, svc.displayName(),
+		)
+		rejectTunnelConn(conn, spare, serviceReserved)
+		return
+	}
+	if isTunnel && tok != nil && !svc.config().tokenAllowed(tok.Name) {
+		audit(
+			"Tunnel conn from %s using token %q rejected from reserved service %s",
+			conn.RemoteAddr(), tok.Name, svc.displayName(),
+		)
+		rejectTunnelConn(conn, spare, serviceReserved)
 		return
 	}
+	if tok != nil {
+		tc, err := acquireToken(conn, tok.Name, reg.Service, tok.Limits)
+		if err != nil {
+			log.Printf(
+				"Rejecting tunnel conn from %s using token %q: %v",
+				conn.RemoteAddr(), tok.Name, err,
+			)
+			rejectTunnelConn(conn, spare, limitExceeded)
+			return
+		}
+		conn = tc
+	}
+	if isTunnel {
+		tokName := ""
+		if tok != nil {
+			tokName = tok.Name
+		}
+		ttl := time.Duration(reg.TTL) * time.Second
+		if !registerEphemeral(tunnelID, tokName, reg.Service, ttl) {
+			rejectTunnelConn(conn, spare, tunnelExpired)
+			return
+		}
+	}
+	if spare && isTunnel {
+		// Trade the spare slot for a regular one before pooling the conn
+		conn.SetDeadline(time.Time{})
+		<-readyCh
+		spareCh <- utils.Unit{}
+		spare = false
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+	}
 	if _, err := conn.Write([]byte{passwordOk}); err != nil {
-		conn.Close()
+		rejectTunnelConn(conn, spare, noStatus)
+		return
+	}
+	if reg.Endpoints {
+		eps := svc.endpoints(conn.LocalAddr())
+		if assigned != "" {
+			eps.URL = svc.config().hostURL(assigned, eps.Addr)
+		}
+		if err := writeMsg(conn, eps); err != nil {
+			rejectTunnelConn(conn, spare, noStatus)
+			return
+		}
+	}
+	metrics.HandshakeSuccesses.Inc()
+	kind := "Tunnel conn"
+	if reg.Dial {
+		kind = "Dialer"
+	} else if reg.Link {
+		kind = "Link"
+	} else if reg.Mux {
+		kind = "Session"
+	}
+	if reg.Name != "" {
+		kind += fmt.Sprintf(" of tunnel %q", reg.Name)
+	}
+	if certName != "" {
+		kind += fmt.Sprintf(" with client cert %q", certName)
+	}
+	if certOnly {
+		audit(
+			"%s from %s registered for %s using its client cert",
+			kind, conn.RemoteAddr(), svc.displayName(),
+		)
+	} else if credential != nil {
+		audit(
+			"%s from %s registered for %s using credential %q",
+			kind, conn.RemoteAddr(), svc.displayName(), credential.name,
+		)
+	} else if tok != nil {
+		audit(
+			"%s from %s registered for %s using token %q",
+			kind, conn.RemoteAddr(), svc.displayName(), tok.Name,
+		)
+	} else {
+		audit(
+			"%s from %s registered for %s using the password",
+			kind, conn.RemoteAddr(), svc.displayName(),
+		)
+	}
+	if reg.Ping {
+		servePing(conn, svc)
+		if !spare {
+			readyCh <- utils.Unit{}
+		}
+		return
+	}
+	if reg.Dial || reg.Mux || reg.Link {
+		// Give back the slot since the conn is a client, session, or link,
+		// not an idle conn
+		if spare {
+			spareCh <- utils.Unit{}
+			spare = false
+		} else {
+			readyCh <- utils.Unit{}
+		}
+	}
+	if reg.Dial {
+		conn.SetDeadline(time.Time{})
+		svc.acceptClient(conn)
 		return
 	}
-	idleConns <- conn
+	if reg.Mux || reg.Link {
+		ready := muxReady
+		if reg.Link {
+			ready = linkReady
+		}
+		if _, err := conn.Write([]byte{ready}); err != nil {
+			conn.Close()
+			return
+		}
+	}
 	conn.SetDeadline(time.Time{})
+	info := tunnelInfo{
+		name: reg.Name, weight: int(reg.Weight), tags: reg.Tags,
+		clientInfo: reg.ClientInfo, hosts: reg.Hosts, baseline: baseline,
+	}
+	if credential != nil {
+		info.credential = credential.name
+	}
+	if info.weight <= 0 {
+		info.weight = 1
+	}
+	if reg.Link {
+		answerLink(conn, svc, tunnelID, info)
+		return
+	} else if reg.Mux {
+		serveSession(conn, svc, tunnelID, info)
+		return
+	}
+	pooled := unlessExpired(tunnelID, func() {
+		svc.resumeListeners()
+		svc.idle.Put(conn, tunnelID, info)
+	})
+	if !pooled {
+		conn.Close()
+		readyCh <- utils.Unit{}
+	}
+}
+
+// serveSession pools the tunnel's session until it ends.
+func serveSession(
+	conn net.Conn, svc *service, tunnelID string, info tunnelInfo,
+) {
+	sess, err := newTunnelSession(conn, false)
+	if err != nil {
+		log.Print("Error starting session: ", err)
+		conn.Close()
+		return
+	}
+	pooled := unlessExpired(tunnelID, func() {
+		svc.resumeListeners()
+		svc.idle.putSession(sess, tunnelID, info)
+	})
+	if !pooled {
+		sess.Close()
+		return
+	}
+	sess.wait()
+	svc.idle.removeSession(sess, tunnelID)
+	log.Printf(
+		"Session from tunnel %s of %s ended",
+		svc.idle.tunnelLabel(tunnelID), svc.displayName(),
+	)
 }
 
 var (
 	readyCh chan utils.Unit
+	// spareCh holds the proxy's spare accept slot, used once readyCh is empty.
+	spareCh = make(chan utils.Unit, 1)
+	dialer  net.Dialer
+	// tcpNetwork is the network used for listening and dialing ("tcp",
+	// "tcp4", or "tcp6").
+	tcpNetwork = "tcp"
 )
 
 func RunTunnel(cmd *cobra.Command, args []string) {
-	proxyAddr := must(cmd.Flags().GetString("paddr"))
-	srvrAddr := must(cmd.Flags().GetString("saddr"))
+	proxyAddrs := must(cmd.Flags().GetStringSlice("paddr"))
+	srvrAddrs := must(cmd.Flags().GetStringSlice("saddr"))
+	configFile := must(cmd.Flags().GetString("config"))
 
-	if proxyAddr == "" || srvrAddr == "" {
-		log.Fatal(`Must provide "paddr" and "saddr"`)
+	if len(proxyAddrs) == 0 || (len(srvrAddrs) == 0 && !tunnelEgress &&
+		configFile == "" && controlSocket == "") {
+		log.Fatal(
+			`Must provide "paddr" and one of "saddr", "egress", "config", or "control-socket"`,
+		)
 	}
-
-	log.Printf("Tunneling to %s and piping to %s", proxyAddr, srvrAddr)
-	for range readyCh {
-		conn, err := net.Dial("tcp", proxyAddr)
+	if tunnelSSH != "" {
+		for _, addr := range proxyAddrs {
+			if isWSURL(addr) {
+				log.Fatal(`"ssh" isn't supported with WebSocket paddrs`)
+			}
+		}
+	}
+	if err := setupSSH(); err != nil {
+		log.Fatal(err)
+	}
+	if proxyPubKey != "" {
+		var err error
+		if pinnedKey, err = parsePubKey(proxyPubKey); err != nil {
+			log.Fatal("Error parsing proxy public key: ", err)
+		}
+		if legacyAuth {
+			log.Fatal("legacy-auth can't be used with proxy-pubkey")
+		}
+	}
+	if err := setupTunnelTLS(); err != nil {
+		log.Fatal(err)
+	} else if err := checkTransport(proxyAddrs); err != nil {
+		log.Fatal(err)
+	}
+	if e2eKeyFile != "" {
+		var err error
+		if e2eKey, err = loadIdentityKey(e2eKeyFile); err != nil {
+			log.Fatal("Error loading e2e key: ", err)
+		}
+		log.Printf(
+			"Encrypting clients end to end (e2e-client's tunnel-pubkey is %s)",
+			e2ePubKey(),
+		)
+	}
+	if bindAddr := must(cmd.Flags().GetString("bind-addr")); bindAddr != "" {
+		ip, err := resolveBindAddr(bindAddr)
 		if err != nil {
-			log.Print("Error connecting to proxy: ", err)
-			continue
+			log.Fatal("Error resolving bind address: ", err)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		log.Print("Dialing from ", ip)
+	}
+
+	cfg := &TunnelConfig{Services: make(map[string]*TunnelServiceConfig)}
+	if configFile != "" {
+		var err error
+		if cfg, err = LoadTunnelConfig(configFile); err != nil {
+			log.Fatal("Error loading config: ", err)
+		}
+	}
+	if len(srvrAddrs) != 0 || tunnelEgress {
+		sc := &TunnelServiceConfig{
+			Saddrs:        srvrAddrs,
+			MinIdle:       must(cmd.Flags().GetUint("min-idle")),
+			Weight:        must(cmd.Flags().GetUint("weight")),
+			WakeMAC:       must(cmd.Flags().GetString("wake-mac")),
+			WakeAddr:      must(cmd.Flags().GetString("wake-addr")),
+			WakeWait:      must(cmd.Flags().GetDuration("wake-wait")).String(),
+			UDP:           tunnelUDP,
+			Egress:        tunnelEgress,
+			EgressCIDRs:   tunnelEgressCIDRs,
+			ProxyProtocol: tunnelProxyProtocol,
+			HTTPHosts:     tunnelHTTPHosts,
+			Mux:           tunnelMux,
+			Link:          tunnelLink,
+		}
+		if err := sc.parse(); err != nil {
+			log.Fatal(err)
 		}
-		go pipeProxySrvr(conn, srvrAddr)
+		cfg.Services[must(cmd.Flags().GetString("service"))] = sc
+	}
+
+	if len(cfg.Services) == 0 && controlSocket == "" {
+		log.Fatal("No services to tunnel")
+	}
+	// The service to measure the proxies' RTTs with
+	measureService := ""
+	for name, sc := range cfg.Services {
+		addTunnelService(newTunnelService(name, sc))
+		measureService = name
+	}
+	sel := newProxySelector(proxyAddrs, measureService)
+	if len(proxyAddrs) > 1 {
+		// Start on the fastest proxy
+		sel.measure()
+		log.Printf("Using proxy %s", sel.Current())
+		go sel.run()
 	}
+	for _, ts := range allTunnelServices() {
+		go ts.run(sel)
+	}
+	if controlSocket != "" {
+		go runControl(controlSocket, sel)
+	}
+	if netWatchInterval > 0 {
+		go watchNetwork(sel)
+	}
+	select {}
 }
 
-func pipeProxySrvr(proxyConn net.Conn, srvrAddr string) {
+// pipeProxySrvr handshakes with the proxy and, once the conn is used, pipes it
+// to a server. The release chan is given back its token once the conn is used.
+func pipeProxySrvr(
+	proxyConn net.Conn, proxyAddr string, ts *tunnelService,
+	release chan utils.Unit,
+) {
+	defer recoverConn("conn to proxy "+proxyAddr, proxyConn)
+	reg := ts.reg
 	closeProxyConn := utils.NewT(true)
 	defer deferredClose(proxyConn, closeProxyConn)
-	// Send password and wait for response
-	if _, err := utils.WriteAll(proxyConn, passwordHash[:]); err != nil {
-		log.Print("Error writing password to proxy: ", err)
+	status, err := proxyHandshake(proxyConn, reg)
+	if err != nil {
+		log.Print("Error handshaking with proxy: ", err)
 		return
 	}
-	b := []byte{0}
-	if _, err := proxyConn.Read(b); err != nil {
-		return
-	} else if b[0] == passwordInvalid {
+	switch status {
+	case passwordOk:
+	case passwordInvalid:
 		log.Print("Invalid password for proxy")
+		ts.fail(errors.New(tunnelit.StatusText(status)), release)
+		return
+	case serviceUnknown:
+		log.Printf("Service %q unknown to proxy", reg.Service)
+		ts.fail(errors.New(tunnelit.StatusText(status)), release)
 		return
-	} else if b[0] != passwordOk {
-		log.Print("Unexpected byte from proxy: ", b[0])
+	case limitExceeded:
+		log.Printf(
+			"Token limit reached for %s, retrying in %s",
+			ts.displayName(), limitRetryDelay,
+		)
+		time.Sleep(limitRetryDelay)
+		release <- utils.Unit{}
+		return
+	case tunnelExpired:
+		log.Fatal("Tunnel expired, exiting")
+	case serviceReserved:
+		log.Printf(
+			"Service %q is reserved for other tokens or not allowed for the credential",
+			reg.Service,
+		)
+		ts.fail(errors.New(tunnelit.StatusText(status)), release)
+		return
+	case badVersion:
+		log.Printf(
+			"Proxy %s doesn't support protocol version %d (upgrade the proxy)",
+			proxyAddr, tunnelit.ProtocolVersion,
+		)
+		ts.fail(errors.New(tunnelit.StatusText(status)), release)
+		return
+	case proxyDraining:
+		log.Printf(
+			"Proxy %s is draining, retrying %s in %s",
+			proxyAddr, ts.displayName(), limitRetryDelay,
+		)
+		time.Sleep(limitRetryDelay)
+		release <- utils.Unit{}
+		return
+	case egressRequired:
+		log.Printf(
+			"%s is in a mode where clients ask for destinations, so the tunnel needs egress",
+			ts.displayName(),
+		)
+		ts.fail(errors.New(tunnelit.StatusText(status)), release)
+		return
+	case hostsRequired:
+		log.Printf(
+			"%s is in http mode, so the tunnel needs HTTP hosts (or, if the proxy assigns subdomains, a name that's a DNS label)",
+			ts.displayName(),
+		)
+		ts.fail(errors.New(tunnelit.StatusText(status)), release)
+		return
+	default:
+		log.Printf(
+			"Unknown status %d from proxy %s (it may be newer than the tunnel)",
+			status, proxyAddr,
+		)
+		ts.fail(errors.New(tunnelit.StatusText(status)), release)
 		return
 	}
-
-	// Wait for ready
-	if _, err := proxyConn.Read(b); err != nil {
+	var eps ServiceEndpoints
+	if err := readMsg(proxyConn, &eps); err != nil {
+		log.Print("Error reading service endpoints from proxy: ", err)
 		return
-	} else if b[0] != connReady {
+	}
+	ts.reportEndpoints(proxyAddr, eps)
+	if ts.reg.Mux {
+		*closeProxyConn = false
+		ts.runSession(proxyConn, proxyAddr, release)
+		return
+	}
+	*closeProxyConn = false
+	ts.serveIdle(proxyConn, proxyAddr, release)
+}
+
+// serveIdle waits for the idle conn to the proxy to be used, answering
+// heartbeats in the meantime, and then serves it. The release chan is given
+// back its token once the conn is used (or closed unused).
+func (ts *tunnelService) serveIdle(
+	proxyConn net.Conn, proxyAddr string, release chan utils.Unit,
+) {
+	untrack := ts.trackIdle(proxyConn, proxyAddr)
+	b := []byte{0}
+	for {
+		if _, err := proxyConn.Read(b); err != nil {
+			break
+		} else if b[0] != heartbeatByte {
+			untrack()
+			ts.serveReady(proxyConn, b[0], func() { release <- utils.Unit{} })
+			return
+		}
+		if _, err := proxyConn.Write(b); err != nil {
+			break
+		}
+	}
+	untrack()
+	proxyConn.Close()
+	// The conn was never used (e.g., the proxy restarted or the conn was
+	// drained), so give back its token so it's replaced
+	time.Sleep(dialRetryDelay)
+	release <- utils.Unit{}
+}
+
+// serveReady handles the ready byte (ConnReady or ConnDial) the proxy sent on
+// the conn (or stream) for a client and pipes it to a server (or the client's
+// destination). The release func is called once the conn is used (or can't
+// be).
+func (ts *tunnelService) serveReady(
+	proxyConn net.Conn, ready byte, release func(),
+) {
+	closeProxyConn := utils.NewT(true)
+	defer deferredClose(proxyConn, closeProxyConn)
+	var dialReq *DialRequest
+	if ready == connDial && ts.reg.Egress {
+		dialReq = &DialRequest{}
+		proxyConn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if err := readMsg(proxyConn, dialReq); err != nil {
+			log.Print("Error reading dial request from proxy: ", err)
+			release()
+			return
+		}
+		proxyConn.SetReadDeadline(time.Time{})
+	} else if ready != connReady {
 		log.Printf(
 			"Received unexpected response from proxy tunnel, expected %d, got %d",
-			connReady, b[0],
+			connReady, ready,
 		)
 		return
 	}
+	var client ClientInfo
+	if ts.reg.ClientInfo {
+		proxyConn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if err := readMsg(proxyConn, &client); err != nil {
+			log.Print("Error reading client info from proxy: ", err)
+			release()
+			return
+		}
+		proxyConn.SetReadDeadline(time.Time{})
+	}
 
 	// Signal that another conn is ready to be connected
-	readyCh <- utils.Unit{}
+	release()
 
-	// Connect to server and send ready response
-	srvrConn, err := net.Dial("tcp", srvrAddr)
-	if err != nil {
-		log.Printf("Error connecting to server (%s): %v", srvrAddr, err)
+	// Connect to server (or the client's destination) and send ready response
+	var srvrConn net.Conn
+	var err error
+	if dialReq != nil {
+		srvrConn, err = ts.dialEgress(dialReq.Addr)
+		if err != nil {
+			log.Printf("Error dialing %s for client: %v", dialReq.Addr, err)
+			proxyConn.Write([]byte{dialFailed})
+			return
+		}
+	} else if srvrConn, _, err = ts.dialBackend(); err != nil {
+		log.Print("Error connecting to server: ", err)
 		return
 	}
+	if ts.proxyProtocol != "" {
+		hdr := proxyProtoHeader(ts.proxyProtocol, client)
+		srvrConn.SetWriteDeadline(time.Now().Add(idleTimeout))
+		if _, err := srvrConn.Write(hdr); err != nil {
+			log.Print("Error writing PROXY protocol header to server: ", err)
+			srvrConn.Close()
+			return
+		}
+		srvrConn.SetWriteDeadline(time.Time{})
+	}
 	if _, err := proxyConn.Write([]byte{connReady}); err != nil {
 		srvrConn.Close()
 		return
 	}
+	if ts.udp {
+		srvrConn = &framedConn{Conn: srvrConn}
+	}
+	// UDP clients send datagrams to the proxy rather than connecting through
+	// e2e-client, so their framed datagrams are piped as is
+	if e2eKey != nil && !ts.udp {
+		proxyConn.SetDeadline(time.Now().Add(idleTimeout))
+		ec, err := e2eServer(proxyConn, e2eKey)
+		if err != nil {
+			log.Print("Error handshaking end to end with client: ", err)
+			srvrConn.Close()
+			return
+		}
+		proxyConn.SetDeadline(time.Time{})
+		proxyConn = ec
+	}
 	*closeProxyConn = false
 
-	go pipe(proxyConn, srvrConn)
-	pipe(srvrConn, proxyConn)
+	pipeConns(proxyConn, srvrConn, connInfo{
+		service: ts.reg.Service, stats: &stats, idleTimeout: streamIdleTimeout,
+	})
+}
+
+// proxyHandshake sends the password and registration to the proxy and returns
+// the proxy's response. If the proxy's key is pinned, the proxy's identity is
+// verified before the password is sent (see tunnelit.Register).
+func proxyHandshake(proxyConn net.Conn, reg Registration) (byte, error) {
+	return tunnelit.Register(
+		proxyConn, passwordHash.Load(), legacyAuth, reg, pinnedKey,
+	)
+}
+
+// resolveBindAddr returns the IP for the given address, which is either an IP
+// or the name of an interface (in which case, its first address is used).
+func resolveBindAddr(addr string) (net.IP, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no addresses", addr)
 }
 
-func pipe(rconn, wconn net.Conn) {
-	io.Copy(wconn, rconn)
-	rconn.Close()
-	wconn.Close()
+// setAddressFamily restricts the networks listened and dialed on to IPv4 or
+// IPv6 (neither means both).
+func setAddressFamily(ipv4, ipv6 bool) error {
+	if ipv4 && ipv6 {
+		return fmt.Errorf("ipv4 and ipv6 are mutually exclusive")
+	} else if ipv4 {
+		tcpNetwork = "tcp4"
+	} else if ipv6 {
+		tcpNetwork = "tcp6"
+	}
+	return nil
 }
 
 func deferredClose(conn net.Conn, shouldClose *bool) {
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+	"github.com/johnietre/utils/go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestPoolSnapshotSkipsBaselineTunnels(t *testing.T) {
+	pool := newIdlePool(&tunnelit.RoundRobin{})
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	pool.Put(c1, "new", tunnelInfo{weight: 1})
+	pool.Put(c2, "baseline", tunnelInfo{weight: 1, baseline: true})
+	snap := pool.snapshot()
+	if len(snap["new"]) != 1 {
+		t.Fatal("expected the new tunnel's conn to be heartbeated")
+	} else if _, ok := snap["baseline"]; ok {
+		t.Fatal("expected the baseline tunnel's conns not to be heartbeated")
+	}
+}
+
+// scriptedConn returns a conn to a backend that writes the input and then
+// closes its side for writing, along with a channel receiving everything
+// written to the conn once it's closed.
+func scriptedConn(t *testing.T, input []byte) (net.Conn, <-chan []byte) {
+	t.Helper()
+	written := make(chan []byte, 1)
+	addr := tunnelittest.StartBackend(t, func(conn net.Conn) {
+		defer conn.Close()
+		conn.Write(input)
+		conn.(*net.TCPConn).CloseWrite()
+		b, _ := io.ReadAll(conn)
+		written <- b
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("error dialing backend: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, written
+}
+
+func TestResolveBindAddr(t *testing.T) {
+	if ip, err := resolveBindAddr("127.0.0.2"); err != nil {
+		t.Fatal("error resolving IP: ", err)
+	} else if !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("expected 127.0.0.2, got %s", ip)
+	}
+	if _, err := resolveBindAddr("no-such-iface0"); err == nil {
+		t.Fatal("expected an error for a nonexistent interface")
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		ip, err := resolveBindAddr(iface.Name)
+		if err != nil {
+			t.Fatalf("error resolving interface %s: %v", iface.Name, err)
+		} else if !ip.IsLoopback() {
+			t.Fatalf("expected a loopback address for %s, got %s", iface.Name, ip)
+		}
+		return
+	}
+	t.Log("no loopback interface to resolve")
+}
+
+// putFakeTunnelConn adds an idle conn from the tunnel to the service, which
+// answers the ready exchange with resp and then echoes.
+func putFakeTunnelConn(
+	t *testing.T, svc *service, tunnelID string, resp byte,
+) {
+	t.Helper()
+	tunnelSide, proxySide := net.Pipe()
+	t.Cleanup(func() { tunnelSide.Close() })
+	go func() {
+		b := []byte{0}
+		if _, err := io.ReadFull(tunnelSide, b); err != nil {
+			return
+		}
+		tunnelSide.Write([]byte{resp})
+		io.Copy(tunnelSide, tunnelSide)
+	}()
+	svc.idle.Put(proxySide, tunnelID, tunnelInfo{weight: 1})
+}
+
+func TestHandleClientConnRetriesReady(t *testing.T) {
+	oldReadyCh, oldRetries := readyCh, readyRetries
+	readyCh = make(chan utils.Unit, 10)
+	t.Cleanup(func() { readyCh, readyRetries = oldReadyCh, oldRetries })
+
+	tests := []struct {
+		name    string
+		retries uint
+		// tunnels are the responses of each tunnel's conn, in the order
+		// they're picked.
+		tunnels []byte
+		ok      bool
+	}{
+		{name: "first", retries: 1, tunnels: []byte{connReady}, ok: true},
+		{
+			name: "retried", retries: 1, tunnels: []byte{connReady + 1, connReady},
+			ok: true,
+		},
+		{
+			name: "out of retries", retries: 1,
+			tunnels: []byte{connReady + 1, connReady + 1, connReady},
+		},
+		{
+			name: "no retries", retries: 0,
+			tunnels: []byte{connReady + 1, connReady},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readyRetries = tt.retries
+			svc := newService("svc", &ServiceConfig{})
+			svc.idle.setPolicy(&tunnelit.RoundRobin{})
+			for i, resp := range tt.tunnels {
+				putFakeTunnelConn(t, svc, string(rune('a'+i)), resp)
+			}
+			retries := metrics.ReadyRetries.Total()
+
+			clientConn, proxySide := net.Pipe()
+			defer clientConn.Close()
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			go handleClientConn(
+				proxySide, svc, tunnelFilter{}, nil, "", nil, httpHead{},
+			)
+			go clientConn.Write([]byte("ping"))
+			var b [4]byte
+			_, err := io.ReadFull(clientConn, b[:])
+			if tt.ok && (err != nil || string(b[:]) != "ping") {
+				t.Fatalf("expected client to be piped, got %q, %v", b, err)
+			} else if !tt.ok && err == nil {
+				t.Fatal("expected client to be closed")
+			}
+			want := uint64(len(tt.tunnels) - 1)
+			if want > uint64(tt.retries) {
+				want = uint64(tt.retries)
+			}
+			if got := metrics.ReadyRetries.Total() - retries; got != want {
+				t.Fatalf("expected %d retries counted, got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestHandleClientConnFallback(t *testing.T) {
+	oldReadyCh, oldRetries, oldTimeout := readyCh, readyRetries, idleTimeout
+	readyCh, readyRetries = make(chan utils.Unit, 10), 0
+	// Clients without a fallback give up waiting for a tunnel quickly
+	idleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		readyCh, readyRetries, idleTimeout = oldReadyCh, oldRetries, oldTimeout
+	})
+	echo := tunnelittest.StartEchoBackend(t)
+
+	tests := []struct {
+		name     string
+		fallback string
+		// tunnels are the responses of each tunnel's conn.
+		tunnels []byte
+		ok      bool
+	}{
+		{name: "no tunnels", fallback: echo, ok: true},
+		{
+			name: "failed ready exchange", fallback: echo,
+			tunnels: []byte{connReady + 1}, ok: true,
+		},
+		{name: "unreachable fallback", fallback: deadAddr(t)},
+		{name: "no fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newService("svc", &ServiceConfig{Fallback: tt.fallback})
+			for i, resp := range tt.tunnels {
+				putFakeTunnelConn(t, svc, string(rune('a'+i)), resp)
+			}
+			fallbacks := metrics.Fallbacks.Total()
+
+			clientConn, proxySide := net.Pipe()
+			defer clientConn.Close()
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			go handleClientConn(
+				proxySide, svc, tunnelFilter{}, nil, "", nil, httpHead{},
+			)
+			go clientConn.Write([]byte("ping"))
+			var b [4]byte
+			_, err := io.ReadFull(clientConn, b[:])
+			if tt.ok && (err != nil || string(b[:]) != "ping") {
+				t.Fatalf("expected client to be piped, got %q, %v", b, err)
+			} else if !tt.ok && err == nil {
+				t.Fatal("expected client to be closed")
+			}
+			want := uint64(0)
+			if tt.ok {
+				want = 1
+			}
+			if got := metrics.Fallbacks.Total() - fallbacks; got != want {
+				t.Fatalf("expected %d fallbacks counted, got %d", want, got)
+			}
+		})
+	}
+
+	cfg := &Config{Services: map[string]*ServiceConfig{
+		"svc": {Addr: "127.0.0.1:0", Fallback: "no-port"},
+	}}
+	if err := cfg.validate(); err == nil {
+		t.Fatal("expected an error for a fallback without a port")
+	}
+}
+
+func TestSetAddressFamily(t *testing.T) {
+	oldNetwork := tcpNetwork
+	t.Cleanup(func() { tcpNetwork = oldNetwork })
+	tests := []struct {
+		ipv4, ipv6 bool
+		tcp, udp   string
+	}{
+		{tcp: "tcp", udp: "udp"},
+		{ipv4: true, tcp: "tcp4", udp: "udp4"},
+		{ipv6: true, tcp: "tcp6", udp: "udp6"},
+	}
+	for _, tt := range tests {
+		tcpNetwork = "tcp"
+		if err := setAddressFamily(tt.ipv4, tt.ipv6); err != nil {
+			t.Fatal("error setting address family: ", err)
+		} else if tcpNetwork != tt.tcp || udpNetwork() != tt.udp {
+			t.Fatalf(
+				"expected %s and %s, got %s and %s",
+				tt.tcp, tt.udp, tcpNetwork, udpNetwork(),
+			)
+		}
+	}
+	if err := setAddressFamily(true, true); err == nil {
+		t.Fatal("expected an error for both ipv4 and ipv6")
+	}
+
+	// Backends of the other family can't be dialed
+	tcpNetwork = "tcp6"
+	bp := newBackendPool([]string{tunnelittest.StartEchoBackend(t)}, nil)
+	if conn, _, err := bp.Dial(); err == nil {
+		conn.Close()
+		t.Fatal("expected an error dialing an IPv4 backend over tcp6")
+	}
+}
+
+// dualStackResolver returns a resolver answering every lookup with both the
+// IPv6 and IPv4 loopback addresses.
+func dualStackResolver() *net.Resolver {
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		var n [2]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		hdr, err := p.Start(buf)
+		if err != nil {
+			return
+		}
+		q, err := p.Question()
+		if err != nil {
+			return
+		}
+		b := dnsmessage.NewBuilder(make([]byte, 2, 512), dnsmessage.Header{
+			ID: hdr.ID, Response: true, Authoritative: true,
+		})
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 60}
+		switch q.Type {
+		case dnsmessage.TypeA:
+			b.AResource(rh, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+		case dnsmessage.TypeAAAA:
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}})
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+		conn.Write(msg)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			// A net.Pipe isn't a PacketConn, so queries are length-prefixed
+			conn, srvr := net.Pipe()
+			go serve(srvr)
+			return conn, nil
+		},
+	}
+}
+
+func TestDialerFallback(t *testing.T) {
+	oldDialer := dialer
+	t.Cleanup(func() { dialer = oldDialer })
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// Nothing listens on the IPv6 address, so only racing (or falling back to)
+	// IPv4 reaches the listener
+	for _, delay := range []time.Duration{250 * time.Millisecond, -1} {
+		dialer = net.Dialer{
+			Resolver: dualStackResolver(), FallbackDelay: delay,
+			Timeout: 5 * time.Second,
+		}
+		conn, err := dialer.Dial("tcp", net.JoinHostPort("dual.test", port))
+		if err != nil {
+			t.Fatalf("%s: error dialing dual-stack address: %v", delay, err)
+		}
+		addr := conn.RemoteAddr().(*net.TCPAddr)
+		conn.Close()
+		if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("%s: expected the IPv4 address, got %s", delay, addr)
+		}
+	}
+}
+
+// registerTunnel registers a tunnel conn with the proxy's handleProxyConn
+// using the password hash, returning the proxy's status and the tunnel's side
+// of the conn (closed at the end of the test).
+func registerTunnel(
+	t *testing.T, pwdHash [sha256.Size]byte, reg Registration,
+) (byte, net.Conn) {
+	t.Helper()
+	tunnelSide, proxySide := net.Pipe()
+	t.Cleanup(func() { tunnelSide.Close() })
+	tunnelSide.SetDeadline(time.Now().Add(5 * time.Second))
+	go handleProxyConn(proxySide, false)
+	status, err := tunnelit.Register(tunnelSide, pwdHash, false, reg, nil)
+	if err != nil {
+		t.Fatal("error registering: ", err)
+	}
+	return status, tunnelSide
+}
+
+func TestHandleProxyConnStatuses(t *testing.T) {
+	setTestPassword(t)
+	pwdHash := sha256.Sum256([]byte(tunnelittest.DefaultPassword))
+	svc := newService("web", &ServiceConfig{})
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+
+	// A newer tunnel's registration (sent with the legacy password hash)
+	tunnelSide, proxySide := net.Pipe()
+	defer tunnelSide.Close()
+	tunnelSide.SetDeadline(time.Now().Add(5 * time.Second))
+	go handleProxyConn(proxySide, false)
+	go func() {
+		tunnelSide.Write([]byte(tunnelit.HashRequest))
+		tunnelSide.Write(pwdHash[:])
+		tunnelit.WriteMsg(tunnelSide, Registration{
+			Service: "web", Version: tunnelit.ProtocolVersion + 1,
+		})
+	}()
+	b := []byte{0}
+	if _, err := io.ReadFull(tunnelSide, b); err != nil || b[0] != badVersion {
+		t.Fatalf("expected a bad version status, got %d, %v", b[0], err)
+	}
+
+	// Draining refuses tunnel conns, but not dialers
+	drain := func(method string) {
+		w := httptest.NewRecorder()
+		handleDrain(w, httptest.NewRequest(method, "/drain", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %s to succeed, got %d", method, w.Code)
+		}
+	}
+	drain(http.MethodPost)
+	t.Cleanup(func() { draining.Store(false) })
+	tests := []struct {
+		reg  Registration
+		want byte
+	}{
+		{reg: Registration{Service: "web"}, want: proxyDraining},
+		{reg: Registration{Service: "web", Ping: true}, want: proxyDraining},
+		{reg: Registration{Service: "web", Dial: true}, want: passwordOk},
+		{reg: Registration{Service: "unknown"}, want: serviceUnknown},
+	}
+	for _, tt := range tests {
+		if status, _ := registerTunnel(t, pwdHash, tt.reg); status != tt.want {
+			t.Fatalf(
+				"%+v: expected %s, got %s", tt.reg,
+				tunnelit.StatusText(tt.want), tunnelit.StatusText(status),
+			)
+		}
+	}
+	drain(http.MethodDelete)
+	status, _ := registerTunnel(t, pwdHash, tests[0].reg)
+	if status != passwordOk {
+		t.Fatalf("expected ok after draining, got %s", tunnelit.StatusText(status))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// clientMemEstimate is the estimated memory used by each client conn that
+	// has been accepted (e.g., while it waits for an idle conn).
+	clientMemEstimate = 16 * 1024
+	// pipeMemEstimate is the estimated memory used by each piped connection,
+	// mostly the copy buffers for each direction.
+	pipeMemEstimate = 2*32*1024 + 16*1024
+)
+
+var (
+	// maxMemory is the memory budget (in bytes) for client conns. Once it's
+	// reached, new clients aren't accepted (so they queue in the TCP backlog).
+	// 0 means unlimited.
+	maxMemory int64
+	// memInUse is the estimated memory used by client conns and pipes.
+	memInUse atomic.Int64
+)
+
+// waitForMemory blocks until there's room in the memory budget for another
+// client.
+func waitForMemory() {
+	if maxMemory <= 0 || memInUse.Load()+clientMemEstimate <= maxMemory {
+		return
+	}
+	log.Printf(
+		"Memory budget reached (%d/%d bytes), pausing accepts",
+		memInUse.Load(), maxMemory,
+	)
+	metrics.MemoryPauses.Inc()
+	for memInUse.Load()+clientMemEstimate > maxMemory {
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Print("Memory back under budget, resuming accepts")
+}
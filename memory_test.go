@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+// setMemory sets the memory budget and usage for the test.
+func setMemory(t *testing.T, max, inUse int64) {
+	t.Helper()
+	oldMax, oldInUse := maxMemory, memInUse.Load()
+	maxMemory = max
+	memInUse.Store(inUse)
+	t.Cleanup(func() {
+		maxMemory = oldMax
+		memInUse.Store(oldInUse)
+	})
+}
+
+func TestWaitForMemory(t *testing.T) {
+	// Unlimited never waits
+	setMemory(t, 0, 1<<40)
+	waitForMemory()
+
+	setMemory(t, 2*clientMemEstimate, 2*clientMemEstimate)
+	pauses := metrics.MemoryPauses.Total()
+	done := make(chan utils.Unit)
+	go func() {
+		waitForMemory()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected accepting to pause while over budget")
+	case <-time.After(100 * time.Millisecond):
+	}
+	memInUse.Add(-clientMemEstimate)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected accepting to resume once under budget")
+	}
+	if metrics.MemoryPauses.Total() != pauses+1 {
+		t.Fatal("expected the pause to be counted")
+	}
+}
+
+func TestPipeCountsMemory(t *testing.T) {
+	setMemory(t, 0, 0)
+	client, backend, done := startPipe(t, connInfo{service: "svc"})
+	client.Write([]byte("x"))
+	var b [1]byte
+	io.ReadFull(backend, b[:])
+	if got := memInUse.Load(); got != pipeMemEstimate {
+		t.Fatalf(
+			"expected %d bytes in use while piping, got %d", pipeMemEstimate, got,
+		)
+	}
+	client.Close()
+	waitPipe(t, done)
+	if got := memInUse.Load(); got != 0 {
+		t.Fatalf("expected no bytes in use once closed, got %d", got)
+	}
+}
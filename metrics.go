@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// windowSecs is the longest window (in seconds) that rates are tracked over.
+const windowSecs = 15 * 60
+
+// rateWindows are the windows that rates are reported over.
+var rateWindows = []struct {
+	name string
+	dur  time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+// windowCounter counts events, keeping per-second buckets so that rates can be
+// calculated over sliding windows.
+type windowCounter struct {
+	mtx     sync.Mutex
+	total   uint64
+	buckets [windowSecs]uint64
+	lastSec int64
+}
+
+// Inc records an event.
+func (wc *windowCounter) Inc() {
+	wc.mtx.Lock()
+	defer wc.mtx.Unlock()
+	sec := wc.advance()
+	wc.buckets[sec%windowSecs]++
+	wc.total++
+}
+
+// Total returns the total number of events ever recorded.
+func (wc *windowCounter) Total() uint64 {
+	wc.mtx.Lock()
+	defer wc.mtx.Unlock()
+	return wc.total
+}
+
+// Count returns the number of events in the last dur (which is capped at
+// windowSecs).
+func (wc *windowCounter) Count(dur time.Duration) uint64 {
+	wc.mtx.Lock()
+	defer wc.mtx.Unlock()
+	sec := wc.advance()
+	secs := int64(dur / time.Second)
+	if secs > windowSecs {
+		secs = windowSecs
+	}
+	var count uint64
+	for i := int64(0); i < secs; i++ {
+		count += wc.buckets[(sec-i)%windowSecs]
+	}
+	return count
+}
+
+// Rate returns the events per second over the last dur.
+func (wc *windowCounter) Rate(dur time.Duration) float64 {
+	return float64(wc.Count(dur)) / dur.Seconds()
+}
+
+// advance clears the buckets that have expired since the last event and
+// returns the current second. The mutex must be held.
+func (wc *windowCounter) advance() int64 {
+	sec := time.Now().Unix()
+	if sec <= wc.lastSec {
+		return wc.lastSec
+	}
+	for s, n := wc.lastSec+1, 0; s <= sec && n < windowSecs; s, n = s+1, n+1 {
+		wc.buckets[s%windowSecs] = 0
+	}
+	wc.lastSec = sec
+	return sec
+}
+
+// Metrics holds the counters used for capacity planning.
+type Metrics struct {
+	ClientAccepts      windowCounter
+	TunnelAccepts      windowCounter
+	HandshakeSuccesses windowCounter
+	HandshakeFailures  windowCounter
+	PoolHits           windowCounter
+	PoolMisses         windowCounter
+	MemoryPauses       windowCounter
+	ReadyRetries       windowCounter
+	Fallbacks          windowCounter
+	Panics             windowCounter
+	LogDrops           windowCounter
+	JA3Blocks          windowCounter
+}
+
+var metrics Metrics
+
+func (m *Metrics) counters() []struct {
+	name, help string
+	wc         *windowCounter
+} {
+	return []struct {
+		name, help string
+		wc         *windowCounter
+	}{
+		{"client_accepts", "Client connections accepted", &m.ClientAccepts},
+		{"tunnel_accepts", "Tunnel connections accepted", &m.TunnelAccepts},
+		{
+			"handshake_successes", "Tunnel handshakes that succeeded",
+			&m.HandshakeSuccesses,
+		},
+		{
+			"handshake_failures", "Tunnel handshakes that failed",
+			&m.HandshakeFailures,
+		},
+		{
+			"pool_hits", "Clients that were immediately paired with an idle conn",
+			&m.PoolHits,
+		},
+		{
+			"pool_misses", "Clients that had to wait for an idle conn",
+			&m.PoolMisses,
+		},
+		{
+			"memory_pauses", "Times accepting was paused by the memory budget",
+			&m.MemoryPauses,
+		},
+		{
+			"ready_retries", "Clients retried with another idle conn",
+			&m.ReadyRetries,
+		},
+		{
+			"fallbacks", "Clients piped to their service's fallback",
+			&m.Fallbacks,
+		},
+		{
+			"panics", "Connection handlers that panicked (and were recovered)",
+			&m.Panics,
+		},
+		{
+			"log_drops", "Log lines dropped because the log output was too slow",
+			&m.LogDrops,
+		},
+		{
+			"ja3_blocks", "Clients rejected for their blocked TLS fingerprint",
+			&m.JA3Blocks,
+		},
+	}
+}
+
+// Rates returns the windowed rates (per second) for each counter, along with
+// the pool hit ratio for each window.
+func (m *Metrics) Rates() map[string]map[string]float64 {
+	rates := make(map[string]map[string]float64)
+	for _, c := range m.counters() {
+		r := make(map[string]float64)
+		for _, w := range rateWindows {
+			r[w.name] = c.wc.Rate(w.dur)
+		}
+		rates[c.name] = r
+	}
+	ratio := make(map[string]float64)
+	for _, w := range rateWindows {
+		ratio[w.name] = hitRatio(
+			m.PoolHits.Count(w.dur), m.PoolMisses.Count(w.dur),
+		)
+	}
+	rates["pool_hit_ratio"] = ratio
+	return rates
+}
+
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// WritePrometheus writes the metrics (and current stats) in the Prometheus
+// text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	for _, c := range m.counters() {
+		name := "tunnelit_" + c.name
+		fmt.Fprintf(w, "# HELP %s_total %s.\n", name, c.help)
+		fmt.Fprintf(w, "# TYPE %s_total counter\n", name)
+		fmt.Fprintf(w, "%s_total %d\n", name, c.wc.Total())
+		fmt.Fprintf(w, "# HELP %s_rate %s per second.\n", name, c.help)
+		fmt.Fprintf(w, "# TYPE %s_rate gauge\n", name)
+		for _, win := range rateWindows {
+			fmt.Fprintf(
+				w, "%s_rate{window=%q} %g\n", name, win.name, c.wc.Rate(win.dur),
+			)
+		}
+	}
+	fmt.Fprint(w, "# HELP tunnelit_pool_hit_ratio Ratio of clients paired immediately.\n")
+	fmt.Fprint(w, "# TYPE tunnelit_pool_hit_ratio gauge\n")
+	for _, win := range rateWindows {
+		fmt.Fprintf(
+			w, "tunnelit_pool_hit_ratio{window=%q} %g\n", win.name,
+			hitRatio(m.PoolHits.Count(win.dur), m.PoolMisses.Count(win.dur)),
+		)
+	}
+
+	gauges := []struct {
+		name, help, typ string
+		val             func(ServiceStats) float64
+	}{
+		{
+			"active_conns", "Active piped connections", "gauge",
+			func(s ServiceStats) float64 { return float64(s.ActiveConns) },
+		},
+		{
+			"waiting_clients", "Clients waiting for an idle conn", "gauge",
+			func(s ServiceStats) float64 { return float64(s.WaitingClients) },
+		},
+		{
+			"idle_conns", "Idle tunnel conns", "gauge",
+			func(s ServiceStats) float64 { return float64(s.IdleConns) },
+		},
+		{
+			"bytes_up_total", "Bytes sent from clients to servers", "counter",
+			func(s ServiceStats) float64 { return float64(s.BytesUp) },
+		},
+		{
+			"bytes_down_total", "Bytes sent from servers to clients", "counter",
+			func(s ServiceStats) float64 { return float64(s.BytesDown) },
+		},
+	}
+	writeJA3Prometheus(w)
+	fmt.Fprint(w, "# HELP tunnelit_memory_estimate_bytes Estimated memory used by client conns.\n")
+	fmt.Fprint(w, "# TYPE tunnelit_memory_estimate_bytes gauge\n")
+	fmt.Fprintf(w, "tunnelit_memory_estimate_bytes %d\n", memInUse.Load())
+
+	all := serviceStats()
+	for _, g := range gauges {
+		name := "tunnelit_" + g.name
+		fmt.Fprintf(w, "# HELP %s %s.\n", name, g.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, g.typ)
+		for svc, st := range all {
+			fmt.Fprintf(w, "%s{service=%q} %g\n", name, svc, g.val(st))
+		}
+	}
+
+	tunnelGauges := []struct {
+		name, help string
+		val        func(TunnelStats) float64
+	}{
+		{
+			"tunnel_idle_conns", "Idle conns from the tunnel",
+			func(s TunnelStats) float64 { return float64(s.IdleConns) },
+		},
+		{
+			"tunnel_active_conns", "Piped connections through the tunnel",
+			func(s TunnelStats) float64 { return float64(s.ActiveConns) },
+		},
+	}
+	for _, g := range tunnelGauges {
+		name := "tunnelit_" + g.name
+		fmt.Fprintf(w, "# HELP %s %s.\n", name, g.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for svc, st := range all {
+			for id, ts := range st.Tunnels {
+				fmt.Fprintf(
+					w, "%s{service=%q,tunnel=%q,name=%q} %g\n",
+					name, svc, id, ts.Name, g.val(ts),
+				)
+			}
+		}
+	}
+
+	tagGauges := []struct {
+		name, help, typ string
+		val             func(TagStats) float64
+	}{
+		{
+			"tag_conns_total", "Connections piped with the tag", "counter",
+			func(s TagStats) float64 { return float64(s.Conns) },
+		},
+		{
+			"tag_active_conns", "Active piped connections with the tag", "gauge",
+			func(s TagStats) float64 { return float64(s.ActiveConns) },
+		},
+		{
+			"tag_bytes_up_total",
+			"Bytes sent from clients with the tag (once done)", "counter",
+			func(s TagStats) float64 { return float64(s.BytesUp) },
+		},
+		{
+			"tag_bytes_down_total",
+			"Bytes sent to clients with the tag (once done)", "counter",
+			func(s TagStats) float64 { return float64(s.BytesDown) },
+		},
+	}
+	allTags := allTagStats()
+	if len(allTags) == 0 {
+		return
+	}
+	for _, g := range tagGauges {
+		name := "tunnelit_" + g.name
+		fmt.Fprintf(w, "# HELP %s %s.\n", name, g.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, g.typ)
+		for tag, st := range allTags {
+			fmt.Fprintf(w, "%s{tag=%q} %g\n", name, tag, g.val(st))
+		}
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WritePrometheus(w)
+}
+
+// handleRates serves the windowed rates as JSON.
+func handleRates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, metrics.Rates())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindowCounter(t *testing.T) {
+	var wc windowCounter
+	for i := 0; i < 3; i++ {
+		wc.Inc()
+	}
+	if wc.Total() != 3 || wc.Count(time.Minute) != 3 {
+		t.Fatalf(
+			"expected a total and count of 3, got %d and %d",
+			wc.Total(), wc.Count(time.Minute),
+		)
+	} else if rate := wc.Rate(time.Minute); rate != 3.0/60 {
+		t.Fatalf("expected a rate of %v, got %v", 3.0/60, rate)
+	}
+}
+
+func TestWindowCounterExpiry(t *testing.T) {
+	tests := []struct {
+		name              string
+		ago               int64
+		count1m, count15m uint64
+	}{
+		{name: "in 1m", ago: 30, count1m: 5, count15m: 5},
+		{name: "in 15m", ago: 120, count1m: 0, count15m: 5},
+		{name: "expired", ago: windowSecs + 10, count1m: 0, count15m: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wc windowCounter
+			sec := time.Now().Unix() - tt.ago
+			wc.lastSec, wc.total = sec, 5
+			wc.buckets[sec%windowSecs] = 5
+			if got := wc.Count(time.Minute); got != tt.count1m {
+				t.Fatalf("expected %d in the last minute, got %d", tt.count1m, got)
+			}
+			if got := wc.Count(15 * time.Minute); got != tt.count15m {
+				t.Fatalf("expected %d in the last 15m, got %d", tt.count15m, got)
+			}
+			if wc.Total() != 5 {
+				t.Fatalf("expected the total to be kept, got %d", wc.Total())
+			}
+		})
+	}
+}
+
+func TestHitRatio(t *testing.T) {
+	if r := hitRatio(0, 0); r != 0 {
+		t.Fatalf("expected 0 with no clients, got %v", r)
+	}
+	if r := hitRatio(3, 1); r != 0.75 {
+		t.Fatalf("expected 0.75, got %v", r)
+	}
+}
+
+func TestMetricsRates(t *testing.T) {
+	var m Metrics
+	m.PoolHits.Inc()
+	m.PoolMisses.Inc()
+	m.ClientAccepts.Inc()
+	rates := m.Rates()
+	if r := rates["pool_hit_ratio"]["1m"]; r != 0.5 {
+		t.Fatalf("expected a 1m pool hit ratio of 0.5, got %v", r)
+	}
+	if r := rates["client_accepts"]["5m"]; r != 1.0/300 {
+		t.Fatalf("expected a 5m accept rate of %v, got %v", 1.0/300, r)
+	}
+	if _, ok := rates["tunnel_accepts"]; !ok {
+		t.Fatal("expected rates for every counter")
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var m Metrics
+	m.ClientAccepts.Inc()
+	m.ClientAccepts.Inc()
+	m.PoolHits.Inc()
+	var sb strings.Builder
+	m.WritePrometheus(&sb)
+	out := sb.String()
+	for _, want := range []string{
+		"# TYPE tunnelit_client_accepts_total counter\n",
+		"tunnelit_client_accepts_total 2\n",
+		"tunnelit_tunnel_accepts_total 0\n",
+		`tunnelit_client_accepts_rate{window="1m"} 0.0333`,
+		`tunnelit_pool_hit_ratio{window="15m"} 1` + "\n",
+		"# TYPE tunnelit_memory_estimate_bytes gauge\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// muxAddr is the address of the shared listener for clients of any service
+// (blank means none).
+var muxAddr string
+
+// tlsRecordHandshake is the first byte of a TLS client hello.
+const tlsRecordHandshake = 0x16
+
+// errHelloRead aborts the TLS handshake once the client hello is read.
+var errHelloRead = errors.New("client hello read")
+
+// listenMux accepts clients of any service on the shared listener until it's
+// closed. Each client selects its service with a preamble (see
+// tunnelit.WritePreamble) or the SNI of its TLS client hello, which is passed
+// through to the tunnel untouched.
+func listenMux(ln net.Listener) {
+	for {
+		waitForMemory()
+		conn, err := ln.Accept()
+		if isClosedErr(err) {
+			return
+		} else if err != nil {
+			log.Fatal("Error accepting: ", err)
+		}
+		if !clientAllowed(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go acceptMuxClient(conn)
+	}
+}
+
+// acceptMuxClient reads which service the client is for and hands it off to
+// the service.
+func acceptMuxClient(conn net.Conn) {
+	defer recoverConn("shared client", conn)
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	name, conn, err := readServiceSelection(conn)
+	if err != nil {
+		log.Printf(
+			"Rejecting shared client %s: error reading service: %v",
+			logAddr(conn.RemoteAddr()), err,
+		)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	svc, ok := getService(name)
+	if !ok {
+		log.Printf(
+			"Rejecting shared client %s: unknown service %q",
+			logAddr(conn.RemoteAddr()), name,
+		)
+		conn.Close()
+		return
+	}
+	svc.acceptClient(conn)
+}
+
+// readServiceSelection reads the name of the service the client selected,
+// returning the conn to pipe, which replays the client hello for TLS clients.
+func readServiceSelection(conn net.Conn) (string, net.Conn, error) {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return "", conn, err
+	}
+	if b[0] != tlsRecordHandshake {
+		name := make([]byte, b[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", conn, err
+		}
+		return string(name), conn, nil
+	}
+	// Service names don't start with a TLS major version, so this is a TLS
+	// record rather than a 22-byte name
+	if _, err := io.ReadFull(conn, b[1:]); err != nil {
+		return "", conn, err
+	} else if b[1] != 3 {
+		name := make([]byte, b[0])
+		copy(name, b[1:])
+		if _, err := io.ReadFull(conn, name[2:]); err != nil {
+			return "", conn, err
+		}
+		return string(name), conn, nil
+	}
+	hello, conn, err := readClientHello(conn, b)
+	return sniService(hello.sni), conn, err
+}
+
+// peekClientHello returns what's known of the client's TLS client hello
+// (nothing if the client isn't using TLS) and the conn to pipe, which replays
+// what was read.
+func peekClientHello(conn net.Conn) (clientHello, net.Conn, error) {
+	if tc, ok := conn.(*terminatedConn); ok {
+		return clientHello{
+			sni: tc.ConnectionState().ServerName, ja3: tc.ja3,
+		}, conn, nil
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return clientHello{}, conn, err
+	} else if b[0] != tlsRecordHandshake {
+		return clientHello{}, &replayConn{
+			Conn: conn, r: io.MultiReader(bytes.NewReader(b), conn),
+		}, nil
+	}
+	return readClientHello(conn, b)
+}
+
+// readClientHello reads the client hello whose first bytes were already read,
+// returning what's known of it and the conn to pipe, which replays the client
+// hello.
+func readClientHello(conn net.Conn, read []byte) (clientHello, net.Conn, error) {
+	hc := &helloConn{Conn: conn}
+	hc.buf.Write(read)
+	hc.r = io.MultiReader(bytes.NewReader(read), io.TeeReader(conn, &hc.buf))
+	var hello clientHello
+	err := tls.Server(hc, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello.sni = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return clientHello{}, conn, err
+	}
+	hello.ja3 = helloJA3(hc.buf.Bytes())
+	return hello, &replayConn{
+		Conn: conn, r: io.MultiReader(&hc.buf, conn),
+	}, nil
+}
+
+// sniService returns the service named by the SNI: the service with the
+// hostname as its name, or else the hostname's first label (e.g., "db" for
+// "db.example.com"). No SNI selects the default service.
+func sniService(sni string) string {
+	if _, ok := getService(sni); ok || sni == "" {
+		return sni
+	}
+	label, _, _ := strings.Cut(sni, ".")
+	return label
+}
+
+// helloConn records what's read from the conn while the client hello is
+// parsed, discarding what the TLS server writes.
+type helloConn struct {
+	net.Conn
+	r   io.Reader
+	buf bytes.Buffer
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *helloConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// replayConn is a conn whose reads start with bytes already read from it.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn returns the underlying conn.
+func (c *replayConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+)
+
+func TestReadServiceSelection(t *testing.T) {
+	oldServices := services
+	services = map[string]*service{
+		"web.example.com": newService("web.example.com", &ServiceConfig{}),
+	}
+	t.Cleanup(func() { services = oldServices })
+
+	// A 22-byte name has the same length byte as a TLS record
+	long := strings.Repeat("x", tlsRecordHandshake)
+	for _, name := range []string{"web", "", long} {
+		conn, peer := pipeConn(t)
+		go func() {
+			tunnelit.WritePreamble(peer, name)
+			peer.Write([]byte("ping"))
+		}()
+		got, conn, err := readServiceSelection(conn)
+		if err != nil {
+			t.Fatalf("%q: error reading selection: %v", name, err)
+		} else if got != name {
+			t.Fatalf("expected %q selected, got %q", name, got)
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Fatalf("%q: expected the bytes after the preamble, got %q", name, b)
+		}
+	}
+
+	tests := []struct{ sni, want string }{
+		{sni: "web.example.com", want: "web.example.com"},
+		{sni: "db.example.com", want: "db"},
+	}
+	for _, tt := range tests {
+		conn, peer := pipeConn(t)
+		go tls.Client(peer, &tls.Config{
+			ServerName: tt.sni, InsecureSkipVerify: true,
+		}).Handshake()
+		got, conn, err := readServiceSelection(conn)
+		if err != nil {
+			t.Fatalf("%s: error reading selection: %v", tt.sni, err)
+		} else if got != tt.want {
+			t.Fatalf("%s: expected %q selected, got %q", tt.sni, tt.want, got)
+		}
+		// The client hello is replayed to the tunnel
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil ||
+			b[0] != tlsRecordHandshake {
+			t.Fatalf("%s: expected the client hello replayed, got %v", tt.sni, b)
+		}
+	}
+}
+
+func TestListenMux(t *testing.T) {
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	sc := &ServiceConfig{}
+	if err := sc.parseSchedule(); err != nil {
+		t.Fatal("error parsing schedule: ", err)
+	}
+	svc := newService("web", sc)
+	putFakeTunnelConn(t, svc, "a", connReady)
+	services = map[string]*service{"web": svc}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	go listenMux(ln)
+
+	dial := func(service string) net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("error dialing: ", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := tunnelit.WritePreamble(conn, service); err != nil {
+			t.Fatal("error writing preamble: ", err)
+		}
+		return conn
+	}
+	conn := dial("unknown")
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected a client of an unknown service to be closed")
+	}
+	conn.Close()
+
+	conn = dial("web")
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal("error writing: ", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("expected the client piped to the service, got %q, %v", b, err)
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	conn, peer := pipeConn(t)
+	go tls.Client(peer, &tls.Config{
+		ServerName: "db.example.com", InsecureSkipVerify: true,
+	}).Handshake()
+	hello, conn, err := peekClientHello(conn)
+	if err != nil {
+		t.Fatal("error peeking client hello: ", err)
+	} else if hello.sni != "db.example.com" {
+		t.Fatalf("expected db.example.com, got %q", hello.sni)
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil || b[0] != tlsRecordHandshake {
+		t.Fatalf("expected the client hello replayed, got %v", b)
+	}
+
+	// Clients not using TLS have no client hello and nothing is lost
+	conn, peer = pipeConn(t)
+	go peer.Write([]byte("GET / HTTP/1.1\r\n"))
+	hello, conn, err = peekClientHello(conn)
+	if err != nil {
+		t.Fatal("error peeking client hello: ", err)
+	} else if hello != (clientHello{}) {
+		t.Fatalf("expected no client hello, got %+v", hello)
+	}
+	b = make([]byte, 3)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "GET" {
+		t.Fatalf("expected the bytes replayed, got %q", b)
+	}
+
+	// A client that hangs up before sending anything is an error
+	conn, peer = pipeConn(t)
+	peer.Close()
+	if _, _, err := peekClientHello(conn); err == nil {
+		t.Fatal("expected an error for a closed client")
+	}
+}
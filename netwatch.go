@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// netSettleDelay is how long to wait after seeing a network change before
+// acting on it, so that related changes (e.g., an address and then a route
+// being added) are handled at once.
+const netSettleDelay = time.Second
+
+// netWatchInterval is how often the tunnel checks for network changes (0
+// means never).
+var netWatchInterval time.Duration
+
+// netState is a snapshot of the machine's network.
+type netState struct {
+	// addrs are the IPs of the interfaces that are up (other than loopback).
+	addrs map[string]bool
+	// routes describes the default routes (blank if unknown).
+	routes string
+}
+
+func currentNetState() (netState, error) {
+	st := netState{addrs: make(map[string]bool), routes: defaultRoutes()}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return st, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return st, err
+		}
+		for _, addr := range addrs {
+			if ipn, ok := addr.(*net.IPNet); ok {
+				st.addrs[ipn.IP.String()] = true
+			}
+		}
+	}
+	return st, nil
+}
+
+func (st netState) String() string {
+	addrs := make([]string, 0, len(st.addrs))
+	for addr := range st.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	s := "addresses: " + strings.Join(addrs, ", ")
+	if st.routes != "" {
+		s += "; default routes: " + st.routes
+	}
+	return s
+}
+
+// watchNetwork checks for network changes (e.g., a laptop moving from WiFi to
+// LTE) every interval, reconnecting to the proxies when there is one rather
+// than waiting for the conns on the dead path to time out.
+func watchNetwork(sel *proxySelector) {
+	last, err := currentNetState()
+	if err != nil {
+		log.Print("Error reading network state: ", err)
+	}
+	for range time.Tick(netWatchInterval) {
+		st, err := currentNetState()
+		if err != nil {
+			log.Print("Error reading network state: ", err)
+			continue
+		} else if st.String() == last.String() {
+			continue
+		}
+		time.Sleep(netSettleDelay)
+		if st, err = currentNetState(); err != nil {
+			log.Print("Error reading network state: ", err)
+			continue
+		}
+		last = st
+		log.Printf("Network changed (%s), reconnecting to proxies", st)
+		reconnectProxies(sel, st)
+	}
+}
+
+// reconnectProxies replaces the idle conns to the proxies (on the fastest
+// proxy over the new network) and closes the pipes whose local address is
+// gone, since they can't recover.
+func reconnectProxies(sel *proxySelector, st netState) {
+	if len(sel.addrs) > 1 {
+		sel.measure()
+	}
+	for _, ts := range allTunnelServices() {
+		ts.closeIdle()
+	}
+	closed := 0
+	for _, ap := range allActivePipes() {
+		ip := addrIP(ap.conn1.LocalAddr())
+		if ip != nil && !ip.IsLoopback() && !st.addrs[ip.String()] {
+			ap.conn1.Close()
+			closed++
+		}
+	}
+	if closed != 0 {
+		log.Printf("Closed %d pipes whose local address is gone", closed)
+	}
+}
+
+// closeIdle closes the service's idle conns so that they're replaced.
+func (ts *tunnelService) closeIdle() {
+	ts.idleMtx.Lock()
+	defer ts.idleMtx.Unlock()
+	for conn := range ts.idle {
+		conn.Close()
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultRoutes describes the IPv4 and IPv6 default routes, read from /proc.
+func defaultRoutes() string {
+	var routes []string
+	if b, err := os.ReadFile("/proc/net/route"); err == nil {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		for _, line := range strings.Split(string(b), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+				continue
+			}
+			gw, err := hex.DecodeString(fields[2])
+			if err != nil || len(gw) != 4 {
+				continue
+			}
+			// The gateway is in host (little-endian) byte order
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+			routes = append(routes, fmt.Sprintf("via %s on %s", ip, fields[0]))
+		}
+	}
+	if b, err := os.ReadFile("/proc/net/ipv6_route"); err == nil {
+		// Destination DestPrefixLen Source SourcePrefixLen NextHop Metric
+		// RefCnt Use Flags Iface
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[1] != "00" ||
+				fields[0] != strings.Repeat("0", 32) || fields[9] == "lo" {
+				continue
+			}
+			gw, err := hex.DecodeString(fields[4])
+			if err != nil || len(gw) != 16 {
+				continue
+			}
+			routes = append(
+				routes, fmt.Sprintf("via %s on %s", net.IP(gw), fields[9]),
+			)
+		}
+	}
+	return strings.Join(routes, ", ")
+}
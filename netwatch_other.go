@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// defaultRoutes returns "" since the default routes aren't read on this
+// platform; changes are still detected through the interface addresses.
+func defaultRoutes() string {
+	return ""
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetStateString(t *testing.T) {
+	st := netState{
+		addrs:  map[string]bool{"192.0.2.2": true, "192.0.2.1": true},
+		routes: "via 192.0.2.254 on wlan0",
+	}
+	want := "addresses: 192.0.2.1, 192.0.2.2; " +
+		"default routes: via 192.0.2.254 on wlan0"
+	if got := st.String(); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	st.routes = ""
+	if got := st.String(); got != "addresses: 192.0.2.1, 192.0.2.2" {
+		t.Fatalf("expected no routes, got %q", got)
+	}
+}
+
+func TestCurrentNetState(t *testing.T) {
+	st, err := currentNetState()
+	if err != nil {
+		t.Fatal("error reading network state: ", err)
+	}
+	for addr := range st.addrs {
+		if net.ParseIP(addr).IsLoopback() {
+			t.Fatalf("expected no loopback addresses, got %s", st)
+		}
+	}
+}
+
+// localAddrConn is a conn with the given local address.
+type localAddrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *localAddrConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func TestReconnectProxies(t *testing.T) {
+	oldServices := tunnelServices
+	tunnelServices = make(map[string]*tunnelService)
+	t.Cleanup(func() { tunnelServices = oldServices })
+	sc := &TunnelServiceConfig{Saddrs: []string{"127.0.0.1:1"}}
+	if err := sc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTunnelService("web", sc)
+	addTunnelService(ts)
+	idle, idlePeer := pipeConn(t)
+	ts.idle[idle] = "proxy"
+
+	// Pipes from an address that's gone are closed, others are kept
+	pipes := make(map[string]net.Conn)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "127.0.0.1"} {
+		conn, peer := pipeConn(t)
+		conn1 := &localAddrConn{conn, &net.TCPAddr{IP: net.ParseIP(ip)}}
+		conn2, _ := pipeConn(t)
+		ap, err := trackPipe(connInfo{service: "web"}, conn1, conn2)
+		if err != nil {
+			t.Fatal("error tracking pipe: ", err)
+		}
+		t.Cleanup(func() { untrackPipe(ap) })
+		pipes[ip] = peer
+	}
+	st := netState{addrs: map[string]bool{"192.0.2.2": true}}
+	reconnectProxies(newProxySelector([]string{"proxy"}, "web"), st)
+
+	// Writing to an open pipe times out since nothing reads it
+	closed := func(conn net.Conn) bool {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err := conn.Write([]byte{0})
+		return err == io.ErrClosedPipe
+	}
+	if !closed(idlePeer) {
+		t.Fatal("expected the idle conn to be closed")
+	}
+	for ip, peer := range pipes {
+		if want := ip == "192.0.2.1"; closed(peer) != want {
+			t.Fatalf("%s: expected closed to be %v", ip, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetryInterval is how long to wait before refetching a cert's OCSP
+	// response after failing to fetch it.
+	ocspRetryInterval = 5 * time.Minute
+	// ocspMinRefresh and ocspMaxRefresh bound how long an OCSP response is
+	// stapled before it's refetched.
+	ocspMinRefresh = time.Minute
+	ocspMaxRefresh = 12 * time.Hour
+	// maxOCSPResponseSize caps the size of OCSP responses read.
+	maxOCSPResponseSize = 1 << 20
+)
+
+var (
+	// ocspStapling is whether OCSP responses are fetched and stapled to the
+	// proxy's certs.
+	ocspStapling bool
+
+	ocspClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// stapleOCSP keeps the loaded cert's OCSP response fresh until the cert is
+// replaced (i.e., reloaded), fetching it from the OCSP server named in the
+// cert. Certs without one (or without their issuer in the chain) aren't
+// stapled.
+func (lc *loadedCert) stapleOCSP(id string) {
+	leaf, issuer, err := certAndIssuer(lc.cert)
+	if err != nil {
+		log.Print("Not stapling OCSP responses: ", err)
+		return
+	} else if len(leaf.OCSPServer) == 0 {
+		return
+	}
+	for {
+		wait := ocspRetryInterval
+		resp, raw, err := fetchOCSP(leaf, issuer)
+		if err != nil {
+			log.Printf("Error fetching OCSP response for %s: %v", leaf.Subject, err)
+		} else {
+			if resp.Status != ocsp.Good {
+				log.Printf(
+					"OCSP response for %s says it's %s",
+					leaf.Subject, ocspStatusText(resp.Status),
+				)
+			}
+			stapled := *lc.cert
+			stapled.OCSPStaple = raw
+			lc.stapled.Store(&stapled)
+			wait = ocspRefreshWait(resp, time.Now())
+		}
+		time.Sleep(wait)
+		loadedCerts.Lock()
+		replaced := loadedCerts.certs[id] != lc
+		loadedCerts.Unlock()
+		if replaced {
+			return
+		}
+	}
+}
+
+// certAndIssuer returns the parsed leaf cert and its issuer (the next cert in
+// the chain).
+func certAndIssuer(cert *tls.Certificate) (leaf, issuer *x509.Certificate, err error) {
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("cert chain has no issuer")
+	}
+	if leaf = cert.Leaf; leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+	issuer, err = x509.ParseCertificate(cert.Certificate[1])
+	return leaf, issuer, err
+}
+
+// fetchOCSP fetches and verifies the cert's OCSP response from its first OCSP
+// server, returning the parsed and raw response.
+func fetchOCSP(leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	hr, err := ocspClient.Post(
+		leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hr.Body.Close()
+	if hr.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP server responded %s", hr.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(hr.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, raw, nil
+}
+
+// ocspRefreshWait returns how long to wait before refetching the response:
+// halfway to its next update (bounded by ocspMinRefresh and ocspMaxRefresh).
+func ocspRefreshWait(resp *ocsp.Response, now time.Time) time.Duration {
+	if resp.NextUpdate.IsZero() {
+		return ocspMaxRefresh
+	}
+	return min(max(resp.NextUpdate.Sub(now)/2, ocspMinRefresh), ocspMaxRefresh)
+}
+
+// ocspStatusText returns the name of the OCSP status.
+func ocspStatusText(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestOCSPResponder returns a CA and an OCSP server responding for it with
+// the status.
+func newTestOCSPResponder(t *testing.T, status int) (
+	ca *x509.Certificate, caKey crypto.Signer, srv *httptest.Server,
+) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("error generating key: ", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal("error creating CA: ", err)
+	}
+	if ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return ca, caKey, srv
+}
+
+// writeTestChain writes a cert issued by the CA (naming the OCSP server) and
+// the CA's cert to a file in the dir, and its key to another.
+func writeTestChain(
+	t *testing.T, dir string, ca *x509.Certificate, caKey crypto.Signer,
+	ocspServer string,
+) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("error generating key: ", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{ocspServer},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal("error creating cert: ", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chain bytes.Buffer
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	certFile, keyFile = filepath.Join(dir, "chain.pem"), filepath.Join(dir, "key.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, chain.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadCertStaplesOCSP(t *testing.T) {
+	ca, caKey, srv := newTestOCSPResponder(t, ocsp.Good)
+	certFile, keyFile := writeTestChain(t, t.TempDir(), ca, caKey, srv.URL)
+	ocspStapling = true
+	defer func() { ocspStapling = false }()
+	if _, err := loadCert(certFile, keyFile); err != nil {
+		t.Fatal("error loading cert: ", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, err := loadCert(certFile, keyFile)
+		if err != nil {
+			t.Fatal("error loading cert: ", err)
+		} else if cert.OCSPStaple != nil {
+			resp, err := ocsp.ParseResponse(cert.OCSPStaple, ca)
+			if err != nil {
+				t.Fatal("error parsing staple: ", err)
+			} else if resp.Status != ocsp.Good {
+				t.Fatalf("expected good status, got %d", resp.Status)
+			}
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatal("OCSP response not stapled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFetchOCSPRevoked(t *testing.T) {
+	ca, caKey, srv := newTestOCSPResponder(t, ocsp.Revoked)
+	certFile, keyFile := writeTestChain(t, t.TempDir(), ca, caKey, srv.URL)
+	cert, err := loadCert(certFile, keyFile)
+	if err != nil {
+		t.Fatal("error loading cert: ", err)
+	}
+	leaf, issuer, err := certAndIssuer(cert)
+	if err != nil {
+		t.Fatal("error parsing chain: ", err)
+	}
+	resp, _, err := fetchOCSP(leaf, issuer)
+	if err != nil {
+		t.Fatal("error fetching OCSP response: ", err)
+	} else if resp.Status != ocsp.Revoked {
+		t.Fatalf("expected revoked status, got %d", resp.Status)
+	}
+}
+
+func TestOCSPRefreshWait(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		nextUpdate time.Time
+		want       time.Duration
+	}{
+		{name: "no next update", want: ocspMaxRefresh},
+		{name: "halfway", nextUpdate: now.Add(2 * time.Hour), want: time.Hour},
+		{name: "soon", nextUpdate: now.Add(time.Second), want: ocspMinRefresh},
+		{name: "past", nextUpdate: now.Add(-time.Hour), want: ocspMinRefresh},
+		{name: "far", nextUpdate: now.Add(7 * 24 * time.Hour), want: ocspMaxRefresh},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &ocsp.Response{NextUpdate: tt.nextUpdate}
+			if got := ocspRefreshWait(resp, now); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
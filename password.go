@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	// passwordFile is the file to read the password from (blank means none).
+	passwordFile string
+	// passwordStdin is whether to read the password from the first line of
+	// stdin.
+	passwordStdin bool
+)
+
+// loadPasswordFile reads the password from the file, ignoring a trailing
+// newline. Files readable by others are warned about but still used.
+func loadPasswordFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		log.Printf(
+			"WARNING: password file %s is accessible by others (mode %o); it should be 0600",
+			path, info.Mode().Perm(),
+		)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// readPasswordStdin reads the password from the first line of stdin.
+func readPasswordStdin() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("error reading password from stdin: %w", err)
+	} else if line == "" && err == io.EOF {
+		return "", fmt.Errorf("no password on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPasswordFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		contents string
+		mode     os.FileMode
+		want     string
+	}{
+		{contents: "secret\n", mode: 0o600, want: "secret"},
+		{contents: "secret\r\n", mode: 0o600, want: "secret"},
+		{contents: " secret ", mode: 0o600, want: " secret "},
+		// Files readable by others are still used
+		{contents: "secret", mode: 0o644, want: "secret"},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, "password")
+		if err := os.WriteFile(path, []byte(tt.contents), tt.mode); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chmod(path, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := loadPasswordFile(path); err != nil {
+			t.Fatalf("%d: error loading password: %v", i, err)
+		} else if got != tt.want {
+			t.Fatalf("%d: expected %q, got %q", i, tt.want, got)
+		}
+	}
+	if _, err := loadPasswordFile(filepath.Join(dir, "none")); err == nil {
+		t.Fatal("expected an error for a nonexistent file")
+	}
+}
+
+func TestReadPasswordStdin(t *testing.T) {
+	oldStdin := os.Stdin
+	t.Cleanup(func() { os.Stdin = oldStdin })
+	tests := []struct {
+		stdin, want string
+		ok          bool
+	}{
+		{stdin: "secret\nignored\n", want: "secret", ok: true},
+		{stdin: "secret\r\n", want: "secret", ok: true},
+		{stdin: "secret", want: "secret", ok: true},
+		{stdin: ""},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "stdin")
+		if err := os.WriteFile(path, []byte(tt.stdin), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stdin = f
+		got, err := readPasswordStdin()
+		f.Close()
+		if (err == nil) != tt.ok {
+			t.Fatalf("%q: expected ok to be %v, got %v", tt.stdin, tt.ok, err)
+		} else if got != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.stdin, tt.want, got)
+		}
+	}
+}
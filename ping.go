@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+	"github.com/spf13/cobra"
+)
+
+// servePing echoes the heartbeats sent on a ping conn for the service until
+// it's closed or idles out, answering end-to-end pings (pingTunnel) once a
+// tunnel conn of the service was readied.
+func servePing(conn net.Conn, svc *service) {
+	defer conn.Close()
+	b := []byte{0}
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		if _, err := conn.Read(b); err != nil {
+			return
+		}
+		switch b[0] {
+		case heartbeatByte:
+		case pingTunnel:
+			if !svc.pingTunnel(conn) {
+				b[0] = dialFailed
+			}
+			conn.SetDeadline(time.Now().Add(idleTimeout))
+		default:
+			return
+		}
+		if _, err := conn.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+// pingTunnel uses a tunnel conn of the service for the pinger as it would for
+// a client, closing it once it's ready, and returns whether it was.
+func (svc *service) pingTunnel(pingConn net.Conn) bool {
+	proxyConn, ok := svc.waitIdle(false, tunnelFilter{})
+	if !ok {
+		return false
+	}
+	if proxyConn.sess == nil {
+		// Signal that another idle conn can be accepted
+		readyCh <- utils.Unit{}
+	}
+	err := readyExchange(proxyConn, pingConn, nil)
+	proxyConn.Close()
+	svc.idle.done(proxyConn)
+	return err == nil
+}
+
+// sendPing sends the ping byte (heartbeatByte or pingTunnel) on the ping conn
+// and returns the time it took to be answered.
+func sendPing(conn net.Conn, b byte) (time.Duration, error) {
+	start := time.Now()
+	if _, err := conn.Write([]byte{b}); err != nil {
+		return 0, fmt.Errorf("error writing to proxy: %w", err)
+	}
+	resp := []byte{0}
+	if _, err := conn.Read(resp); err != nil {
+		return 0, fmt.Errorf("error reading from proxy: %w", err)
+	}
+	rtt := time.Since(start)
+	if resp[0] == dialFailed && b == pingTunnel {
+		return 0, errors.New("no tunnel of the service was ready")
+	} else if resp[0] != b {
+		return 0, fmt.Errorf("unexpected byte from proxy: %d", resp[0])
+	}
+	return rtt, nil
+}
+
+func RunPing(cmd *cobra.Command, args []string) {
+	proxyAddr := must(cmd.Flags().GetString("paddr"))
+	e2e := must(cmd.Flags().GetBool("e2e"))
+	count := must(cmd.Flags().GetUint("count"))
+	interval := must(cmd.Flags().GetDuration("interval"))
+	if count == 0 {
+		log.Fatal("count must be positive")
+	}
+	if proxyPubKey != "" {
+		var err error
+		if pinnedKey, err = parsePubKey(proxyPubKey); err != nil {
+			log.Fatal("Error parsing proxy public key: ", err)
+		}
+		if legacyAuth {
+			log.Fatal("legacy-auth can't be used with proxy-pubkey")
+		}
+	}
+
+	if err := setupTunnelTLS(); err != nil {
+		log.Fatal(err)
+	} else if err := checkTransport([]string{proxyAddr}); err != nil {
+		log.Fatal(err)
+	}
+	conn, err := dialProxy(proxyAddr)
+	if err != nil {
+		log.Fatal("Error connecting to proxy: ", err)
+	}
+	defer conn.Close()
+	reg := Registration{Service: must(cmd.Flags().GetString("service")), Ping: true}
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+	start := time.Now()
+	status, err := proxyHandshake(conn, reg)
+	if err != nil {
+		log.Fatal("Error handshaking with proxy: ", err)
+	} else if status == serviceUnknown || status == serviceReserved {
+		log.Fatalf("Service %q: %s", reg.Service, tunnelit.StatusText(status))
+	} else if status != passwordOk {
+		log.Fatal("Proxy rejected the ping: ", tunnelit.StatusText(status))
+	}
+	fmt.Printf("Handshake with %s took %s\n", proxyAddr, fmtRTT(time.Since(start)))
+
+	var proxyRTTs, e2eRTTs []time.Duration
+	for i := uint(0); i < count; i++ {
+		if i != 0 {
+			time.Sleep(interval)
+		}
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		rtt, err := sendPing(conn, heartbeatByte)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxyRTTs = append(proxyRTTs, rtt)
+		if !e2e {
+			fmt.Printf("seq=%d proxy=%s\n", i+1, fmtRTT(rtt))
+			continue
+		}
+		// The proxy may wait for a tunnel conn and then for the tunnel to
+		// connect to its server
+		conn.SetDeadline(time.Now().Add(3 * idleTimeout))
+		e2eRTT, err := sendPing(conn, pingTunnel)
+		if err != nil {
+			log.Fatal("Error pinging through a tunnel: ", err)
+		}
+		e2eRTTs = append(e2eRTTs, e2eRTT)
+		fmt.Printf(
+			"seq=%d proxy=%s end-to-end=%s\n", i+1, fmtRTT(rtt), fmtRTT(e2eRTT),
+		)
+	}
+
+	fmt.Println()
+	printRTTSummary("proxy", proxyRTTs)
+	if len(e2eRTTs) != 0 {
+		printRTTSummary("end-to-end", e2eRTTs)
+	}
+}
+
+// printRTTSummary prints the min, average, and 99th percentile of the RTTs.
+func printRTTSummary(name string, rtts []time.Duration) {
+	sorted := append([]time.Duration(nil), rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, rtt := range sorted {
+		sum += rtt
+	}
+	p99 := sorted[int(math.Ceil(float64(len(sorted))*0.99))-1]
+	fmt.Printf(
+		"%s: min/avg/p99 = %s/%s/%s (%d samples)\n",
+		name, fmtRTT(sorted[0]), fmtRTT(sum/time.Duration(len(sorted))),
+		fmtRTT(p99), len(sorted),
+	)
+}
+
+func fmtRTT(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
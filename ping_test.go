@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+func TestServePing(t *testing.T) {
+	oldReadyCh, oldIdleTimeout := readyCh, idleTimeout
+	readyCh = make(chan utils.Unit, 10)
+	idleTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { readyCh, idleTimeout = oldReadyCh, oldIdleTimeout })
+	svc := newService("svc", &ServiceConfig{})
+	pinger, proxySide := net.Pipe()
+	defer pinger.Close()
+	go servePing(proxySide, svc)
+	pinger.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := sendPing(pinger, heartbeatByte); err != nil {
+		t.Fatal("error pinging proxy: ", err)
+	}
+
+	// The tunnel is readied (having connected to its server) before the
+	// end-to-end ping is answered
+	tunnelSide, pooled := net.Pipe()
+	svc.idle.Put(pooled, "t", tunnelInfo{weight: 1})
+	readied := make(chan bool, 1)
+	go func() {
+		defer tunnelSide.Close()
+		b := []byte{0}
+		if _, err := io.ReadFull(tunnelSide, b); err != nil || b[0] != connReady {
+			readied <- false
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		tunnelSide.Write(b)
+		readied <- true
+		// The proxy closes the conn once it's ready
+		_, err := tunnelSide.Read(b)
+		readied <- err == io.EOF
+	}()
+	rtt, err := sendPing(pinger, pingTunnel)
+	if err != nil {
+		t.Fatal("error pinging through tunnel: ", err)
+	} else if !<-readied {
+		t.Fatal("expected tunnel conn readied")
+	} else if !<-readied {
+		t.Fatal("expected tunnel conn closed after the ping")
+	} else if rtt < 20*time.Millisecond {
+		t.Fatalf("expected RTT to include the tunnel's, got %s", rtt)
+	}
+
+	// Without tunnels, the ping fails without ending the ping conn
+	if _, err := sendPing(pinger, pingTunnel); err == nil {
+		t.Fatal("expected error pinging without tunnels")
+	} else if _, err := sendPing(pinger, heartbeatByte); err != nil {
+		t.Fatal("error pinging proxy after failed ping: ", err)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+var (
+	maxLifetime   time.Duration
+	lifetimeGrace time.Duration
+	maxConnBytes  int64
+	stallTimeout  time.Duration
+	// streamIdleTimeout is how long a piped connection may go without bytes
+	// in either direction before it's closed (0 means never). Services may
+	// override it (see ServiceConfig.StreamIdleTimeout).
+	streamIdleTimeout time.Duration
+)
+
+var errByteCapExceeded = errors.New("byte cap exceeded")
+
+var (
+	// logSampleRate is N where 1 in N closed pipes are logged (0 or 1 means all
+	// are). Errors are always logged.
+	logSampleRate uint64
+	pipesClosed   atomic.Uint64
+)
+
+// sampleSuffix returns whether a closed pipe should be logged and, if so, the
+// suffix noting the sample rate (so counts can be reconstructed).
+func sampleSuffix() (string, bool) {
+	if logSampleRate <= 1 {
+		return "", true
+	}
+	if pipesClosed.Add(1)%logSampleRate != 1 {
+		return "", false
+	}
+	return fmt.Sprintf(" (sampled 1/%d)", logSampleRate), true
+}
+
+// connInfo holds information about a connection being piped.
+type connInfo struct {
+	// service is the name of the service the connection is for.
+	service string
+	// tunnel is the label of the tunnel the connection is piped through (blank
+	// on the tunnel's side).
+	tunnel string
+	// stats are updated live as the connection is piped.
+	stats *Stats
+	// tags are the tags the connection matched. The stats for each are updated
+	// once the connection is done.
+	tags []string
+	// ja3 is the JA3 fingerprint of the client's TLS client hello (blank if
+	// unknown).
+	ja3 string
+	// onActive, if set, is called with the number of active connections once
+	// this one is counted.
+	onActive func(active int64)
+	// record is whether the connection must be recorded. It's closed if it
+	// can't be.
+	record bool
+	// idleTimeout is how long the connection may go without bytes in either
+	// direction before it's closed (0 means never).
+	idleTimeout time.Duration
+	// inspect, if set, is the ring the connection's HTTP exchanges are
+	// recorded in, which keeps up to inspectMax of them.
+	inspect    *exchangeRing
+	inspectMax int
+	// replay is the ID of the exchange the connection replays (if any).
+	replay uint64
+}
+
+// pipeConns pipes between the two conns until either side closes (or the max
+// lifetime is reached), closing both conns. The bytes transferred in each
+// direction are logged once done, with "sent" being from conn1 to conn2, so
+// conn1 should always be the side closer to the client. The bytes sent and
+// received are returned.
+func pipeConns(conn1, conn2 net.Conn, info connInfo) (sent, received int64) {
+	st := info.stats
+	if maxLifetime > 0 {
+		stop := enforceLifetime(conn1, conn2)
+		defer stop()
+	}
+	ap, err := trackPipe(info, conn1, conn2)
+	if err != nil {
+		log.Printf(
+			"Closing pipe between %s and %s: error starting recording: %v",
+			logAddr(conn1.RemoteAddr()), logAddr(conn2.RemoteAddr()), err,
+		)
+		conn1.Close()
+		conn2.Close()
+		return 0, 0
+	}
+	defer untrackPipe(ap)
+	if info.idleTimeout > 0 {
+		stop := enforceIdle(ap, conn1, conn2, info.idleTimeout)
+		defer stop()
+	}
+	memInUse.Add(pipeMemEstimate)
+	defer memInUse.Add(-pipeMemEstimate)
+	st.Conns.Add(1)
+	active := st.ActiveConns.Add(1)
+	defer st.ActiveConns.Add(-1)
+	if info.onActive != nil {
+		info.onActive(active)
+	}
+	for _, tag := range info.tags {
+		if ts := tagStats[tag]; ts != nil {
+			ts.Conns.Add(1)
+			ts.ActiveConns.Add(1)
+			defer ts.ActiveConns.Add(-1)
+		}
+	}
+
+	// The conns written to
+	var w1, w2 net.Conn = conn1, conn2
+	if stallTimeout > 0 {
+		for _, conn := range []net.Conn{conn1, conn2} {
+			if err := setUserTimeout(conn, stallTimeout); err != nil {
+				log.Print("Error setting TCP user timeout: ", err)
+			}
+		}
+		w1 = &stallConn{Conn: conn1, timeout: stallTimeout}
+		w2 = &stallConn{Conn: conn2, timeout: stallTimeout}
+	}
+
+	// The disconnect hook waits for the connect hook so they're run in order
+	var ev hookEvent
+	var connected chan utils.Unit
+	if hooksSet() {
+		ev = hookEvent{
+			Event:      "connect",
+			Service:    info.service,
+			ClientAddr: logAddr(conn1.RemoteAddr()),
+			PeerAddr:   logAddr(conn2.RemoteAddr()),
+			Tags:       formatTags(info.tags),
+		}
+		connected = make(chan utils.Unit)
+		go func(ev hookEvent) {
+			runHook(onConnect, ev)
+			close(connected)
+		}(ev)
+	}
+
+	start := time.Now()
+	var n12, n21 int64
+	// The side whose read ended first is sent first
+	closedFirst := make(chan net.Conn, 2)
+	done := make(chan utils.Unit)
+	go func() {
+		defer close(done)
+		defer recoverConn("pipe from "+logAddr(conn1.RemoteAddr()), conn1)
+		n12 = pipe(
+			conn1, &pipeTap{&countConn{w2, &st.BytesUp}, ap, true}, closedFirst,
+		)
+	}()
+	n21 = pipe(
+		conn2, &pipeTap{&countConn{w1, &st.BytesDown}, ap, false}, closedFirst,
+	)
+	<-done
+
+	if connected != nil {
+		ev.Event, ev.BytesSent, ev.BytesRecvd = "disconnect", n12, n21
+		ev.DurationMS = time.Since(start).Milliseconds()
+		go func() {
+			<-connected
+			runHook(onDisconnect, ev)
+		}()
+	}
+	audit(
+		"Pipe between %s and %s closed (%d bytes sent, %d bytes received)",
+		conn1.RemoteAddr(), conn2.RemoteAddr(), n12, n21,
+	)
+	for _, tag := range info.tags {
+		if ts := tagStats[tag]; ts != nil {
+			ts.BytesUp.Add(uint64(n12))
+			ts.BytesDown.Add(uint64(n21))
+		}
+	}
+	if !shouldLogTags(info.tags) {
+		return n12, n21
+	}
+	sampleStr, ok := sampleSuffix()
+	if !ok {
+		return n12, n21
+	}
+	tagsStr := ""
+	if len(info.tags) != 0 {
+		tagsStr = " [" + formatTags(info.tags) + "]"
+	}
+	tunnelStr := ""
+	if info.tunnel != "" {
+		tunnelStr = " through tunnel " + info.tunnel
+	}
+	ja3Str := ""
+	if info.ja3 != "" {
+		ja3Str = " (JA3 " + info.ja3 + ")"
+	}
+	log.Printf(
+		"Pipe between %s and %s%s closed after %s (%d bytes sent, %d bytes received, %s closed first)%s%s%s",
+		logAddr(conn1.RemoteAddr()), logAddr(conn2.RemoteAddr()), tunnelStr,
+		time.Since(start).Round(time.Millisecond),
+		n12, n21, logAddr((<-closedFirst).RemoteAddr()), ja3Str, tagsStr, sampleStr,
+	)
+	return n12, n21
+}
+
+// enforceLifetime closes the conns once the max lifetime is reached, logging a
+// warning the grace period beforehand. The returned func stops the timers.
+func enforceLifetime(conn1, conn2 net.Conn) (stop func()) {
+	var warnTimer *time.Timer
+	if lifetimeGrace > 0 && lifetimeGrace < maxLifetime {
+		warnTimer = time.AfterFunc(maxLifetime-lifetimeGrace, func() {
+			log.Printf(
+				"Pipe between %s and %s will be closed in %s (max lifetime)",
+				logAddr(conn1.RemoteAddr()), logAddr(conn2.RemoteAddr()),
+				lifetimeGrace,
+			)
+		})
+	}
+	closeTimer := time.AfterFunc(maxLifetime, func() {
+		log.Printf(
+			"Closing pipe between %s and %s: max lifetime (%s) reached",
+			logAddr(conn1.RemoteAddr()), logAddr(conn2.RemoteAddr()),
+			maxLifetime,
+		)
+		conn1.Close()
+		conn2.Close()
+	})
+	return func() {
+		if warnTimer != nil {
+			warnTimer.Stop()
+		}
+		closeTimer.Stop()
+	}
+}
+
+// enforceIdle closes the conns once the pipe has gone the timeout without
+// bytes in either direction. The returned func stops the timer.
+func enforceIdle(
+	ap *activePipe, conn1, conn2 net.Conn, timeout time.Duration,
+) (stop func()) {
+	ap.lastActive.Store(time.Now().UnixNano())
+	var mtx sync.Mutex
+	var timer *time.Timer
+	stopped := false
+	check := func() {
+		idle := time.Since(time.Unix(0, ap.lastActive.Load()))
+		if idle < timeout {
+			mtx.Lock()
+			if !stopped {
+				timer.Reset(timeout - idle)
+			}
+			mtx.Unlock()
+			return
+		}
+		log.Printf(
+			"Closing pipe between %s and %s: idle for %s",
+			logAddr(conn1.RemoteAddr()), logAddr(conn2.RemoteAddr()), timeout,
+		)
+		conn1.Close()
+		conn2.Close()
+	}
+	mtx.Lock()
+	timer = time.AfterFunc(timeout, check)
+	mtx.Unlock()
+	return func() {
+		mtx.Lock()
+		defer mtx.Unlock()
+		stopped = true
+		timer.Stop()
+	}
+}
+
+// pipe copies from rconn to wconn, closing both when done. The rconn is sent
+// on the ended chan before the conns are closed. Returns the number of bytes
+// written.
+func pipe(rconn, wconn net.Conn, ended chan<- net.Conn) int64 {
+	src := rconn
+	if maxConnBytes > 0 {
+		src = &capConn{Conn: rconn, left: maxConnBytes}
+	}
+	var n int64
+	var err error
+	if chaos != nil {
+		n, err = chaos.Copy(wconn, src)
+	} else {
+		n, err = io.Copy(wconn, src)
+	}
+	if errors.Is(err, errByteCapExceeded) {
+		log.Printf(
+			"Closing pipe from %s to %s: exceeded %d bytes",
+			logAddr(rconn.RemoteAddr()), logAddr(wconn.RemoteAddr()),
+			maxConnBytes,
+		)
+	}
+	ended <- rconn
+	rconn.Close()
+	wconn.Close()
+	return n
+}
+
+// capConn wraps a conn, returning errByteCapExceeded from Read once more than
+// the allowed number of bytes would be read.
+type capConn struct {
+	net.Conn
+	left int64
+}
+
+func (c *capConn) Read(p []byte) (int, error) {
+	if c.left <= 0 {
+		// Check whether there's actually more data or if the conn just ended
+		var b [1]byte
+		n, err := c.Conn.Read(b[:])
+		if n > 0 {
+			return 0, errByteCapExceeded
+		}
+		return 0, err
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.Conn.Read(p)
+	c.left -= int64(n)
+	return n, err
+}
+
+// stallConn sets a write deadline before each write so that a write to a peer
+// whose network has blackholed fails within the timeout.
+type stallConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// activePipe is a pipe being run, tracked for state dumps and captures.
+type activePipe struct {
+	// id identifies the pipe for the admin API.
+	id                   uint64
+	service, tunnel      string
+	clientAddr, peerAddr string
+	start                time.Time
+	// conn1 is the side of the pipe closer to the client.
+	conn1 net.Conn
+	// sent and received are updated live, in the same directions as
+	// pipeConns's.
+	sent, received atomic.Uint64
+	// capture is the pipe's running capture (nil if none).
+	capture atomic.Pointer[pipeCapture]
+	// recording is the pipe's compliance recording (nil if it isn't
+	// recorded).
+	recording *pipeCapture
+	// clientTalker and serviceTalker count the pipe's bytes for the top
+	// talkers.
+	clientTalker, serviceTalker *talker
+	// lastActive is when (in Unix nanoseconds) bytes were last written in
+	// either direction.
+	lastActive atomic.Int64
+	// inspector parses the pipe's HTTP exchanges (nil if it isn't
+	// inspected).
+	inspector *pipeInspector
+}
+
+var (
+	activePipesMtx sync.Mutex
+	activePipes    = make(map[uint64]*activePipe)
+	lastPipeID     atomic.Uint64
+)
+
+// trackPipe records a pipe between the conns as active until untrackPipe is
+// called with it, starting its recording if it must be recorded.
+func trackPipe(info connInfo, conn1, conn2 net.Conn) (*activePipe, error) {
+	ap := &activePipe{
+		id:         lastPipeID.Add(1),
+		service:    info.service,
+		tunnel:     info.tunnel,
+		clientAddr: logAddr(conn1.RemoteAddr()),
+		peerAddr:   logAddr(conn2.RemoteAddr()),
+		start:      time.Now(),
+		conn1:      conn1,
+	}
+	if info.record {
+		var err error
+		if ap.recording, err = startRecording(ap, conn1, conn2); err != nil {
+			return nil, err
+		}
+	}
+	if info.inspect != nil {
+		ap.inspector = inspectPipe(info.inspect, info.inspectMax, HTTPExchange{
+			Service: info.service, Tunnel: info.tunnel,
+			ClientAddr: ap.clientAddr, Replay: info.replay,
+		})
+	}
+	ap.clientTalker = clientTalkers.acquire(talkerName(conn1.RemoteAddr()))
+	ap.serviceTalker = serviceTalkers.acquire(info.service)
+	activePipesMtx.Lock()
+	defer activePipesMtx.Unlock()
+	activePipes[ap.id] = ap
+	return ap, nil
+}
+
+// untrackPipe removes the pipe from the active pipes, stopping its capture,
+// recording, and inspection (if any).
+func untrackPipe(ap *activePipe) {
+	activePipesMtx.Lock()
+	delete(activePipes, ap.id)
+	activePipesMtx.Unlock()
+	clientTalkers.release(ap.clientTalker)
+	serviceTalkers.release(ap.serviceTalker)
+	if pc := ap.capture.Swap(nil); pc != nil {
+		pc.close("pipe closed")
+	}
+	if ap.recording != nil {
+		ap.recording.close("pipe closed")
+	}
+	if ap.inspector != nil {
+		ap.inspector.close()
+	}
+}
+
+// getActivePipe returns the active pipe with the given ID.
+func getActivePipe(id uint64) (*activePipe, bool) {
+	activePipesMtx.Lock()
+	defer activePipesMtx.Unlock()
+	ap, ok := activePipes[id]
+	return ap, ok
+}
+
+// allActivePipes returns the active pipes, oldest first.
+func allActivePipes() []*activePipe {
+	activePipesMtx.Lock()
+	pipes := make([]*activePipe, 0, len(activePipes))
+	for _, ap := range activePipes {
+		pipes = append(pipes, ap)
+	}
+	activePipesMtx.Unlock()
+	sort.Slice(pipes, func(i, j int) bool { return pipes[i].id < pipes[j].id })
+	return pipes
+}
+
+// pipeTap counts the bytes written in one direction of a pipe (for it and its
+// talkers), recording them in the pipe's recording and capture and feeding
+// them to its inspector (if any).
+type pipeTap struct {
+	net.Conn
+	ap *activePipe
+	// up is whether the bytes are from the client.
+	up bool
+}
+
+func (t *pipeTap) Write(p []byte) (int, error) {
+	n, err := t.Conn.Write(p)
+	if t.up {
+		t.ap.sent.Add(uint64(n))
+	} else {
+		t.ap.received.Add(uint64(n))
+	}
+	if n > 0 {
+		t.ap.lastActive.Store(time.Now().UnixNano())
+	}
+	t.ap.clientTalker.add(t.up, uint64(n))
+	t.ap.serviceTalker.add(t.up, uint64(n))
+	if t.ap.recording != nil && n > 0 {
+		t.ap.recording.record(t.up, p[:n])
+	}
+	if pc := t.ap.capture.Load(); pc != nil && n > 0 {
+		pc.record(t.up, p[:n])
+	}
+	if t.ap.inspector != nil && n > 0 {
+		t.ap.inspector.feed(t.up, p[:n])
+	}
+	return n, err
+}
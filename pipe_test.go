@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+// pipeResult is the result of a pipeConns call.
+type pipeResult struct {
+	sent, received int64
+}
+
+// startPipe pipes between two in-memory conn pairs, returning the client's
+// and backend's ends and a channel receiving the pipe's result once it's done.
+func startPipe(
+	t *testing.T, info connInfo,
+) (client, backend net.Conn, done <-chan pipeResult) {
+	t.Helper()
+	client, conn1 := net.Pipe()
+	conn2, backend := net.Pipe()
+	if info.stats == nil {
+		info.stats = &Stats{}
+	}
+	res := make(chan pipeResult, 1)
+	go func() {
+		sent, received := pipeConns(conn1, conn2, info)
+		res <- pipeResult{sent, received}
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		backend.Close()
+	})
+	return client, backend, res
+}
+
+// waitPipe waits for the pipe to finish.
+func waitPipe(t *testing.T, done <-chan pipeResult) pipeResult {
+	t.Helper()
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for pipe to close")
+		return pipeResult{}
+	}
+}
+
+func TestPipeMaxLifetime(t *testing.T) {
+	oldLifetime, oldGrace := maxLifetime, lifetimeGrace
+	maxLifetime, lifetimeGrace = 100*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() { maxLifetime, lifetimeGrace = oldLifetime, oldGrace })
+
+	client, backend, done := startPipe(t, connInfo{service: "svc"})
+	go io.Copy(io.Discard, backend)
+	start := time.Now()
+	// The pipe stays up while active until the lifetime is reached
+	for time.Since(start) < 50*time.Millisecond {
+		if _, err := client.Write([]byte("x")); err != nil {
+			t.Fatal("pipe closed before its max lifetime: ", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitPipe(t, done)
+	if elapsed := time.Since(start); elapsed < maxLifetime {
+		t.Fatalf("expected pipe to last %s, closed after %s", maxLifetime, elapsed)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Fatal("expected the client's conn to be closed")
+	}
+}
+
+func TestPipeByteCap(t *testing.T) {
+	oldMax := maxConnBytes
+	maxConnBytes = 10
+	t.Cleanup(func() { maxConnBytes = oldMax })
+
+	tests := []struct {
+		name string
+		sent string
+		want string
+	}{
+		{name: "under", sent: "hello", want: "hello"},
+		{name: "at", sent: "0123456789", want: "0123456789"},
+		{name: "over", sent: "0123456789abcdef", want: "0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, backend, done := startPipe(t, connInfo{service: "svc"})
+			go func() {
+				client.Write([]byte(tt.sent))
+				// Close only once the pipe has read everything it will
+				if len(tt.sent) <= int(maxConnBytes) {
+					client.Close()
+				}
+			}()
+			go io.Copy(io.Discard, client)
+			got, _ := io.ReadAll(backend)
+			if string(got) != tt.want {
+				t.Fatalf("expected backend to get %q, got %q", tt.want, got)
+			}
+			if res := waitPipe(t, done); res.sent != int64(len(tt.want)) {
+				t.Fatalf("expected %d bytes sent, got %d", len(tt.want), res.sent)
+			}
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer that's safe to write from multiple goroutines.
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+// captureLog returns a buffer receiving the log's output for the test.
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestPipeLogsByteCounts(t *testing.T) {
+	logs := captureLog(t)
+	client, backend, done := startPipe(t, connInfo{service: "svc"})
+	go func() {
+		client.Write([]byte("hello"))
+		// Wait for the reply before closing
+		var b [3]byte
+		io.ReadFull(client, b[:])
+		client.Close()
+	}()
+	var b [5]byte
+	if _, err := io.ReadFull(backend, b[:]); err != nil {
+		t.Fatal("error reading from pipe: ", err)
+	}
+	backend.Write([]byte("hey"))
+	res := waitPipe(t, done)
+	if res.sent != 5 || res.received != 3 {
+		t.Fatalf("expected 5 bytes sent and 3 received, got %+v", res)
+	}
+	line := logs.String()
+	if !strings.Contains(line, "(5 bytes sent, 3 bytes received, ") {
+		t.Fatalf("expected byte counts to be logged, got %q", line)
+	} else if !strings.Contains(line, " closed after ") {
+		t.Fatalf("expected duration to be logged, got %q", line)
+	}
+}
+
+func TestPipeStalledPeer(t *testing.T) {
+	oldStall := stallTimeout
+	stallTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { stallTimeout = oldStall })
+
+	// The backend never reads, so the pipe's write to it stalls
+	client, _, done := startPipe(t, connInfo{service: "svc"})
+	go client.Write([]byte("stuck"))
+	start := time.Now()
+	waitPipe(t, done)
+	if elapsed := time.Since(start); elapsed < stallTimeout {
+		t.Fatalf(
+			"expected the pipe to wait %s, closed after %s", stallTimeout, elapsed,
+		)
+	}
+}
+
+func TestSampleSuffix(t *testing.T) {
+	oldRate, oldClosed := logSampleRate, pipesClosed.Load()
+	t.Cleanup(func() {
+		logSampleRate = oldRate
+		pipesClosed.Store(oldClosed)
+	})
+
+	logSampleRate = 0
+	if suffix, ok := sampleSuffix(); !ok || suffix != "" {
+		t.Fatalf("expected all pipes logged, got %q, %v", suffix, ok)
+	}
+
+	logSampleRate = 3
+	pipesClosed.Store(0)
+	var logged []int
+	for i := 0; i < 7; i++ {
+		if suffix, ok := sampleSuffix(); ok {
+			if suffix != " (sampled 1/3)" {
+				t.Fatalf("expected the sample rate noted, got %q", suffix)
+			}
+			logged = append(logged, i)
+		}
+	}
+	if len(logged) != 3 || logged[0] != 0 || logged[1] != 3 || logged[2] != 6 {
+		t.Fatalf("expected pipes 0, 3, and 6 logged, got %v", logged)
+	}
+}
+
+func TestPipeLogSampling(t *testing.T) {
+	oldRate, oldClosed := logSampleRate, pipesClosed.Load()
+	t.Cleanup(func() {
+		logSampleRate = oldRate
+		pipesClosed.Store(oldClosed)
+	})
+	logSampleRate = 2
+	pipesClosed.Store(0)
+	logs := captureLog(t)
+	for i := 0; i < 4; i++ {
+		client, _, done := startPipe(t, connInfo{service: "svc"})
+		client.Close()
+		waitPipe(t, done)
+	}
+	if n := strings.Count(logs.String(), "(sampled 1/2)"); n != 2 {
+		t.Fatalf("expected 2 of 4 pipes logged, got %d:\n%s", n, logs)
+	}
+}
+
+func TestPipeStreamIdleTimeout(t *testing.T) {
+	client, backend, done := startPipe(t, connInfo{
+		service: "svc", idleTimeout: 100 * time.Millisecond,
+	})
+	go io.Copy(io.Discard, backend)
+	// The pipe stays up while there are bytes within the timeout
+	var lastWrite time.Time
+	for start := time.Now(); time.Since(start) < 200*time.Millisecond; {
+		if _, err := client.Write([]byte("x")); err != nil {
+			t.Fatal("pipe closed while active: ", err)
+		}
+		lastWrite = time.Now()
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitPipe(t, done)
+	// With some slack since the pipe's bytes are counted after the write
+	if idle := time.Since(lastWrite); idle < 90*time.Millisecond {
+		t.Fatalf("expected the pipe closed after the timeout, took %s", idle)
+	}
+}
+
+func TestHandleClientConnStreamIdle(t *testing.T) {
+	oldReadyCh := readyCh
+	readyCh = make(chan utils.Unit, 10)
+	t.Cleanup(func() { readyCh = oldReadyCh })
+	cfg := &Config{Services: map[string]*ServiceConfig{
+		"svc": {Addr: "127.0.0.1:0", StreamIdleTimeout: "50ms"},
+	}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal("error validating config: ", err)
+	}
+
+	// gRPC streams are exempt from the timeout
+	for _, grpc := range []bool{false, true} {
+		svc := newService("svc", cfg.Services["svc"])
+		putFakeTunnelConn(t, svc, "a", connReady)
+		clientConn, proxySide := net.Pipe()
+		defer clientConn.Close()
+		go handleClientConn(
+			proxySide, svc, tunnelFilter{}, nil, "", nil,
+			httpHead{host: "example.com", grpc: grpc},
+		)
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		go clientConn.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(clientConn, b); err != nil {
+			t.Fatal("error reading echo: ", err)
+		}
+		// Reading times out if the pipe is still up after the idle timeout
+		clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := clientConn.Read(b)
+		nerr, ok := err.(net.Error)
+		if closed := !ok || !nerr.Timeout(); closed == grpc {
+			t.Fatalf("grpc %v: expected closed to be %v, got %v", grpc, !grpc, err)
+		}
+	}
+}
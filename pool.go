@@ -0,0 +1,744 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+)
+
+const (
+	// heartbeatInterval is how often idle tunnel conns are heartbeated.
+	heartbeatInterval = 5 * time.Second
+	// heartbeatTimeout is how long to wait for a heartbeat response.
+	heartbeatTimeout = 5 * time.Second
+	// tunnelForgetAfter is how long a tunnel without idle conns is remembered.
+	tunnelForgetAfter = time.Minute
+)
+
+// poolTunnel holds a tunnel's idle conns.
+type poolTunnel struct {
+	id string
+	// name is the tunnel's friendly name (blank if it has none).
+	name string
+	// credential is the name of the credential the tunnel authenticated with
+	// (blank if it used the password or a token).
+	credential string
+	// clientInfo is whether the tunnel asked for the clients' info.
+	clientInfo bool
+	// hosts are the HTTP hosts the tunnel serves (for services in http mode).
+	hosts []string
+	// tags are the tags the tunnel registered with, which clients' tunnel
+	// selectors are matched against.
+	tags  map[string]string
+	conns []net.Conn
+	// sessions are the tunnel's sessions, each of which can take any number
+	// of clients (as streams).
+	sessions []*tunnelSession
+	active   int
+	weight   int
+	// links is the number of links the tunnel has for the service (normally
+	// at most one).
+	links int
+	// linkIdle is the number of idle conns the tunnel last reported over its
+	// link.
+	linkIdle int
+	// baseline is whether the tunnel predates registrations, so its idle conns
+	// can't be heartbeated.
+	baseline bool
+	// rtt is the smoothed heartbeat RTT (0 if not measured yet).
+	rtt time.Duration
+	// lastPut is when a conn was last added.
+	lastPut time.Time
+}
+
+// idlePool holds a service's idle tunnel conns, grouped by the tunnel they
+// came from. The tunnel each conn is taken from is picked by the policy.
+type idlePool struct {
+	mtx     sync.Mutex
+	tunnels map[string]*poolTunnel
+	len     int
+	// sessions is the number of sessions of all the tunnels.
+	sessions int
+	policy   tunnelit.Policy
+	// waiters are the clients waiting for a conn, in order.
+	waiters []poolWaiter
+}
+
+// poolWaiter is a client waiting for a conn.
+type poolWaiter struct {
+	ch    chan pooledConn
+	since time.Time
+	// filter is the filter the conn's tunnel must match.
+	filter tunnelFilter
+}
+
+// tunnelFilter restricts the tunnels a client can be paired with.
+type tunnelFilter struct {
+	sel tunnelSelector
+	// host, if set, is the HTTP host the tunnel must serve.
+	host string
+}
+
+// matches returns whether the tunnel matches the filter.
+func (f tunnelFilter) matches(pt *poolTunnel) bool {
+	return f.sel.matches(pt.tags) && (f.host == "" || sniMatches(pt.hosts, f.host))
+}
+
+// tunnelSelector restricts the tunnels a client can be paired with to those
+// with all of its tags (nil means any tunnel).
+type tunnelSelector map[string]string
+
+// matches returns whether the tags have all the selector's tags.
+func (sel tunnelSelector) matches(tags map[string]string) bool {
+	for k, v := range sel {
+		if tv, ok := tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// tunnelInfo is what a tunnel registers its conns with.
+type tunnelInfo struct {
+	name       string
+	weight     int
+	tags       map[string]string
+	credential string
+	// clientInfo is whether the tunnel asked for the clients' info.
+	clientInfo bool
+	hosts      []string
+	// baseline is whether the tunnel sent no registration.
+	baseline bool
+}
+
+// pooledConn is a conn taken from the pool. done must be called once the conn
+// is no longer in use.
+type pooledConn struct {
+	net.Conn
+	tunnel *poolTunnel
+	// clientInfo is whether the tunnel asked for the client's info.
+	clientInfo bool
+	// sess is the session the conn is a stream of (nil if it's an idle conn,
+	// in which case taking it frees an idle slot). The stream is opened once
+	// the conn is taken, outside the mutex (see openStream).
+	sess *tunnelSession
+}
+
+func newIdlePool(policy tunnelit.Policy) *idlePool {
+	return &idlePool{tunnels: make(map[string]*poolTunnel), policy: policy}
+}
+
+// Len returns the number of idle conns.
+func (p *idlePool) Len() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.len
+}
+
+// Put adds an idle conn from the given tunnel, handing it directly to the
+// longest waiting client it can serve if there is one.
+func (p *idlePool) Put(conn net.Conn, tunnelID string, info tunnelInfo) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.tunnel(tunnelID)
+	pt.lastPut = time.Now()
+	pt.setInfo(info)
+	p.add(conn, pt)
+}
+
+// putSession adds a session from the given tunnel, handing it to all the
+// waiting clients it can serve (who each open a stream of it).
+func (p *idlePool) putSession(
+	sess *tunnelSession, tunnelID string, info tunnelInfo,
+) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.tunnel(tunnelID)
+	pt.lastPut = time.Now()
+	pt.setInfo(info)
+	pt.sessions = append(pt.sessions, sess)
+	p.sessions++
+	kept := p.waiters[:0]
+	for _, w := range p.waiters {
+		if !w.filter.matches(pt) {
+			kept = append(kept, w)
+			continue
+		}
+		pt.active++
+		w.ch <- pooledConn{tunnel: pt, clientInfo: pt.clientInfo, sess: sess}
+	}
+	p.waiters = kept
+}
+
+// removeSession removes the session from the given tunnel (once it's ended).
+func (p *idlePool) removeSession(sess *tunnelSession, tunnelID string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if pt := p.tunnels[tunnelID]; pt != nil {
+		p.dropSession(pt, sess)
+	}
+}
+
+// dropSession removes the session from the tunnel if it's still there. The
+// mutex must be held.
+func (p *idlePool) dropSession(pt *poolTunnel, sess *tunnelSession) {
+	for i, s := range pt.sessions {
+		if s == sess {
+			pt.sessions = append(pt.sessions[:i], pt.sessions[i+1:]...)
+			p.sessions--
+			// Remembered from now on as if a conn was just added
+			pt.lastPut = time.Now()
+			return
+		}
+	}
+}
+
+// putBack adds back an idle conn that was removed (e.g., for a heartbeat).
+func (p *idlePool) putBack(conn net.Conn, tunnelID string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.add(conn, p.tunnel(tunnelID))
+}
+
+// setInfo sets the info the tunnel registered with.
+func (pt *poolTunnel) setInfo(info tunnelInfo) {
+	pt.name, pt.weight, pt.tags = info.name, info.weight, info.tags
+	pt.credential, pt.clientInfo = info.credential, info.clientInfo
+	pt.hosts, pt.baseline = info.hosts, info.baseline
+}
+
+// label returns how the tunnel is shown in logs: its name (if it has one), ID,
+// and credential (if it used one).
+func (pt *poolTunnel) label() string {
+	id := pt.id
+	if pt.credential != "" {
+		id += fmt.Sprintf(", credential %q", pt.credential)
+	}
+	if pt.name == "" {
+		if pt.credential == "" {
+			return id
+		}
+		return fmt.Sprintf("%s (credential %q)", pt.id, pt.credential)
+	}
+	return fmt.Sprintf("%q (%s)", pt.name, id)
+}
+
+// tunnelLabel returns the label of the tunnel with the given ID.
+func (p *idlePool) tunnelLabel(id string) string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if pt := p.tunnels[id]; pt != nil {
+		return pt.label()
+	}
+	return id
+}
+
+// tunnel returns the tunnel with the given ID, creating it if needed. The
+// mutex must be held.
+func (p *idlePool) tunnel(id string) *poolTunnel {
+	pt := p.tunnels[id]
+	if pt == nil {
+		pt = &poolTunnel{id: id, weight: 1, lastPut: time.Now()}
+		p.tunnels[id] = pt
+	}
+	return pt
+}
+
+// add adds the conn to the tunnel's idle conns or hands it to a waiting
+// client. The mutex must be held.
+func (p *idlePool) add(conn net.Conn, pt *poolTunnel) {
+	for i, w := range p.waiters {
+		if !w.filter.matches(pt) {
+			continue
+		}
+		pt.active++
+		w.ch <- pooledConn{Conn: conn, tunnel: pt, clientInfo: pt.clientInfo}
+		p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+		return
+	}
+	pt.conns = append(pt.conns, conn)
+	p.len++
+}
+
+// TryGet returns an idle conn from a tunnel matching the filter if one is
+// available.
+func (p *idlePool) TryGet(filter tunnelFilter) (pooledConn, bool) {
+	for {
+		p.mtx.Lock()
+		pc, ok := p.take(filter)
+		p.mtx.Unlock()
+		if !ok {
+			return pc, false
+		} else if pc, ok = p.openStream(pc); ok {
+			return pc, true
+		}
+	}
+}
+
+// Get waits up to the timeout for an idle conn from a tunnel matching the
+// filter.
+func (p *idlePool) Get(
+	timeout time.Duration, filter tunnelFilter,
+) (pooledConn, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pc, ok := p.wait(time.Until(deadline), filter)
+		if !ok {
+			return pc, false
+		} else if pc, ok = p.openStream(pc); ok {
+			return pc, true
+		}
+	}
+}
+
+// wait waits up to the timeout for an idle conn (or session) from a tunnel
+// matching the filter.
+func (p *idlePool) wait(
+	timeout time.Duration, filter tunnelFilter,
+) (pooledConn, bool) {
+	p.mtx.Lock()
+	if pc, ok := p.take(filter); ok {
+		p.mtx.Unlock()
+		return pc, true
+	}
+	ch := make(chan pooledConn, 1)
+	p.waiters = append(
+		p.waiters, poolWaiter{ch: ch, since: time.Now(), filter: filter},
+	)
+	p.mtx.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case pc := <-ch:
+		return pc, true
+	case <-timer.C:
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i, w := range p.waiters {
+		if w.ch == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return pooledConn{}, false
+		}
+	}
+	// A conn was handed over before the waiter could be removed
+	return <-ch, true
+}
+
+// openStream opens the stream of the conn if it was taken from a session,
+// which is done outside the mutex since opening a stream can block. If the
+// session has ended, it's removed and false is returned.
+func (p *idlePool) openStream(pc pooledConn) (pooledConn, bool) {
+	if pc.sess == nil {
+		return pc, true
+	}
+	st, err := pc.sess.Open()
+	if err == nil {
+		pc.Conn = st
+		return pc, true
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pc.tunnel.active--
+	if p.tunnels[pc.tunnel.id] == pc.tunnel {
+		p.dropSession(pc.tunnel, pc.sess)
+	}
+	return pooledConn{}, false
+}
+
+// take removes and returns a conn from the tunnel picked by the policy among
+// those matching the filter, or one of its sessions (whose stream is yet to
+// be opened) if it has no idle conns. The mutex must be held.
+func (p *idlePool) take(filter tunnelFilter) (pooledConn, bool) {
+	if p.len == 0 && p.sessions == 0 {
+		return pooledConn{}, false
+	}
+	pts := make([]*poolTunnel, 0, len(p.tunnels))
+	for _, pt := range p.tunnels {
+		if (len(pt.conns) != 0 || len(pt.sessions) != 0) && filter.matches(pt) {
+			pts = append(pts, pt)
+		}
+	}
+	if len(pts) == 0 {
+		return pooledConn{}, false
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i].id < pts[j].id })
+	tunnels := make([]tunnelit.Tunnel, len(pts))
+	for i, pt := range pts {
+		tunnels[i] = tunnelit.Tunnel{
+			ID:          pt.id,
+			IdleConns:   len(pt.conns) + len(pt.sessions),
+			ActiveConns: pt.active,
+			RTT:         pt.rtt,
+			Weight:      pt.weight,
+		}
+	}
+	i := p.policy.Pick(tunnels)
+	if i < 0 || i >= len(pts) {
+		i = 0
+	}
+	pt := pts[i]
+	if len(pt.conns) == 0 {
+		// Take turns between the sessions
+		sess := pt.sessions[0]
+		pt.sessions = append(pt.sessions[1:], sess)
+		if sess.IsClosed() {
+			// The session has ended but hasn't been removed yet
+			p.dropSession(pt, sess)
+			return pooledConn{}, false
+		}
+		pt.active++
+		return pooledConn{tunnel: pt, clientInfo: pt.clientInfo, sess: sess}, true
+	}
+	conn := pt.conns[0]
+	pt.conns = pt.conns[1:]
+	pt.active++
+	p.len--
+	return pooledConn{Conn: conn, tunnel: pt, clientInfo: pt.clientInfo}, true
+}
+
+// setPolicy sets the policy used to pick tunnels.
+func (p *idlePool) setPolicy(policy tunnelit.Policy) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.policy = policy
+}
+
+// drain removes and returns all the idle conns and sessions.
+func (p *idlePool) drain() ([]net.Conn, []*tunnelSession) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	var conns []net.Conn
+	var sessions []*tunnelSession
+	for _, pt := range p.tunnels {
+		conns = append(conns, pt.conns...)
+		sessions = append(sessions, pt.sessions...)
+		pt.conns, pt.sessions = nil, nil
+	}
+	p.len, p.sessions = 0, 0
+	return conns, sessions
+}
+
+// removeTunnel removes the tunnel, returning its idle conns and sessions. Its
+// conns in use are unaffected (other than its sessions' streams, once the
+// sessions are closed).
+func (p *idlePool) removeTunnel(
+	tunnelID string,
+) ([]net.Conn, []*tunnelSession) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.tunnels[tunnelID]
+	if pt == nil {
+		return nil, nil
+	}
+	delete(p.tunnels, tunnelID)
+	p.len -= len(pt.conns)
+	p.sessions -= len(pt.sessions)
+	return pt.conns, pt.sessions
+}
+
+// hasTunnels returns whether any tunnels matching the filter have idle or
+// active conns (or sessions).
+func (p *idlePool) hasTunnels(filter tunnelFilter) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, pt := range p.tunnels {
+		idle := len(pt.conns) != 0 || len(pt.sessions) != 0
+		if (idle || pt.active != 0) && filter.matches(pt) {
+			return true
+		}
+	}
+	return false
+}
+
+// knowsTunnels returns whether any tunnels matching the filter have had idle
+// or active conns recently (or have links), even if all their conns are in
+// use.
+func (p *idlePool) knowsTunnels(filter tunnelFilter) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, pt := range p.tunnels {
+		recent := pt.active != 0 || pt.links != 0 ||
+			time.Since(pt.lastPut) <= tunnelForgetAfter
+		idle := len(pt.conns) != 0 || len(pt.sessions) != 0
+		if (idle || recent) && filter.matches(pt) {
+			return true
+		}
+	}
+	return false
+}
+
+// done marks the conn as no longer in use.
+func (p *idlePool) done(pc pooledConn) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pc.tunnel.active--
+}
+
+// remove removes the given conn if it's still idle, returning whether it was.
+func (p *idlePool) remove(conn net.Conn, tunnelID string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.tunnels[tunnelID]
+	if pt == nil {
+		return false
+	}
+	for i, c := range pt.conns {
+		if c == conn {
+			pt.conns = append(pt.conns[:i], pt.conns[i+1:]...)
+			p.len--
+			return true
+		}
+	}
+	return false
+}
+
+// takeTunnelIdle removes and returns the tunnel's idle conns and sessions,
+// keeping the tunnel.
+func (p *idlePool) takeTunnelIdle(
+	tunnelID string,
+) ([]net.Conn, []*tunnelSession) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.tunnels[tunnelID]
+	if pt == nil {
+		return nil, nil
+	}
+	conns, sessions := pt.conns, pt.sessions
+	pt.conns, pt.sessions = nil, nil
+	p.len -= len(conns)
+	p.sessions -= len(sessions)
+	return conns, sessions
+}
+
+// removeSessions removes and returns the sessions whose conns match the
+// predicate.
+func (p *idlePool) removeSessions(
+	pred func(net.Conn) bool,
+) []*tunnelSession {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	var removed []*tunnelSession
+	for _, pt := range p.tunnels {
+		kept := pt.sessions[:0]
+		for _, sess := range pt.sessions {
+			if pred(sess.conn) {
+				removed = append(removed, sess)
+			} else {
+				kept = append(kept, sess)
+			}
+		}
+		pt.sessions = kept
+	}
+	p.sessions -= len(removed)
+	return removed
+}
+
+// removeIdle removes and returns the idle conns matching the predicate.
+func (p *idlePool) removeIdle(pred func(net.Conn) bool) []net.Conn {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	var removed []net.Conn
+	for _, pt := range p.tunnels {
+		kept := pt.conns[:0]
+		for _, conn := range pt.conns {
+			if pred(conn) {
+				removed = append(removed, conn)
+			} else {
+				kept = append(kept, conn)
+			}
+		}
+		pt.conns = kept
+	}
+	p.len -= len(removed)
+	return removed
+}
+
+// addLink records that the tunnel has a link, returning the func to call
+// once it's lost, which returns how many links the tunnel still has.
+func (p *idlePool) addLink(tunnelID string, info tunnelInfo) func() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.tunnel(tunnelID)
+	pt.setInfo(info)
+	pt.links++
+	return func() int {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		if pt.links--; pt.links == 0 {
+			pt.linkIdle = 0
+		}
+		// Remembered from now on as if a conn was just added
+		pt.lastPut = time.Now()
+		return pt.links
+	}
+}
+
+// linkStatus returns the status sent over the tunnel's link, recording the
+// number of idle conns the tunnel reported in its last status.
+func (p *idlePool) linkStatus(tunnelID string, reported int) LinkStatus {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.tunnel(tunnelID)
+	pt.linkIdle = reported
+	return LinkStatus{
+		IdleConns:   len(pt.conns) + len(pt.sessions),
+		ActiveConns: pt.active,
+	}
+}
+
+// recordRTT records a heartbeat RTT for the tunnel.
+func (p *idlePool) recordRTT(tunnelID string, rtt time.Duration) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.tunnels[tunnelID]
+	if pt == nil {
+		return
+	}
+	if pt.rtt == 0 {
+		pt.rtt = rtt
+	} else {
+		pt.rtt = (pt.rtt*7 + rtt) / 8
+	}
+}
+
+// snapshot returns the idle conns of each tunnel, forgetting tunnels that
+// haven't had idle or active conns (or sessions or links) for a while.
+// Sessions aren't included since they heartbeat themselves, nor are the conns
+// of baseline tunnels, which don't answer heartbeats.
+func (p *idlePool) snapshot() map[string][]net.Conn {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	snap := make(map[string][]net.Conn, len(p.tunnels))
+	for id, pt := range p.tunnels {
+		if len(pt.conns) == 0 {
+			if pt.active == 0 && len(pt.sessions) == 0 && pt.links == 0 &&
+				time.Since(pt.lastPut) > tunnelForgetAfter {
+				delete(p.tunnels, id)
+			}
+			continue
+		} else if pt.baseline {
+			continue
+		}
+		snap[id] = append([]net.Conn(nil), pt.conns...)
+	}
+	return snap
+}
+
+// TunnelStats holds the stats for a tunnel serving a service.
+type TunnelStats struct {
+	Name        string            `json:"name,omitempty"`
+	Credential  string            `json:"credential,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	IdleConns   int               `json:"idle_conns"`
+	Sessions    int               `json:"sessions,omitempty"`
+	ActiveConns int               `json:"active_conns"`
+	RTTMillis   float64           `json:"rtt_ms"`
+	Weight      int               `json:"weight"`
+	// Link is whether the tunnel has a link for the service.
+	Link bool `json:"link,omitempty"`
+	// LinkIdleConns is the number of idle conns the tunnel last reported over
+	// its link, which may differ from IdleConns while conns are being
+	// replaced.
+	LinkIdleConns int `json:"link_idle_conns,omitempty"`
+}
+
+// tunnelStats returns the stats for each known tunnel.
+func (p *idlePool) tunnelStats() map[string]TunnelStats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	all := make(map[string]TunnelStats, len(p.tunnels))
+	for id, pt := range p.tunnels {
+		all[id] = TunnelStats{
+			Name:          pt.name,
+			Credential:    pt.credential,
+			Tags:          pt.tags,
+			IdleConns:     len(pt.conns),
+			Sessions:      len(pt.sessions),
+			ActiveConns:   pt.active,
+			RTTMillis:     float64(pt.rtt) / float64(time.Millisecond),
+			Weight:        pt.weight,
+			Link:          pt.links != 0,
+			LinkIdleConns: pt.linkIdle,
+		}
+	}
+	return all
+}
+
+// closeIdle closes the idle conns and sessions removed from a pool.
+func closeIdle(conns []net.Conn, sessions []*tunnelSession) {
+	for _, conn := range conns {
+		conn.Close()
+		// Signal that another idle conn can be accepted
+		readyCh <- utils.Unit{}
+	}
+	for _, sess := range sessions {
+		sess.Close()
+	}
+}
+
+// heartbeatLoop periodically heartbeats the service's idle conns, recording
+// the RTT of each tunnel and dropping dead conns.
+func (svc *service) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-svc.stop:
+			return
+		}
+		snap := svc.idle.snapshot()
+		ids := make([]string, 0, len(snap))
+		for id := range snap {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			for _, conn := range snap[id] {
+				// The conn may have been used since the snapshot
+				if !svc.idle.remove(conn, id) {
+					continue
+				}
+				rtt, err := heartbeat(conn)
+				if err != nil {
+					log.Printf(
+						"Dropping idle conn from tunnel %s of %s: %v",
+						svc.idle.tunnelLabel(id), svc.displayName(), err,
+					)
+					conn.Close()
+					// Signal that another idle conn can be accepted
+					readyCh <- utils.Unit{}
+					continue
+				}
+				svc.idle.recordRTT(id, rtt)
+				svc.idle.putBack(conn, id)
+			}
+		}
+	}
+}
+
+// heartbeat sends a heartbeat on the idle conn and waits for the response,
+// returning the RTT.
+func heartbeat(conn net.Conn) (time.Duration, error) {
+	start := time.Now()
+	conn.SetDeadline(start.Add(heartbeatTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte{heartbeatByte}); err != nil {
+		return 0, err
+	}
+	b := []byte{0}
+	if _, err := conn.Read(b); err != nil {
+		return 0, err
+	} else if b[0] != heartbeatByte {
+		return 0, fmt.Errorf("unexpected response %d", b[0])
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+)
+
+// answerHeartbeats answers heartbeats on the conn with the given byte until
+// it's closed.
+func answerHeartbeats(conn net.Conn, resp byte) {
+	b := []byte{0}
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		if _, err := conn.Write([]byte{resp}); err != nil {
+			return
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go answerHeartbeats(c2, heartbeatByte)
+	rtt, err := heartbeat(c1)
+	if err != nil {
+		t.Fatal("error heartbeating: ", err)
+	} else if rtt < 10*time.Millisecond {
+		t.Fatalf("expected an RTT of at least 10ms, got %s", rtt)
+	}
+
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+	go answerHeartbeats(c4, heartbeatByte+1)
+	if _, err := heartbeat(c3); err == nil {
+		t.Fatal("expected an error for an unexpected response")
+	}
+
+	c5, c6 := net.Pipe()
+	defer c5.Close()
+	c6.Close()
+	if _, err := heartbeat(c5); err == nil {
+		t.Fatal("expected an error for a closed conn")
+	}
+}
+
+func TestPoolRecordRTT(t *testing.T) {
+	pool := newIdlePool(&tunnelit.RoundRobin{})
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	pool.Put(c1, "a", tunnelInfo{weight: 1})
+	pool.recordRTT("a", 80*time.Millisecond)
+	pool.recordRTT("a", 160*time.Millisecond)
+	// Unknown tunnels are ignored
+	pool.recordRTT("b", time.Millisecond)
+	stats := pool.tunnelStats()
+	if got := stats["a"].RTTMillis; got != 90 {
+		t.Fatalf("expected a smoothed RTT of 90ms, got %vms", got)
+	} else if _, ok := stats["b"]; ok {
+		t.Fatal("expected no stats for an unknown tunnel")
+	}
+}
+
+func TestPoolPrefersLowestLatency(t *testing.T) {
+	pool := newIdlePool(&tunnelit.LowestLatency{Hysteresis: 0.8})
+	for _, id := range []string{"far", "near", "unmeasured"} {
+		for i := 0; i < 2; i++ {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			pool.Put(c1, id, tunnelInfo{weight: 1})
+		}
+	}
+	pool.recordRTT("far", 100*time.Millisecond)
+	pool.recordRTT("near", 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		pc, ok := pool.TryGet(tunnelFilter{})
+		if !ok {
+			t.Fatal("expected an idle conn")
+		} else if pc.tunnel.id != "near" {
+			t.Fatalf("expected the nearest tunnel, got %s", pc.tunnel.id)
+		}
+		pool.done(pc)
+	}
+	// Once the nearest tunnel has no idle conns, the next nearest is used
+	if pc, ok := pool.TryGet(tunnelFilter{}); !ok || pc.tunnel.id != "far" {
+		t.Fatalf("expected the far tunnel, got %v", pc.tunnel)
+	}
+}
+
+func TestPoolSnapshotForgetsTunnels(t *testing.T) {
+	pool := newIdlePool(&tunnelit.RoundRobin{})
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	pool.Put(c1, "gone", tunnelInfo{weight: 1})
+	if !pool.remove(c1, "gone") {
+		t.Fatal("expected the idle conn to be removed")
+	}
+	if snap := pool.snapshot(); len(snap) != 0 {
+		t.Fatalf("expected no conns to heartbeat, got %v", snap)
+	} else if _, ok := pool.tunnelStats()["gone"]; !ok {
+		t.Fatal("expected a tunnel to be remembered for a while")
+	}
+	pool.tunnels["gone"].lastPut = time.Now().Add(-2 * tunnelForgetAfter)
+	pool.snapshot()
+	if _, ok := pool.tunnelStats()["gone"]; ok {
+		t.Fatal("expected a tunnel without conns to be forgotten")
+	}
+}
+
+func TestPoolTunnelNames(t *testing.T) {
+	svc := newService("web", &ServiceConfig{})
+	oldServices := services
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { services = oldServices })
+	for _, id := range []string{"t1", "t2"} {
+		conn, _ := pipeConn(t)
+		name := ""
+		if id == "t1" {
+			name = "laptop"
+		}
+		svc.idle.Put(conn, id, tunnelInfo{name: name, weight: 1})
+	}
+	tests := []struct{ id, want string }{
+		{"t1", `"laptop" (t1)`}, {"t2", "t2"}, {"unknown", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := svc.idle.tunnelLabel(tt.id); got != tt.want {
+			t.Fatalf("%s: expected label %s, got %s", tt.id, tt.want, got)
+		}
+	}
+	if got := svc.idle.tunnelStats()["t1"].Name; got != "laptop" {
+		t.Fatalf("expected the name in the stats, got %q", got)
+	}
+
+	var sb strings.Builder
+	metrics.WritePrometheus(&sb)
+	want := `tunnelit_tunnel_idle_conns{service="web",tunnel="t1",name="laptop"} 1`
+	if !strings.Contains(sb.String(), want) {
+		t.Fatalf("expected %s in the metrics, got:\n%s", want, sb.String())
+	}
+}
+
+func TestTunnelSelectorMatches(t *testing.T) {
+	tags := map[string]string{"region": "eu", "tier": "gold"}
+	tests := []struct {
+		sel  tunnelSelector
+		want bool
+	}{
+		{sel: nil, want: true},
+		{sel: tunnelSelector{"region": "eu"}, want: true},
+		{sel: tunnelSelector{"region": "eu", "tier": "gold"}, want: true},
+		{sel: tunnelSelector{"region": "us"}, want: false},
+		{sel: tunnelSelector{"zone": "a"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.sel.matches(tags); got != tt.want {
+			t.Fatalf("%v: expected %v, got %v", tt.sel, tt.want, got)
+		}
+	}
+	if (tunnelSelector{"region": "eu"}).matches(nil) {
+		t.Fatal("expected untagged tunnels not to match a selector")
+	}
+}
+
+func TestPoolSelectsTaggedTunnels(t *testing.T) {
+	pool := newIdlePool(&tunnelit.RoundRobin{})
+	conn, _ := pipeConn(t)
+	pool.Put(conn, "us", tunnelInfo{weight: 1, tags: map[string]string{
+		"region": "us",
+	}})
+	eu := tunnelFilter{sel: tunnelSelector{"region": "eu"}}
+	if _, ok := pool.TryGet(eu); ok {
+		t.Fatal("expected no conn from a tunnel not matching the selector")
+	}
+
+	got := make(chan pooledConn, 1)
+	go func() {
+		pc, _ := pool.Get(5*time.Second, eu)
+		got <- pc
+	}()
+	// Wait for the client to be waiting before adding the conns
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		pool.mtx.Lock()
+		n := len(pool.waiters)
+		pool.mtx.Unlock()
+		if n != 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("expected a waiting client")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conn, _ = pipeConn(t)
+	pool.Put(conn, "us2", tunnelInfo{weight: 1, tags: map[string]string{
+		"region": "us",
+	}})
+	conn, _ = pipeConn(t)
+	pool.Put(conn, "eu", tunnelInfo{weight: 1, tags: map[string]string{
+		"region": "eu", "tier": "gold",
+	}})
+	if pc := <-got; pc.tunnel == nil || pc.tunnel.id != "eu" {
+		t.Fatalf("expected the waiter to get the eu tunnel, got %v", pc.tunnel)
+	}
+	// The unmatched conn stays idle for clients without a selector
+	if pc, ok := pool.TryGet(tunnelFilter{}); !ok || pc.tunnel.id == "eu" {
+		t.Fatalf("expected a us tunnel's idle conn, got %v", pc.tunnel)
+	}
+}
+
+func TestServiceRouteSelector(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	web := newService("web", &ServiceConfig{
+		TunnelSelector: tunnelSelector{"region": "us"},
+		Routes: []*RouteConfig{
+			{
+				Service:        "web",
+				TunnelSelector: tunnelSelector{"region": "eu"},
+				nets:           []*net.IPNet{ipNet},
+			},
+		},
+	})
+	oldServices := services
+	services = map[string]*service{"web": web}
+	t.Cleanup(func() { services = oldServices })
+
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, "eu"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}, "us"},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, "us"},
+	}
+	for _, tt := range tests {
+		svc, sel := web.route(tt.addr, &exprEnv{})
+		if svc != web || sel["region"] != tt.want {
+			t.Fatalf("%s: expected region %s, got %v", tt.addr, tt.want, sel)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/johnietre/utils/go"
+)
+
+var (
+	// anonymizeIPs is how addresses are anonymized in the access logs
+	// ("truncate", "hash", or blank for not at all).
+	anonymizeIPs string
+	// anonymizeKey is the key addresses are hashed with. It's random per
+	// process so hashes can't be reversed by brute force across runs.
+	anonymizeKey []byte
+	// auditLogFile is the file the audit log (with full addresses) is written
+	// to (blank means disabled).
+	auditLogFile string
+	auditLogger  *log.Logger
+)
+
+// setupPrivacy validates the anonymization mode and opens the audit log.
+func setupPrivacy() error {
+	switch anonymizeIPs {
+	case "", "truncate":
+	case "hash":
+		anonymizeKey = make([]byte, 32)
+		if _, err := rand.Read(anonymizeKey); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf(`anonymize-ips must be "truncate" or "hash"`)
+	}
+	if auditLogFile != "" {
+		f, err := utils.OpenAppend(auditLogFile)
+		if err != nil {
+			return err
+		}
+		auditLogger = log.New(f, "", log.LstdFlags|log.LUTC)
+	}
+	return nil
+}
+
+// logAddr returns the address as it should appear in the access logs,
+// anonymized if enabled. Truncation keeps the /24 of IPv4 addresses and the
+// /48 of IPv6 addresses and drops the port.
+func logAddr(addr net.Addr) string {
+	if anonymizeIPs == "" {
+		return addr.String()
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return addr.String()
+	}
+	if anonymizeIPs == "hash" {
+		h := hmac.New(sha256.New, anonymizeKey)
+		h.Write(ip)
+		return "ip-" + hex.EncodeToString(h.Sum(nil)[:8])
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// addrIP returns the IP of the address, if it has one.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// audit writes to the audit log, if enabled. Addresses should be logged in
+// full.
+func audit(format string, args ...any) {
+	if auditLogger != nil {
+		auditLogger.Printf(format, args...)
+	}
+}
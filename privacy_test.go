@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setPrivacy sets the anonymization mode and audit log for the test.
+func setPrivacy(t *testing.T, mode, auditFile string) {
+	t.Helper()
+	oldMode, oldKey := anonymizeIPs, anonymizeKey
+	oldFile, oldLogger := auditLogFile, auditLogger
+	t.Cleanup(func() {
+		anonymizeIPs, anonymizeKey = oldMode, oldKey
+		auditLogFile, auditLogger = oldFile, oldLogger
+	})
+	anonymizeIPs, auditLogFile, auditLogger = mode, auditFile, nil
+	if err := setupPrivacy(); err != nil {
+		t.Fatal("error setting up privacy: ", err)
+	}
+}
+
+func TestLogAddr(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.123"), Port: 4321}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2::5"), Port: 4321}
+	unix := &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}
+
+	setPrivacy(t, "", "")
+	if got := logAddr(v4); got != "192.0.2.123:4321" {
+		t.Fatalf("expected the full address, got %s", got)
+	}
+
+	setPrivacy(t, "truncate", "")
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{v4, "192.0.2.0/24"},
+		{v6, "2001:db8:1::/48"},
+		{unix, "/tmp/sock"},
+	}
+	for _, tt := range tests {
+		if got := logAddr(tt.addr); got != tt.want {
+			t.Fatalf("%s: expected %s, got %s", tt.addr, tt.want, got)
+		}
+	}
+
+	setPrivacy(t, "hash", "")
+	h1 := logAddr(v4)
+	otherPort := &net.TCPAddr{IP: v4.IP, Port: 1}
+	if !strings.HasPrefix(h1, "ip-") || len(h1) != len("ip-")+16 {
+		t.Fatalf("expected a hashed address, got %s", h1)
+	} else if strings.Contains(h1, "192") {
+		t.Fatalf("expected the IP not to appear, got %s", h1)
+	} else if logAddr(otherPort) != h1 {
+		t.Fatal("expected the same IP to hash the same regardless of port")
+	} else if logAddr(v6) == h1 {
+		t.Fatal("expected different IPs to hash differently")
+	}
+	// Keys are random per process (here, per setup)
+	setPrivacy(t, "hash", "")
+	if logAddr(v4) == h1 {
+		t.Fatal("expected a new key to hash differently")
+	}
+}
+
+func TestSetupPrivacyInvalid(t *testing.T) {
+	oldMode := anonymizeIPs
+	t.Cleanup(func() { anonymizeIPs = oldMode })
+	anonymizeIPs = "scramble"
+	if err := setupPrivacy(); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	setPrivacy(t, "", "")
+	// Without an audit log, nothing is written
+	audit("Pipe between %s and %s closed", "a", "b")
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	setPrivacy(t, "truncate", path)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.123"), Port: 4321}
+	audit("Pipe from %s closed", addr)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("error reading audit log: ", err)
+	} else if !strings.Contains(string(b), "Pipe from 192.0.2.123:4321 closed") {
+		t.Fatalf("expected the full address in the audit log, got %q", b)
+	}
+}
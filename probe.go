@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	probeAddr string
+)
+
+// runProbe listens for availability probes. A probe client sends a service
+// name terminated by a newline and receives "yes\n" if the service currently
+// has a tunnel (with conns or mux sessions), or "no\n" otherwise (including
+// when the service doesn't exist). The default service is named by a blank
+// line.
+func runProbe(addr string) {
+	ln, err := net.Listen(tcpNetwork, addr)
+	if err != nil {
+		log.Fatal("Error starting probe listener: ", err)
+	}
+	log.Print("Listening for probes on ", addr)
+	serveProbes(ln)
+}
+
+// serveProbes answers the probes of the clients allowed to connect (so others
+// can't find out which services are live).
+func serveProbes(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if isClosedErr(err) {
+			return
+		} else if err != nil {
+			log.Fatal("Error accepting probe conn: ", err)
+		}
+		if !clientAllowed(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go handleProbeConn(conn)
+	}
+}
+
+func handleProbeConn(conn net.Conn) {
+	defer recoverConn("probe conn", conn)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	resp := "no\n"
+	svc, ok := getService(strings.TrimSpace(line))
+	if ok && svc.idle.hasTunnels(tunnelFilter{}) {
+		resp = "yes\n"
+	}
+	conn.Write([]byte(resp))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startProbes serves probes on a local address, returning the address.
+func startProbes(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveProbes(ln)
+	return ln.Addr().String()
+}
+
+// probe returns the answer to a probe for the service (blank if the conn was
+// closed without one).
+func probe(t *testing.T, addr, name string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("error dialing probe listener: ", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.WriteString(conn, name+"\n"); err != nil {
+		return ""
+	}
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return ""
+	}
+	return resp
+}
+
+func TestProbeDeniedClient(t *testing.T) {
+	oldAllow, oldDeny, oldServices := allowNets, denyNets, services
+	t.Cleanup(func() { allowNets, denyNets, services = oldAllow, oldDeny, oldServices })
+	svc := newService("svc", &ServiceConfig{})
+	services = map[string]*service{"svc": svc}
+	tunnelSide, proxySide := net.Pipe()
+	defer tunnelSide.Close()
+	svc.idle.Put(proxySide, "t", tunnelInfo{})
+	addr := startProbes(t)
+
+	if got := probe(t, addr, "svc"); got != "yes\n" {
+		t.Fatalf("expected allowed client answered yes, got %q", got)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	denyNets = []*net.IPNet{loopback}
+	if got := probe(t, addr, "svc"); got != "" {
+		t.Fatalf("expected denied client's conn closed, got %q", got)
+	}
+}
+
+func TestProbeMuxOnlyTunnel(t *testing.T) {
+	oldServices := services
+	t.Cleanup(func() { services = oldServices })
+	svc := newService("mux", &ServiceConfig{})
+	services = map[string]*service{"mux": svc}
+	addr := startProbes(t)
+
+	if got := probe(t, addr, "mux"); got != "no\n" {
+		t.Fatalf("expected no without tunnels, got %q", got)
+	}
+	opener, _ := newSessionPair(t)
+	svc.idle.putSession(opener, "t", tunnelInfo{weight: 1})
+	if got := probe(t, addr, "mux"); got != "yes\n" {
+		t.Fatalf("expected yes with a mux session, got %q", got)
+	}
+	if got := probe(t, addr, "other"); got != "no\n" {
+		t.Fatalf("expected no for an unknown service, got %q", got)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+)
+
+// The wire protocol lives in the library so that embedders (see
+// tunnelit.Listen) speak the same protocol.
+type (
+	Registration     = tunnelit.Registration
+	ServiceEndpoints = tunnelit.ServiceEndpoints
+	IdentityProof    = tunnelit.IdentityProof
+	DialRequest      = tunnelit.DialRequest
+	ClientInfo       = tunnelit.ClientInfo
+	LinkStatus       = tunnelit.LinkStatus
+)
+
+var (
+	writeMsg = tunnelit.WriteMsg
+	readMsg  = tunnelit.ReadMsg
+)
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The PROXY protocol (v1 and v2) lets the tunnel pass the addresses of the
+// clients (forwarded by the proxy; see tunnelit.ClientInfo) on to the servers,
+// which otherwise only see conns from the tunnel. The proxy can also accept it
+// from load balancers in front of its client listeners (see
+// ServiceConfig.AcceptProxyProtocol), so the addresses it uses and forwards
+// are the clients' rather than the load balancers'.
+
+// proxyProtoSig is the signature starting v2 headers.
+const proxyProtoSig = "\r\n\r\n\x00\r\nQUIT\n"
+
+var (
+	// tunnelProxyProtocol is the PROXY protocol version the default service's
+	// tunnel sends the servers ("v1" or "v2"; blank means none).
+	tunnelProxyProtocol string
+	// flagAcceptProxyProtocol is whether the default service's clients are
+	// preceded by PROXY protocol headers (overriding the config).
+	flagAcceptProxyProtocol bool
+)
+
+// proxyProtoMaxV1 is the longest v1 header, including the CRLF.
+const proxyProtoMaxV1 = 107
+
+// validProxyProtocol returns an error if the PROXY protocol version isn't
+// supported.
+func validProxyProtocol(version string) error {
+	switch version {
+	case "", "v1", "v2":
+		return nil
+	}
+	return fmt.Errorf("unsupported PROXY protocol version %q", version)
+}
+
+// proxyProtoHeader returns the PROXY protocol header of the given version for
+// a TCP conn from the client to the proxy. If either address isn't a TCP
+// address (or is blank), the header doesn't carry any addresses (UNKNOWN or
+// LOCAL), so the servers use the conn's own.
+func proxyProtoHeader(version string, info ClientInfo) []byte {
+	src, srcErr := net.ResolveTCPAddr("tcp", info.Addr)
+	dst, dstErr := net.ResolveTCPAddr("tcp", info.LocalAddr)
+	// Blank addresses (e.g., from proxies not forwarding them) resolve without
+	// an IP
+	known := srcErr == nil && dstErr == nil && src.IP != nil && dst.IP != nil
+	srcIP4, dstIP4 := net.IP(nil), net.IP(nil)
+	if known {
+		srcIP4, dstIP4 = src.IP.To4(), dst.IP.To4()
+	}
+	v4 := srcIP4 != nil && dstIP4 != nil
+	if version == "v1" {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto, srcIP, dstIP := "TCP6", src.IP.To16(), dst.IP.To16()
+		if v4 {
+			proto, srcIP, dstIP = "TCP4", srcIP4, dstIP4
+		}
+		return []byte(fmt.Sprintf(
+			"PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port,
+		))
+	}
+	hdr := []byte(proxyProtoSig)
+	if !known {
+		// LOCAL command, unspecified family
+		return append(hdr, 0x20, 0x00, 0, 0)
+	}
+	var addrs []byte
+	if v4 {
+		hdr = append(hdr, 0x21, 0x11)
+		addrs = append(append(addrs, srcIP4...), dstIP4...)
+	} else {
+		hdr = append(hdr, 0x21, 0x21)
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+// proxyProtoConn is a conn whose addresses were read from its PROXY protocol
+// header.
+type proxyProtoConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// NetConn returns the underlying conn.
+func (c *proxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyProtoHeader reads the conn's PROXY protocol header (v1 or v2),
+// returning the conn with the addresses from it. Headers without addresses
+// (UNKNOWN or LOCAL, e.g., from health checks) leave the conn's own.
+func readProxyProtoHeader(conn net.Conn) (net.Conn, error) {
+	// Both versions' headers are at least as long as the v2 signature
+	b := make([]byte, len(proxyProtoSig), proxyProtoMaxV1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return conn, err
+	}
+	if string(b) == proxyProtoSig {
+		return readProxyProtoV2(conn)
+	} else if !bytes.HasPrefix(b, []byte("PROXY ")) {
+		return conn, errors.New("missing PROXY protocol header")
+	}
+	// Read the rest of the v1 header a byte at a time so nothing after it is
+	// consumed
+	for !bytes.HasSuffix(b, []byte("\r\n")) {
+		if len(b) == proxyProtoMaxV1 {
+			return conn, errors.New("PROXY protocol v1 header too long")
+		}
+		b = b[:len(b)+1]
+		if _, err := io.ReadFull(conn, b[len(b)-1:]); err != nil {
+			return conn, err
+		}
+	}
+	fields := strings.Fields(string(b[:len(b)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return conn, nil
+	} else if len(fields) != 6 ||
+		(fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return conn, fmt.Errorf("invalid PROXY protocol v1 header %q", b)
+	}
+	src, err := parseProxyProtoAddr(fields[2], fields[4])
+	if err != nil {
+		return conn, fmt.Errorf("invalid PROXY protocol source: %w", err)
+	}
+	dst, err := parseProxyProtoAddr(fields[3], fields[5])
+	if err != nil {
+		return conn, fmt.Errorf("invalid PROXY protocol destination: %w", err)
+	}
+	return &proxyProtoConn{Conn: conn, remote: src, local: dst}, nil
+}
+
+// parseProxyProtoAddr parses an address of a v1 header, which must be an IP
+// (so a header can't make the proxy look up names).
+func parseProxyProtoAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyProtoV2 reads the rest of a v2 header, whose signature was read.
+func readProxyProtoV2(conn net.Conn) (net.Conn, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return conn, err
+	} else if hdr[0]>>4 != 2 {
+		return conn, fmt.Errorf("unsupported PROXY protocol version %d", hdr[0]>>4)
+	}
+	// The addresses are followed by any TLVs, which are skipped
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return conn, err
+	}
+	cmd, family := hdr[0]&0x0F, hdr[1]>>4
+	if cmd == 0 {
+		// LOCAL
+		return conn, nil
+	}
+	ipLen := 0
+	switch family {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// Unspecified or Unix addresses
+		return conn, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return conn, errors.New("PROXY protocol v2 addresses too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return &proxyProtoConn{Conn: conn, remote: src, local: dst}, nil
+}
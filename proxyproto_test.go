@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+func TestProxyProtoRoundTrip(t *testing.T) {
+	v4 := ClientInfo{Addr: "203.0.113.7:4321", LocalAddr: "198.51.100.1:443"}
+	v6 := ClientInfo{Addr: "[2001:db8::7]:4321", LocalAddr: "[2001:db8::1]:443"}
+	// unknown has no TCP addresses (e.g., a client of a udp service)
+	unknown := ClientInfo{}
+	tests := []struct {
+		name    string
+		version string
+		info    ClientInfo
+		// known is whether the header carries the addresses.
+		known bool
+	}{
+		{name: "v1 IPv4", version: "v1", info: v4, known: true},
+		{name: "v1 IPv6", version: "v1", info: v6, known: true},
+		{name: "v1 unknown", version: "v1", info: unknown},
+		{name: "v2 IPv4", version: "v2", info: v4, known: true},
+		{name: "v2 IPv6", version: "v2", info: v6, known: true},
+		{name: "v2 local", version: "v2", info: unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := proxyProtoHeader(tt.version, tt.info)
+			conn, _ := scriptedConn(t, append(hdr, "payload"...))
+			got, err := readProxyProtoHeader(conn)
+			if err != nil {
+				t.Fatal("error reading header: ", err)
+			}
+			if !tt.known {
+				if got != conn {
+					t.Fatalf("expected the conn's own addresses, got %v", got.RemoteAddr())
+				}
+			} else if got.RemoteAddr().String() != tt.info.Addr {
+				t.Fatalf("expected remote %s, got %s", tt.info.Addr, got.RemoteAddr())
+			} else if got.LocalAddr().String() != tt.info.LocalAddr {
+				t.Fatalf("expected local %s, got %s", tt.info.LocalAddr, got.LocalAddr())
+			}
+			// Nothing after the header is consumed
+			if rest, err := io.ReadAll(got); err != nil || string(rest) != "payload" {
+				t.Fatalf("expected payload after header, got %q (err: %v)", rest, err)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtoHeaderInvalid(t *testing.T) {
+	v2 := func(b ...byte) []byte {
+		return append([]byte(proxyProtoSig), b...)
+	}
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "empty"},
+		{name: "missing", input: []byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 203.0.113.7")},
+		{
+			name:  "v1 too long",
+			input: []byte("PROXY TCP4 " + strings.Repeat("1", proxyProtoMaxV1) + "\r\n"),
+		},
+		{name: "v1 missing ports", input: []byte("PROXY TCP4 203.0.113.7 198.51.100.1\r\n")},
+		{name: "v1 unknown protocol", input: []byte("PROXY UDP4 203.0.113.7 198.51.100.1 1 2\r\n")},
+		{name: "v1 hostname", input: []byte("PROXY TCP4 example.com 198.51.100.1 1 2\r\n")},
+		{name: "v1 invalid port", input: []byte("PROXY TCP4 203.0.113.7 198.51.100.1 65536 2\r\n")},
+		{name: "v2 unsupported version", input: v2(0x11, 0x11, 0, 0)},
+		{name: "v2 truncated", input: v2(0x21, 0x11, 0, 12, 203, 0, 113)},
+		{name: "v2 addresses too short", input: v2(0x21, 0x11, 0, 4, 203, 0, 113, 7)},
+		{name: "v2 IPv6 addresses too short", input: v2(0x21, 0x21, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _ := scriptedConn(t, tt.input)
+			if got, err := readProxyProtoHeader(conn); err == nil {
+				t.Fatalf("expected error, got remote %v", got.RemoteAddr())
+			}
+		})
+	}
+}
+
+func TestProxyProtoHeaderSkipsTLVs(t *testing.T) {
+	hdr := proxyProtoHeader("v2", ClientInfo{
+		Addr: "203.0.113.7:4321", LocalAddr: "198.51.100.1:443",
+	})
+	// Append a TLV (type 0x04, a NOOP) and grow the length to cover it
+	tlv := []byte{0x04, 0, 2, 0, 0}
+	hdr[len(proxyProtoSig)+3] += byte(len(tlv))
+	input := append(append(hdr, tlv...), "payload"...)
+	conn, _ := scriptedConn(t, input)
+	got, err := readProxyProtoHeader(conn)
+	if err != nil {
+		t.Fatal("error reading header: ", err)
+	} else if got.RemoteAddr().String() != "203.0.113.7:4321" {
+		t.Fatalf("expected remote 203.0.113.7:4321, got %s", got.RemoteAddr())
+	}
+	if rest, _ := io.ReadAll(got); !bytes.Equal(rest, []byte("payload")) {
+		t.Fatalf("expected payload after TLVs, got %q", rest)
+	}
+}
+
+func TestTunnelServiceProxyProtocolConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		sc   TunnelServiceConfig
+		ok   bool
+	}{
+		{name: "v1", sc: TunnelServiceConfig{ProxyProtocol: "v1"}, ok: true},
+		{name: "v2", sc: TunnelServiceConfig{ProxyProtocol: "v2"}, ok: true},
+		{name: "v3", sc: TunnelServiceConfig{ProxyProtocol: "v3"}},
+		{name: "udp", sc: TunnelServiceConfig{ProxyProtocol: "v1", UDP: true}},
+	}
+	for _, tt := range tests {
+		tt.sc.Saddrs = []string{"127.0.0.1:1"}
+		if err := tt.sc.parse(); (err == nil) != tt.ok {
+			t.Fatalf("%s: expected ok to be %v, got %v", tt.name, tt.ok, err)
+		}
+	}
+	sc := &TunnelServiceConfig{
+		Saddrs: []string{"127.0.0.1:1"}, ProxyProtocol: "v2",
+	}
+	if err := sc.parse(); err != nil {
+		t.Fatal(err)
+	} else if !newTunnelService("web", sc).reg.ClientInfo {
+		t.Fatal("expected the tunnel to ask for the clients' info")
+	}
+}
+
+func TestServeReadyProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	remotes := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if conn, err = readProxyProtoHeader(conn); err != nil {
+			remotes <- err.Error()
+			return
+		}
+		remotes <- conn.RemoteAddr().String()
+		io.Copy(conn, conn)
+	}()
+
+	sc := &TunnelServiceConfig{
+		Saddrs: []string{ln.Addr().String()}, ProxyProtocol: "v1",
+	}
+	if err := sc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTunnelService("web", sc)
+	tunnelSide, proxySide := net.Pipe()
+	defer proxySide.Close()
+	proxySide.SetDeadline(time.Now().Add(5 * time.Second))
+	released := make(chan utils.Unit, 1)
+	go ts.serveReady(tunnelSide, connReady, func() {
+		released <- utils.Unit{}
+	})
+	info := ClientInfo{Addr: "203.0.113.7:4321", LocalAddr: "198.51.100.1:443"}
+	if err := writeMsg(proxySide, info); err != nil {
+		t.Fatal("error writing client info: ", err)
+	}
+	b := []byte{0}
+	if _, err := io.ReadFull(proxySide, b); err != nil || b[0] != connReady {
+		t.Fatalf("expected ready byte, got %d (err: %v)", b[0], err)
+	}
+	<-released
+	if got := <-remotes; got != info.Addr {
+		t.Fatalf("expected the server to get the client's address, got %s", got)
+	}
+	go proxySide.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(proxySide, got); err != nil || string(got) != "ping" {
+		t.Fatalf("expected the server's echo, got %q (err: %v)", got, err)
+	}
+}
+
+func TestReadyExchangeClientInfo(t *testing.T) {
+	// A loopback conn, so the client has TCP addresses
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("error dialing: ", err)
+	}
+	defer dialed.Close()
+	clientConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("error accepting: ", err)
+	}
+	defer clientConn.Close()
+
+	for _, clientInfo := range []bool{true, false} {
+		tunnelSide, proxySide := net.Pipe()
+		defer tunnelSide.Close()
+		tunnelSide.SetDeadline(time.Now().Add(5 * time.Second))
+		infos := make(chan ClientInfo, 1)
+		go func() {
+			b := []byte{0}
+			if _, err := io.ReadFull(tunnelSide, b); err != nil {
+				return
+			}
+			var info ClientInfo
+			if clientInfo {
+				if err := readMsg(tunnelSide, &info); err != nil {
+					return
+				}
+			}
+			infos <- info
+			tunnelSide.Write([]byte{connReady})
+		}()
+		pc := pooledConn{Conn: proxySide, clientInfo: clientInfo}
+		if err := readyExchange(pc, clientConn, nil); err != nil {
+			t.Fatal("error in ready exchange: ", err)
+		}
+		want := ClientInfo{}
+		if clientInfo {
+			want = ClientInfo{
+				Addr:      clientConn.RemoteAddr().String(),
+				LocalAddr: clientConn.LocalAddr().String(),
+			}
+		}
+		if got := <-infos; got != want {
+			t.Fatalf("expected client info %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestListenClientsAcceptProxyProtocol(t *testing.T) {
+	oldReadyCh := readyCh
+	readyCh = make(chan utils.Unit, 10)
+	t.Cleanup(func() { readyCh = oldReadyCh })
+	// The header's address is checked rather than the conn's
+	setCIDRs(t, nil, []string{"192.0.2.0/24"}, nil)
+	sc := &ServiceConfig{AcceptProxyProtocol: true}
+	if err := sc.parseSchedule(); err != nil {
+		t.Fatal("error parsing schedule: ", err)
+	}
+	svc := newService("web", sc)
+
+	// A tunnel asking for the clients' info, which it sends on infos
+	infos := make(chan ClientInfo, 1)
+	tunnelSide, proxySide := net.Pipe()
+	t.Cleanup(func() { tunnelSide.Close() })
+	go func() {
+		b := []byte{0}
+		if _, err := io.ReadFull(tunnelSide, b); err != nil {
+			return
+		}
+		var info ClientInfo
+		if err := readMsg(tunnelSide, &info); err != nil {
+			return
+		}
+		infos <- info
+		tunnelSide.Write([]byte{connReady})
+		io.Copy(tunnelSide, tunnelSide)
+	}()
+	svc.idle.Put(proxySide, "a", tunnelInfo{weight: 1, clientInfo: true})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	go listenClients(svc, ln)
+	dial := func(hdr string) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("error dialing: ", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(hdr + "ping")); err != nil {
+			t.Fatal("error writing: ", err)
+		}
+		return conn
+	}
+
+	for _, hdr := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.0.2.7 127.0.0.1 4321 443\r\n",
+	} {
+		_, err := dial(hdr).Read(make([]byte, 1))
+		if nerr, ok := err.(net.Error); err == nil || (ok && nerr.Timeout()) {
+			t.Fatalf("%q: expected the client to be closed, got %v", hdr, err)
+		}
+	}
+
+	conn := dial("PROXY TCP4 203.0.113.7 127.0.0.1 4321 443\r\n")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("expected the client piped, got %q (err: %v)", b, err)
+	} else if info := <-infos; info.Addr != "203.0.113.7:4321" {
+		t.Fatalf("expected the header's address forwarded, got %s", info.Addr)
+	}
+}
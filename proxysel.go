@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+)
+
+const (
+	// proxySwitchHysteresis is how much faster (as a fraction of the current
+	// proxy's RTT) another proxy must be to switch to it.
+	proxySwitchHysteresis = 0.8
+	// proxyDrainInterval is the time between closing each idle conn to the
+	// previous proxy after switching, so the pool moves over gradually.
+	proxyDrainInterval = 100 * time.Millisecond
+)
+
+// selectInterval is how often the proxies' RTTs are measured.
+var selectInterval time.Duration
+
+// proxySelector picks which of the proxies the tunnel keeps its idle conns
+// on, preferring the one with the lowest measured RTT.
+type proxySelector struct {
+	addrs []string
+	// service is the service registered for when measuring.
+	service string
+
+	mtx sync.Mutex
+	// rtts are the smoothed RTTs of each proxy (0 if unreachable).
+	rtts    []time.Duration
+	current int
+}
+
+func newProxySelector(addrs []string, service string) *proxySelector {
+	return &proxySelector{
+		addrs: addrs, service: service, rtts: make([]time.Duration, len(addrs)),
+	}
+}
+
+// Current returns the address of the proxy in use.
+func (ps *proxySelector) Current() string {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	return ps.addrs[ps.current]
+}
+
+// run measures the proxies' RTTs every interval, switching proxies (and
+// draining the previous proxy's idle conns) when another is sufficiently
+// faster.
+func (ps *proxySelector) run() {
+	for range time.Tick(selectInterval) {
+		if prev, ok := ps.measure(); ok {
+			for _, ts := range allTunnelServices() {
+				go ts.drain(prev)
+			}
+		}
+	}
+}
+
+// measure measures each proxy's RTT, switching to the fastest if needed. If
+// it switched, the previous proxy's address is returned.
+func (ps *proxySelector) measure() (string, bool) {
+	rtts := make([]time.Duration, len(ps.addrs))
+	var wg sync.WaitGroup
+	for i, addr := range ps.addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			rtt, err := measureProxy(addr, ps.service)
+			if err != nil {
+				log.Printf("Error measuring RTT to proxy %s: %v", addr, err)
+				return
+			}
+			rtts[i] = rtt
+		}(i, addr)
+	}
+	wg.Wait()
+
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	best := -1
+	for i, rtt := range rtts {
+		if rtt == 0 {
+			ps.rtts[i] = 0
+			continue
+		}
+		if ps.rtts[i] == 0 {
+			ps.rtts[i] = rtt
+		} else {
+			ps.rtts[i] = (ps.rtts[i]*7 + rtt) / 8
+		}
+		if best == -1 || ps.rtts[i] < ps.rtts[best] {
+			best = i
+		}
+	}
+	cur := ps.current
+	if best == -1 || best == cur {
+		return "", false
+	}
+	if ps.rtts[cur] != 0 &&
+		float64(ps.rtts[best]) >= float64(ps.rtts[cur])*proxySwitchHysteresis {
+		return "", false
+	}
+	log.Printf(
+		"Switching from proxy %s (RTT %s) to %s (RTT %s)",
+		ps.addrs[cur], fmtRTT(ps.rtts[cur]), ps.addrs[best], fmtRTT(ps.rtts[best]),
+	)
+	ps.current = best
+	return ps.addrs[cur], true
+}
+
+// measureProxy handshakes with the proxy and returns the RTT of a heartbeat.
+func measureProxy(addr, service string) (time.Duration, error) {
+	conn, err := dialProxy(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+	status, err := proxyHandshake(conn, Registration{Service: service, Ping: true})
+	if err != nil {
+		return 0, err
+	} else if status != passwordOk {
+		return 0, errors.New(tunnelit.StatusText(status))
+	}
+	start := time.Now()
+	b := []byte{heartbeatByte}
+	if _, err := conn.Write(b); err != nil {
+		return 0, err
+	} else if _, err := conn.Read(b); err != nil {
+		return 0, err
+	} else if b[0] != heartbeatByte {
+		return 0, fmt.Errorf("unexpected response %d", b[0])
+	}
+	return time.Since(start), nil
+}
+
+// trackIdle records that the conn to the proxy is idle (until the returned
+// func is called).
+func (ts *tunnelService) trackIdle(conn net.Conn, proxyAddr string) func() {
+	ts.idleMtx.Lock()
+	defer ts.idleMtx.Unlock()
+	if ts.stopped {
+		// The service was removed, so don't keep the conn
+		conn.Close()
+	}
+	ts.idle[conn] = proxyAddr
+	return func() {
+		ts.idleMtx.Lock()
+		defer ts.idleMtx.Unlock()
+		delete(ts.idle, conn)
+	}
+}
+
+// drain closes the service's idle conns to the proxy one at a time, so that
+// they're replaced by conns to the current proxy.
+func (ts *tunnelService) drain(proxyAddr string) {
+	ts.idleMtx.Lock()
+	var conns []net.Conn
+	for conn, addr := range ts.idle {
+		if addr == proxyAddr {
+			conns = append(conns, conn)
+		}
+	}
+	ts.idleMtx.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+		time.Sleep(proxyDrainInterval)
+	}
+}
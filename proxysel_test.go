@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+)
+
+// setTestPassword sets the password to the test proxy's default.
+func setTestPassword(t *testing.T) {
+	t.Helper()
+	oldHash, _ := passwordHash.LoadSafe()
+	passwordHash.Store(sha256.Sum256([]byte(tunnelittest.DefaultPassword)))
+	t.Cleanup(func() { passwordHash.Store(oldHash) })
+}
+
+func TestProxySelectorMeasure(t *testing.T) {
+	setTestPassword(t)
+	down := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{
+		Faults: tunnelittest.Faults{RejectStatus: tunnelit.StatusDraining},
+	})
+	up := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{})
+	if rtt, err := measureProxy(up.TunnelAddr, ""); err != nil {
+		t.Fatal("error measuring proxy: ", err)
+	} else if rtt <= 0 {
+		t.Fatalf("expected a positive RTT, got %s", rtt)
+	}
+	if _, err := measureProxy(down.TunnelAddr, ""); err == nil {
+		t.Fatal("expected an error measuring a rejecting proxy")
+	}
+
+	ps := newProxySelector([]string{down.TunnelAddr, up.TunnelAddr}, "")
+	if prev, ok := ps.measure(); !ok || prev != down.TunnelAddr {
+		t.Fatalf("expected to switch from the down proxy, got %q, %v", prev, ok)
+	} else if ps.Current() != up.TunnelAddr {
+		t.Fatalf("expected the up proxy to be current, got %s", ps.Current())
+	}
+	if _, ok := ps.measure(); ok {
+		t.Fatal("expected to stay on the only reachable proxy")
+	}
+
+	// Another proxy must be sufficiently faster to switch to
+	other := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{})
+	ps = newProxySelector([]string{up.TunnelAddr, other.TunnelAddr}, "")
+	ps.rtts[0], ps.rtts[1] = 10*time.Millisecond, 10*time.Millisecond
+	if _, ok := ps.measure(); ok {
+		t.Fatal("expected to keep the current proxy within the hysteresis")
+	}
+	ps.rtts[0] = time.Second
+	if prev, ok := ps.measure(); !ok || prev != up.TunnelAddr {
+		t.Fatalf("expected to switch from the slow proxy, got %q, %v", prev, ok)
+	}
+}
+
+func TestTunnelServiceDrain(t *testing.T) {
+	ts := newTunnelService("web", &TunnelServiceConfig{
+		Saddrs: []string{"127.0.0.1:8080"},
+	})
+	var oldConns, newConns []net.Conn
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		ts.trackIdle(c1, "old:1")
+		oldConns = append(oldConns, c2)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	untrack := ts.trackIdle(c1, "new:1")
+	newConns = append(newConns, c2)
+
+	ts.drain("old:1")
+	for _, conn := range oldConns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("expected the old proxy's conns to be closed, got ", err)
+		}
+	}
+	for _, conn := range newConns {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("expected the new proxy's conn to be kept, got ", err)
+		}
+	}
+	// Conns are tracked until their owners untrack them
+	untrack()
+	if len(ts.idle) != 2 {
+		t.Fatalf("expected 2 tracked conns, got %d", len(ts.idle))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// encodeQR encodes the data as a QR code at error correction level L (the
+// smallest version holding it, up to version 40), returning its modules (true
+// is dark) without a quiet zone, indexed by row and then column.
+func encodeQR(data []byte) ([][]bool, error) {
+	q, err := qrcode.New(string(data), qrcode.Low)
+	if err != nil {
+		return nil, err
+	}
+	q.DisableBorder = true
+	return q.Bitmap(), nil
+}
+
+// renderQR writes the QR code to a terminal, two rows per line, with a quiet
+// zone around it. The colors are set explicitly so it scans on both light and
+// dark terminals.
+func renderQR(w io.Writer, modules [][]bool) {
+	const quiet = 4
+	size := len(modules)
+	light := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		if x < 0 || x >= size || y < 0 || y >= size {
+			return true
+		}
+		return !modules[y][x]
+	}
+	var sb strings.Builder
+	for y := 0; y < size+quiet*2; y += 2 {
+		// White foreground (light modules) on a black background
+		sb.WriteString("\x1b[97;40m")
+		for x := 0; x < size+quiet*2; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\x1b[0m\n")
+	}
+	io.WriteString(w, sb.String())
+}
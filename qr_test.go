@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEncodeQR(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		// size is the expected number of modules on a side (0 if an error is
+		// expected).
+		size int
+	}{
+		{name: "version 1", data: "tcp://a.io:1", size: 21},
+		{name: "version 2", data: "tcp://proxy.example.com:12345", size: 25},
+		{name: "version 7", data: strings.Repeat("e", 150), size: 45},
+		{name: "version 40", data: strings.Repeat("e", 2953), size: 177},
+		{name: "too long", data: strings.Repeat("e", 2954)},
+	}
+	// finder is a finder pattern's rows (the top left, top right and bottom
+	// left corners of every code).
+	finder := []string{
+		"#######",
+		"#.....#",
+		"#.###.#",
+		"#.###.#",
+		"#.###.#",
+		"#.....#",
+		"#######",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := encodeQR([]byte(tt.data))
+			if tt.size == 0 {
+				if err == nil {
+					t.Fatal("expected error encoding")
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error encoding: ", err)
+			} else if len(m) != tt.size {
+				t.Fatalf("expected %d rows, got %d", tt.size, len(m))
+			}
+			for y, row := range m {
+				if len(row) != tt.size {
+					t.Fatalf("row %d: expected %d modules, got %d", y, tt.size, len(row))
+				}
+			}
+			for _, corner := range [][2]int{{0, 0}, {tt.size - 7, 0}, {0, tt.size - 7}} {
+				for y, row := range finder {
+					for x, c := range row {
+						if m[corner[1]+y][corner[0]+x] != (c == '#') {
+							t.Fatalf("expected finder pattern at %v", corner)
+						}
+					}
+				}
+			}
+			// Timing patterns alternate between the finders
+			for i := 8; i < tt.size-8; i++ {
+				if m[6][i] != (i%2 == 0) || m[i][6] != (i%2 == 0) {
+					t.Fatalf("expected timing pattern module at %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderQR(t *testing.T) {
+	m, err := encodeQR([]byte("tcp://a.io:1"))
+	if err != nil {
+		t.Fatal("error encoding: ", err)
+	}
+	var buf bytes.Buffer
+	renderQR(&buf, m)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	// 21 modules with a 4-module quiet zone on each side, two rows per line
+	if len(lines) != 15 {
+		t.Fatalf("expected 15 lines, got %d", len(lines))
+	}
+	for i, line := range lines {
+		line = strings.TrimPrefix(line, "\x1b[97;40m")
+		line = strings.TrimSuffix(line, "\x1b[0m")
+		if n := utf8.RuneCountInString(line); n != 29 {
+			t.Fatalf("line %d: expected 29 columns, got %d", i, n)
+		}
+		if i < 2 && line != strings.Repeat("█", 29) {
+			t.Fatalf("line %d: expected quiet zone, got %q", i, line)
+		}
+	}
+	// The first line after the quiet zone has its last column, then the top
+	// left finder's first column (dark) and second (dark over light)
+	runes := []rune(strings.TrimPrefix(lines[2], "\x1b[97;40m"))
+	if got := string(runes[3:6]); got != "█ ▄" {
+		t.Fatalf("expected the finder's corner after the quiet zone, got %q", got)
+	}
+}
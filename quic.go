@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// With the QUIC transport (the tunnel's transport quic), the tunnel keeps a
+// single QUIC connection to each proxy (served on tunnel-quic-addr), and each
+// of its tunnel conns is a stream of it, so conns cost neither a socket nor a
+// handshake of their own, and a lost packet only stalls the stream it was for.
+// QUIC's TLS 1.3 encrypts the link, so it requires "tls" on both sides (whose
+// certs and client certs are used as usual). The usual handshake and piping
+// happen inside each stream. Its datagrams can carry FEC for lossy links (see
+// fec.go).
+
+// quicALPN is the ALPN protocol of the QUIC transport.
+const quicALPN = "tunnelit"
+
+const (
+	// quicMaxStreams is the max number of streams (tunnel conns) a tunnel's
+	// QUIC connection may have open at once.
+	quicMaxStreams = 1 << 16
+	// quicKeepAlive is how often idle QUIC connections are kept alive.
+	quicKeepAlive = 15 * time.Second
+)
+
+var (
+	// tunnelQUICAddr is the UDP address the proxy accepts QUIC tunnels on
+	// (blank means none).
+	tunnelQUICAddr string
+
+	// quicConns are the tunnel's QUIC connections, keyed by the proxy
+	// address.
+	quicConns = struct {
+		sync.Mutex
+		conns map[string]*quic.Conn
+	}{conns: make(map[string]*quic.Conn)}
+)
+
+// quicConfig returns the config of QUIC connections on either side.
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: idleTimeout,
+		MaxIncomingStreams:   quicMaxStreams,
+		KeepAlivePeriod:      quicKeepAlive,
+		// Leave room for the FEC header (see fec.go)
+		DisablePathMTUDiscovery: fecEnabled(),
+	}
+}
+
+// fecTransport returns a QUIC transport with FEC over a UDP socket bound to
+// the address.
+func fecTransport(addr string) (*quic.Transport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := newFECConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &quic.Transport{Conn: fc}, nil
+}
+
+// closeTransport closes the transport along with its socket.
+func closeTransport(tr *quic.Transport) {
+	tr.Close()
+	tr.Conn.Close()
+}
+
+// quicConn is a stream of a QUIC connection used as a tunnel conn.
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes both directions of the stream (the stream's Close only closes
+// the write direction).
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// ConnectionState returns the state of the connection's TLS.
+func (c *quicConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// serveQUIC accepts QUIC tunnels on the (UDP) address, handing their streams
+// to the listener's Accept.
+func (l *tunnelListener) serveQUIC(addr string) error {
+	if tlsConfig == nil {
+		return errors.New(`"tunnel-quic-addr" requires "tls"`)
+	} else if err := validFEC(); err != nil {
+		return err
+	}
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = []string{quicALPN}
+	var ln *quic.Listener
+	if fecEnabled() {
+		tr, err := fecTransport(addr)
+		if err != nil {
+			return err
+		}
+		if ln, err = tr.Listen(cfg, quicConfig()); err != nil {
+			closeTransport(tr)
+			return err
+		}
+	} else {
+		var err error
+		if ln, err = quic.ListenAddr(addr, cfg, quicConfig()); err != nil {
+			return err
+		}
+	}
+	log.Print("Listening for QUIC tunnels on ", ln.Addr())
+	go func() {
+		for {
+			qc, err := ln.Accept(context.Background())
+			if err != nil {
+				log.Fatal("Error accepting QUIC tunnel: ", err)
+			}
+			go l.acceptStreams(qc)
+		}
+	}()
+	return nil
+}
+
+// acceptStreams hands the connection's streams to the listener's Accept until
+// the connection closes.
+func (l *tunnelListener) acceptStreams(qc *quic.Conn) {
+	for {
+		st, err := qc.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		l.conns <- &quicConn{Stream: st, conn: qc}
+	}
+}
+
+// dialQUIC opens a stream to the proxy at the address, connecting to it first
+// if there's no connection to it yet (or it was lost).
+func dialQUIC(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), idleTimeout)
+	defer cancel()
+	qc, err := quicConnTo(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	st, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		// Redialed next time if the connection was lost
+		return nil, err
+	}
+	return &quicConn{Stream: st, conn: qc}, nil
+}
+
+// quicConnTo returns the connection to the proxy at the address, connecting to
+// it if there's none that's still open.
+func quicConnTo(ctx context.Context, addr string) (*quic.Conn, error) {
+	quicConns.Lock()
+	defer quicConns.Unlock()
+	if qc := quicConns.conns[addr]; qc != nil && qc.Context().Err() == nil {
+		return qc, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = []string{quicALPN}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	var qc *quic.Conn
+	if fecEnabled() {
+		qc, err = dialFEC(ctx, addr, cfg)
+	} else {
+		qc, err = quic.DialAddr(ctx, addr, cfg, quicConfig())
+	}
+	if err != nil {
+		return nil, err
+	}
+	quicConns.conns[addr] = qc
+	return qc, nil
+}
+
+// dialFEC connects to the proxy at the address over its own transport with
+// FEC, which is closed along with the connection.
+func dialFEC(
+	ctx context.Context, addr string, cfg *tls.Config,
+) (*quic.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := fecTransport(":0")
+	if err != nil {
+		return nil, err
+	}
+	qc, err := tr.Dial(ctx, udpAddr, cfg, quicConfig())
+	if err != nil {
+		closeTransport(tr)
+		return nil, err
+	}
+	go func() {
+		<-qc.Context().Done()
+		closeTransport(tr)
+	}()
+	return qc, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// setupTestQUIC serves QUIC tunnels on a local address, returning the
+// listener and the address, with tlsConfig set up for both sides.
+func setupTestQUIC(t *testing.T) (*tunnelListener, string) {
+	t.Helper()
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "localhost")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	oldConfig := tlsConfig
+	tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert}, RootCAs: roots, ServerName: "localhost",
+	}
+	t.Cleanup(func() {
+		tlsConfig = oldConfig
+		quicConns.Lock()
+		defer quicConns.Unlock()
+		for addr, qc := range quicConns.conns {
+			qc.CloseWithError(0, "")
+			delete(quicConns.conns, addr)
+		}
+	})
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcpLn.Close() })
+	// Find a free UDP port
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	ln := newTunnelListener(tcpLn)
+	if err := ln.serveQUIC(addr); err != nil {
+		t.Fatal("error serving QUIC: ", err)
+	}
+	return ln, addr
+}
+
+// acceptTimeout accepts a conn from the listener, failing after a second.
+func acceptTimeout(t *testing.T, ln *tunnelListener) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-ln.conns:
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("timed out accepting conn")
+		return nil
+	}
+}
+
+func TestQUICTransport(t *testing.T) {
+	ln, addr := setupTestQUIC(t)
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := dialQUIC(addr)
+		if err != nil {
+			t.Fatal("error dialing: ", err)
+		}
+		defer conn.Close()
+		// Streams are only seen once written to, as tunnels do first
+		if _, err := conn.Write([]byte{byte(i)}); err != nil {
+			t.Fatal("error writing: ", err)
+		}
+		conns = append(conns, conn)
+	}
+	if len(quicConns.conns) != 1 {
+		t.Fatalf("expected the streams to share a connection, got %d", len(quicConns.conns))
+	}
+	for range conns {
+		accepted := acceptTimeout(t, ln)
+		b := []byte{0}
+		if _, err := io.ReadFull(accepted, b); err != nil {
+			t.Fatal("error reading: ", err)
+		}
+		if _, err := accepted.Write(b); err != nil {
+			t.Fatal("error echoing: ", err)
+		}
+		if clientCertName(accepted) != "" {
+			t.Fatal("expected no client cert name")
+		}
+		accepted.Close()
+		conn := conns[b[0]]
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal("error reading echo: ", err)
+		} else if _, err := conn.Read(b); err != io.EOF {
+			t.Fatalf("expected EOF after peer closed, got %v", err)
+		}
+	}
+
+	// A lost connection is replaced
+	quicConns.Lock()
+	quicConns.conns[addr].CloseWithError(0, "")
+	quicConns.Unlock()
+	conn, err := dialQUIC(addr)
+	if err != nil {
+		t.Fatal("error redialing: ", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0})
+	acceptTimeout(t, ln).Close()
+}
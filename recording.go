@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// recordingMagic starts each recording file. It's followed by the 8-byte
+	// ID of the key the recording is encrypted with and the file's nonce.
+	recordingMagic = "TUNNELIT-RECORDING\x01"
+	// recordingChunkSize is the amount of plaintext sealed in each chunk of a
+	// recording (so up to this much is lost if the proxy dies mid-session).
+	recordingChunkSize = 64 << 10
+	// recordingIndexName is the name of the index in the recording directory.
+	recordingIndexName = "index.jsonl"
+	// recordingPruneInterval is how often recordings past the retention are
+	// removed.
+	recordingPruneInterval = time.Hour
+)
+
+var (
+	// recordDir is the directory the recordings of the services with
+	// recording enabled are written to (blank means recording is disabled).
+	recordDir string
+	// recordKeyFile is the file holding the hex-encoded AES-256 key the
+	// recordings are encrypted with.
+	recordKeyFile string
+	// recordRetention is how long recordings are kept (e.g., 90d; blank means
+	// forever).
+	recordRetention string
+
+	recordKey      *recordingKey
+	recordIndexMtx sync.Mutex
+)
+
+// recordingKey is a key recordings are encrypted with.
+type recordingKey struct {
+	aead cipher.AEAD
+	// id identifies the key (without revealing it) so that recordings
+	// encrypted with another key are reported as such.
+	id [8]byte
+}
+
+// loadRecordingKey loads the hex-encoded AES-256 key from the file.
+func loadRecordingKey(path string) (*recordingKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf(
+			"%s must hold a hex-encoded 32-byte key (e.g., from \"openssl rand -hex 32\")",
+			path,
+		)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	rk := &recordingKey{aead: aead}
+	sum := sha256.Sum256(append([]byte("tunnelit recording key\x00"), key...))
+	copy(rk.id[:], sum[:])
+	return rk, nil
+}
+
+// setupRecording loads the recording key and starts removing recordings past
+// the retention. Recording is disabled if there's no recording directory.
+func setupRecording() error {
+	if recordDir == "" {
+		return nil
+	} else if recordKeyFile == "" {
+		return errors.New(`Must provide "record-key-file" with "record-dir"`)
+	}
+	retention, err := parseDays(recordRetention)
+	if err != nil {
+		return fmt.Errorf("error parsing record-retention: %w", err)
+	}
+	if recordKey, err = loadRecordingKey(recordKeyFile); err != nil {
+		return fmt.Errorf("error loading recording key: %w", err)
+	}
+	if err := os.MkdirAll(recordDir, 0700); err != nil {
+		return err
+	}
+	if retention > 0 {
+		go func() {
+			for {
+				pruneRecordings(time.Now().Add(-retention))
+				time.Sleep(recordingPruneInterval)
+			}
+		}()
+	}
+	return nil
+}
+
+// startRecording starts recording all of the pipe's traffic to a new
+// encrypted file in the recording directory. The conns' full addresses are
+// recorded (regardless of the anonymization mode). Should writing the
+// recording fail, the conns are closed so that nothing goes unrecorded.
+func startRecording(ap *activePipe, conn1, conn2 net.Conn) (*pipeCapture, error) {
+	if recordKey == nil {
+		return nil, errors.New("recording isn't enabled (see record-dir)")
+	}
+	f, err := os.CreateTemp(recordDir, fmt.Sprintf(
+		"tunnelit-rec-%s-%d-*.trec", ap.start.UTC().Format("20060102T150405Z"), ap.id,
+	))
+	if err != nil {
+		return nil, err
+	}
+	sw, err := newSealWriter(f, recordKey)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	entry := RecordingEntry{
+		File: filepath.Base(f.Name()), PipeID: ap.id,
+		Service: ap.service, Tunnel: ap.tunnel,
+		ClientAddr: conn1.RemoteAddr().String(),
+		PeerAddr:   conn2.RemoteAddr().String(),
+		Started:    ap.start,
+	}
+	pc, err := newPipeCapture(f.Name(), sw, CaptureHeader{
+		PipeID: ap.id, Service: ap.service, Tunnel: ap.tunnel,
+		ClientAddr: entry.ClientAddr, PeerAddr: entry.PeerAddr,
+		Started: ap.start,
+	}, math.MaxInt64)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	pc.done = func(pc *pipeCapture, reason string, err error) {
+		entry.Ended, entry.Bytes = time.Now(), pc.recorded
+		if err != nil {
+			log.Printf("Error writing recording %s: %v", pc.path, err)
+			entry.Error = err.Error()
+			conn1.Close()
+			conn2.Close()
+		}
+		if err := appendRecordingIndex(entry); err != nil {
+			log.Print("Error writing recording index: ", err)
+		}
+	}
+	return pc, nil
+}
+
+// RecordingEntry is a finished recording, as written to the index.
+type RecordingEntry struct {
+	// File is the recording's file name (in the recording directory).
+	File       string    `json:"file"`
+	PipeID     uint64    `json:"pipe_id"`
+	Service    string    `json:"service"`
+	Tunnel     string    `json:"tunnel,omitempty"`
+	ClientAddr string    `json:"client_addr"`
+	PeerAddr   string    `json:"peer_addr"`
+	Started    time.Time `json:"started"`
+	Ended      time.Time `json:"ended"`
+	// Bytes is the number of payload bytes recorded (in both directions).
+	Bytes int64 `json:"bytes"`
+	// Error is the error that stopped the recording (and the session), if
+	// any.
+	Error string `json:"error,omitempty"`
+}
+
+// appendRecordingIndex appends the entry to the recording index.
+func appendRecordingIndex(entry RecordingEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	recordIndexMtx.Lock()
+	defer recordIndexMtx.Unlock()
+	f, err := os.OpenFile(
+		filepath.Join(recordDir, recordingIndexName),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// pruneRecordings removes the recordings last written to before the given
+// time (other than those still being written) and their index entries.
+func pruneRecordings(before time.Time) {
+	active := make(map[string]bool)
+	for _, ap := range allActivePipes() {
+		if ap.recording != nil {
+			active[filepath.Base(ap.recording.path)] = true
+		}
+	}
+	paths, err := filepath.Glob(filepath.Join(recordDir, "*.trec"))
+	if err != nil {
+		log.Print("Error listing recordings: ", err)
+		return
+	}
+	removed := make(map[string]bool)
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil || active[fi.Name()] || !fi.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Print("Error removing recording: ", err)
+			continue
+		}
+		removed[fi.Name()] = true
+	}
+	if len(removed) == 0 {
+		return
+	}
+	if err := pruneRecordingIndex(removed); err != nil {
+		log.Print("Error pruning recording index: ", err)
+	}
+	log.Printf("Removed %d recordings past the retention", len(removed))
+}
+
+// pruneRecordingIndex rewrites the index without the entries of the removed
+// files.
+func pruneRecordingIndex(removed map[string]bool) error {
+	recordIndexMtx.Lock()
+	defer recordIndexMtx.Unlock()
+	indexPath := filepath.Join(recordDir, recordingIndexName)
+	b, err := os.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var kept bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		var entry RecordingEntry
+		if json.Unmarshal(line, &entry) == nil && removed[entry.File] {
+			continue
+		}
+		kept.Write(line)
+	}
+	tmpPath := indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, kept.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, indexPath)
+}
+
+// sealWriter encrypts what's written to it in chunks with AES-GCM so that
+// recordings can't be read, or undetectably altered, reordered, or truncated,
+// without the key. Each chunk is its 4-byte big-endian length followed by the
+// sealed bytes. The nonce of each is the file's nonce XORed with the chunk's
+// index, and the last chunk is sealed with the additional data byte 1 (the
+// others with 0).
+type sealWriter struct {
+	w     io.WriteCloser
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	buf   []byte
+}
+
+// newSealWriter writes the recording's magic, key ID, and (random) nonce to
+// the writer and returns a sealWriter writing to it.
+func newSealWriter(w io.WriteCloser, key *recordingKey) (*sealWriter, error) {
+	sw := &sealWriter{
+		w: w, aead: key.aead, nonce: make([]byte, key.aead.NonceSize()),
+	}
+	if _, err := rand.Read(sw.nonce); err != nil {
+		return nil, err
+	}
+	preamble := append([]byte(recordingMagic), key.id[:]...)
+	if _, err := w.Write(append(preamble, sw.nonce...)); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	sw.buf = append(sw.buf, p...)
+	for len(sw.buf) >= recordingChunkSize {
+		if err := sw.seal(sw.buf[:recordingChunkSize], false); err != nil {
+			return 0, err
+		}
+		sw.buf = sw.buf[:copy(sw.buf, sw.buf[recordingChunkSize:])]
+	}
+	return len(p), nil
+}
+
+// Close seals the rest of the bytes as the last chunk and closes the writer.
+func (sw *sealWriter) Close() error {
+	err := sw.seal(sw.buf, true)
+	if cerr := sw.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (sw *sealWriter) seal(p []byte, last bool) error {
+	out := make([]byte, 4, 4+len(p)+sw.aead.Overhead())
+	out = sw.aead.Seal(
+		out, chunkNonce(sw.nonce, sw.n), p, chunkAD(last),
+	)
+	sw.n++
+	binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+	_, err := sw.w.Write(out)
+	return err
+}
+
+// chunkNonce returns the nonce of the chunk at index n.
+func chunkNonce(nonce []byte, n uint64) []byte {
+	cn := append([]byte(nil), nonce...)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], n)
+	for i, b := range ctr {
+		cn[len(cn)-8+i] ^= b
+	}
+	return cn
+}
+
+// chunkAD returns the additional data a chunk is sealed with.
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// decryptRecording writes the decrypted recording (a capture, as written by
+// pipeCapture) read from r to w.
+func decryptRecording(w io.Writer, r io.Reader, key *recordingKey) error {
+	br := bufio.NewReader(r)
+	preamble := make([]byte, len(recordingMagic)+len(key.id)+key.aead.NonceSize())
+	if _, err := io.ReadFull(br, preamble); err != nil ||
+		string(preamble[:len(recordingMagic)]) != recordingMagic {
+		return errors.New("not a tunnelit recording")
+	}
+	keyID := preamble[len(recordingMagic) : len(recordingMagic)+len(key.id)]
+	if !bytes.Equal(keyID, key.id[:]) {
+		return errors.New("recording was encrypted with a different key")
+	}
+	nonce := preamble[len(recordingMagic)+len(key.id):]
+	var lenBuf [4]byte
+	for n := uint64(0); ; n++ {
+		if _, err := io.ReadFull(br, lenBuf[:]); err == io.EOF {
+			return errors.New(
+				"recording is truncated (e.g., the proxy stopped while writing it)",
+			)
+		} else if err != nil {
+			return err
+		}
+		l := binary.BigEndian.Uint32(lenBuf[:])
+		if l > recordingChunkSize+uint32(key.aead.Overhead()) {
+			return fmt.Errorf("chunk %d is corrupt", n)
+		}
+		chunk := make([]byte, l)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return fmt.Errorf("error reading chunk %d: %w", n, err)
+		}
+		last := false
+		p, err := key.aead.Open(nil, chunkNonce(nonce, n), chunk, chunkAD(false))
+		if err != nil {
+			p, err = key.aead.Open(nil, chunkNonce(nonce, n), chunk, chunkAD(true))
+			last = true
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %d failed to authenticate", n)
+		}
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		if last {
+			if _, err := br.ReadByte(); err != io.EOF {
+				return errors.New("unexpected data after the last chunk")
+			}
+			return nil
+		}
+	}
+}
+
+func RunRecordingDecrypt(cmd *cobra.Command, args []string) {
+	keyFile := must(cmd.Flags().GetString("key-file"))
+	outPath := must(cmd.Flags().GetString("out"))
+	key, err := loadRecordingKey(keyFile)
+	if err != nil {
+		log.Fatal("Error loading recording key: ", err)
+	}
+	in, err := os.Open(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	var out io.WriteCloser = os.Stdout
+	if outPath != "" {
+		if out, err = os.OpenFile(
+			outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600,
+		); err != nil {
+			log.Fatal(err)
+		}
+	}
+	bw := bufio.NewWriter(out)
+	err = decryptRecording(bw, in, key)
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatal("Error decrypting recording: ", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRecordingKey = "000102030405060708090a0b0c0d0e0f" +
+	"101112131415161718191a1b1c1d1e1f"
+
+// writeKeyFile writes the hex-encoded key to a file, returning its path.
+func writeKeyFile(t *testing.T, key string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "record.key")
+	if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal("error writing key file: ", err)
+	}
+	return path
+}
+
+// setRecording enables recording to a new directory for the test, returning
+// the key file's path.
+func setRecording(t *testing.T) string {
+	t.Helper()
+	oldDir, oldKeyFile := recordDir, recordKeyFile
+	oldRetention, oldKey := recordRetention, recordKey
+	t.Cleanup(func() {
+		recordDir, recordKeyFile = oldDir, oldKeyFile
+		recordRetention, recordKey = oldRetention, oldKey
+	})
+	recordDir = filepath.Join(t.TempDir(), "recordings")
+	recordKeyFile, recordRetention = writeKeyFile(t, testRecordingKey), ""
+	if err := setupRecording(); err != nil {
+		t.Fatal("error setting up recording: ", err)
+	}
+	return recordKeyFile
+}
+
+func TestLoadRecordingKey(t *testing.T) {
+	k1, err := loadRecordingKey(writeKeyFile(t, testRecordingKey))
+	if err != nil {
+		t.Fatal("error loading key: ", err)
+	}
+	k2, err := loadRecordingKey(writeKeyFile(t, strings.Repeat("ff", 32)))
+	if err != nil {
+		t.Fatal("error loading key: ", err)
+	} else if k1.id == k2.id {
+		t.Fatal("expected different keys to have different IDs")
+	}
+	for _, key := range []string{"", "abcd", "zz" + testRecordingKey[2:]} {
+		if _, err := loadRecordingKey(writeKeyFile(t, key)); err == nil {
+			t.Fatalf("%q: expected an error for an invalid key", key)
+		}
+	}
+}
+
+func TestSealWriter(t *testing.T) {
+	key, err := loadRecordingKey(writeKeyFile(t, testRecordingKey))
+	if err != nil {
+		t.Fatal("error loading key: ", err)
+	}
+	// Spans multiple chunks
+	plain := bytes.Repeat([]byte("0123456789"), recordingChunkSize/4)
+	var buf bufferCloser
+	sw, err := newSealWriter(&buf, key)
+	if err != nil {
+		t.Fatal("error creating writer: ", err)
+	}
+	sw.Write(plain[:100])
+	sw.Write(plain[100:])
+	if err := sw.Close(); err != nil {
+		t.Fatal("error closing writer: ", err)
+	} else if bytes.Contains(buf.Bytes(), plain[:100]) {
+		t.Fatal("expected the recording to be encrypted")
+	}
+	sealed := buf.Bytes()
+
+	var out bytes.Buffer
+	if err := decryptRecording(&out, bytes.NewReader(sealed), key); err != nil {
+		t.Fatal("error decrypting: ", err)
+	} else if !bytes.Equal(out.Bytes(), plain) {
+		t.Fatal("expected the decrypted bytes to match")
+	}
+
+	other, err := loadRecordingKey(writeKeyFile(t, strings.Repeat("ff", 32)))
+	if err != nil {
+		t.Fatal("error loading key: ", err)
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	// The first chunk's length and bytes follow the preamble
+	preambleLen := len(recordingMagic) + len(key.id) + key.aead.NonceSize()
+	firstLen := 4 + recordingChunkSize + key.aead.Overhead()
+	tests := []struct {
+		name string
+		data []byte
+		key  *recordingKey
+		want string
+	}{
+		{"other key", sealed, other, "different key"},
+		{"tampered", tampered, key, "failed to authenticate"},
+		{"truncated", sealed[:preambleLen+firstLen], key, "truncated"},
+		{"not a recording", []byte("hello"), key, "not a tunnelit recording"},
+	}
+	for _, tt := range tests {
+		err := decryptRecording(io.Discard, bytes.NewReader(tt.data), tt.key)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("%s: expected an error with %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+// readRecordingIndex returns the entries of the recording index.
+func readRecordingIndex(t *testing.T) []RecordingEntry {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(recordDir, recordingIndexName))
+	if err != nil {
+		t.Fatal("error reading index: ", err)
+	}
+	var entries []RecordingEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var entry RecordingEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal("error decoding index entry: ", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRecordPipe(t *testing.T) {
+	keyFile := setRecording(t)
+	client, backend, done := startPipe(t, connInfo{service: "web", record: true})
+	go client.Write([]byte("ping"))
+	if _, err := io.ReadFull(backend, make([]byte, 4)); err != nil {
+		t.Fatal("error reading: ", err)
+	}
+	// Wait for the bytes to be recorded so the records are in order
+	ap := allActivePipes()[0]
+	waitFor(t, "the bytes to be recorded", func() bool {
+		return ap.recording.info().Recorded == 4
+	})
+	go backend.Write([]byte("pong"))
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatal("error reading: ", err)
+	}
+	client.Close()
+	backend.Close()
+	waitPipe(t, done)
+
+	entries := readRecordingIndex(t)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 index entry, got %+v", entries)
+	}
+	entry := entries[0]
+	if entry.Service != "web" || entry.Bytes != 8 || entry.Error != "" {
+		t.Fatalf("expected the pipe's 8 bytes recorded, got %+v", entry)
+	}
+	path := filepath.Join(recordDir, entry.File)
+	if _, _, err := openCapture(path, ""); err == nil {
+		t.Fatal("expected an error opening a recording without the key")
+	}
+	r, hdr, err := openCapture(path, keyFile)
+	if err != nil {
+		t.Fatal("error opening recording: ", err)
+	} else if hdr.PipeID != entry.PipeID {
+		t.Fatalf("expected pipe #%d, got %+v", entry.PipeID, hdr)
+	}
+	want := []struct {
+		up   bool
+		data string
+	}{{true, "ping"}, {false, "pong"}}
+	for _, w := range want {
+		rec, err := readCaptureRecord(r)
+		if err != nil {
+			t.Fatal("error reading record: ", err)
+		} else if rec.up != w.up || string(rec.data) != w.data {
+			t.Fatalf(
+				"expected %q (up %v), got %q (up %v)", w.data, w.up, rec.data, rec.up,
+			)
+		}
+	}
+	if _, err := readCaptureRecord(r); err != io.EOF {
+		t.Fatal("expected no more records, got ", err)
+	}
+}
+
+func TestPruneRecordings(t *testing.T) {
+	setRecording(t)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"old.trec", "new.trec"} {
+		path := filepath.Join(recordDir, name)
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal("error writing recording: ", err)
+		}
+		if name == "old.trec" {
+			os.Chtimes(path, old, old)
+		}
+		if err := appendRecordingIndex(RecordingEntry{File: name}); err != nil {
+			t.Fatal("error writing index: ", err)
+		}
+	}
+
+	pruneRecordings(time.Now().Add(-24 * time.Hour))
+	oldPath := filepath.Join(recordDir, "old.trec")
+	newPath := filepath.Join(recordDir, "new.trec")
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Fatal("expected the old recording to be removed")
+	} else if _, err := os.Stat(newPath); err != nil {
+		t.Fatal("expected the new recording to be kept, got ", err)
+	}
+	if entries := readRecordingIndex(t); len(entries) != 1 ||
+		entries[0].File != "new.trec" {
+		t.Fatalf("expected only the new recording indexed, got %+v", entries)
+	}
+}
+
+func TestSetupRecordingRequiresKey(t *testing.T) {
+	setRecording(t)
+	recordKeyFile = ""
+	if err := setupRecording(); err == nil {
+		t.Fatal("expected an error without a key file")
+	}
+	recordKeyFile, recordRetention = writeKeyFile(t, testRecordingKey), "soon"
+	if err := setupRecording(); err == nil {
+		t.Fatal("expected an error for an invalid retention")
+	}
+}
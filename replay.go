@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// captureRecord is a record of a capture (see CaptureHeader).
+type captureRecord struct {
+	// up is whether the bytes were from the client.
+	up bool
+	// at is when the bytes were piped, relative to the capture's start.
+	at   time.Duration
+	data []byte
+}
+
+// openCapture opens a capture, or a recording (decrypting it with the key in
+// the key file), returning a reader of its records and its header.
+func openCapture(path, keyFile string) (*bufio.Reader, CaptureHeader, error) {
+	var hdr CaptureHeader
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, hdr, err
+	}
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(len(recordingMagic))
+	if err == nil && string(magic) == recordingMagic {
+		if keyFile == "" {
+			f.Close()
+			return nil, hdr, errors.New(
+				`file is an encrypted recording, provide "key-file" to decrypt it`,
+			)
+		}
+		key, err := loadRecordingKey(keyFile)
+		if err != nil {
+			f.Close()
+			return nil, hdr, fmt.Errorf("error loading recording key: %w", err)
+		}
+		pr, pw := io.Pipe()
+		go func(src io.Reader) {
+			defer f.Close()
+			pw.CloseWithError(decryptRecording(pw, src, key))
+		}(br)
+		br = bufio.NewReader(pr)
+	}
+	// Errors other than EOFs are from reading the file or decrypting it
+	b := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, b); err != nil &&
+		err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, hdr, err
+	} else if err != nil || string(b) != captureMagic {
+		return nil, hdr, errors.New("not a tunnelit capture")
+	} else if err := readMsg(br, &hdr); err != nil {
+		return nil, hdr, fmt.Errorf("error reading capture header: %w", err)
+	}
+	return br, hdr, nil
+}
+
+// readCaptureRecord reads the next record of the capture, returning io.EOF
+// once there are no more.
+func readCaptureRecord(r io.Reader) (captureRecord, error) {
+	var hdr [13]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("capture is truncated")
+		}
+		return captureRecord{}, err
+	}
+	rec := captureRecord{
+		up:   hdr[0] == 0,
+		at:   time.Duration(binary.BigEndian.Uint64(hdr[1:])),
+		data: make([]byte, binary.BigEndian.Uint32(hdr[9:])),
+	}
+	if _, err := io.ReadFull(r, rec.data); err != nil {
+		return captureRecord{}, errors.New("capture is truncated")
+	}
+	return rec, nil
+}
+
+func RunReplay(cmd *cobra.Command, args []string) {
+	to := must(cmd.Flags().GetString("to"))
+	pace := must(cmd.Flags().GetBool("pace"))
+	speed := must(cmd.Flags().GetFloat64("speed"))
+	respPath := must(cmd.Flags().GetString("responses"))
+	wait := must(cmd.Flags().GetDuration("wait"))
+	keyFile := must(cmd.Flags().GetString("key-file"))
+	if speed <= 0 {
+		log.Fatal("speed must be positive")
+	}
+
+	r, hdr, err := openCapture(args[0], keyFile)
+	if err != nil {
+		log.Fatal("Error opening capture: ", err)
+	}
+	log.Printf(
+		"Replaying pipe #%d from %s (captured %s) to %s",
+		hdr.PipeID, hdr.ClientAddr, hdr.Started.Format(time.RFC3339), to,
+	)
+	var resp io.Writer = io.Discard
+	if respPath != "" {
+		f, err := os.OpenFile(
+			respPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		resp = f
+	}
+
+	conn, err := dialer.Dial(tcpNetwork, to)
+	if err != nil {
+		log.Fatal("Error connecting: ", err)
+	}
+	defer conn.Close()
+	var received int64
+	readDone := make(chan error, 1)
+	go func() {
+		var err error
+		received, err = io.Copy(resp, conn)
+		readDone <- err
+	}()
+
+	start := time.Now()
+	var sent, writes int64
+	for {
+		rec, err := readCaptureRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal("Error reading capture: ", err)
+		}
+		if !rec.up {
+			continue
+		}
+		if pace {
+			time.Sleep(time.Until(
+				start.Add(time.Duration(float64(rec.at) / speed)),
+			))
+		}
+		if _, err := conn.Write(rec.data); err != nil {
+			log.Fatalf("Error writing after %d bytes: %v", sent, err)
+		}
+		sent += int64(len(rec.data))
+		writes++
+	}
+	// Signal the end of the stream, as the client closing would, and give
+	// the backend a chance to finish responding
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	select {
+	case err := <-readDone:
+		if err != nil {
+			log.Print("Error reading responses: ", err)
+		}
+	case <-time.After(wait):
+		conn.Close()
+		<-readDone
+	}
+	log.Printf(
+		"Replayed %d bytes in %d writes over %s (%d bytes received)",
+		sent, writes, time.Since(start).Round(time.Millisecond), received,
+	)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// writeTestCapture writes a capture with the records, returning its path.
+func writeTestCapture(t *testing.T, recs []captureRecord) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.tcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal("error creating capture: ", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	w.WriteString(captureMagic)
+	writeMsg(w, CaptureHeader{PipeID: 1, Service: "web", Started: time.Now()})
+	for _, rec := range recs {
+		var hdr [13]byte
+		if !rec.up {
+			hdr[0] = 1
+		}
+		binary.BigEndian.PutUint64(hdr[1:], uint64(rec.at))
+		binary.BigEndian.PutUint32(hdr[9:], uint32(len(rec.data)))
+		w.Write(hdr[:])
+		w.Write(rec.data)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal("error writing capture: ", err)
+	}
+	return path
+}
+
+// replayCommand returns a replay command with the flags set.
+func replayCommand(to string, pace bool, respPath string) *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.Flags().String("to", to, "")
+	cmd.Flags().Bool("pace", pace, "")
+	cmd.Flags().Float64("speed", 2, "")
+	cmd.Flags().String("responses", respPath, "")
+	cmd.Flags().Duration("wait", 5*time.Second, "")
+	cmd.Flags().String("key-file", "", "")
+	return cmd
+}
+
+func TestRunReplay(t *testing.T) {
+	path := writeTestCapture(t, []captureRecord{
+		{up: true, at: 0, data: []byte("GET / HTTP/1.0\r\n")},
+		{up: false, at: 10 * time.Millisecond, data: []byte("not replayed")},
+		{up: true, at: 200 * time.Millisecond, data: []byte("\r\n")},
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		c.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		received <- string(b)
+	}()
+
+	respPath := filepath.Join(t.TempDir(), "responses")
+	start := time.Now()
+	RunReplay(replayCommand(ln.Addr().String(), true, respPath), []string{path})
+	// The records 200ms apart are replayed at twice the speed
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected the replay to be paced, took %s", elapsed)
+	}
+	if got := <-received; got != "GET / HTTP/1.0\r\n\r\n" {
+		t.Fatalf("expected the client's bytes replayed, got %q", got)
+	}
+	if b, err := os.ReadFile(respPath); err != nil {
+		t.Fatal("error reading responses: ", err)
+	} else if string(b) != "HTTP/1.0 200 OK\r\n\r\n" {
+		t.Fatalf("expected the response written, got %q", b)
+	}
+}
+
+func TestOpenCaptureInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not.tcap")
+	if err := os.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openCapture(path, ""); err == nil {
+		t.Fatal("expected an error for a file that isn't a capture")
+	}
+
+	// Records cut short are reported as truncated
+	path = writeTestCapture(t, []captureRecord{{up: true, data: []byte("abc")}})
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(path, b[:len(b)-1], 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := openCapture(path, "")
+	if err != nil {
+		t.Fatal("error opening capture: ", err)
+	} else if _, err := readCaptureRecord(r); err == nil || err == io.EOF {
+		t.Fatal("expected a truncated record to be an error, got ", err)
+	}
+}
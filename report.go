@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	// reportInterval is how often usage reports are emitted ("daily",
+	// "weekly", or blank for never).
+	reportInterval string
+	reportWebhook  string
+	reportFile     string
+)
+
+// Report is a usage summary for a period.
+type Report struct {
+	Period string `json:"period"`
+	// Start and End are the first and last days (UTC) of the period.
+	Start    string            `json:"start"`
+	End      string            `json:"end"`
+	Services map[string]*Usage `json:"services"`
+}
+
+// nextReport returns when the current period ends (midnight UTC, or Monday
+// for weekly reports) and the first day of the current period.
+func nextReport(now time.Time, interval string) (time.Time, time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if interval == "weekly" {
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start.AddDate(0, 0, 7), start
+	}
+	return day.AddDate(0, 0, 1), day
+}
+
+// reportLoop emits a usage report at the end of each period.
+func reportLoop() {
+	for {
+		end, start := nextReport(time.Now().UTC(), reportInterval)
+		time.Sleep(time.Until(end))
+		rep := state.report(
+			reportInterval,
+			start.Format(usageDateFormat),
+			end.AddDate(0, 0, -1).Format(usageDateFormat),
+		)
+		if err := emitReport(rep); err != nil {
+			log.Print("Error emitting usage report: ", err)
+		}
+	}
+}
+
+// report aggregates the usage for the days from start to end (inclusive).
+func (s *State) report(period, start, end string) *Report {
+	rep := &Report{
+		Period: period, Start: start, End: end,
+		Services: make(map[string]*Usage),
+	}
+	for _, row := range s.usageRows(start) {
+		if row.Date > end {
+			continue
+		}
+		u := rep.Services[row.Service]
+		if u == nil {
+			u = &Usage{}
+			rep.Services[row.Service] = u
+		}
+		u.Conns += row.Conns
+		u.BytesUp += row.BytesUp
+		u.BytesDown += row.BytesDown
+		if row.PeakActiveConns > u.PeakActiveConns {
+			u.PeakActiveConns = row.PeakActiveConns
+		}
+	}
+	return rep
+}
+
+// emitReport sends the report to the webhook and/or appends it to the file.
+func emitReport(rep *Report) error {
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	if reportFile != "" {
+		f, err := os.OpenFile(
+			reportFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(b, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if reportWebhook != "" {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(
+			reportWebhook, "application/json", bytes.NewReader(b),
+		)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook returned status %s", resp.Status)
+		}
+	}
+	log.Printf("Emitted %s usage report for %s to %s", rep.Period, rep.Start, rep.End)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextReport(t *testing.T) {
+	// 2026-10-14 is a Wednesday
+	now := time.Date(2026, 10, 14, 15, 30, 0, 0, time.UTC)
+	tests := []struct {
+		interval   string
+		end, start string
+	}{
+		{interval: "daily", end: "2026-10-15", start: "2026-10-14"},
+		{interval: "weekly", end: "2026-10-19", start: "2026-10-12"},
+	}
+	for _, tt := range tests {
+		end, start := nextReport(now, tt.interval)
+		if got := end.Format(usageDateFormat); got != tt.end {
+			t.Fatalf("%s: expected end %s, got %s", tt.interval, tt.end, got)
+		} else if got := start.Format(usageDateFormat); got != tt.start {
+			t.Fatalf("%s: expected start %s, got %s", tt.interval, tt.start, got)
+		}
+	}
+	// A week starting on Sunday's report still begins on Monday
+	sunday := time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)
+	if _, start := nextReport(sunday, "weekly"); start.Day() != 12 {
+		t.Fatalf("expected Sunday's week to start on the 12th, got %s", start)
+	}
+}
+
+func TestStateReport(t *testing.T) {
+	s := newState("")
+	s.Usage = map[string]map[string]*Usage{
+		"web": {
+			"2026-10-11": {Conns: 100},
+			"2026-10-12": {
+				Conns: 1, BytesUp: 10, BytesDown: 20, PeakActiveConns: 3,
+			},
+			"2026-10-13": {
+				Conns: 2, BytesUp: 30, BytesDown: 40, PeakActiveConns: 5,
+			},
+			"2026-10-19": {Conns: 100},
+		},
+	}
+	rep := s.report("weekly", "2026-10-12", "2026-10-18")
+	want := Usage{Conns: 3, BytesUp: 40, BytesDown: 60, PeakActiveConns: 5}
+	if u := rep.Services["web"]; u == nil || *u != want {
+		t.Fatalf("expected %+v, got %+v", want, u)
+	}
+}
+
+// setReportOutputs sets the report's outputs for the test.
+func setReportOutputs(t *testing.T, file, webhook string) {
+	t.Helper()
+	oldFile, oldWebhook := reportFile, reportWebhook
+	reportFile, reportWebhook = file, webhook
+	t.Cleanup(func() { reportFile, reportWebhook = oldFile, oldWebhook })
+}
+
+func TestEmitReport(t *testing.T) {
+	received := make(chan Report, 1)
+	srvr := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				http.NotFound(w, r)
+				return
+			}
+			var rep Report
+			if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			received <- rep
+		},
+	))
+	defer srvr.Close()
+	path := filepath.Join(t.TempDir(), "reports.jsonl")
+	setReportOutputs(t, path, srvr.URL)
+
+	rep := &Report{
+		Period: "daily", Start: "2026-10-12", End: "2026-10-12",
+		Services: map[string]*Usage{"web": {Conns: 1}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := emitReport(rep); err != nil {
+			t.Fatal("error emitting report: ", err)
+		}
+		got := <-received
+		if got.Start != rep.Start || got.Services["web"] == nil {
+			t.Fatalf("expected the report posted, got %+v", got)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("error reading report file: ", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 reports appended, got %q", b)
+	}
+
+	setReportOutputs(t, "", srvr.URL+"/missing")
+	if err := emitReport(rep); err == nil {
+		t.Fatal("expected an error for a failed webhook")
+	}
+}
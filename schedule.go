@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ScheduleWindow is a window of time during which a service accepts clients.
+type ScheduleWindow struct {
+	// Days is a comma-separated list of days or day ranges (e.g., "mon-fri" or
+	// "sat,sun"). Blank means every day.
+	Days string `json:"days,omitempty"`
+	// Start is the time of day the window starts, in the form "15:04".
+	Start string `json:"start"`
+	// End is the time of day the window ends, in the form "15:04". If it's
+	// before the start, the window ends on the following day.
+	End string `json:"end"`
+
+	days       [7]bool
+	start, end time.Duration
+}
+
+func (sw *ScheduleWindow) parse() error {
+	if sw.Days == "" {
+		for i := range sw.days {
+			sw.days[i] = true
+		}
+	}
+	for _, part := range strings.Split(sw.Days, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+		from, ok1 := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !ok1 || !ok2 {
+			return fmt.Errorf("invalid days %q", part)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			sw.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	var err error
+	if sw.start, err = parseTimeOfDay(sw.Start); err != nil {
+		return err
+	}
+	if sw.end, err = parseTimeOfDay(sw.End); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains returns whether the window contains the given time.
+func (sw *ScheduleWindow) contains(t time.Time) bool {
+	y, m, d := t.Date()
+	tod := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if sw.start <= sw.end {
+		return sw.days[t.Weekday()] && tod >= sw.start && tod < sw.end
+	}
+	// The window wraps past midnight, so the part after midnight belongs to
+	// the previous day
+	if tod >= sw.start {
+		return sw.days[t.Weekday()]
+	}
+	return tod < sw.end && sw.days[(t.Weekday()+6)%7]
+}
+
+// parseSchedule parses the service's schedule windows and timezone.
+func (sc *ServiceConfig) parseSchedule() error {
+	for i, sw := range sc.Schedule {
+		if err := sw.parse(); err != nil {
+			return fmt.Errorf("schedule window %d: %w", i, err)
+		}
+	}
+	sc.loc = time.Local
+	if sc.Timezone != "" {
+		loc, err := time.LoadLocation(sc.Timezone)
+		if err != nil {
+			return err
+		}
+		sc.loc = loc
+	}
+	return nil
+}
+
+// IsOpen returns whether the service accepts clients at the given time. A
+// service without a schedule is always open.
+func (sc *ServiceConfig) IsOpen(t time.Time) bool {
+	if len(sc.Schedule) == 0 {
+		return true
+	}
+	t = t.In(sc.loc)
+	for _, sw := range sc.Schedule {
+		if sw.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindowParse(t *testing.T) {
+	tests := []struct {
+		name, days, start, end string
+		ok                     bool
+	}{
+		{name: "every day", start: "09:00", end: "17:00", ok: true},
+		{name: "range", days: "Mon-Fri", start: "09:00", end: "17:00", ok: true},
+		{name: "list", days: "sat, sun", start: "00:00", end: "23:59", ok: true},
+		{name: "bad day", days: "funday", start: "09:00", end: "17:00"},
+		{name: "bad range", days: "mon-xyz", start: "09:00", end: "17:00"},
+		{name: "bad start", start: "9am", end: "17:00"},
+		{name: "bad end", start: "09:00", end: "25:00"},
+	}
+	for _, tt := range tests {
+		sw := &ScheduleWindow{Days: tt.days, Start: tt.start, End: tt.end}
+		if err := sw.parse(); (err == nil) != tt.ok {
+			t.Fatalf("%s: expected ok %v, got error %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestServiceConfigIsOpen(t *testing.T) {
+	// 2026-10-12 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2026, 10, 12+day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		schedule []*ScheduleWindow
+		open     []time.Time
+		closed   []time.Time
+	}{
+		{
+			name: "no schedule",
+			open: []time.Time{at(0, 3, 0), at(5, 23, 0)},
+		},
+		{
+			name: "weekdays",
+			schedule: []*ScheduleWindow{
+				{Days: "mon-fri", Start: "09:00", End: "17:00"},
+			},
+			open:   []time.Time{at(0, 9, 0), at(4, 16, 59)},
+			closed: []time.Time{at(0, 8, 59), at(0, 17, 0), at(5, 12, 0)},
+		},
+		{
+			name: "past midnight",
+			schedule: []*ScheduleWindow{
+				{Days: "fri", Start: "22:00", End: "02:00"},
+			},
+			// Friday night and early Saturday, but not early Friday
+			open:   []time.Time{at(4, 22, 0), at(5, 1, 59)},
+			closed: []time.Time{at(4, 1, 0), at(5, 2, 0), at(5, 22, 0)},
+		},
+		{
+			name: "wrapping days",
+			schedule: []*ScheduleWindow{
+				{Days: "sat-mon", Start: "00:00", End: "12:00"},
+			},
+			open:   []time.Time{at(5, 6, 0), at(6, 6, 0), at(0, 6, 0)},
+			closed: []time.Time{at(1, 6, 0), at(5, 13, 0)},
+		},
+		{
+			name: "multiple windows",
+			schedule: []*ScheduleWindow{
+				{Start: "08:00", End: "09:00"},
+				{Start: "18:00", End: "19:00"},
+			},
+			open:   []time.Time{at(2, 8, 30), at(2, 18, 30)},
+			closed: []time.Time{at(2, 12, 0)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &ServiceConfig{Schedule: tt.schedule, Timezone: "UTC"}
+			if err := sc.parseSchedule(); err != nil {
+				t.Fatal("error parsing schedule: ", err)
+			}
+			for _, tm := range tt.open {
+				if !sc.IsOpen(tm) {
+					t.Fatalf("expected open at %s", tm.Format(time.RFC1123))
+				}
+			}
+			for _, tm := range tt.closed {
+				if sc.IsOpen(tm) {
+					t.Fatalf("expected closed at %s", tm.Format(time.RFC1123))
+				}
+			}
+		})
+	}
+}
+
+func TestServiceConfigIsOpenTimezone(t *testing.T) {
+	sc := &ServiceConfig{
+		Schedule: []*ScheduleWindow{{Start: "09:00", End: "17:00"}},
+	}
+	if err := sc.parseSchedule(); err != nil {
+		t.Fatal("error parsing schedule: ", err)
+	}
+	// The schedule is in the service's timezone, not the time's
+	sc.loc = time.FixedZone("UTC+5", 5*60*60)
+	if tm := time.Date(2026, 10, 12, 5, 0, 0, 0, time.UTC); !sc.IsOpen(tm) {
+		t.Fatal("expected open at 10:00 in the service's timezone")
+	}
+	if tm := time.Date(2026, 10, 12, 13, 0, 0, 0, time.UTC); sc.IsOpen(tm) {
+		t.Fatal("expected closed at 18:00 in the service's timezone")
+	}
+
+	sc.Timezone = "Nowhere/Nothing"
+	if err := sc.parseSchedule(); err == nil {
+		t.Fatal("expected an error for an unknown timezone")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+)
+
+// service is the proxy's runtime state for a service.
+type service struct {
+	name  string
+	cfg   utils.AValue[*ServiceConfig]
+	idle  *idlePool
+	stats Stats
+	// exchanges are the service's recent HTTP exchanges (see
+	// ServiceConfig.Inspect).
+	exchanges exchangeRing
+	// stop is closed once the service is removed.
+	stop chan utils.Unit
+
+	// lnMtx guards the listeners.
+	lnMtx    sync.Mutex
+	ln, wsLn net.Listener
+	udpLn    *udpListener
+	lnAddrs  [3]string
+	// paused is whether the listeners are closed until a tunnel registers
+	// (e.g., since the service's tunnels expired).
+	paused bool
+}
+
+var (
+	servicesMtx sync.RWMutex
+	services    map[string]*service
+)
+
+func newServices(cfg *Config) map[string]*service {
+	svcs := make(map[string]*service, len(cfg.Services))
+	for name, sc := range cfg.Services {
+		svcs[name] = newService(name, sc)
+	}
+	return svcs
+}
+
+func newService(name string, sc *ServiceConfig) *service {
+	// The total number of idle conns is limited by readyCh
+	svc := &service{
+		name: name, idle: newIdlePool(servicePolicy(sc)), stop: make(chan utils.Unit),
+	}
+	svc.cfg.Store(sc)
+	return svc
+}
+
+// servicePolicy returns the service's policy, or the default if it has none.
+func servicePolicy(sc *ServiceConfig) tunnelit.Policy {
+	if sc.policy != nil {
+		return sc.policy
+	}
+	policy, _ := tunnelit.NewPolicy(tunnelit.DefaultPolicy)
+	return policy
+}
+
+// getService returns the service with the given name.
+func getService(name string) (*service, bool) {
+	servicesMtx.RLock()
+	defer servicesMtx.RUnlock()
+	svc, ok := services[name]
+	return svc, ok
+}
+
+// allServices returns a copy of the services map.
+func allServices() map[string]*service {
+	servicesMtx.RLock()
+	defer servicesMtx.RUnlock()
+	svcs := make(map[string]*service, len(services))
+	for name, svc := range services {
+		svcs[name] = svc
+	}
+	return svcs
+}
+
+// config returns the service's current config.
+func (svc *service) config() *ServiceConfig {
+	return svc.cfg.Load()
+}
+
+// displayName returns the name of the service for logging.
+func (svc *service) displayName() string {
+	if svc.name == "" {
+		return "(default)"
+	}
+	return svc.name
+}
+
+// route returns the service whose tunnel conns should be used for a client of
+// this service with the given address (and env).
+func (svc *service) route(
+	clientAddr net.Addr, env *exprEnv,
+) (*service, tunnelSelector) {
+	tcpAddr, ok := clientAddr.(*net.TCPAddr)
+	if !ok {
+		return svc, svc.config().TunnelSelector
+	}
+	for _, rc := range svc.config().Routes {
+		if rc.Matches(tcpAddr.IP, env) {
+			if routed, ok := getService(rc.Service); ok {
+				if rc.TunnelSelector != nil {
+					return routed, rc.TunnelSelector
+				}
+				return routed, routed.config().TunnelSelector
+			}
+		}
+	}
+	return svc, svc.config().TunnelSelector
+}
+
+// start starts the service's heartbeats and listeners.
+func (svc *service) start() error {
+	go svc.heartbeatLoop()
+	return svc.updateListeners()
+}
+
+// updateListeners (re)starts the service's listeners whose addresses differ
+// from its config's, stopping those no longer configured.
+func (svc *service) updateListeners() error {
+	sc := svc.config()
+	svc.lnMtx.Lock()
+	defer svc.lnMtx.Unlock()
+	if svc.paused {
+		return nil
+	}
+	if sc.Addr != svc.lnAddrs[0] {
+		if svc.ln != nil {
+			svc.ln.Close()
+			svc.ln = nil
+		}
+		svc.lnAddrs[0] = ""
+		if sc.Addr != "" {
+			ln, err := listen(sc.Addr)
+			if err != nil {
+				return err
+			}
+			svc.ln, svc.lnAddrs[0] = ln, sc.Addr
+			log.Printf(
+				"Listening for clients of %s on %s", svc.displayName(), ln.Addr(),
+			)
+			go listenClients(svc, ln)
+		}
+	}
+	if sc.WSAddr != svc.lnAddrs[1] {
+		if svc.wsLn != nil {
+			svc.wsLn.Close()
+			svc.wsLn = nil
+		}
+		svc.lnAddrs[1] = ""
+		if sc.WSAddr != "" {
+			ln, err := listen(sc.WSAddr)
+			if err != nil {
+				return err
+			}
+			svc.wsLn, svc.lnAddrs[1] = ln, sc.WSAddr
+			log.Printf(
+				"Listening for WebSocket clients of %s on %s",
+				svc.displayName(), ln.Addr(),
+			)
+			go listenWS(svc, ln)
+		}
+	}
+	if sc.UDPAddr != svc.lnAddrs[2] {
+		if svc.udpLn != nil {
+			svc.udpLn.Close()
+			svc.udpLn = nil
+		}
+		svc.lnAddrs[2] = ""
+		if sc.UDPAddr != "" {
+			ln, err := listenUDP(sc.UDPAddr)
+			if err != nil {
+				return err
+			}
+			svc.udpLn, svc.lnAddrs[2] = ln, sc.UDPAddr
+			log.Printf(
+				"Listening for UDP clients of %s on %s", svc.displayName(), ln.Addr(),
+			)
+			go listenUDPClients(svc, ln)
+		}
+	}
+	return nil
+}
+
+// pauseListeners closes the service's listeners until resumeListeners is
+// called.
+func (svc *service) pauseListeners() {
+	svc.lnMtx.Lock()
+	defer svc.lnMtx.Unlock()
+	if svc.paused {
+		return
+	}
+	svc.closeListeners()
+	svc.paused = true
+	log.Printf("Closed the listeners of %s since it has no tunnels", svc.displayName())
+}
+
+// resumeListeners restarts the service's listeners if they were paused.
+func (svc *service) resumeListeners() {
+	svc.lnMtx.Lock()
+	paused := svc.paused
+	svc.paused = false
+	svc.lnMtx.Unlock()
+	if !paused {
+		return
+	}
+	if err := svc.updateListeners(); err != nil {
+		log.Printf("Error listening for %s: %v", svc.displayName(), err)
+	}
+}
+
+// closeListeners closes the service's listeners. The lnMtx must be held.
+func (svc *service) closeListeners() {
+	for _, ln := range []net.Listener{svc.ln, svc.wsLn} {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+	if svc.udpLn != nil {
+		svc.udpLn.Close()
+	}
+	svc.ln, svc.wsLn, svc.udpLn, svc.lnAddrs = nil, nil, nil, [3]string{}
+}
+
+// endpoints returns the addresses the service's listeners are bound to. If
+// local is given, it's used as the host for listeners bound to all addresses
+// (i.e., the address the proxy was reached on).
+func (svc *service) endpoints(local net.Addr) ServiceEndpoints {
+	svc.lnMtx.Lock()
+	defer svc.lnMtx.Unlock()
+	var eps ServiceEndpoints
+	if svc.ln != nil {
+		eps.Addr = publicAddr(svc.ln.Addr(), local)
+	}
+	if svc.wsLn != nil {
+		eps.WSAddr = publicAddr(svc.wsLn.Addr(), local)
+	}
+	if svc.udpLn != nil {
+		eps.UDPAddr = publicAddr(svc.udpLn.Addr(), local)
+	}
+	return eps
+}
+
+// publicAddr returns the listener's address, with its host replaced by the
+// local address's if it's unspecified.
+func publicAddr(lnAddr, local net.Addr) string {
+	ip, port := addrIP(lnAddr), 0
+	switch a := lnAddr.(type) {
+	case *net.TCPAddr:
+		port = a.Port
+	case *net.UDPAddr:
+		port = a.Port
+	}
+	localTCP, localOk := local.(*net.TCPAddr)
+	if ip == nil || !localOk || !ip.IsUnspecified() {
+		return lnAddr.String()
+	}
+	return net.JoinHostPort(localTCP.IP.String(), strconv.Itoa(port))
+}
+
+// remove stops the service's listeners and heartbeats and closes its idle
+// conns and sessions.
+func (svc *service) remove() {
+	svc.lnMtx.Lock()
+	svc.closeListeners()
+	svc.lnMtx.Unlock()
+	close(svc.stop)
+	closeIdle(svc.idle.drain())
+}
+
+// updateServices applies the config's services, updating existing services
+// in place (so their idle conns are kept), starting new ones, and removing
+// those no longer configured.
+func updateServices(cfg *Config) {
+	servicesMtx.Lock()
+	defer servicesMtx.Unlock()
+	for name, sc := range cfg.Services {
+		svc, ok := services[name]
+		if !ok {
+			svc = newService(name, sc)
+			services[name] = svc
+			log.Printf("Added service %s", svc.displayName())
+			if err := svc.start(); err != nil {
+				log.Printf("Error listening for %s: %v", svc.displayName(), err)
+			}
+			continue
+		}
+		svc.cfg.Store(sc)
+		svc.idle.setPolicy(servicePolicy(sc))
+		if err := svc.updateListeners(); err != nil {
+			log.Printf("Error listening for %s: %v", svc.displayName(), err)
+		}
+	}
+	for name, svc := range services {
+		if _, ok := cfg.Services[name]; !ok {
+			delete(services, name)
+			svc.remove()
+			log.Printf("Removed service %s", svc.displayName())
+		}
+	}
+}
+
+// isClosedErr returns whether the error is from using a closed listener.
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
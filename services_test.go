@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPublicAddr(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9000}
+	tests := []struct {
+		lnAddr net.Addr
+		local  net.Addr
+		want   string
+	}{
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 8080}, local, "192.0.2.1:8080"},
+		{
+			&net.TCPAddr{IP: net.IPv6unspecified, Port: 8080}, local,
+			"192.0.2.1:8080",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}, local,
+			"127.0.0.1:8080",
+		},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 8080}, nil, "0.0.0.0:8080"},
+		{&net.UDPAddr{IP: net.IPv4zero, Port: 5353}, local, "192.0.2.1:5353"},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(tt.lnAddr, tt.local); got != tt.want {
+			t.Fatalf("%s: expected %s, got %s", tt.lnAddr, tt.want, got)
+		}
+	}
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	sc := &ServiceConfig{Addr: "127.0.0.1:0"}
+	if err := sc.parseSchedule(); err != nil {
+		t.Fatal("error parsing schedule: ", err)
+	}
+	svc := newService("web", sc)
+	if err := svc.updateListeners(); err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer svc.remove()
+	eps := svc.endpoints(nil)
+	// The picked port is reported rather than port 0
+	if !strings.HasPrefix(eps.Addr, "127.0.0.1:") ||
+		strings.HasSuffix(eps.Addr, ":0") {
+		t.Fatalf("expected the picked port, got %q", eps.Addr)
+	} else if eps.WSAddr != "" {
+		t.Fatalf("expected no WebSocket endpoint, got %q", eps.WSAddr)
+	}
+	if conn, err := net.Dial("tcp", eps.Addr); err != nil {
+		t.Fatal("error dialing the reported endpoint: ", err)
+	} else {
+		conn.Close()
+	}
+}
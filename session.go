@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Tunnels registered with Mux keep a single conn (a session) to the proxy,
+// over which each client is a yamux stream opened by the proxy, rather than
+// pre-dialing an idle conn per client. Each stream starts with the same ready
+// exchange as an idle conn (ConnReady or ConnDial, etc.). yamux gives each
+// stream its own receive window, so a slow client can't stall the other
+// streams, and both sides ping regularly, closing the session once the pings
+// go unanswered.
+
+// tunnelMux is whether the default service's clients are multiplexed over a
+// session.
+var tunnelMux bool
+
+// tunnelSession multiplexes streams over a conn between the tunnel and
+// proxy. The proxy opens the streams and the tunnel accepts them.
+type tunnelSession struct {
+	*yamux.Session
+	conn net.Conn
+}
+
+// sessionConfig returns the config of sessions on either side.
+func sessionConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.KeepAliveInterval = heartbeatInterval
+	cfg.ConnectionWriteTimeout = idleTimeout
+	cfg.StreamOpenTimeout = idleTimeout
+	cfg.LogOutput = io.Discard
+	return cfg
+}
+
+// newTunnelSession returns a session over the conn. If accepting is true, the
+// peer opens the streams, which are returned by Accept.
+func newTunnelSession(conn net.Conn, accepting bool) (*tunnelSession, error) {
+	newSession := yamux.Client
+	if accepting {
+		newSession = yamux.Server
+	}
+	sess, err := newSession(conn, sessionConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &tunnelSession{Session: sess, conn: conn}, nil
+}
+
+// wait waits for the session to end (i.e., be closed by either side or fail).
+func (s *tunnelSession) wait() {
+	<-s.CloseChan()
+}
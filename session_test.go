@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+)
+
+// newSessionPair returns the two ends of a session over an in-memory conn.
+func newSessionPair(t *testing.T) (opener, accepter *tunnelSession) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	opener, err := newTunnelSession(c1, false)
+	if err != nil {
+		t.Fatal("error starting opening session: ", err)
+	}
+	accepter, err = newTunnelSession(c2, true)
+	if err != nil {
+		t.Fatal("error starting accepting session: ", err)
+	}
+	t.Cleanup(func() {
+		opener.Close()
+		accepter.Close()
+	})
+	return opener, accepter
+}
+
+func TestSessionStreamsForgottenOnClose(t *testing.T) {
+	const numStreams = 50
+	tests := []struct {
+		name string
+		// acceptFirst is whether the accepting side closes first.
+		acceptFirst bool
+		// reply is whether the accepting side writes before closing.
+		reply bool
+	}{
+		{name: "opener closes first", reply: true},
+		{name: "accepter closes first", acceptFirst: true, reply: true},
+		{name: "accepter closes without writing", acceptFirst: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opener, accepter := newSessionPair(t)
+			for i := 0; i < numStreams; i++ {
+				st, err := opener.Open()
+				if err != nil {
+					t.Fatal("error opening stream: ", err)
+				}
+				if _, err := st.Write([]byte{connReady}); err != nil {
+					t.Fatal("error writing to stream: ", err)
+				}
+				acc, err := accepter.Accept()
+				if err != nil {
+					t.Fatal("error accepting stream: ", err)
+				}
+				b := []byte{0}
+				if _, err := io.ReadFull(acc, b); err != nil || b[0] != connReady {
+					t.Fatalf("expected ready byte, got %d (err: %v)", b[0], err)
+				}
+				if tt.reply {
+					if _, err := acc.Write(b); err != nil {
+						t.Fatal("error writing to accepted stream: ", err)
+					} else if _, err := io.ReadFull(st, b); err != nil {
+						t.Fatal("error reading reply: ", err)
+					}
+				}
+				first, second := st, acc
+				if tt.acceptFirst {
+					first, second = acc, st
+				}
+				first.Close()
+				second.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := second.Read(b); err != io.EOF {
+					t.Fatalf("expected EOF after peer closed, got %v", err)
+				}
+				second.Close()
+			}
+			deadline := time.Now().Add(time.Second)
+			for opener.NumStreams()+accepter.NumStreams() != 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf(
+						"streams not forgotten: opener has %d, accepter has %d",
+						opener.NumStreams(), accepter.NumStreams(),
+					)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestPoolOpensSessionStreams(t *testing.T) {
+	p := newIdlePool(&tunnelit.RoundRobin{})
+	opener, accepter := newSessionPair(t)
+
+	// A client waiting before the session is added gets a stream of it, as
+	// does one taking a conn afterwards
+	got := make(chan pooledConn, 1)
+	go func() {
+		pc, _ := p.Get(time.Second, tunnelFilter{})
+		got <- pc
+	}()
+	for {
+		p.mtx.Lock()
+		waiting := len(p.waiters)
+		p.mtx.Unlock()
+		if waiting != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.putSession(opener, "t", tunnelInfo{weight: 1})
+	for i := 0; i < 2; i++ {
+		var pc pooledConn
+		if i == 0 {
+			pc = <-got
+		} else {
+			pc, _ = p.TryGet(tunnelFilter{})
+		}
+		if pc.Conn == nil || pc.sess != opener {
+			t.Fatalf("client %d: expected a stream of the session, got %+v", i, pc)
+		}
+		go pc.Write([]byte{connReady})
+		acc, err := accepter.Accept()
+		if err != nil {
+			t.Fatalf("client %d: error accepting stream: %v", i, err)
+		}
+		b := []byte{0}
+		if _, err := io.ReadFull(acc, b); err != nil || b[0] != connReady {
+			t.Fatalf("client %d: expected ready byte, got %d (err: %v)", i, b[0], err)
+		}
+		pc.Close()
+		p.done(pc)
+	}
+
+	// Once the session ends, it's dropped rather than handed out
+	accepter.Close()
+	opener.wait()
+	if pc, ok := p.TryGet(tunnelFilter{}); ok {
+		t.Fatalf("expected no conn once the session ended, got %+v", pc)
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.sessions != 0 || p.tunnels["t"].active != 0 {
+		t.Fatalf(
+			"expected ended session dropped, got %d sessions and %d active",
+			p.sessions, p.tunnels["t"].active,
+		)
+	}
+}
+
+func TestRunSessionOlderProxy(t *testing.T) {
+	srvr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvr.Close()
+	go func() {
+		for {
+			c, err := srvr.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	sc := &TunnelServiceConfig{Saddrs: []string{srvr.Addr().String()}, Mux: true}
+	if err := sc.parse(); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTunnelService("echo", sc)
+
+	// An older proxy heartbeats the conn and then uses it for a client, as it
+	// would an idle conn
+	tunnelSide, proxySide := net.Pipe()
+	defer proxySide.Close()
+	release := make(chan utils.Unit, 1)
+	go ts.runSession(tunnelSide, "proxy", release)
+	proxySide.SetDeadline(time.Now().Add(5 * time.Second))
+	b := []byte{heartbeatByte}
+	if _, err := proxySide.Write(b); err != nil {
+		t.Fatal("error heartbeating: ", err)
+	} else if _, err := io.ReadFull(proxySide, b); err != nil || b[0] != heartbeatByte {
+		t.Fatalf("expected heartbeat answered, got %d (err: %v)", b[0], err)
+	}
+	b[0] = connReady
+	if _, err := proxySide.Write(b); err != nil {
+		t.Fatal("error writing ready byte: ", err)
+	} else if _, err := io.ReadFull(proxySide, b); err != nil || b[0] != connReady {
+		t.Fatalf("expected client served, got %d (err: %v)", b[0], err)
+	}
+	select {
+	case <-release:
+	case <-time.After(time.Second):
+		t.Fatal("expected token released once the conn was used")
+	}
+	b = []byte("ping")
+	if _, err := proxySide.Write(b); err != nil {
+		t.Fatal("error writing to server: ", err)
+	} else if _, err := io.ReadFull(proxySide, b); err != nil || string(b) != "ping" {
+		t.Fatalf("expected echo, got %q (err: %v)", b, err)
+	}
+}
+
+func TestFailStopsUnreportedService(t *testing.T) {
+	ts := newTunnelService("rejected", &TunnelServiceConfig{MinIdle: 1})
+	if !addTunnelService(ts) {
+		t.Fatal("service already exists")
+	}
+	release := make(chan utils.Unit, 1)
+	ts.fail(errors.New("rejected"), release)
+	select {
+	case <-release:
+	default:
+		t.Fatal("expected token released")
+	}
+	select {
+	case <-ts.stop:
+	default:
+		t.Fatal("expected service stopped")
+	}
+	if _, ok := getTunnelService("rejected"); ok {
+		t.Fatal("expected service removed")
+	}
+}
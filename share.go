@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// endpointFile, if set, is the file the services' endpoints are written to
+	// (one per line) whenever they change.
+	endpointFile string
+	// showQR is whether to print QR codes of the services' endpoints.
+	showQR bool
+
+	sharedMtx sync.Mutex
+	// shared holds the endpoints of each service (by name) on each proxy.
+	shared = make(map[string]map[string][]string)
+)
+
+// shareEndpoints makes the service's endpoints on the proxy easy to share,
+// printing them as QR codes and writing them to the endpoint file if
+// configured.
+func shareEndpoints(ts *tunnelService, proxyAddr string, addrs []string) {
+	if showQR {
+		for _, addr := range addrs {
+			m, err := encodeQR([]byte(addr))
+			if err != nil {
+				log.Printf("Error encoding %s as a QR code: %v", addr, err)
+				continue
+			}
+			fmt.Printf("%s (%s):\n", ts.displayName(), addr)
+			renderQR(os.Stdout, m)
+		}
+	}
+	if endpointFile == "" {
+		return
+	}
+	sharedMtx.Lock()
+	defer sharedMtx.Unlock()
+	if shared[ts.reg.Service] == nil {
+		shared[ts.reg.Service] = make(map[string][]string)
+	}
+	shared[ts.reg.Service][proxyAddr] = addrs
+	if err := writeEndpointFile(); err != nil {
+		log.Print("Error writing endpoint file: ", err)
+	}
+}
+
+// unshareEndpoints removes the service's endpoints from the endpoint file.
+func unshareEndpoints(ts *tunnelService) {
+	if endpointFile == "" {
+		return
+	}
+	sharedMtx.Lock()
+	defer sharedMtx.Unlock()
+	if _, ok := shared[ts.reg.Service]; !ok {
+		return
+	}
+	delete(shared, ts.reg.Service)
+	if err := writeEndpointFile(); err != nil {
+		log.Print("Error writing endpoint file: ", err)
+	}
+}
+
+// writeEndpointFile writes the shared endpoints, sorted by service and then
+// proxy. The mutex must be held.
+func writeEndpointFile() error {
+	var names []string
+	for name := range shared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		var proxies []string
+		for proxy := range shared[name] {
+			proxies = append(proxies, proxy)
+		}
+		sort.Strings(proxies)
+		for _, proxy := range proxies {
+			for _, addr := range shared[name][proxy] {
+				sb.WriteString(addr + "\n")
+			}
+		}
+	}
+	// Write to a temp file and rename so readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(endpointFile), ".tunnelit-endpoints-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), endpointFile)
+}
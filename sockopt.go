@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var (
+	// fwmark is the SO_MARK set on tunnel sockets (0 means unset).
+	fwmark uint
+	// dscp is the DSCP value set on tunnel sockets (-1 means unset).
+	dscp int
+	// rcvBuf and sndBuf are the SO_RCVBUF and SO_SNDBUF set on all piped
+	// sockets (0 means the kernel default).
+	rcvBuf, sndBuf int
+	// linkMSS is the TCP_MAXSEG set on the sockets of the link between the
+	// tunnel and proxy (0 means the kernel's, from the route's MTU).
+	linkMSS int
+)
+
+const (
+	// minLinkMSS and maxLinkMSS bound linkMSS (the least MSS every IPv4 host
+	// must accept and the most an IPv4 packet can carry).
+	minLinkMSS = 536
+	maxLinkMSS = 65495
+)
+
+// socketMarksSet returns whether any socket marks were configured.
+func socketMarksSet() bool {
+	return fwmark != 0 || dscp >= 0
+}
+
+// bufSizesSet returns whether any socket buffer sizes were configured.
+func bufSizesSet() bool {
+	return rcvBuf != 0 || sndBuf != 0
+}
+
+// setupSocketOpts validates the socket options and makes the dialer set them
+// on the sockets it dials.
+func setupSocketOpts() error {
+	if dscp > 63 {
+		return fmt.Errorf("dscp must be between 0 and 63")
+	} else if rcvBuf < 0 || sndBuf < 0 {
+		return fmt.Errorf("socket buffer sizes must not be negative")
+	} else if linkMSS != 0 && (linkMSS < minLinkMSS || linkMSS > maxLinkMSS) {
+		return fmt.Errorf(
+			"link-mss must be between %d and %d", minLinkMSS, maxLinkMSS,
+		)
+	}
+	if !socketMarksSet() && !bufSizesSet() && linkMSS == 0 {
+		return nil
+	}
+	if !socketOptsSupported {
+		return fmt.Errorf(
+			"fwmark, dscp, rcvbuf, sndbuf, and link-mss are only supported on Linux",
+		)
+	}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		return rawControl(c, func(fd uintptr) error {
+			if err := setSocketMarks(fd); err != nil {
+				return err
+			}
+			return setBufSizes(fd)
+		})
+	}
+	return nil
+}
+
+// listen listens on the TCP address, setting the configured buffer sizes on
+// the listener so that accepted sockets inherit them (before the handshake,
+// so they're reflected in the window scale).
+func listen(addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if bufSizesSet() {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return rawControl(c, setBufSizes)
+		}
+	}
+	return lc.Listen(context.Background(), tcpNetwork, addr)
+}
+
+// The MSS of the link's TCP segments follows from the MTU of the route to the
+// peer, and path-MTU discovery lowers it when a smaller hop (e.g., PPPoE's
+// 1492) answers oversized packets. When that hop (or a firewall) drops them
+// silently instead, the link blackholes as soon as it carries a full segment,
+// so link-mss clamps the MSS up front (e.g., 1452 for PPPoE). It's set before
+// the handshake so that it's also what each side announces to the other. QUIC
+// sizes its own packets, probing the path MTU as it goes.
+
+// linkDialer returns the dialer for the link's conns to the proxy, which also
+// clamps their MSS if link-mss is set.
+func linkDialer() *net.Dialer {
+	if linkMSS == 0 {
+		return &dialer
+	}
+	d := dialer
+	control := dialer.Control
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return rawControl(c, setMSS)
+	}
+	return &d
+}
+
+// listenLink is listen for the link's conns from tunnels, clamping their MSS
+// if link-mss is set (accepted sockets inherit it from the listener).
+func listenLink(addr string) (net.Listener, error) {
+	if linkMSS == 0 {
+		return listen(addr)
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return rawControl(c, func(fd uintptr) error {
+				if err := setBufSizes(fd); err != nil {
+					return err
+				}
+				return setMSS(fd)
+			})
+		},
+	}
+	return lc.Listen(context.Background(), tcpNetwork, addr)
+}
+
+// rawControl calls f with the raw conn's file descriptor.
+func rawControl(c syscall.RawConn, f func(fd uintptr) error) error {
+	var ferr error
+	if err := c.Control(func(fd uintptr) { ferr = f(fd) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// unwrapConn returns the innermost conn of a conn wrapping another (through a
+// NetConn method, like tls.Conn).
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		wc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = wc.NetConn()
+	}
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// socketOptsSupported is whether fwmark, DSCP, buffer sizes, and the link's
+// MSS can be set.
+const socketOptsSupported = true
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, which the syscall package doesn't define.
+const tcpUserTimeout = 0x12
+
+// setUserTimeout sets TCP_USER_TIMEOUT on the conn so that the kernel drops it
+// if sent data remains unacknowledged for longer than the timeout.
+func setUserTimeout(conn net.Conn, timeout time.Duration) error {
+	return controlConn(conn, func(fd uintptr) error {
+		return syscall.SetsockoptInt(
+			int(fd), syscall.IPPROTO_TCP, tcpUserTimeout,
+			int(timeout/time.Millisecond),
+		)
+	})
+}
+
+// controlConn calls f with the conn's file descriptor, if it's a TCP conn.
+func controlConn(conn net.Conn, f func(fd uintptr) error) error {
+	tc, ok := unwrapConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rawControl(rc, f)
+}
+
+// setSocketMarks sets the configured SO_MARK and DSCP on the socket.
+func setSocketMarks(fd uintptr) error {
+	if fwmark != 0 {
+		err := syscall.SetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(fwmark),
+		)
+		if err != nil {
+			return fmt.Errorf("error setting SO_MARK: %w", err)
+		}
+	}
+	if dscp >= 0 {
+		tos := dscp << 2
+		sa, err := syscall.Getsockname(int(fd))
+		if err != nil {
+			return err
+		}
+		if _, ok := sa.(*syscall.SockaddrInet6); ok {
+			err := syscall.SetsockoptInt(
+				int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos,
+			)
+			if err != nil {
+				return fmt.Errorf("error setting IPV6_TCLASS: %w", err)
+			}
+			// Also covers IPv4-mapped addresses on dual-stack sockets
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		} else {
+			err := syscall.SetsockoptInt(
+				int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos,
+			)
+			if err != nil {
+				return fmt.Errorf("error setting IP_TOS: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// setBufSizes sets the configured SO_RCVBUF and SO_SNDBUF on the socket.
+func setBufSizes(fd uintptr) error {
+	if rcvBuf != 0 {
+		err := syscall.SetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvBuf,
+		)
+		if err != nil {
+			return fmt.Errorf("error setting SO_RCVBUF: %w", err)
+		}
+	}
+	if sndBuf != 0 {
+		err := syscall.SetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndBuf,
+		)
+		if err != nil {
+			return fmt.Errorf("error setting SO_SNDBUF: %w", err)
+		}
+	}
+	return nil
+}
+
+// setMSS sets the configured link MSS (TCP_MAXSEG) on the socket.
+func setMSS(fd uintptr) error {
+	err := syscall.SetsockoptInt(
+		int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, linkMSS,
+	)
+	if err != nil {
+		return fmt.Errorf("error setting TCP_MAXSEG: %w", err)
+	}
+	return nil
+}
+
+// markConn sets the configured SO_MARK and DSCP on an accepted conn.
+func markConn(conn net.Conn) error {
+	if !socketMarksSet() {
+		return nil
+	}
+	return controlConn(conn, setSocketMarks)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLinkMSS(t *testing.T) {
+	const mss = 1200
+	tests := []struct {
+		name string
+		// listen and dial are whether the listening and dialing sides clamp.
+		listen, dial bool
+	}{
+		{name: "dialer", dial: true},
+		{name: "listener", listen: true},
+		{name: "both", listen: true, dial: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { linkMSS = 0 })
+			if tt.listen {
+				linkMSS = mss
+			}
+			ln, err := listenLink("127.0.0.1:0")
+			if err != nil {
+				t.Fatal("error listening: ", err)
+			}
+			defer ln.Close()
+			linkMSS = 0
+			if tt.dial {
+				linkMSS = mss
+			}
+			dialed, err := linkDialer().Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal("error dialing: ", err)
+			}
+			defer dialed.Close()
+			accepted, err := ln.Accept()
+			if err != nil {
+				t.Fatal("error accepting: ", err)
+			}
+			defer accepted.Close()
+			// Either side clamping caps the segments both ways since the MSS
+			// it announces is what the other sends
+			for _, conn := range []net.Conn{dialed, accepted} {
+				if got := connMSS(t, conn); got > mss {
+					t.Fatalf("expected MSS of at most %d, got %d", mss, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSetupLinkMSS(t *testing.T) {
+	t.Cleanup(func() { linkMSS = 0 })
+	for _, mss := range []int{-1, minLinkMSS - 1, maxLinkMSS + 1} {
+		linkMSS = mss
+		if err := setupSocketOpts(); err == nil {
+			t.Fatalf("expected error for link-mss %d", mss)
+		}
+	}
+}
+
+// connMSS returns the conn's current MSS (TCP_MAXSEG).
+func connMSS(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	var mss int
+	err := controlConn(conn, func(fd uintptr) error {
+		var err error
+		mss, err = syscall.GetsockoptInt(
+			int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG,
+		)
+		return err
+	})
+	if err != nil {
+		t.Fatal("error getting TCP_MAXSEG: ", err)
+	}
+	return mss
+}
+
+func TestSetUserTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("error dialing: ", err)
+	}
+	defer conn.Close()
+	if err := setUserTimeout(conn, 1500*time.Millisecond); err != nil {
+		t.Fatal("error setting TCP_USER_TIMEOUT: ", err)
+	}
+	var got int
+	err = controlConn(conn, func(fd uintptr) error {
+		var err error
+		got, err = syscall.GetsockoptInt(
+			int(fd), syscall.IPPROTO_TCP, tcpUserTimeout,
+		)
+		return err
+	})
+	if err != nil {
+		t.Fatal("error getting TCP_USER_TIMEOUT: ", err)
+	} else if got != 1500 {
+		t.Fatalf("expected a timeout of 1500ms, got %d", got)
+	}
+	// Non-TCP conns are left alone
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := setUserTimeout(c1, time.Second); err != nil {
+		t.Fatal("expected no error for a non-TCP conn, got ", err)
+	}
+}
+
+// saveSocketOpts restores the socket options and dialer after the test.
+func saveSocketOpts(t *testing.T) {
+	t.Helper()
+	oldMark, oldDSCP, oldRcv, oldSnd := fwmark, dscp, rcvBuf, sndBuf
+	oldDialer := dialer
+	t.Cleanup(func() {
+		fwmark, dscp, rcvBuf, sndBuf = oldMark, oldDSCP, oldRcv, oldSnd
+		dialer = oldDialer
+	})
+	fwmark, dscp, rcvBuf, sndBuf = 0, -1, 0, 0
+}
+
+// dialPair returns a conn dialed with the dialer and the conn accepted from
+// the listener for it.
+func dialPair(t *testing.T, ln net.Listener) (dialed, accepted net.Conn) {
+	t.Helper()
+	dialed, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("error dialing: ", err)
+	}
+	t.Cleanup(func() { dialed.Close() })
+	if accepted, err = ln.Accept(); err != nil {
+		t.Fatal("error accepting: ", err)
+	}
+	t.Cleanup(func() { accepted.Close() })
+	return dialed, accepted
+}
+
+// sockoptInt returns the value of the socket option on the conn.
+func sockoptInt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	var val int
+	err := controlConn(conn, func(fd uintptr) error {
+		var err error
+		val, err = syscall.GetsockoptInt(int(fd), level, opt)
+		return err
+	})
+	if err != nil {
+		t.Fatal("error getting socket option: ", err)
+	}
+	return val
+}
+
+func TestSocketMarks(t *testing.T) {
+	saveSocketOpts(t)
+	dscp = 46
+	if err := setupSocketOpts(); err != nil {
+		t.Fatal("error setting up socket options: ", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	dialed, accepted := dialPair(t, ln)
+	if err := markConn(accepted); err != nil {
+		t.Fatal("error marking accepted conn: ", err)
+	}
+	for _, conn := range []net.Conn{dialed, accepted} {
+		tos := sockoptInt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS)
+		if tos != 46<<2 {
+			t.Fatalf("expected TOS %d, got %d", 46<<2, tos)
+		}
+	}
+
+	// Setting SO_MARK needs CAP_NET_ADMIN
+	fwmark = 42
+	if err := setupSocketOpts(); err != nil {
+		t.Fatal("error setting up socket options: ", err)
+	}
+	dialed, err = dialer.Dial("tcp", ln.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("not permitted to set SO_MARK")
+	} else if err != nil {
+		t.Fatal("error dialing: ", err)
+	}
+	defer dialed.Close()
+	mark := sockoptInt(t, dialed, syscall.SOL_SOCKET, syscall.SO_MARK)
+	if mark != 42 {
+		t.Fatalf("expected mark 42, got %d", mark)
+	}
+}
+
+func TestSetupSocketMarksInvalid(t *testing.T) {
+	saveSocketOpts(t)
+	dscp = 64
+	if err := setupSocketOpts(); err == nil {
+		t.Fatal("expected an error for a DSCP over 63")
+	}
+}
+
+func TestBufSizes(t *testing.T) {
+	saveSocketOpts(t)
+	const size = 64 * 1024
+	rcvBuf, sndBuf = size, size
+	if err := setupSocketOpts(); err != nil {
+		t.Fatal("error setting up socket options: ", err)
+	}
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	dialed, accepted := dialPair(t, ln)
+	// Linux doubles the sizes set (for its bookkeeping)
+	for _, conn := range []net.Conn{dialed, accepted} {
+		rcv := sockoptInt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		snd := sockoptInt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		if rcv != 2*size || snd != 2*size {
+			t.Fatalf("expected buffers of %d, got %d and %d", 2*size, rcv, snd)
+		}
+	}
+
+	rcvBuf = -1
+	if err := setupSocketOpts(); err == nil {
+		t.Fatal("expected an error for a negative buffer size")
+	}
+}
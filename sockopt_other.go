@@ -0,0 +1,38 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// socketOptsSupported is whether fwmark, DSCP, buffer sizes, and the link's
+// MSS can be set.
+const socketOptsSupported = false
+
+// setUserTimeout is a no-op on platforms without TCP_USER_TIMEOUT; the write
+// deadlines set while piping still apply.
+func setUserTimeout(conn net.Conn, timeout time.Duration) error {
+	return nil
+}
+
+// setSocketMarks is a no-op since socket options aren't supported.
+func setSocketMarks(fd uintptr) error {
+	return nil
+}
+
+// setBufSizes is a no-op since socket options aren't supported.
+func setBufSizes(fd uintptr) error {
+	return nil
+}
+
+// setMSS is a no-op since socket options aren't supported.
+func setMSS(fd uintptr) error {
+	return nil
+}
+
+// markConn is a no-op since socket options aren't supported.
+func markConn(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+// Services in socks mode (see ServiceConfig.Mode) are SOCKS5 servers (RFC
+// 1928) whose egress happens on the tunnels, as with connect mode. Only the
+// CONNECT command and no authentication are supported.
+
+// modeSocks is the mode of services whose clients speak SOCKS5.
+const modeSocks = "socks"
+
+// flagSocks is whether the default service is in socks mode (overriding the
+// config).
+var flagSocks bool
+
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xFF
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded            = 0x00
+	socksGeneralFailure       = 0x01
+	socksCmdNotSupported      = 0x07
+	socksAddrTypeNotSupported = 0x08
+)
+
+// readSocksRequest negotiates with the SOCKS5 client and reads its CONNECT
+// request, returning the destination.
+func readSocksRequest(conn net.Conn) (*clientDial, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	} else if hdr[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	} else if method == socksNoAcceptable {
+		return nil, errors.New("client doesn't support no authentication")
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return nil, err
+	} else if req[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", req[0])
+	} else if req[1] != socksCmdConnect {
+		writeSocksReply(conn, socksCmdNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		l := []byte{0}
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		writeSocksReply(conn, socksAddrTypeNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(
+		host, strconv.Itoa(int(binary.BigEndian.Uint16(port))),
+	)
+	return &clientDial{
+		req: DialRequest{Addr: addr},
+		reply: func(ok bool) error {
+			rep := byte(socksSucceeded)
+			if !ok {
+				rep = socksGeneralFailure
+			}
+			conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+			defer conn.SetWriteDeadline(time.Time{})
+			return writeSocksReply(conn, rep)
+		},
+	}, nil
+}
+
+// writeSocksReply writes the reply with the given code. The bound address is
+// always 0.0.0.0:0 since it's the tunnel's, which the proxy doesn't know.
+func writeSocksReply(conn net.Conn, rep byte) error {
+	_, err := utils.WriteAll(
+		conn, []byte{socksVersion, rep, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0},
+	)
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+func TestReadSocksRequest(t *testing.T) {
+	// greeting offers no authentication
+	greeting := []byte{socksVersion, 1, socksNoAuth}
+	request := func(addr ...byte) []byte {
+		req := append([]byte(nil), greeting...)
+		return append(append(req, socksVersion, socksCmdConnect, 0), addr...)
+	}
+	chosen := []byte{socksVersion, socksNoAuth}
+	reply := func(rep byte) []byte {
+		return append(
+			append([]byte(nil), chosen...),
+			socksVersion, rep, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0,
+		)
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		// addr is the destination read (blank means an error is expected).
+		addr string
+		// written is what's written to the client, including the success
+		// reply if a destination is read.
+		written []byte
+	}{
+		{
+			name:    "IPv4",
+			input:   request(socksAddrIPv4, 127, 0, 0, 1, 0, 80),
+			addr:    "127.0.0.1:80",
+			written: reply(socksSucceeded),
+		},
+		{
+			name: "IPv6",
+			input: request(
+				socksAddrIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0xbb,
+			),
+			addr:    "[::1]:443",
+			written: reply(socksSucceeded),
+		},
+		{
+			name:    "domain",
+			input:   request(append(append([]byte{socksAddrDomain, 11}, "example.com"...), 0, 80)...),
+			addr:    "example.com:80",
+			written: reply(socksSucceeded),
+		},
+		{name: "empty"},
+		{name: "SOCKS4", input: []byte{4, 1, 0, 80, 127, 0, 0, 1, 0}},
+		{name: "truncated methods", input: []byte{socksVersion, 3, socksNoAuth}},
+		{
+			name:    "no acceptable method",
+			input:   []byte{socksVersion, 1, 0x02},
+			written: []byte{socksVersion, socksNoAcceptable},
+		},
+		{
+			name:    "wrong request version",
+			input:   append(append([]byte(nil), greeting...), 4, socksCmdConnect, 0, socksAddrIPv4),
+			written: chosen,
+		},
+		{
+			name:    "BIND",
+			input:   append(append([]byte(nil), greeting...), socksVersion, 0x02, 0, socksAddrIPv4),
+			written: reply(socksCmdNotSupported),
+		},
+		{
+			name:    "unknown address type",
+			input:   request(0x05, 127, 0, 0, 1, 0, 80),
+			written: reply(socksAddrTypeNotSupported),
+		},
+		{
+			name:    "truncated IPv4",
+			input:   request(socksAddrIPv4, 127, 0),
+			written: chosen,
+		},
+		{
+			name:    "truncated domain",
+			input:   request(socksAddrDomain, 11, 'e', 'x'),
+			written: chosen,
+		},
+		{
+			name:    "missing port",
+			input:   request(socksAddrIPv4, 127, 0, 0, 1),
+			written: chosen,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, written := scriptedConn(t, tt.input)
+			dial, err := readSocksRequest(conn)
+			if tt.addr == "" {
+				if err == nil {
+					t.Fatalf("expected error, got destination %s", dial.req.Addr)
+				}
+			} else if err != nil {
+				t.Fatal("error reading request: ", err)
+			} else if dial.req.Addr != tt.addr {
+				t.Fatalf("expected destination %s, got %s", tt.addr, dial.req.Addr)
+			} else if err := dial.reply(true); err != nil {
+				t.Fatal("error replying: ", err)
+			}
+			conn.Close()
+			if got := <-written; !bytes.Equal(got, tt.written) {
+				t.Fatalf("expected %x written, got %x", tt.written, got)
+			}
+		})
+	}
+}
+
+func TestAcceptClientSocks(t *testing.T) {
+	oldReadyCh := readyCh
+	readyCh = make(chan utils.Unit, 10)
+	t.Cleanup(func() { readyCh = oldReadyCh })
+	sc := &ServiceConfig{Mode: modeSocks}
+	if err := sc.parseSchedule(); err != nil {
+		t.Fatal("error parsing schedule: ", err)
+	}
+
+	tests := []struct {
+		resp, rep byte
+	}{
+		{resp: connReady, rep: socksSucceeded},
+		{resp: dialFailed, rep: socksGeneralFailure},
+	}
+	for _, tt := range tests {
+		svc := newService("socks", sc)
+		reqs := make(chan DialRequest, 1)
+		putFakeEgressConn(t, svc, tt.resp, reqs)
+		clientConn, proxySide := net.Pipe()
+		defer clientConn.Close()
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		go svc.acceptClient(proxySide)
+
+		go clientConn.Write([]byte{
+			socksVersion, 1, socksNoAuth,
+			socksVersion, socksCmdConnect, 0, socksAddrDomain, 11,
+			'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x01, 0xbb,
+		})
+		b := make([]byte, 2+10)
+		if _, err := io.ReadFull(clientConn, b); err != nil {
+			t.Fatal("error reading SOCKS replies: ", err)
+		} else if req := <-reqs; req.Addr != "example.com:443" {
+			t.Fatalf("expected the client's destination sent, got %s", req.Addr)
+		} else if b[3] != tt.rep {
+			t.Fatalf("expected reply %d, got %d", tt.rep, b[3])
+		}
+		if tt.resp != connReady {
+			continue
+		}
+		go clientConn.Write([]byte("ping"))
+		if _, err := io.ReadFull(clientConn, b[:4]); err != nil ||
+			string(b[:4]) != "ping" {
+			t.Fatalf("expected the client piped, got %q (err: %v)", b[:4], err)
+		}
+	}
+}
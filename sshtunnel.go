@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Tunnels in environments whose only egress is SSH can reach the proxy
+// through a bastion (--ssh user@bastion), which connects to paddr on their
+// behalf. The tunnel keeps one SSH connection to the bastion, and each tunnel
+// conn is a forwarded channel (direct-tcpip, as with ssh -W) of it, so only
+// the first conn pays for the SSH handshake. It authenticates with the keys of
+// the SSH agent (SSH_AUTH_SOCK) and the ssh-key (or ~/.ssh/id_ed25519,
+// id_ecdsa, and id_rsa), and the bastion's host key must be in ssh-known-hosts.
+// SSH channels don't support deadlines, so a bastion that stops responding is
+// noticed through keepalives, which close the connection (and its conns).
+
+var (
+	// tunnelSSH is the SSH destination (user@host, or ssh://user@host:port)
+	// the tunnel reaches the proxies through (blank means none).
+	tunnelSSH string
+	// sshKeyFile is the private key file to authenticate to the bastion with
+	// (blank means the default ones).
+	sshKeyFile string
+	// sshKnownHosts is the known_hosts file with the bastion's host key
+	// (blank means ~/.ssh/known_hosts).
+	sshKnownHosts string
+)
+
+const (
+	// sshDefaultPort is the port of SSH destinations without one.
+	sshDefaultPort = "22"
+	// sshKeepAlive is how often the SSH connection is kept alive (and how
+	// long a keepalive can go unanswered before it's closed).
+	sshKeepAlive = 15 * time.Second
+)
+
+// sshDefaultKeys are the key files (in ~/.ssh) tried without an ssh-key.
+var sshDefaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+var sshState struct {
+	sync.Mutex
+	// addr is the bastion's address.
+	addr   string
+	config *ssh.ClientConfig
+	// client is the connection to the bastion (nil if there's none yet).
+	client *ssh.Client
+	// closed is closed once the client's connection has ended.
+	closed chan struct{}
+}
+
+// setupSSH sets up reaching the proxies through the SSH destination, if any.
+func setupSSH() error {
+	if tunnelSSH == "" {
+		return nil
+	}
+	username, addr, err := parseSSHDest(tunnelSSH)
+	if err != nil {
+		return fmt.Errorf("invalid ssh destination: %w", err)
+	}
+	auth, err := sshAuthMethods(sshKeyFile)
+	if err != nil {
+		return err
+	}
+	knownHosts := sshKnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("error finding known_hosts: %w", err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return fmt.Errorf("error loading ssh known hosts: %w", err)
+	}
+	sshState.Lock()
+	defer sshState.Unlock()
+	sshState.addr = addr
+	sshState.config = &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         idleTimeout,
+	}
+	return nil
+}
+
+// parseSSHDest parses an SSH destination (user@host[:port], or
+// ssh://user@host[:port]) into its user (the current user if there's none)
+// and address.
+func parseSSHDest(dest string) (username, addr string, err error) {
+	if strings.HasPrefix(dest, "ssh://") {
+		u, err := url.Parse(dest)
+		if err != nil {
+			return "", "", err
+		} else if u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return "", "", errors.New("expected ssh://[user@]host[:port]")
+		}
+		username, addr = u.User.Username(), u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), sshDefaultPort)
+		}
+	} else {
+		host := dest
+		if i := strings.LastIndexByte(dest, '@'); i != -1 {
+			username, host = dest[:i], dest[i+1:]
+		}
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			addr = host
+		} else {
+			addr = net.JoinHostPort(strings.Trim(host, "[]"), sshDefaultPort)
+		}
+	}
+	if host, _, _ := net.SplitHostPort(addr); host == "" {
+		return "", "", errors.New("missing host")
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", "", fmt.Errorf("no user given and no current user: %w", err)
+		}
+		username = u.Username
+	}
+	return username, addr, nil
+}
+
+// sshAuthMethods returns the methods to authenticate to the bastion with:
+// the SSH agent's keys (if there's an agent) and the key file (or the default
+// ones that exist, skipping those that are encrypted).
+func sshAuthMethods(keyFile string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			return agent.NewClient(conn).Signers()
+		}))
+	}
+	var signers []ssh.Signer
+	if keyFile != "" {
+		signer, err := loadSSHKey(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading ssh key: %w", err)
+		}
+		signers = append(signers, signer)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range sshDefaultKeys {
+			path := filepath.Join(home, ".ssh", name)
+			signer, err := loadSSHKey(path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				log.Printf("Skipping ssh key %s: %v", path, err)
+				continue
+			}
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) != 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New(
+			`no ssh keys (run an ssh agent or pass "ssh-key")`,
+		)
+	}
+	return methods, nil
+}
+
+// loadSSHKey loads the (unencrypted) private key file.
+func loadSSHKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+// sshClient returns the connection to the bastion, connecting if there's
+// none that's still open.
+func sshClient() (*ssh.Client, error) {
+	sshState.Lock()
+	defer sshState.Unlock()
+	if sshState.client != nil {
+		select {
+		case <-sshState.closed:
+		default:
+			return sshState.client, nil
+		}
+	}
+	addr := sshState.addr
+	client, err := ssh.Dial("tcp", addr, sshState.config)
+	if err != nil {
+		return nil, err
+	}
+	closed := make(chan struct{})
+	go func() {
+		err := client.Wait()
+		close(closed)
+		log.Printf("SSH connection to %s ended: %v", addr, err)
+	}()
+	go sshKeepAliveLoop(client, closed)
+	sshState.client, sshState.closed = client, closed
+	return client, nil
+}
+
+// sshKeepAliveLoop keeps the connection alive until it's closed, closing it
+// if a keepalive goes unanswered.
+func sshKeepAliveLoop(client *ssh.Client, closed chan struct{}) {
+	ticker := time.NewTicker(sshKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		timer := time.AfterFunc(sshKeepAlive, func() { client.Close() })
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		timer.Stop()
+		if err != nil {
+			client.Close()
+			return
+		}
+	}
+}
+
+// dialSSH connects to the address through the SSH destination, completing
+// the TLS handshake if it's enabled.
+func dialSSH(addr string) (net.Conn, error) {
+	client, err := sshClient()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ssh destination: %w", err)
+	}
+	conn, err := client.Dial("tcp", addr)
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+	cfg := tlsConfig
+	if cfg.ServerName == "" {
+		cfg = tlsConfig.Clone()
+		if cfg.ServerName, _, err = net.SplitHostPort(addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	tc := tls.Client(conn, cfg)
+	// Bounded by closing the conn since its deadlines aren't supported
+	timer := time.AfterFunc(idleTimeout, func() { conn.Close() })
+	err = tc.Handshake()
+	if !timer.Stop() && err == nil {
+		err = errors.New("TLS handshake timed out")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
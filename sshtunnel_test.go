@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestParseSSHDest(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("no current user: ", err)
+	}
+	tests := []struct {
+		dest, user, addr string
+		// wantErr is whether the destination is invalid.
+		wantErr bool
+	}{
+		{dest: "bob@bastion", user: "bob", addr: "bastion:22"},
+		{dest: "bob@bastion:2222", user: "bob", addr: "bastion:2222"},
+		{dest: "bastion", user: u.Username, addr: "bastion:22"},
+		{dest: "bob@[::1]", user: "bob", addr: "[::1]:22"},
+		{dest: "bob@[::1]:2222", user: "bob", addr: "[::1]:2222"},
+		{dest: "ssh://bob@bastion:2222", user: "bob", addr: "bastion:2222"},
+		{dest: "ssh://bastion", user: u.Username, addr: "bastion:22"},
+		{dest: "bob@", wantErr: true},
+		{dest: "ssh://bob@bastion/path", wantErr: true},
+	}
+	for _, tt := range tests {
+		gotUser, gotAddr, err := parseSSHDest(tt.dest)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q and %q", tt.dest, gotUser, gotAddr)
+			}
+		} else if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.dest, err)
+		} else if gotUser != tt.user || gotAddr != tt.addr {
+			t.Errorf(
+				"%q: expected %q and %q, got %q and %q",
+				tt.dest, tt.user, tt.addr, gotUser, gotAddr,
+			)
+		}
+	}
+}
+
+// startTestSSH starts an SSH server forwarding direct-tcpip channels for the
+// client key, returning its address and host key.
+func startTestSSH(t *testing.T, clientKey ssh.PublicKey) (string, ssh.PublicKey) {
+	t.Helper()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(
+			_ ssh.ConnMetadata, key ssh.PublicKey,
+		) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSH(conn, cfg)
+		}
+	}()
+	return ln.Addr().String(), hostKey.PublicKey()
+}
+
+// serveTestSSH serves the SSH conn, forwarding its direct-tcpip channels.
+func serveTestSSH(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		var dest struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if nc.ChannelType() != "direct-tcpip" ||
+			ssh.Unmarshal(nc.ExtraData(), &dest) != nil {
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		target, err := net.Dial(
+			"tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))),
+		)
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			io.Copy(ch, target)
+			ch.CloseWrite()
+		}()
+		go func() {
+			io.Copy(target, ch)
+			target.Close()
+		}()
+	}
+}
+
+func TestDialSSH(t *testing.T) {
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sshAddr, hostKey := startTestSSH(t, clientSigner.PublicKey())
+	echoAddr := tunnelittest.StartEchoBackend(t)
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	oldDest, oldKey, oldKnown := tunnelSSH, sshKeyFile, sshKnownHosts
+	t.Cleanup(func() {
+		tunnelSSH, sshKeyFile, sshKnownHosts = oldDest, oldKey, oldKnown
+	})
+	tunnelSSH, sshKeyFile = "tester@"+sshAddr, keyFile
+
+	tests := []struct {
+		name string
+		// trusted is whether the server's host key is known.
+		trusted bool
+	}{
+		{name: "known host key", trusted: true},
+		{name: "unknown host key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			knownKey := hostKey
+			if !tt.trusted {
+				pub, _, err := ed25519.GenerateKey(rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if knownKey, err = ssh.NewPublicKey(pub); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sshKnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+			line := knownhosts.Line([]string{sshAddr}, knownKey) + "\n"
+			if err := os.WriteFile(sshKnownHosts, []byte(line), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := setupSSH(); err != nil {
+				t.Fatal("error setting up ssh: ", err)
+			}
+			t.Cleanup(func() {
+				sshState.Lock()
+				defer sshState.Unlock()
+				if sshState.client != nil {
+					sshState.client.Close()
+					sshState.client = nil
+				}
+			})
+
+			conn, err := dialSSH(echoAddr)
+			if !tt.trusted {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected unknown host key to be rejected")
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error dialing through ssh: ", err)
+			}
+			defer conn.Close()
+			first, _ := sshClient()
+			// A second conn shares the SSH connection
+			conn2, err := dialSSH(echoAddr)
+			if err != nil {
+				t.Fatal("error dialing second conn through ssh: ", err)
+			}
+			defer conn2.Close()
+			if second, _ := sshClient(); second != first {
+				t.Fatal("expected conns to share the SSH connection")
+			}
+			for _, c := range []net.Conn{conn, conn2} {
+				if _, err := c.Write([]byte("ping")); err != nil {
+					t.Fatal("error writing: ", err)
+				}
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+					t.Fatalf("expected echo, got %q (err: %v)", b, err)
+				}
+			}
+		})
+	}
+}
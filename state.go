@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the proxy state that is persisted to the state file (if one is
+// given).
+type State struct {
+	Tokens map[string]*Token `json:"tokens"`
+	// Usage is the usage of each service, keyed by service and then day.
+	Usage map[string]map[string]*Usage `json:"usage,omitempty"`
+
+	mtx        sync.Mutex
+	path       string
+	usageDirty bool
+}
+
+// Token is a named credential that a tunnel can use in place of the shared
+// password. Only the hash of the token is stored.
+type Token struct {
+	Name    string      `json:"name"`
+	Hash    string      `json:"hash"`
+	Created time.Time   `json:"created"`
+	Limits  TokenLimits `json:"limits"`
+	// Rotated is when the token's secret was last rotated (zero if never).
+	Rotated time.Time `json:"rotated"`
+	// PrevHash is the hash of the token's previous secret, which is accepted
+	// until PrevExpires so that tunnels can be moved to the new one.
+	PrevHash    string    `json:"prev_hash,omitempty"`
+	PrevExpires time.Time `json:"prev_expires"`
+}
+
+var (
+	stateFile string
+	state     = newState("")
+)
+
+func newState(path string) *State {
+	return &State{
+		Tokens: make(map[string]*Token),
+		Usage:  make(map[string]map[string]*Usage),
+		path:   path,
+	}
+}
+
+// LoadState loads the state from the given path. A nonexistent file results
+// in an empty state that will be created on the first save.
+func LoadState(path string) (*State, error) {
+	s := newState(path)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("error parsing state file: %w", err)
+	}
+	if s.Tokens == nil {
+		s.Tokens = make(map[string]*Token)
+	}
+	if s.Usage == nil {
+		s.Usage = make(map[string]map[string]*Usage)
+	}
+	return s, nil
+}
+
+// save writes the state to its file. The mutex must be held.
+func (s *State) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file and rename so a crash can't leave a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".tunnelit-state-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// newTokenSecret returns a new random token secret and its hex-encoded hash.
+func newTokenSecret() (secret, hash string, err error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", "", err
+	}
+	secret = hex.EncodeToString(b[:])
+	h := sha256.Sum256([]byte(secret))
+	return secret, hex.EncodeToString(h[:]), nil
+}
+
+// CreateToken creates a new token with the given name and limits, returning
+// the token secret. The secret is not stored and cannot be retrieved again.
+func (s *State) CreateToken(name string, limits TokenLimits) (string, error) {
+	secret, hash, err := newTokenSecret()
+	if err != nil {
+		return "", err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.Tokens[name]; ok {
+		return "", fmt.Errorf("token %q already exists", name)
+	}
+	s.Tokens[name] = &Token{
+		Name:    name,
+		Hash:    hash,
+		Created: time.Now().UTC(),
+		Limits:  limits,
+	}
+	if err := s.save(); err != nil {
+		delete(s.Tokens, name)
+		return "", err
+	}
+	return secret, nil
+}
+
+// RevokeToken deletes the token with the given name, returning false if it
+// didn't exist.
+func (s *State) RevokeToken(name string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tok, ok := s.Tokens[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.Tokens, name)
+	if err := s.save(); err != nil {
+		s.Tokens[name] = tok
+		return false, err
+	}
+	return true, nil
+}
+
+// RotateToken replaces the secret of the token with the given name, returning
+// the new secret (or false if the token doesn't exist). The old secret is
+// accepted for the grace period. Conns already authenticated with the old
+// secret are unaffected.
+func (s *State) RotateToken(
+	name string, grace time.Duration,
+) (string, bool, error) {
+	secret, hash, err := newTokenSecret()
+	if err != nil {
+		return "", false, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tok, ok := s.Tokens[name]
+	if !ok {
+		return "", false, nil
+	}
+	old := *tok
+	now := time.Now().UTC()
+	tok.Hash, tok.Rotated = hash, now
+	tok.PrevHash, tok.PrevExpires = "", time.Time{}
+	if grace > 0 {
+		tok.PrevHash, tok.PrevExpires = old.Hash, now.Add(grace)
+	}
+	if err := s.save(); err != nil {
+		*tok = old
+		return "", false, err
+	}
+	return secret, true, nil
+}
+
+// ListTokens returns copies of all the tokens.
+func (s *State) ListTokens() []Token {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	toks := make([]Token, 0, len(s.Tokens))
+	for _, tok := range s.Tokens {
+		toks = append(toks, *tok)
+	}
+	sort.Slice(toks, func(i, j int) bool { return toks[i].Name < toks[j].Name })
+	return toks
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+// setState sets the state for the test.
+func setState(t *testing.T, s *State) {
+	t.Helper()
+	old := state
+	state = s
+	t.Cleanup(func() { state = old })
+}
+
+func TestStateTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := LoadState(path)
+	if err != nil {
+		t.Fatal("error loading nonexistent state: ", err)
+	}
+	limits := TokenLimits{MaxConns: 3}
+	secret, err := s.CreateToken("a", limits)
+	if err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+	if _, err := s.CreateToken("a", TokenLimits{}); err == nil {
+		t.Fatal("expected an error creating a duplicate token")
+	}
+	if _, err := s.CreateToken("b", TokenLimits{}); err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+
+	// The tokens (and only the hash of the secret) are persisted
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatal("error loading state: ", err)
+	}
+	toks := loaded.ListTokens()
+	if len(toks) != 2 || toks[0].Name != "a" || toks[1].Name != "b" {
+		t.Fatalf("expected tokens a and b, got %+v", toks)
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if toks[0].Hash != hex.EncodeToString(hash[:]) {
+		t.Fatal("expected the hash of the secret to be stored")
+	} else if toks[0].Limits != limits {
+		t.Fatalf("expected limits %+v, got %+v", limits, toks[0].Limits)
+	}
+
+	if ok, err := loaded.RevokeToken("a"); err != nil || !ok {
+		t.Fatalf("expected token to be revoked, got %v, %v", ok, err)
+	}
+	if ok, err := loaded.RevokeToken("a"); err != nil || ok {
+		t.Fatalf("expected revoked token not to be found, got %v, %v", ok, err)
+	}
+	loaded, err = LoadState(path)
+	if err != nil {
+		t.Fatal("error loading state: ", err)
+	}
+	if toks := loaded.ListTokens(); len(toks) != 1 || toks[0].Name != "b" {
+		t.Fatalf("expected only token b after revoking, got %+v", toks)
+	}
+}
+
+func TestLoadStateInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadState(path); err == nil {
+		t.Fatal("expected an error loading an invalid state file")
+	}
+}
+
+func TestHandleTokens(t *testing.T) {
+	setState(t, newState(""))
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		if strings.HasPrefix(target, "/tokens/") {
+			handleToken(rec, r)
+		} else {
+			handleTokens(rec, r)
+		}
+		return rec
+	}
+
+	tests := []struct {
+		name, method, target, body string
+		want                       int
+	}{
+		{
+			name: "create", method: http.MethodPost, target: "/tokens",
+			body: `{"name":"a","max_conns":2}`, want: http.StatusCreated,
+		},
+		{
+			name: "duplicate", method: http.MethodPost, target: "/tokens",
+			body: `{"name":"a"}`, want: http.StatusConflict,
+		},
+		{
+			name: "missing name", method: http.MethodPost, target: "/tokens",
+			body: `{}`, want: http.StatusBadRequest,
+		},
+		{
+			name: "bad body", method: http.MethodPost, target: "/tokens",
+			body: `{`, want: http.StatusBadRequest,
+		},
+		{
+			name: "negative limit", method: http.MethodPost, target: "/tokens",
+			body: `{"name":"b","max_conns":-1}`, want: http.StatusBadRequest,
+		},
+		{
+			name: "bad method", method: http.MethodPut, target: "/tokens",
+			want: http.StatusMethodNotAllowed,
+		},
+		{
+			name: "revoke bad method", method: http.MethodGet, target: "/tokens/a",
+			want: http.StatusMethodNotAllowed,
+		},
+		{
+			name: "revoke missing", method: http.MethodDelete, target: "/tokens/b",
+			want: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		if rec := do(tt.method, tt.target, tt.body); rec.Code != tt.want {
+			t.Fatalf(
+				"%s: expected %d, got %d: %s", tt.name, tt.want, rec.Code, rec.Body,
+			)
+		}
+	}
+
+	rec := do(http.MethodGet, "/tokens", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d listing tokens, got %d", http.StatusOK, rec.Code)
+	} else if strings.Contains(rec.Body.String(), "hash") {
+		t.Fatalf("expected token hashes not to be listed, got %s", rec.Body)
+	}
+	var infos []struct {
+		Name   string      `json:"name"`
+		Limits TokenLimits `json:"limits"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal("error decoding tokens: ", err)
+	}
+	if len(infos) != 1 || infos[0].Name != "a" || infos[0].Limits.MaxConns != 2 {
+		t.Fatalf("expected token a with 2 max conns, got %+v", infos)
+	}
+
+	rec = do(http.MethodDelete, "/tokens/a", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d revoking, got %d", http.StatusNoContent, rec.Code)
+	}
+	if toks := state.ListTokens(); len(toks) != 0 {
+		t.Fatalf("expected no tokens after revoking, got %+v", toks)
+	}
+}
+
+func TestStateRotateToken(t *testing.T) {
+	s := newState("")
+	first, err := s.CreateToken("laptop", TokenLimits{})
+	if err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+	accepted := func(secret string) bool {
+		hash := sha256.Sum256([]byte(secret))
+		_, ok := s.TokenForAuth(hash[:], nil, nil)
+		return ok
+	}
+	second, ok, err := s.RotateToken("laptop", time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("error rotating token: %v (found: %v)", err, ok)
+	} else if second == first {
+		t.Fatal("expected a new secret")
+	} else if !accepted(first) || !accepted(second) {
+		t.Fatal("expected both secrets accepted during the grace period")
+	}
+	if tok := s.ListTokens()[0]; tok.Rotated.IsZero() {
+		t.Fatal("expected the rotation time recorded")
+	}
+
+	// Once the grace period is over, only the new secret is accepted
+	s.mtx.Lock()
+	s.Tokens["laptop"].PrevExpires = time.Now().Add(-time.Second)
+	s.mtx.Unlock()
+	if accepted(first) || !accepted(second) {
+		t.Fatal("expected only the new secret accepted after the grace period")
+	}
+
+	// Without a grace period, the old secret stops working immediately
+	third, _, err := s.RotateToken("laptop", 0)
+	if err != nil {
+		t.Fatal("error rotating token: ", err)
+	} else if accepted(second) || !accepted(third) {
+		t.Fatal("expected only the new secret accepted without a grace period")
+	}
+	if _, ok, err := s.RotateToken("unknown", 0); ok || err != nil {
+		t.Fatalf("expected an unknown token not found, got %v, %v", ok, err)
+	}
+}
+
+func TestHandleRotateToken(t *testing.T) {
+	setState(t, newState(""))
+	if _, err := state.CreateToken("laptop", TokenLimits{}); err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+	tests := []struct {
+		name, method, target string
+		want                 int
+	}{
+		{
+			name: "bad method", method: http.MethodGet,
+			target: "/tokens/laptop/rotate", want: http.StatusMethodNotAllowed,
+		},
+		{
+			name: "bad grace", method: http.MethodPost,
+			target: "/tokens/laptop/rotate?grace=-1m", want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown", method: http.MethodPost,
+			target: "/tokens/unknown/rotate", want: http.StatusNotFound,
+		},
+		{
+			name: "rotate", method: http.MethodPost,
+			target: "/tokens/laptop/rotate?grace=1m", want: http.StatusOK,
+		},
+	}
+	var resp struct{ Name, Token string }
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleToken(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		if rec.Code != tt.want {
+			t.Fatalf(
+				"%s: expected %d, got %d: %s", tt.name, tt.want, rec.Code, rec.Body,
+			)
+		} else if rec.Code == http.StatusOK {
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+		}
+	}
+	hash := sha256.Sum256([]byte(resp.Token))
+	if tok, ok := state.TokenForAuth(hash[:], nil, nil); !ok ||
+		resp.Name != "laptop" || tok.Name != "laptop" {
+		t.Fatalf("expected the new secret for laptop, got %+v", resp)
+	} else if tok.PrevExpires.IsZero() {
+		t.Fatal("expected the old secret to have a grace period")
+	}
+}
+
+func TestRevokeTokenClosesIdle(t *testing.T) {
+	setTestPassword(t)
+	setState(t, newState(""))
+	secret, err := state.CreateToken("laptop", TokenLimits{})
+	if err != nil {
+		t.Fatal("error creating token: ", err)
+	}
+	svc := newService("web", &ServiceConfig{})
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+
+	reg := Registration{Service: "web", Tunnel: "laptop"}
+	status, conn := registerTunnel(t, sha256.Sum256([]byte(secret)), reg)
+	if status != passwordOk {
+		t.Fatalf("expected the token accepted, got %d", status)
+	}
+	waitFor(t, "the conn to be pooled", func() bool {
+		return svc.idle.tunnelStats()["laptop"].IdleConns == 1
+	})
+	rec := httptest.NewRecorder()
+	handleToken(rec, httptest.NewRequest(http.MethodDelete, "/tokens/laptop", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected the token revoked, got %d", rec.Code)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the token's idle conn to be closed")
+	}
+}
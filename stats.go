@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Stats holds live counters for the connections going through a process.
+type Stats struct {
+	// Conns is the total number of connections piped.
+	Conns atomic.Uint64
+	// ActiveConns is the number of pipes currently running.
+	ActiveConns atomic.Int64
+	// WaitingClients is the number of clients waiting for an idle tunnel conn.
+	WaitingClients atomic.Int64
+	// BytesUp is the total number of bytes sent from clients to the server.
+	BytesUp atomic.Uint64
+	// BytesDown is the total number of bytes sent from the server to clients.
+	BytesDown atomic.Uint64
+}
+
+// stats are the process-wide stats, used by the tunnel.
+var stats Stats
+
+// ServiceStats is a snapshot of the stats for a service, as reported by the
+// admin API.
+type ServiceStats struct {
+	// Addr and WSAddr are the addresses the service's listeners are bound to.
+	Addr           string `json:"addr,omitempty"`
+	WSAddr         string `json:"ws_addr,omitempty"`
+	Conns          uint64 `json:"conns"`
+	ActiveConns    int64  `json:"active_conns"`
+	WaitingClients int64  `json:"waiting_clients"`
+	IdleConns      int    `json:"idle_conns"`
+	MaxIdleConns   int    `json:"max_idle_conns"`
+	BytesUp        uint64 `json:"bytes_up"`
+	BytesDown      uint64 `json:"bytes_down"`
+	// Tunnels holds the stats for each tunnel serving the service.
+	Tunnels map[string]TunnelStats `json:"tunnels,omitempty"`
+}
+
+// serviceStats returns the stats for each service, keyed by name.
+func serviceStats() map[string]ServiceStats {
+	svcs := allServices()
+	all := make(map[string]ServiceStats, len(svcs))
+	for name, svc := range svcs {
+		eps := svc.endpoints(nil)
+		all[name] = ServiceStats{
+			Addr:           eps.Addr,
+			WSAddr:         eps.WSAddr,
+			Conns:          svc.stats.Conns.Load(),
+			ActiveConns:    svc.stats.ActiveConns.Load(),
+			WaitingClients: svc.stats.WaitingClients.Load(),
+			IdleConns:      svc.idle.Len(),
+			MaxIdleConns:   int(maxIdleConns),
+			BytesUp:        svc.stats.BytesUp.Load(),
+			BytesDown:      svc.stats.BytesDown.Load(),
+			Tunnels:        svc.idle.tunnelStats(),
+		}
+	}
+	return all
+}
+
+// TagStats is a snapshot of the stats for a tag, as reported by the admin API.
+type TagStats struct {
+	Conns       uint64 `json:"conns"`
+	ActiveConns int64  `json:"active_conns"`
+	BytesUp     uint64 `json:"bytes_up"`
+	BytesDown   uint64 `json:"bytes_down"`
+}
+
+// allTagStats returns the stats for each tag. The bytes are only updated once
+// each connection is done.
+func allTagStats() map[string]TagStats {
+	all := make(map[string]TagStats, len(tagStats))
+	for tag, ts := range tagStats {
+		all[tag] = TagStats{
+			Conns:       ts.Conns.Load(),
+			ActiveConns: ts.ActiveConns.Load(),
+			BytesUp:     ts.BytesUp.Load(),
+			BytesDown:   ts.BytesDown.Load(),
+		}
+	}
+	return all
+}
+
+// countConn counts the bytes written to the conn.
+type countConn struct {
+	net.Conn
+	count *atomic.Uint64
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.count.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// TagRule tags client connections matching all of its (non-empty) criteria.
+type TagRule struct {
+	// Tag is the tag given to matching connections.
+	Tag string `json:"tag"`
+	// CIDRs are the networks the client's address must be in (any of).
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Services are the services the client must be connecting to (any of).
+	Services []string `json:"services,omitempty"`
+	// SNI are the server names the client's TLS client hello must be for (any
+	// of), either exact or wildcards of one label (e.g., "*.example.com").
+	// Requires services, whose clients' TLS client hellos are then peeked at
+	// (clients without TLS don't match).
+	SNI []string `json:"sni,omitempty"`
+
+	nets []*net.IPNet
+}
+
+var (
+	tagRules []*TagRule
+	// tagStats holds the stats for each tag defined by the tag rules.
+	tagStats map[string]*Stats
+	// logSkipTags are the tags of connections whose pipes aren't logged.
+	logSkipTags []string
+)
+
+func (tr *TagRule) parse() error {
+	if tr.Tag == "" {
+		return fmt.Errorf("missing tag")
+	}
+	if len(tr.SNI) != 0 && len(tr.Services) == 0 {
+		return fmt.Errorf("sni requires services")
+	}
+	tr.nets = tr.nets[:0]
+	for _, cidr := range tr.CIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		tr.nets = append(tr.nets, ipNet)
+	}
+	return nil
+}
+
+// Matches returns whether a client with the given address connecting to the
+// given service with the given SNI (blank if unknown) matches the rule.
+func (tr *TagRule) Matches(clientAddr net.Addr, svcName, sni string) bool {
+	if len(tr.nets) != 0 {
+		tcpAddr, ok := clientAddr.(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, ipNet := range tr.nets {
+			if ipNet.Contains(tcpAddr.IP) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(tr.Services) != 0 {
+		matched := false
+		for _, name := range tr.Services {
+			if name == svcName {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return len(tr.SNI) == 0 || sniMatches(tr.SNI, sni)
+}
+
+// newTagStats creates the stats for each tag in the rules.
+func newTagStats(rules []*TagRule) map[string]*Stats {
+	ts := make(map[string]*Stats)
+	for _, tr := range rules {
+		if _, ok := ts[tr.Tag]; !ok {
+			ts[tr.Tag] = &Stats{}
+		}
+	}
+	return ts
+}
+
+// tagsFor returns the (sorted, deduplicated) tags for a client with the given
+// address connecting to the given service with the given SNI.
+func tagsFor(clientAddr net.Addr, svcName, sni string) []string {
+	var tags []string
+	for _, tr := range tagRules {
+		if tr.Matches(clientAddr, svcName, sni) && !containsStr(tags, tr.Tag) {
+			tags = append(tags, tr.Tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// tagsNeedSNI returns whether any tag rule for the service matches on SNI.
+func tagsNeedSNI(svcName string) bool {
+	for _, tr := range tagRules {
+		if len(tr.SNI) != 0 && containsStr(tr.Services, svcName) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldLogTags returns whether a connection with the given tags should be
+// logged.
+func shouldLogTags(tags []string) bool {
+	for _, tag := range tags {
+		if containsStr(logSkipTags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func formatTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+func containsStr(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
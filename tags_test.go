@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTagRuleMatchesSNI(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	tests := []struct {
+		name string
+		rule TagRule
+		svc  string
+		sni  string
+		want bool
+	}{
+		{
+			name: "exact",
+			rule: TagRule{Services: []string{"web"}, SNI: []string{"api.example.com"}},
+			svc:  "web", sni: "API.example.com", want: true,
+		},
+		{
+			name: "wildcard",
+			rule: TagRule{Services: []string{"web"}, SNI: []string{"*.example.com"}},
+			svc:  "web", sni: "api.example.com", want: true,
+		},
+		{
+			name: "wildcard matches one label",
+			rule: TagRule{Services: []string{"web"}, SNI: []string{"*.example.com"}},
+			svc:  "web", sni: "a.api.example.com",
+		},
+		{
+			name: "no TLS",
+			rule: TagRule{Services: []string{"web"}, SNI: []string{"*.example.com"}},
+			svc:  "web",
+		},
+		{
+			name: "other service",
+			rule: TagRule{Services: []string{"web"}, SNI: []string{"api.example.com"}},
+			svc:  "db", sni: "api.example.com",
+		},
+		{
+			name: "with cidrs",
+			rule: TagRule{
+				CIDRs: []string{"10.0.0.0/8"}, Services: []string{"web"},
+				SNI: []string{"api.example.com"},
+			},
+			svc: "web", sni: "api.example.com", want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Tag = "tag"
+			if err := tt.rule.parse(); err != nil {
+				t.Fatal("error parsing rule: ", err)
+			}
+			if got := tt.rule.Matches(addr, tt.svc, tt.sni); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+	rule := TagRule{Tag: "tag", SNI: []string{"api.example.com"}}
+	if err := rule.parse(); err == nil {
+		t.Fatal("expected error parsing sni rule without services")
+	}
+}
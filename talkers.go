@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// talkerWindowSecs is the longest window (in seconds) that top talkers are
+	// tracked over.
+	talkerWindowSecs = 60
+	// defaultTalkerWindow is the window top talkers are reported over by
+	// default.
+	defaultTalkerWindow = 10 * time.Second
+	// talkerSweepInterval is how often talkers that are no longer active are
+	// removed.
+	talkerSweepInterval = time.Minute
+)
+
+// talker counts the bytes transferred by a client IP or service, keeping
+// per-second buckets so they can be summed over sliding windows.
+type talker struct {
+	mtx      sync.Mutex
+	up, down [talkerWindowSecs]uint64
+	lastSec  int64
+	// pipes is the number of active pipes counted by the talker. It's guarded
+	// by the set's mutex.
+	pipes int
+}
+
+// add records n bytes sent from (up) or to the client.
+func (t *talker) add(up bool, n uint64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	sec := t.advance()
+	if up {
+		t.up[sec%talkerWindowSecs] += n
+	} else {
+		t.down[sec%talkerWindowSecs] += n
+	}
+}
+
+// sums returns the bytes transferred in each direction in the last secs
+// seconds.
+func (t *talker) sums(secs int64) (up, down uint64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	sec := t.advance()
+	for i := int64(0); i < secs; i++ {
+		up += t.up[(sec-i)%talkerWindowSecs]
+		down += t.down[(sec-i)%talkerWindowSecs]
+	}
+	return up, down
+}
+
+// advance clears the buckets that have expired since the last call and
+// returns the current second. The mutex must be held.
+func (t *talker) advance() int64 {
+	sec := time.Now().Unix()
+	if sec <= t.lastSec {
+		return t.lastSec
+	}
+	for s, n := t.lastSec+1, 0; s <= sec && n < talkerWindowSecs; s, n = s+1, n+1 {
+		t.up[s%talkerWindowSecs], t.down[s%talkerWindowSecs] = 0, 0
+	}
+	t.lastSec = sec
+	return sec
+}
+
+// talkerSet holds the talkers of a kind (client IPs or services) by name.
+type talkerSet struct {
+	mtx     sync.Mutex
+	talkers map[string]*talker
+}
+
+var clientTalkers, serviceTalkers = newTalkerSet(), newTalkerSet()
+
+func newTalkerSet() *talkerSet {
+	return &talkerSet{talkers: make(map[string]*talker)}
+}
+
+// acquire returns the named talker for a new pipe, which must be released
+// once the pipe is done.
+func (ts *talkerSet) acquire(name string) *talker {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	t := ts.talkers[name]
+	if t == nil {
+		t = &talker{lastSec: time.Now().Unix()}
+		ts.talkers[name] = t
+	}
+	t.pipes++
+	return t
+}
+
+func (ts *talkerSet) release(t *talker) {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	t.pipes--
+}
+
+// sweep removes the talkers without active pipes or bytes in the window.
+func (ts *talkerSet) sweep() {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	for name, t := range ts.talkers {
+		if up, down := t.sums(talkerWindowSecs); t.pipes == 0 && up+down == 0 {
+			delete(ts.talkers, name)
+		}
+	}
+}
+
+// sweepTalkersLoop periodically removes the talkers that are no longer active.
+func sweepTalkersLoop() {
+	for range time.Tick(talkerSweepInterval) {
+		clientTalkers.sweep()
+		serviceTalkers.sweep()
+	}
+}
+
+// TalkerStats is a talker's transfer over a window, as reported by the admin
+// API.
+type TalkerStats struct {
+	Name      string `json:"name"`
+	BytesUp   uint64 `json:"bytes_up"`
+	BytesDown uint64 `json:"bytes_down"`
+	// UpRate and DownRate are the average bytes per second over the window.
+	UpRate      float64 `json:"up_rate"`
+	DownRate    float64 `json:"down_rate"`
+	ActiveConns int     `json:"active_conns"`
+}
+
+// top returns the n talkers that transferred the most bytes (in both
+// directions) in the last secs seconds.
+func (ts *talkerSet) top(n int, secs int64) []TalkerStats {
+	ts.mtx.Lock()
+	stats := make([]TalkerStats, 0, len(ts.talkers))
+	for name, t := range ts.talkers {
+		up, down := t.sums(secs)
+		if up+down == 0 && t.pipes == 0 {
+			continue
+		}
+		stats = append(stats, TalkerStats{
+			Name: name, BytesUp: up, BytesDown: down,
+			UpRate:      float64(up) / float64(secs),
+			DownRate:    float64(down) / float64(secs),
+			ActiveConns: t.pipes,
+		})
+	}
+	ts.mtx.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		ti, tj := stats[i].BytesUp+stats[i].BytesDown, stats[j].BytesUp+stats[j].BytesDown
+		if ti != tj {
+			return ti > tj
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// talkerName returns the name a client is counted under: its IP, anonymized
+// if enabled.
+func talkerName(addr net.Addr) string {
+	if anonymizeIPs != "" {
+		return logAddr(addr)
+	}
+	if ip := addrIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr.String()
+}
+
+// TopTalkers are the top talkers over a window, as reported by the admin API.
+type TopTalkers struct {
+	Window   string        `json:"window"`
+	Clients  []TalkerStats `json:"clients"`
+	Services []TalkerStats `json:"services"`
+}
+
+// handleTalkers handles getting the client IPs and services that transferred
+// the most bytes recently. The n query parameter is the number of each to
+// return (default 10) and window is the window to sum over (default 10s, at
+// most 1m).
+func handleTalkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, window := 10, defaultTalkerWindow
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.URL.Query().Get("window"); s != "" {
+		var err error
+		window, err = time.ParseDuration(s)
+		if err != nil || window < time.Second ||
+			window > talkerWindowSecs*time.Second {
+			http.Error(
+				w, "window must be a duration from 1s to 1m", http.StatusBadRequest,
+			)
+			return
+		}
+	}
+	secs := int64(window / time.Second)
+	writeJSON(w, http.StatusOK, TopTalkers{
+		Window:   (time.Duration(secs) * time.Second).String(),
+		Clients:  clientTalkers.top(n, secs),
+		Services: serviceTalkers.top(n, secs),
+	})
+}
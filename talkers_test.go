@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTalkerSums(t *testing.T) {
+	now := time.Now().Unix()
+	tk := &talker{lastSec: now}
+	tk.add(true, 10)
+	tk.add(false, 20)
+	// Bytes from 5 seconds ago only count in windows that long
+	tk.up[(now-5)%talkerWindowSecs] = 100
+	if up, down := tk.sums(3); up != 10 || down != 20 {
+		t.Fatalf("expected 10 up and 20 down over 3s, got %d and %d", up, down)
+	} else if up, _ := tk.sums(10); up != 110 {
+		t.Fatalf("expected 110 up over 10s, got %d", up)
+	}
+
+	// Buckets older than the window are cleared
+	tk.lastSec = now - talkerWindowSecs - 1
+	if up, down := tk.sums(talkerWindowSecs); up != 0 || down != 0 {
+		t.Fatalf("expected the expired bytes cleared, got %d and %d", up, down)
+	}
+}
+
+func TestTalkerSetTop(t *testing.T) {
+	ts := newTalkerSet()
+	big, small, idle := ts.acquire("big"), ts.acquire("small"), ts.acquire("idle")
+	big.add(true, 300)
+	small.add(false, 100)
+	same := ts.acquire("same")
+	same.add(true, 100)
+	ts.release(same)
+
+	top := ts.top(10, 10)
+	want := []string{"big", "same", "small", "idle"}
+	if len(top) != len(want) {
+		t.Fatalf("expected %v, got %+v", want, top)
+	}
+	for i, name := range want {
+		if top[i].Name != name {
+			t.Fatalf("expected %v, got %+v", want, top)
+		}
+	}
+	if top[0].BytesUp != 300 || top[0].UpRate != 30 || top[0].ActiveConns != 1 {
+		t.Fatalf("expected big's stats, got %+v", top[0])
+	} else if top[1].ActiveConns != 0 {
+		t.Fatalf("expected same to be released, got %+v", top[1])
+	}
+	if top := ts.top(2, 10); len(top) != 2 || top[1].Name != "same" {
+		t.Fatalf("expected the top 2, got %+v", top)
+	}
+
+	// Only talkers without pipes or bytes are swept
+	ts.release(idle)
+	ts.sweep()
+	if _, ok := ts.talkers["idle"]; ok {
+		t.Fatal("expected the idle talker to be swept")
+	} else if len(ts.talkers) != 3 {
+		t.Fatalf("expected 3 talkers left, got %d", len(ts.talkers))
+	}
+	ts.release(big)
+	ts.release(small)
+}
+
+func TestTalkerName(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.123"), Port: 4321}
+	setPrivacy(t, "", "")
+	if got := talkerName(addr); got != "192.0.2.123" {
+		t.Fatalf("expected the IP without the port, got %s", got)
+	}
+	setPrivacy(t, "truncate", "")
+	if got := talkerName(addr); got != "192.0.2.0/24" {
+		t.Fatalf("expected the anonymized IP, got %s", got)
+	}
+}
+
+func TestHandleTalkers(t *testing.T) {
+	oldClients, oldServices := clientTalkers, serviceTalkers
+	clientTalkers, serviceTalkers = newTalkerSet(), newTalkerSet()
+	t.Cleanup(func() { clientTalkers, serviceTalkers = oldClients, oldServices })
+	clientTalkers.acquire("192.0.2.1").add(true, 50)
+	clientTalkers.acquire("192.0.2.2").add(true, 10)
+	serviceTalkers.acquire("web").add(false, 60)
+
+	w := httptest.NewRecorder()
+	handleTalkers(w, httptest.NewRequest(
+		http.MethodGet, "/talkers?n=1&window=2500ms", nil,
+	))
+	var got TopTalkers
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal("error decoding talkers: ", err)
+	} else if got.Window != "2s" {
+		t.Fatalf("expected the window rounded down to 2s, got %s", got.Window)
+	} else if len(got.Clients) != 1 || got.Clients[0].Name != "192.0.2.1" {
+		t.Fatalf("expected the top client, got %+v", got.Clients)
+	} else if len(got.Services) != 1 || got.Services[0].BytesDown != 60 {
+		t.Fatalf("expected the web service, got %+v", got.Services)
+	}
+
+	for _, query := range []string{"n=0", "n=x", "window=500ms", "window=2m"} {
+		w := httptest.NewRecorder()
+		handleTalkers(w, httptest.NewRequest(
+			http.MethodGet, "/talkers?"+query, nil,
+		))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	handleTalkers(w, httptest.NewRequest(http.MethodPost, "/talkers", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST to be disallowed, got %d", w.Code)
+	}
+}
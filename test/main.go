@@ -21,6 +21,7 @@ import (
 var (
 	thisDir, binFile          string
 	addr, proxyAddr, srvrAddr string
+	chaosSpec                 string
 
 	// TODO: Do better
 	proxyCmd, tunnelCmd *exec.Cmd
@@ -40,6 +41,7 @@ func init() {
 	addr = envOr("ADDR", "127.0.0.1:17390")
 	proxyAddr = envOr("PROXY_ADDR", "127.0.0.1:17391")
 	srvrAddr = envOr("PROXY_ADDR", "127.0.0.1:17392")
+	chaosSpec = os.Getenv("CHAOS")
 }
 
 func main() {
@@ -81,6 +83,9 @@ func runProxy() {
 		"--log", filepath.Join(thisDir, "proxy.log"),
 		"--idle-conns", "10",
 	)
+	if chaosSpec != "" {
+		cmd.Args = append(cmd.Args, "--chaos", chaosSpec)
+	}
 
 	buf := bytes.NewBuffer(nil)
 	cmd.Stderr = buf
@@ -109,6 +114,9 @@ func runTunnel() {
 		"--log", filepath.Join(thisDir, "tunnel.log"),
 		"--idle-conns", "10",
 	)
+	if chaosSpec != "" {
+		cmd.Args = append(cmd.Args, "--chaos", chaosSpec)
+	}
 
 	buf := bytes.NewBuffer(nil)
 	cmd.Stderr = buf
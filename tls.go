@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	// useTLS is whether the link between the tunnels and the proxy is
+	// encrypted with TLS.
+	useTLS bool
+	// tlsCertFile and tlsKeyFile are the proxy's cert and key files, or the
+	// tunnel's client cert and key files.
+	tlsCertFile, tlsKeyFile string
+	// tlsClientCAFile is the file holding the CA certs the proxy verifies the
+	// tunnels' client certs with (blank means client certs aren't required).
+	tlsClientCAFile string
+	// tlsCertOnly is whether tunnels with verified client certs are accepted
+	// without checking their password.
+	tlsCertOnly bool
+	// tlsCAFile is the file holding the CA certs the tunnel verifies the
+	// proxy's cert with (blank means the system's).
+	tlsCAFile string
+	// tlsConfig is the config for the link's TLS (nil if not enabled).
+	tlsConfig *tls.Config
+
+	// tlsMinVersion and tlsMaxVersion are the TLS versions (e.g., "1.2")
+	// allowed for the link and the clients whose TLS is terminated (blank
+	// means 1.2 and the latest).
+	tlsMinVersion, tlsMaxVersion string
+	// tlsCiphers are the names of the cipher suites allowed for TLS 1.2 and
+	// below (empty means Go's defaults). TLS 1.3's aren't configurable.
+	tlsCiphers []string
+	// tlsCurves are the names of the key exchange mechanisms (e.g., X25519 or
+	// P256) allowed, in order of preference (empty means Go's defaults).
+	tlsCurves []string
+	// tlsSettings are the parsed TLS settings applied to every TLS config the
+	// proxy or tunnel makes.
+	tlsSettings tlsPolicy
+)
+
+// tlsPolicy holds the TLS versions, cipher suites, and curves allowed.
+type tlsPolicy struct {
+	minVersion, maxVersion uint16
+	ciphers                []uint16
+	curves                 []tls.CurveID
+}
+
+// tlsVersions maps the TLS version names to their versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurveIDs are the curves that can be given by name.
+var tlsCurveIDs = []tls.CurveID{
+	tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521,
+}
+
+// parseTLSPolicy parses the TLS settings from the flags.
+func parseTLSPolicy() (tlsPolicy, error) {
+	p := tlsPolicy{minVersion: tls.VersionTLS12}
+	if tlsMinVersion != "" {
+		v, ok := tlsVersions[tlsMinVersion]
+		if !ok {
+			return p, fmt.Errorf("invalid TLS min version %q", tlsMinVersion)
+		}
+		p.minVersion = v
+	}
+	if tlsMaxVersion != "" {
+		v, ok := tlsVersions[tlsMaxVersion]
+		if !ok {
+			return p, fmt.Errorf("invalid TLS max version %q", tlsMaxVersion)
+		} else if v < p.minVersion {
+			return p, errors.New("TLS max version is below the min version")
+		}
+		p.maxVersion = v
+	}
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, name := range tlsCiphers {
+		i := slices.IndexFunc(suites, func(cs *tls.CipherSuite) bool {
+			return strings.EqualFold(cs.Name, name)
+		})
+		if i == -1 {
+			return p, fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		p.ciphers = append(p.ciphers, suites[i].ID)
+	}
+	for _, name := range tlsCurves {
+		i := slices.IndexFunc(tlsCurveIDs, func(id tls.CurveID) bool {
+			// Accepted with or without the "Curve" prefix
+			s := id.String()
+			return strings.EqualFold(s, name) ||
+				strings.EqualFold(strings.TrimPrefix(s, "Curve"), name)
+		})
+		if i == -1 {
+			return p, fmt.Errorf("unknown TLS curve %q", name)
+		}
+		p.curves = append(p.curves, tlsCurveIDs[i])
+	}
+	return p, nil
+}
+
+// apply sets the config's versions, cipher suites, and curves, returning the
+// config.
+func (p tlsPolicy) apply(cfg *tls.Config) *tls.Config {
+	cfg.MinVersion, cfg.MaxVersion = p.minVersion, p.maxVersion
+	cfg.CipherSuites, cfg.CurvePreferences = p.ciphers, p.curves
+	return cfg
+}
+
+// setupProxyTLS loads the proxy's cert and key if TLS is enabled.
+func setupProxyTLS() error {
+	var err error
+	if tlsSettings, err = parseTLSPolicy(); err != nil {
+		return err
+	}
+	if !useTLS {
+		if tlsClientCAFile != "" || tlsCertOnly {
+			return errors.New(`client certs require "tls"`)
+		} else if vaultTLSPath != "" {
+			return errors.New(`"vault-tls-path" requires "tls"`)
+		}
+		return nil
+	}
+	// Reloaded when renewed so new conns use the renewed cert
+	getCert := func() (*tls.Certificate, error) {
+		return loadCert(tlsCertFile, tlsKeyFile)
+	}
+	if vaultTLSPath != "" {
+		if tlsCertFile != "" || tlsKeyFile != "" {
+			return errors.New(`"vault-tls-path" and "tls-cert" are mutually exclusive`)
+		} else if vaultRefresh <= 0 {
+			return errors.New("vault-refresh must be positive")
+		}
+		if getCert, err = loadVaultCert(); err != nil {
+			return err
+		}
+	} else if tlsCertFile == "" || tlsKeyFile == "" {
+		return errors.New(
+			`must provide "tls-cert" and "tls-key" (or "vault-tls-path") with "tls"`,
+		)
+	} else if _, err := loadCert(tlsCertFile, tlsKeyFile); err != nil {
+		return fmt.Errorf("error loading TLS cert: %w", err)
+	}
+	tlsConfig = tlsSettings.apply(&tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return getCert()
+		},
+	})
+	if tlsClientCAFile == "" {
+		if tlsCertOnly {
+			return errors.New(`"tls-client-cert-only" requires "tls-client-ca"`)
+		}
+		return nil
+	}
+	if tlsConfig.ClientCAs, err = loadCertPool(tlsClientCAFile); err != nil {
+		return err
+	}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// setupTunnelTLS loads the CA certs used to verify the proxy if TLS is
+// enabled.
+func setupTunnelTLS() error {
+	var err error
+	if tlsSettings, err = parseTLSPolicy(); err != nil {
+		return err
+	} else if !useTLS {
+		return nil
+	}
+	tlsConfig = tlsSettings.apply(&tls.Config{})
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return errors.New(`must provide both "tls-cert" and "tls-key" or neither`)
+	} else if tlsCertFile != "" {
+		if _, err := loadCert(tlsCertFile, tlsKeyFile); err != nil {
+			return fmt.Errorf("error loading TLS client cert: %w", err)
+		}
+		tlsConfig.GetClientCertificate = func(
+			*tls.CertificateRequestInfo,
+		) (*tls.Certificate, error) {
+			return loadCert(tlsCertFile, tlsKeyFile)
+		}
+	}
+	if tlsCAFile == "" {
+		return nil
+	}
+	tlsConfig.RootCAs, err = loadCertPool(tlsCAFile)
+	return err
+}
+
+// loadCertPool loads the PEM-encoded certs in the file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading TLS CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certs found in TLS CA file %s", path)
+	}
+	return pool, nil
+}
+
+// clientCertName returns the name (common name or first DNS name) of the
+// conn's verified TLS client cert, or blank if it doesn't have one.
+func clientCertName(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if ws, isWS := conn.(*wsConn); isWS {
+		// Upgraded over TLS
+		tc, ok = ws.Conn.(*tls.Conn)
+	}
+	var cs tls.ConnectionState
+	if qc, isQUIC := conn.(*quicConn); isQUIC {
+		cs = qc.ConnectionState()
+	} else if ok {
+		cs = tc.ConnectionState()
+	} else {
+		return ""
+	}
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := cs.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" || len(cert.DNSNames) == 0 {
+		return cert.Subject.CommonName
+	}
+	return cert.DNSNames[0]
+}
+
+// dialProxy dials the proxy, completing the TLS handshake if it's enabled.
+// WebSocket URLs are dialed with dialWS, and addresses are dialed through the
+// SSH destination (if any) with dialSSH.
+func dialProxy(addr string) (net.Conn, error) {
+	if isWSURL(addr) {
+		return dialWS(addr)
+	} else if tunnelTransport == transportQUIC {
+		return dialQUIC(addr)
+	} else if tunnelSSH != "" {
+		return dialSSH(addr)
+	} else if tlsConfig == nil {
+		return linkDialer().Dial(tcpNetwork, addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), idleTimeout)
+	defer cancel()
+	td := &tls.Dialer{NetDialer: linkDialer(), Config: tlsConfig}
+	return td.DialContext(ctx, tcpNetwork, addr)
+}
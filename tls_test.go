@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	tests := []struct {
+		name            string
+		minVersion      string
+		maxVersion      string
+		ciphers, curves []string
+		want            tlsPolicy
+		ok              bool
+	}{
+		{name: "defaults", want: tlsPolicy{minVersion: tls.VersionTLS12}, ok: true},
+		{
+			name:       "versions",
+			minVersion: "1.3",
+			maxVersion: "1.3",
+			want: tlsPolicy{
+				minVersion: tls.VersionTLS13, maxVersion: tls.VersionTLS13,
+			},
+			ok: true,
+		},
+		{name: "unknown version", minVersion: "1.4"},
+		{name: "max below min", minVersion: "1.3", maxVersion: "1.2"},
+		{
+			name:    "ciphers",
+			ciphers: []string{"tls_ecdhe_ecdsa_with_aes_256_gcm_sha384"},
+			want: tlsPolicy{
+				minVersion: tls.VersionTLS12,
+				ciphers:    []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			},
+			ok: true,
+		},
+		{name: "unknown cipher", ciphers: []string{"TLS_NULL"}},
+		{
+			name:   "curves",
+			curves: []string{"X25519", "P256", "CurveP384"},
+			want: tlsPolicy{
+				minVersion: tls.VersionTLS12,
+				curves:     []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+			},
+			ok: true,
+		},
+		{name: "unknown curve", curves: []string{"P192"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsMinVersion, tlsMaxVersion = tt.minVersion, tt.maxVersion
+			tlsCiphers, tlsCurves = tt.ciphers, tt.curves
+			got, err := parseTLSPolicy()
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok=%v, got error %v", tt.ok, err)
+			} else if !tt.ok {
+				return
+			}
+			if got.minVersion != tt.want.minVersion ||
+				got.maxVersion != tt.want.maxVersion ||
+				!slices.Equal(got.ciphers, tt.want.ciphers) ||
+				!slices.Equal(got.curves, tt.want.curves) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+	tlsMinVersion, tlsMaxVersion, tlsCiphers, tlsCurves = "", "", nil, nil
+}
+
+// setLinkTLS sets the link's TLS flags for the test, restoring them (and the
+// config set up from them) after.
+func setLinkTLS(t *testing.T, certFile, keyFile, caFile string) {
+	t.Helper()
+	oldUse, oldCert, oldKey := useTLS, tlsCertFile, tlsKeyFile
+	oldCA, oldClientCA, oldCertOnly := tlsCAFile, tlsClientCAFile, tlsCertOnly
+	oldConfig, oldSettings := tlsConfig, tlsSettings
+	t.Cleanup(func() {
+		useTLS, tlsCertFile, tlsKeyFile = oldUse, oldCert, oldKey
+		tlsCAFile, tlsClientCAFile, tlsCertOnly = oldCA, oldClientCA, oldCertOnly
+		tlsConfig, tlsSettings = oldConfig, oldSettings
+	})
+	useTLS, tlsCertFile, tlsKeyFile = true, certFile, keyFile
+	tlsCAFile, tlsClientCAFile, tlsCertOnly = caFile, "", false
+	tlsConfig = nil
+}
+
+func TestSetupLinkTLSInvalid(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "proxy.test")
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		setup func() error
+		// cert, key, and ca are the files set.
+		cert, key, ca string
+	}{
+		{name: "proxy without cert", setup: setupProxyTLS, key: keyFile},
+		{
+			name: "proxy bad cert", setup: setupProxyTLS,
+			cert: keyFile, key: keyFile,
+		},
+		{name: "tunnel without ca certs", setup: setupTunnelTLS, ca: empty},
+		{name: "tunnel only cert", setup: setupTunnelTLS, cert: certFile},
+	}
+	for _, tt := range tests {
+		setLinkTLS(t, tt.cert, tt.key, tt.ca)
+		if err := tt.setup(); err == nil {
+			t.Fatalf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestDialProxyTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "proxy.test")
+	setLinkTLS(t, certFile, keyFile, "")
+	if err := setupProxyTLS(); err != nil {
+		t.Fatal("error setting up proxy TLS: ", err)
+	}
+	// The cert is loaded from the flags on each handshake, which are then
+	// changed for the tunnel
+	cert, err := tlsConfig.GetCertificate(nil)
+	if err != nil {
+		t.Fatal("error loading cert: ", err)
+	}
+	proxyConfig := tlsConfig.Clone()
+	proxyConfig.GetCertificate = func(
+		*tls.ClientHelloInfo,
+	) (*tls.Certificate, error) {
+		return cert, nil
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", proxyConfig)
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// The proxy's self-signed cert isn't trusted by the system
+	setLinkTLS(t, "", "", "")
+	if err := setupTunnelTLS(); err != nil {
+		t.Fatal("error setting up tunnel TLS: ", err)
+	}
+	tlsConfig.ServerName = "proxy.test"
+	if conn, err := dialProxy(ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("expected an untrusted cert to be rejected")
+	}
+
+	setLinkTLS(t, "", "", certFile)
+	if err := setupTunnelTLS(); err != nil {
+		t.Fatal("error setting up tunnel TLS: ", err)
+	} else if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected TLS 1.2 at least, got %x", tlsConfig.MinVersion)
+	}
+	tlsConfig.ServerName = "proxy.test"
+	conn, err := dialProxy(ln.Addr().String())
+	if err != nil {
+		t.Fatal("error dialing proxy: ", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Fatalf("expected a TLS conn, got %T", conn)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("expected the link to work, got %q, %v", b, err)
+	}
+}
+
+// mtlsPipe returns the proxy's and tunnel's sides of a TLS conn where the
+// proxy requires client certs signed by the client cert (self-signed) and the
+// tunnel presents it.
+func mtlsPipe(t *testing.T, clientCert string) (proxySide, tunnelSide net.Conn) {
+	t.Helper()
+	proxyCertFile, proxyKeyFile := writeTestCert(t, t.TempDir(), "proxy.test")
+	proxyCert, err := tls.LoadX509KeyPair(proxyCertFile, proxyKeyFile)
+	if err != nil {
+		t.Fatal("error loading cert: ", err)
+	}
+	certFile, keyFile := writeTestCert(t, t.TempDir(), clientCert)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal("error loading cert: ", err)
+	}
+	clientCAs, err := loadCertPool(certFile)
+	if err != nil {
+		t.Fatal("error loading client CAs: ", err)
+	}
+	rootCAs, err := loadCertPool(proxyCertFile)
+	if err != nil {
+		t.Fatal("error loading root CAs: ", err)
+	}
+	c1, c2 := pipeConn(t)
+	proxySide = tls.Server(c1, &tls.Config{
+		Certificates: []tls.Certificate{proxyCert},
+		ClientCAs:    clientCAs, ClientAuth: tls.RequireAndVerifyClientCert,
+	})
+	tunnelSide = tls.Client(c2, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs, ServerName: "proxy.test",
+	})
+	tunnelSide.SetDeadline(time.Now().Add(5 * time.Second))
+	return proxySide, tunnelSide
+}
+
+func TestClientCertName(t *testing.T) {
+	proxySide, tunnelSide := mtlsPipe(t, "laptop")
+	go tunnelSide.(*tls.Conn).Handshake()
+	if err := proxySide.(*tls.Conn).Handshake(); err != nil {
+		t.Fatal("error handshaking: ", err)
+	} else if got := clientCertName(proxySide); got != "laptop" {
+		t.Fatalf("expected the client cert's name, got %q", got)
+	}
+	conn, _ := pipeConn(t)
+	if got := clientCertName(conn); got != "" {
+		t.Fatalf("expected no name without TLS, got %q", got)
+	}
+}
+
+func TestHandleProxyConnClientCertOnly(t *testing.T) {
+	setTestPassword(t)
+	setState(t, newState(""))
+	svc := newService("web", &ServiceConfig{})
+	oldReadyCh, oldServices := readyCh, services
+	readyCh = make(chan utils.Unit, 10)
+	services = map[string]*service{"web": svc}
+	t.Cleanup(func() { readyCh, services = oldReadyCh, oldServices })
+	t.Cleanup(func() { closeIdle(svc.idle.drain()) })
+	oldCertOnly := tlsCertOnly
+	t.Cleanup(func() { tlsCertOnly = oldCertOnly })
+
+	wrongHash := sha256.Sum256([]byte("wrong password"))
+	for _, certOnly := range []bool{false, true} {
+		tlsCertOnly = certOnly
+		proxySide, tunnelSide := mtlsPipe(t, "laptop")
+		go handleProxyConn(proxySide, false)
+		status, err := tunnelit.Register(
+			tunnelSide, wrongHash, false, Registration{Service: "web"}, nil,
+		)
+		want := passwordInvalid
+		if certOnly {
+			want = passwordOk
+		}
+		if err != nil {
+			t.Fatal("error registering: ", err)
+		} else if status != want {
+			t.Fatalf(
+				"cert only %v: expected %s, got %s", certOnly,
+				tunnelit.StatusText(want), tunnelit.StatusText(status),
+			)
+		}
+	}
+}
+
+func TestSetupProxyTLSClientCerts(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "proxy.test")
+	setLinkTLS(t, certFile, keyFile, "")
+	tlsCertOnly = true
+	if err := setupProxyTLS(); err == nil {
+		t.Fatal("expected an error for cert only without a client CA")
+	}
+	tlsCertOnly, tlsClientCAFile = false, certFile
+	if err := setupProxyTLS(); err != nil {
+		t.Fatal("error setting up proxy TLS: ", err)
+	} else if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf(
+			"expected client certs to be required, got %v", tlsConfig.ClientAuth,
+		)
+	}
+	useTLS = false
+	if err := setupProxyTLS(); err == nil {
+		t.Fatal("expected an error for a client CA without TLS")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// topHistoryLen is the number of samples shown in the throughput sparklines.
+const topHistoryLen = 30
+
+var sparkChars = []rune("▁▂▃▄▅▆▇█")
+
+// topService holds the history used to display a service.
+type topService struct {
+	last     ServiceStats
+	upRates  []float64
+	dnRates  []float64
+	hasFirst bool
+}
+
+func RunTop(cmd *cobra.Command, args []string) {
+	adminAddr := must(cmd.Flags().GetString("admin-addr"))
+	token := must(cmd.Flags().GetString("admin-token"))
+	interval := must(cmd.Flags().GetDuration("interval"))
+	numTalkers := must(cmd.Flags().GetInt("talkers"))
+	if interval <= 0 {
+		log.Fatal("interval must be positive")
+	}
+	url := adminAddr
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	url = strings.TrimSuffix(url, "/")
+
+	client := &http.Client{Timeout: interval}
+	services := make(map[string]*topService)
+	ticker := time.NewTicker(interval)
+	for ; true; <-ticker.C {
+		var all map[string]ServiceStats
+		err := fetchJSON(client, url+"/stats", token, &all)
+		var sb strings.Builder
+		// Move the cursor home and clear the screen
+		sb.WriteString("\x1b[H\x1b[2J")
+		fmt.Fprintf(
+			&sb, "tunnelit top - %s - %s\n\n",
+			adminAddr, time.Now().Format("15:04:05"),
+		)
+		if err != nil {
+			fmt.Fprintf(&sb, "Error fetching stats: %v\n", err)
+			os.Stdout.WriteString(sb.String())
+			continue
+		}
+
+		names := make([]string, 0, len(all))
+		for name, st := range all {
+			names = append(names, name)
+			ts, ok := services[name]
+			if !ok {
+				ts = &topService{}
+				services[name] = ts
+			}
+			ts.update(st, interval)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			services[name].render(&sb, name)
+		}
+		if numTalkers > 0 {
+			var tt TopTalkers
+			talkersURL := fmt.Sprintf("%s/talkers?n=%d", url, numTalkers)
+			if err := fetchJSON(client, talkersURL, token, &tt); err != nil {
+				fmt.Fprintf(&sb, "Error fetching top talkers: %v\n", err)
+			} else {
+				renderTalkers(&sb, tt)
+			}
+		}
+		os.Stdout.WriteString(sb.String())
+	}
+}
+
+// fetchJSON gets the URL from the admin API, decoding the response into v.
+func fetchJSON(client *http.Client, url, token string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (ts *topService) update(st ServiceStats, interval time.Duration) {
+	if ts.hasFirst {
+		secs := interval.Seconds()
+		ts.upRates = appendRate(ts.upRates, st.BytesUp, ts.last.BytesUp, secs)
+		ts.dnRates = appendRate(
+			ts.dnRates, st.BytesDown, ts.last.BytesDown, secs,
+		)
+	}
+	ts.last, ts.hasFirst = st, true
+}
+
+func appendRate(rates []float64, cur, prev uint64, secs float64) []float64 {
+	rate := 0.0
+	if cur >= prev {
+		rate = float64(cur-prev) / secs
+	}
+	rates = append(rates, rate)
+	if len(rates) > topHistoryLen {
+		rates = rates[len(rates)-topHistoryLen:]
+	}
+	return rates
+}
+
+func (ts *topService) render(sb *strings.Builder, name string) {
+	if name == "" {
+		name = "(default)"
+	}
+	st := ts.last
+	health := "ok"
+	if st.IdleConns == 0 {
+		health = "EMPTY"
+	} else if st.IdleConns*4 < st.MaxIdleConns {
+		health = "low"
+	}
+	fmt.Fprintf(sb, "%s\n", name)
+	fmt.Fprintf(
+		sb, "  conns: %d active, %d waiting\n",
+		st.ActiveConns, st.WaitingClients,
+	)
+	fmt.Fprintf(
+		sb, "  pool:  %d/%d idle (%s)\n",
+		st.IdleConns, st.MaxIdleConns, health,
+	)
+	fmt.Fprintf(
+		sb, "  up:    %-*s %s/s\n",
+		topHistoryLen, sparkline(ts.upRates), formatBytes(lastRate(ts.upRates)),
+	)
+	fmt.Fprintf(
+		sb, "  down:  %-*s %s/s\n\n",
+		topHistoryLen, sparkline(ts.dnRates), formatBytes(lastRate(ts.dnRates)),
+	)
+}
+
+// renderTalkers renders the client IPs transferring the most bytes.
+func renderTalkers(sb *strings.Builder, tt TopTalkers) {
+	fmt.Fprintf(sb, "top clients (last %s)\n", tt.Window)
+	if len(tt.Clients) == 0 {
+		sb.WriteString("  none\n")
+	}
+	for _, ts := range tt.Clients {
+		fmt.Fprintf(
+			sb, "  %-24s up %12s/s  down %12s/s  %d active\n", ts.Name,
+			formatBytes(ts.UpRate), formatBytes(ts.DownRate), ts.ActiveConns,
+		)
+	}
+}
+
+func sparkline(vals []float64) string {
+	max := 0.0
+	for _, v := range vals {
+		if v > max {
+			max = v
+		}
+	}
+	var sb strings.Builder
+	for _, v := range vals {
+		i := 0
+		if max > 0 {
+			i = int(v / max * float64(len(sparkChars)-1))
+		}
+		sb.WriteRune(sparkChars[i])
+	}
+	return sb.String()
+}
+
+func lastRate(rates []float64) float64 {
+	if len(rates) == 0 {
+		return 0
+	}
+	return rates[len(rates)-1]
+}
+
+func formatBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0f B", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", b/div, "KMGTPE"[exp])
+}
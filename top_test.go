@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		b    float64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.b); got != tt.want {
+			t.Fatalf("%v: expected %q, got %q", tt.b, tt.want, got)
+		}
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	if got := sparkline([]float64{0, 0}); got != "▁▁" {
+		t.Fatalf("expected a flat line for no traffic, got %q", got)
+	}
+	if got := sparkline([]float64{0, 50, 100}); got != "▁▄█" {
+		t.Fatalf("expected ▁▄█, got %q", got)
+	}
+}
+
+func TestTopServiceUpdate(t *testing.T) {
+	ts := &topService{}
+	ts.update(ServiceStats{BytesUp: 1000, BytesDown: 100}, time.Second)
+	if len(ts.upRates) != 0 {
+		t.Fatal("expected no rate from the first sample")
+	}
+	ts.update(ServiceStats{BytesUp: 3000, BytesDown: 100}, 2*time.Second)
+	if lastRate(ts.upRates) != 1000 || lastRate(ts.dnRates) != 0 {
+		t.Fatalf(
+			"expected rates of 1000 up and 0 down, got %v and %v",
+			ts.upRates, ts.dnRates,
+		)
+	}
+	// A counter going backwards (the proxy restarted) isn't a negative rate
+	ts.update(ServiceStats{BytesUp: 10}, time.Second)
+	if lastRate(ts.upRates) != 0 {
+		t.Fatalf("expected a rate of 0 after a reset, got %v", ts.upRates)
+	}
+	for i := 0; i < topHistoryLen*2; i++ {
+		ts.update(ServiceStats{}, time.Second)
+	}
+	if len(ts.upRates) != topHistoryLen {
+		t.Fatalf("expected %d rates kept, got %d", topHistoryLen, len(ts.upRates))
+	}
+}
+
+func TestTopServiceRender(t *testing.T) {
+	tests := []struct {
+		idle, max int
+		want      string
+	}{
+		{idle: 0, max: 8, want: "(EMPTY)"},
+		{idle: 1, max: 8, want: "(low)"},
+		{idle: 2, max: 8, want: "(ok)"},
+	}
+	for _, tt := range tests {
+		ts := &topService{}
+		st := ServiceStats{IdleConns: tt.idle, MaxIdleConns: tt.max}
+		ts.update(st, time.Second)
+		var sb strings.Builder
+		ts.render(&sb, "")
+		out := sb.String()
+		if !strings.HasPrefix(out, "(default)\n") {
+			t.Fatalf("expected the default service's name, got %q", out)
+		} else if !strings.Contains(out, tt.want) {
+			t.Fatalf(
+				"%d/%d idle: expected %s, got %q", tt.idle, tt.max, tt.want, out,
+			)
+		}
+	}
+}
+
+func TestFetchJSON(t *testing.T) {
+	srvr := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]ServiceStats{
+				"web": {ActiveConns: 2},
+			})
+		},
+	))
+	defer srvr.Close()
+
+	var all map[string]ServiceStats
+	if err := fetchJSON(srvr.Client(), srvr.URL, "secret", &all); err != nil {
+		t.Fatal("error fetching stats: ", err)
+	} else if all["web"].ActiveConns != 2 {
+		t.Fatalf("expected web's stats, got %+v", all)
+	}
+	if err := fetchJSON(srvr.Client(), srvr.URL, "wrong", &all); err == nil {
+		t.Fatal("expected an error for a non-OK status")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The link between the tunnel and proxy runs over the tunnel's transport: TCP
+// (optionally inside a WebSocket; see wstunnel.go, or through SSH; see
+// sshtunnel.go) or QUIC (see quic.go, optionally with FEC; see fec.go). The
+// proxy accepts every transport it has an address for.
+
+const (
+	transportTCP  = "tcp"
+	transportQUIC = "quic"
+)
+
+// tunnelTransport is the transport the tunnel reaches the proxies over.
+var tunnelTransport = transportTCP
+
+// checkTransport returns an error if the transport can't be used to reach the
+// proxies at the addresses.
+func checkTransport(proxyAddrs []string) error {
+	switch tunnelTransport {
+	case transportTCP:
+		if fecEnabled() {
+			return errors.New("FEC requires transport quic")
+		}
+		return nil
+	case transportQUIC:
+	default:
+		return fmt.Errorf("unknown transport %q", tunnelTransport)
+	}
+	if err := validFEC(); err != nil {
+		return err
+	}
+	if !useTLS {
+		return fmt.Errorf(`transport %q requires "tls"`, tunnelTransport)
+	} else if tunnelSSH != "" {
+		return fmt.Errorf(`"ssh" isn't supported with transport %q`, tunnelTransport)
+	}
+	for _, addr := range proxyAddrs {
+		if isWSURL(addr) {
+			return errors.New("WebSocket paddrs require transport tcp")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+// dialRetryDelay is how long to wait before retrying after failing to dial the
+// proxy.
+const dialRetryDelay = time.Second
+
+// limitRetryDelay is how long to wait before trying another conn after the
+// proxy rejects one for exceeding the token's limits.
+const limitRetryDelay = 5 * time.Second
+
+// tunnelID identifies this tunnel process to the proxy.
+var tunnelID = newTunnelID()
+
+var (
+	// tunnelName is the tunnel's friendly name, sent to the proxy.
+	tunnelName string
+	// tunnelTags are the tunnel's tags, sent to the proxy.
+	tunnelTags map[string]string
+)
+
+// tunnelTTL is how long after the tunnel first registers the proxy deregisters
+// it (0 means never).
+var tunnelTTL time.Duration
+
+func newTunnelID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// tunnelService is the tunnel's runtime state for a service it serves.
+type tunnelService struct {
+	reg      Registration
+	backends *backendPool
+	// udp is whether the servers are UDP servers, with the tunnel conns
+	// carrying framed datagrams.
+	udp bool
+	// proxyProtocol is the PROXY protocol version sent to the servers (blank
+	// means none).
+	proxyProtocol string
+	// egressNets are the networks the destinations clients ask for must be in
+	// (empty means any), if the tunnel has egress (see reg.Egress).
+	egressNets []*net.IPNet
+	// waker wakes the servers when they can't be dialed (nil means don't).
+	waker *waker
+	// reserved holds the tokens for the service's min idle conns.
+	reserved chan utils.Unit
+	// reservedOnly is whether the service only uses its reserved tokens (and
+	// not the shared ones).
+	reservedOnly bool
+	// link is whether the tunnel keeps a link to the proxy for the service.
+	link bool
+
+	// idle holds the idle conns and the addresses of the proxies they're to.
+	idleMtx sync.Mutex
+	idle    map[net.Conn]string
+	// stopped is whether the service was removed (guarded by idleMtx).
+	stopped bool
+	// stop is closed once the service is removed.
+	stop chan utils.Unit
+	// ready is closed once a proxy first reports the service's endpoints.
+	ready     chan utils.Unit
+	readyOnce sync.Once
+	// failed receives the error if the proxy rejects the service (nil means
+	// rejections aren't reported).
+	failed chan error
+	// expires is when the service is removed (zero means never).
+	expires time.Time
+
+	// endpoints are the service's endpoints last reported by each proxy.
+	endpointsMtx sync.Mutex
+	endpoints    map[string]ServiceEndpoints
+
+	// linkStatus is the status last received over the link (nil if there's
+	// no link).
+	linkMtx    sync.Mutex
+	linkStatus *LinkStatus
+}
+
+func newTunnelService(
+	name string, sc *TunnelServiceConfig,
+) *tunnelService {
+	ts := &tunnelService{
+		reg: Registration{
+			Service: name, Tunnel: tunnelID, Name: tunnelName, Tags: tunnelTags,
+			Weight: sc.Weight, Endpoints: true, TTL: int64(tunnelTTL / time.Second),
+			Egress: sc.Egress, ClientInfo: sc.ProxyProtocol != "",
+			Hosts: sc.HTTPHosts, Mux: sc.Mux,
+		},
+		backends:      newBackendPool(sc.Saddrs, sc.k8s),
+		udp:           sc.UDP,
+		proxyProtocol: sc.ProxyProtocol,
+		egressNets:    sc.egressNets,
+		waker:         sc.waker,
+		reserved:      make(chan utils.Unit, sc.MinIdle),
+		link:          sc.Link,
+		idle:          make(map[net.Conn]string),
+		endpoints:     make(map[string]ServiceEndpoints),
+		stop:          make(chan utils.Unit),
+		ready:         make(chan utils.Unit),
+	}
+	if sc.UDP {
+		ts.backends.network = udpNetwork()
+	}
+	if sc.Mux {
+		// A single session takes all the clients, so it needs no tokens (see
+		// runMux)
+		return ts
+	}
+	for i := uint(0); i < sc.MinIdle; i++ {
+		ts.reserved <- utils.Unit{}
+	}
+	return ts
+}
+
+var (
+	tunnelServicesMtx sync.Mutex
+	// tunnelServices are the services being tunneled, keyed by name.
+	tunnelServices = make(map[string]*tunnelService)
+)
+
+// addTunnelService adds the service, returning false if one with the same name
+// already exists.
+func addTunnelService(ts *tunnelService) bool {
+	tunnelServicesMtx.Lock()
+	defer tunnelServicesMtx.Unlock()
+	if _, ok := tunnelServices[ts.reg.Service]; ok {
+		return false
+	}
+	tunnelServices[ts.reg.Service] = ts
+	return true
+}
+
+// getTunnelService returns the service with the given name.
+func getTunnelService(name string) (*tunnelService, bool) {
+	tunnelServicesMtx.Lock()
+	defer tunnelServicesMtx.Unlock()
+	ts, ok := tunnelServices[name]
+	return ts, ok
+}
+
+// allTunnelServices returns the services being tunneled.
+func allTunnelServices() []*tunnelService {
+	tunnelServicesMtx.Lock()
+	defer tunnelServicesMtx.Unlock()
+	tss := make([]*tunnelService, 0, len(tunnelServices))
+	for _, ts := range tunnelServices {
+		tss = append(tss, ts)
+	}
+	return tss
+}
+
+// removeTunnelService stops tunneling the service, returning false if it was
+// already removed.
+func removeTunnelService(ts *tunnelService) bool {
+	tunnelServicesMtx.Lock()
+	if tunnelServices[ts.reg.Service] != ts {
+		tunnelServicesMtx.Unlock()
+		return false
+	}
+	delete(tunnelServices, ts.reg.Service)
+	tunnelServicesMtx.Unlock()
+
+	close(ts.stop)
+	// Close the idle conns so the proxy stops handing them to clients
+	ts.idleMtx.Lock()
+	ts.stopped = true
+	for conn := range ts.idle {
+		conn.Close()
+	}
+	ts.idleMtx.Unlock()
+	unshareEndpoints(ts)
+	return true
+}
+
+// fail reports that the proxy rejected the service. If rejections are
+// reported, the token is given back so the conn is retried until the service
+// is removed. Otherwise, the service is stopped, since retrying would only be
+// rejected again.
+func (ts *tunnelService) fail(err error, release chan utils.Unit) {
+	if ts.failed == nil {
+		if removeTunnelService(ts) {
+			log.Printf(
+				"Stopped tunneling %s since the proxy rejected it: %v",
+				ts.displayName(), err,
+			)
+		}
+		release <- utils.Unit{}
+		return
+	}
+	select {
+	case ts.failed <- err:
+	default:
+	}
+	time.Sleep(dialRetryDelay)
+	release <- utils.Unit{}
+}
+
+// dialBackend dials one of the service's servers, waking them first if needed.
+func (ts *tunnelService) dialBackend() (net.Conn, string, error) {
+	if ts.waker == nil {
+		return ts.backends.Dial()
+	}
+	return ts.backends.dialWaking(ts.waker)
+}
+
+// reportEndpoints logs (and shares) the service's endpoints reported by the
+// proxy if they changed.
+func (ts *tunnelService) reportEndpoints(proxyAddr string, eps ServiceEndpoints) {
+	ts.endpointsMtx.Lock()
+	defer ts.endpointsMtx.Unlock()
+	defer ts.readyOnce.Do(func() { close(ts.ready) })
+	select {
+	case <-ts.stop:
+		return
+	default:
+	}
+	if old, ok := ts.endpoints[proxyAddr]; ok && old == eps {
+		return
+	}
+	ts.endpoints[proxyAddr] = eps
+	var addrs []string
+	if eps.Addr != "" {
+		addrs = append(addrs, eps.Addr)
+	}
+	if eps.WSAddr != "" {
+		addrs = append(addrs, "ws://"+eps.WSAddr)
+	}
+	if eps.UDPAddr != "" {
+		addrs = append(addrs, "udp://"+eps.UDPAddr)
+	}
+	if eps.URL != "" {
+		addrs = append(addrs, eps.URL)
+	}
+	if len(addrs) == 0 {
+		log.Printf(
+			"%s has no client endpoints on proxy %s", ts.displayName(), proxyAddr,
+		)
+	} else {
+		log.Printf(
+			"%s is reachable at %s (through proxy %s)",
+			ts.displayName(), strings.Join(addrs, ", "), proxyAddr,
+		)
+	}
+	shareEndpoints(ts, proxyAddr, addrs)
+}
+
+// endpointAddrs returns the service's endpoints reported by the proxies.
+func (ts *tunnelService) endpointAddrs() []string {
+	ts.endpointsMtx.Lock()
+	defer ts.endpointsMtx.Unlock()
+	addrs := []string{}
+	for _, eps := range ts.endpoints {
+		if eps.Addr != "" {
+			addrs = append(addrs, eps.Addr)
+		}
+		if eps.WSAddr != "" {
+			addrs = append(addrs, "ws://"+eps.WSAddr)
+		}
+		if eps.UDPAddr != "" {
+			addrs = append(addrs, "udp://"+eps.UDPAddr)
+		}
+		if eps.URL != "" {
+			addrs = append(addrs, eps.URL)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// displayName returns the name of the service for logging.
+func (ts *tunnelService) displayName() string {
+	if ts.reg.Service == "" {
+		return "(default)"
+	}
+	return ts.reg.Service
+}
+
+// run keeps connecting idle conns to the proxy for the service until it's
+// removed. Each conn takes either one of the service's reserved tokens
+// (preferred) or one of the shared tokens from readyCh, which is given back
+// once the conn is used.
+func (ts *tunnelService) run(sel *proxySelector) {
+	log.Printf(
+		"Tunneling %s to %s and piping to %s",
+		ts.displayName(), strings.Join(sel.addrs, ", "),
+		strings.Join(ts.backends.specs, ", "),
+	)
+	ts.backends.watch(ts.stop)
+	if ts.link {
+		go ts.runLink(sel)
+	}
+	if ts.reg.Mux {
+		ts.runMux(sel)
+		return
+	}
+	shared := readyCh
+	if ts.reservedOnly {
+		// Never receives
+		shared = nil
+	}
+	for {
+		var release chan utils.Unit
+		select {
+		case <-ts.stop:
+			return
+		case <-ts.reserved:
+			release = ts.reserved
+		default:
+			select {
+			case <-ts.stop:
+				return
+			case <-ts.reserved:
+				release = ts.reserved
+			case <-shared:
+				release = readyCh
+			}
+		}
+		proxyAddr := sel.Current()
+		conn, err := dialProxy(proxyAddr)
+		if err != nil {
+			log.Print("Error connecting to proxy: ", err)
+			release <- utils.Unit{}
+			time.Sleep(dialRetryDelay)
+			continue
+		}
+		go pipeProxySrvr(conn, proxyAddr, ts, release)
+	}
+}
+
+// runMux keeps a session to the proxy for the service (registered with Mux)
+// until it's removed, dialing a new one whenever it ends. Unlike idle conns,
+// it takes none of the reserved or shared tokens.
+func (ts *tunnelService) runMux(sel *proxySelector) {
+	for {
+		proxyAddr := sel.Current()
+		conn, err := dialProxy(proxyAddr)
+		if err != nil {
+			log.Print("Error connecting to proxy: ", err)
+			select {
+			case <-ts.stop:
+				return
+			case <-time.After(dialRetryDelay):
+			}
+			continue
+		}
+		release := make(chan utils.Unit, 1)
+		returned := make(chan utils.Unit)
+		go func() {
+			defer close(returned)
+			pipeProxySrvr(conn, proxyAddr, ts, release)
+		}()
+		select {
+		case <-ts.stop:
+			return
+		case <-release:
+		case <-returned:
+			select {
+			case <-release:
+			default:
+				// Not released (e.g., the handshake failed)
+				time.Sleep(dialRetryDelay)
+			}
+		}
+	}
+}
+
+// runSession uses the conn to the proxy as a session (for services
+// registered with Mux), serving the clients' streams until it ends. The
+// release chan is given back its token once it has. If the proxy doesn't
+// support sessions, the conn is used as an idle conn instead.
+func (ts *tunnelService) runSession(
+	proxyConn net.Conn, proxyAddr string, release chan utils.Unit,
+) {
+	b := []byte{0}
+	// Tracked like an idle conn so that it's replaced when switching proxies
+	untrack := ts.trackIdle(proxyConn, proxyAddr)
+	if _, err := proxyConn.Read(b); err != nil {
+		untrack()
+		proxyConn.Close()
+		time.Sleep(dialRetryDelay)
+		release <- utils.Unit{}
+		return
+	} else if b[0] != muxReady {
+		untrack()
+		log.Printf(
+			"Proxy %s doesn't support sessions, so %s uses an idle conn per client (upgrade the proxy or don't use mux)",
+			proxyAddr, ts.displayName(),
+		)
+		if b[0] != heartbeatByte {
+			ts.serveReady(proxyConn, b[0], func() { release <- utils.Unit{} })
+			return
+		} else if _, err := proxyConn.Write(b); err != nil {
+			proxyConn.Close()
+			time.Sleep(dialRetryDelay)
+			release <- utils.Unit{}
+			return
+		}
+		ts.serveIdle(proxyConn, proxyAddr, release)
+		return
+	}
+	defer untrack()
+	sess, err := newTunnelSession(proxyConn, true)
+	if err != nil {
+		log.Print("Error starting session: ", err)
+		proxyConn.Close()
+		time.Sleep(dialRetryDelay)
+		release <- utils.Unit{}
+		return
+	}
+	go func() {
+		for {
+			st, err := sess.Accept()
+			if err != nil {
+				return
+			}
+			go ts.serveStream(st)
+		}
+	}()
+	sess.wait()
+	log.Printf("Session to proxy %s for %s ended", proxyAddr, ts.displayName())
+	time.Sleep(dialRetryDelay)
+	release <- utils.Unit{}
+}
+
+// serveStream serves a client's stream of a session.
+func (ts *tunnelService) serveStream(st net.Conn) {
+	defer recoverConn("session stream", st)
+	b := []byte{0}
+	st.SetReadDeadline(time.Now().Add(idleTimeout))
+	if _, err := st.Read(b); err != nil {
+		st.Close()
+		return
+	}
+	st.SetReadDeadline(time.Time{})
+	ts.serveReady(st, b[0], func() {})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewTunnelServiceMinIdle(t *testing.T) {
+	sc := &TunnelServiceConfig{Saddrs: []string{"127.0.0.1:8080"}, MinIdle: 3}
+	ts := newTunnelService("web", sc)
+	if len(ts.reserved) != 3 {
+		t.Fatalf("expected 3 reserved tokens, got %d", len(ts.reserved))
+	} else if ts.reg.Service != "web" {
+		t.Fatalf("expected to register for web, got %q", ts.reg.Service)
+	}
+
+	// Muxed services take all clients over one session, so reserve nothing
+	sc.Mux = true
+	if ts := newTunnelService("web", sc); len(ts.reserved) != 0 {
+		t.Fatalf("expected no reserved tokens with mux, got %d", len(ts.reserved))
+	}
+}
+
+func TestReportEndpoints(t *testing.T) {
+	buf := captureLog(t)
+	ts := newTunnelService("web", &TunnelServiceConfig{
+		Saddrs: []string{"127.0.0.1:8080"},
+	})
+	eps := ServiceEndpoints{Addr: "192.0.2.1:8080", WSAddr: "192.0.2.1:8081"}
+	ts.reportEndpoints("proxy:1", eps)
+	ts.reportEndpoints("proxy:1", eps)
+	if got := strings.Count(buf.String(), "web is reachable at"); got != 1 {
+		t.Fatalf("expected the endpoints logged once, got %d: %q", got, buf)
+	}
+	ts.reportEndpoints("proxy:2", ServiceEndpoints{Addr: "198.51.100.1:8080"})
+	want := "192.0.2.1:8080 198.51.100.1:8080 ws://192.0.2.1:8081"
+	if got := ts.endpointAddrs(); strings.Join(got, " ") != want {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,128 @@
+package tunnelit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit/controlpb"
+	"github.com/johnietre/utils/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// The control messages are also defined in protobuf (see
+// proto/tunnelit/control/v1/control.proto), mirroring the handshake and
+// statuses above one to one, so that tunnel clients in other languages can
+// be generated from them. They're sent in frames of the framing version, the
+// length, and the encoded controlpb.Frame.
+
+//go:generate protoc -I ../proto --go_out=.. --go_opt=module=github.com/johnietre/tunnel-proxy tunnelit/control/v1/control.proto
+
+// ControlVersion is the version of the control framing.
+const ControlVersion = 1
+
+// ControlMaxFrame is the most encoded message a control frame holds.
+const ControlMaxFrame = 1 << 20
+
+// ErrControlVersion is returned reading a control frame of another framing
+// version.
+var ErrControlVersion = errors.New("unsupported control framing version")
+
+// WriteControl writes the control frame.
+func WriteControl(w io.Writer, f *controlpb.Frame) error {
+	b, err := proto.Marshal(f)
+	if err != nil {
+		return err
+	} else if len(b) > ControlMaxFrame {
+		return fmt.Errorf("control frame too long (%d bytes)", len(b))
+	}
+	hdr := binary.BigEndian.AppendUint32([]byte{ControlVersion}, uint32(len(b)))
+	_, err = utils.WriteAll(w, append(hdr, b...))
+	return err
+}
+
+// ReadControl reads a control frame written by WriteControl. Fields unknown to
+// this version of the messages are ignored.
+func ReadControl(r io.Reader) (*controlpb.Frame, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	} else if hdr[0] != ControlVersion {
+		return nil, fmt.Errorf("%w: %d", ErrControlVersion, hdr[0])
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > ControlMaxFrame {
+		return nil, fmt.Errorf("control frame too long (%d bytes)", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	f := &controlpb.Frame{}
+	if err := proto.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("error decoding control frame: %w", err)
+	}
+	return f, nil
+}
+
+// Proto returns the registration as a control message.
+func (reg Registration) Proto() *controlpb.Register {
+	return &controlpb.Register{
+		Version:    uint32(reg.Version),
+		Service:    reg.Service,
+		Tunnel:     reg.Tunnel,
+		Name:       reg.Name,
+		Tags:       reg.Tags,
+		Weight:     uint32(reg.Weight),
+		Nonce:      reg.Nonce,
+		Ping:       reg.Ping,
+		Endpoints:  reg.Endpoints,
+		Ttl:        reg.TTL,
+		Dial:       reg.Dial,
+		Egress:     reg.Egress,
+		ClientInfo: reg.ClientInfo,
+		Hosts:      reg.Hosts,
+		Mux:        reg.Mux,
+		Link:       reg.Link,
+	}
+}
+
+// RegistrationFromProto returns the registration of the control message.
+func RegistrationFromProto(m *controlpb.Register) Registration {
+	return Registration{
+		Version:    int(m.GetVersion()),
+		Service:    m.GetService(),
+		Tunnel:     m.GetTunnel(),
+		Name:       m.GetName(),
+		Tags:       m.GetTags(),
+		Weight:     uint(m.GetWeight()),
+		Nonce:      m.GetNonce(),
+		Ping:       m.GetPing(),
+		Endpoints:  m.GetEndpoints(),
+		TTL:        m.GetTtl(),
+		Dial:       m.GetDial(),
+		Egress:     m.GetEgress(),
+		ClientInfo: m.GetClientInfo(),
+		Hosts:      m.GetHosts(),
+		Mux:        m.GetMux(),
+		Link:       m.GetLink(),
+	}
+}
+
+// StatusProto returns the status byte as a control message.
+func StatusProto(status byte) *controlpb.Status {
+	return &controlpb.Status{Code: controlpb.Status_Code(status)}
+}
+
+// StatusFromProto returns the status byte of the control message.
+func StatusFromProto(m *controlpb.Status) byte {
+	code := m.GetCode()
+	if code < 0 || code > 255 {
+		return 0
+	}
+	return byte(code)
+}
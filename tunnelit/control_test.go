@@ -0,0 +1,178 @@
+package tunnelit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit/controlpb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestControlRoundTrip(t *testing.T) {
+	frames := []*controlpb.Frame{
+		{Msg: &controlpb.Frame_Auth{Auth: &controlpb.Auth{
+			Credential: &controlpb.Auth_VerifierProof{VerifierProof: []byte("proof")},
+		}}},
+		{Msg: &controlpb.Frame_Challenge{Challenge: &controlpb.Challenge{
+			Nonce: bytes.Repeat([]byte{1}, ChallengeSize),
+			Verifier: &controlpb.VerifierParams{
+				Salt: []byte{1, 2, 3}, Time: 1, Memory: 64, Threads: 1,
+			},
+		}}},
+		{Msg: &controlpb.Frame_Register{Register: Registration{
+			Service: "svc", Tags: map[string]string{"region": "eu"},
+		}.Proto()}},
+		{Msg: &controlpb.Frame_Status{Status: StatusProto(StatusOK)}},
+		{Msg: &controlpb.Frame_Ready{Ready: &controlpb.Ready{
+			Client:   &controlpb.ClientInfo{Addr: "1.2.3.4:5", LocalAddr: "5.6.7.8:9"},
+			DialAddr: "example.com:443",
+		}}},
+		{Msg: &controlpb.Frame_Heartbeat{Heartbeat: &controlpb.Heartbeat{UnixNanos: 1}}},
+		{Msg: &controlpb.Frame_Teardown{Teardown: &controlpb.Teardown{Reason: "draining"}}},
+		{Msg: &controlpb.Frame_Stats{Stats: &controlpb.Stats{
+			IdleConns: 3, ActiveConns: 2, BytesSent: 100, BytesReceived: 200,
+		}}},
+		// An empty frame (e.g., a Ready echoed by the tunnel) has no body
+		{Msg: &controlpb.Frame_Ready{Ready: &controlpb.Ready{}}},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := WriteControl(&buf, f); err != nil {
+			t.Fatal("error writing: ", err)
+		}
+	}
+	for i, want := range frames {
+		got, err := ReadControl(&buf)
+		if err != nil {
+			t.Fatalf("frame %d: error reading: %v", i, err)
+		} else if !proto.Equal(got, want) {
+			t.Fatalf("frame %d: expected %v, got %v", i, want, got)
+		}
+	}
+	if _, err := ReadControl(&buf); err != io.EOF {
+		t.Fatalf("expected EOF after the frames, got %v", err)
+	}
+}
+
+// controlFrame returns a frame of the version and length followed by the
+// body.
+func controlFrame(version byte, length uint32, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{version}, length)
+	return append(b, body...)
+}
+
+func TestReadControlErrors(t *testing.T) {
+	body, err := proto.Marshal(&controlpb.Frame{
+		Msg: &controlpb.Frame_Teardown{Teardown: &controlpb.Teardown{Reason: "bye"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		frame []byte
+		// is is the error expected to be matched by errors.Is (if any).
+		is error
+	}{
+		{
+			name:  "other version",
+			frame: controlFrame(ControlVersion+1, uint32(len(body)), body),
+			is:    ErrControlVersion,
+		},
+		{
+			name:  "too long",
+			frame: controlFrame(ControlVersion, ControlMaxFrame+1, nil),
+		},
+		{
+			name:  "truncated header",
+			frame: controlFrame(ControlVersion, uint32(len(body)), nil)[:3],
+			is:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "truncated body",
+			frame: controlFrame(ControlVersion, uint32(len(body)), body[:len(body)-1]),
+			is:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "invalid body",
+			frame: controlFrame(ControlVersion, 2, []byte{0xFF, 0xFF}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadControl(bytes.NewReader(tt.frame))
+			if err == nil {
+				t.Fatal("expected error")
+			} else if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Fatalf("expected %v, got %v", tt.is, err)
+			}
+		})
+	}
+}
+
+func TestReadControlUnknownFields(t *testing.T) {
+	// A newer sender's frame, with a field this version doesn't know
+	body, err := proto.Marshal(&controlpb.Frame{
+		Msg: &controlpb.Frame_Teardown{Teardown: &controlpb.Teardown{Reason: "bye"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = protowire.AppendTag(body, 99, protowire.VarintType)
+	body = protowire.AppendVarint(body, 1)
+	f, err := ReadControl(bytes.NewReader(
+		controlFrame(ControlVersion, uint32(len(body)), body),
+	))
+	if err != nil {
+		t.Fatal("error reading: ", err)
+	} else if f.GetTeardown().GetReason() != "bye" {
+		t.Fatalf("expected the known fields decoded, got %v", f)
+	}
+}
+
+func TestRegistrationProto(t *testing.T) {
+	reg := Registration{
+		Version: ProtocolVersion, Service: "svc", Tunnel: "id", Name: "name",
+		Tags: map[string]string{"region": "eu"}, Weight: 2,
+		Nonce: []byte{1, 2}, Ping: true, Endpoints: true, TTL: 60, Dial: true,
+		Egress: true, ClientInfo: true, Hosts: []string{"a.example"},
+		Mux: true, Link: true,
+	}
+	// Every field is set, so none is missed converting
+	v := reflect.ValueOf(reg)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Fatalf("test registration's %s isn't set", v.Type().Field(i).Name)
+		}
+	}
+	b, err := proto.Marshal(reg.Proto())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &controlpb.Register{}
+	if err := proto.Unmarshal(b, m); err != nil {
+		t.Fatal(err)
+	}
+	if got := RegistrationFromProto(m); !reflect.DeepEqual(got, reg) {
+		t.Fatalf("expected %+v, got %+v", reg, got)
+	}
+}
+
+func TestStatusProto(t *testing.T) {
+	for status := StatusPasswordInvalid; status <= StatusHostsRequired; status++ {
+		m := StatusProto(status)
+		if got := StatusFromProto(m); got != status {
+			t.Errorf("%s: expected status %d, got %d", StatusText(status), status, got)
+		} else if _, ok := controlpb.Status_Code_name[int32(status)]; !ok {
+			t.Errorf("%s: no code defined for status %d", StatusText(status), status)
+		}
+	}
+	if got := StatusFromProto(&controlpb.Status{Code: 1000}); got != 0 {
+		t.Fatalf("expected unknown code mapped to 0, got %d", got)
+	}
+}
@@ -0,0 +1,1222 @@
+// Control-plane messages exchanged between the proxy and tunnels, mirroring
+// the handshake and statuses in tunnelit/protocol.go, for tunnel clients
+// written in other languages. The Go types are generated into
+// tunnelit/controlpb (see tunnelit/control.go for the framing):
+//
+//   go generate ./tunnelit
+//
+// Framing: each frame is a 1-byte framing version (currently 1), followed by
+// a 4-byte big-endian length and the encoded Frame message. Fields are only
+// ever added, so that readers of a version ignore those they don't know.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.5
+// 	protoc        (unknown)
+// source: tunnelit/control/v1/control.proto
+
+package controlpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// The codes are those of the status bytes.
+type Status_Code int32
+
+const (
+	Status_CODE_UNSPECIFIED      Status_Code = 0
+	Status_CODE_PASSWORD_INVALID Status_Code = 10
+	Status_CODE_OK               Status_Code = 11
+	Status_CODE_SERVICE_UNKNOWN  Status_Code = 12
+	Status_CODE_LIMIT_EXCEEDED   Status_Code = 13
+	Status_CODE_TUNNEL_EXPIRED   Status_Code = 14
+	Status_CODE_SERVICE_RESERVED Status_Code = 15
+	Status_CODE_BAD_VERSION      Status_Code = 16
+	Status_CODE_DRAINING         Status_Code = 17
+	Status_CODE_EGRESS_REQUIRED  Status_Code = 18
+	Status_CODE_HOSTS_REQUIRED   Status_Code = 19
+)
+
+// Enum value maps for Status_Code.
+var (
+	Status_Code_name = map[int32]string{
+		0:  "CODE_UNSPECIFIED",
+		10: "CODE_PASSWORD_INVALID",
+		11: "CODE_OK",
+		12: "CODE_SERVICE_UNKNOWN",
+		13: "CODE_LIMIT_EXCEEDED",
+		14: "CODE_TUNNEL_EXPIRED",
+		15: "CODE_SERVICE_RESERVED",
+		16: "CODE_BAD_VERSION",
+		17: "CODE_DRAINING",
+		18: "CODE_EGRESS_REQUIRED",
+		19: "CODE_HOSTS_REQUIRED",
+	}
+	Status_Code_value = map[string]int32{
+		"CODE_UNSPECIFIED":      0,
+		"CODE_PASSWORD_INVALID": 10,
+		"CODE_OK":               11,
+		"CODE_SERVICE_UNKNOWN":  12,
+		"CODE_LIMIT_EXCEEDED":   13,
+		"CODE_TUNNEL_EXPIRED":   14,
+		"CODE_SERVICE_RESERVED": 15,
+		"CODE_BAD_VERSION":      16,
+		"CODE_DRAINING":         17,
+		"CODE_EGRESS_REQUIRED":  18,
+		"CODE_HOSTS_REQUIRED":   19,
+	}
+)
+
+func (x Status_Code) Enum() *Status_Code {
+	p := new(Status_Code)
+	*p = x
+	return p
+}
+
+func (x Status_Code) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Status_Code) Descriptor() protoreflect.EnumDescriptor {
+	return file_tunnelit_control_v1_control_proto_enumTypes[0].Descriptor()
+}
+
+func (Status_Code) Type() protoreflect.EnumType {
+	return &file_tunnelit_control_v1_control_proto_enumTypes[0]
+}
+
+func (x Status_Code) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Status_Code.Descriptor instead.
+func (Status_Code) EnumDescriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{5, 0}
+}
+
+// Frame wraps every control message.
+type Frame struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Msg:
+	//
+	//	*Frame_Auth
+	//	*Frame_Challenge
+	//	*Frame_Register
+	//	*Frame_Status
+	//	*Frame_Ready
+	//	*Frame_Heartbeat
+	//	*Frame_Teardown
+	//	*Frame_Stats
+	Msg           isFrame_Msg `protobuf_oneof:"msg"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Frame) Reset() {
+	*x = Frame{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Frame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Frame) ProtoMessage() {}
+
+func (x *Frame) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Frame.ProtoReflect.Descriptor instead.
+func (*Frame) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Frame) GetMsg() isFrame_Msg {
+	if x != nil {
+		return x.Msg
+	}
+	return nil
+}
+
+func (x *Frame) GetAuth() *Auth {
+	if x != nil {
+		if x, ok := x.Msg.(*Frame_Auth); ok {
+			return x.Auth
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetChallenge() *Challenge {
+	if x != nil {
+		if x, ok := x.Msg.(*Frame_Challenge); ok {
+			return x.Challenge
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetRegister() *Register {
+	if x != nil {
+		if x, ok := x.Msg.(*Frame_Register); ok {
+			return x.Register
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetStatus() *Status {
+	if x != nil {
+		if x, ok := x.Msg.(*Frame_Status); ok {
+			return x.Status
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetReady() *Ready {
+	if x != nil {
+		if x, ok := x.Msg.(*Frame_Ready); ok {
+			return x.Ready
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetHeartbeat() *Heartbeat {
+	if x != nil {
+		if x, ok := x.Msg.(*Frame_Heartbeat); ok {
+			return x.Heartbeat
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetTeardown() *Teardown {
+	if x != nil {
+		if x, ok := x.Msg.(*Frame_Teardown); ok {
+			return x.Teardown
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetStats() *Stats {
+	if x != nil {
+		if x, ok := x.Msg.(*Frame_Stats); ok {
+			return x.Stats
+		}
+	}
+	return nil
+}
+
+type isFrame_Msg interface {
+	isFrame_Msg()
+}
+
+type Frame_Auth struct {
+	Auth *Auth `protobuf:"bytes,1,opt,name=auth,proto3,oneof"`
+}
+
+type Frame_Challenge struct {
+	Challenge *Challenge `protobuf:"bytes,2,opt,name=challenge,proto3,oneof"`
+}
+
+type Frame_Register struct {
+	Register *Register `protobuf:"bytes,3,opt,name=register,proto3,oneof"`
+}
+
+type Frame_Status struct {
+	Status *Status `protobuf:"bytes,4,opt,name=status,proto3,oneof"`
+}
+
+type Frame_Ready struct {
+	Ready *Ready `protobuf:"bytes,5,opt,name=ready,proto3,oneof"`
+}
+
+type Frame_Heartbeat struct {
+	Heartbeat *Heartbeat `protobuf:"bytes,6,opt,name=heartbeat,proto3,oneof"`
+}
+
+type Frame_Teardown struct {
+	Teardown *Teardown `protobuf:"bytes,7,opt,name=teardown,proto3,oneof"`
+}
+
+type Frame_Stats struct {
+	Stats *Stats `protobuf:"bytes,8,opt,name=stats,proto3,oneof"`
+}
+
+func (*Frame_Auth) isFrame_Msg() {}
+
+func (*Frame_Challenge) isFrame_Msg() {}
+
+func (*Frame_Register) isFrame_Msg() {}
+
+func (*Frame_Status) isFrame_Msg() {}
+
+func (*Frame_Ready) isFrame_Msg() {}
+
+func (*Frame_Heartbeat) isFrame_Msg() {}
+
+func (*Frame_Teardown) isFrame_Msg() {}
+
+func (*Frame_Stats) isFrame_Msg() {}
+
+// Auth is the tunnel's credential, sent first on each tunnel conn.
+type Auth struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Credential:
+	//
+	//	*Auth_PasswordHash
+	//	*Auth_ChallengeResponse
+	//	*Auth_VerifierProof
+	Credential    isAuth_Credential `protobuf_oneof:"credential"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Auth) Reset() {
+	*x = Auth{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Auth) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Auth) ProtoMessage() {}
+
+func (x *Auth) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Auth.ProtoReflect.Descriptor instead.
+func (*Auth) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Auth) GetCredential() isAuth_Credential {
+	if x != nil {
+		return x.Credential
+	}
+	return nil
+}
+
+func (x *Auth) GetPasswordHash() []byte {
+	if x != nil {
+		if x, ok := x.Credential.(*Auth_PasswordHash); ok {
+			return x.PasswordHash
+		}
+	}
+	return nil
+}
+
+func (x *Auth) GetChallengeResponse() []byte {
+	if x != nil {
+		if x, ok := x.Credential.(*Auth_ChallengeResponse); ok {
+			return x.ChallengeResponse
+		}
+	}
+	return nil
+}
+
+func (x *Auth) GetVerifierProof() []byte {
+	if x != nil {
+		if x, ok := x.Credential.(*Auth_VerifierProof); ok {
+			return x.VerifierProof
+		}
+	}
+	return nil
+}
+
+type isAuth_Credential interface {
+	isAuth_Credential()
+}
+
+type Auth_PasswordHash struct {
+	// SHA-256 hash of the password or token (legacy auth).
+	PasswordHash []byte `protobuf:"bytes,1,opt,name=password_hash,json=passwordHash,proto3,oneof"`
+}
+
+type Auth_ChallengeResponse struct {
+	// HMAC-SHA256 of the challenge's nonce keyed by the hash.
+	ChallengeResponse []byte `protobuf:"bytes,2,opt,name=challenge_response,json=challengeResponse,proto3,oneof"`
+}
+
+type Auth_VerifierProof struct {
+	// Proof of the verifier's client key for the challenge's nonce.
+	VerifierProof []byte `protobuf:"bytes,3,opt,name=verifier_proof,json=verifierProof,proto3,oneof"`
+}
+
+func (*Auth_PasswordHash) isAuth_Credential() {}
+
+func (*Auth_ChallengeResponse) isAuth_Credential() {}
+
+func (*Auth_VerifierProof) isAuth_Credential() {}
+
+// Challenge is the proxy's challenge for the tunnel's credential.
+type Challenge struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Nonce []byte                 `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	// Unset if the proxy has no verifier.
+	Verifier      *VerifierParams `protobuf:"bytes,2,opt,name=verifier,proto3" json:"verifier,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Challenge) Reset() {
+	*x = Challenge{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Challenge) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Challenge) ProtoMessage() {}
+
+func (x *Challenge) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Challenge.ProtoReflect.Descriptor instead.
+func (*Challenge) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Challenge) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *Challenge) GetVerifier() *VerifierParams {
+	if x != nil {
+		return x.Verifier
+	}
+	return nil
+}
+
+// VerifierParams are the Argon2id params of a password verifier.
+type VerifierParams struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Salt  []byte                 `protobuf:"bytes,1,opt,name=salt,proto3" json:"salt,omitempty"`
+	Time  uint32                 `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"`
+	// In KiB.
+	Memory        uint32 `protobuf:"varint,3,opt,name=memory,proto3" json:"memory,omitempty"`
+	Threads       uint32 `protobuf:"varint,4,opt,name=threads,proto3" json:"threads,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VerifierParams) Reset() {
+	*x = VerifierParams{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VerifierParams) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VerifierParams) ProtoMessage() {}
+
+func (x *VerifierParams) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VerifierParams.ProtoReflect.Descriptor instead.
+func (*VerifierParams) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *VerifierParams) GetSalt() []byte {
+	if x != nil {
+		return x.Salt
+	}
+	return nil
+}
+
+func (x *VerifierParams) GetTime() uint32 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+func (x *VerifierParams) GetMemory() uint32 {
+	if x != nil {
+		return x.Memory
+	}
+	return 0
+}
+
+func (x *VerifierParams) GetThreads() uint32 {
+	if x != nil {
+		return x.Threads
+	}
+	return 0
+}
+
+// Register describes what a tunnel conn serves.
+type Register struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Version uint32                 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	// Blank for the default service.
+	Service   string            `protobuf:"bytes,2,opt,name=service,proto3" json:"service,omitempty"`
+	Tunnel    string            `protobuf:"bytes,3,opt,name=tunnel,proto3" json:"tunnel,omitempty"`
+	Name      string            `protobuf:"bytes,4,opt,name=name,proto3" json:"name,omitempty"`
+	Tags      map[string]string `protobuf:"bytes,5,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Weight    uint32            `protobuf:"varint,6,opt,name=weight,proto3" json:"weight,omitempty"`
+	Nonce     []byte            `protobuf:"bytes,7,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Ping      bool              `protobuf:"varint,8,opt,name=ping,proto3" json:"ping,omitempty"`
+	Endpoints bool              `protobuf:"varint,9,opt,name=endpoints,proto3" json:"endpoints,omitempty"`
+	// In seconds (0 means never).
+	Ttl           int64    `protobuf:"varint,10,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	Dial          bool     `protobuf:"varint,11,opt,name=dial,proto3" json:"dial,omitempty"`
+	Egress        bool     `protobuf:"varint,12,opt,name=egress,proto3" json:"egress,omitempty"`
+	ClientInfo    bool     `protobuf:"varint,13,opt,name=client_info,json=clientInfo,proto3" json:"client_info,omitempty"`
+	Hosts         []string `protobuf:"bytes,14,rep,name=hosts,proto3" json:"hosts,omitempty"`
+	Mux           bool     `protobuf:"varint,15,opt,name=mux,proto3" json:"mux,omitempty"`
+	Link          bool     `protobuf:"varint,16,opt,name=link,proto3" json:"link,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Register) Reset() {
+	*x = Register{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Register) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Register) ProtoMessage() {}
+
+func (x *Register) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Register.ProtoReflect.Descriptor instead.
+func (*Register) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Register) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Register) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *Register) GetTunnel() string {
+	if x != nil {
+		return x.Tunnel
+	}
+	return ""
+}
+
+func (x *Register) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Register) GetTags() map[string]string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Register) GetWeight() uint32 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+func (x *Register) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *Register) GetPing() bool {
+	if x != nil {
+		return x.Ping
+	}
+	return false
+}
+
+func (x *Register) GetEndpoints() bool {
+	if x != nil {
+		return x.Endpoints
+	}
+	return false
+}
+
+func (x *Register) GetTtl() int64 {
+	if x != nil {
+		return x.Ttl
+	}
+	return 0
+}
+
+func (x *Register) GetDial() bool {
+	if x != nil {
+		return x.Dial
+	}
+	return false
+}
+
+func (x *Register) GetEgress() bool {
+	if x != nil {
+		return x.Egress
+	}
+	return false
+}
+
+func (x *Register) GetClientInfo() bool {
+	if x != nil {
+		return x.ClientInfo
+	}
+	return false
+}
+
+func (x *Register) GetHosts() []string {
+	if x != nil {
+		return x.Hosts
+	}
+	return nil
+}
+
+func (x *Register) GetMux() bool {
+	if x != nil {
+		return x.Mux
+	}
+	return false
+}
+
+func (x *Register) GetLink() bool {
+	if x != nil {
+		return x.Link
+	}
+	return false
+}
+
+// Status is the proxy's response to a registration.
+type Status struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Code          Status_Code            `protobuf:"varint,1,opt,name=code,proto3,enum=tunnelit.control.v1.Status_Code" json:"code,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Status) Reset() {
+	*x = Status{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Status) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Status) ProtoMessage() {}
+
+func (x *Status) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Status.ProtoReflect.Descriptor instead.
+func (*Status) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Status) GetCode() Status_Code {
+	if x != nil {
+		return x.Code
+	}
+	return Status_CODE_UNSPECIFIED
+}
+
+// Ready is sent by the proxy when a client is paired with the conn and echoed
+// (without fields) by the tunnel once it's ready to pipe.
+type Ready struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Set if the tunnel registered with client_info.
+	Client *ClientInfo `protobuf:"bytes,1,opt,name=client,proto3" json:"client,omitempty"`
+	// The destination to dial, for tunnels registered with egress.
+	DialAddr      string `protobuf:"bytes,2,opt,name=dial_addr,json=dialAddr,proto3" json:"dial_addr,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Ready) Reset() {
+	*x = Ready{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Ready) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ready) ProtoMessage() {}
+
+func (x *Ready) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ready.ProtoReflect.Descriptor instead.
+func (*Ready) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Ready) GetClient() *ClientInfo {
+	if x != nil {
+		return x.Client
+	}
+	return nil
+}
+
+func (x *Ready) GetDialAddr() string {
+	if x != nil {
+		return x.DialAddr
+	}
+	return ""
+}
+
+// ClientInfo describes the client a conn is used for.
+type ClientInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Addr          string                 `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+	LocalAddr     string                 `protobuf:"bytes,2,opt,name=local_addr,json=localAddr,proto3" json:"local_addr,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ClientInfo) Reset() {
+	*x = ClientInfo{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ClientInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClientInfo) ProtoMessage() {}
+
+func (x *ClientInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClientInfo.ProtoReflect.Descriptor instead.
+func (*ClientInfo) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ClientInfo) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
+func (x *ClientInfo) GetLocalAddr() string {
+	if x != nil {
+		return x.LocalAddr
+	}
+	return ""
+}
+
+// Heartbeat keeps idle conns alive, echoed by the tunnel.
+type Heartbeat struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UnixNanos     int64                  `protobuf:"varint,1,opt,name=unix_nanos,json=unixNanos,proto3" json:"unix_nanos,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Heartbeat) Reset() {
+	*x = Heartbeat{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Heartbeat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Heartbeat) ProtoMessage() {}
+
+func (x *Heartbeat) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Heartbeat.ProtoReflect.Descriptor instead.
+func (*Heartbeat) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Heartbeat) GetUnixNanos() int64 {
+	if x != nil {
+		return x.UnixNanos
+	}
+	return 0
+}
+
+// Teardown tells the other side the conn is being closed.
+type Teardown struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Reason        string                 `protobuf:"bytes,1,opt,name=reason,proto3" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Teardown) Reset() {
+	*x = Teardown{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Teardown) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Teardown) ProtoMessage() {}
+
+func (x *Teardown) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Teardown.ProtoReflect.Descriptor instead.
+func (*Teardown) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Teardown) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+// Stats are the counts of a tunnel's conns for a service, exchanged over its
+// link.
+type Stats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	IdleConns     int64                  `protobuf:"varint,1,opt,name=idle_conns,json=idleConns,proto3" json:"idle_conns,omitempty"`
+	ActiveConns   int64                  `protobuf:"varint,2,opt,name=active_conns,json=activeConns,proto3" json:"active_conns,omitempty"`
+	BytesSent     uint64                 `protobuf:"varint,3,opt,name=bytes_sent,json=bytesSent,proto3" json:"bytes_sent,omitempty"`
+	BytesReceived uint64                 `protobuf:"varint,4,opt,name=bytes_received,json=bytesReceived,proto3" json:"bytes_received,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Stats) Reset() {
+	*x = Stats{}
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stats) ProtoMessage() {}
+
+func (x *Stats) ProtoReflect() protoreflect.Message {
+	mi := &file_tunnelit_control_v1_control_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stats.ProtoReflect.Descriptor instead.
+func (*Stats) Descriptor() ([]byte, []int) {
+	return file_tunnelit_control_v1_control_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *Stats) GetIdleConns() int64 {
+	if x != nil {
+		return x.IdleConns
+	}
+	return 0
+}
+
+func (x *Stats) GetActiveConns() int64 {
+	if x != nil {
+		return x.ActiveConns
+	}
+	return 0
+}
+
+func (x *Stats) GetBytesSent() uint64 {
+	if x != nil {
+		return x.BytesSent
+	}
+	return 0
+}
+
+func (x *Stats) GetBytesReceived() uint64 {
+	if x != nil {
+		return x.BytesReceived
+	}
+	return 0
+}
+
+var File_tunnelit_control_v1_control_proto protoreflect.FileDescriptor
+
+var file_tunnelit_control_v1_control_proto_rawDesc = string([]byte{
+	0x0a, 0x21, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2f, 0x63, 0x6f, 0x6e, 0x74, 0x72,
+	0x6f, 0x6c, 0x2f, 0x76, 0x31, 0x2f, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x12, 0x13, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2e, 0x63, 0x6f,
+	0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x22, 0xd8, 0x03, 0x0a, 0x05, 0x46, 0x72, 0x61,
+	0x6d, 0x65, 0x12, 0x2f, 0x0a, 0x04, 0x61, 0x75, 0x74, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x19, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74,
+	0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x41, 0x75, 0x74, 0x68, 0x48, 0x00, 0x52, 0x04, 0x61,
+	0x75, 0x74, 0x68, 0x12, 0x3e, 0x0a, 0x09, 0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1e, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69,
+	0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x43, 0x68, 0x61,
+	0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x48, 0x00, 0x52, 0x09, 0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65,
+	0x6e, 0x67, 0x65, 0x12, 0x3b, 0x0a, 0x08, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74,
+	0x2e, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x67, 0x69,
+	0x73, 0x74, 0x65, 0x72, 0x48, 0x00, 0x52, 0x08, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72,
+	0x12, 0x35, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x1b, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74,
+	0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x48, 0x00, 0x52,
+	0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x32, 0x0a, 0x05, 0x72, 0x65, 0x61, 0x64, 0x79,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69,
+	0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x61,
+	0x64, 0x79, 0x48, 0x00, 0x52, 0x05, 0x72, 0x65, 0x61, 0x64, 0x79, 0x12, 0x3e, 0x0a, 0x09, 0x68,
+	0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1e,
+	0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f,
+	0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x48, 0x00,
+	0x52, 0x09, 0x68, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x12, 0x3b, 0x0a, 0x08, 0x74,
+	0x65, 0x61, 0x72, 0x64, 0x6f, 0x77, 0x6e, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c,
+	0x2e, 0x76, 0x31, 0x2e, 0x54, 0x65, 0x61, 0x72, 0x64, 0x6f, 0x77, 0x6e, 0x48, 0x00, 0x52, 0x08,
+	0x74, 0x65, 0x61, 0x72, 0x64, 0x6f, 0x77, 0x6e, 0x12, 0x32, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x74,
+	0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
+	0x69, 0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74,
+	0x61, 0x74, 0x73, 0x48, 0x00, 0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x73, 0x42, 0x05, 0x0a, 0x03,
+	0x6d, 0x73, 0x67, 0x22, 0x95, 0x01, 0x0a, 0x04, 0x41, 0x75, 0x74, 0x68, 0x12, 0x25, 0x0a, 0x0d,
+	0x70, 0x61, 0x73, 0x73, 0x77, 0x6f, 0x72, 0x64, 0x5f, 0x68, 0x61, 0x73, 0x68, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x0c, 0x70, 0x61, 0x73, 0x73, 0x77, 0x6f, 0x72, 0x64, 0x48,
+	0x61, 0x73, 0x68, 0x12, 0x2f, 0x0a, 0x12, 0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65,
+	0x5f, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x48,
+	0x00, 0x52, 0x11, 0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x27, 0x0a, 0x0e, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x65, 0x72,
+	0x5f, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x0d,
+	0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x65, 0x72, 0x50, 0x72, 0x6f, 0x6f, 0x66, 0x42, 0x0c, 0x0a,
+	0x0a, 0x63, 0x72, 0x65, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x61, 0x6c, 0x22, 0x62, 0x0a, 0x09, 0x43,
+	0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x6e, 0x63,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x12, 0x3f,
+	0x0a, 0x08, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x65, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x23, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74,
+	0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x56, 0x65, 0x72, 0x69, 0x66, 0x69, 0x65, 0x72, 0x50,
+	0x61, 0x72, 0x61, 0x6d, 0x73, 0x52, 0x08, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x65, 0x72, 0x22,
+	0x6a, 0x0a, 0x0e, 0x56, 0x65, 0x72, 0x69, 0x66, 0x69, 0x65, 0x72, 0x50, 0x61, 0x72, 0x61, 0x6d,
+	0x73, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x61, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x04, 0x73, 0x61, 0x6c, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0d, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6d, 0x65, 0x6d,
+	0x6f, 0x72, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72,
+	0x79, 0x12, 0x18, 0x0a, 0x07, 0x74, 0x68, 0x72, 0x65, 0x61, 0x64, 0x73, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x0d, 0x52, 0x07, 0x74, 0x68, 0x72, 0x65, 0x61, 0x64, 0x73, 0x22, 0xdb, 0x03, 0x0a, 0x08,
+	0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x16, 0x0a, 0x06,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x74, 0x75,
+	0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x3b, 0x0a, 0x04, 0x74, 0x61, 0x67, 0x73,
+	0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x27, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69,
+	0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x67,
+	0x69, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x54, 0x61, 0x67, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52,
+	0x04, 0x74, 0x61, 0x67, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x65, 0x69, 0x67, 0x68, 0x74, 0x18,
+	0x06, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x77, 0x65, 0x69, 0x67, 0x68, 0x74, 0x12, 0x14, 0x0a,
+	0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x05, 0x6e, 0x6f,
+	0x6e, 0x63, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x69, 0x6e, 0x67, 0x18, 0x08, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x04, 0x70, 0x69, 0x6e, 0x67, 0x12, 0x1c, 0x0a, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f,
+	0x69, 0x6e, 0x74, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x65, 0x6e, 0x64, 0x70,
+	0x6f, 0x69, 0x6e, 0x74, 0x73, 0x12, 0x10, 0x0a, 0x03, 0x74, 0x74, 0x6c, 0x18, 0x0a, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x03, 0x74, 0x74, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x69, 0x61, 0x6c, 0x18,
+	0x0b, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x64, 0x69, 0x61, 0x6c, 0x12, 0x16, 0x0a, 0x06, 0x65,
+	0x67, 0x72, 0x65, 0x73, 0x73, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x65, 0x67, 0x72,
+	0x65, 0x73, 0x73, 0x12, 0x1f, 0x0a, 0x0b, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x5f, 0x69, 0x6e,
+	0x66, 0x6f, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74,
+	0x49, 0x6e, 0x66, 0x6f, 0x12, 0x14, 0x0a, 0x05, 0x68, 0x6f, 0x73, 0x74, 0x73, 0x18, 0x0e, 0x20,
+	0x03, 0x28, 0x09, 0x52, 0x05, 0x68, 0x6f, 0x73, 0x74, 0x73, 0x12, 0x10, 0x0a, 0x03, 0x6d, 0x75,
+	0x78, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x08, 0x52, 0x03, 0x6d, 0x75, 0x78, 0x12, 0x12, 0x0a, 0x04,
+	0x6c, 0x69, 0x6e, 0x6b, 0x18, 0x10, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x6c, 0x69, 0x6e, 0x6b,
+	0x1a, 0x37, 0x0a, 0x09, 0x54, 0x61, 0x67, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a,
+	0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12,
+	0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0xc8, 0x02, 0x0a, 0x06, 0x53, 0x74,
+	0x61, 0x74, 0x75, 0x73, 0x12, 0x34, 0x0a, 0x04, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0e, 0x32, 0x20, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2e, 0x63, 0x6f,
+	0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x2e,
+	0x43, 0x6f, 0x64, 0x65, 0x52, 0x04, 0x63, 0x6f, 0x64, 0x65, 0x22, 0x87, 0x02, 0x0a, 0x04, 0x43,
+	0x6f, 0x64, 0x65, 0x12, 0x14, 0x0a, 0x10, 0x43, 0x4f, 0x44, 0x45, 0x5f, 0x55, 0x4e, 0x53, 0x50,
+	0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x19, 0x0a, 0x15, 0x43, 0x4f, 0x44,
+	0x45, 0x5f, 0x50, 0x41, 0x53, 0x53, 0x57, 0x4f, 0x52, 0x44, 0x5f, 0x49, 0x4e, 0x56, 0x41, 0x4c,
+	0x49, 0x44, 0x10, 0x0a, 0x12, 0x0b, 0x0a, 0x07, 0x43, 0x4f, 0x44, 0x45, 0x5f, 0x4f, 0x4b, 0x10,
+	0x0b, 0x12, 0x18, 0x0a, 0x14, 0x43, 0x4f, 0x44, 0x45, 0x5f, 0x53, 0x45, 0x52, 0x56, 0x49, 0x43,
+	0x45, 0x5f, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x0c, 0x12, 0x17, 0x0a, 0x13, 0x43,
+	0x4f, 0x44, 0x45, 0x5f, 0x4c, 0x49, 0x4d, 0x49, 0x54, 0x5f, 0x45, 0x58, 0x43, 0x45, 0x45, 0x44,
+	0x45, 0x44, 0x10, 0x0d, 0x12, 0x17, 0x0a, 0x13, 0x43, 0x4f, 0x44, 0x45, 0x5f, 0x54, 0x55, 0x4e,
+	0x4e, 0x45, 0x4c, 0x5f, 0x45, 0x58, 0x50, 0x49, 0x52, 0x45, 0x44, 0x10, 0x0e, 0x12, 0x19, 0x0a,
+	0x15, 0x43, 0x4f, 0x44, 0x45, 0x5f, 0x53, 0x45, 0x52, 0x56, 0x49, 0x43, 0x45, 0x5f, 0x52, 0x45,
+	0x53, 0x45, 0x52, 0x56, 0x45, 0x44, 0x10, 0x0f, 0x12, 0x14, 0x0a, 0x10, 0x43, 0x4f, 0x44, 0x45,
+	0x5f, 0x42, 0x41, 0x44, 0x5f, 0x56, 0x45, 0x52, 0x53, 0x49, 0x4f, 0x4e, 0x10, 0x10, 0x12, 0x11,
+	0x0a, 0x0d, 0x43, 0x4f, 0x44, 0x45, 0x5f, 0x44, 0x52, 0x41, 0x49, 0x4e, 0x49, 0x4e, 0x47, 0x10,
+	0x11, 0x12, 0x18, 0x0a, 0x14, 0x43, 0x4f, 0x44, 0x45, 0x5f, 0x45, 0x47, 0x52, 0x45, 0x53, 0x53,
+	0x5f, 0x52, 0x45, 0x51, 0x55, 0x49, 0x52, 0x45, 0x44, 0x10, 0x12, 0x12, 0x17, 0x0a, 0x13, 0x43,
+	0x4f, 0x44, 0x45, 0x5f, 0x48, 0x4f, 0x53, 0x54, 0x53, 0x5f, 0x52, 0x45, 0x51, 0x55, 0x49, 0x52,
+	0x45, 0x44, 0x10, 0x13, 0x22, 0x5d, 0x0a, 0x05, 0x52, 0x65, 0x61, 0x64, 0x79, 0x12, 0x37, 0x0a,
+	0x06, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1f, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x69, 0x74, 0x2e, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c,
+	0x2e, 0x76, 0x31, 0x2e, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x06,
+	0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x12, 0x1b, 0x0a, 0x09, 0x64, 0x69, 0x61, 0x6c, 0x5f, 0x61,
+	0x64, 0x64, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x64, 0x69, 0x61, 0x6c, 0x41,
+	0x64, 0x64, 0x72, 0x22, 0x3f, 0x0a, 0x0a, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x6e, 0x66,
+	0x6f, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x64, 0x64, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x61, 0x64, 0x64, 0x72, 0x12, 0x1d, 0x0a, 0x0a, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x5f, 0x61,
+	0x64, 0x64, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x6c, 0x6f, 0x63, 0x61, 0x6c,
+	0x41, 0x64, 0x64, 0x72, 0x22, 0x2a, 0x0a, 0x09, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61,
+	0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x75, 0x6e, 0x69, 0x78, 0x5f, 0x6e, 0x61, 0x6e, 0x6f, 0x73, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x75, 0x6e, 0x69, 0x78, 0x4e, 0x61, 0x6e, 0x6f, 0x73,
+	0x22, 0x22, 0x0a, 0x08, 0x54, 0x65, 0x61, 0x72, 0x64, 0x6f, 0x77, 0x6e, 0x12, 0x16, 0x0a, 0x06,
+	0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65,
+	0x61, 0x73, 0x6f, 0x6e, 0x22, 0x8f, 0x01, 0x0a, 0x05, 0x53, 0x74, 0x61, 0x74, 0x73, 0x12, 0x1d,
+	0x0a, 0x0a, 0x69, 0x64, 0x6c, 0x65, 0x5f, 0x63, 0x6f, 0x6e, 0x6e, 0x73, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x09, 0x69, 0x64, 0x6c, 0x65, 0x43, 0x6f, 0x6e, 0x6e, 0x73, 0x12, 0x21, 0x0a,
+	0x0c, 0x61, 0x63, 0x74, 0x69, 0x76, 0x65, 0x5f, 0x63, 0x6f, 0x6e, 0x6e, 0x73, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x0b, 0x61, 0x63, 0x74, 0x69, 0x76, 0x65, 0x43, 0x6f, 0x6e, 0x6e, 0x73,
+	0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x79, 0x74, 0x65, 0x73, 0x5f, 0x73, 0x65, 0x6e, 0x74, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x62, 0x79, 0x74, 0x65, 0x73, 0x53, 0x65, 0x6e, 0x74, 0x12,
+	0x25, 0x0a, 0x0e, 0x62, 0x79, 0x74, 0x65, 0x73, 0x5f, 0x72, 0x65, 0x63, 0x65, 0x69, 0x76, 0x65,
+	0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0d, 0x62, 0x79, 0x74, 0x65, 0x73, 0x52, 0x65,
+	0x63, 0x65, 0x69, 0x76, 0x65, 0x64, 0x42, 0x36, 0x5a, 0x34, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62,
+	0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6a, 0x6f, 0x68, 0x6e, 0x69, 0x65, 0x74, 0x72, 0x65, 0x2f, 0x74,
+	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2d, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x74, 0x75, 0x6e, 0x6e,
+	0x65, 0x6c, 0x69, 0x74, 0x2f, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x70, 0x62, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+})
+
+var (
+	file_tunnelit_control_v1_control_proto_rawDescOnce sync.Once
+	file_tunnelit_control_v1_control_proto_rawDescData []byte
+)
+
+func file_tunnelit_control_v1_control_proto_rawDescGZIP() []byte {
+	file_tunnelit_control_v1_control_proto_rawDescOnce.Do(func() {
+		file_tunnelit_control_v1_control_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_tunnelit_control_v1_control_proto_rawDesc), len(file_tunnelit_control_v1_control_proto_rawDesc)))
+	})
+	return file_tunnelit_control_v1_control_proto_rawDescData
+}
+
+var file_tunnelit_control_v1_control_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_tunnelit_control_v1_control_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
+var file_tunnelit_control_v1_control_proto_goTypes = []any{
+	(Status_Code)(0),       // 0: tunnelit.control.v1.Status.Code
+	(*Frame)(nil),          // 1: tunnelit.control.v1.Frame
+	(*Auth)(nil),           // 2: tunnelit.control.v1.Auth
+	(*Challenge)(nil),      // 3: tunnelit.control.v1.Challenge
+	(*VerifierParams)(nil), // 4: tunnelit.control.v1.VerifierParams
+	(*Register)(nil),       // 5: tunnelit.control.v1.Register
+	(*Status)(nil),         // 6: tunnelit.control.v1.Status
+	(*Ready)(nil),          // 7: tunnelit.control.v1.Ready
+	(*ClientInfo)(nil),     // 8: tunnelit.control.v1.ClientInfo
+	(*Heartbeat)(nil),      // 9: tunnelit.control.v1.Heartbeat
+	(*Teardown)(nil),       // 10: tunnelit.control.v1.Teardown
+	(*Stats)(nil),          // 11: tunnelit.control.v1.Stats
+	nil,                    // 12: tunnelit.control.v1.Register.TagsEntry
+}
+var file_tunnelit_control_v1_control_proto_depIdxs = []int32{
+	2,  // 0: tunnelit.control.v1.Frame.auth:type_name -> tunnelit.control.v1.Auth
+	3,  // 1: tunnelit.control.v1.Frame.challenge:type_name -> tunnelit.control.v1.Challenge
+	5,  // 2: tunnelit.control.v1.Frame.register:type_name -> tunnelit.control.v1.Register
+	6,  // 3: tunnelit.control.v1.Frame.status:type_name -> tunnelit.control.v1.Status
+	7,  // 4: tunnelit.control.v1.Frame.ready:type_name -> tunnelit.control.v1.Ready
+	9,  // 5: tunnelit.control.v1.Frame.heartbeat:type_name -> tunnelit.control.v1.Heartbeat
+	10, // 6: tunnelit.control.v1.Frame.teardown:type_name -> tunnelit.control.v1.Teardown
+	11, // 7: tunnelit.control.v1.Frame.stats:type_name -> tunnelit.control.v1.Stats
+	4,  // 8: tunnelit.control.v1.Challenge.verifier:type_name -> tunnelit.control.v1.VerifierParams
+	12, // 9: tunnelit.control.v1.Register.tags:type_name -> tunnelit.control.v1.Register.TagsEntry
+	0,  // 10: tunnelit.control.v1.Status.code:type_name -> tunnelit.control.v1.Status.Code
+	8,  // 11: tunnelit.control.v1.Ready.client:type_name -> tunnelit.control.v1.ClientInfo
+	12, // [12:12] is the sub-list for method output_type
+	12, // [12:12] is the sub-list for method input_type
+	12, // [12:12] is the sub-list for extension type_name
+	12, // [12:12] is the sub-list for extension extendee
+	0,  // [0:12] is the sub-list for field type_name
+}
+
+func init() { file_tunnelit_control_v1_control_proto_init() }
+func file_tunnelit_control_v1_control_proto_init() {
+	if File_tunnelit_control_v1_control_proto != nil {
+		return
+	}
+	file_tunnelit_control_v1_control_proto_msgTypes[0].OneofWrappers = []any{
+		(*Frame_Auth)(nil),
+		(*Frame_Challenge)(nil),
+		(*Frame_Register)(nil),
+		(*Frame_Status)(nil),
+		(*Frame_Ready)(nil),
+		(*Frame_Heartbeat)(nil),
+		(*Frame_Teardown)(nil),
+		(*Frame_Stats)(nil),
+	}
+	file_tunnelit_control_v1_control_proto_msgTypes[1].OneofWrappers = []any{
+		(*Auth_PasswordHash)(nil),
+		(*Auth_ChallengeResponse)(nil),
+		(*Auth_VerifierProof)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_tunnelit_control_v1_control_proto_rawDesc), len(file_tunnelit_control_v1_control_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   12,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_tunnelit_control_v1_control_proto_goTypes,
+		DependencyIndexes: file_tunnelit_control_v1_control_proto_depIdxs,
+		EnumInfos:         file_tunnelit_control_v1_control_proto_enumTypes,
+		MessageInfos:      file_tunnelit_control_v1_control_proto_msgTypes,
+	}.Build()
+	File_tunnelit_control_v1_control_proto = out.File
+	file_tunnelit_control_v1_control_proto_goTypes = nil
+	file_tunnelit_control_v1_control_proto_depIdxs = nil
+}
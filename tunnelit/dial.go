@@ -0,0 +1,87 @@
+package tunnelit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Dialer dials services through a tunnelit proxy by name, as clients of the
+// services. This reaches services that aren't exposed on any of the proxy's
+// listeners.
+type Dialer struct {
+	// ProxyAddr is the address of the proxy's tunnel listener.
+	ProxyAddr string
+	// Password is the proxy's password or a token.
+	Password string
+	// ProxyPubKey, if set, is the proxy's pinned identity key, which is
+	// verified on each conn.
+	ProxyPubKey ed25519.PublicKey
+	// Dialer is used to dial the proxy (nil means the zero Dialer).
+	Dialer *net.Dialer
+	// TLSConfig, if set, is used to encrypt the conns to the proxy with TLS
+	// (the proxy must have TLS enabled).
+	TLSConfig *tls.Config
+	// LegacyAuth sends the password hash itself rather than answering the
+	// proxy's challenge, for proxies that don't support challenges.
+	LegacyAuth bool
+}
+
+// Dial dials the named service.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials the named service. The network must be a TCP network. The
+// address is the service's name, with any port ignored so that the Dialer can
+// be used as an http.Transport's DialContext (with URLs like
+// http://service/). A blank name (e.g., ":0") dials the default service.
+func (d *Dialer) DialContext(
+	ctx context.Context, network, addr string,
+) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	service := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		service = host
+	}
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialProxy(ctx, dialer, d.TLSConfig, network, d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reg := Registration{Service: service, Dial: true}
+	pwdHash := sha256.Sum256([]byte(d.Password))
+	err = handshake(conn, pwdHash, d.LegacyAuth, reg, d.ProxyPubKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialProxy dials the proxy, completing the TLS handshake if a config is
+// given.
+func dialProxy(
+	ctx context.Context, dialer *net.Dialer, cfg *tls.Config,
+	network, addr string,
+) (net.Conn, error) {
+	if cfg == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	td := &tls.Dialer{NetDialer: dialer, Config: cfg}
+	return td.DialContext(ctx, network, addr)
+}
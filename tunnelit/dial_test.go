@@ -0,0 +1,79 @@
+package tunnelit_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+)
+
+func TestDialer(t *testing.T) {
+	proxy := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{
+		Services: []string{"", "db"},
+	})
+	tunnelittest.StartTunnel(
+		t, proxy, tunnelittest.StartEchoBackend(t),
+		tunnelit.ListenConfig{Service: "db"},
+	)
+	d := proxy.Dialer()
+	conn, err := d.Dial("tcp", "db:5432")
+	if err != nil {
+		t.Fatal("error dialing db: ", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("expected the backend's echo, got %q, %v", got, err)
+	}
+
+	if _, err := d.Dial("udp", "db:5432"); err == nil {
+		t.Fatal("expected an error for a non-TCP network")
+	}
+	var se *tunnelit.StatusError
+	if _, err := d.Dial("tcp", "unknown"); !errors.As(err, &se) ||
+		se.Status != tunnelit.StatusServiceUnknown {
+		t.Fatal("expected the service to be unknown, got ", err)
+	}
+	bad := *d
+	bad.Password = "wrong"
+	if _, err := bad.Dial("tcp", "db"); !errors.As(err, &se) ||
+		se.Status != tunnelit.StatusPasswordInvalid {
+		t.Fatal("expected the password to be invalid, got ", err)
+	}
+}
+
+func TestDialerHTTPTransport(t *testing.T) {
+	proxy := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{
+		Services: []string{"api"},
+	})
+	backend := tunnelittest.StartBackend(t, func(conn net.Conn) {
+		defer conn.Close()
+		// Answers one request
+		buf := make([]byte, 1024)
+		conn.Read(buf)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n"+
+			"Connection: close\r\n\r\nok")
+	})
+	tunnelittest.StartTunnel(
+		t, proxy, backend, tunnelit.ListenConfig{Service: "api"},
+	)
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: proxy.Dialer().DialContext},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get("http://api/health")
+	if err != nil {
+		t.Fatal("error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "ok" {
+		t.Fatalf("expected the backend's response, got %q", b)
+	}
+}
@@ -0,0 +1,322 @@
+package tunnelit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+const (
+	// DefaultIdleConns is the number of idle conns kept with the proxy when
+	// none is given.
+	DefaultIdleConns = 10
+	// retryDelay is how long to wait before redialing the proxy after an
+	// error.
+	retryDelay = time.Second
+	// limitRetryDelay is how long to wait before redialing after the proxy
+	// rejects a conn temporarily (e.g., for exceeding the token's limits).
+	limitRetryDelay = 5 * time.Second
+)
+
+// ListenConfig configures a Listener.
+type ListenConfig struct {
+	// ProxyAddr is the address of the proxy's tunnel listener.
+	ProxyAddr string
+	// Password is the proxy's password or a token.
+	Password string
+	// Service is the name of the service to serve (blank for the default).
+	Service string
+	// Name is the friendly name the proxy shows for the listener's conns.
+	Name string
+	// Tags are matched by the proxy's tunnel selectors.
+	Tags map[string]string
+	// Weight is the weight for the service's weighted policy (0 means 1).
+	Weight uint
+	// IdleConns is the number of idle conns kept with the proxy (0 means
+	// DefaultIdleConns). The proxy must have room for them.
+	IdleConns int
+	// TTL is how long after registering the proxy deregisters the listener
+	// (0 means never). The listener is closed once it's deregistered.
+	TTL time.Duration
+	// ProxyPubKey, if set, is the proxy's pinned identity key, which is
+	// verified on each conn.
+	ProxyPubKey ed25519.PublicKey
+	// Dialer is used to dial the proxy (nil means the zero Dialer).
+	Dialer *net.Dialer
+	// TLSConfig, if set, is used to encrypt the conns to the proxy with TLS
+	// (the proxy must have TLS enabled).
+	TLSConfig *tls.Config
+	// LegacyAuth sends the password hash itself rather than answering the
+	// proxy's challenge, for proxies that don't support challenges.
+	LegacyAuth bool
+}
+
+// Listener is a net.Listener whose conns are the clients of a service arriving
+// through a tunnelit proxy. Since the conns are tunneled, their remote
+// addresses are the proxy's.
+type Listener struct {
+	cfg       ListenConfig
+	reg       Registration
+	pwdHash   [sha256.Size]byte
+	endpoints utils.AValue[ServiceEndpoints]
+
+	// conns receives the conns that have been used for clients.
+	conns chan net.Conn
+	done  chan utils.Unit
+	// err is the error the listener was closed with.
+	err       error
+	closeOnce sync.Once
+
+	// idle are the idle conns, closed when the listener is.
+	idleMtx sync.Mutex
+	idle    map[net.Conn]utils.Unit
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listen registers with the proxy as a tunnel for the service, returning a
+// listener for the service's clients. The context bounds the first
+// registration, which reports errors such as an invalid password or unknown
+// service.
+func Listen(ctx context.Context, cfg ListenConfig) (*Listener, error) {
+	if cfg.IdleConns <= 0 {
+		cfg.IdleConns = DefaultIdleConns
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = &net.Dialer{}
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		cfg: cfg,
+		reg: Registration{
+			Service:   cfg.Service,
+			Tunnel:    hex.EncodeToString(id[:]),
+			Name:      cfg.Name,
+			Tags:      cfg.Tags,
+			Weight:    cfg.Weight,
+			Endpoints: true,
+			TTL:       int64(cfg.TTL / time.Second),
+		},
+		pwdHash: sha256.Sum256([]byte(cfg.Password)),
+		conns:   make(chan net.Conn),
+		done:    make(chan utils.Unit),
+		idle:    make(map[net.Conn]utils.Unit),
+	}
+	conn, err := l.register(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go l.serve(conn)
+	for i := 1; i < cfg.IdleConns; i++ {
+		go l.serve(nil)
+	}
+	return l, nil
+}
+
+// Accept waits for and returns the next client conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case conn := <-l.conns:
+			// Tell the proxy the conn is ready to be piped
+			if _, err := conn.Write([]byte{ConnReady}); err != nil {
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		case <-l.done:
+			return nil, l.err
+		}
+	}
+}
+
+// Close closes the listener and its idle conns. Conns already accepted are
+// unaffected.
+func (l *Listener) Close() error {
+	l.close(net.ErrClosed)
+	return nil
+}
+
+func (l *Listener) close(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+		l.idleMtx.Lock()
+		defer l.idleMtx.Unlock()
+		for conn := range l.idle {
+			conn.Close()
+		}
+	})
+}
+
+// Addr returns the service's (TCP) endpoint as reported by the proxy, or the
+// proxy's address if the service has none.
+func (l *Listener) Addr() net.Addr {
+	addr := l.endpoints.Load().Addr
+	if addr == "" {
+		addr = l.cfg.ProxyAddr
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return tcpAddr
+}
+
+// Endpoints returns the service's endpoints as last reported by the proxy.
+func (l *Listener) Endpoints() ServiceEndpoints {
+	return l.endpoints.Load()
+}
+
+// closed returns whether the listener is closed.
+func (l *Listener) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// serve keeps an idle conn with the proxy until the listener is closed,
+// starting with the given conn (if not nil).
+func (l *Listener) serve(conn net.Conn) {
+	for !l.closed() {
+		if conn == nil {
+			var err error
+			if conn, err = l.register(context.Background()); err != nil {
+				var se *StatusError
+				if errors.As(err, &se) && se.Temporary() {
+					time.Sleep(limitRetryDelay)
+					continue
+				} else if se != nil {
+					// The proxy won't accept any conns
+					l.close(err)
+					return
+				}
+				time.Sleep(retryDelay)
+				continue
+			}
+		}
+		if !l.waitUsed(conn) {
+			conn.Close()
+		}
+		conn = nil
+	}
+}
+
+// waitUsed waits for the proxy to use the idle conn for a client (answering
+// heartbeats in the meantime), handing it to Accept. False is returned if the
+// conn wasn't used.
+func (l *Listener) waitUsed(conn net.Conn) bool {
+	l.idleMtx.Lock()
+	if l.closed() {
+		l.idleMtx.Unlock()
+		return false
+	}
+	l.idle[conn] = utils.Unit{}
+	l.idleMtx.Unlock()
+	defer func() {
+		l.idleMtx.Lock()
+		defer l.idleMtx.Unlock()
+		delete(l.idle, conn)
+	}()
+
+	b := []byte{0}
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return false
+		} else if b[0] != Heartbeat {
+			break
+		}
+		if _, err := conn.Write(b); err != nil {
+			return false
+		}
+	}
+	if b[0] != ConnReady {
+		return false
+	}
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// StatusError is returned when the proxy rejects a registration.
+type StatusError struct {
+	Status byte
+}
+
+func (e *StatusError) Error() string {
+	return StatusText(e.Status)
+}
+
+// Temporary returns whether the registration may succeed if retried later.
+func (e *StatusError) Temporary() bool {
+	return e.Status == StatusLimitExceeded || e.Status == StatusDraining
+}
+
+// register dials the proxy and registers a conn for the service.
+func (l *Listener) register(ctx context.Context) (net.Conn, error) {
+	conn, err := dialProxy(
+		ctx, l.cfg.Dialer, l.cfg.TLSConfig, "tcp", l.cfg.ProxyAddr,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := l.handshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// handshake registers the conn, recording the reported endpoints.
+func (l *Listener) handshake(conn net.Conn) error {
+	err := handshake(
+		conn, l.pwdHash, l.cfg.LegacyAuth, l.reg, l.cfg.ProxyPubKey,
+	)
+	if err != nil {
+		return err
+	}
+	var eps ServiceEndpoints
+	if err := ReadMsg(conn, &eps); err != nil {
+		return fmt.Errorf("error reading service endpoints: %w", err)
+	}
+	l.endpoints.Store(eps)
+	return nil
+}
+
+// handshake registers the conn (see Register), checking the proxy's
+// response (and identity, if the key is given).
+func handshake(
+	conn net.Conn, pwdHash [sha256.Size]byte, legacyAuth bool,
+	reg Registration, pubKey ed25519.PublicKey,
+) error {
+	status, err := Register(conn, pwdHash, legacyAuth, reg, pubKey)
+	if err != nil {
+		return err
+	} else if status != StatusOK {
+		return &StatusError{Status: status}
+	}
+	return nil
+}
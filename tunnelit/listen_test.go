@@ -0,0 +1,94 @@
+package tunnelit_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/tunnel-proxy/tunnelit/tunnelittest"
+)
+
+func TestListen(t *testing.T) {
+	proxy := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{
+		Services: []string{"web"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ln, err := tunnelit.Listen(ctx, tunnelit.ListenConfig{
+		ProxyAddr: proxy.TunnelAddr, Password: proxy.Password,
+		Service: "web", IdleConns: 2,
+	})
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	if got, want := ln.Addr().String(), proxy.ClientAddr(t, "web"); got != want {
+		t.Fatalf("expected the service's endpoint %s, got %s", want, got)
+	}
+
+	client, err := net.Dial("tcp", proxy.ClientAddr(t, "web"))
+	if err != nil {
+		t.Fatal("error dialing proxy: ", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write([]byte("ping"))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("error accepting: ", err)
+	}
+	defer conn.Close()
+	go io.Copy(conn, conn)
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(client, got); err != nil || string(got) != "ping" {
+		t.Fatalf("expected the accepted conn's echo, got %q, %v", got, err)
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected accepting after closing to fail, got ", err)
+	}
+}
+
+func TestListenRejected(t *testing.T) {
+	proxy := tunnelittest.StartProxy(t, tunnelittest.ProxyConfig{})
+	tests := []struct {
+		name string
+		cfg  tunnelit.ListenConfig
+		want byte
+	}{
+		{
+			name: "wrong password",
+			cfg: tunnelit.ListenConfig{
+				ProxyAddr: proxy.TunnelAddr, Password: "wrong",
+			},
+			want: tunnelit.StatusPasswordInvalid,
+		},
+		{
+			name: "unknown service",
+			cfg: tunnelit.ListenConfig{
+				ProxyAddr: proxy.TunnelAddr, Password: proxy.Password,
+				Service: "unknown",
+			},
+			want: tunnelit.StatusServiceUnknown,
+		},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := tunnelit.Listen(ctx, tt.cfg)
+		cancel()
+		var se *tunnelit.StatusError
+		if !errors.As(err, &se) || se.Status != tt.want {
+			t.Fatalf("%s: expected status %d, got %v", tt.name, tt.want, err)
+		} else if se.Temporary() {
+			t.Fatalf("%s: expected a permanent error", tt.name)
+		}
+	}
+	if !(&tunnelit.StatusError{Status: tunnelit.StatusDraining}).Temporary() {
+		t.Fatal("expected draining to be temporary")
+	}
+}
@@ -0,0 +1,190 @@
+// Package tunnelit holds the parts of tunnelit that can be used when embedding
+// it, such as the load-balancing policies.
+package tunnelit
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tunnel describes a tunnel (with idle conns) serving a service, as seen by a
+// Policy.
+type Tunnel struct {
+	// ID identifies the tunnel.
+	ID string
+	// IdleConns is the number of idle conns from the tunnel, counting each of
+	// its sessions (which can take any number of clients) as one (always
+	// > 0).
+	IdleConns int
+	// ActiveConns is the number of conns from the tunnel currently in use.
+	ActiveConns int
+	// RTT is the smoothed heartbeat RTT to the tunnel (0 if not measured yet).
+	RTT time.Duration
+	// Weight is the tunnel's weight (always > 0).
+	Weight int
+}
+
+// Policy picks which tunnel a client's conn is taken from. Pick is given the
+// tunnels with idle conns, sorted by ID, and returns the index of the chosen
+// one. Calls to Pick for a service are serialized, so policies may keep state
+// without locking.
+type Policy interface {
+	Pick(tunnels []Tunnel) int
+}
+
+var (
+	policiesMtx sync.Mutex
+	policies    = map[string]func() Policy{
+		"lowest-latency":     func() Policy { return &LowestLatency{Hysteresis: 0.8} },
+		"round-robin":        func() Policy { return &RoundRobin{} },
+		"least-conns":        func() Policy { return LeastConns{} },
+		"random-two-choices": func() Policy { return RandomTwoChoices{} },
+		"weighted":           func() Policy { return Weighted{} },
+	}
+)
+
+// DefaultPolicy is the name of the policy used when none is given.
+const DefaultPolicy = "lowest-latency"
+
+// RegisterPolicy registers a policy under the given name, replacing any
+// existing one. The func is called to create the policy for each service that
+// uses it.
+func RegisterPolicy(name string, newPolicy func() Policy) {
+	policiesMtx.Lock()
+	defer policiesMtx.Unlock()
+	policies[name] = newPolicy
+}
+
+// NewPolicy creates the policy registered under the given name (or the
+// default policy if the name is blank).
+func NewPolicy(name string) (Policy, error) {
+	if name == "" {
+		name = DefaultPolicy
+	}
+	policiesMtx.Lock()
+	newPolicy, ok := policies[name]
+	policiesMtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown policy %q", name)
+	}
+	return newPolicy(), nil
+}
+
+// PolicyNames returns the names of the registered policies, sorted.
+func PolicyNames() []string {
+	policiesMtx.Lock()
+	defer policiesMtx.Unlock()
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LowestLatency picks the tunnel with the lowest RTT, sticking with the
+// previous pick unless another's RTT is under Hysteresis times its RTT (to
+// avoid flapping). Tunnels without a measured RTT are picked last.
+type LowestLatency struct {
+	Hysteresis float64
+	preferred  string
+}
+
+// Pick implements Policy.
+func (p *LowestLatency) Pick(tunnels []Tunnel) int {
+	best, pref := 0, -1
+	for i, t := range tunnels {
+		if rttLess(t.RTT, tunnels[best].RTT) {
+			best = i
+		}
+		if t.ID == p.preferred {
+			pref = i
+		}
+	}
+	if pref != -1 {
+		prefRTT, bestRTT := tunnels[pref].RTT, tunnels[best].RTT
+		if prefRTT == 0 || bestRTT == 0 ||
+			float64(bestRTT) >= float64(prefRTT)*p.Hysteresis {
+			best = pref
+		}
+	}
+	p.preferred = tunnels[best].ID
+	return best
+}
+
+// rttLess returns whether RTT a is less than b, with unmeasured (0) RTTs
+// being the greatest.
+func rttLess(a, b time.Duration) bool {
+	if a == 0 {
+		return false
+	} else if b == 0 {
+		return true
+	}
+	return a < b
+}
+
+// RoundRobin picks each tunnel in turn.
+type RoundRobin struct {
+	last string
+}
+
+// Pick implements Policy.
+func (p *RoundRobin) Pick(tunnels []Tunnel) int {
+	i := sort.Search(len(tunnels), func(i int) bool {
+		return tunnels[i].ID > p.last
+	})
+	if i == len(tunnels) {
+		i = 0
+	}
+	p.last = tunnels[i].ID
+	return i
+}
+
+// LeastConns picks the tunnel with the fewest active conns.
+type LeastConns struct{}
+
+// Pick implements Policy.
+func (LeastConns) Pick(tunnels []Tunnel) int {
+	best := 0
+	for i, t := range tunnels {
+		if t.ActiveConns < tunnels[best].ActiveConns {
+			best = i
+		}
+	}
+	return best
+}
+
+// RandomTwoChoices picks two tunnels at random and uses the one with fewer
+// active conns.
+type RandomTwoChoices struct{}
+
+// Pick implements Policy.
+func (RandomTwoChoices) Pick(tunnels []Tunnel) int {
+	i, j := rand.Intn(len(tunnels)), rand.Intn(len(tunnels))
+	if tunnels[j].ActiveConns < tunnels[i].ActiveConns {
+		return j
+	}
+	return i
+}
+
+// Weighted picks tunnels at random in proportion to their weights.
+type Weighted struct{}
+
+// Pick implements Policy.
+func (Weighted) Pick(tunnels []Tunnel) int {
+	total := 0
+	for _, t := range tunnels {
+		total += t.Weight
+	}
+	n := rand.Intn(total)
+	for i, t := range tunnels {
+		if n < t.Weight {
+			return i
+		}
+		n -= t.Weight
+	}
+	return len(tunnels) - 1
+}
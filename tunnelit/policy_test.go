@@ -0,0 +1,127 @@
+package tunnelit
+
+import (
+	"testing"
+	"time"
+)
+
+const ms = time.Millisecond
+
+// testTunnels are tunnels a, b, and c with differing RTTs, loads, and weights.
+var testTunnels = []Tunnel{
+	{ID: "a", IdleConns: 1, ActiveConns: 5, RTT: 30 * ms, Weight: 1},
+	{ID: "b", IdleConns: 1, ActiveConns: 1, RTT: 0, Weight: 3},
+	{ID: "c", IdleConns: 1, ActiveConns: 3, RTT: 20 * ms, Weight: 1},
+}
+
+// picks returns the IDs of the tunnels picked by n calls to Pick.
+func picks(p Policy, tunnels []Tunnel, n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = tunnels[p.Pick(tunnels)].ID
+	}
+	return ids
+}
+
+func TestLowestLatency(t *testing.T) {
+	p := &LowestLatency{Hysteresis: 0.8}
+	if got := picks(p, testTunnels, 2); got[0] != "c" || got[1] != "c" {
+		t.Fatalf("expected c (the lowest measured RTT), got %v", got)
+	}
+
+	// Sticks with c unless another is sufficiently better
+	tunnels := append([]Tunnel(nil), testTunnels...)
+	tunnels[0].RTT = 18 * time.Millisecond
+	if got := tunnels[p.Pick(tunnels)].ID; got != "c" {
+		t.Fatalf("expected c to be kept within the hysteresis, got %s", got)
+	}
+	tunnels[0].RTT = 10 * time.Millisecond
+	if got := tunnels[p.Pick(tunnels)].ID; got != "a" {
+		t.Fatalf("expected a once it's sufficiently better, got %s", got)
+	}
+
+	// Unmeasured tunnels are picked last
+	p = &LowestLatency{Hysteresis: 0.8}
+	tunnels = []Tunnel{{ID: "x"}, {ID: "y", RTT: time.Second}}
+	if got := tunnels[p.Pick(tunnels)].ID; got != "y" {
+		t.Fatalf("expected the measured tunnel, got %s", got)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	p := &RoundRobin{}
+	got := picks(p, testTunnels, 4)
+	want := []string{"a", "b", "c", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	// Continues after the last pick even if the tunnels change
+	if got := testTunnels[p.Pick(testTunnels[1:])+1].ID; got != "b" {
+		t.Fatalf("expected b after a, got %s", got)
+	}
+}
+
+func TestLeastConns(t *testing.T) {
+	if got := picks(LeastConns{}, testTunnels, 1)[0]; got != "b" {
+		t.Fatalf("expected b (the fewest active conns), got %s", got)
+	}
+}
+
+func TestRandomTwoChoices(t *testing.T) {
+	counts := make(map[string]int)
+	for _, id := range picks(RandomTwoChoices{}, testTunnels, 300) {
+		counts[id]++
+	}
+	// a has the most active conns, so it's only picked when chosen twice
+	if counts["a"] >= counts["b"] || counts["a"] >= counts["c"] {
+		t.Fatalf("expected a to be picked least, got %v", counts)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	counts := make(map[string]int)
+	for _, id := range picks(Weighted{}, testTunnels, 1000) {
+		counts[id]++
+	}
+	// b has 3/5 of the weight
+	if counts["b"] < 500 || counts["b"] > 700 {
+		t.Fatalf("expected b to be picked about 600 times, got %v", counts)
+	}
+}
+
+// firstPolicy always picks the first tunnel.
+type firstPolicy struct{}
+
+func (firstPolicy) Pick(tunnels []Tunnel) int { return 0 }
+
+func TestNewPolicy(t *testing.T) {
+	if p, err := NewPolicy(""); err != nil {
+		t.Fatal("error creating default policy: ", err)
+	} else if _, ok := p.(*LowestLatency); !ok {
+		t.Fatalf("expected the default policy to be lowest-latency, got %T", p)
+	}
+	if _, err := NewPolicy("no-such-policy"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+
+	RegisterPolicy("first", func() Policy { return firstPolicy{} })
+	t.Cleanup(func() {
+		policiesMtx.Lock()
+		delete(policies, "first")
+		policiesMtx.Unlock()
+	})
+	if p, err := NewPolicy("first"); err != nil {
+		t.Fatal("error creating registered policy: ", err)
+	} else if _, ok := p.(firstPolicy); !ok {
+		t.Fatalf("expected the registered policy, got %T", p)
+	}
+	found := false
+	for _, name := range PolicyNames() {
+		found = found || name == "first"
+	}
+	if !found {
+		t.Fatalf("expected first in %v", PolicyNames())
+	}
+}
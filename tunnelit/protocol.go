@@ -0,0 +1,633 @@
+package tunnelit
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/johnietre/utils/go"
+	"golang.org/x/crypto/argon2"
+)
+
+// ProtocolVersion is the version of the protocol sent in registrations. A
+// registration without a version is treated as version 1.
+const ProtocolVersion = 1
+
+// The bytes sent between the tunnel and proxy over a tunnel conn.
+const (
+	// ConnReady is sent by the proxy when the conn is used for a client and
+	// echoed by the tunnel once it's ready to pipe. If the tunnel registered
+	// with ClientInfo, it's followed by a ClientInfo.
+	ConnReady byte = 1
+	// Heartbeat is sent by the proxy on idle conns and echoed by the tunnel.
+	Heartbeat byte = 2
+	// ConnDial is sent by the proxy in place of ConnReady when the client
+	// asked for a destination, followed by a DialRequest (and a ClientInfo if
+	// the tunnel registered with ClientInfo). Only sent to
+	// tunnels registered with Egress, which respond with ConnReady once
+	// they've dialed the destination or DialFailed if they couldn't.
+	ConnDial byte = 3
+	// DialFailed is sent by the tunnel in response to ConnDial when it
+	// couldn't dial the destination. The tunnel closes the conn after it.
+	DialFailed byte = 4
+	// MuxReady is sent by the proxy to tunnels registered with Mux (after the
+	// status, identity proof, and endpoints) once the conn is used as a
+	// yamux session (github.com/hashicorp/yamux), in which the proxy opens a
+	// stream per client, each starting with ConnReady (or ConnDial) like an
+	// idle conn. Proxies that don't support sessions use the conn as an idle
+	// conn instead (sending a Heartbeat or ConnReady, etc.).
+	MuxReady byte = 5
+	// LinkReady is sent by the proxy to tunnels registered with Link (after
+	// the status, identity proof, and endpoints) once the conn is used as the
+	// tunnel's link for the service, over which the tunnel sends a LinkStatus
+	// every few seconds, each answered by the proxy with its own. Proxies
+	// that don't support links send a Heartbeat instead.
+	LinkReady byte = 6
+	// PingTunnel is sent on a ping conn in place of a Heartbeat to measure the
+	// round trip through a tunnel of the service to its backend. The proxy
+	// uses one of the service's tunnel conns as it would for a client (so
+	// the tunnel connects to its server), closes it once the tunnel is ready,
+	// and echoes PingTunnel, or sends DialFailed if no tunnel was ready.
+	PingTunnel byte = 7
+
+	// The statuses the proxy responds to a registration with. Only StatusOK is
+	// followed by anything else; the proxy closes the conn after the others.
+
+	// StatusPasswordInvalid means the password or token isn't valid. Retrying
+	// won't help until the credential is fixed.
+	StatusPasswordInvalid byte = 10
+	// StatusOK means the registration was accepted.
+	StatusOK byte = 11
+	// StatusServiceUnknown means the proxy doesn't have the service. Retrying
+	// won't help until it's added to the proxy's config.
+	StatusServiceUnknown byte = 12
+	// StatusLimitExceeded means the token's quota (conns, services, or
+	// bandwidth) is used up. It's worth retrying after a while.
+	StatusLimitExceeded byte = 13
+	// StatusTunnelExpired means the tunnel's TTL has passed. The tunnel won't
+	// be accepted again.
+	StatusTunnelExpired byte = 14
+	// StatusServiceReserved means the service is reserved for other tokens or
+	// isn't one the credential can be used for.
+	StatusServiceReserved byte = 15
+	// StatusBadVersion means the proxy doesn't support the registration's
+	// protocol version.
+	StatusBadVersion byte = 16
+	// StatusDraining means the proxy isn't accepting new tunnel conns (e.g.,
+	// before maintenance). It's worth retrying after a while, or with
+	// another proxy.
+	StatusDraining byte = 17
+	// StatusEgressRequired means the service's clients ask for destinations
+	// (e.g., as an HTTP CONNECT proxy), so only tunnels registered with
+	// Egress can serve it.
+	StatusEgressRequired byte = 18
+	// StatusHostsRequired means the service routes clients by the Host of
+	// their HTTP requests, so only tunnels registered with Hosts (or, if the
+	// proxy assigns subdomains, a Name that's a valid DNS label) can serve
+	// it.
+	StatusHostsRequired byte = 19
+)
+
+// StatusText returns a description of the status.
+func StatusText(status byte) string {
+	switch status {
+	case StatusPasswordInvalid:
+		return "invalid password"
+	case StatusOK:
+		return "ok"
+	case StatusServiceUnknown:
+		return "service unknown to proxy"
+	case StatusLimitExceeded:
+		return "token limit reached"
+	case StatusTunnelExpired:
+		return "tunnel expired"
+	case StatusServiceReserved:
+		return "service reserved for other tokens or credentials"
+	case StatusBadVersion:
+		return fmt.Sprintf(
+			"protocol version %d unsupported by proxy", ProtocolVersion,
+		)
+	case StatusDraining:
+		return "proxy is draining"
+	case StatusEgressRequired:
+		return "service requires a tunnel with egress"
+	case StatusHostsRequired:
+		return "service requires a tunnel with HTTP hosts"
+	}
+	return fmt.Sprintf("unknown status from proxy: %d", status)
+}
+
+// ChallengeRequest is sent by the tunnel in place of the password hash to ask
+// the proxy for a challenge, so that the hash (which anyone sniffing the link
+// could replay) is never sent. The proxy responds with a random nonce of
+// ChallengeSize bytes, and the tunnel with ChallengeResponse.
+const ChallengeRequest = "tunnelit-challenge-response-v1\x00\x00"
+
+// ChallengeSize is the size of the proxy's challenge nonce.
+const ChallengeSize = 32
+
+// ChallengeResponse returns the response to the proxy's challenge nonce for
+// the password (or token) hash.
+func ChallengeResponse(pwdHash [sha256.Size]byte, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, pwdHash[:])
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// ChallengeRequestV2 is sent in place of ChallengeRequest so that the proxy
+// may store a salted verifier of its password rather than the password hash.
+// The proxy responds with a random nonce of ChallengeSize bytes followed by
+// the verifier's params (see VerifierParams.Append), which are zeros if it
+// has no verifier. Without a verifier, the tunnel responds with
+// ChallengeResponse. With one, it responds with VerifierProof alone, so that
+// nothing cheaper to brute-force than the verifier is sent; the proxy checks
+// tokens and credentials against verifiers it derives from their hashes with
+// the same params.
+const ChallengeRequestV2 = "tunnelit-challenge-response-v2\x00\x00"
+
+// SaltSize is the size of a password verifier's salt.
+const SaltSize = 16
+
+// VerifierParamsSize is the size of the encoded VerifierParams.
+const VerifierParamsSize = SaltSize + 4 + 4 + 1
+
+// The most work the tunnel does to derive a verifier's keys, so that a rogue
+// proxy can't tie it up.
+const (
+	MaxVerifierTime    = 16
+	MaxVerifierMemory  = 256 << 10
+	MaxVerifierThreads = 16
+)
+
+// VerifierParams are the Argon2id params (RFC 9106) a password verifier's
+// keys are derived with.
+type VerifierParams struct {
+	Salt [SaltSize]byte
+	// Time is the number of passes over the memory.
+	Time uint32
+	// Memory is the memory used, in KiB.
+	Memory uint32
+	// Threads is the degree of parallelism.
+	Threads uint8
+}
+
+// DefaultVerifierParams returns the params recommended by RFC 9106 for
+// memory-constrained environments with a random salt.
+func DefaultVerifierParams() (VerifierParams, error) {
+	p := VerifierParams{Time: 3, Memory: 64 << 10, Threads: 4}
+	_, err := rand.Read(p.Salt[:])
+	return p, err
+}
+
+// IsZero returns whether the params are zeros (i.e., there's no verifier).
+func (p VerifierParams) IsZero() bool {
+	return p == VerifierParams{}
+}
+
+// Validate returns an error if the params are zero or take more work than
+// the tunnel is willing to do.
+func (p VerifierParams) Validate() error {
+	switch {
+	case p.Time == 0 || p.Time > MaxVerifierTime:
+		return fmt.Errorf("time must be between 1 and %d", MaxVerifierTime)
+	case p.Memory < 8*uint32(p.Threads) || p.Memory > MaxVerifierMemory:
+		return fmt.Errorf(
+			"memory must be between 8*threads and %d KiB", MaxVerifierMemory,
+		)
+	case p.Threads == 0 || p.Threads > MaxVerifierThreads:
+		return fmt.Errorf("threads must be between 1 and %d", MaxVerifierThreads)
+	}
+	return nil
+}
+
+// Append appends the encoded params to b: the salt, time (4 bytes, big
+// endian), memory (4 bytes, big endian), and threads (1 byte).
+func (p VerifierParams) Append(b []byte) []byte {
+	b = append(b, p.Salt[:]...)
+	b = binary.BigEndian.AppendUint32(b, p.Time)
+	b = binary.BigEndian.AppendUint32(b, p.Memory)
+	return append(b, p.Threads)
+}
+
+// ParseVerifierParams parses params encoded by Append.
+func ParseVerifierParams(b []byte) (p VerifierParams, err error) {
+	if len(b) != VerifierParamsSize {
+		return p, fmt.Errorf("verifier params must be %d bytes", VerifierParamsSize)
+	}
+	copy(p.Salt[:], b)
+	p.Time = binary.BigEndian.Uint32(b[SaltSize:])
+	p.Memory = binary.BigEndian.Uint32(b[SaltSize+4:])
+	p.Threads = b[SaltSize+8]
+	return p, nil
+}
+
+// VerifierKeys derives the keys of a password verifier from the password hash
+// with Argon2id. The proxy stores only the stored key (the hash of the client
+// key) and the tunnel proves it knows the client key with VerifierProof, like
+// SCRAM (RFC 5802).
+func VerifierKeys(
+	pwdHash [sha256.Size]byte, params VerifierParams,
+) (clientKey, storedKey [sha256.Size]byte) {
+	salted := argon2.IDKey(
+		pwdHash[:], params.Salt[:], params.Time, params.Memory, params.Threads,
+		sha256.Size,
+	)
+	mac := hmac.New(sha256.New, salted)
+	mac.Write([]byte("Client Key"))
+	copy(clientKey[:], mac.Sum(nil))
+	return clientKey, sha256.Sum256(clientKey[:])
+}
+
+// VerifierProof returns the proof of the client key for the proxy's challenge
+// nonce: the client key XORed with the ChallengeResponse of the stored key.
+// The proxy recovers the client key by XORing it back and checks that it
+// hashes to the stored key.
+func VerifierProof(clientKey, storedKey [sha256.Size]byte, nonce []byte) []byte {
+	proof := ChallengeResponse(storedKey, nonce)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return proof
+}
+
+// ProofVerifies returns whether the proof (see VerifierProof) is for the
+// stored key.
+func ProofVerifies(storedKey [sha256.Size]byte, nonce, proof []byte) bool {
+	if len(proof) != sha256.Size {
+		return false
+	}
+	var clientKey [sha256.Size]byte
+	mask := ChallengeResponse(storedKey, nonce)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ mask[i]
+	}
+	got := sha256.Sum256(clientKey[:])
+	return subtle.ConstantTimeCompare(got[:], storedKey[:]) == 1
+}
+
+// verifierKeyCache caches the keys derived for verifiers, since deriving them
+// is slow by design and each tunnel conn is authenticated separately.
+var verifierKeyCache struct {
+	sync.Mutex
+	keys map[string][2][sha256.Size]byte
+}
+
+// CachedVerifierKeys is VerifierKeys, caching the keys derived for the most
+// recent hashes and params.
+func CachedVerifierKeys(
+	pwdHash [sha256.Size]byte, params VerifierParams,
+) (clientKey, storedKey [sha256.Size]byte) {
+	id := string(params.Append(pwdHash[:]))
+	verifierKeyCache.Lock()
+	keys, ok := verifierKeyCache.keys[id]
+	verifierKeyCache.Unlock()
+	if ok {
+		return keys[0], keys[1]
+	}
+	clientKey, storedKey = VerifierKeys(pwdHash, params)
+	verifierKeyCache.Lock()
+	defer verifierKeyCache.Unlock()
+	// Only a changed password, token, or verifier adds keys, so clearing them
+	// all now and then is enough to keep the cache small
+	if verifierKeyCache.keys == nil || len(verifierKeyCache.keys) >= 1024 {
+		verifierKeyCache.keys = make(map[string][2][sha256.Size]byte)
+	}
+	verifierKeyCache.keys[id] = [2][sha256.Size]byte{clientKey, storedKey}
+	return clientKey, storedKey
+}
+
+// Authenticate sends the tunnel's credential to the proxy, which is the
+// response to the proxy's challenge (see ChallengeRequestV2) or, if legacy is
+// true, the password hash itself (for proxies that don't support challenges).
+func Authenticate(
+	rw io.ReadWriter, pwdHash [sha256.Size]byte, legacy bool,
+) error {
+	if legacy {
+		if _, err := utils.WriteAll(rw, pwdHash[:]); err != nil {
+			return fmt.Errorf("error writing password: %w", err)
+		}
+		return nil
+	}
+	if _, err := io.WriteString(rw, ChallengeRequestV2); err != nil {
+		return fmt.Errorf("error requesting challenge: %w", err)
+	}
+	challenge := make([]byte, ChallengeSize+VerifierParamsSize)
+	if _, err := io.ReadFull(rw, challenge); err != nil {
+		return fmt.Errorf(
+			"error reading challenge (the proxy may only support legacy auth): %w",
+			err,
+		)
+	}
+	resp, err := ChallengeAnswer(pwdHash, challenge)
+	if err != nil {
+		return err
+	}
+	if _, err := utils.WriteAll(rw, resp); err != nil {
+		return fmt.Errorf("error writing challenge response: %w", err)
+	}
+	return nil
+}
+
+// ChallengeAnswer returns the tunnel's answer to the proxy's version 2
+// challenge (the nonce followed by the verifier params): the VerifierProof if
+// the proxy has a verifier and the ChallengeResponse otherwise.
+func ChallengeAnswer(pwdHash [sha256.Size]byte, challenge []byte) ([]byte, error) {
+	nonce := challenge[:ChallengeSize]
+	params, err := ParseVerifierParams(challenge[ChallengeSize:])
+	if err != nil {
+		return nil, err
+	} else if params.IsZero() {
+		return ChallengeResponse(pwdHash, nonce), nil
+	} else if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid password verifier params from proxy: %w", err)
+	}
+	clientKey, storedKey := CachedVerifierKeys(pwdHash, params)
+	return VerifierProof(clientKey, storedKey, nonce), nil
+}
+
+// HashRequest is sent by tunnels using legacy auth ahead of their password
+// hash and registration, so that the proxy can tell them from tunnels
+// predating registrations, which send the hash alone, as soon as it's read.
+const HashRequest = "tunnelit-hash-registration-v1\x00\x00\x00"
+
+// IdentityRequest is sent in place of ChallengeRequestV2 by tunnels pinning
+// the proxy's identity key, followed by the registration (with a Nonce of
+// IdentityNonceSize bytes), so that the proxy proves its identity before the
+// tunnel sends any credential. The proxy responds with the version 2
+// challenge followed by an IdentityProof signing IdentitySigned of the
+// tunnel's nonce, the challenge, and the registration as sent. Only once the
+// signature is verified does the tunnel answer the challenge (see
+// ChallengeAnswer), after which the proxy responds with its status as usual.
+const IdentityRequest = "tunnelit-identity-challenge-v1\x00\x00"
+
+// IdentityNonceSize is the size of the tunnel's nonce sent with
+// IdentityRequest.
+const IdentityNonceSize = 32
+
+// Register authenticates with the proxy and sends the registration, returning
+// the proxy's status. If pubKey is set, the proxy's identity is verified
+// against it first (see IdentityRequest) so that the credential is never sent
+// to an impostor, which legacy auth can't do.
+func Register(
+	rw io.ReadWriter, pwdHash [sha256.Size]byte, legacy bool,
+	reg Registration, pubKey ed25519.PublicKey,
+) (byte, error) {
+	reg.Version = ProtocolVersion
+	if pubKey != nil {
+		if legacy {
+			return 0, errors.New(
+				"legacy auth can't be used when verifying the proxy's identity",
+			)
+		} else if err := authenticateVerified(rw, pwdHash, reg, pubKey); err != nil {
+			return 0, err
+		}
+	} else if legacy {
+		msg, err := marshalMsg(reg)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding registration: %w", err)
+		}
+		b := append(append([]byte(HashRequest), pwdHash[:]...), msg...)
+		if _, err := utils.WriteAll(rw, b); err != nil {
+			return 0, fmt.Errorf("error writing password: %w", err)
+		}
+	} else if err := Authenticate(rw, pwdHash, legacy); err != nil {
+		return 0, err
+	} else if err := WriteMsg(rw, reg); err != nil {
+		return 0, fmt.Errorf("error writing registration: %w", err)
+	}
+	b := []byte{0}
+	if _, err := io.ReadFull(rw, b); err != nil {
+		return 0, fmt.Errorf("error reading response: %w", err)
+	}
+	return b[0], nil
+}
+
+// authenticateVerified sends IdentityRequest and the registration, verifies
+// the proxy's identity proof against the key, and only then answers the
+// proxy's challenge.
+func authenticateVerified(
+	rw io.ReadWriter, pwdHash [sha256.Size]byte, reg Registration,
+	pubKey ed25519.PublicKey,
+) error {
+	reg.Nonce = make([]byte, IdentityNonceSize)
+	if _, err := rand.Read(reg.Nonce); err != nil {
+		return err
+	}
+	msg, err := marshalMsg(reg)
+	if err != nil {
+		return fmt.Errorf("error encoding registration: %w", err)
+	}
+	if _, err := utils.WriteAll(rw, append([]byte(IdentityRequest), msg...)); err != nil {
+		return fmt.Errorf("error requesting identity proof: %w", err)
+	}
+	challenge := make([]byte, ChallengeSize+VerifierParamsSize)
+	if _, err := io.ReadFull(rw, challenge); err != nil {
+		return fmt.Errorf(
+			"error reading challenge (the proxy may not support identity proofs): %w",
+			err,
+		)
+	}
+	var proof IdentityProof
+	if err := ReadMsg(rw, &proof); err != nil {
+		return fmt.Errorf("error reading identity proof: %w", err)
+	} else if len(proof.Signature) == 0 {
+		return errors.New("proxy has no identity key")
+	}
+	signed := IdentitySigned(reg.Nonce, challenge, msg[2:])
+	if !ed25519.Verify(pubKey, signed, proof.Signature) {
+		return errors.New("invalid identity signature from proxy")
+	}
+	resp, err := ChallengeAnswer(pwdHash, challenge)
+	if err != nil {
+		return err
+	}
+	if _, err := utils.WriteAll(rw, resp); err != nil {
+		return fmt.Errorf("error writing challenge response: %w", err)
+	}
+	return nil
+}
+
+// Registration is sent by the tunnel (after its credential) for each tunnel
+// conn to describe what the conn serves.
+type Registration struct {
+	// Version is the protocol version the tunnel speaks (0 means 1).
+	Version int `json:"version,omitempty"`
+	// Service is the name of the service the conn serves (blank for the
+	// default service).
+	Service string `json:"service,omitempty"`
+	// Tunnel is the ID of the tunnel process the conn is from, used to group
+	// conns from the same tunnel.
+	Tunnel string `json:"tunnel,omitempty"`
+	// Name is the tunnel's friendly name, shown by the proxy alongside the
+	// tunnel's ID.
+	Name string `json:"name,omitempty"`
+	// Tags are the tunnel's tags (e.g., "region": "eu"), which the proxy's
+	// tunnel selectors match to partition clients across tunnels.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Weight is the tunnel's weight for the weighted policy (0 means 1).
+	Weight uint `json:"weight,omitempty"`
+	// Nonce is the tunnel's nonce for the proxy to sign when the registration
+	// is sent with IdentityRequest.
+	Nonce []byte `json:"nonce,omitempty"`
+	// Ping marks the conn as being used to measure latency. The proxy echoes
+	// heartbeats sent on it instead of pooling it.
+	Ping bool `json:"ping,omitempty"`
+	// Endpoints asks the proxy to report the service's endpoints (after the
+	// identity proof, if any).
+	Endpoints bool `json:"endpoints,omitempty"`
+	// TTL is the number of seconds after the tunnel's first registration that
+	// the proxy deregisters it (0 means never).
+	TTL int64 `json:"ttl,omitempty"`
+	// Dial marks the conn as a client of the service (from a Dialer) rather
+	// than a tunnel conn. Once the proxy responds, the conn is piped to one of
+	// the service's tunnel conns.
+	Dial bool `json:"dial,omitempty"`
+	// Egress marks the tunnel as dialing the destinations clients ask for
+	// (see ConnDial) rather than only its own servers.
+	Egress bool `json:"egress,omitempty"`
+	// ClientInfo asks the proxy to send a ClientInfo along with ConnReady
+	// (or ConnDial) so the tunnel knows who the client is (e.g., to pass on
+	// to the servers with the PROXY protocol).
+	ClientInfo bool `json:"client_info,omitempty"`
+	// Hosts are the HTTP hosts (e.g., "app.example.com" or
+	// "*.example.com") the tunnel serves, for services routing clients by the
+	// Host of their requests. Without them, the proxy may assign the tunnel
+	// a subdomain named after it (see ServiceEndpoints.URL).
+	Hosts []string `json:"hosts,omitempty"`
+	// Mux asks the proxy to use the conn as a session multiplexing any number
+	// of clients (see MuxReady) rather than as a single idle conn.
+	Mux bool `json:"mux,omitempty"`
+	// Link asks the proxy to use the conn as the tunnel's link for the
+	// service (see LinkReady) rather than as an idle conn, so that both sides
+	// notice within seconds if the connection between them is lost and
+	// replace their idle conns rather than waiting for clients to fail on
+	// them.
+	Link bool `json:"link,omitempty"`
+}
+
+// LinkStatus is sent periodically by the tunnel over its link and answered
+// by the proxy, doubling as the link's heartbeat. Each side considers the link
+// lost if it receives none for a few intervals.
+type LinkStatus struct {
+	// IdleConns is the number of the tunnel's idle conns (or sessions) for
+	// the service the sender has.
+	IdleConns int `json:"idle_conns"`
+	// ActiveConns is the number of the tunnel's conns (or streams) for the
+	// service in use by clients, as counted by the proxy (only sent by the
+	// proxy).
+	ActiveConns int `json:"active_conns,omitempty"`
+}
+
+// ClientInfo describes the client a conn is used for, as sent by the proxy.
+type ClientInfo struct {
+	// Addr is the client's address (host:port).
+	Addr string `json:"addr"`
+	// LocalAddr is the proxy's address the client connected to.
+	LocalAddr string `json:"local_addr"`
+}
+
+// DialRequest is sent by the proxy after ConnDial.
+type DialRequest struct {
+	// Addr is the address (host:port) of the destination to dial.
+	Addr string `json:"addr"`
+}
+
+// ServiceEndpoints are the addresses a service's clients can reach it on, as
+// reported by the proxy. They reflect the ports the proxy picked for services
+// listening on port 0.
+type ServiceEndpoints struct {
+	Addr    string `json:"addr,omitempty"`
+	WSAddr  string `json:"ws_addr,omitempty"`
+	UDPAddr string `json:"udp_addr,omitempty"`
+	// URL is the URL of the subdomain the proxy assigned the tunnel (if any)
+	// for services routing clients by HTTP host.
+	URL string `json:"url,omitempty"`
+}
+
+// identityContext is prefixed to the data the proxy signs so the signatures
+// can't be used for anything else.
+const identityContext = "tunnelit-proxy-identity-v2\x00"
+
+// IdentityProof is sent by the proxy after its challenge when the tunnel
+// sends IdentityRequest.
+type IdentityProof struct {
+	// Signature is the signature of IdentitySigned (empty if the proxy has no
+	// identity key).
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// IdentitySigned returns the data the proxy signs for the tunnel's nonce,
+// the proxy's challenge (its nonce and verifier params), and the encoded
+// registration, binding the proof to the conn's handshake.
+func IdentitySigned(nonce, challenge, reg []byte) []byte {
+	regHash := sha256.Sum256(reg)
+	signed := append([]byte(identityContext), nonce...)
+	signed = append(signed, challenge...)
+	return append(signed, regHash[:]...)
+}
+
+// WriteMsg writes the JSON encoding of v, prefixed by its 2-byte length.
+func WriteMsg(w io.Writer, v any) error {
+	b, err := marshalMsg(v)
+	if err != nil {
+		return err
+	}
+	_, err = utils.WriteAll(w, b)
+	return err
+}
+
+// marshalMsg returns the message WriteMsg writes for v.
+func marshalMsg(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > math.MaxUint16 {
+		return nil, fmt.Errorf("message too long (%d bytes)", len(b))
+	}
+	return append(utils.Put2(uint16(len(b))), b...), nil
+}
+
+// ReadMsg reads a message written by WriteMsg into v.
+func ReadMsg(r io.Reader, v any) error {
+	b, err := ReadMsgBytes(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ReadMsgBytes reads a message written by WriteMsg, returning its encoding
+// without the length.
+func ReadMsgBytes(r io.Reader) ([]byte, error) {
+	var lb [2]byte
+	if _, err := io.ReadFull(r, lb[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, utils.Get2(lb[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WritePreamble writes the preamble selecting the service (blank for the
+// default) on a proxy's shared client listener. Clients must write it before
+// anything else, unless they speak TLS, in which case the SNI of their client
+// hello selects the service instead.
+func WritePreamble(w io.Writer, service string) error {
+	if len(service) > math.MaxUint8 {
+		return fmt.Errorf("service name too long (%d bytes)", len(service))
+	}
+	_, err := utils.WriteAll(w, append([]byte{byte(len(service))}, service...))
+	return err
+}
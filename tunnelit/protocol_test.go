@@ -0,0 +1,354 @@
+package tunnelit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testParams are cheap verifier params for tests.
+var testParams = VerifierParams{
+	Salt: [SaltSize]byte{1, 2, 3}, Time: 1, Memory: 64, Threads: 1,
+}
+
+func TestVerifierParamsRoundTrip(t *testing.T) {
+	b := testParams.Append(nil)
+	if len(b) != VerifierParamsSize {
+		t.Fatalf("expected %d bytes, got %d", VerifierParamsSize, len(b))
+	}
+	p, err := ParseVerifierParams(b)
+	if err != nil {
+		t.Fatal("error parsing params: ", err)
+	} else if p != testParams {
+		t.Fatalf("expected %+v, got %+v", testParams, p)
+	}
+	if _, err := ParseVerifierParams(b[1:]); err == nil {
+		t.Fatal("expected error parsing short params")
+	}
+}
+
+func TestVerifierParamsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		params VerifierParams
+		ok     bool
+	}{
+		{name: "test params", params: testParams, ok: true},
+		{name: "zero", params: VerifierParams{}},
+		{
+			name:   "too many passes",
+			params: VerifierParams{Time: MaxVerifierTime + 1, Memory: 64, Threads: 1},
+		},
+		{
+			name:   "too much memory",
+			params: VerifierParams{Time: 1, Memory: MaxVerifierMemory + 1, Threads: 1},
+		},
+		{
+			name:   "less memory than threads need",
+			params: VerifierParams{Time: 1, Memory: 8, Threads: 2},
+		},
+		{
+			name:   "too many threads",
+			params: VerifierParams{Time: 1, Memory: 1024, Threads: MaxVerifierThreads + 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.params.Validate(); (err == nil) != tt.ok {
+				t.Fatalf("expected ok=%v, got error %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestVerifierProof(t *testing.T) {
+	pwdHash := sha256.Sum256([]byte("password"))
+	clientKey, storedKey := VerifierKeys(pwdHash, testParams)
+	nonce := bytes.Repeat([]byte{7}, ChallengeSize)
+	proof := VerifierProof(clientKey, storedKey, nonce)
+	if !ProofVerifies(storedKey, nonce, proof) {
+		t.Fatal("proof didn't verify")
+	}
+	otherNonce := bytes.Repeat([]byte{8}, ChallengeSize)
+	if ProofVerifies(storedKey, otherNonce, proof) {
+		t.Fatal("proof verified for another nonce")
+	}
+	_, otherKey := VerifierKeys(sha256.Sum256([]byte("other")), testParams)
+	if ProofVerifies(otherKey, nonce, proof) {
+		t.Fatal("proof verified for another password")
+	}
+	if ProofVerifies(storedKey, nonce, proof[1:]) {
+		t.Fatal("short proof verified")
+	}
+}
+
+func TestChallengeAnswer(t *testing.T) {
+	pwdHash := sha256.Sum256([]byte("password"))
+	nonce := bytes.Repeat([]byte{7}, ChallengeSize)
+	clientKey, storedKey := VerifierKeys(pwdHash, testParams)
+	tests := []struct {
+		name   string
+		params VerifierParams
+		// want is the expected answer (nil means an error).
+		want []byte
+	}{
+		{name: "no verifier", want: ChallengeResponse(pwdHash, nonce)},
+		{
+			// Only the proof is sent, never the fast response
+			name:   "verifier",
+			params: testParams,
+			want:   VerifierProof(clientKey, storedKey, nonce),
+		},
+		{
+			name:   "too costly",
+			params: VerifierParams{Time: MaxVerifierTime + 1, Memory: 64, Threads: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge := tt.params.Append(append([]byte(nil), nonce...))
+			got, err := ChallengeAnswer(pwdHash, challenge)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal("error answering challenge: ", err)
+			} else if !bytes.Equal(got, tt.want) {
+				t.Fatalf("expected %x, got %x", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReadMsg(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		ok    bool
+	}{
+		{name: "valid", input: []byte("\x00\x11{\"service\":\"web\"}"), ok: true},
+		{name: "empty", input: nil},
+		{name: "truncated length", input: []byte{0}},
+		{name: "truncated body", input: []byte("\x00\x11{\"service\"")},
+		{name: "invalid JSON", input: []byte("\x00\x02{]")},
+		{name: "wrong type", input: []byte("\x00\x0e{\"service\":1}")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reg Registration
+			err := ReadMsg(bytes.NewReader(tt.input), &reg)
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok=%v, got error %v", tt.ok, err)
+			} else if tt.ok && reg.Service != "web" {
+				t.Fatalf("expected service web, got %q", reg.Service)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	pwdHash := sha256.Sum256([]byte("password"))
+	var buf bytes.Buffer
+	if err := Authenticate(&buf, pwdHash, true); err != nil {
+		t.Fatal("error authenticating: ", err)
+	} else if !bytes.Equal(buf.Bytes(), pwdHash[:]) {
+		t.Fatalf("expected the legacy hash sent, got %x", buf.Bytes())
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	errCh := make(chan error, 1)
+	go func() { errCh <- Authenticate(c1, pwdHash, false) }()
+	req := make([]byte, len(ChallengeRequestV2))
+	if _, err := io.ReadFull(c2, req); err != nil {
+		t.Fatal("error reading challenge request: ", err)
+	}
+	// Zero params mean the proxy has no verifier
+	nonce := bytes.Repeat([]byte{7}, ChallengeSize)
+	go c2.Write(append(nonce, make([]byte, VerifierParamsSize)...))
+	resp := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(c2, resp); err != nil {
+		t.Fatal("error reading response: ", err)
+	} else if err := <-errCh; err != nil {
+		t.Fatal("error authenticating: ", err)
+	} else if !bytes.Equal(resp, ChallengeResponse(pwdHash, nonce)) {
+		t.Fatalf("expected the challenge response, got %x", resp)
+	}
+
+	// A proxy that only supports legacy auth closes the conn
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	go func() {
+		io.ReadFull(c2, make([]byte, len(ChallengeRequestV2)))
+		c2.Close()
+	}()
+	if err := Authenticate(c1, pwdHash, false); err == nil {
+		t.Fatal("expected an error without a challenge")
+	}
+}
+
+func TestAuthenticateWithVerifier(t *testing.T) {
+	pwdHash := sha256.Sum256([]byte("password"))
+	_, storedKey := VerifierKeys(pwdHash, testParams)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	errCh := make(chan error, 1)
+	go func() { errCh <- Authenticate(c1, pwdHash, false) }()
+
+	req := make([]byte, len(ChallengeRequestV2))
+	if _, err := c2.Read(req); err != nil || string(req) != ChallengeRequestV2 {
+		t.Fatalf("expected challenge request, got %q (err: %v)", req, err)
+	}
+	nonce := bytes.Repeat([]byte{7}, ChallengeSize)
+	go c2.Write(testParams.Append(append([]byte(nil), nonce...)))
+	proof := make([]byte, sha256.Size)
+	if _, err := c2.Read(proof); err != nil {
+		t.Fatal("error reading proof: ", err)
+	} else if err := <-errCh; err != nil {
+		t.Fatal("error authenticating: ", err)
+	}
+	if !ProofVerifies(storedKey, nonce, proof) {
+		t.Fatal("proof didn't verify")
+	}
+}
+
+func TestRegisterVerifiesIdentity(t *testing.T) {
+	pwdHash := sha256.Sum256([]byte("password"))
+	pubKey, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		name string
+		// sign returns the proxy's signature of the signed data.
+		sign func(signed []byte) []byte
+		ok   bool
+	}{
+		{
+			name: "pinned key",
+			sign: func(signed []byte) []byte { return ed25519.Sign(privKey, signed) },
+			ok:   true,
+		},
+		{
+			name: "other key",
+			sign: func(signed []byte) []byte { return ed25519.Sign(otherKey, signed) },
+		},
+		{
+			// E.g., a relayed proof from a handshake with another registration
+			name: "other registration",
+			sign: func(signed []byte) []byte {
+				signed[len(signed)-1] ^= 1
+				return ed25519.Sign(privKey, signed)
+			},
+		},
+		{name: "no identity key", sign: func([]byte) []byte { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			// The proxy's answer is the credential it received, if any
+			credCh := make(chan []byte, 1)
+			go func() {
+				defer c2.Close()
+				req := make([]byte, len(IdentityRequest))
+				if _, err := io.ReadFull(c2, req); err != nil ||
+					string(req) != IdentityRequest {
+					credCh <- nil
+					return
+				}
+				regMsg, err := ReadMsgBytes(c2)
+				var reg Registration
+				if err != nil || json.Unmarshal(regMsg, &reg) != nil {
+					credCh <- nil
+					return
+				}
+				challenge := make([]byte, ChallengeSize+VerifierParamsSize)
+				rand.Read(challenge[:ChallengeSize])
+				c2.Write(challenge)
+				sig := tt.sign(IdentitySigned(reg.Nonce, challenge, regMsg))
+				WriteMsg(c2, IdentityProof{Signature: sig})
+				cred := make([]byte, sha256.Size)
+				if _, err := io.ReadFull(c2, cred); err != nil {
+					credCh <- nil
+					return
+				}
+				credCh <- cred
+				c2.Write([]byte{StatusOK})
+			}()
+			status, err := Register(
+				c1, pwdHash, false, Registration{Service: "web"}, pubKey,
+			)
+			c1.Close()
+			cred := <-credCh
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected error registering")
+				} else if cred != nil {
+					t.Fatal("credential sent before the proxy's identity was verified")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("error registering: ", err)
+			} else if status != StatusOK {
+				t.Fatalf("expected status OK, got %d", status)
+			} else if cred == nil {
+				t.Fatal("no credential sent")
+			}
+		})
+	}
+}
+
+func TestRegisterRejectsLegacyWithPinnedKey(t *testing.T) {
+	pubKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	var buf bytes.Buffer
+	_, err := Register(&buf, [sha256.Size]byte{}, true, Registration{}, pubKey)
+	if err == nil {
+		t.Fatal("expected error registering with legacy auth")
+	} else if buf.Len() != 0 {
+		t.Fatalf("expected nothing written, got %q", buf.Bytes())
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	seen := make(map[string]byte)
+	for _, status := range []byte{
+		StatusPasswordInvalid, StatusOK, StatusServiceUnknown,
+		StatusLimitExceeded, StatusTunnelExpired, StatusServiceReserved,
+		StatusBadVersion, StatusDraining, StatusEgressRequired,
+		StatusHostsRequired,
+	} {
+		text := StatusText(status)
+		if strings.HasPrefix(text, "unknown status") {
+			t.Fatalf("expected status %d to be documented", status)
+		} else if other, ok := seen[text]; ok {
+			t.Fatalf("statuses %d and %d have the same text %q", other, status, text)
+		}
+		seen[text] = status
+	}
+	if got := StatusText(255); got != "unknown status from proxy: 255" {
+		t.Fatalf("expected an unknown status, got %q", got)
+	}
+}
+
+func TestWritePreamble(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePreamble(&buf, "web"); err != nil {
+		t.Fatal("error writing preamble: ", err)
+	} else if got := buf.String(); got != "\x03web" {
+		t.Fatalf("expected the length-prefixed name, got %q", got)
+	}
+	buf.Reset()
+	if err := WritePreamble(&buf, strings.Repeat("x", 256)); err == nil {
+		t.Fatal("expected an error for a name over 255 bytes")
+	} else if buf.Len() != 0 {
+		t.Fatalf("expected nothing written, got %q", buf.Bytes())
+	}
+}
@@ -0,0 +1,42 @@
+package tunnelittest
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// StartBackend starts a fake backend server on a random loopback port,
+// serving each conn with the handler, and returns its address. The handler is
+// responsible for closing the conn. The backend is closed when the test
+// finishes.
+func StartBackend(t testing.TB, handler func(net.Conn)) string {
+	t.Helper()
+	ln, err := listen()
+	if err != nil {
+		t.Fatal("error starting backend: ", err)
+	}
+	serve(t, ln, handler)
+	return ln.Addr().String()
+}
+
+// StartEchoBackend starts a fake backend that echoes what it receives.
+func StartEchoBackend(t testing.TB) string {
+	t.Helper()
+	return StartBackend(t, Echo)
+}
+
+// Echo is a backend handler that echoes what it receives.
+func Echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+// Reply returns a backend handler that writes the response to each conn and
+// then closes it.
+func Reply(resp []byte) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		conn.Write(resp)
+	}
+}
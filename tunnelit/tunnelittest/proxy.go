@@ -0,0 +1,442 @@
+// Package tunnelittest provides an in-process tunnelit proxy, tunnels, and
+// fake backends for testing code that embeds tunnelit, without spawning the
+// tunnelit binary. Everything listens on random loopback ports and is cleaned
+// up when the test finishes.
+package tunnelittest
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+)
+
+const (
+	// DefaultPassword is the proxy's password when none is given.
+	DefaultPassword = "tunnelittest"
+	// DefaultWaitTimeout is how long a client waits for a tunnel conn when no
+	// timeout is given.
+	DefaultWaitTimeout = 5 * time.Second
+	// readyTimeout is how long a tunnel conn has to answer ConnReady.
+	readyTimeout = 5 * time.Second
+)
+
+// ProxyConfig configures a Proxy.
+type ProxyConfig struct {
+	// Password is the password tunnels and dialers must give (blank means
+	// DefaultPassword).
+	Password string
+	// Services are the names of the services the proxy has, each of which
+	// gets a client listener (nil means just the default service).
+	Services []string
+	// IdentityKey, if set, is used to prove the proxy's identity to tunnels
+	// and dialers that pin its public key.
+	IdentityKey ed25519.PrivateKey
+	// WaitTimeout is how long a client waits for one of the service's tunnel
+	// conns before being closed (0 means DefaultWaitTimeout).
+	WaitTimeout time.Duration
+	// Faults are the faults injected from the start (see Proxy.SetFaults).
+	Faults Faults
+}
+
+// Faults are faults injected by a Proxy, to test how code copes with a
+// misbehaving proxy or network.
+type Faults struct {
+	// RejectStatus, if set, is the status registrations (from tunnels and
+	// dialers) are rejected with.
+	RejectStatus byte
+	// Latency is added before each chunk of data is piped, in both
+	// directions.
+	Latency time.Duration
+	// DropAfter, if positive, is the number of bytes piped (in either
+	// direction) after which each pipe is abruptly closed.
+	DropAfter int64
+}
+
+// Proxy is an in-process tunnelit proxy speaking the tunnel protocol. It's a
+// stand-in for the real proxy, supporting registrations, dialers, and
+// clients of its services, but none of its policies, limits, or admin API.
+type Proxy struct {
+	// TunnelAddr is the address of the proxy's tunnel listener, which tunnels
+	// and dialers connect to.
+	TunnelAddr string
+	// Password is the proxy's password.
+	Password string
+
+	cfg      ProxyConfig
+	pwdHash  [sha256.Size]byte
+	faults   atomic.Pointer[Faults]
+	ln       net.Listener
+	services map[string]*service
+
+	// conns are all the open conns, closed when the proxy is.
+	mtx    sync.Mutex
+	conns  map[net.Conn]utils.Unit
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// service is one of the proxy's services.
+type service struct {
+	ln net.Listener
+	// idle receives the service's idle tunnel conns.
+	idle chan net.Conn
+}
+
+// StartProxy starts a proxy, which is closed when the test finishes. The test
+// fails if the proxy can't be started.
+func StartProxy(t testing.TB, cfg ProxyConfig) *Proxy {
+	t.Helper()
+	if cfg.Password == "" {
+		cfg.Password = DefaultPassword
+	}
+	if cfg.Services == nil {
+		cfg.Services = []string{""}
+	}
+	if cfg.WaitTimeout <= 0 {
+		cfg.WaitTimeout = DefaultWaitTimeout
+	}
+	p := &Proxy{
+		Password: cfg.Password,
+		cfg:      cfg,
+		pwdHash:  sha256.Sum256([]byte(cfg.Password)),
+		services: make(map[string]*service, len(cfg.Services)),
+		conns:    make(map[net.Conn]utils.Unit),
+	}
+	p.SetFaults(cfg.Faults)
+	t.Cleanup(p.Close)
+	var err error
+	if p.ln, err = listen(); err != nil {
+		t.Fatal("error starting proxy: ", err)
+	}
+	p.TunnelAddr = p.ln.Addr().String()
+	for _, name := range cfg.Services {
+		ln, err := listen()
+		if err != nil {
+			p.Close()
+			t.Fatalf("error starting proxy service %q: %v", name, err)
+		}
+		svc := &service{ln: ln, idle: make(chan net.Conn, 1024)}
+		p.services[name] = svc
+		p.goAccept(ln, func(c net.Conn) { p.handleClient(svc, c) })
+	}
+	p.goAccept(p.ln, p.handleTunnel)
+	return p
+}
+
+// ClientAddr returns the address of the named service's client listener,
+// failing the test if the proxy doesn't have the service.
+func (p *Proxy) ClientAddr(t testing.TB, service string) string {
+	t.Helper()
+	svc := p.services[service]
+	if svc == nil {
+		t.Fatalf("proxy has no service %q", service)
+	}
+	return svc.ln.Addr().String()
+}
+
+// Dialer returns a Dialer for the proxy's services.
+func (p *Proxy) Dialer() *tunnelit.Dialer {
+	var pubKey ed25519.PublicKey
+	if p.cfg.IdentityKey != nil {
+		pubKey = p.cfg.IdentityKey.Public().(ed25519.PublicKey)
+	}
+	return &tunnelit.Dialer{
+		ProxyAddr: p.TunnelAddr, Password: p.Password, ProxyPubKey: pubKey,
+	}
+}
+
+// SetFaults sets the faults injected into new registrations and pipes.
+func (p *Proxy) SetFaults(f Faults) {
+	p.faults.Store(&f)
+}
+
+// DropIdle closes the idle tunnel conns of all services, as a proxy restart
+// or network blip would. Tunnels are expected to replace them.
+func (p *Proxy) DropIdle() {
+	for _, svc := range p.services {
+		for {
+			select {
+			case conn := <-svc.idle:
+				p.closeConn(conn)
+				continue
+			default:
+			}
+			break
+		}
+	}
+}
+
+// Close closes the proxy's listeners and conns, waiting for its goroutines to
+// finish.
+func (p *Proxy) Close() {
+	p.mtx.Lock()
+	if p.closed {
+		p.mtx.Unlock()
+		return
+	}
+	p.closed = true
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	for _, svc := range p.services {
+		svc.ln.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mtx.Unlock()
+	p.wg.Wait()
+}
+
+// goAccept accepts conns from the listener until it's closed, handling each
+// in its own goroutine.
+func (p *Proxy) goAccept(ln net.Listener, handle func(net.Conn)) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			} else if !p.track(conn) {
+				conn.Close()
+				return
+			}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+// track records the conn so that it's closed with the proxy, returning false
+// if the proxy is already closed.
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = utils.Unit{}
+	return true
+}
+
+func (p *Proxy) closeConn(conn net.Conn) {
+	conn.Close()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.conns, conn)
+}
+
+// handleTunnel handles a conn to the tunnel listener, from a tunnel or
+// dialer.
+func (p *Proxy) handleTunnel(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(readyTimeout))
+	var cred [sha256.Size]byte
+	var reg tunnelit.Registration
+	if _, err := io.ReadFull(conn, cred[:]); err != nil {
+		p.closeConn(conn)
+		return
+	}
+	var authed bool
+	var regMsg []byte
+	if req := string(cred[:]); req == tunnelit.ChallengeRequest ||
+		req == tunnelit.ChallengeRequestV2 || req == tunnelit.IdentityRequest {
+		if req == tunnelit.IdentityRequest {
+			var err error
+			if regMsg, err = tunnelit.ReadMsgBytes(conn); err != nil {
+				p.closeConn(conn)
+				return
+			} else if err := json.Unmarshal(regMsg, &reg); err != nil {
+				p.closeConn(conn)
+				return
+			}
+		}
+		nonce := make([]byte, tunnelit.ChallengeSize)
+		challenge := nonce
+		if req != tunnelit.ChallengeRequest {
+			// The proxy has no password verifier, so the params are zeros
+			challenge = make(
+				[]byte, tunnelit.ChallengeSize+tunnelit.VerifierParamsSize,
+			)
+			nonce = challenge[:tunnelit.ChallengeSize]
+		}
+		if _, err := rand.Read(nonce); err != nil {
+			p.closeConn(conn)
+			return
+		} else if _, err := conn.Write(challenge); err != nil {
+			p.closeConn(conn)
+			return
+		}
+		if regMsg != nil {
+			var proof tunnelit.IdentityProof
+			if p.cfg.IdentityKey != nil {
+				proof.Signature = ed25519.Sign(
+					p.cfg.IdentityKey,
+					tunnelit.IdentitySigned(reg.Nonce, challenge, regMsg),
+				)
+			}
+			if err := tunnelit.WriteMsg(conn, proof); err != nil {
+				p.closeConn(conn)
+				return
+			}
+		}
+		if _, err := io.ReadFull(conn, cred[:]); err != nil {
+			p.closeConn(conn)
+			return
+		}
+		authed = hmac.Equal(cred[:], tunnelit.ChallengeResponse(p.pwdHash, nonce))
+	} else {
+		if string(cred[:]) == tunnelit.HashRequest {
+			if _, err := io.ReadFull(conn, cred[:]); err != nil {
+				p.closeConn(conn)
+				return
+			}
+		}
+		authed = subtle.ConstantTimeCompare(cred[:], p.pwdHash[:]) == 1
+	}
+	if regMsg == nil {
+		if err := tunnelit.ReadMsg(conn, &reg); err != nil {
+			p.closeConn(conn)
+			return
+		}
+	}
+	svc := p.services[reg.Service]
+	status := tunnelit.StatusOK
+	if f := p.faults.Load(); f.RejectStatus != 0 {
+		status = f.RejectStatus
+	} else if !authed {
+		status = tunnelit.StatusPasswordInvalid
+	} else if reg.Version > tunnelit.ProtocolVersion {
+		status = tunnelit.StatusBadVersion
+	} else if svc == nil && !reg.Ping {
+		status = tunnelit.StatusServiceUnknown
+	}
+	if _, err := conn.Write([]byte{status}); err != nil || status != tunnelit.StatusOK {
+		p.closeConn(conn)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch {
+	case reg.Ping:
+		// Echo heartbeats until the conn is closed
+		io.Copy(conn, conn)
+		p.closeConn(conn)
+	case reg.Dial:
+		p.handleClient(svc, conn)
+	default:
+		if reg.Endpoints {
+			eps := tunnelit.ServiceEndpoints{Addr: svc.ln.Addr().String()}
+			if err := tunnelit.WriteMsg(conn, eps); err != nil {
+				p.closeConn(conn)
+				return
+			}
+		}
+		select {
+		case svc.idle <- conn:
+		default:
+			p.closeConn(conn)
+		}
+	}
+}
+
+// handleClient pipes a client of the service to one of its idle tunnel
+// conns, closing the client if none becomes ready in time.
+func (p *Proxy) handleClient(svc *service, client net.Conn) {
+	timer := time.NewTimer(p.cfg.WaitTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case conn := <-svc.idle:
+			if !p.ready(conn) {
+				p.closeConn(conn)
+				continue
+			}
+			p.pipe(client, conn)
+			return
+		case <-timer.C:
+			p.closeConn(client)
+			return
+		}
+	}
+}
+
+// ready tells the tunnel conn it's being used for a client, returning whether
+// the tunnel acknowledged it.
+func (p *Proxy) ready(conn net.Conn) bool {
+	conn.SetDeadline(time.Now().Add(readyTimeout))
+	defer conn.SetDeadline(time.Time{})
+	b := []byte{tunnelit.ConnReady}
+	if _, err := conn.Write(b); err != nil {
+		return false
+	} else if _, err := io.ReadFull(conn, b); err != nil {
+		return false
+	}
+	return b[0] == tunnelit.ConnReady
+}
+
+// pipe pipes the client and tunnel conns until either is done, injecting the
+// current faults.
+func (p *Proxy) pipe(client, tunnel net.Conn) {
+	f := *p.faults.Load()
+	var budget *atomic.Int64
+	if f.DropAfter > 0 {
+		budget = &atomic.Int64{}
+		budget.Store(f.DropAfter)
+	}
+	done := make(chan utils.Unit, 2)
+	copyConn := func(dst, src net.Conn) {
+		io.Copy(faultWriter{w: dst, latency: f.Latency, budget: budget}, src)
+		done <- utils.Unit{}
+	}
+	go copyConn(client, tunnel)
+	go copyConn(tunnel, client)
+	<-done
+	p.closeConn(client)
+	p.closeConn(tunnel)
+	<-done
+}
+
+// faultWriter is a writer that injects latency and drops the pipe once the
+// byte budget (shared by both directions) is used up.
+type faultWriter struct {
+	w       io.Writer
+	latency time.Duration
+	budget  *atomic.Int64
+}
+
+func (fw faultWriter) Write(b []byte) (int, error) {
+	if fw.latency > 0 {
+		time.Sleep(fw.latency)
+	}
+	if fw.budget == nil {
+		return fw.w.Write(b)
+	}
+	left := fw.budget.Add(-int64(len(b))) + int64(len(b))
+	if left <= 0 {
+		return 0, io.ErrClosedPipe
+	} else if left < int64(len(b)) {
+		n, _ := fw.w.Write(b[:left])
+		return n, io.ErrClosedPipe
+	}
+	return fw.w.Write(b)
+}
+
+func listen() (net.Listener, error) {
+	return net.Listen("tcp", "127.0.0.1:0")
+}
@@ -0,0 +1,111 @@
+package tunnelittest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+)
+
+// startTimeout bounds starting a tunnel.
+const startTimeout = 5 * time.Second
+
+// StartTunnel registers a tunnel for the proxy's service with cfg (whose
+// ProxyAddr and Password are filled in from the proxy), forwarding each client
+// to the backend at backendAddr. The tunnel is closed when the test finishes,
+// and the test fails if it can't be started.
+func StartTunnel(
+	t testing.TB, p *Proxy, backendAddr string, cfg tunnelit.ListenConfig,
+) *tunnelit.Listener {
+	t.Helper()
+	return StartTunnelFunc(t, p, cfg, func(conn net.Conn) {
+		backend, err := net.Dial("tcp", backendAddr)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		Pipe(conn, backend)
+	})
+}
+
+// StartTunnelFunc is like StartTunnel but serves each client with the handler
+// rather than forwarding it to a backend. The handler is responsible for
+// closing the conn.
+func StartTunnelFunc(
+	t testing.TB, p *Proxy, cfg tunnelit.ListenConfig, handler func(net.Conn),
+) *tunnelit.Listener {
+	t.Helper()
+	cfg.ProxyAddr, cfg.Password = p.TunnelAddr, p.Password
+	if cfg.ProxyPubKey == nil && p.cfg.IdentityKey != nil {
+		cfg.ProxyPubKey = p.cfg.IdentityKey.Public().(ed25519.PublicKey)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	l, err := tunnelit.Listen(ctx, cfg)
+	if err != nil {
+		t.Fatalf("error starting tunnel for service %q: %v", cfg.Service, err)
+	}
+	serve(t, l, handler)
+	return l
+}
+
+// Pipe pipes the conns to each other until either is done, then closes both.
+func Pipe(conn1, conn2 net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn1, conn2)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn2, conn1)
+		done <- struct{}{}
+	}()
+	<-done
+	conn1.Close()
+	conn2.Close()
+	<-done
+}
+
+// serve accepts conns from the listener, handling each in its own goroutine,
+// until the test finishes. The listener is closed then and the handlers are
+// waited for.
+func serve(t testing.TB, ln net.Listener, handler func(net.Conn)) {
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mtx.Lock()
+			conns[conn] = struct{}{}
+			mtx.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handler(conn)
+				mtx.Lock()
+				delete(conns, conn)
+				mtx.Unlock()
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		mtx.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mtx.Unlock()
+		wg.Wait()
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnietre/utils/go"
+)
+
+// UDP services are tunneled by giving each client (peer address) a session
+// with its own tunnel conn. The datagrams are sent over the conn framed by a
+// 2-byte (big endian) length, and the tunnel relays them to the server from
+// its own UDP socket for the session.
+
+// maxDatagramSize is the largest datagram relayed.
+const maxDatagramSize = 65535
+
+var (
+	// flagUDPAddr is the address the default service's UDP clients are
+	// listened for on (overriding the config).
+	flagUDPAddr string
+	// udpTimeout is how long a UDP session lasts without datagrams in either
+	// direction.
+	udpTimeout = 2 * time.Minute
+	// tunnelUDP is whether the default service's servers (saddr) are UDP.
+	tunnelUDP bool
+)
+
+// udpNetwork is the UDP network matching tcpNetwork.
+func udpNetwork() string {
+	return strings.Replace(tcpNetwork, "tcp", "udp", 1)
+}
+
+// udpListener is a listener whose conns are the sessions of the peers sending
+// it datagrams, framed as they're sent over tunnel conns.
+type udpListener struct {
+	pc     *net.UDPConn
+	accept chan net.Conn
+	// closed is closed once the listener is closed.
+	closed    chan utils.Unit
+	closeOnce sync.Once
+
+	mtx      sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func listenUDP(addr string) (*udpListener, error) {
+	udpAddr, err := net.ResolveUDPAddr(udpNetwork(), addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(udpNetwork(), udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		pc:       pc,
+		accept:   make(chan net.Conn, 64),
+		closed:   make(chan utils.Unit),
+		sessions: make(map[string]*udpSession),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// serve reads datagrams until the listener is closed, handing each to its
+// peer's session. Datagrams are dropped (as they may be anyway) if the session
+// is behind or new sessions aren't being accepted fast enough.
+func (l *udpListener) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, peer, err := l.pc.ReadFromUDP(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		key := peer.String()
+		l.mtx.Lock()
+		s, ok := l.sessions[key]
+		if !ok {
+			s = newUDPSession(l, peer)
+			select {
+			case l.accept <- &framedConn{Conn: s}:
+				l.sessions[key] = s
+			default:
+				l.mtx.Unlock()
+				continue
+			}
+		}
+		l.mtx.Unlock()
+		select {
+		case s.in <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener and its sessions.
+func (l *udpListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		err = l.pc.Close()
+		close(l.closed)
+		l.mtx.Lock()
+		sessions := l.sessions
+		l.sessions = make(map[string]*udpSession)
+		l.mtx.Unlock()
+		for _, s := range sessions {
+			s.Close()
+		}
+	})
+	return err
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// udpSession is a conn with a peer of a udpListener. Each read and write is a
+// single datagram. Deadlines aren't supported; the session closes itself once
+// it's idle for udpTimeout.
+type udpSession struct {
+	l    *udpListener
+	peer *net.UDPAddr
+	in   chan []byte
+	idle *time.Timer
+	// closed is closed once the session is closed.
+	closed    chan utils.Unit
+	closeOnce sync.Once
+}
+
+func newUDPSession(l *udpListener, peer *net.UDPAddr) *udpSession {
+	s := &udpSession{
+		l: l, peer: peer, in: make(chan []byte, 64), closed: make(chan utils.Unit),
+	}
+	s.idle = time.AfterFunc(udpTimeout, func() { s.Close() })
+	return s
+}
+
+func (s *udpSession) Read(p []byte) (int, error) {
+	select {
+	case b := <-s.in:
+		s.idle.Reset(udpTimeout)
+		return copy(p, b), nil
+	case <-s.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (s *udpSession) Write(p []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	s.idle.Reset(udpTimeout)
+	return s.l.pc.WriteToUDP(p, s.peer)
+}
+
+// Close ends the session. Datagrams from the peer afterwards start a new one.
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.idle.Stop()
+		close(s.closed)
+		s.l.mtx.Lock()
+		if s.l.sessions[s.peer.String()] == s {
+			delete(s.l.sessions, s.peer.String())
+		}
+		s.l.mtx.Unlock()
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.l.pc.LocalAddr()
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.peer
+}
+
+func (s *udpSession) SetDeadline(time.Time) error      { return nil }
+func (s *udpSession) SetReadDeadline(time.Time) error  { return nil }
+func (s *udpSession) SetWriteDeadline(time.Time) error { return nil }
+
+// framedConn turns a conn whose reads and writes are datagrams into a stream
+// of the framed datagrams, as they're sent over tunnel conns.
+type framedConn struct {
+	net.Conn
+	// rbuf holds the rest of the last datagram read, framed.
+	rbuf []byte
+	// wbuf holds what's been written of the next datagram to send.
+	wbuf []byte
+}
+
+func (c *framedConn) Read(p []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		buf := make([]byte, 2+maxDatagramSize)
+		n, err := c.Conn.Read(buf[2:])
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		c.rbuf = buf[:2+n]
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *framedConn) Write(p []byte) (int, error) {
+	c.wbuf = append(c.wbuf, p...)
+	for len(c.wbuf) >= 2 {
+		size := int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < 2+size {
+			break
+		}
+		if _, err := c.Conn.Write(c.wbuf[2 : 2+size]); err != nil {
+			return 0, err
+		}
+		c.wbuf = c.wbuf[2+size:]
+	}
+	return len(p), nil
+}
+
+// NetConn returns the underlying conn.
+func (c *framedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// listenUDPClients accepts the sessions of the service's UDP clients until the
+// listener is closed.
+func listenUDPClients(svc *service, ln *udpListener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if !clientAllowed(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go svc.acceptClient(conn)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readDatagram reads a framed datagram from the conn.
+func readDatagram(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		t.Fatal("error reading datagram size: ", err)
+	}
+	b := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal("error reading datagram: ", err)
+	}
+	return string(b)
+}
+
+// dialUDP dials the address, returning the client's conn.
+func dialUDP(t *testing.T, addr net.Addr) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal("error dialing: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// acceptUDP accepts the next session from the listener.
+func acceptUDP(t *testing.T, ln *udpListener) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	select {
+	case conn := <-accepted:
+		if conn == nil {
+			t.Fatal("expected a session")
+		}
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out accepting a session")
+	}
+	return nil
+}
+
+func TestUDPListener(t *testing.T) {
+	ln, err := listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+
+	client := dialUDP(t, ln.Addr())
+	client.Write([]byte("ping"))
+	client.Write([]byte("ping again"))
+	sess := acceptUDP(t, ln)
+	if sess.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatalf(
+			"expected the session of %s, got %s",
+			client.LocalAddr(), sess.RemoteAddr(),
+		)
+	}
+	// Datagrams from the same peer go to its session, framed
+	for _, want := range []string{"ping", "ping again"} {
+		if got := readDatagram(t, sess); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	// A frame written in pieces is sent as one datagram
+	if _, err := sess.Write([]byte{0, 4, 'p'}); err != nil {
+		t.Fatal("error writing: ", err)
+	} else if _, err := sess.Write([]byte("ong")); err != nil {
+		t.Fatal("error writing: ", err)
+	}
+	b := make([]byte, maxDatagramSize)
+	if n, err := client.Read(b); err != nil || string(b[:n]) != "pong" {
+		t.Fatalf("expected pong, got %q (err: %v)", b[:n], err)
+	}
+
+	// Each peer gets its own session
+	other := dialUDP(t, ln.Addr())
+	other.Write([]byte("hello"))
+	otherSess := acceptUDP(t, ln)
+	if got := readDatagram(t, otherSess); got != "hello" {
+		t.Fatalf("expected hello, got %q", got)
+	}
+
+	// Datagrams after a session is closed start a new one
+	sess.Close()
+	if _, err := sess.Read(b); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected reading a closed session to fail, got ", err)
+	}
+	client.Write([]byte("back"))
+	if got := readDatagram(t, acceptUDP(t, ln)); got != "back" {
+		t.Fatalf("expected back, got %q", got)
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected accepting from a closed listener to fail, got ", err)
+	} else if _, err := otherSess.Read(b); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected the sessions closed with the listener, got ", err)
+	}
+}
+
+func TestUDPSessionIdle(t *testing.T) {
+	oldTimeout := udpTimeout
+	udpTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { udpTimeout = oldTimeout })
+	ln, err := listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+
+	dialUDP(t, ln.Addr()).Write([]byte("ping"))
+	sess := acceptUDP(t, ln)
+	readDatagram(t, sess)
+	waitFor(t, "the idle session to close", func() bool {
+		ln.mtx.Lock()
+		defer ln.mtx.Unlock()
+		return len(ln.sessions) == 0
+	})
+	if _, err := sess.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected the idle session closed, got ", err)
+	}
+}
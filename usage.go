@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// usageDateFormat is the format of the days usage is recorded for (UTC).
+	usageDateFormat = "2006-01-02"
+	// usageSaveInterval is how often recorded usage is saved to the state file.
+	usageSaveInterval = time.Minute
+)
+
+// Usage is the usage of a service for a day.
+type Usage struct {
+	Conns     uint64 `json:"conns"`
+	BytesUp   uint64 `json:"bytes_up"`
+	BytesDown uint64 `json:"bytes_down"`
+	// PeakActiveConns is the most connections active at once.
+	PeakActiveConns int64 `json:"peak_active_conns"`
+}
+
+// RecordUsage records a finished connection of the service for the current
+// day. The usage is saved periodically by saveUsageLoop.
+func (s *State) RecordUsage(service string, up, down int64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u := s.todaysUsage(service)
+	u.Conns++
+	u.BytesUp += uint64(up)
+	u.BytesDown += uint64(down)
+	s.usageDirty = true
+}
+
+// RecordActive records the number of active connections of the service,
+// updating the current day's peak.
+func (s *State) RecordActive(service string, active int64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if u := s.todaysUsage(service); active > u.PeakActiveConns {
+		u.PeakActiveConns = active
+		s.usageDirty = true
+	}
+}
+
+// todaysUsage returns the service's usage for the current day. The mutex must
+// be held.
+func (s *State) todaysUsage(service string) *Usage {
+	day := time.Now().UTC().Format(usageDateFormat)
+	days := s.Usage[service]
+	if days == nil {
+		days = make(map[string]*Usage)
+		s.Usage[service] = days
+	}
+	u := days[day]
+	if u == nil {
+		u = &Usage{}
+		days[day] = u
+	}
+	return u
+}
+
+// saveUsageLoop periodically saves the state if there's new usage.
+func (s *State) saveUsageLoop() {
+	for range time.Tick(usageSaveInterval) {
+		s.mtx.Lock()
+		if s.usageDirty {
+			if err := s.save(); err != nil {
+				log.Print("Error saving usage: ", err)
+			} else {
+				s.usageDirty = false
+			}
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// usageRow is a row of a usage export.
+type usageRow struct {
+	Service string `json:"service"`
+	Date    string `json:"date"`
+	Usage
+}
+
+// usageRows returns the usage on or after the since day, sorted by service
+// and date.
+func (s *State) usageRows(since string) []usageRow {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var rows []usageRow
+	for service, days := range s.Usage {
+		for day, u := range days {
+			if day >= since {
+				rows = append(rows, usageRow{Service: service, Date: day, Usage: *u})
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Service != rows[j].Service {
+			return rows[i].Service < rows[j].Service
+		}
+		return rows[i].Date < rows[j].Date
+	})
+	return rows
+}
+
+// parseDays parses a duration that may also be given in days (e.g., "30d").
+// A blank string is a zero duration.
+func parseDays(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	} else if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func RunUsageExport(cmd *cobra.Command, args []string) {
+	path := must(cmd.Flags().GetString("state-file"))
+	format := must(cmd.Flags().GetString("format"))
+	since, err := parseDays(must(cmd.Flags().GetString("since")))
+	if err != nil {
+		log.Fatal("Error parsing since: ", err)
+	}
+	if path == "" {
+		log.Fatal(`Must provide "state-file"`)
+	}
+	s, err := LoadState(path)
+	if err != nil {
+		log.Fatal("Error loading state: ", err)
+	}
+	sinceDay := ""
+	if since > 0 {
+		sinceDay = time.Now().UTC().Add(-since).Format(usageDateFormat)
+	}
+	rows := s.usageRows(sinceDay)
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if rows == nil {
+			rows = []usageRow{}
+		}
+		err = enc.Encode(rows)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{
+			"service", "date", "conns", "bytes_up", "bytes_down",
+			"peak_active_conns",
+		})
+		for _, row := range rows {
+			w.Write([]string{
+				row.Service, row.Date,
+				strconv.FormatUint(row.Conns, 10),
+				strconv.FormatUint(row.BytesUp, 10),
+				strconv.FormatUint(row.BytesDown, 10),
+				strconv.FormatInt(row.PeakActiveConns, 10),
+			})
+		}
+		w.Flush()
+		err = w.Error()
+	default:
+		log.Fatalf("Unknown format %q (must be csv or json)", format)
+	}
+	if err != nil {
+		log.Fatal("Error writing usage: ", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRecordUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := newState(path)
+	s.RecordActive("web", 2)
+	s.RecordUsage("web", 100, 1000)
+	s.RecordActive("web", 1)
+	s.RecordUsage("web", 50, 500)
+	s.RecordUsage("db", 1, 2)
+	if !s.usageDirty {
+		t.Fatal("expected recorded usage to be unsaved")
+	}
+
+	today := time.Now().UTC().Format(usageDateFormat)
+	want := Usage{Conns: 2, BytesUp: 150, BytesDown: 1500, PeakActiveConns: 2}
+	if got := *s.Usage["web"][today]; got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	s.mtx.Lock()
+	err := s.save()
+	s.mtx.Unlock()
+	if err != nil {
+		t.Fatal("error saving state: ", err)
+	}
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatal("error loading state: ", err)
+	}
+	if got := *loaded.Usage["web"][today]; got != want {
+		t.Fatalf("expected %+v saved, got %+v", want, got)
+	}
+}
+
+func TestStateUsageRows(t *testing.T) {
+	s := newState("")
+	s.Usage = map[string]map[string]*Usage{
+		"web": {
+			"2026-10-01": {Conns: 1},
+			"2026-09-30": {Conns: 2},
+			"2026-10-02": {Conns: 3},
+		},
+		"db": {"2026-10-01": {Conns: 4}},
+	}
+	rows := s.usageRows("2026-10-01")
+	want := []struct{ service, date string }{
+		{"db", "2026-10-01"}, {"web", "2026-10-01"}, {"web", "2026-10-02"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d rows, got %+v", len(want), rows)
+	}
+	for i, w := range want {
+		if rows[i].Service != w.service || rows[i].Date != w.date {
+			t.Fatalf(
+				"row %d: expected %s on %s, got %+v", i, w.service, w.date, rows[i],
+			)
+		}
+	}
+	if rows := s.usageRows(""); len(rows) != 4 {
+		t.Fatalf("expected all 4 rows, got %d", len(rows))
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{s: "", want: 0, ok: true},
+		{s: "30d", want: 30 * 24 * time.Hour, ok: true},
+		{s: "12h", want: 12 * time.Hour, ok: true},
+		{s: "xd"},
+		{s: "soon"},
+	}
+	for _, tt := range tests {
+		got, err := parseDays(tt.s)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%q: expected ok %v, got error %v", tt.s, tt.ok, err)
+		} else if got != tt.want {
+			t.Fatalf("%q: expected %s, got %s", tt.s, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultAddrEnvName     = "VAULT_ADDR"
+	vaultTokenEnvName    = "VAULT_TOKEN"
+	vaultRoleIDEnvName   = "VAULT_ROLE_ID"
+	vaultSecretIDEnvName = "VAULT_SECRET_ID"
+)
+
+var (
+	vaultAddr    string
+	vaultPath    string
+	vaultField   string
+	vaultRefresh time.Duration
+
+	// vaultTLSPath is the path of the Vault secret holding the proxy's TLS
+	// cert and key (blank means they're read from files).
+	vaultTLSPath string
+	// vaultTLSCertField and vaultTLSKeyField are the fields of the secret
+	// holding the PEM-encoded cert (chain) and key.
+	vaultTLSCertField, vaultTLSKeyField string
+
+	// sharedVault is the client shared by everything read from Vault (nil
+	// until first needed).
+	sharedVault struct {
+		sync.Mutex
+		vc *vaultClient
+	}
+)
+
+// vaultClient fetches secrets from Vault using its HTTP API, authenticating
+// with either a token or AppRole credentials.
+type vaultClient struct {
+	addr               string
+	roleID, secretID   string
+	client             *http.Client
+	mtx                sync.Mutex
+	token              string
+	tokenExpires       time.Time
+	renewable, fromEnv bool
+}
+
+func newVaultClient(addr string) (*vaultClient, error) {
+	vc := &vaultClient{
+		addr:     strings.TrimSuffix(addr, "/"),
+		token:    os.Getenv(vaultTokenEnvName),
+		roleID:   os.Getenv(vaultRoleIDEnvName),
+		secretID: os.Getenv(vaultSecretIDEnvName),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	vc.fromEnv = vc.token != ""
+	if !vc.fromEnv && (vc.roleID == "" || vc.secretID == "") {
+		return nil, fmt.Errorf(
+			"must set %s or both %s and %s",
+			vaultTokenEnvName, vaultRoleIDEnvName, vaultSecretIDEnvName,
+		)
+	}
+	return vc, nil
+}
+
+// vaultResp is the subset of a Vault API response that's used.
+type vaultResp struct {
+	Data map[string]any `json:"data"`
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func (vc *vaultClient) do(
+	method, path, token string, body any,
+) (*vaultResp, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, vc.addr+"/v1/"+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := vc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	vr := &vaultResp{}
+	if err := json.NewDecoder(resp.Body).Decode(vr); err != nil {
+		return nil, fmt.Errorf("error decoding response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"received status %s: %s", resp.Status, strings.Join(vr.Errors, "; "),
+		)
+	}
+	return vr, nil
+}
+
+// ensureToken logs in (using AppRole) or renews the token if it's close to
+// expiring. The mutex must be held.
+func (vc *vaultClient) ensureToken() error {
+	if vc.token != "" &&
+		(vc.tokenExpires.IsZero() || time.Until(vc.tokenExpires) > vaultRefresh) {
+		return nil
+	}
+	if vc.token != "" && vc.renewable {
+		vr, err := vc.do(http.MethodPost, "auth/token/renew-self", vc.token, nil)
+		if err == nil && vr.Auth != nil {
+			vc.setAuth(vr)
+			return nil
+		} else if vc.fromEnv {
+			return fmt.Errorf("error renewing token: %w", err)
+		}
+		log.Print("Error renewing Vault token, logging in again: ", err)
+	}
+	vr, err := vc.do(http.MethodPost, "auth/approle/login", "", map[string]string{
+		"role_id":   vc.roleID,
+		"secret_id": vc.secretID,
+	})
+	if err != nil {
+		return fmt.Errorf("error logging in with AppRole: %w", err)
+	} else if vr.Auth == nil {
+		return fmt.Errorf("error logging in with AppRole: missing auth")
+	}
+	vc.setAuth(vr)
+	return nil
+}
+
+func (vc *vaultClient) setAuth(vr *vaultResp) {
+	vc.token, vc.renewable = vr.Auth.ClientToken, vr.Auth.Renewable
+	vc.tokenExpires = time.Time{}
+	if vr.Auth.LeaseDuration > 0 {
+		vc.tokenExpires = time.Now().Add(
+			time.Duration(vr.Auth.LeaseDuration) * time.Second,
+		)
+	}
+}
+
+// ReadField reads the given field of the secret at the given path. Both KV v1
+// and v2 secrets are supported.
+func (vc *vaultClient) ReadField(path, field string) (string, error) {
+	vals, err := vc.ReadFields(path, field)
+	if err != nil {
+		return "", err
+	}
+	return vals[0], nil
+}
+
+// ReadFields reads the given fields of the secret at the given path at once
+// (so they're from the same version of it).
+func (vc *vaultClient) ReadFields(path string, fields ...string) ([]string, error) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	if err := vc.ensureToken(); err != nil {
+		return nil, err
+	}
+	vr, err := vc.do(http.MethodGet, strings.TrimPrefix(path, "/"), vc.token, nil)
+	if err != nil {
+		return nil, err
+	}
+	data := vr.Data
+	// KV v2 nests the secret's data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	vals := make([]string, len(fields))
+	for i, field := range fields {
+		val, ok := data[field].(string)
+		if !ok {
+			return nil, fmt.Errorf("secret %s has no string field %q", path, field)
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+// getVaultClient returns the shared Vault client, creating it if needed.
+func getVaultClient() (*vaultClient, error) {
+	sharedVault.Lock()
+	defer sharedVault.Unlock()
+	if sharedVault.vc == nil {
+		vc, err := newVaultClient(vaultAddr)
+		if err != nil {
+			return nil, err
+		}
+		sharedVault.vc = vc
+	}
+	return sharedVault.vc, nil
+}
+
+// loadVaultPassword fetches the password from Vault and keeps refreshing it
+// (and renewing the Vault token) in the background.
+func loadVaultPassword() error {
+	vc, err := getVaultClient()
+	if err != nil {
+		return err
+	}
+	pwd, err := vc.ReadField(vaultPath, vaultField)
+	if err != nil {
+		return fmt.Errorf("error reading password from Vault: %w", err)
+	}
+	passwordHash.Store(sha256.Sum256([]byte(pwd)))
+	log.Print("Loaded password from Vault")
+
+	go func() {
+		for range time.Tick(vaultRefresh) {
+			pwd, err := vc.ReadField(vaultPath, vaultField)
+			if err != nil {
+				log.Print("Error refreshing password from Vault: ", err)
+				continue
+			}
+			hash := sha256.Sum256([]byte(pwd))
+			if old, _ := passwordHash.Swap(hash); old != hash {
+				log.Print("Password changed in Vault")
+			}
+		}
+	}()
+	return nil
+}
+
+// loadVaultCert fetches the proxy's TLS cert and key from Vault and keeps
+// refreshing them in the background (so reissued certs are picked up),
+// returning a func returning the current cert (with its OCSP response stapled
+// if ocspStapling is set).
+func loadVaultCert() (func() (*tls.Certificate, error), error) {
+	vc, err := getVaultClient()
+	if err != nil {
+		return nil, err
+	}
+	id := "vault:" + vaultTLSPath
+	fetch := func() (*tls.Certificate, error) {
+		vals, err := vc.ReadFields(vaultTLSPath, vaultTLSCertField, vaultTLSKeyField)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair([]byte(vals[0]), []byte(vals[1]))
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	}
+	cert, err := fetch()
+	if err != nil {
+		return nil, fmt.Errorf("error reading TLS cert from Vault: %w", err)
+	}
+	storeVaultCert(id, cert)
+	log.Print("Loaded TLS cert from Vault")
+
+	go func() {
+		for range time.Tick(vaultRefresh) {
+			cert, err := fetch()
+			if err != nil {
+				log.Print("Error refreshing TLS cert from Vault: ", err)
+				continue
+			}
+			if storeVaultCert(id, cert) {
+				log.Print("TLS cert changed in Vault")
+			}
+		}
+	}()
+	return func() (*tls.Certificate, error) {
+		loadedCerts.Lock()
+		defer loadedCerts.Unlock()
+		return loadedCerts.certs[id].current(), nil
+	}, nil
+}
+
+// storeVaultCert stores the cert read from Vault under the ID unless it's the
+// same as the stored one, returning whether it was stored.
+func storeVaultCert(id string, cert *tls.Certificate) bool {
+	loadedCerts.Lock()
+	defer loadedCerts.Unlock()
+	if lc := loadedCerts.certs[id]; lc != nil && sameChain(lc.cert, cert) {
+		return false
+	}
+	lc := &loadedCert{cert: cert}
+	loadedCerts.certs[id] = lc
+	if ocspStapling {
+		go lc.stapleOCSP(id)
+	}
+	return true
+}
+
+// sameChain returns whether the certs have the same chain.
+func sameChain(a, b *tls.Certificate) bool {
+	if len(a.Certificate) != len(b.Certificate) {
+		return false
+	}
+	for i := range a.Certificate {
+		if !bytes.Equal(a.Certificate[i], b.Certificate[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestVault returns the address of a fake Vault serving the KV v2 secret
+// at the path.
+func newTestVault(t *testing.T, path string, data map[string]string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+			return
+		} else if r.URL.Path != "/v1/"+path {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"errors": []string{}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": map[string]any{"data": data, "metadata": map[string]any{}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestLoadVaultCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "vault.example.com")
+	certPEM, _ := os.ReadFile(certFile)
+	keyPEM, _ := os.ReadFile(keyFile)
+
+	t.Setenv(vaultTokenEnvName, "token")
+	oldAddr, oldPath, oldRefresh := vaultAddr, vaultTLSPath, vaultRefresh
+	oldCertField, oldKeyField, oldStapling := vaultTLSCertField, vaultTLSKeyField, ocspStapling
+	t.Cleanup(func() {
+		vaultAddr, vaultTLSPath, vaultRefresh = oldAddr, oldPath, oldRefresh
+		vaultTLSCertField, vaultTLSKeyField, ocspStapling = oldCertField, oldKeyField, oldStapling
+		sharedVault.vc = nil
+	})
+	vaultAddr = newTestVault(t, "secret/data/tls", map[string]string{
+		"certificate": string(certPEM), "private_key": string(keyPEM),
+	})
+	vaultTLSPath, vaultTLSCertField, vaultTLSKeyField = "secret/data/tls", "certificate", "private_key"
+	// Long enough not to refresh during the test
+	vaultRefresh, ocspStapling, sharedVault.vc = time.Hour, false, nil
+
+	getCert, err := loadVaultCert()
+	if err != nil {
+		t.Fatal("error loading cert: ", err)
+	}
+	cert, err := getCert()
+	if err != nil {
+		t.Fatal("error getting cert: ", err)
+	}
+	want, _ := tls.X509KeyPair(certPEM, keyPEM)
+	if !sameChain(cert, &want) {
+		t.Fatal("expected the cert from Vault")
+	}
+
+	// Refreshes only replace the cert if it changed
+	if storeVaultCert("vault:"+vaultTLSPath, &want) {
+		t.Fatal("expected the unchanged cert to be kept")
+	}
+	certFile, keyFile = writeTestCert(t, t.TempDir(), "new.example.com")
+	renewed, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storeVaultCert("vault:"+vaultTLSPath, &renewed) {
+		t.Fatal("expected the renewed cert to be stored")
+	} else if cert, _ := getCert(); !sameChain(cert, &renewed) {
+		t.Fatal("expected the renewed cert after refreshing")
+	}
+
+	vaultTLSKeyField = "missing"
+	if _, err := loadVaultCert(); err == nil {
+		t.Fatal("expected error loading cert with a missing field")
+	}
+}
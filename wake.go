@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultWakeAddr is the address magic packets are sent to by default.
+	defaultWakeAddr = "255.255.255.255:9"
+	// defaultWakeWait is how long to wait for a woken server by default.
+	defaultWakeWait = 30 * time.Second
+	// wakeResendInterval is the minimum time between magic packets.
+	wakeResendInterval = 5 * time.Second
+	// wakeDialInterval is how often a woken server is redialed.
+	wakeDialInterval = time.Second
+)
+
+// waker wakes a sleeping server using Wake-on-LAN.
+type waker struct {
+	mac  net.HardwareAddr
+	addr string
+	wait time.Duration
+	// lastSent is the unix nano time the last magic packet was sent.
+	lastSent atomic.Int64
+}
+
+// parseWake parses the service's Wake-on-LAN settings, if any.
+func (sc *TunnelServiceConfig) parseWake() error {
+	if sc.WakeMAC == "" {
+		return nil
+	}
+	mac, err := net.ParseMAC(sc.WakeMAC)
+	if err != nil {
+		return fmt.Errorf("invalid wake-mac: %w", err)
+	}
+	w := &waker{mac: mac, addr: sc.WakeAddr, wait: defaultWakeWait}
+	if w.addr == "" {
+		w.addr = defaultWakeAddr
+	}
+	if sc.WakeWait != "" {
+		if w.wait, err = time.ParseDuration(sc.WakeWait); err != nil {
+			return fmt.Errorf("invalid wake-wait: %w", err)
+		} else if w.wait <= 0 {
+			return fmt.Errorf("wake-wait must be positive")
+		}
+	}
+	sc.waker = w
+	return nil
+}
+
+// magicPacket returns the Wake-on-LAN magic packet for the MAC: 6 0xFF bytes
+// followed by the MAC 16 times.
+func magicPacket(mac net.HardwareAddr) []byte {
+	pkt := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		pkt = append(pkt, 0xFF)
+	}
+	for i := 0; i < 16; i++ {
+		pkt = append(pkt, mac...)
+	}
+	return pkt
+}
+
+// Wake sends a magic packet unless one was sent recently, returning whether
+// one was sent.
+func (w *waker) Wake() (bool, error) {
+	now := time.Now().UnixNano()
+	last := w.lastSent.Load()
+	if now-last < int64(wakeResendInterval) || !w.lastSent.CompareAndSwap(last, now) {
+		return false, nil
+	}
+	conn, err := net.Dial("udp", w.addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = conn.Write(magicPacket(w.mac))
+	return err == nil, err
+}
+
+// dialWaking wakes the server after dialing the backends fails and redials
+// until one succeeds or the wait is over.
+func (bp *backendPool) dialWaking(w *waker) (net.Conn, string, error) {
+	conn, addr, err := bp.Dial()
+	if err == nil {
+		return conn, addr, nil
+	}
+	if sent, err := w.Wake(); err != nil {
+		log.Printf("Error sending Wake-on-LAN packet to %s: %v", w.mac, err)
+	} else if sent {
+		log.Printf("Waking %s, waiting up to %s", w.mac, w.wait)
+	}
+	deadline := time.Now().Add(w.wait)
+	for time.Now().Before(deadline) {
+		time.Sleep(wakeDialInterval)
+		if conn, addr, err = bp.Dial(); err == nil {
+			return conn, addr, nil
+		}
+	}
+	return nil, "", err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMagicPacket(t *testing.T) {
+	mac, _ := net.ParseMAC("01:23:45:67:89:ab")
+	pkt := magicPacket(mac)
+	if len(pkt) != 6+16*6 {
+		t.Fatalf("expected 102 bytes, got %d", len(pkt))
+	} else if !bytes.Equal(pkt[:6], bytes.Repeat([]byte{0xFF}, 6)) {
+		t.Fatalf("expected 6 0xFF bytes first, got %x", pkt[:6])
+	} else if !bytes.Equal(pkt[6:], bytes.Repeat(mac, 16)) {
+		t.Fatal("expected the MAC repeated 16 times")
+	}
+}
+
+func TestParseWake(t *testing.T) {
+	tests := []struct {
+		sc   TunnelServiceConfig
+		ok   bool
+		addr string
+		wait time.Duration
+	}{
+		{sc: TunnelServiceConfig{}, ok: true},
+		{
+			sc: TunnelServiceConfig{WakeMAC: "01:23:45:67:89:ab"}, ok: true,
+			addr: defaultWakeAddr, wait: defaultWakeWait,
+		},
+		{
+			sc: TunnelServiceConfig{
+				WakeMAC: "01:23:45:67:89:ab", WakeAddr: "192.0.2.255:7",
+				WakeWait: "2m",
+			},
+			ok: true, addr: "192.0.2.255:7", wait: 2 * time.Minute,
+		},
+		{sc: TunnelServiceConfig{WakeMAC: "not-a-mac"}},
+		{sc: TunnelServiceConfig{WakeMAC: "01:23:45:67:89:ab", WakeWait: "x"}},
+		{sc: TunnelServiceConfig{WakeMAC: "01:23:45:67:89:ab", WakeWait: "0s"}},
+	}
+	for i, tt := range tests {
+		err := tt.sc.parseWake()
+		if (err == nil) != tt.ok {
+			t.Fatalf("%d: expected ok %v, got error %v", i, tt.ok, err)
+		} else if !tt.ok {
+			continue
+		}
+		w := tt.sc.waker
+		if tt.addr == "" {
+			if w != nil {
+				t.Fatalf("%d: expected no waker without a MAC", i)
+			}
+			continue
+		}
+		if w.addr != tt.addr || w.wait != tt.wait {
+			t.Fatalf(
+				"%d: expected %s and %s, got %s and %s",
+				i, tt.addr, tt.wait, w.addr, w.wait,
+			)
+		}
+	}
+}
+
+// wakeListener listens for magic packets, returning the waker sending to it
+// and a channel receiving the packets.
+func wakeListener(t *testing.T, wait time.Duration) (*waker, <-chan []byte) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	pkts := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pkts <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	mac, _ := net.ParseMAC("01:23:45:67:89:ab")
+	return &waker{mac: mac, addr: pc.LocalAddr().String(), wait: wait}, pkts
+}
+
+func TestWakerWake(t *testing.T) {
+	w, pkts := wakeListener(t, time.Second)
+	if sent, err := w.Wake(); err != nil {
+		t.Fatal("error waking: ", err)
+	} else if !sent {
+		t.Fatal("expected a magic packet to be sent")
+	}
+	select {
+	case pkt := <-pkts:
+		if !bytes.Equal(pkt, magicPacket(w.mac)) {
+			t.Fatalf("expected the magic packet, got %x", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the magic packet to be received")
+	}
+	// Packets aren't resent within the resend interval
+	if sent, err := w.Wake(); err != nil || sent {
+		t.Fatalf("expected no packet to be resent, got %v, %v", sent, err)
+	}
+}
+
+func TestDialWaking(t *testing.T) {
+	w, pkts := wakeListener(t, 3*time.Second)
+	addr := deadAddr(t)
+	// "Wake" the backend once the magic packet is received
+	go func() {
+		<-pkts
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { ln.Close() })
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	bp := newBackendPool([]string{addr}, nil)
+	conn, got, err := bp.dialWaking(w)
+	if err != nil {
+		t.Fatal("expected the woken backend to be dialed, got ", err)
+	}
+	conn.Close()
+	if got != addr {
+		t.Fatalf("expected %s, got %s", addr, got)
+	}
+
+	// Gives up once the wait is over
+	w, _ = wakeListener(t, time.Second)
+	bp = newBackendPool([]string{deadAddr(t)}, nil)
+	if conn, _, err := bp.dialWaking(w); err == nil {
+		conn.Close()
+		t.Fatal("expected an error for a backend that never wakes")
+	}
+}
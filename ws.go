@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is appended to the client's key to compute the accept key (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// listenWS listens for WebSocket clients of the service, bridging the
+// messages they send and receive to and from the service's tunnel conns.
+// The listener is served until it's closed.
+func listenWS(svc *service, ln net.Listener) {
+	srvr := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !clientAllowed(addrFromString(r.RemoteAddr)) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if !svc.config().wsOriginAllowed(r.Header.Get("Origin")) {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			waitForMemory()
+			conn, err := upgradeWS(w, r)
+			if err != nil {
+				log.Printf(
+					"Error upgrading WebSocket client %s: %v",
+					logAddr(addrFromString(r.RemoteAddr)), err,
+				)
+				return
+			}
+			svc.acceptClient(conn)
+		}),
+		ReadHeaderTimeout: idleTimeout,
+	}
+	if err := srvr.Serve(ln); !isClosedErr(err) {
+		log.Fatal("Error serving WebSocket clients: ", err)
+	}
+}
+
+// wsOriginAllowed returns whether a WebSocket client from the given origin is
+// allowed.
+func (sc *ServiceConfig) wsOriginAllowed(origin string) bool {
+	if len(sc.WSOrigins) == 0 {
+		return true
+	}
+	return containsStr(sc.WSOrigins, origin)
+}
+
+// addrFromString returns the TCP address for the string (or an empty one if
+// it's invalid).
+func addrFromString(s string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// headerHasToken returns whether the comma-separated header has the token
+// (case-insensitive).
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWS completes the WebSocket handshake, returning the WebSocket conn.
+func upgradeWS(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "Expected WebSocket upgrade", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported version")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't upgrade", http.StatusInternalServerError)
+		return nil, fmt.Errorf("can't hijack conn")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// websockify-style clients (e.g., noVNC) ask for the binary subprotocol
+	protoHeader := ""
+	if headerHasToken(r.Header, "Sec-WebSocket-Protocol", "binary") {
+		protoHeader = "Sec-WebSocket-Protocol: binary\r\n"
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) +
+		"\r\n" + protoHeader + "\r\n"
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, br: rw.Reader}, nil
+}
+
+// wsConn is a WebSocket conn whose messages are read and written as a byte
+// stream. Writes are sent as binary messages.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+	// client is whether this is the client's side, which masks the frames it
+	// sends rather than those it receives.
+	client bool
+	// left is the number of payload bytes left in the current frame.
+	left    uint64
+	mask    [4]byte
+	maskPos int
+	wmtx    sync.Mutex
+	closed  bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.br.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= c.mask[c.maskPos]
+		c.maskPos = (c.maskPos + 1) % 4
+	}
+	c.left -= uint64(n)
+	return n, err
+}
+
+// readHeader reads the next data frame's header, handling any control frames
+// before it.
+func (c *wsConn) readHeader() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	op, masked := hdr[0]&0x0F, hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if masked == c.client {
+		if c.client {
+			return errors.New("received masked frame from server")
+		}
+		return errors.New("received unmasked frame from client")
+	}
+	c.mask = [4]byte{}
+	if masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.left = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > 125 {
+			return errors.New("control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i%4]
+		}
+		if op == wsOpPing {
+			return c.writeFrame(wsOpPong, payload)
+		} else if op == wsOpClose {
+			// Echo the status code (if any) back
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsOpClose, payload)
+			return io.EOF
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown opcode %d", op)
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes a single frame, masked if this is the client's side.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	hdr := make([]byte, 2, 14)
+	hdr[0] = 0x80 | op
+	switch n := len(payload); {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		hdr[1] |= 0x80
+		hdr = append(hdr, mask[:]...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ mask[i%4]
+		}
+		payload = masked
+	}
+	_, err := (&net.Buffers{hdr, payload}).WriteTo(c.Conn)
+	if op == wsOpClose {
+		c.closed = true
+	}
+	return err
+}
+
+// Close sends a close frame (if one wasn't already) and closes the conn.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying conn.
+func (c *wsConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/johnietre/tunnel-proxy/tunnelit"
+	"github.com/johnietre/utils/go"
+)
+
+// newWSPair returns the client and server sides of an in-memory WebSocket
+// conn.
+func newWSPair(t *testing.T) (client, server *wsConn) {
+	t.Helper()
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	client = &wsConn{Conn: c, br: bufio.NewReader(c), client: true}
+	server = &wsConn{Conn: s, br: bufio.NewReader(s)}
+	return client, server
+}
+
+func TestWSConnFrames(t *testing.T) {
+	client, server := newWSPair(t)
+	// Payloads with each of the length encodings
+	for _, n := range []int{5, 300, 70000} {
+		msg := bytes.Repeat([]byte{'x'}, n)
+		go client.Write(msg)
+		got := make([]byte, n)
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatalf("%d: error reading from client: %v", n, err)
+		} else if !bytes.Equal(got, msg) {
+			t.Fatalf("%d: expected the message unmasked", n)
+		}
+		go server.Write(msg)
+		if _, err := io.ReadFull(client, got); err != nil {
+			t.Fatalf("%d: error reading from server: %v", n, err)
+		} else if !bytes.Equal(got, msg) {
+			t.Fatalf("%d: expected the message", n)
+		}
+	}
+
+	// Pings are answered with pongs, which are skipped
+	go func() {
+		client.writeFrame(wsOpPing, []byte("hi"))
+		client.Write([]byte("after"))
+	}()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(client, make([]byte, 5))
+		readErr <- err
+	}()
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "after" {
+		t.Fatalf("expected the message after the ping, got %q, %v", got, err)
+	}
+	go server.Write([]byte("reply"))
+	if err := <-readErr; err != nil {
+		t.Fatal("expected the pong to be skipped, got ", err)
+	}
+
+	// Closes are echoed and end reads
+	go client.Close()
+	if _, err := server.Read(got); err != io.EOF {
+		t.Fatal("expected EOF after a close frame, got ", err)
+	}
+	if _, err := server.Write([]byte("x")); err != net.ErrClosed {
+		t.Fatal("expected writes after closing to fail, got ", err)
+	}
+}
+
+func TestWSConnRequiresMasking(t *testing.T) {
+	client, server := newWSPair(t)
+	// A client that doesn't mask its frames
+	client.client = false
+	go client.Write([]byte("hi"))
+	if _, err := server.Read(make([]byte, 2)); err == nil {
+		t.Fatal("expected an error for an unmasked client frame")
+	}
+}
+
+func TestListenWS(t *testing.T) {
+	oldReadyCh := readyCh
+	readyCh = make(chan utils.Unit, 10)
+	t.Cleanup(func() { readyCh = oldReadyCh })
+	sc := &ServiceConfig{WSOrigins: []string{"https://example.com"}}
+	if err := sc.parseSchedule(); err != nil {
+		t.Fatal("error parsing schedule: ", err)
+	}
+	svc := newService("svc", sc)
+	svc.idle.setPolicy(&tunnelit.RoundRobin{})
+	putFakeTunnelConn(t, svc, "a", connReady)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	go listenWS(svc, ln)
+
+	// upgrade sends the RFC 6455 example handshake from the origin.
+	upgrade := func(origin string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("error dialing: ", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req := "GET / HTTP/1.1\r\nHost: example.com\r\n" +
+			"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+			"Sec-WebSocket-Version: 13\r\nOrigin: " + origin + "\r\n\r\n"
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal("error writing upgrade: ", err)
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal("error reading upgrade response: ", err)
+		}
+		return conn, br, resp
+	}
+
+	conn, _, resp := upgrade("https://evil.example")
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf(
+			"expected a disallowed origin to be forbidden, got %s", resp.Status,
+		)
+	}
+
+	conn, br, resp := upgrade("https://example.com")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the upgrade to succeed, got %s", resp.Status)
+	} else if got := resp.Header.Get("Sec-WebSocket-Accept"); got !=
+		"s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("expected the RFC 6455 accept key, got %s", got)
+	}
+	// The tunnel conn echoes the client's messages
+	ws := &wsConn{Conn: conn, br: br, client: true}
+	if _, err := ws.Write([]byte("ping")); err != nil {
+		t.Fatal("error writing: ", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(ws, got); err != nil || string(got) != "ping" {
+		t.Fatalf("expected the message echoed, got %q, %v", got, err)
+	}
+}
+
+func TestHeaderHasToken(t *testing.T) {
+	h := http.Header{}
+	h.Add("Connection", "keep-alive, Upgrade")
+	if !headerHasToken(h, "Connection", "upgrade") {
+		t.Fatal("expected the token to be found case-insensitively")
+	} else if headerHasToken(h, "Connection", "close") {
+		t.Fatal("expected a missing token not to be found")
+	}
+}
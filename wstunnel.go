@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Tunnels behind networks that only allow outbound HTTP(S), possibly through
+// an HTTP proxy, can connect over a WebSocket (paddr ws://host/path or
+// wss://host/path). The proxy serves the endpoint on tunnel-ws-addr (over TLS
+// if "tls" is enabled), and the usual handshake and piping happen inside the
+// WebSocket stream.
+
+var (
+	// tunnelWSAddr is the address the proxy serves the WebSocket endpoint for
+	// tunnels on (blank means none).
+	tunnelWSAddr string
+	// tunnelWSPath is the path of the WebSocket endpoint for tunnels.
+	tunnelWSPath = "/"
+)
+
+// isWSURL returns whether the proxy address is a WebSocket URL.
+func isWSURL(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// tunnelListener accepts tunnels from the proxy's listener along with those
+// upgraded on the WebSocket endpoint (if any).
+type tunnelListener struct {
+	net.Listener
+	conns chan net.Conn
+	errs  chan error
+}
+
+func newTunnelListener(ln net.Listener) *tunnelListener {
+	l := &tunnelListener{
+		Listener: ln,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				l.errs <- err
+				return
+			}
+			l.conns <- conn
+		}
+	}()
+	return l
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+// serveWS serves the WebSocket endpoint for tunnels on the address, handing
+// the upgraded conns to the listener's Accept. Since the conns are upgraded
+// over HTTP, their addresses are those of the last hop (e.g., a reverse proxy
+// in front of the endpoint).
+func (l *tunnelListener) serveWS(addr string) error {
+	ln, err := listenLink(addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	log.Print("Listening for WebSocket tunnels on ", ln.Addr())
+	srvr := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != tunnelWSPath {
+				http.NotFound(w, r)
+				return
+			}
+			conn, err := upgradeWS(w, r)
+			if err != nil {
+				log.Printf(
+					"Error upgrading WebSocket tunnel %s: %v",
+					logAddr(addrFromString(r.RemoteAddr)), err,
+				)
+				return
+			}
+			l.conns <- conn
+		}),
+		ReadHeaderTimeout: idleTimeout,
+	}
+	go func() {
+		if err := srvr.Serve(ln); !isClosedErr(err) {
+			log.Fatal("Error serving WebSocket tunnels: ", err)
+		}
+	}()
+	return nil
+}
+
+// dialWS connects to the proxy's WebSocket endpoint at the URL, through the
+// HTTP proxy from the environment (HTTPS_PROXY, HTTP_PROXY, and NO_PROXY), if
+// any.
+func dialWS(rawURL string) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host, useTLS := u.Host, u.Scheme == "wss"
+	if u.Port() == "" {
+		if useTLS {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	// The HTTP proxy is picked by the scheme of the equivalent HTTP URL
+	httpURL := *u
+	httpURL.Scheme = "http"
+	if useTLS {
+		httpURL.Scheme = "https"
+	}
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: &httpURL})
+	if err != nil {
+		return nil, fmt.Errorf("error getting HTTP proxy: %w", err)
+	}
+	var conn net.Conn
+	if proxyURL == nil {
+		conn, err = linkDialer().Dial(tcpNetwork, host)
+	} else {
+		conn, err = dialHTTPProxy(proxyURL, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+	if useTLS {
+		cfg := tlsSettings.apply(&tls.Config{})
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	wc, err := wsClientHandshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return wc, nil
+}
+
+// dialHTTPProxy connects to the address through the HTTP proxy with CONNECT.
+func dialHTTPProxy(proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyHost := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyHost = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyHost = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := linkDialer().Dial(tcpNetwork, proxyHost)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to HTTP proxy: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+	if proxyURL.Scheme == "https" {
+		tc := tls.Client(conn, tlsSettings.apply(&tls.Config{
+			ServerName: proxyURL.Hostname(),
+		}))
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error connecting to HTTP proxy: %w", err)
+		}
+		conn = tc
+	}
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user := proxyURL.User; user != nil {
+		pwd, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString(
+			[]byte(user.Username() + ":" + pwd),
+		)
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error writing CONNECT to HTTP proxy: %w", err)
+	}
+	// Nothing is sent after the response until the tunnel speaks, so the
+	// reader's buffer can be dropped
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy refused CONNECT: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// wsClientHandshake upgrades the conn to the WebSocket at the URL.
+func wsClientHandshake(conn net.Conn, u *url.URL) (*wsConn, error) {
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	req := "GET " + u.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, fmt.Errorf("error writing WebSocket upgrade: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WebSocket upgrade: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, fmt.Errorf("WebSocket upgrade refused: %s", resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	if resp.Header.Get("Sec-WebSocket-Accept") != accept {
+		return nil, fmt.Errorf("WebSocket upgrade has invalid accept key")
+	}
+	return &wsConn{Conn: conn, br: br, client: true}, nil
+}
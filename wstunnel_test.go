@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestIsWSURL(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"ws://example.com/tunnel":  true,
+		"wss://example.com/tunnel": true,
+		"example.com:8000":         false,
+		"https://example.com":      false,
+	} {
+		if got := isWSURL(addr); got != want {
+			t.Fatalf("%s: expected %v", addr, want)
+		}
+	}
+}
+
+func TestTunnelListenerWS(t *testing.T) {
+	oldTLSConfig, oldPath := tlsConfig, tunnelWSPath
+	tlsConfig, tunnelWSPath = nil, "/tunnel"
+	t.Cleanup(func() { tlsConfig, tunnelWSPath = oldTLSConfig, oldPath })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	defer ln.Close()
+	l := newTunnelListener(ln)
+	logs := captureLog(t)
+	if err := l.serveWS("127.0.0.1:0"); err != nil {
+		t.Fatal("error serving WebSocket: ", err)
+	}
+	m := regexp.MustCompile(`WebSocket tunnels on (\S+)`).
+		FindStringSubmatch(logs.String())
+	if m == nil {
+		t.Fatalf("expected the WebSocket address logged, got %q", logs)
+	}
+	wsAddr := m[1]
+
+	// Tunnels are accepted from both the listener and the endpoint
+	accept := func() net.Conn {
+		t.Helper()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := l.Accept()
+			accepted <- conn
+		}()
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out accepting")
+		}
+		return nil
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("error dialing: ", err)
+	}
+	conn.Close()
+	accept().Close()
+
+	conn, err = dialWS("ws://" + wsAddr + "/tunnel")
+	if err != nil {
+		t.Fatal("error dialing WebSocket: ", err)
+	}
+	defer conn.Close()
+	srvrConn := accept()
+	defer srvrConn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	srvrConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(srvrConn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("expected ping through the WebSocket, got %q, %v", b, err)
+	}
+	go srvrConn.Write([]byte("pong"))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "pong" {
+		t.Fatalf("expected pong through the WebSocket, got %q, %v", b, err)
+	}
+
+	if _, err := dialWS("ws://" + wsAddr + "/other"); err == nil {
+		t.Fatal("expected an error upgrading on another path")
+	}
+}
+
+// startConnectProxy starts an HTTP proxy handling a single CONNECT, echoing
+// what's sent through it if it's accepted, and returning its URL and the
+// CONNECT request.
+func startConnectProxy(
+	t *testing.T, status int,
+) (*url.URL, <-chan *http.Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening: ", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	reqs := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		reqs <- req
+		resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+		resp.Write(conn)
+		if status == http.StatusOK {
+			io.Copy(conn, br)
+		}
+	}()
+	return &url.URL{
+		Scheme: "http", User: url.UserPassword("user", "pass"),
+		Host: ln.Addr().String(),
+	}, reqs
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	proxyURL, reqs := startConnectProxy(t, http.StatusOK)
+	conn, err := dialHTTPProxy(proxyURL, "example.com:443")
+	if err != nil {
+		t.Fatal("error dialing through proxy: ", err)
+	}
+	defer conn.Close()
+	req := <-reqs
+	wantAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if req.Method != http.MethodConnect || req.Host != "example.com:443" {
+		t.Fatalf(
+			"expected CONNECT example.com:443, got %s %s", req.Method, req.Host,
+		)
+	} else if got := req.Header.Get("Proxy-Authorization"); got != wantAuth {
+		t.Fatalf("expected the proxy credentials, got %q", got)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("expected ping through the proxy, got %q, %v", b, err)
+	}
+
+	proxyURL, _ = startConnectProxy(t, http.StatusProxyAuthRequired)
+	if _, err := dialHTTPProxy(proxyURL, "example.com:443"); err == nil {
+		t.Fatal("expected an error for a refused CONNECT")
+	}
+}